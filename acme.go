@@ -0,0 +1,749 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCA_ACME        = ".webca.acme"
+	ACME_PREFIX       = "/acme/"
+	ACME_DEFAULT_DAYS = 90
+	ACME_ORDER_LIFE   = 7 * 24 * time.Hour
+	ACME_TIMEOUT      = 10 * time.Second
+	ACME_MAX_NONCES   = 10000
+	ACME_MAX_BODY     = 1 << 16
+)
+
+// ACME object status values (RFC 8555 section 7.1.6)
+const (
+	ACME_PENDING    = "pending"
+	ACME_PROCESSING = "processing"
+	ACME_READY      = "ready"
+	ACME_VALID      = "valid"
+	ACME_INVALID    = "invalid"
+)
+
+// ACME configures the ACME server
+type ACME struct {
+	CA      string // name of the CA issuing the certificates
+	Profile string // issuance profile, if any
+	Days    int    // certificate validity, the profile one (or ACME_DEFAULT_DAYS) if 0
+}
+
+// acmeIdentifier is a name a certificate is ordered for
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// acmeAccount is an ACME client registration, identified by its key thumbprint
+type acmeAccount struct {
+	ID      string
+	Key     JWK
+	Contact []string
+	Status  string
+}
+
+// acmeOrder is a request for a certificate
+type acmeOrder struct {
+	ID          string
+	Account     string
+	Status      string
+	Expires     time.Time
+	Identifiers []acmeIdentifier
+	Authzs      []string
+	Cert        string // issued certificate name
+	Serial      string // issued certificate serial
+}
+
+// acmeAuthz is the authorization of an account for an identifier
+type acmeAuthz struct {
+	ID         string
+	Account    string
+	Status     string
+	Expires    time.Time
+	Identifier acmeIdentifier
+	Wildcard   bool
+	Challenges []acmeChallenge
+}
+
+// acmeChallenge is a way to prove the control of an identifier
+type acmeChallenge struct {
+	ID        string
+	Type      string // http-01 or dns-01
+	Token     string
+	Status    string
+	Validated time.Time
+	Error     string
+}
+
+// acmeState is all the ACME server persistent state
+type acmeState struct {
+	Accounts map[string]*acmeAccount
+	Orders   map[string]*acmeOrder
+	Authzs   map[string]*acmeAuthz
+}
+
+// acmeProblem is an ACME error (RFC 8555 section 6.7)
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+// acme is the ACME state, loaded on first use
+var acme *acmeState
+
+// ACME state lock
+var sacme sync.Mutex
+
+// nonces not used yet
+var nonces = make(map[string]bool)
+
+// nonces lock
+var snonces sync.Mutex
+
+// acmeHTTPGet fetches an http-01 challenge response (replaceable for testing)
+var acmeHTTPGet = func(url string) ([]byte, error) {
+	client := &http.Client{Timeout: ACME_TIMEOUT}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, res.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+}
+
+// acmeLookupTXT resolves a dns-01 challenge record (replaceable for testing)
+var acmeLookupTXT = net.LookupTXT
+
+// newProblem returns an ACME problem of the given type
+func newProblem(status int, kind, detail string) *acmeProblem {
+	return &acmeProblem{"urn:ietf:params:acme:error:" + kind, detail, status}
+}
+
+// acmeHandler serves the ACME protocol under ACME_PREFIX (no login, clients sign their requests)
+func acmeHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	base := acmeBase(r)
+	w.Header().Set("Replay-Nonce", newNonce())
+	w.Header().Set("Link", "<"+base+"directory>;rel=\"index\"")
+	if cfg == nil || cfg.ACME == nil {
+		acmeFail(w, newProblem(http.StatusNotFound, "malformed", tr("ACME is not enabled")))
+		return
+	}
+	route := strings.TrimPrefix(r.URL.Path, ACME_PREFIX)
+	switch route {
+	case "directory":
+		acmeReply(w, http.StatusOK, map[string]interface{}{
+			"newNonce":   base + "new-nonce",
+			"newAccount": base + "new-account",
+			"newOrder":   base + "new-order",
+			"revokeCert": base + "revoke-cert",
+			"meta":       map[string]interface{}{"externalAccountRequired": false},
+		})
+		return
+	case "new-nonce":
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	if r.Method != "POST" {
+		acmeFail(w, newProblem(http.StatusMethodNotAllowed, "malformed", tr("ACME requests must be POST")))
+		return
+	}
+	sacme.Lock()
+	defer sacme.Unlock()
+	state, err := loadACME()
+	if err != nil {
+		acmeFail(w, newProblem(http.StatusInternalServerError, "serverInternal", err.Error()))
+		return
+	}
+	acct, payload, problem := state.verify(r, base, route == "new-account")
+	if problem == nil {
+		problem = state.route(w, cfg.ACME, base, route, acct, payload, remoteAddr(r))
+	}
+	if problem != nil {
+		acmeFail(w, problem)
+	}
+}
+
+// verify checks the request JWS and returns its signing account (or a new one for new-account)
+// and payload
+func (state *acmeState) verify(r *http.Request, base string, newAccount bool) (*acmeAccount, []byte, *acmeProblem) {
+	var jws JWS
+	if err := json.NewDecoder(io.LimitReader(r.Body, ACME_MAX_BODY)).Decode(&jws); err != nil {
+		return nil, nil, newProblem(http.StatusBadRequest, "malformed", tr("Wrong JWS: %s", err))
+	}
+	h, err := jws.Header()
+	if err != nil {
+		return nil, nil, newProblem(http.StatusBadRequest, "malformed", tr("Wrong JWS header: %s", err))
+	}
+	if !useNonce(h.Nonce) {
+		return nil, nil, newProblem(http.StatusBadRequest, "badNonce", tr("Unknown or used nonce"))
+	}
+	if h.URL != base+strings.TrimPrefix(r.URL.Path, ACME_PREFIX) {
+		return nil, nil, newProblem(http.StatusUnauthorized, "unauthorized", tr("Wrong JWS url"))
+	}
+	var acct *acmeAccount
+	if newAccount {
+		var jwk JWK
+		if len(h.JWK) == 0 || json.Unmarshal(h.JWK, &jwk) != nil {
+			return nil, nil, newProblem(http.StatusBadRequest, "malformed", tr("A JWK is required"))
+		}
+		acct = state.Accounts[jwk.Thumbprint()]
+		if acct == nil {
+			acct = &acmeAccount{ID: jwk.Thumbprint(), Key: jwk, Status: ACME_VALID}
+		}
+	} else {
+		acct = state.Accounts[strings.TrimPrefix(h.KID, base+"acct/")]
+		if acct == nil {
+			return nil, nil, newProblem(http.StatusBadRequest, "accountDoesNotExist", tr("Unknown account"))
+		}
+		if acct.Status != ACME_VALID {
+			return nil, nil, newProblem(http.StatusUnauthorized, "unauthorized", tr("Account is %s", acct.Status))
+		}
+	}
+	key, err := acct.Key.PublicKey()
+	if err != nil {
+		return nil, nil, newProblem(http.StatusBadRequest, "badPublicKey", err.Error())
+	}
+	payload, err := jws.Verify(h.Alg, key)
+	if err != nil {
+		return nil, nil, newProblem(http.StatusBadRequest, "malformed", err.Error())
+	}
+	return acct, payload, nil
+}
+
+// route runs the signed request on the state
+func (state *acmeState) route(w http.ResponseWriter, cfg *ACME, base, route string,
+	acct *acmeAccount, payload []byte, addr string) *acmeProblem {
+	parts := strings.SplitN(route, "/", 3)
+	switch {
+	case route == "new-account":
+		return state.newAccount(w, base, acct, payload)
+	case route == "new-order":
+		return state.newOrder(w, base, acct, payload)
+	case route == "revoke-cert":
+		return state.revoke(w, acct, payload, addr)
+	case len(parts) == 2 && parts[0] == "acct" && parts[1] == acct.ID:
+		return state.updateAccount(w, base, acct, payload)
+	case len(parts) >= 2 && parts[0] == "order":
+		o := state.Orders[parts[1]]
+		if o == nil || o.Account != acct.ID {
+			return newProblem(http.StatusNotFound, "malformed", tr("Unknown order"))
+		}
+		if len(parts) == 3 && parts[2] == "finalize" {
+			return state.finalize(w, cfg, base, o, payload, addr)
+		}
+		acmeReply(w, http.StatusOK, state.orderJSON(base, o))
+	case len(parts) == 2 && parts[0] == "authz":
+		a := state.Authzs[parts[1]]
+		if a == nil || a.Account != acct.ID {
+			return newProblem(http.StatusNotFound, "malformed", tr("Unknown authorization"))
+		}
+		acmeReply(w, http.StatusOK, authzJSON(base, a))
+	case len(parts) == 2 && parts[0] == "chall":
+		a, ch := state.findChallenge(parts[1])
+		if ch == nil || a.Account != acct.ID {
+			return newProblem(http.StatusNotFound, "malformed", tr("Unknown challenge"))
+		}
+		return state.validate(w, base, acct, a, ch, payload)
+	case len(parts) == 2 && parts[0] == "cert":
+		o := state.Orders[parts[1]]
+		if o == nil || o.Account != acct.ID || o.Status != ACME_VALID {
+			return newProblem(http.StatusNotFound, "malformed", tr("Unknown certificate"))
+		}
+		c := FindCert(o.Cert)
+		if c == nil || serialKey(c.Crt.SerialNumber) != o.Serial {
+			return newProblem(http.StatusNotFound, "malformed", tr("The certificate was replaced"))
+		}
+		data, _ := FullChainPEM(c, false)
+		w.Header().Set("Content-type", "application/pem-certificate-chain")
+		w.Write(data)
+	default:
+		return newProblem(http.StatusNotFound, "malformed", tr("Unknown ACME resource"))
+	}
+	return nil
+}
+
+// newAccount registers an account, or finds the existing one for the key
+func (state *acmeState) newAccount(w http.ResponseWriter, base string, acct *acmeAccount, payload []byte) *acmeProblem {
+	var req struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", err.Error())
+	}
+	w.Header().Set("Location", base+"acct/"+acct.ID)
+	if state.Accounts[acct.ID] != nil {
+		acmeReply(w, http.StatusOK, accountJSON(acct))
+		return nil
+	}
+	if req.OnlyReturnExisting {
+		return newProblem(http.StatusBadRequest, "accountDoesNotExist", tr("Unknown account"))
+	}
+	acct.Contact = req.Contact
+	state.Accounts[acct.ID] = acct
+	if err := state.save(); err != nil {
+		return newProblem(http.StatusInternalServerError, "serverInternal", err.Error())
+	}
+	acmeReply(w, http.StatusCreated, accountJSON(acct))
+	return nil
+}
+
+// updateAccount changes the account contacts or deactivates it
+func (state *acmeState) updateAccount(w http.ResponseWriter, base string, acct *acmeAccount, payload []byte) *acmeProblem {
+	if len(payload) > 0 {
+		var req struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return newProblem(http.StatusBadRequest, "malformed", err.Error())
+		}
+		if req.Contact != nil {
+			acct.Contact = req.Contact
+		}
+		if req.Status == "deactivated" {
+			acct.Status = req.Status
+		}
+		if err := state.save(); err != nil {
+			return newProblem(http.StatusInternalServerError, "serverInternal", err.Error())
+		}
+	}
+	w.Header().Set("Location", base+"acct/"+acct.ID)
+	acmeReply(w, http.StatusOK, accountJSON(acct))
+	return nil
+}
+
+// newOrder creates an order with an authorization for each identifier
+func (state *acmeState) newOrder(w http.ResponseWriter, base string, acct *acmeAccount, payload []byte) *acmeProblem {
+	var req struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) == 0 {
+		return newProblem(http.StatusBadRequest, "malformed", tr("Identifiers are required"))
+	}
+	o := &acmeOrder{ID: acmeID(), Account: acct.ID, Status: ACME_PENDING,
+		Expires: time.Now().Add(ACME_ORDER_LIFE).UTC()}
+	for _, id := range req.Identifiers {
+		id.Value = strings.ToLower(strings.TrimSuffix(id.Value, "."))
+		if id.Type != "dns" || !validHostname(strings.TrimPrefix(id.Value, "*.")) {
+			return newProblem(http.StatusBadRequest, "rejectedIdentifier", tr("Unsupported identifier %s", id.Value))
+		}
+		o.Identifiers = append(o.Identifiers, id)
+		a := &acmeAuthz{ID: acmeID(), Account: acct.ID, Status: ACME_PENDING, Expires: o.Expires,
+			Identifier: acmeIdentifier{"dns", strings.TrimPrefix(id.Value, "*.")},
+			Wildcard:   strings.HasPrefix(id.Value, "*.")}
+		types := []string{"http-01", "dns-01"}
+		if a.Wildcard {
+			types = types[1:]
+		}
+		for _, t := range types {
+			a.Challenges = append(a.Challenges, acmeChallenge{ID: acmeID(), Type: t, Token: acmeID(),
+				Status: ACME_PENDING})
+		}
+		state.Authzs[a.ID] = a
+		o.Authzs = append(o.Authzs, a.ID)
+	}
+	state.Orders[o.ID] = o
+	if err := state.save(); err != nil {
+		return newProblem(http.StatusInternalServerError, "serverInternal", err.Error())
+	}
+	w.Header().Set("Location", base+"order/"+o.ID)
+	acmeReply(w, http.StatusCreated, state.orderJSON(base, o))
+	return nil
+}
+
+// validHostname tells whether or not the name is a DNS host name: letter, digit and hyphen labels,
+// without port, path nor IP address
+func validHostname(name string) bool {
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	top := labels[len(labels)-1]
+	return strings.Trim(top, "0123456789") != "" // not a number, as the last part of an address
+}
+
+// validate checks the challenge response and updates the authorization and orders accordingly.
+// The check is done without the state lock (the caller holds sacme), so that slow responders
+// don't hold up the other clients; the challenge is processing meanwhile
+func (state *acmeState) validate(w http.ResponseWriter, base string, acct *acmeAccount, a *acmeAuthz,
+	ch *acmeChallenge, payload []byte) *acmeProblem {
+	if len(payload) > 0 && ch.Status == ACME_PENDING && a.Status == ACME_PENDING {
+		keyAuth := ch.Token + "." + acct.Key.Thumbprint()
+		ch.Status = ACME_PROCESSING
+		domain, token, http01 := a.Identifier.Value, ch.Token, ch.Type == "http-01"
+		sacme.Unlock()
+		var err error
+		if http01 {
+			err = checkHTTP01(domain, token, keyAuth)
+		} else {
+			err = checkDNS01(domain, keyAuth)
+		}
+		sacme.Lock()
+		if err != nil {
+			ch.Status, ch.Error, a.Status = ACME_INVALID, err.Error(), ACME_INVALID
+		} else {
+			ch.Status, ch.Validated, a.Status = ACME_VALID, time.Now().UTC(), ACME_VALID
+		}
+		state.updateOrders()
+		if err := state.save(); err != nil {
+			return newProblem(http.StatusInternalServerError, "serverInternal", err.Error())
+		}
+	}
+	w.Header().Add("Link", "<"+base+"authz/"+a.ID+">;rel=\"up\"")
+	acmeReply(w, http.StatusOK, challengeJSON(base, ch))
+	return nil
+}
+
+// checkHTTP01 verifies the http-01 challenge response
+func checkHTTP01(domain, token, keyAuth string) error {
+	url := "http://" + domain + "/.well-known/acme-challenge/" + token
+	body, err := acmeHTTPGet(url)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("%s", tr("Wrong key authorization at %s", url))
+	}
+	return nil
+}
+
+// checkDNS01 verifies the dns-01 challenge TXT record
+func checkDNS01(domain, keyAuth string) error {
+	name := "_acme-challenge." + domain
+	txts, err := acmeLookupTXT(name)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	for _, txt := range txts {
+		if txt == b64(sum[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s", tr("No matching TXT record at %s", name))
+}
+
+// updateOrders sets the pending orders ready (or invalid) from their authorizations status
+func (state *acmeState) updateOrders() {
+	for _, o := range state.Orders {
+		if o.Status != ACME_PENDING {
+			continue
+		}
+		ready := true
+		for _, id := range o.Authzs {
+			switch state.Authzs[id].Status {
+			case ACME_INVALID:
+				o.Status = ACME_INVALID
+			case ACME_PENDING:
+				ready = false
+			}
+		}
+		if ready && o.Status == ACME_PENDING {
+			o.Status = ACME_READY
+		}
+	}
+}
+
+// finalize issues the certificate of a ready order for the CSR
+func (state *acmeState) finalize(w http.ResponseWriter, cfg *ACME, base string, o *acmeOrder, payload []byte,
+	addr string) *acmeProblem {
+	if o.Status != ACME_READY {
+		return newProblem(http.StatusForbidden, "orderNotReady", tr("The order is %s", o.Status))
+	}
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", err.Error())
+	}
+	der, err := unb64(req.CSR)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR", err.Error())
+	}
+	csr, err := ParseCSR(der)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR", err.Error())
+	}
+	if err := o.checkCSR(csr); err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR", err.Error())
+	}
+	c, err := acmeIssue(cfg, csr)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "serverInternal", err.Error())
+	}
+	o.Status, o.Cert, o.Serial = ACME_VALID, c.Crt.Subject.CommonName, serialKey(c.Crt.SerialNumber)
+	if err := state.save(); err != nil {
+		return newProblem(http.StatusInternalServerError, "serverInternal", err.Error())
+	}
+	audit(AUDIT_ISSUE, "acme:"+o.Account, addr, certObject(c.Crt))
+	w.Header().Set("Location", base+"order/"+o.ID)
+	acmeReply(w, http.StatusOK, state.orderJSON(base, o))
+	return nil
+}
+
+// checkCSR verifies the CSR asks for exactly the order identifiers, and names it after the
+// first one if it has no common name
+func (o *acmeOrder) checkCSR(csr *x509.CertificateRequest) error {
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return fmt.Errorf("%s", tr("Only DNS names can be requested"))
+	}
+	names := make(map[string]bool)
+	for _, dns := range csr.DNSNames {
+		names[strings.ToLower(dns)] = true
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" {
+		names[cn] = true
+	}
+	ordered := make(map[string]bool)
+	for _, id := range o.Identifiers {
+		ordered[id.Value] = true
+	}
+	if len(names) != len(ordered) {
+		return fmt.Errorf("%s", tr("The CSR names don't match the order"))
+	}
+	for name := range names {
+		if !ordered[name] {
+			return fmt.Errorf("%s", tr("The CSR names don't match the order"))
+		}
+	}
+	if csr.Subject.CommonName == "" {
+		csr.Subject.CommonName = o.Identifiers[0].Value
+	}
+	return nil
+}
+
+// acmeIssue signs the CSR with the ACME CA
+func acmeIssue(cfg *ACME, csr *x509.CertificateRequest) (*Cert, error) {
+	ca, err := findIssuer(cfg.CA)
+	if err != nil {
+		return nil, err
+	}
+	prof := LoadConfig().getProfile(cfg.Profile)
+	days := cfg.Days
+	if days <= 0 && (prof == nil || prof.Duration <= 0) {
+		days = ACME_DEFAULT_DAYS
+	}
+	period, err := requestPeriod(days, prof)
+	if err != nil {
+		return nil, err
+	}
+	return ReplaceCSR(ca, csr, period, prof)
+}
+
+// revoke revokes a certificate issued to the account
+func (state *acmeState) revoke(w http.ResponseWriter, acct *acmeAccount, payload []byte, addr string) *acmeProblem {
+	var req struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", err.Error())
+	}
+	der, err := unb64(req.Certificate)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", err.Error())
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", err.Error())
+	}
+	serial := serialKey(crt.SerialNumber)
+	for _, o := range state.Orders {
+		if o.Account != acct.ID || o.Serial != serial {
+			continue
+		}
+		c := FindCert(o.Cert)
+		if c == nil || serialKey(c.Crt.SerialNumber) != serial {
+			break
+		}
+		if err := RevokeCert(c, req.Reason); err != nil {
+			return newProblem(http.StatusBadRequest, "alreadyRevoked", err.Error())
+		}
+		audit(AUDIT_REVOKE, "acme:"+acct.ID, addr, certObject(c.Crt))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	return newProblem(http.StatusForbidden, "unauthorized", tr("The certificate was not issued to this account"))
+}
+
+// findChallenge returns the challenge with the given id and its authorization
+func (state *acmeState) findChallenge(id string) (*acmeAuthz, *acmeChallenge) {
+	for _, a := range state.Authzs {
+		for i := range a.Challenges {
+			if a.Challenges[i].ID == id {
+				return a, &a.Challenges[i]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// accountJSON returns the ACME account object
+func accountJSON(acct *acmeAccount) interface{} {
+	return map[string]interface{}{"status": acct.Status, "contact": acct.Contact}
+}
+
+// orderJSON returns the ACME order object
+func (state *acmeState) orderJSON(base string, o *acmeOrder) interface{} {
+	authzs := make([]string, 0, len(o.Authzs))
+	for _, id := range o.Authzs {
+		authzs = append(authzs, base+"authz/"+id)
+	}
+	order := map[string]interface{}{
+		"status":         o.Status,
+		"expires":        o.Expires,
+		"identifiers":    o.Identifiers,
+		"authorizations": authzs,
+		"finalize":       base + "order/" + o.ID + "/finalize",
+	}
+	if o.Status == ACME_VALID {
+		order["certificate"] = base + "cert/" + o.ID
+	}
+	return order
+}
+
+// authzJSON returns the ACME authorization object
+func authzJSON(base string, a *acmeAuthz) interface{} {
+	challenges := make([]interface{}, 0, len(a.Challenges))
+	for i := range a.Challenges {
+		challenges = append(challenges, challengeJSON(base, &a.Challenges[i]))
+	}
+	authz := map[string]interface{}{
+		"status":     a.Status,
+		"expires":    a.Expires,
+		"identifier": a.Identifier,
+		"challenges": challenges,
+	}
+	if a.Wildcard {
+		authz["wildcard"] = true
+	}
+	return authz
+}
+
+// challengeJSON returns the ACME challenge object
+func challengeJSON(base string, ch *acmeChallenge) interface{} {
+	challenge := map[string]interface{}{
+		"type":   ch.Type,
+		"url":    base + "chall/" + ch.ID,
+		"status": ch.Status,
+		"token":  ch.Token,
+	}
+	if !ch.Validated.IsZero() {
+		challenge["validated"] = ch.Validated
+	}
+	if ch.Error != "" {
+		challenge["error"] = newProblem(http.StatusForbidden, "incorrectResponse", ch.Error)
+	}
+	return challenge
+}
+
+// acmeReply sends v as the JSON response with the given status
+func acmeReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// acmeFail sends the problem as the response
+func acmeFail(w http.ResponseWriter, p *acmeProblem) {
+	w.Header().Set("Content-type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// acmeBase returns the ACME URLs prefix as seen by the client
+func acmeBase(r *http.Request) string {
+	return webBase(r) + ACME_PREFIX
+}
+
+// acmeID returns a new random identifier
+func acmeID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return b64(id)
+}
+
+// newNonce returns a new single use nonce
+func newNonce() string {
+	snonces.Lock()
+	defer snonces.Unlock()
+	if len(nonces) >= ACME_MAX_NONCES { // forget them all rather than growing forever
+		nonces = make(map[string]bool)
+	}
+	nonce := acmeID()
+	nonces[nonce] = true
+	return nonce
+}
+
+// useNonce consumes the nonce, telling whether or not it was valid
+func useNonce(nonce string) bool {
+	snonces.Lock()
+	defer snonces.Unlock()
+	if !nonces[nonce] {
+		return false
+	}
+	delete(nonces, nonce)
+	return true
+}
+
+// loadACME returns the ACME state, reading it from the storage if needed (the caller must hold sacme)
+func loadACME() (*acmeState, error) {
+	if acme != nil {
+		return acme, nil
+	}
+	state := &acmeState{make(map[string]*acmeAccount), make(map[string]*acmeOrder), make(map[string]*acmeAuthz)}
+	if err := loadGob(WEBCA_ACME, state); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	acme = state
+	return acme, nil
+}
+
+// save stores the ACME state, forgetting the expired orders (the caller must hold sacme)
+func (state *acmeState) save() error {
+	now := time.Now()
+	for id, o := range state.Orders {
+		if o.Expires.Before(now) {
+			for _, a := range o.Authzs {
+				delete(state.Authzs, a)
+			}
+			delete(state.Orders, id)
+		}
+	}
+	return saveGob(WEBCA_ACME, state)
+}
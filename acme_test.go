@@ -0,0 +1,152 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACME(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{ACME: &ACME{CA: "ACMECA", Days: 30}}
+	acme = nil
+	defer func() { acme = nil }()
+	_, err := GenCACert(pkix.Name{CommonName: "ACMECA"}, ForDays(365))
+	dieOnError(t, err)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	jwk, _ := json.Marshal(JWK{Kty: "EC", Crv: "P-256",
+		X: b64(key.X.FillBytes(make([]byte, 32))), Y: b64(key.Y.FillBytes(make([]byte, 32)))})
+	base := "http://example.com" + ACME_PREFIX
+	nonce := ""
+	kid := ""
+	post := func(url string, payload interface{}, status int, v interface{}) http.Header {
+		h := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": base + url}
+		if kid == "" {
+			h["jwk"] = json.RawMessage(jwk)
+		} else {
+			h["kid"] = kid
+		}
+		protected, _ := json.Marshal(h)
+		body := ""
+		if payload != nil {
+			data, _ := json.Marshal(payload)
+			body = b64(data)
+		}
+		sum := sha256.Sum256([]byte(b64(protected) + "." + body))
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		dieOnError(t, err)
+		sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		jws, _ := json.Marshal(JWS{b64(protected), body, b64(sig)})
+		w := httptest.NewRecorder()
+		acmeHandler(w, httptest.NewRequest("POST", base+url, bytes.NewReader(jws)))
+		if w.Code != status {
+			t.Fatalf("POST %s -> %d (expected %d): %s", url, w.Code, status, w.Body)
+		}
+		nonce = w.Header().Get("Replay-Nonce")
+		if v != nil {
+			dieOnError(t, json.Unmarshal(w.Body.Bytes(), v))
+		}
+		return w.Header()
+	}
+	w := httptest.NewRecorder()
+	acmeHandler(w, httptest.NewRequest("HEAD", base+"new-nonce", nil))
+	post("new-account", map[string]interface{}{}, http.StatusBadRequest, nil) // no nonce yet
+	post("new-account", map[string]interface{}{"termsOfServiceAgreed": true}, http.StatusCreated, nil)
+	kid = post("new-account", map[string]interface{}{}, http.StatusOK, nil).Get("Location")
+	var order struct {
+		Status         string
+		Authorizations []string
+		Finalize       string
+		Certificate    string
+	}
+	for _, wrong := range []string{"10.0.0.5:8080/x?", "10.0.0.5", "::1", "a..example.com", "-a.example.com",
+		"a_b.example.com", "*.*.example.com", "example.123", ""} {
+		post("new-order", map[string]interface{}{"identifiers": []acmeIdentifier{{"dns", wrong}}},
+			http.StatusBadRequest, nil)
+	}
+	loc := post("new-order", map[string]interface{}{"identifiers": []acmeIdentifier{
+		{"dns", "acme.example.com"}, {"dns", "*.acme.example.com"}}}, http.StatusCreated, &order).Get("Location")
+	if order.Status != ACME_PENDING || len(order.Authorizations) != 2 {
+		t.Fatalf("Unexpected order %v", order)
+	}
+	thumbprint := strings.TrimPrefix(kid, base+"acct/")
+	defer func(get func(string) ([]byte, error), lookup func(string) ([]string, error)) {
+		acmeHTTPGet, acmeLookupTXT = get, lookup
+	}(acmeHTTPGet, acmeLookupTXT)
+	acmeHTTPGet = func(url string) ([]byte, error) {
+		if !sacme.TryLock() {
+			t.Error("ACME state locked during the challenge check")
+		} else {
+			sacme.Unlock()
+		}
+		token := url[strings.LastIndex(url, "/")+1:]
+		return []byte(token + "." + thumbprint), nil
+	}
+	acmeLookupTXT = func(name string) ([]string, error) { return nil, nil }
+	for _, authz := range order.Authorizations {
+		var a struct {
+			Wildcard   bool
+			Challenges []struct{ Type, URL, Status string }
+		}
+		post(strings.TrimPrefix(authz, base), nil, http.StatusOK, &a)
+		var ch struct{ Status string }
+		post(strings.TrimPrefix(a.Challenges[0].URL, base), map[string]interface{}{}, http.StatusOK, &ch)
+		if a.Wildcard && (len(a.Challenges) != 1 || ch.Status != ACME_INVALID) {
+			t.Fatalf("Wildcard validated without a TXT record: %v", a)
+		} else if !a.Wildcard && ch.Status != ACME_VALID {
+			t.Fatalf("http-01 challenge not validated: %v", ch)
+		}
+	}
+	post(strings.TrimPrefix(loc, base), nil, http.StatusOK, &order)
+	if order.Status != ACME_INVALID {
+		t.Fatalf("Order with a failed challenge is %s", order.Status)
+	}
+	loc = post("new-order", map[string]interface{}{"identifiers": []acmeIdentifier{{"dns", "acme.example.com"}}},
+		http.StatusCreated, &order).Get("Location")
+	var a struct {
+		Challenges []struct{ Type, URL, Token string }
+	}
+	post(strings.TrimPrefix(order.Authorizations[0], base), nil, http.StatusOK, &a)
+	acmeLookupTXT = func(name string) ([]string, error) {
+		sum := sha256.Sum256([]byte(a.Challenges[1].Token + "." + thumbprint))
+		if name != "_acme-challenge.acme.example.com" {
+			return nil, nil
+		}
+		return []string{b64(sum[:])}, nil
+	}
+	post(strings.TrimPrefix(a.Challenges[1].URL, base), map[string]interface{}{}, http.StatusOK, nil)
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{"other.example.com"}}, certKey)
+	dieOnError(t, err)
+	post(strings.TrimPrefix(order.Finalize, base), map[string]string{"csr": b64(der)}, http.StatusBadRequest, nil)
+	der, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{"acme.example.com"}}, certKey)
+	dieOnError(t, err)
+	post(strings.TrimPrefix(order.Finalize, base), map[string]string{"csr": b64(der)}, http.StatusOK, &order)
+	if order.Status != ACME_VALID || order.Certificate == "" {
+		t.Fatalf("Unexpected finalized order %v", order)
+	}
+	c := FindCert("acme.example.com")
+	if c == nil || c.Parent != FindCert("ACMECA") || c.Crt.NotAfter.Sub(c.Crt.NotBefore) > 31*24*time.Hour {
+		t.Fatal("ACME certificate not issued properly")
+	}
+	post(strings.TrimPrefix(order.Certificate, base), nil, http.StatusOK, nil)
+	post("revoke-cert", map[string]interface{}{"certificate": b64(c.Crt.Raw)}, http.StatusOK, nil)
+	if Revoked(c) == nil {
+		t.Fatal("ACME certificate not revoked")
+	}
+}
@@ -0,0 +1,539 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	API_PREFIX   = "/api/v1/"
+	API_MAX_BODY = 1 << 20
+)
+
+// CertInfo is the JSON representation of a certificate on the API
+type CertInfo struct {
+	Name        string      `json:"name"`
+	Serial      string      `json:"serial"`
+	Issuer      string      `json:"issuer"`
+	IsCA        bool        `json:"isCA"`
+	NotBefore   time.Time   `json:"notBefore"`
+	NotAfter    time.Time   `json:"notAfter"`
+	SANs        []string    `json:"sans"`
+	Fingerprint string      `json:"fingerprint"`
+	HasKey      bool        `json:"hasKey"`
+	Revoked     *Revocation `json:"revoked,omitempty"`
+	PEM         string      `json:"pem,omitempty"`
+	Key         string      `json:"key,omitempty"` // only when issued with noStoredKey, never again
+}
+
+// CertList is a page of certificates on the API
+type CertList struct {
+	Certs []CertInfo `json:"certs"`
+	Page  int        `json:"page"`
+	Pages int        `json:"pages"`
+	Total int        `json:"total"`
+}
+
+// IssueRequest asks the API for a new certificate, or a new root CA when there is no parent
+type IssueRequest struct {
+	Name               string   `json:"name"`
+	Parent             string   `json:"parent"`
+	SANs               []string `json:"sans"`
+	Days               int      `json:"days"`
+	Profile            string   `json:"profile"`
+	Organization       string   `json:"organization"`
+	OrganizationalUnit string   `json:"organizationalUnit"`
+	Country            string   `json:"country"`
+	Province           string   `json:"province"`
+	Locality           string   `json:"locality"`
+	NoStoredKey        bool     `json:"noStoredKey"` // return the generated key once instead of storing it
+}
+
+// SignRequest asks the API to issue a certificate for a PKCS#10 request
+type SignRequest struct {
+	Parent  string `json:"parent"`
+	CSR     string `json:"csr"` // PEM
+	Days    int    `json:"days"`
+	Profile string `json:"profile"`
+}
+
+// RenewRequest asks the API to renew a certificate
+type RenewRequest struct {
+	Rekey bool `json:"rekey"`
+}
+
+// RevokeRequest asks the API to revoke a certificate
+type RevokeRequest struct {
+	Reason int `json:"reason"`
+}
+
+// apiError is the body of the failed API calls
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// newCertInfo returns the API representation of c, with its PEM if withPEM is set
+func newCertInfo(c *Cert, withPEM bool) CertInfo {
+	ci := CertInfo{
+		Name:        c.Crt.Subject.CommonName,
+		Serial:      serialKey(c.Crt.SerialNumber),
+		Issuer:      c.Crt.Issuer.CommonName,
+		IsCA:        c.Crt.IsCA,
+		NotBefore:   c.Crt.NotBefore,
+		NotAfter:    c.Crt.NotAfter,
+		SANs:        SANs(c.Crt),
+		Fingerprint: Fingerprint(c.Crt),
+		HasKey:      c.Key != nil,
+		Revoked:     Revoked(c),
+	}
+	if withPEM {
+		ci.PEM = string(pemCerts(c.Crt))
+	}
+	return ci
+}
+
+// apiAccess invokes the API handler h ONLY IF a valid Bearer token is given or we are logged in,
+// otherwise fails with 401, and the user has the role of the call, otherwise fails with 403
+func apiAccess(h func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := bearerToken(r); token != "" {
+			if LoadConfig().tokenUser(token) == nil {
+				apiFail(w, http.StatusUnauthorized, fmt.Errorf("%s", tr("Invalid API token!")))
+				return
+			}
+			if apiAllowed(w, r, apiRole(r)) {
+				apiOrg(h, w, r)
+			}
+			return
+		}
+		s, err := SessionFor(w, r)
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, err)
+			return
+		}
+		if u, ok := s[LOGGEDUSER].(User); (!ok || !LoadConfig().activeUser(u.Username)) && !fakedLogin {
+			apiFail(w, http.StatusUnauthorized, fmt.Errorf("%s", tr("Authentication required!")))
+			return
+		}
+		if apiAllowed(w, r, apiRole(r)) {
+			apiOrg(h, w, r)
+		}
+	})
+}
+
+// apiOrg serves the API call with h if orgControl allows it, otherwise fails with a 403
+func apiOrg(h func(w http.ResponseWriter, r *http.Request), w http.ResponseWriter, r *http.Request) {
+	r, err := orgControl(w, r)
+	if err != nil {
+		apiFail(w, http.StatusForbidden, err)
+		return
+	}
+	h(w, r)
+}
+
+// apiRole returns the role needed for the API call: viewers can only read, CAs and users are for
+// admins
+func apiRole(r *http.Request) string {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/"), "/")
+	if parts[0] == "users" || parts[0] == "backup" || parts[0] == "settings" {
+		return ROLE_ADMIN
+	}
+	if r.Method == "GET" {
+		return ROLE_VIEWER
+	}
+	if parts[0] == "cas" {
+		return ROLE_ADMIN
+	}
+	if len(parts) > 1 && parts[0] == "certs" {
+		if c := FindCert(parts[1]); c != nil && c.Crt.IsCA {
+			return ROLE_ADMIN
+		}
+	}
+	return ROLE_OPERATOR
+}
+
+// apiAllowed tells whether or not the API caller has the role, failing with a 403 if not
+func apiAllowed(w http.ResponseWriter, r *http.Request, role string) bool {
+	if u := requestUser(w, r); u != nil && u.can(role) {
+		return true
+	}
+	apiFail(w, http.StatusForbidden, fmt.Errorf("%s", tr("Access Denied")))
+	return false
+}
+
+// apiReply sends v as the JSON response with the given status
+func apiReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// apiFail sends err as a JSON error response with the given status
+func apiFail(w http.ResponseWriter, status int, err error) {
+	apiReply(w, status, apiError{err.Error()})
+}
+
+// apiRead decodes the JSON request body into v (an empty body leaves v untouched)
+func apiRead(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, API_MAX_BODY)).Decode(v)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %s", tr("Wrong JSON request"), err)
+	}
+	return nil
+}
+
+// api dispatches the /api/v1/ calls:
+//
+//	GET    certs                  list certificates (same filters and paging as the index)
+//	POST   certs                  issue a certificate (IssueRequest), replying its key if not stored
+//	POST   sign                   issue a certificate for a CSR (SignRequest)
+//	GET    certs/<name>           get a certificate with its PEM
+//	GET    certs/by-fingerprint/<sha256>  get the certificate with the SHA-256 fingerprint, with its PEM
+//	DELETE certs/<name>           delete a certificate
+//	POST   certs/<name>/renew     renew a certificate (RenewRequest)
+//	POST   certs/<name>/revoke    revoke a certificate (RevokeRequest), or put it on hold (reason 6)
+//	POST   certs/<name>/unhold    reinstate a certificate on hold
+//	POST   certs/<name>/link      create a one-time download link of a certificate and its key (LinkRequest)
+//	GET    cas                    list the CAs
+//	POST   cas                    create a root CA (IssueRequest with no parent)
+//	GET    users                  list the users
+//	POST   users                  create a user (UserRequest)
+//	GET    users/<name>           get a user
+//	PUT    users/<name>           update a user (UserRequest)
+//	DELETE users/<name>           delete a user
+//	POST   backup                 download the encrypted backup of the CA (BackupRequest)
+//	GET    settings               get the mailer, web certificate and general settings (SettingsRequest)
+//	PUT    settings               change the settings given (SettingsRequest)
+func api(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/"), "/")
+	route := r.Method + " " + parts[0]
+	if len(parts) > 1 {
+		route += "/*"
+	}
+	if len(parts) > 2 {
+		route += "/" + strings.Join(parts[2:], "/")
+	}
+	if len(parts) == 3 && parts[0] == "certs" && parts[1] == "by-fingerprint" {
+		route = r.Method + " certs/by-fingerprint/*"
+	}
+	switch route {
+	case "GET certs":
+		if serial := r.URL.Query().Get("serial"); serial != "" {
+			apiCertBySerial(w, r, serial)
+			return
+		}
+		apiListCerts(w, r)
+	case "POST certs":
+		apiIssue(w, r, false)
+	case "POST sign":
+		apiSign(w, r)
+	case "GET cas":
+		cas := make([]CertInfo, 0)
+		for _, c := range visibleCerts(requestOrg(r), Authorities()) {
+			cas = append(cas, newCertInfo(c, false))
+		}
+		apiReply(w, http.StatusOK, cas)
+	case "POST cas":
+		apiIssue(w, r, true)
+	case "GET certs/by-fingerprint/*":
+		if !sha256Hex.MatchString(fingerprintKey(parts[2])) {
+			apiFail(w, http.StatusBadRequest, fmt.Errorf("%s: %v", tr("Wrong SHA-256 fingerprint!"), parts[2]))
+			return
+		}
+		c := FindCertByFingerprint(parts[2])
+		if c == nil || !LoadConfig().visibleIn(requestOrg(r), c) {
+			apiFail(w, http.StatusNotFound, fmt.Errorf("%s", tr("No certificate with fingerprint %s!", parts[2])))
+			return
+		}
+		apiReply(w, http.StatusOK, newCertInfo(c, true))
+	case "GET certs/*", "DELETE certs/*", "POST certs/*/renew", "POST certs/*/revoke", "POST certs/*/unhold",
+		"POST certs/*/link":
+		c := FindCert(parts[1])
+		if c == nil || len(c.Crt.Raw) == 0 {
+			apiFail(w, http.StatusNotFound, fmt.Errorf("%s", tr("%v certificate not found!", parts[1])))
+			return
+		}
+		apiCert(w, r, c, route)
+	case "GET users", "POST users", "GET users/*", "PUT users/*", "DELETE users/*":
+		username := ""
+		if len(parts) > 1 {
+			username = parts[1]
+		}
+		apiUsers(w, r, route, username)
+	case "POST backup":
+		apiBackup(w, r)
+	case "GET settings", "PUT settings":
+		apiSettings(w, r)
+	default:
+		apiFail(w, http.StatusNotFound, fmt.Errorf("%s", tr("Unknown API call %s %s", r.Method, r.URL.Path)))
+	}
+}
+
+// apiListCerts lists a page of the certificates matching the filter
+func apiListCerts(w http.ResponseWriter, r *http.Request) {
+	f, err := readCertFilter(r)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	number, size := readPaging(r)
+	apiReply(w, http.StatusOK, listCerts(f, number, size))
+}
+
+// apiCertBySerial replies the certificate with the serial number, in hexadecimal with or without
+// separators, if the organization of the caller can see it
+func apiCertBySerial(w http.ResponseWriter, r *http.Request, serial string) {
+	n, ok := new(big.Int).SetString(cleanSerial(serial), 16)
+	if !ok || n.Sign() <= 0 {
+		apiFail(w, http.StatusBadRequest, fmt.Errorf("%s: %v", tr("Wrong serial number!"), serial))
+		return
+	}
+	c := FindCertBySerial(n)
+	if c == nil || !LoadConfig().visibleIn(requestOrg(r), c) {
+		apiFail(w, http.StatusNotFound, fmt.Errorf("%s", tr("No certificate with serial %s!", serial)))
+		return
+	}
+	apiReply(w, http.StatusOK, newCertInfo(c, true))
+}
+
+// listCerts returns a page of the certificates matching the filter
+func listCerts(f CertFilter, number, size int) CertList {
+	page := PageCerts(f, number, size)
+	list := CertList{Certs: make([]CertInfo, 0), Page: page.Number, Pages: page.Pages(), Total: page.Total}
+	for _, c := range page.Certs {
+		list.Certs = append(list.Certs, newCertInfo(c, false))
+	}
+	return list
+}
+
+// apiIssue issues a certificate, or a root CA if ca is set
+func apiIssue(w http.ResponseWriter, r *http.Request, ca bool) {
+	var req IssueRequest
+	if err := apiRead(r, &req); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if orgHides(r, req.Parent) {
+		apiFail(w, http.StatusBadRequest, fmt.Errorf("%s", tr("%v CA not found!", req.Parent)))
+		return
+	}
+	c, status, err := issueRequest(req, ca)
+	if err == nil && ca {
+		if err = LoadConfig().assignCA(requestOrg(r), c.Crt.Subject.CommonName); err != nil {
+			status = http.StatusInternalServerError
+		}
+	}
+	if u := requestUser(w, r); err == nil && u != nil {
+		if err = LoadConfig().setOwner(c.Crt.Subject.CommonName, u.Username); err != nil {
+			status = http.StatusInternalServerError
+		}
+	}
+	if err != nil {
+		apiFail(w, status, err)
+		return
+	}
+	auditRequest(w, r, AUDIT_ISSUE, certObject(c.Crt))
+	info := newCertInfo(c, true)
+	if req.NoStoredKey {
+		block, err := marshalKey(c.Key)
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, err)
+			return
+		}
+		info.Key, info.HasKey = string(pem.EncodeToMemory(block)), false
+		auditRequest(w, r, AUDIT_KEY_DOWNLOAD, certObject(c.Crt)+" not stored")
+	}
+	apiReply(w, status, info)
+}
+
+// apiSign issues a certificate for a CSR
+func apiSign(w http.ResponseWriter, r *http.Request) {
+	var req SignRequest
+	if err := apiRead(r, &req); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if orgHides(r, req.Parent) {
+		apiFail(w, http.StatusBadRequest, fmt.Errorf("%s", tr("%v CA not found!", req.Parent)))
+		return
+	}
+	c, status, err := signRequest(req)
+	if err != nil {
+		apiFail(w, status, err)
+		return
+	}
+	auditRequest(w, r, AUDIT_ISSUE, certObject(c.Crt))
+	apiReply(w, status, newCertInfo(c, true))
+}
+
+// issueRequest issues the requested certificate, or a root CA if ca is set, returning
+// the HTTP status describing the outcome. The key of a certificate issued with NoStoredKey is
+// only in the one returned
+func issueRequest(req IssueRequest, ca bool) (*Cert, int, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("%s", tr("Can't create a certificate with no name!"))
+	}
+	if FindCert(req.Name) != nil {
+		return nil, http.StatusConflict, fmt.Errorf("%s", tr("Certificate %s already exists!", req.Name))
+	}
+	var parent *Cert
+	var name pkix.Name
+	if ca {
+		name = pkix.Name{
+			Organization:       []string{req.Organization},
+			OrganizationalUnit: []string{req.OrganizationalUnit},
+			Country:            []string{req.Country},
+			Province:           []string{req.Province},
+			Locality:           []string{req.Locality},
+		}
+	} else {
+		var err error
+		if parent, err = findIssuer(req.Parent); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		name = copyName(parent.Crt.Subject)
+	}
+	name.CommonName = req.Name
+	prof := LoadConfig().getProfile(req.Profile)
+	period, err := requestPeriod(req.Days, prof)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if req.NoStoredKey {
+		c, key, err := IssueCertOnce(parent, name, period, prof, req.SANs...)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		c.Key = key // only in memory
+		return c, http.StatusCreated, nil
+	}
+	c, err := IssueCert(parent, name, period, prof, req.SANs...)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return c, http.StatusCreated, nil
+}
+
+// signRequest issues a certificate for the requested CSR, returning the HTTP status
+// describing the outcome
+func signRequest(req SignRequest) (*Cert, int, error) {
+	parent, err := findIssuer(req.Parent)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	csr, err := ParseCSR([]byte(req.CSR))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if FindCert(csr.Subject.CommonName) != nil {
+		return nil, http.StatusConflict, fmt.Errorf("%s", tr("Certificate %s already exists!", csr.Subject.CommonName))
+	}
+	prof := LoadConfig().getProfile(req.Profile)
+	period, err := requestPeriod(req.Days, prof)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	c, err := SignCSR(parent, csr, period, prof)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return c, http.StatusCreated, nil
+}
+
+// findIssuer returns the named CA, if it can sign certificates
+func findIssuer(name string) (*Cert, error) {
+	parent := FindCert(name)
+	if parent == nil || parent.Key == nil || !parent.Crt.IsCA {
+		return nil, fmt.Errorf("%s", tr("%v CA not found!", name))
+	}
+	return parent, nil
+}
+
+// requestPeriod returns the validity for the requested days or, if none, the profile duration
+func requestPeriod(days int, prof *Profile) (Period, error) {
+	cs := &CertSetup{Duration: days, Unit: DAYS}
+	if days <= 0 && prof != nil {
+		cs.Duration, cs.Unit = prof.Duration, prof.Unit
+	}
+	return cs.Period()
+}
+
+// apiCert runs the route on the certificate c
+func apiCert(w http.ResponseWriter, r *http.Request, c *Cert, route string) {
+	switch route {
+	case "GET certs/*":
+		apiReply(w, http.StatusOK, newCertInfo(c, true))
+	case "DELETE certs/*":
+		if len(c.Childs) > 0 {
+			apiFail(w, http.StatusConflict, fmt.Errorf("%s", tr("Can't delete Certificate with Children Certificates")))
+			return
+		}
+		if !DeleteCert(c) {
+			apiFail(w, http.StatusInternalServerError,
+				fmt.Errorf("%s", tr("Failed to delete %s!", c.Crt.Subject.CommonName)))
+			return
+		}
+		auditRequest(w, r, AUDIT_DELETE, certObject(c.Crt))
+		w.WriteHeader(http.StatusNoContent)
+	case "POST certs/*/renew":
+		var req RenewRequest
+		if err := apiRead(r, &req); err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		renewed, err := RenewCert(c, req.Rekey)
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, err)
+			return
+		}
+		auditRequest(w, r, AUDIT_RENEW, certObject(renewed.Crt))
+		apiReply(w, http.StatusOK, newCertInfo(renewed, true))
+	case "POST certs/*/revoke":
+		var req RevokeRequest
+		if err := apiRead(r, &req); err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := RevokeCert(c, req.Reason); err != nil {
+			apiFail(w, http.StatusConflict, err)
+			return
+		}
+		auditRequest(w, r, AUDIT_REVOKE, revokedObject(c, req.Reason))
+		apiReply(w, http.StatusOK, newCertInfo(c, false))
+	case "POST certs/*/unhold":
+		if err := UnholdCert(c); err != nil {
+			apiFail(w, http.StatusConflict, err)
+			return
+		}
+		auditRequest(w, r, AUDIT_UNHOLD, certObject(c.Crt))
+		apiReply(w, http.StatusOK, newCertInfo(c, false))
+	case "POST certs/*/link":
+		if u := requestUser(w, r); u == nil || !u.ownsKey(c.Crt.Subject.CommonName) {
+			apiFail(w, http.StatusForbidden, fmt.Errorf("%s", tr("Access Denied")))
+			return
+		}
+		var req LinkRequest
+		if err := apiRead(r, &req); err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		token, l, err := LoadConfig().NewDownloadLink(c.Crt.Subject.CommonName, req.Format,
+			requestUser(w, r).Username, req.Hours)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		auditRequest(w, r, AUDIT_CONFIG, "download link "+l.ID+" of "+certObject(c.Crt))
+		apiReply(w, http.StatusCreated, LinkReply{URL: downloadLinkURL(webBase(r), token), Expires: l.Expires})
+	}
+}
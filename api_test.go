@@ -0,0 +1,74 @@
+package webca
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	call := func(method, url, body string, status int, v interface{}) {
+		w := httptest.NewRecorder()
+		api(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		if w.Code != status {
+			t.Fatalf("%s %s -> %d (expected %d): %s", method, url, w.Code, status, w.Body)
+		}
+		if v != nil {
+			dieOnError(t, json.Unmarshal(w.Body.Bytes(), v))
+		}
+	}
+	var ci CertInfo
+	call("POST", "/api/v1/cas", `{"name": "APICA", "organization": "ACME", "days": 365}`, http.StatusCreated, &ci)
+	if !ci.IsCA || !strings.Contains(ci.PEM, "CERTIFICATE") {
+		t.Fatalf("Unexpected CA %v", ci)
+	}
+	call("POST", "/api/v1/certs", `{"name": "api.example.com", "parent": "APICA", "days": 30,
+		"sans": ["api.example.com"]}`, http.StatusCreated, &ci)
+	if ci.Issuer != "APICA" || len(ci.SANs) != 1 {
+		t.Fatalf("Unexpected certificate %v", ci)
+	}
+	call("POST", "/api/v1/certs", `{"name": "api.example.com", "parent": "APICA", "days": 30}`,
+		http.StatusConflict, nil)
+	call("POST", "/api/v1/certs", `{"name": "x", "parent": "nope", "days": 30}`, http.StatusBadRequest, nil)
+	var list CertList
+	call("GET", "/api/v1/certs?Name=api.", "", http.StatusOK, &list)
+	if list.Total != 1 || list.Certs[0].Name != "api.example.com" {
+		t.Fatalf("Unexpected list %v", list)
+	}
+	var cas []CertInfo
+	call("GET", "/api/v1/cas", "", http.StatusOK, &cas)
+	if len(cas) != 1 || cas[0].Name != "APICA" {
+		t.Fatalf("Unexpected CAs %v", cas)
+	}
+	serial := ci.Serial
+	call("POST", "/api/v1/certs/api.example.com/renew", "", http.StatusOK, &ci)
+	if ci.Serial == serial {
+		t.Fatal("Renewed certificate kept the serial")
+	}
+	call("POST", "/api/v1/certs/api.example.com/revoke", `{"reason": 4}`, http.StatusOK, &ci)
+	if ci.Revoked == nil || ci.Revoked.Reason != 4 {
+		t.Fatalf("Certificate not revoked %v", ci)
+	}
+	var found CertInfo
+	fp := strings.ToLower(strings.Replace(ci.Fingerprint, ":", "", -1))
+	call("GET", "/api/v1/certs/by-fingerprint/"+fp, "", http.StatusOK, &found)
+	if found.Name != "api.example.com" || found.Serial != ci.Serial || found.PEM == "" {
+		t.Fatalf("Unexpected certificate by fingerprint %v", found)
+	}
+	call("GET", "/api/v1/certs/by-fingerprint/"+strings.Repeat("00", 32), "", http.StatusNotFound, nil)
+	call("GET", "/api/v1/certs/by-fingerprint/"+fp[:40], "", http.StatusBadRequest, nil)
+	call("GET", "/api/v1/certs?Fingerprint="+url.QueryEscape(ci.Fingerprint), "", http.StatusOK, &list)
+	if list.Total != 1 || list.Certs[0].Name != "api.example.com" {
+		t.Fatalf("Unexpected fingerprint search %v", list)
+	}
+	call("GET", "/api/v1/certs?Fingerprint=zz", "", http.StatusBadRequest, nil)
+	call("DELETE", "/api/v1/certs/APICA", "", http.StatusConflict, nil)
+	call("DELETE", "/api/v1/certs/api.example.com", "", http.StatusNoContent, nil)
+	call("GET", "/api/v1/certs/api.example.com", "", http.StatusNotFound, nil)
+	call("GET", "/api/v1/nothing", "", http.StatusNotFound, nil)
+}
@@ -0,0 +1,106 @@
+package webca
+
+import (
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ARCHIVE_DIR = "old"
+)
+
+// archiveCert keeps a copy of the current certificate (and key) files so that they remain
+// available after being replaced and until they expire
+func archiveCert(cert *Cert) error {
+	err := storage.Tx(func(tx Storage) error {
+		return archiveFiles(tx, cert)
+	})
+	if err != nil {
+		return err
+	}
+	purgeArchive()
+	return nil
+}
+
+// archiveFiles copies the current certificate (and key) files to the archive within the
+// transaction
+func archiveFiles(tx Storage, cert *Cert) error {
+	base := archived(cert)
+	if err := copyFile(tx, certFile(*cert), base+CERT_SUFFIX, false); err != nil {
+		return err
+	}
+	if cert.Key != nil {
+		return copyFile(tx, keyFile(*cert), base+KEY_SUFFIX, true)
+	}
+	return nil
+}
+
+// PreviousCerts returns the archived versions of a certificate that are still valid,
+// the most recent first
+func PreviousCerts(cert *Cert) []*Cert {
+	purgeArchive()
+	prefix := filename(cert.Crt.Subject.CommonName) + "."
+	previous := make([]*Cert, 0)
+	for _, name := range archivedFiles() {
+		if !strings.HasPrefix(name, prefix) || strings.Contains(name[len(prefix):], ".") {
+			continue
+		}
+		crt, err := readCert(path.Join(ARCHIVE_DIR, name))
+		if err != nil {
+			log.Printf("(Warning) %s", err)
+			continue
+		}
+		previous = append(previous, crt)
+	}
+	sort.Slice(previous, func(i, j int) bool {
+		return previous[i].Crt.NotAfter.After(previous[j].Crt.NotAfter)
+	})
+	return previous
+}
+
+// archived returns the archive file path (without suffix) for a certificate
+func archived(cert *Cert) string {
+	return path.Join(ARCHIVE_DIR,
+		filename(cert.Crt.Subject.CommonName)+"."+serialKey(cert.Crt.SerialNumber))
+}
+
+// archivedFiles returns the archived certificate names, without suffixes
+func archivedFiles() []string {
+	files, err := storage.List(ARCHIVE_DIR)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(files))
+	for _, name := range files {
+		if strings.HasSuffix(name, CERT_SUFFIX) && !strings.HasSuffix(name, KEY_SUFFIX) {
+			names = append(names, strings.TrimSuffix(name, CERT_SUFFIX))
+		}
+	}
+	return names
+}
+
+// purgeArchive removes the archived certificates that already expired
+func purgeArchive() {
+	now := time.Now()
+	for _, name := range archivedFiles() {
+		base := path.Join(ARCHIVE_DIR, name)
+		crt, err := readCert(base)
+		if err != nil || crt.Crt.NotAfter.After(now) {
+			continue
+		}
+		storage.Delete(base + CERT_SUFFIX)
+		storage.Delete(base + KEY_SUFFIX)
+	}
+}
+
+// copyFile copies the src file contents into dst, kept secret if so told
+func copyFile(st Storage, src, dst string, secret bool) error {
+	data, err := st.Get(src)
+	if err != nil {
+		return err
+	}
+	return st.Put(dst, data, secret)
+}
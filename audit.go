@@ -0,0 +1,262 @@
+package webca
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCA_AUDIT      = ".webca.audit"       // hash chained JSON lines, only appended to (in a directory)
+	AUDIT_PAGE       = 500                  // entries shown by the audit page
+	AUDIT_MAX_OBJECT = 1024                 // bytes of the object recorded
+	AUDIT_TAIL       = 8 * AUDIT_MAX_OBJECT // bytes read back to find the last entry
+)
+
+const (
+	AUDIT_LOGIN           = "login"
+	AUDIT_LOGIN_FAILED    = "login-failed"
+	AUDIT_LOGOUT          = "logout"
+	AUDIT_LOCKOUT         = "lockout"        // too many failed logins of an account or address
+	AUDIT_LOCKED_OUT      = "login-rejected" // login attempt during a lockout
+	AUDIT_PASSKEY_ADDED   = "passkey-added"
+	AUDIT_PASSKEY_DELETED = "passkey-deleted"
+	AUDIT_ISSUE           = "issue"
+	AUDIT_RENEW           = "renew"
+	AUDIT_REVOKE          = "revoke"
+	AUDIT_UNHOLD          = "unhold"
+	AUDIT_DELETE          = "delete"
+	AUDIT_CROSS           = "cross-sign"
+	AUDIT_KEY_DOWNLOAD    = "key-download"
+	AUDIT_CONFIG          = "config-change"
+	AUDIT_SESSION_REVOKED = "session-revoked"
+	AUDIT_BACKUP          = "backup"
+	AUDIT_RESTORE         = "restore"
+	AUDIT_REQUEST         = "request" // certificate request submitted for approval
+	AUDIT_REJECT          = "reject"  // certificate request rejected
+)
+
+// AuditActions lists the actions of the audit log
+var AuditActions = []string{AUDIT_LOGIN, AUDIT_LOGIN_FAILED, AUDIT_LOGOUT, AUDIT_LOCKOUT, AUDIT_LOCKED_OUT,
+	AUDIT_PASSKEY_ADDED, AUDIT_PASSKEY_DELETED, AUDIT_ISSUE, AUDIT_RENEW, AUDIT_REVOKE, AUDIT_UNHOLD, AUDIT_DELETE,
+	AUDIT_CROSS, AUDIT_KEY_DOWNLOAD, AUDIT_CONFIG, AUDIT_SESSION_REVOKED, AUDIT_BACKUP, AUDIT_RESTORE, AUDIT_REQUEST, AUDIT_REJECT}
+
+// AuditEntry is a record of the audit log, chained to the previous one by its hash so that
+// changing or removing a record breaks the chain
+type AuditEntry struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	User   string    `json:"user"`
+	Addr   string    `json:"addr"`
+	Object string    `json:"object"`
+	Prev   string    `json:"prev"` // hash of the previous entry, empty for the first one
+	Hash   string    `json:"hash"` // hex SHA-256 of the entry without it
+}
+
+// audit log lock
+var saudit sync.Mutex
+
+// audit records a security relevant action of the user from the address on the object
+func audit(action, user, addr, object string) {
+	log.Printf("(Audit) %s user=%q addr=%s %s", action, user, addr, object)
+	if len(object) > AUDIT_MAX_OBJECT {
+		object = object[:AUDIT_MAX_OBJECT]
+	}
+	valid := func(s string) string { // hashed as decoded back from the log
+		return strings.ToValidUTF8(s, "\uFFFD")
+	}
+	e := AuditEntry{Time: time.Now().UTC(), Action: valid(action), User: valid(user), Addr: valid(addr),
+		Object: valid(object)}
+	e, err := appendAudit(e)
+	if err != nil {
+		log.Printf("(Warning) Could not write the audit log: %s", err)
+		return
+	}
+	if cfg := LoadConfig(); cfg != nil {
+		cfg.AuditSinks.ship(e)
+	}
+}
+
+// auditRequest records an action of the user of the request on the object
+func auditRequest(w http.ResponseWriter, r *http.Request, action, object string) {
+	user := ""
+	if u := requestUser(w, r); u != nil {
+		user = u.Username
+	}
+	audit(action, user, remoteAddr(r), object)
+}
+
+// certObject names a certificate in the audit log
+func certObject(crt *x509.Certificate) string {
+	return crt.Subject.CommonName + " " + serialKey(crt.SerialNumber)
+}
+
+// remoteAddr returns the IP address the request comes from
+func remoteAddr(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// digest returns the hash of the entry, computed without its Hash
+func (e AuditEntry) digest() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendAudit chains the entry to the last one of the audit log, appends it and returns it chained
+func appendAudit(e AuditEntry) (AuditEntry, error) {
+	saudit.Lock()
+	defer saudit.Unlock()
+	last, err := storage.LastAudit()
+	if err != nil {
+		return e, err
+	}
+	e.Seq, e.Prev = last.Seq+1, last.Hash
+	e.Hash = e.digest()
+	return e, storage.AppendAudit(e)
+}
+
+// ReadAudit returns all the entries of the audit log, oldest first
+func ReadAudit() ([]AuditEntry, error) {
+	saudit.Lock()
+	defer saudit.Unlock()
+	entries, err := storage.AuditEntries("", "", 0, 0)
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
+
+// filterAudit returns latest first the entries, given oldest first, of the action and user (any if
+// empty), skipping offset of them and keeping limit at most, all if limit <= 0
+func filterAudit(entries []AuditEntry, action, user string, offset, limit int) []AuditEntry {
+	found := make([]AuditEntry, 0)
+	for i := len(entries) - 1; i >= 0 && (limit <= 0 || len(found) < limit); i-- {
+		if (action == "" || entries[i].Action == action) && (user == "" || entries[i].User == user) {
+			if offset > 0 {
+				offset--
+			} else {
+				found = append(found, entries[i])
+			}
+		}
+	}
+	return found
+}
+
+func (d dirStorage) AppendAudit(e AuditEntry) error {
+	return appendJSONLine(d.path(WEBCA_AUDIT), e)
+}
+
+// LastAudit reads the last entry from the end of WEBCA_AUDIT
+func (d dirStorage) LastAudit() (AuditEntry, error) {
+	var last AuditEntry
+	f, err := os.Open(d.path(WEBCA_AUDIT))
+	if os.IsNotExist(err) {
+		return last, nil
+	} else if err != nil {
+		return last, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || size == 0 {
+		return last, err
+	}
+	offset := size - AUDIT_TAIL
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, size-offset)
+	if _, err := f.ReadAt(tail, offset); err != nil {
+		return last, err
+	}
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	if err := json.Unmarshal(lines[len(lines)-1], &last); err != nil {
+		return last, fmt.Errorf("Corrupted audit log %s: %s", WEBCA_AUDIT, err)
+	}
+	return last, nil
+}
+
+// AuditEntries reads the whole WEBCA_AUDIT, the entries up to a corrupted one being returned with
+// the error
+func (d dirStorage) AuditEntries(action, user string, offset, limit int) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+	f, err := os.Open(d.path(WEBCA_AUDIT))
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, AUDIT_TAIL), AUDIT_TAIL)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			err = fmt.Errorf("%s", tr("The audit log is corrupted after entry %d!", len(entries)))
+			return filterAudit(entries, action, user, offset, limit), err
+		}
+		entries = append(entries, e)
+	}
+	return filterAudit(entries, action, user, offset, limit), sc.Err()
+}
+
+// VerifyAudit checks the hash chain of the entries, from the first one, and fails on the first
+// entry that was changed, inserted or removed
+func VerifyAudit(entries []AuditEntry) error {
+	prev := AuditEntry{}
+	for _, e := range entries {
+		if e.Seq != prev.Seq+1 || e.Prev != prev.Hash || e.Hash != e.digest() {
+			return fmt.Errorf("%s", tr("The audit log was tampered with at entry %d!", prev.Seq+1))
+		}
+		prev = e
+	}
+	return nil
+}
+
+// auditLog shows the admins the latest entries of the audit log matching the action and user
+// filters, and whether or not its chain is intact
+func auditLog(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	entries, err := ReadAudit()
+	if err == nil {
+		err = VerifyAudit(entries)
+	}
+	action, user := r.FormValue("action"), strings.TrimSpace(r.FormValue("user"))
+	shown, serr := storage.AuditEntries(action, user, 0, AUDIT_PAGE)
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		ps["Error"] = err.Error()
+	}
+	if len(entries) > 0 {
+		ps["LastHash"] = entries[len(entries)-1].Hash
+	}
+	ps["Entries"] = shown
+	ps["Total"] = len(entries)
+	ps["Actions"] = AuditActions
+	ps["Action"] = action
+	ps["FilterUser"] = user
+	err = templatesFor(r).ExecuteTemplate(w, "audit", ps)
+	handleError(w, r, err)
+}
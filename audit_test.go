@@ -0,0 +1,61 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{}}
+	ca, err := GenCACert(pkix.Name{CommonName: "AuditCA"}, ForDays(365))
+	dieOnError(t, err)
+	c, err := GenCert(ca, "audited", ForDays(30))
+	dieOnError(t, err)
+	audit(AUDIT_LOGIN, "boss", "198.51.100.1", "")
+	audit(AUDIT_LOGIN_FAILED, "bad\xffname", "198.51.100.2", strings.Repeat("x", 2*AUDIT_MAX_OBJECT))
+	req := httptest.NewRequest("POST", "/revoke", strings.NewReader("cert=audited&confirm=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	accessControl(revoke).ServeHTTP(httptest.NewRecorder(), req)
+	entries, err := ReadAudit()
+	dieOnError(t, err)
+	if len(entries) != 3 || entries[2].Action != AUDIT_REVOKE || entries[2].User != "fuser" ||
+		entries[2].Object != certObject(c.Crt) || len(entries[1].Object) != AUDIT_MAX_OBJECT {
+		t.Fatalf("Wrong audit entries: %+v", entries)
+	}
+	dieOnError(t, VerifyAudit(entries))
+	w := httptest.NewRecorder()
+	accessControl(auditLog).ServeHTTP(w, httptest.NewRequest("GET", "/audit?action=revoke", nil))
+	if out := w.Body.String(); !strings.Contains(out, "audited") || strings.Contains(out, "198.51.100.1") {
+		t.Error("The audit page does not show the revocation alone")
+	}
+
+	data, err := ioutil.ReadFile(WEBCA_AUDIT)
+	dieOnError(t, err)
+	lines := strings.SplitAfter(string(data), "\n")
+	for name, tampered := range map[string]string{
+		"changed": strings.Replace(string(data), `"user":"boss"`, `"user":"nobody"`, 1),
+		"removed": lines[0] + lines[2],
+		"dropped": lines[1] + lines[2],
+	} {
+		dieOnError(t, ioutil.WriteFile(WEBCA_AUDIT, []byte(tampered), 0600))
+		entries, err := ReadAudit()
+		dieOnError(t, err)
+		if VerifyAudit(entries) == nil {
+			t.Errorf("An audit log with a %s entry verifies", name)
+		}
+	}
+	dieOnError(t, ioutil.WriteFile(WEBCA_AUDIT, data, 0600))
+	audit(AUDIT_CONFIG, "boss", "198.51.100.1", "settings")
+	entries, err = ReadAudit()
+	dieOnError(t, err)
+	if len(entries) != 4 || VerifyAudit(entries) != nil {
+		t.Error("The audit log is not chained after the last entry")
+	}
+}
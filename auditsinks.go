@@ -0,0 +1,136 @@
+package webca
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SYSLOG_TIMEOUT   = 5 * time.Second
+	SYSLOG_FACILITY  = 10 // authpriv
+	SYSLOG_NOTICE    = 5  // severity of the actions
+	SYSLOG_WARNING   = 4  // severity of the failed or rejected logins
+	SYSLOG_SD_ID     = "webca@32473"
+	SYSLOG_APP_NAME  = "webca"
+	SYSLOG_MSG_ID    = "audit"
+	SYSLOG_UDP       = "udp"
+	SYSLOG_TCP       = "tcp"
+	SYSLOG_MAX_FRAME = 2048 // bytes of a UDP message, the object is cut to fit
+)
+
+// AuditSinks ships a copy of the audit events out of the CA, for SIEM tooling
+type AuditSinks struct {
+	Syslog   string // host:port of an RFC 5424 syslog server, none if empty
+	Network  string // SYSLOG_UDP (default) or SYSLOG_TCP, with octet counting framing
+	JSONFile string // file the entries are appended to as JSON lines, none if empty
+}
+
+// ship sends the entry to the configured sinks, the syslog server in the background
+func (as *AuditSinks) ship(e AuditEntry) {
+	if as == nil {
+		return
+	}
+	if as.JSONFile != "" {
+		if err := appendJSONLine(as.JSONFile, e); err != nil {
+			log.Printf("(Warning) Could not write the audit event to %s: %s", as.JSONFile, err)
+		}
+	}
+	if as.Syslog != "" {
+		go func(network, addr string) {
+			if err := sendSyslog(network, addr, e); err != nil {
+				log.Printf("(Warning) Could not send the audit event to %s: %s", addr, err)
+			}
+		}(as.Network, as.Syslog)
+	}
+}
+
+// appendJSONLine appends the entry to the file as a JSON line
+func appendJSONLine(name string, e AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syslogMessage formats the entry as an RFC 5424 message, with the entry fields as structured data
+// and the object as the message
+func syslogMessage(e AuditEntry) string {
+	severity := SYSLOG_NOTICE
+	switch e.Action {
+	case AUDIT_LOGIN_FAILED, AUDIT_LOCKOUT, AUDIT_LOCKED_OUT:
+		severity = SYSLOG_WARNING
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "-"
+	}
+	param := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	msg := fmt.Sprintf(`<%d>1 %s %s %s - %s [%s seq="%d" action="%s" user="%s" addr="%s" hash="%s"] `,
+		SYSLOG_FACILITY*8+severity, e.Time.UTC().Format(time.RFC3339Nano), host, SYSLOG_APP_NAME,
+		SYSLOG_MSG_ID, SYSLOG_SD_ID, e.Seq, param.Replace(e.Action), param.Replace(e.User),
+		param.Replace(e.Addr), e.Hash)
+	if room := SYSLOG_MAX_FRAME - len(msg); len(e.Object) > room && room >= 0 {
+		e.Object = strings.ToValidUTF8(e.Object[:room], "")
+	}
+	return msg + e.Object
+}
+
+// sendSyslog sends the entry to the syslog server
+func sendSyslog(network, addr string, e AuditEntry) error {
+	if network != SYSLOG_TCP {
+		network = SYSLOG_UDP
+	}
+	conn, err := net.DialTimeout(network, addr, SYSLOG_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SYSLOG_TIMEOUT))
+	msg := syslogMessage(e)
+	if network == SYSLOG_TCP {
+		msg = strconv.Itoa(len(msg)) + " " + msg // RFC 6587 octet counting
+	}
+	_, err = conn.Write([]byte(msg))
+	return err
+}
+
+// readAuditSinks reads the audit sinks of the setup or settings form, nil if there are none
+func readAuditSinks(r *http.Request) (*AuditSinks, error) {
+	as := &AuditSinks{Syslog: strings.TrimSpace(r.FormValue("AuditSyslog")), Network: r.FormValue("AuditNetwork"),
+		JSONFile: strings.TrimSpace(r.FormValue("AuditJSONFile"))}
+	if as.Syslog == "" && as.JSONFile == "" {
+		return nil, nil
+	}
+	if as.Network != SYSLOG_TCP {
+		as.Network = SYSLOG_UDP
+	}
+	if as.Syslog != "" {
+		if _, port, err := net.SplitHostPort(as.Syslog); err != nil || port == "" {
+			return nil, fmt.Errorf("%s: %v", tr("The syslog server must be host:port!"), as.Syslog)
+		}
+	}
+	if as.JSONFile != "" {
+		f, err := os.OpenFile(as.JSONFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tr("Cannot write the audit file!"), err)
+		}
+		f.Close()
+	}
+	return as, nil
+}
@@ -0,0 +1,73 @@
+package webca
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditSinks(t *testing.T) {
+	inTestDir(t)
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	dieOnError(t, err)
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	defer tcp.Close()
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{}}
+	r := httptest.NewRequest("POST", "/setup", strings.NewReader(url.Values{"AuditSyslog": {"nowhere"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := readAuditSinks(r); err == nil {
+		t.Error("A syslog server without a port is accepted")
+	}
+	form := url.Values{"AuditSyslog": {udp.LocalAddr().String()}, "AuditJSONFile": {"siem.jsonl"}}
+	r = httptest.NewRequest("POST", "/setup", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	cachedCfg.AuditSinks, err = readAuditSinks(r)
+	dieOnError(t, err)
+
+	audit(AUDIT_LOGIN_FAILED, `bad"user]`, "198.51.100.1", "password")
+	buf := make([]byte, SYSLOG_MAX_FRAME)
+	udp.SetDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := udp.ReadFrom(buf)
+	dieOnError(t, err)
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<84>1 ") || !strings.Contains(msg, `user="bad\"user\]"`) ||
+		!strings.HasSuffix(msg, "] password") {
+		t.Errorf("Wrong syslog message: %s", msg)
+	}
+	cachedCfg.AuditSinks.Syslog, cachedCfg.AuditSinks.Network = tcp.Addr().String(), SYSLOG_TCP
+	audit(AUDIT_ISSUE, "boss", "198.51.100.1", strings.Repeat("x", AUDIT_MAX_OBJECT))
+	conn, err := tcp.Accept()
+	dieOnError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	dieOnError(t, err)
+	frame := strings.SplitN(string(data), " ", 2)
+	if len(frame) != 2 || frame[0] != strconv.Itoa(len(frame[1])) || !strings.HasPrefix(frame[1], "<85>1 ") {
+		t.Errorf("Wrong syslog frame: %s", data)
+	}
+
+	entries, err := ReadAudit()
+	dieOnError(t, err)
+	data, err = ioutil.ReadFile("siem.jsonl")
+	dieOnError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Wrong JSON lines: %s", data)
+	}
+	for i, l := range lines {
+		var e AuditEntry
+		dieOnError(t, json.Unmarshal([]byte(l), &e))
+		if e != entries[i] {
+			t.Errorf("The JSON line %+v is not the audit entry %+v", e, entries[i])
+		}
+	}
+}
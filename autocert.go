@@ -0,0 +1,334 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LETSENCRYPT_URL    = "https://acme-v02.api.letsencrypt.org/directory"
+	AUTOCERT_DIR       = "autocert" // cache directory in the data one, if none is chosen
+	AUTOCERT_DAYS      = 30         // days before expiry the certificate is renewed
+	AUTOCERT_ACCOUNT   = "account.key.pem"
+	AUTOCERT_POLL      = time.Second
+	AUTOCERT_POLLS     = 60
+	ACME_CHALLENGE_DIR = "/.well-known/acme-challenge/"
+)
+
+// challenges are the key authorizations of the http-01 challenges in progress, by token
+var challenges = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// web certificate ACME lock
+var sautocert sync.Mutex
+
+// autocertDir returns the directory the ACME account key and web certificate are kept in
+func (o Options) autocertDir() string {
+	if o.AutocertDir != "" {
+		return o.AutocertDir
+	}
+	return dataPath(AUTOCERT_DIR)
+}
+
+// autocertFiles returns the web certificate (with its chain) and key files got through ACME
+func (o Options) autocertFiles() (string, string) {
+	return filepath.Join(o.autocertDir(), o.AutocertHost+CERT_SUFFIX),
+		filepath.Join(o.autocertDir(), o.AutocertHost+KEY_SUFFIX)
+}
+
+// serveChallenge answers the http-01 challenges of the web certificate orders, telling whether or
+// not the request was one
+func serveChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, ACME_CHALLENGE_DIR) {
+		return false
+	}
+	challenges.RLock()
+	keyAuth, ok := challenges.m[strings.TrimPrefix(r.URL.Path, ACME_CHALLENGE_DIR)]
+	challenges.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, keyAuth)
+	return true
+}
+
+// RenewAutocert gets the web certificate from the ACME server of the options (Let's Encrypt by
+// default) when there is none yet or it expires within AUTOCERT_DAYS, and serves it
+func RenewAutocert(now time.Time) error {
+	if options.AutocertHost == "" {
+		return nil
+	}
+	sautocert.Lock()
+	defer sautocert.Unlock()
+	certfile, keyfile := options.autocertFiles()
+	if data, err := ioutil.ReadFile(certfile); err == nil {
+		if block, _ := pem.Decode(data); block != nil {
+			crt, err := x509.ParseCertificate(block.Bytes)
+			if err == nil && crt.NotAfter.After(now.Add(AUTOCERT_DAYS*24*time.Hour)) {
+				return nil
+			}
+		}
+	}
+	certPEM, keyPEM, err := obtainCert(options.AutocertURL, options.AutocertEmail, options.AutocertHost)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(options.autocertDir(), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyfile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certfile, certPEM, 0644); err != nil {
+		return err
+	}
+	log.Printf("Web certificate for %s got through ACME", options.AutocertHost)
+	return serveWebCert(certfile, keyfile)
+}
+
+// acmeClient orders certificates to an ACME server (RFC 8555)
+type acmeClient struct {
+	dir   struct{ NewNonce, NewAccount, NewOrder string }
+	key   *ecdsa.PrivateKey
+	kid   string
+	nonce string
+}
+
+// clientOrder is the order of a certificate as told by the ACME server
+type clientOrder struct {
+	Status         string
+	Authorizations []string
+	Finalize       string
+	Certificate    string
+}
+
+// obtainCert orders a certificate for the host to the ACME server of the directory URL, answering
+// its http-01 challenge, and returns it with its chain and its key in PEM
+func obtainCert(directory, email, host string) ([]byte, []byte, error) {
+	if directory == "" {
+		directory = LETSENCRYPT_URL
+	}
+	c := &acmeClient{}
+	if err := c.accountKey(); err != nil {
+		return nil, nil, err
+	}
+	res, err := http.Get(directory)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, ACME_MAX_BODY)).Decode(&c.dir)
+	res.Body.Close()
+	if err != nil || c.dir.NewAccount == "" || c.dir.NewOrder == "" {
+		return nil, nil, fmt.Errorf("Wrong ACME directory %s: %v", directory, err)
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	h, err := c.post(c.dir.NewAccount, account, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.kid = h.Get("Location")
+	var o clientOrder
+	h, err = c.post(c.dir.NewOrder, map[string]interface{}{"identifiers": []acmeIdentifier{{"dns", host}}}, &o)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := h.Get("Location")
+	for _, authz := range o.Authorizations {
+		if err := c.authorize(authz); err != nil {
+			return nil, nil, err
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: host}, DNSNames: []string{host}}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := c.post(o.Finalize, map[string]string{"csr": b64(csr)}, &o); err != nil {
+		return nil, nil, err
+	}
+	for i := 0; o.Status != ACME_VALID; i++ {
+		if o.Status == ACME_INVALID || i == AUTOCERT_POLLS {
+			return nil, nil, fmt.Errorf("The ACME order of %s is %s", host, o.Status)
+		}
+		time.Sleep(AUTOCERT_POLL)
+		if _, err := c.post(orderURL, nil, &o); err != nil {
+			return nil, nil, err
+		}
+	}
+	var chain bytes.Buffer
+	if _, err := c.post(o.Certificate, nil, &chain); err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if _, err := tls.X509KeyPair(chain.Bytes(), keyPEM); err != nil {
+		return nil, nil, fmt.Errorf("Wrong certificate from the ACME server: %s", err)
+	}
+	return chain.Bytes(), keyPEM, nil
+}
+
+// accountKey loads the ACME account key, or generates it the first time
+func (c *acmeClient) accountKey() error {
+	file := filepath.Join(options.autocertDir(), AUTOCERT_ACCOUNT)
+	if data, err := ioutil.ReadFile(file); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("Wrong ACME account key %s", file)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		c.key = key
+		return nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(options.autocertDir(), 0700); err != nil {
+		return err
+	}
+	c.key = key
+	return ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// authorize answers the http-01 challenge of the authorization and waits for its validation
+func (c *acmeClient) authorize(authz string) error {
+	var a struct {
+		Status     string
+		Identifier acmeIdentifier
+		Challenges []struct{ Type, URL, Token string }
+	}
+	if _, err := c.post(authz, nil, &a); err != nil {
+		return err
+	}
+	if a.Status == ACME_VALID {
+		return nil
+	}
+	jwk := ecJWK(&c.key.PublicKey)
+	for _, ch := range a.Challenges {
+		if ch.Type != "http-01" {
+			continue
+		}
+		challenges.Lock()
+		challenges.m[ch.Token] = ch.Token + "." + jwk.Thumbprint()
+		challenges.Unlock()
+		defer func(token string) {
+			challenges.Lock()
+			delete(challenges.m, token)
+			challenges.Unlock()
+		}(ch.Token)
+		if _, err := c.post(ch.URL, map[string]interface{}{}, nil); err != nil {
+			return err
+		}
+		for i := 0; i < AUTOCERT_POLLS; i++ {
+			if _, err := c.post(authz, nil, &a); err != nil {
+				return err
+			}
+			if a.Status != ACME_PENDING {
+				break
+			}
+			time.Sleep(AUTOCERT_POLL)
+		}
+		if a.Status != ACME_VALID {
+			return fmt.Errorf("The ACME authorization of %s is %s", a.Identifier.Value, a.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("No http-01 challenge for %s", a.Identifier.Value)
+}
+
+// post sends the payload (nil for POST-as-GET) signed to the URL, decoding the JSON response into
+// v, or copying it to v when it is a buffer. A bad nonce is retried once
+func (c *acmeClient) post(url string, payload, v interface{}) (http.Header, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	for retry := true; ; retry = false {
+		if c.nonce == "" {
+			res, err := http.Head(c.dir.NewNonce)
+			if err != nil {
+				return nil, err
+			}
+			res.Body.Close()
+			c.nonce = res.Header.Get("Replay-Nonce")
+		}
+		h := JWSHeader{Nonce: c.nonce, URL: url, KID: c.kid}
+		if c.kid == "" {
+			h.JWK, _ = json.Marshal(ecJWK(&c.key.PublicKey))
+		}
+		jws, err := signJWS(c.key, h, body)
+		if err != nil {
+			return nil, err
+		}
+		data, _ := json.Marshal(jws)
+		res, err := http.Post(url, "application/jose+json", bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		reply, err := ioutil.ReadAll(io.LimitReader(res.Body, ACME_MAX_BODY))
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		c.nonce = res.Header.Get("Replay-Nonce")
+		if res.StatusCode >= 400 {
+			var p acmeProblem
+			json.Unmarshal(reply, &p)
+			if retry && strings.HasSuffix(p.Type, ":badNonce") {
+				continue
+			}
+			return nil, fmt.Errorf("ACME %s failed: %s %s", url, res.Status, p.Detail)
+		}
+		switch v := v.(type) {
+		case nil:
+		case *bytes.Buffer:
+			v.Write(reply)
+		default:
+			if err := json.Unmarshal(reply, v); err != nil {
+				return nil, err
+			}
+		}
+		return res.Header, nil
+	}
+}
@@ -0,0 +1,76 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAutocert(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *Certree) { certree = saved }(certree)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	defer func(saved *tls.Certificate) { served.crt = saved }(served.crt)
+	defer func(saved Options) { options = saved }(options)
+	defer func(get func(string) ([]byte, error)) { acmeHTTPGet = get }(acmeHTTPGet)
+	defer func() { acme = nil }()
+	certree, acme = nil, nil
+	_, err := GenCACert(pkix.Name{CommonName: "AutocertCA"}, ForDays(365))
+	dieOnError(t, err)
+	cachedCfg = &config{ACME: &ACME{CA: "AutocertCA", Days: 90}}
+	smux := http.NewServeMux()
+	smux.HandleFunc(ACME_PREFIX, acmeHandler)
+	srv := httptest.NewServer(smux)
+	defer srv.Close()
+	acmeHTTPGet = func(url string) ([]byte, error) { // through the port 80 listener
+		rr := httptest.NewRecorder()
+		redirectHandler("443").ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		if rr.Code != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %d", url, rr.Code)
+		}
+		return rr.Body.Bytes(), nil
+	}
+	options = Options{AutocertHost: "ui.example.com", AutocertURL: srv.URL + ACME_PREFIX + "directory",
+		AutocertEmail: "admin@example.com"}
+
+	now := time.Now()
+	dieOnError(t, RenewAutocert(now))
+	certfile, keyfile := options.autocertFiles()
+	if fi, err := os.Stat(keyfile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Wrong key file: %v", err)
+	}
+	served.crt = nil
+	dieOnError(t, serveWebCert("", ""))
+	leaf, err := x509.ParseCertificate(served.crt.Certificate[0])
+	dieOnError(t, err)
+	if leaf.Subject.CommonName != "ui.example.com" || leaf.Issuer.CommonName != "AutocertCA" {
+		t.Errorf("Wrong web certificate served: %s by %s", leaf.Subject.CommonName, leaf.Issuer.CommonName)
+	}
+	if len(challenges.m) != 0 || len(acme.Accounts) != 1 {
+		t.Errorf("Wrong ACME state: %d challenges left, %d accounts", len(challenges.m), len(acme.Accounts))
+	}
+	for _, acct := range acme.Accounts {
+		if len(acct.Contact) != 1 || acct.Contact[0] != "mailto:admin@example.com" {
+			t.Errorf("Wrong ACME account contact %v", acct.Contact)
+		}
+	}
+
+	data, err := ioutil.ReadFile(certfile)
+	dieOnError(t, err)
+	dieOnError(t, RenewAutocert(now.Add(30*24*time.Hour)))
+	if again, _ := ioutil.ReadFile(certfile); !bytes.Equal(again, data) || len(acme.Orders) != 1 {
+		t.Error("The web certificate was renewed too soon")
+	}
+	dieOnError(t, RenewAutocert(now.Add(70*24*time.Hour)))
+	if again, _ := ioutil.ReadFile(certfile); bytes.Equal(again, data) || len(acme.Orders) != 2 || len(acme.Accounts) != 1 {
+		t.Error("The web certificate was not renewed with the same account")
+	}
+}
@@ -0,0 +1,210 @@
+package webca
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCA_RENEWALS     = ".webca.renewals"
+	AUTORENEW_PERIOD   = time.Hour
+	AUTORENEW_DAYS     = 14
+	AUTORENEW_HISTORY  = 200
+	EVENT_RENEW_FAILED = "renew-failed" // not a lifecycle event, sent by the auto-renewal
+)
+
+// RenewalOutcome records an automatic renewal attempt
+type RenewalOutcome struct {
+	Name   string
+	Time   time.Time
+	Serial string // of the renewed certificate, empty on failure
+	Error  string
+}
+
+// renewalLog keeps the latest automatic renewal outcomes, oldest first
+type renewalLog struct {
+	Outcomes []RenewalOutcome
+}
+
+// auto-renewal lock
+var srenewals sync.Mutex
+
+// ScheduleAutoRenew renews the flagged certificates in the background now and hourly
+func ScheduleAutoRenew() {
+	go func() {
+		for {
+			if err := AutoRenew(time.Now()); err != nil {
+				log.Printf("(Warning) Auto-renewal failed: %s", err)
+			}
+			time.Sleep(AUTORENEW_PERIOD)
+		}
+	}()
+}
+
+// autoRenewDays returns the days before expiry when the flagged certificates are renewed
+func (cfg *config) autoRenewDays() int {
+	if cfg.AutoRenewDays > 0 {
+		return cfg.AutoRenewDays
+	}
+	return AUTORENEW_DAYS
+}
+
+// AutoRenew renews the certificates flagged for auto-renewal about to expire, recording the
+// outcomes and notifying the new failures
+func AutoRenew(now time.Time) error {
+	srenewals.Lock()
+	defer srenewals.Unlock()
+	cfg := LoadConfig()
+	if cfg == nil || len(cfg.AutoRenew) == 0 {
+		return nil
+	}
+	rl, err := loadRenewals()
+	if err != nil {
+		return err
+	}
+	horizon := now.Add(time.Duration(cfg.autoRenewDays()) * 24 * time.Hour)
+	failed := make([]RenewalOutcome, 0)
+	for _, c := range FindCerts(CertFilter{ExpiresBefore: horizon}) {
+		name := c.Crt.Subject.CommonName
+		if !cfg.AutoRenew[name] || Revoked(c) != nil {
+			continue
+		}
+		o := RenewalOutcome{Name: name, Time: now}
+		var renewed *Cert
+		err = fmt.Errorf("%s", tr("There is no key for %s!", name)) // the CSR requester holds it
+		if c.Key != nil {
+			renewed, err = RenewCert(c, false)
+		}
+		if err != nil {
+			o.Error = err.Error()
+			if last := rl.last(name); last == nil || last.Error == "" { // only once until it works
+				failed = append(failed, o)
+			}
+		} else {
+			o.Serial = serialKey(renewed.Crt.SerialNumber)
+			audit(AUDIT_RENEW, "auto-renewal", "", certObject(renewed.Crt))
+		}
+		rl.Outcomes = append(rl.Outcomes, o)
+	}
+	if len(rl.Outcomes) > AUTORENEW_HISTORY {
+		rl.Outcomes = rl.Outcomes[len(rl.Outcomes)-AUTORENEW_HISTORY:]
+	}
+	if err := rl.save(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return notifyRenewFailures(cfg, failed)
+	}
+	return nil
+}
+
+// notifyRenewFailures emails the recipients and tells the chat hooks and the inbox about the
+// failed renewals
+func notifyRenewFailures(cfg *config, failed []RenewalOutcome) error {
+	lines := make([]string, 0, len(failed))
+	for _, o := range failed {
+		lines = append(lines, fmt.Sprintf("%s: %s", o.Name, o.Error))
+	}
+	title := tr("%d certificates could not be renewed", len(failed))
+	for _, o := range failed {
+		addInboxItem(EVENT_RENEW_FAILED, o.Name, tr("The automatic renewal of %s failed: %s", o.Name, o.Error))
+	}
+	for _, ch := range cfg.ChatHooks {
+		if (Event{Type: EVENT_RENEW_FAILED}).Matches(ch.Events) {
+			if err := ch.notify(title, strings.Join(lines, "\n")); err != nil {
+				log.Printf("(Warning) %s notification failed: %s", ch.Kind, err)
+			}
+		}
+	}
+	if cfg.Mailer == nil || cfg.Mailer.Server == "" {
+		return nil
+	}
+	body := tr("The automatic renewal of these certificates failed:") + "\n\n  " + strings.Join(lines, "\n  ")
+	var errs []string
+	for _, to := range cfg.notifyRecipients() {
+		if err := sendMail(cfg.Mailer, to, title, body); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", to, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// LastRenewal returns the latest automatic renewal outcome of the named certificate, if any
+func LastRenewal(name string) *RenewalOutcome {
+	srenewals.Lock()
+	defer srenewals.Unlock()
+	rl, err := loadRenewals()
+	if err != nil {
+		return nil
+	}
+	return rl.last(name)
+}
+
+// last returns the latest outcome for the named certificate, if any
+func (rl *renewalLog) last(name string) *RenewalOutcome {
+	for i := len(rl.Outcomes) - 1; i >= 0; i-- {
+		if rl.Outcomes[i].Name == name {
+			return &rl.Outcomes[i]
+		}
+	}
+	return nil
+}
+
+// loadRenewals reads the renewal outcomes from the storage (the caller must hold srenewals)
+func loadRenewals() (*renewalLog, error) {
+	rl := &renewalLog{}
+	if err := loadGob(WEBCA_RENEWALS, rl); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// save stores the renewal outcomes (the caller must hold srenewals)
+func (rl *renewalLog) save() error {
+	return saveGob(WEBCA_RENEWALS, rl)
+}
+
+// autoRenew allows the web user to flag or unflag a certificate for automatic renewal
+func autoRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	err = LoadConfig().update(func(cfg *config) error {
+		autoRenew := make(map[string]bool, len(cfg.AutoRenew)+1)
+		for cert, on := range cfg.AutoRenew {
+			autoRenew[cert] = on
+		}
+		if r.FormValue("off") != "" {
+			delete(autoRenew, name)
+		} else {
+			autoRenew[name] = true
+		}
+		cfg.AutoRenew = autoRenew
+		return nil
+	})
+	if handleError(w, r, err) {
+		return
+	}
+	auditRequest(w, r, AUDIT_CONFIG, "auto-renewal of "+name)
+	setCertControl(ps, c)
+	err = templatesFor(r).ExecuteTemplate(w, "certControl", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,76 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoRenew(t *testing.T) {
+	inTestDir(t)
+	sent := make([]string, 0)
+	defer func(saved func(m *Mailer, to, subject, body string) error) { sendMail = saved }(sendMail)
+	sendMail = func(m *Mailer, to, subject, body string) error {
+		sent = append(sent, body)
+		return nil
+	}
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Mailer: &Mailer{Server: "smtp.example.com"},
+		Users:     map[string]User{"admin": {Username: "admin", Email: "admin@example.com"}},
+		AutoRenew: map[string]bool{"soon": true, "later": true, "orphan": true}}
+	ca, err := GenCACert(pkix.Name{CommonName: "RenewCA"}, ForDays(365))
+	dieOnError(t, err)
+	for name, days := range map[string]int{"soon": 5, "manual": 5, "later": 100} {
+		_, err := GenCert(ca, name, ForDays(days))
+		dieOnError(t, err)
+	}
+	other, err := GenCACert(pkix.Name{CommonName: "KeylessCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(other, "orphan", ForDays(5))
+	dieOnError(t, err)
+	dieOnError(t, os.Remove(keyFile(*other))) // can't sign the renewal
+	certree = nil
+	serials := make(map[string]string)
+	for _, name := range []string{"soon", "manual", "later"} {
+		serials[name] = serialKey(FindCert(name).Crt.SerialNumber)
+	}
+	dieOnError(t, AutoRenew(time.Now()))
+	for name, renewed := range map[string]bool{"soon": true, "manual": false, "later": false} {
+		if (serialKey(FindCert(name).Crt.SerialNumber) != serials[name]) != renewed {
+			t.Fatalf("%s renewed: %v", name, !renewed)
+		}
+	}
+	if o := LastRenewal("soon"); o == nil || o.Error != "" || o.Serial != serialKey(FindCert("soon").Crt.SerialNumber) {
+		t.Fatalf("Unexpected outcome %v", o)
+	}
+	if o := LastRenewal("orphan"); o == nil || o.Error == "" {
+		t.Fatalf("Unexpected outcome %v", o)
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0], "orphan") {
+		t.Fatalf("Unexpected failure notifications: %v", sent)
+	}
+	dieOnError(t, AutoRenew(time.Now()))
+	if len(sent) != 1 {
+		t.Fatalf("The same failure was notified twice: %v", sent)
+	}
+
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	flagged := cachedCfg.AutoRenew
+	post := func(form string) {
+		req := httptest.NewRequest("POST", "/autoRenew", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		autoRenew(httptest.NewRecorder(), req)
+	}
+	post("cert=manual")
+	if !cachedCfg.AutoRenew["manual"] || flagged["manual"] {
+		t.Fatalf("Wrong flags %v, before %v", cachedCfg.AutoRenew, flagged)
+	}
+	post("cert=soon&off=1")
+	if cachedCfg.AutoRenew["soon"] || !flagged["soon"] {
+		t.Fatalf("Wrong flags %v, before %v", cachedCfg.AutoRenew, flagged)
+	}
+}
@@ -0,0 +1,240 @@
+package webca
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	BACKUP_MAGIC      = "WEBCABK1" // format version of the archives
+	BACKUP_SALT_BYTES = 16
+	BACKUP_MAX_UPLOAD = 64 << 20
+	BACKUP_PREFIX     = "webca-"
+	BACKUP_SUFFIX     = ".backup"
+)
+
+// backupDirs are the storage directories with the certificates and keys
+var backupDirs = []string{"", ARCHIVE_DIR, CROSS_DIR}
+
+// backupStateFiles are the state files of the CA, which the listings hide
+var backupStateFiles = []string{WEBCA_CFG, WEBCA_SERIALS, WEBCA_REVOKED, WEBCA_RENEWALS, WEBCA_NOTIFIED,
+	WEBCA_DELIVERIES, WEBCA_ACME}
+
+// backupCipher returns the AES-256-GCM keyed from the passphrase with Argon2id
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("%s", tr("The backup needs a passphrase!"))
+	}
+	block, err := aes.NewCipher(argon2.IDKey([]byte(passphrase), salt, PASSWORD_TIME, PASSWORD_MEMORY, PASSWORD_THREADS, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Backup returns the whole CA state (config and users, certificates, keys, revocations and the
+// rest of the state files) as a zip archive encrypted with the passphrase. The keys are kept as
+// stored, so those encrypted with the master key need it again once restored
+func Backup(passphrase string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string) error {
+		data, err := storage.Get(name)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()}
+		hdr.SetMode(0644)
+		if strings.HasPrefix(path.Base(name), ".") || strings.HasSuffix(name, KEY_SUFFIX) {
+			hdr.SetMode(0600)
+		}
+		f, err := zw.CreateHeader(hdr)
+		if err == nil {
+			_, err = f.Write(data)
+		}
+		return err
+	}
+	seen := make(map[string]bool)
+	names := append([]string{}, backupStateFiles...)
+	for _, dir := range backupDirs {
+		listed, err := storage.List(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range listed {
+			names = append(names, path.Join(dir, name))
+		}
+	}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			if err := add(name); err != nil {
+				return nil, fmt.Errorf("Failed to back up %s: %s", name, err)
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, BACKUP_SALT_BYTES)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(BACKUP_MAGIC), salt...), nonce...)
+	return aead.Seal(header, nonce, buf.Bytes(), header), nil
+}
+
+// Restore decrypts the backup archive with the passphrase and writes all its files to the
+// storage, none if any fails, returning how many there were
+func Restore(data []byte, passphrase string) (int, error) {
+	if !bytes.HasPrefix(data, []byte(BACKUP_MAGIC)) || len(data) < len(BACKUP_MAGIC)+BACKUP_SALT_BYTES {
+		return 0, fmt.Errorf("%s", tr("This is not a WebCA backup!"))
+	}
+	salt := data[len(BACKUP_MAGIC) : len(BACKUP_MAGIC)+BACKUP_SALT_BYTES]
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return 0, err
+	}
+	hlen := len(BACKUP_MAGIC) + BACKUP_SALT_BYTES + aead.NonceSize()
+	if len(data) < hlen {
+		return 0, fmt.Errorf("%s", tr("This is not a WebCA backup!"))
+	}
+	plain, err := aead.Open(nil, data[hlen-aead.NonceSize():hlen], data[hlen:], data[:hlen])
+	if err != nil {
+		return 0, fmt.Errorf("%s", tr("Wrong passphrase or damaged backup!"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		return 0, err
+	}
+	err = storage.Tx(func(tx Storage) error {
+		for _, f := range zr.File {
+			name := path.Clean(f.Name)
+			if path.IsAbs(name) || strings.HasPrefix(name, "..") || f.FileInfo().IsDir() {
+				return fmt.Errorf("Wrong file name %q in the backup", f.Name)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			content, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(name, content, f.Mode().Perm()&0044 == 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	oneCfg.Lock()
+	cachedCfg = nil
+	oneCfg.Unlock()
+	certree = nil // forces full reload later
+	log.Printf("Restored %d files from the backup", len(zr.File))
+	return len(zr.File), nil
+}
+
+// backupName names the archive made at t, so that the names sort in time
+func backupName(t time.Time) string {
+	return BACKUP_PREFIX + t.Format("20060102-150405") + BACKUP_SUFFIX
+}
+
+// backup downloads the backup of the CA encrypted with the passphrase of the form
+func backup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return
+	}
+	data, err := Backup(r.FormValue("BackupPassphrase"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := backupName(time.Now())
+	auditRequest(w, r, AUDIT_BACKUP, name)
+	download(w, name, "application/octet-stream", data)
+}
+
+// BackupRequest asks the API for a backup of the CA
+type BackupRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// apiBackup sends the backup of the CA encrypted with the passphrase of the request
+func apiBackup(w http.ResponseWriter, r *http.Request) {
+	var req BackupRequest
+	if err := apiRead(r, &req); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	data, err := Backup(req.Passphrase)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	name := backupName(time.Now())
+	auditRequest(w, r, AUDIT_BACKUP, name)
+	download(w, name, "application/octet-stream", data)
+}
+
+// restore restores a backup from the setup wizard, instead of setting up a new CA
+func restore(w http.ResponseWriter, r *http.Request) {
+	oneSetup.Lock()
+	defer oneSetup.Unlock()
+	if !setupDone {
+		r.ParseMultipartForm(BACKUP_MAX_UPLOAD)
+		file, _, err := r.FormFile("Backup")
+		if err != nil {
+			http.Error(w, tr("No backup was uploaded!"), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(file, BACKUP_MAX_UPLOAD))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, err := Restore(data, r.FormValue("BackupPassphrase"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg := LoadConfig(); cfg == nil || cfg.WebCert == nil {
+			http.Error(w, tr("The backup has no configuration!"), http.StatusBadRequest)
+			return
+		}
+		audit(AUDIT_RESTORE, "", remoteAddr(r), fmt.Sprintf("%d files", n))
+		setupDone = true
+		rootFunc = restart
+		go webCA()
+	}
+	restart(w, r)
+}
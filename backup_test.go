@@ -0,0 +1,64 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"os"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *Certree) { certree = saved }(certree)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "BackupCA"}, ForDays(365))
+	dieOnError(t, err)
+	web, err := GenCert(ca, "backup.example.com", ForDays(30))
+	dieOnError(t, err)
+	old, err := GenCert(ca, "old.example.com", ForDays(30))
+	dieOnError(t, err)
+	dieOnError(t, RevokeCert(old, 1))
+	cachedCfg = NewConfig(User{Username: "admin"}, ca, web, Mailer{})
+	dieOnError(t, cachedCfg.Save())
+
+	data, err := Backup("Backup-passphrase")
+	dieOnError(t, err)
+	if _, err := Backup(""); err == nil {
+		t.Error("A backup was made without a passphrase")
+	}
+	dieOnError(t, os.Chdir(".."))
+	dieOnError(t, os.RemoveAll("tests"))
+	dieOnError(t, os.MkdirAll("tests", 0750))
+	dieOnError(t, os.Chdir("tests"))
+	cachedCfg, certree = nil, nil
+
+	if _, err := Restore(data, "Wrong-passphrase"); err == nil {
+		t.Fatal("The backup was restored with a wrong passphrase")
+	}
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := Restore(tampered, "Backup-passphrase"); err == nil {
+		t.Fatal("A damaged backup was restored")
+	}
+	if names, _ := storage.List(""); len(names) != 0 {
+		t.Fatalf("Failed restores left files: %v", names)
+	}
+	n, err := Restore(data, "Backup-passphrase")
+	dieOnError(t, err)
+	if n < 6 {
+		t.Errorf("Only %d files were restored", n)
+	}
+	cfg := LoadConfig()
+	if cfg == nil || cfg.getUser("admin").Username != "admin" || cfg.WebCert.Crt.Subject.CommonName != "backup.example.com" {
+		t.Fatal("The config was not restored")
+	}
+	if c := FindCert("BackupCA"); c == nil || c.Key == nil || !sameKey(c.Key, ca.Key) {
+		t.Error("The CA was not restored with its key")
+	}
+	if rev := Revoked(FindCert("old.example.com")); rev == nil || rev.Reason != 1 {
+		t.Error("The revocation was not restored")
+	}
+	if fi, err := os.Stat(keyFile(*ca)); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("The restored key is not kept secret")
+	}
+}
@@ -0,0 +1,290 @@
+package webca
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCA_BACKUPS       = ".webca.backups"
+	BACKUP_CHECK_PERIOD = 5 * time.Minute
+	BACKUP_HOURS        = 24
+	BACKUP_KEEP         = 7
+	BACKUP_HISTORY      = 100
+)
+
+// BackupSchedule holds the settings of the automatic backups
+type BackupSchedule struct {
+	Hours      int       // between backups, BACKUP_HOURS if 0
+	Keep       int       // latest backups kept, BACKUP_KEEP if 0
+	Passphrase string    // the backups are encrypted with
+	Dir        string    // directory the backups are written to, unless in a bucket
+	S3         *S3Bucket // bucket the backups are written to, if not nil
+}
+
+// BackupOutcome records an automatic backup attempt
+type BackupOutcome struct {
+	Time  time.Time
+	Name  string
+	Size  int
+	Error string
+}
+
+// backupLog keeps the latest automatic backup outcomes, oldest first
+type backupLog struct {
+	Outcomes []BackupOutcome
+}
+
+// backupTarget is where the automatic backups are kept
+type backupTarget interface {
+	Put(name string, data []byte) error
+	List() ([]string, error)
+	Remove(name string) error
+}
+
+// backupDir keeps the backups in a local directory
+type backupDir string
+
+func (d backupDir) Put(name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(string(d), name), data, 0600)
+}
+
+func (d backupDir) List() ([]string, error) {
+	fis, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names, nil
+}
+
+func (d backupDir) Remove(name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
+
+// automatic backups lock
+var sbackups sync.Mutex
+
+// ScheduleBackups makes the automatic backups in the background when they are due
+func ScheduleBackups() {
+	go func() {
+		for {
+			if err := AutoBackup(time.Now()); err != nil {
+				log.Printf("(Warning) Automatic backup failed: %s", err)
+			}
+			time.Sleep(BACKUP_CHECK_PERIOD)
+		}
+	}()
+}
+
+// hours returns the hours between backups
+func (bs *BackupSchedule) hours() int {
+	if bs.Hours > 0 {
+		return bs.Hours
+	}
+	return BACKUP_HOURS
+}
+
+// keep returns how many backups are kept
+func (bs *BackupSchedule) keep() int {
+	if bs.Keep > 0 {
+		return bs.Keep
+	}
+	return BACKUP_KEEP
+}
+
+// target returns where the backups are kept
+func (bs *BackupSchedule) target() backupTarget {
+	if bs.S3 != nil {
+		return bs.S3
+	}
+	return backupDir(bs.Dir)
+}
+
+// AutoBackup makes a backup if the last attempt is older than the schedule interval
+func AutoBackup(now time.Time) error {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.Backups == nil {
+		return nil
+	}
+	if last := LastBackup(); last != nil && now.Before(last.Time.Add(time.Duration(cfg.Backups.hours())*time.Hour)) {
+		return nil
+	}
+	return RunBackup(now)
+}
+
+// RunBackup writes a backup to the scheduled target, deletes those beyond the ones kept and
+// records the outcome
+func RunBackup(now time.Time) error {
+	sbackups.Lock()
+	defer sbackups.Unlock()
+	cfg := LoadConfig()
+	if cfg == nil || cfg.Backups == nil {
+		return fmt.Errorf("%s", tr("The automatic backups are not configured!"))
+	}
+	bl, err := loadBackups()
+	if err != nil {
+		return err
+	}
+	o := BackupOutcome{Time: now, Name: backupName(now)}
+	data, err := Backup(cfg.Backups.Passphrase)
+	if err == nil {
+		o.Size = len(data)
+		err = cfg.Backups.target().Put(o.Name, data)
+	}
+	if err == nil {
+		err = cfg.Backups.prune()
+	}
+	if err != nil {
+		o.Error = err.Error()
+	} else {
+		audit(AUDIT_BACKUP, "automatic-backup", "", o.Name)
+	}
+	bl.Outcomes = append(bl.Outcomes, o)
+	if len(bl.Outcomes) > BACKUP_HISTORY {
+		bl.Outcomes = bl.Outcomes[len(bl.Outcomes)-BACKUP_HISTORY:]
+	}
+	if serr := saveGob(WEBCA_BACKUPS, bl); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// prune deletes the oldest backups beyond the ones kept
+func (bs *BackupSchedule) prune() error {
+	t := bs.target()
+	names, err := t.List()
+	if err != nil {
+		return err
+	}
+	backups := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, BACKUP_PREFIX) && strings.HasSuffix(name, BACKUP_SUFFIX) {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+	for i := 0; i < len(backups)-bs.keep(); i++ {
+		if err := t.Remove(backups[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBackups reads the backup outcomes from the storage
+func loadBackups() (*backupLog, error) {
+	bl := &backupLog{}
+	if err := loadGob(WEBCA_BACKUPS, bl); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return bl, nil
+}
+
+// LastBackup returns the latest automatic backup outcome, if any
+func LastBackup() *BackupOutcome {
+	bl, err := loadBackups()
+	if err != nil || len(bl.Outcomes) == 0 {
+		return nil
+	}
+	return &bl.Outcomes[len(bl.Outcomes)-1]
+}
+
+// readBackupSchedule reads the automatic backup settings from the form, keeping the secrets of
+// the old ones (if any) left empty, nil if they are disabled
+func readBackupSchedule(r *http.Request, old *BackupSchedule) (*BackupSchedule, error) {
+	if r.FormValue("Enabled") == "" {
+		return nil, nil
+	}
+	bs := &BackupSchedule{Passphrase: r.FormValue("Passphrase"), Dir: strings.TrimSpace(r.FormValue("Dir"))}
+	for field, v := range map[string]*int{"Hours": &bs.Hours, "Keep": &bs.Keep} {
+		if s := strings.TrimSpace(r.FormValue(field)); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%s", tr("Wrong %s value %s!", field, s))
+			}
+			*v = n
+		}
+	}
+	if bucket := strings.TrimSpace(r.FormValue("S3Bucket")); bucket != "" {
+		bs.S3 = &S3Bucket{Endpoint: strings.TrimSpace(r.FormValue("S3Endpoint")), Region: strings.TrimSpace(r.FormValue("S3Region")),
+			Bucket: bucket, Prefix: strings.TrimSpace(r.FormValue("S3Prefix")),
+			AccessKey: strings.TrimSpace(r.FormValue("S3AccessKey")), SecretKey: r.FormValue("S3SecretKey")}
+		if bs.S3.Endpoint != "" {
+			if err := checkURL(bs.S3.Endpoint); err != nil {
+				return nil, err
+			}
+		}
+		if bs.S3.SecretKey == "" && old != nil && old.S3 != nil {
+			bs.S3.SecretKey = old.S3.SecretKey
+		}
+	} else if bs.Dir == "" {
+		return nil, fmt.Errorf("%s", tr("The backups need a directory or an S3 bucket!"))
+	}
+	if bs.Passphrase == "" && old != nil {
+		bs.Passphrase = old.Passphrase
+	}
+	if bs.Passphrase == "" {
+		return nil, fmt.Errorf("%s", tr("The backup needs a passphrase!"))
+	}
+	return bs, nil
+}
+
+// backups allows the admins to configure the automatic backups, see how they went and make
+// one right away
+func backups(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	if r.Method == "POST" {
+		var err error
+		if r.FormValue("action") == "run" {
+			err = RunBackup(time.Now())
+		} else {
+			var bs *BackupSchedule
+			if bs, err = readBackupSchedule(r, cfg.Backups); err == nil {
+				err = cfg.update(func(cfg *config) error {
+					cfg.Backups = bs
+					return nil
+				})
+			}
+			if err == nil {
+				auditRequest(w, r, AUDIT_CONFIG, "backups")
+			}
+		}
+		if err == nil {
+			http.Redirect(w, r, "/backups", 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	bl, err := loadBackups()
+	if handleError(w, r, err) {
+		return
+	}
+	latest := make([]BackupOutcome, 0, len(bl.Outcomes))
+	for i := len(bl.Outcomes) - 1; i >= 0; i-- {
+		latest = append(latest, bl.Outcomes[i])
+	}
+	ps["Backups"] = cfg.Backups
+	ps["Outcomes"] = latest
+	err = templatesFor(r).ExecuteTemplate(w, "backups", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,92 @@
+package webca
+
+import (
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduledBackups(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *Certree) { certree = saved }(certree)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "ScheduledCA"}, ForDays(365))
+	dieOnError(t, err)
+	web, err := GenCert(ca, "scheduled.example.com", ForDays(30))
+	dieOnError(t, err)
+	cachedCfg = NewConfig(User{Username: "admin"}, ca, web, Mailer{})
+	dir, err := filepath.Abs("backups")
+	dieOnError(t, err)
+	cachedCfg.Backups = &BackupSchedule{Hours: 6, Keep: 2, Passphrase: "Scheduled-passphrase", Dir: dir}
+	dieOnError(t, cachedCfg.Save())
+
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, now := range []time.Time{start, start.Add(time.Hour), start.Add(7 * time.Hour), start.Add(14 * time.Hour)} {
+		dieOnError(t, AutoBackup(now))
+		if last := LastBackup(); last == nil || last.Error != "" || (i != 1 && !last.Time.Equal(now)) {
+			t.Fatalf("Backup %d was not made when due: %+v", i, last)
+		}
+	}
+	names, err := backupDir(dir).List()
+	dieOnError(t, err)
+	if len(names) != 2 || names[1] != backupName(start.Add(14*time.Hour)) {
+		t.Fatalf("The backups were not pruned: %v", names)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, names[1]))
+	dieOnError(t, err)
+	if n, err := Restore(data, "Scheduled-passphrase"); err != nil || n == 0 {
+		t.Errorf("The scheduled backup cannot be restored: %d %v", n, err)
+	}
+
+	objects := make(map[string][]byte)
+	var mu sync.Mutex
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch r.Method {
+		case "PUT":
+			objects[key] = body
+		case "DELETE":
+			delete(objects, key)
+		case "GET":
+			fmt.Fprint(w, "<ListBucketResult>")
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", k)
+				}
+			}
+			fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+		}
+	}))
+	defer s3.Close()
+	cfg := LoadConfig() // reloaded by the restore
+	cfg.Backups = &BackupSchedule{Keep: 1, Passphrase: "Scheduled-passphrase",
+		S3: &S3Bucket{Endpoint: s3.URL, Bucket: "bucket", Prefix: "webca/", AccessKey: "AKID", SecretKey: "secret"}}
+	dieOnError(t, RunBackup(start.Add(20*time.Hour)))
+	dieOnError(t, RunBackup(start.Add(21*time.Hour)))
+	if _, ok := objects["webca/"+backupName(start.Add(21*time.Hour))]; !ok || len(objects) != 1 {
+		t.Errorf("The backups were not kept in the bucket: %d", len(objects))
+	}
+	s3.Close()
+	if err := RunBackup(start.Add(22 * time.Hour)); err == nil || LastBackup().Error == "" {
+		t.Error("A failed backup was not recorded")
+	}
+}
@@ -0,0 +1,143 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	WEBCA_BOOTSTRAP = "WEBCA_BOOTSTRAP" // environment variable naming the bootstrap file
+	BOOTSTRAP_FILE  = "bootstrap.toml"  // bootstrap file read, if any, when there is no such variable
+	BOOTSTRAP_CA    = 3650              // days of the bootstrapped CA, when not given
+	BOOTSTRAP_CERT  = 365               // days of the bootstrapped web certificate, when not given
+)
+
+// Bootstrap is the initial setup done on the first run instead of the setup wizard, read from a
+// file with the options syntax and overridden by the environment, for Docker and IaC deployments
+type Bootstrap struct {
+	AdminUser         string `toml:"admin_user" env:"WEBCA_ADMIN_USER"`
+	AdminPassword     string `toml:"admin_password" env:"WEBCA_ADMIN_PASSWORD"`
+	AdminPasswordFile string `toml:"admin_password_file" env:"WEBCA_ADMIN_PASSWORD_FILE"` // e.g. a Docker secret, instead of AdminPassword
+	AdminFullname     string `toml:"admin_fullname" env:"WEBCA_ADMIN_FULLNAME"`
+	AdminEmail        string `toml:"admin_email" env:"WEBCA_ADMIN_EMAIL"`
+	CAName            string `toml:"ca_name" env:"WEBCA_CA_NAME"`
+	CAOrganization    string `toml:"ca_organization" env:"WEBCA_CA_ORGANIZATION"`
+	CAUnit            string `toml:"ca_unit" env:"WEBCA_CA_UNIT"`
+	CACountry         string `toml:"ca_country" env:"WEBCA_CA_COUNTRY"`
+	CAProvince        string `toml:"ca_province" env:"WEBCA_CA_PROVINCE"`
+	CALocality        string `toml:"ca_locality" env:"WEBCA_CA_LOCALITY"`
+	CADays            int    `toml:"ca_days" env:"WEBCA_CA_DAYS"`             // BOOTSTRAP_CA if 0
+	WebCertName       string `toml:"web_cert_name" env:"WEBCA_WEB_CERT_NAME"` // host name the WebCA is served as
+	WebCertSANs       string `toml:"web_cert_sans" env:"WEBCA_WEB_CERT_SANS"` // comma separated
+	WebCertDays       int    `toml:"web_cert_days" env:"WEBCA_WEB_CERT_DAYS"` // BOOTSTRAP_CERT if 0
+	MailServer        string `toml:"mail_server" env:"WEBCA_MAIL_SERVER"`     // host:port of the SMTP server, no mail if empty
+	MailUser          string `toml:"mail_user" env:"WEBCA_MAIL_USER"`
+	MailPassword      string `toml:"mail_password" env:"WEBCA_MAIL_PASSWORD"`
+	MailTLS           string `toml:"mail_tls" env:"WEBCA_MAIL_TLS"`                 // starttls, tls or none, STARTTLS when offered if empty
+	MailSkipVerify    bool   `toml:"mail_skip_verify" env:"WEBCA_MAIL_SKIP_VERIFY"` // don't verify the SMTP server certificate
+	MailAuth          string `toml:"mail_auth" env:"WEBCA_MAIL_AUTH"`               // PLAIN, LOGIN or CRAM-MD5, the first one that works if empty
+}
+
+// loadBootstrap reads the bootstrap file and the environment, returning nil if neither of them
+// asks for a bootstrap
+func loadBootstrap() (*Bootstrap, error) {
+	b := &Bootstrap{}
+	file, required := os.Getenv(WEBCA_BOOTSTRAP), true
+	if file == "" {
+		file, required = BOOTSTRAP_FILE, false
+	}
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		if err = parseOptions(data, b); err != nil {
+			return nil, fmt.Errorf("Wrong bootstrap file %s: %s", file, err)
+		}
+		log.Printf("Bootstrap read from %s", file)
+	} else if required || !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := fromEnv(b); err != nil {
+		return nil, err
+	}
+	if *b == (Bootstrap{}) {
+		return nil, nil
+	}
+	if b.AdminPasswordFile != "" {
+		data, err := ioutil.ReadFile(b.AdminPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		b.AdminPassword = strings.TrimRight(string(data), "\r\n")
+	}
+	return b, nil
+}
+
+// setup generates the CA and web certificate and returns the initial configuration bootstrapped
+func (b *Bootstrap) setup() (*config, error) {
+	for _, field := range []string{"admin_user", "ca_name", "web_cert_name"} {
+		if f, _ := optionField(b, "toml", field); strings.TrimSpace(f.String()) == "" {
+			return nil, fmt.Errorf("Missing %s in the bootstrap", field)
+		}
+	}
+	if err := LoadConfig().passwordPolicy().check(b.AdminUser, b.AdminPassword); err != nil {
+		return nil, err
+	}
+	mailer := Mailer{Server: b.MailServer, User: b.MailUser, Passwd: b.MailPassword, TLS: b.MailTLS,
+		SkipVerify: b.MailSkipVerify, Auth: b.MailAuth}
+	if err := mailer.checkOptions(); err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(b.AdminPassword)
+	if err != nil {
+		return nil, err
+	}
+	caDays, certDays := b.CADays, b.WebCertDays
+	if caDays == 0 {
+		caDays = BOOTSTRAP_CA
+	}
+	if certDays == 0 {
+		certDays = BOOTSTRAP_CERT
+	}
+	name := pkix.Name{CommonName: b.CAName}
+	prepareName(&name)
+	name.Organization[0], name.OrganizationalUnit[0] = b.CAOrganization, b.CAUnit
+	name.Country[0], name.Province[0], name.Locality[0] = b.CACountry, b.CAProvince, b.CALocality
+	ca, err := GenCACert(name, ForDays(caDays))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := GenCert(ca, b.WebCertName, ForDays(certDays), splitSANs(b.WebCertSANs)...)
+	if err != nil {
+		return nil, err
+	}
+	user := User{Username: b.AdminUser, Fullname: b.AdminFullname, Email: b.AdminEmail, Password: hash}
+	return NewConfig(user, ca, cert, mailer), nil
+}
+
+// BootstrapSetup completes the setup without the wizard when the WebCA is not configured yet and
+// there is a bootstrap file or environment, otherwise leaves the setup to the wizard
+func BootstrapSetup() error {
+	oneSetup.Lock()
+	defer oneSetup.Unlock()
+	if LoadConfig() != nil {
+		return nil
+	}
+	b, err := loadBootstrap()
+	if err != nil || b == nil {
+		return err
+	}
+	log.Printf("Bootstrapping the setup of %s...", b.CAName)
+	cfg, err := b.setup()
+	if err != nil {
+		return err
+	}
+	if err = cfg.Save(); err != nil {
+		return err
+	}
+	setupDone = true
+	log.Printf("Setup bootstrapped, admin %s", b.AdminUser)
+	return nil
+}
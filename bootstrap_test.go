@@ -0,0 +1,52 @@
+package webca
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config, done bool) { cachedCfg, setupDone = saved, done }(cachedCfg, setupDone)
+	cachedCfg = nil
+	dieOnError(t, BootstrapSetup())
+	if LoadConfig() != nil {
+		t.Fatal("Setup bootstrapped without a bootstrap")
+	}
+	dieOnError(t, ioutil.WriteFile("bootstrap.toml", []byte(`# first run
+admin_user = "root"
+ca_name = "Bootstrap CA"
+ca_organization = "Example"
+web_cert_sans = "ca.example.com, 127.0.0.1"
+`), 0600))
+	if err := BootstrapSetup(); err == nil || !strings.Contains(err.Error(), "web_cert_name") {
+		t.Fatalf("Incomplete bootstrap accepted: %v", err)
+	}
+	dieOnError(t, ioutil.WriteFile("secret", []byte("Correct-Horse-Battery-9\n"), 0600))
+	for k, v := range map[string]string{"WEBCA_WEB_CERT_NAME": "ca.example.com", "WEBCA_ADMIN_PASSWORD_FILE": "secret"} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	dieOnError(t, BootstrapSetup())
+	cfg := LoadConfig()
+	if cfg == nil || !setupDone {
+		t.Fatal("Setup not bootstrapped")
+	}
+	u := cfg.getUser("root")
+	if u.Role != ROLE_ADMIN || !checkPassword(u.Password, "Correct-Horse-Battery-9") {
+		t.Fatalf("Wrong bootstrapped admin %+v", u)
+	}
+	web := cfg.getWebCert()
+	if web.Crt.Subject.CommonName != "ca.example.com" || len(web.Crt.IPAddresses) != 1 ||
+		web.Parent.Crt.Subject.CommonName != "Bootstrap CA" || web.Parent.Crt.Subject.Organization[0] != "Example" {
+		t.Fatalf("Wrong bootstrapped certificates %v", web.Crt.Subject)
+	}
+	os.Setenv("WEBCA_CA_NAME", "Another CA")
+	defer os.Unsetenv("WEBCA_CA_NAME")
+	dieOnError(t, BootstrapSetup())
+	if FindCert("Another CA") != nil {
+		t.Fatal("Setup bootstrapped twice")
+	}
+}
@@ -0,0 +1,291 @@
+package webca
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	BULK_MAX_UPLOAD = 1 << 20 // 1MB of CSV is plenty of certificates
+)
+
+// BulkEntry is a certificate requested on a bulk CSV upload
+type BulkEntry struct {
+	Name string
+	SANs []string
+}
+
+// BulkResult is the outcome of issuing a BulkEntry
+type BulkResult struct {
+	BulkEntry
+	Error string
+}
+
+// parseBulkCSV reads bulk entries from CSV lines like: common name, alternative names...
+// Empty lines, lines starting with # and a "CN" or "CommonName" header line are skipped
+func parseBulkCSV(r io.Reader) ([]BulkEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	entries := make([]BulkEntry, 0)
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s", tr("Wrong CSV on line %d: %s", line, err))
+		}
+		name := strings.TrimSpace(record[0])
+		if name == "" || (len(entries) == 0 &&
+			(strings.EqualFold(name, "CN") || strings.EqualFold(name, "CommonName"))) {
+			continue
+		}
+		entry := BulkEntry{Name: name, SANs: make([]string, 0)}
+		for _, field := range record[1:] {
+			entry.SANs = append(entry.SANs, splitSANs(field)...)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s", tr("No certificates found on the CSV!"))
+	}
+	return entries, nil
+}
+
+// BulkIssue issues a certificate signed by ca for each entry, following the given profile
+// (if any). Failures are reported per entry and don't stop the rest of the batch
+func BulkIssue(ca *Cert, entries []BulkEntry, p Period, prof *Profile) []BulkResult {
+	results := make([]BulkResult, 0, len(entries))
+	for _, entry := range entries {
+		result := BulkResult{BulkEntry: entry}
+		if FindCert(entry.Name) != nil {
+			result.Error = tr("Certificate %s already exists!", entry.Name)
+		} else {
+			name := copyName(ca.Crt.Subject)
+			name.CommonName = entry.Name
+			if _, err := IssueCert(ca, name, p, prof, entry.SANs...); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// BatchResult is the outcome of renewing or revoking a certificate of a batch
+type BatchResult struct {
+	Name  string
+	Error string
+}
+
+// BatchRenew renews each certificate, with new key pairs if rekey is set. Failures are reported per
+// certificate and don't stop the rest of the batch
+func BatchRenew(certs []*Cert, rekey bool) []BatchResult {
+	results := make([]BatchResult, 0, len(certs))
+	for _, c := range certs {
+		result := BatchResult{Name: c.Crt.Subject.CommonName}
+		if _, err := RenewCert(c, rekey); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// BatchRevoke revokes each certificate for the reason. Failures are reported per certificate and
+// don't stop the rest of the batch
+func BatchRevoke(certs []*Cert, reason int) []BatchResult {
+	results := make([]BatchResult, 0, len(certs))
+	for _, c := range certs {
+		result := BatchResult{Name: c.Crt.Subject.CommonName}
+		if err := RevokeCert(c, reason); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// writeZip packs the given certificates into a ZIP file, with the keys (when available) of those
+// withKey is true for
+func writeZip(w io.Writer, certs []*Cert, withKey func(c *Cert) bool) error {
+	zw := zip.NewWriter(w)
+	for _, c := range certs {
+		files := []string{certFile(*c)}
+		if c.Key != nil && withKey(c) {
+			files = append(files, keyFile(*c))
+		}
+		for _, file := range files {
+			data, err := storage.Get(file)
+			if err != nil {
+				return err
+			}
+			f, err := zw.Create(path.Base(file))
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// readBulkCSV reads the CSV from the uploaded file or, if there is none, the pasted text
+func readBulkCSV(r *http.Request) ([]BulkEntry, error) {
+	if file, _, err := r.FormFile("CSVFile"); err == nil {
+		defer file.Close()
+		return parseBulkCSV(io.LimitReader(file, BULK_MAX_UPLOAD))
+	}
+	return parseBulkCSV(strings.NewReader(r.FormValue("CSV")))
+}
+
+// bulk allows the web user to issue a batch of certificates under a CA from a CSV
+func bulk(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	parent := r.FormValue("parent")
+	profile := r.FormValue("profile")
+	validity := &CertSetup{}
+	if r.Method == "POST" {
+		r.ParseMultipartForm(BULK_MAX_UPLOAD)
+		ca, err := FindCertOrFail(parent)
+		var cs *CertSetup
+		var entries []BulkEntry
+		if err == nil {
+			cs, err = readCertSetup("Cert", r)
+		}
+		var period Period
+		if err == nil {
+			validity = cs
+			period, err = cs.Period()
+		}
+		if err == nil {
+			entries, err = readBulkCSV(r)
+		}
+		if err == nil {
+			results := BulkIssue(ca, entries, period, LoadConfig().getProfile(profile))
+			issued := 0
+			for _, result := range results {
+				if result.Error == "" {
+					issued++
+					LoadConfig().setOwner(result.Name, requestUser(w, r).Username)
+					auditRequest(w, r, AUDIT_ISSUE, result.Name)
+				}
+			}
+			ps["CA"] = ca
+			ps["Results"] = results
+			ps["Issued"] = issued
+			err := templatesFor(r).ExecuteTemplate(w, "bulkResults", ps)
+			handleError(w, r, err)
+			return
+		}
+		ps["Error"] = err.Error()
+		ps["CSV"] = r.FormValue("CSV")
+	}
+	ps["parent"] = parent
+	ps["CAs"] = visibleCerts(requestOrg(r), Authorities())
+	ps["Validity"] = validity
+	setProfiles(ps, profile)
+	err := templatesFor(r).ExecuteTemplate(w, "bulk", ps)
+	handleError(w, r, err)
+}
+
+// bulkZip downloads the requested certificates and keys as a single ZIP file
+func bulkZip(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	certs := make([]*Cert, 0)
+	for _, name := range r.Form["name"] {
+		c, err := FindCertOrFail(name)
+		if handleError(w, r, err) {
+			return
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		handleError(w, r, fmt.Errorf("%s", tr("Nothing to download!")))
+		return
+	}
+	withKey := func(c *Cert) bool { return c.Key != nil && keysAllowed(w, r, c.Crt.Subject.CommonName) }
+	for _, c := range certs {
+		if withKey(c) {
+			auditRequest(w, r, AUDIT_KEY_DOWNLOAD, certObject(c.Crt)+" zip")
+		}
+	}
+	w.Header().Set("Content-disposition", "attachment; filename=certificates.zip")
+	w.Header().Set("Content-type", "application/zip")
+	handleError(w, r, writeZip(w, certs, withKey))
+}
+
+// batch renews or revokes the certificates selected on the index at once, the CAs only for the
+// admins, and shows how each one went
+func batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	r.ParseForm()
+	u := requestUser(w, r)
+	certs := make([]*Cert, 0)
+	denied := make([]BatchResult, 0)
+	for _, name := range r.Form["cert"] {
+		c, err := FindCertOrFail(name)
+		if err == nil && c.Crt.IsCA && (u == nil || !u.can(ROLE_ADMIN)) {
+			err = fmt.Errorf("%s", ps.tr("Access Denied"))
+		}
+		if err != nil {
+			denied = append(denied, BatchResult{name, err.Error()})
+		} else {
+			certs = append(certs, c)
+		}
+	}
+	if len(certs)+len(denied) == 0 {
+		handleError(w, r, fmt.Errorf("%s", ps.tr("No certificates selected!")))
+		return
+	}
+	var results []BatchResult
+	action := r.FormValue("action")
+	reason, _ := strconv.Atoi(r.FormValue("reason"))
+	switch action {
+	case "renew":
+		results = BatchRenew(certs, r.FormValue("rekey") != "")
+		ps["Title"] = ps.tr("Batch Renewal")
+	case "revoke":
+		results = BatchRevoke(certs, reason)
+		ps["Title"] = ps.tr("Batch Revocation")
+	default:
+		handleError(w, r, fmt.Errorf("%s", ps.tr("Unknown batch action %q", action)))
+		return
+	}
+	done := 0
+	for i, result := range results {
+		if result.Error != "" {
+			continue
+		}
+		done++
+		if action == "renew" {
+			auditRequest(w, r, AUDIT_RENEW, certObject(certs[i].Crt))
+		} else {
+			auditRequest(w, r, AUDIT_REVOKE, revokedObject(certs[i], reason))
+		}
+	}
+	ps["Results"] = append(results, denied...)
+	ps["Done"] = done
+	err := templatesFor(r).ExecuteTemplate(w, "batchResults", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,86 @@
+package webca
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBulk(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "BulkCA"}, ForDays(365))
+	dieOnError(t, err)
+	csv := "CN,SANs\n# comment\na.example.com, \"a1.example.com a2.example.com\", 10.0.0.1\n\n" +
+		"b.example.com\nBulkCA\n"
+	entries, err := parseBulkCSV(strings.NewReader(csv))
+	dieOnError(t, err)
+	if len(entries) != 3 || strings.Join(entries[0].SANs, ",") != "a1.example.com,a2.example.com,10.0.0.1" {
+		t.Fatalf("Unexpected bulk entries: %v", entries)
+	}
+	results := BulkIssue(ca, entries, ForDays(30), nil)
+	if results[0].Error != "" || results[1].Error != "" || results[2].Error == "" {
+		t.Fatalf("Unexpected bulk results: %v", results)
+	}
+	a := FindCert("a.example.com")
+	if a == nil || len(a.Crt.IPAddresses) != 1 || a.Parent.Crt.Subject.CommonName != "BulkCA" {
+		t.Fatalf("Bulk certificate not issued properly: %v", a)
+	}
+	var buf bytes.Buffer
+	dieOnError(t, writeZip(&buf, []*Cert{a}, func(c *Cert) bool { return true }))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	dieOnError(t, err)
+	if len(zr.File) != 2 {
+		t.Fatalf("Expected the certificate and its key on the ZIP but got %d files", len(zr.File))
+	}
+	if _, err := parseBulkCSV(strings.NewReader("CN\n")); err == nil {
+		t.Fatal("An empty CSV should fail!")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "BatchCA"}, ForDays(365))
+	dieOnError(t, err)
+	one, err := GenCert(ca, "one", ForDays(30))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "two", ForDays(30))
+	dieOnError(t, err)
+	post := func(form url.Values) string {
+		req := httptest.NewRequest("POST", "/batch", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		batch(w, req)
+		return w.Body.String()
+	}
+
+	page := post(url.Values{"cert": {"one", "two", "BatchCA"}, "action": {"renew"}})
+	if !strings.Contains(page, "2 of 3 certificates done.") || !strings.Contains(page, "Access Denied") {
+		t.Fatalf("Wrong batch renewal:\n%s", page)
+	}
+	if renewed := FindCert("one"); renewed.Crt.SerialNumber.Cmp(one.Crt.SerialNumber) == 0 {
+		t.Fatal("Certificate not renewed")
+	}
+	if FindCert("BatchCA").Crt.SerialNumber.Cmp(ca.Crt.SerialNumber) != 0 {
+		t.Fatal("CA renewed without the admin role")
+	}
+	page = post(url.Values{"cert": {"one", "ghost"}, "action": {"revoke"}, "reason": {"4"}})
+	if rv := Revoked(FindCert("one")); rv == nil || rv.Reason != 4 || !strings.Contains(page, "1 of 2 certificates done.") {
+		t.Fatalf("Wrong batch revocation %v:\n%s", rv, page)
+	}
+	if Revoked(FindCert("two")) != nil {
+		t.Fatal("Certificate not selected revoked")
+	}
+	w := httptest.NewRecorder()
+	batch(w, httptest.NewRequest("GET", "/batch?cert=two&action=revoke", nil))
+	if w.Code != http.StatusMethodNotAllowed || Revoked(FindCert("two")) != nil {
+		t.Fatalf("Batch run on a GET: %d", w.Code)
+	}
+}
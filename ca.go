@@ -2,16 +2,16 @@ package webca
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"math/big"
 	"os"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -20,22 +20,34 @@ import (
 const (
 	CERT_SUFFIX = ".pem"
 	KEY_SUFFIX  = ".key.pem"
+	DER_SUFFIX  = ".der"
+	CRT_SUFFIX  = ".crt" // DER too, as expected by Windows
 	MYFMT       = "2006/01/02"
+	BACKDATE    = 5 * time.Minute // tolerated clock skew for new certificates
 )
 
 // Cert holds the certificate the key and links to parent and children
 type Cert struct {
 	Crt    *x509.Certificate
-	Key    *rsa.PrivateKey
+	Key    crypto.Signer
 	Parent *Cert   // parent (CA) cert if any
 	Childs []*Cert // children (CA) certs if any
 }
 
 // Certree holds a certificate tree
 type Certree struct {
-	names   map[string]*Cert
-	roots   []*Cert
-	foreign []*Cert
+	names        map[string]*Cert
+	serials      map[string]*Cert
+	fingerprints map[string]*Cert // by fingerprintKey
+	expiries     []*Cert          // by expiry, the soonest first
+	roots        []*Cert
+	foreign      []*Cert
+}
+
+// Period is a certificate validity period
+type Period struct {
+	NotBefore, NotAfter time.Time
+	Backdate            time.Duration // NotBefore was moved back by it for the clock skew
 }
 
 // certree in memory
@@ -44,39 +56,112 @@ var certree *Certree
 // certree access lock
 var scerts sync.RWMutex
 
-// GenCACert generates a CA Certificate, that is a self signed certificate
-func GenCACert(name pkix.Name, days int) (*Cert, error) {
-	cert, err := genCert(nil, name, days)
-	if err != nil {
-		return nil, err
+// ForDays returns a validity Period starting now and lasting the given days
+func ForDays(days int) Period {
+	now := time.Now()
+	return Period{now.Add(-BACKDATE).UTC(), now.AddDate(0, 0, days).UTC(), BACKDATE}
+}
+
+// ForDuration returns a validity Period starting now and lasting d
+func ForDuration(d time.Duration) Period {
+	now := time.Now()
+	return Period{now.Add(-BACKDATE).UTC(), now.Add(d).UTC(), BACKDATE}
+}
+
+// Duration returns how long the Period lasts, not counting the clock skew backdating
+func (p Period) Duration() time.Duration {
+	return p.NotAfter.Sub(p.NotBefore) - p.Backdate
+}
+
+// certPeriod returns the validity Period of the certificate, backdated if it lasts whole hours
+// once BACKDATE is taken out, as those issued for some days or hours
+func certPeriod(crt *x509.Certificate) Period {
+	p := Period{NotBefore: crt.NotBefore, NotAfter: crt.NotAfter}
+	if d := p.Duration() - BACKDATE; d > 0 && d%time.Hour == 0 {
+		p.Backdate = BACKDATE
 	}
-	certree = nil // forces full reload later
-	return cert, nil
+	return p
 }
 
-// CenCert generates a Certificate signed by another certificate
-func GenCert(parent *Cert, certname string, days int) (*Cert, error) {
+// GenCACert generates a CA Certificate, that is a self signed certificate
+func GenCACert(name pkix.Name, p Period) (*Cert, error) {
+	return IssueCert(nil, name, p, nil)
+}
+
+// CenCert generates a Certificate signed by another certificate,
+// optionally with some Subject Alternative Names (DNS names, IPs, emails or URIs)
+func GenCert(parent *Cert, certname string, p Period, sans ...string) (*Cert, error) {
 	name := copyName(parent.Crt.Subject)
 	name.CommonName = certname
-	cert, err := genCert(parent, name, days)
-	if err != nil {
-		return nil, err
-	}
-	certree = nil // forces full reload later
-	return cert, nil
+	return IssueCert(parent, name, p, nil, sans...)
 }
 
-// RenewCert renews the given certificate for the same duration as before from now
-func RenewCert(cert *Cert) (*Cert, error) {
-	days := int(cert.Crt.NotAfter.Sub(cert.Crt.NotBefore).Hours() / 24)
-	cert, err := genCert(cert.Parent, cert.Crt.Subject, days)
+// RenewCert renews the given certificate for the same duration as before from now,
+// keeping the same key pair unless rekey is set, alternative names and extensions.
+// The previous certificate is archived and kept available until it expires.
+func RenewCert(cert *Cert, rekey bool) (*Cert, error) {
+	parent := cert.Parent
+	if parent == cert { // roots are their own parent
+		parent = nil
+	}
+	key := cert.Key
+	if rekey {
+		key = nil
+	}
+	tmpl := RenewTemplate(cert, rekey)
+	if err := archiveCert(cert); err != nil {
+		return nil, err
+	}
+	cert, err := genCert(parent, tmpl, key)
 	if err != nil {
 		return nil, err
 	}
-	certree = nil // forces full reload later
+	publish(EVENT_RENEW, cert.Crt)
 	return cert, nil
 }
 
+// RenewTemplate returns the template a renewal of cert would be generated from:
+// everything but the serial number and validity is copied from the current certificate
+// (the Subject Key Id is only kept when the key pair is reused)
+func RenewTemplate(cert *Cert, rekey bool) *x509.Certificate {
+	old := cert.Crt
+	p := ForDuration(old.NotAfter.Sub(old.NotBefore) - BACKDATE) // the whole validity is kept
+	tmpl := &x509.Certificate{
+		Subject:                     old.Subject,
+		NotBefore:                   p.NotBefore,
+		NotAfter:                    p.NotAfter,
+		KeyUsage:                    old.KeyUsage,
+		ExtKeyUsage:                 old.ExtKeyUsage,
+		UnknownExtKeyUsage:          old.UnknownExtKeyUsage,
+		BasicConstraintsValid:       old.BasicConstraintsValid,
+		IsCA:                        old.IsCA,
+		MaxPathLen:                  old.MaxPathLen,
+		MaxPathLenZero:              old.MaxPathLenZero,
+		DNSNames:                    old.DNSNames,
+		EmailAddresses:              old.EmailAddresses,
+		IPAddresses:                 old.IPAddresses,
+		URIs:                        old.URIs,
+		PermittedDNSDomainsCritical: old.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         old.PermittedDNSDomains,
+		ExcludedDNSDomains:          old.ExcludedDNSDomains,
+		PermittedIPRanges:           old.PermittedIPRanges,
+		ExcludedIPRanges:            old.ExcludedIPRanges,
+		PermittedEmailAddresses:     old.PermittedEmailAddresses,
+		ExcludedEmailAddresses:      old.ExcludedEmailAddresses,
+		PermittedURIDomains:         old.PermittedURIDomains,
+		ExcludedURIDomains:          old.ExcludedURIDomains,
+		OCSPServer:                  old.OCSPServer,
+		IssuingCertificateURL:       old.IssuingCertificateURL,
+		CRLDistributionPoints:       old.CRLDistributionPoints,
+		PolicyIdentifiers:           old.PolicyIdentifiers,
+		ExtraExtensions:             customExtensions(old),
+	}
+	if !rekey {
+		tmpl.SubjectKeyId = old.SubjectKeyId
+	}
+	return tmpl
+}
+
 // ListCerts returns the current Certree
 func ListCerts() *Certree {
 	return autoload()
@@ -87,17 +172,41 @@ func FindCert(certname string) *Cert {
 	autoload()
 	scerts.RLock()
 	defer scerts.RUnlock()
+	if certree == nil {
+		return nil
+	}
 	return certree.names[certname]
 }
 
+// Authorities returns all CAs able to sign certificates (those with a key), ordered by name
+func Authorities() []*Cert {
+	autoload()
+	scerts.RLock()
+	defer scerts.RUnlock()
+	cas := make([]*Cert, 0)
+	if certree == nil {
+		return cas
+	}
+	for _, c := range certree.names {
+		if c.Crt.IsCA && c.Key != nil {
+			cas = place(cas, c)
+		}
+	}
+	return cas
+}
+
 // ReadCert reads the Certificate Contents
 func ReadCert(cert *Cert) ([]byte, error) {
-	return ioutil.ReadFile(certFile(*cert))
+	return storage.Get(certFile(*cert))
 }
 
-// ReadCertKey reads the Certificate Key contents
+// ReadCertKey reads the Certificate Key contents, decrypted if stored with the master key
 func ReadCertKey(cert *Cert) ([]byte, error) {
-	return ioutil.ReadFile(keyFile(*cert))
+	data, err := storage.Get(keyFile(*cert))
+	if err != nil {
+		return nil, err
+	}
+	return plainKey(data)
 }
 
 // CloneCert generates a clone of the original certificate with a new name
@@ -107,26 +216,75 @@ func CloneCert(cert *Cert, newname string) *Cert {
 	return c
 }
 
-// DeleteCert deletes a certificate
+// DeleteCert deletes a certificate, moving it to the trash
 func DeleteCert(cert *Cert) bool {
-	scerts.Lock()
-	defer scerts.Unlock()
-	if err := os.Remove(certFile(*cert)); err != nil {
+	if err := trashCerts(cert); err != nil {
+		log.Printf("(Warning) Can't delete %s: %s", cert.Crt.Subject.CommonName, err)
 		return false
 	}
-	if err := os.Remove(keyFile(*cert)); err != nil {
-		return false
-	}
-	certree = nil // forces full reload later
+	publish(EVENT_DELETE, cert.Crt)
 	return true
 }
 
-// autoload will autoload certree
+// removeCert removes the certificate and key (if any) files
+func removeCert(cert *Cert) bool {
+	err := storage.Tx(func(tx Storage) error {
+		return deleteCertFiles(tx, cert)
+	})
+	return err == nil
+}
+
+// DeleteTree deletes a certificate with all the ones below it, the deepest first and all or
+// none of them, moving them to the trash and returning them
+func DeleteTree(cert *Cert) ([]*Cert, error) {
+	scerts.RLock()
+	doomed := subtree(cert, make(map[*Cert]bool))
+	scerts.RUnlock()
+	if err := trashCerts(doomed...); err != nil {
+		return nil, err
+	}
+	for _, c := range doomed {
+		publish(EVENT_DELETE, c.Crt)
+	}
+	return doomed, nil
+}
+
+// subtree returns the certificates below cert depth first, then cert itself
+func subtree(cert *Cert, seen map[*Cert]bool) []*Cert {
+	seen[cert] = true
+	certs := make([]*Cert, 0)
+	for _, child := range cert.Childs {
+		if !seen[child] {
+			certs = append(certs, subtree(child, seen)...)
+		}
+	}
+	return append(certs, cert)
+}
+
+// deleteCertFiles deletes the certificate and key (if any) files within the transaction
+func deleteCertFiles(tx Storage, cert *Cert) error {
+	if err := tx.Delete(certFile(*cert)); err != nil {
+		return err
+	}
+	if err := tx.Delete(keyFile(*cert)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// autoload will autoload certree, or bring it up to date with the certificate files changed since
 func autoload() *Certree {
 	scerts.Lock()
 	defer scerts.Unlock()
+	changed := takeCertChanges()
+	if certree != nil && len(changed) > 0 && !certree.update(changed) {
+		certree = nil
+	}
 	if certree == nil {
-		certree = loadCertree(".")
+		certree = loadCertree("")
+		if certree != nil {
+			indexSerials(certree.serials)
+		}
 	}
 	return certree
 }
@@ -157,73 +315,90 @@ func prepareName(name *pkix.Name) {
 	}
 }
 
-// genCert generates a certificated signed by itself or by another certificate
-func genCert(p *Cert, name pkix.Name, days int) (*Cert, error) {
+// newTemplate returns a certificate template for the given name, validity and alternative names
+func newTemplate(name pkix.Name, period Period, sans []string) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		Subject:   name,
+		NotBefore: period.NotBefore,
+		NotAfter:  period.NotAfter,
+		KeyUsage:  x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	setSANs(tmpl, sans)
+	return tmpl
+}
+
+// genCert generates a certificate from the template signed by itself or by another certificate
+// (a new key pair is generated unless one is given)
+func genCert(p *Cert, tmpl *x509.Certificate, key crypto.Signer) (*Cert, error) {
 	t := &Cert{}
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to generate private key: %s", err)
+	if key == nil {
+		var err error
+		key, err = newKey(tmpl.Subject.CommonName, p == nil || tmpl.IsCA, DEFAULT_KEY_TYPE, DEFAULT_KEY_BITS)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate private key: %s", err)
+		}
 	}
-	now := time.Now()
-	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(9223372036854775807))
-	ski := []byte{0, 0, 0, 0}
-	rand.Reader.Read(ski)
+	if keyType(key) != RSA { // only RSA keys can encipher other keys
+		tmpl.KeyUsage &^= x509.KeyUsageKeyEncipherment
+	}
+	if !tmpl.NotAfter.After(tmpl.NotBefore) {
+		return nil, fmt.Errorf("%s", tr("The certificate must expire after it starts being valid!"))
+	}
+	name := tmpl.Subject
+	serial, err := newSerial(name.CommonName)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to generate random serial number: %s", err)
+		return nil, err
 	}
-	//log.Println("serial:", serial)
-	//log.Println("ski:", ski)
-	t.Crt = &x509.Certificate{
-		SerialNumber: serial,
-		Subject:      name,
-		NotBefore:    now.Add(-5 * time.Minute).UTC(),
-		NotAfter:     now.AddDate(0, 0, days).UTC(), // valid for days
-
-		SubjectKeyId: ski,
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	tmpl.SerialNumber = serial
+	if tmpl.SubjectKeyId == nil {
+		ski := []byte{0, 0, 0, 0}
+		rand.Reader.Read(ski)
+		tmpl.SubjectKeyId = ski
 	}
+	t.Crt = tmpl
 	t.Key = key
 	if p == nil {
 		t.Crt.BasicConstraintsValid = true
 		t.Crt.IsCA = true
 		t.Crt.MaxPathLen = 0
-		t.Crt.KeyUsage = t.Crt.KeyUsage | x509.KeyUsageCertSign
+		t.Crt.KeyUsage = t.Crt.KeyUsage | x509.KeyUsageCertSign | x509.KeyUsageCRLSign
 		p = t
-		//log.Println("t.Key.PublicKey=", t.Key.PublicKey)
-		//log.Println("p.Key=", t.Key)
 	} else {
 		t.Parent = p
 	}
 
-	certname := name.CommonName + CERT_SUFFIX
-	keyname := name.CommonName + KEY_SUFFIX
+	certname := filename(name.CommonName) + CERT_SUFFIX
+	keyname := filename(name.CommonName) + KEY_SUFFIX
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, t.Crt, p.Crt, &t.Key.PublicKey, p.Key)
+	derBytes, err := createCertificate(t.Crt, p, t.Key.Public())
 	//log.Println("Generated:", tmpl)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create Certificate: %s", err)
 	}
+	if t.Crt, err = x509.ParseCertificate(derBytes); err != nil {
+		return nil, fmt.Errorf("Failed to parse the new Certificate: %s", err)
+	}
 
-	certOut, err := os.Create(certname)
+	block, err := sealKey(t.Key)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open "+certname+" for writing: %s", err)
+		return nil, fmt.Errorf("Failed to encode the key for "+keyname+": %s", err)
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	certOut.Close()
-	//log.Print("Written " + certname + "\n")
-
-	keyOut, err := os.OpenFile(keyname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	err = storage.Tx(func(tx Storage) error {
+		if err := tx.Put(certname, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), false); err != nil {
+			return fmt.Errorf("Failed to write "+certname+": %s", err)
+		}
+		if err := tx.Put(keyname, pem.EncodeToMemory(block), true); err != nil {
+			return fmt.Errorf("Failed to write "+keyname+": %s", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open "+keyname+" for writing: %s", err)
+		return nil, err
 	}
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(t.Key)})
-	keyOut.Close()
-	//log.Print("Written " + keyname + "\n")
 	return t, nil
 }
 
-// readCert loads a Cert and Key pair from disk .pem files
+// readCert loads a Cert and Key pair from the stored .pem files
 func readCert(name string) (*Cert, error) {
 	cert := Cert{}
 	kname := name
@@ -236,79 +411,62 @@ func readCert(name string) (*Cert, error) {
 	if !strings.HasSuffix(name, CERT_SUFFIX) {
 		name = name + CERT_SUFFIX
 	}
-	certIn, err := ioutil.ReadFile(name)
+	certIn, err := storage.Get(name)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open "+name+" for reading: %s", err)
 	}
 	b, _ := pem.Decode(certIn)
 	if b == nil {
-		return nil, fmt.Errorf("Failed to find a certificate in " + name)
+		return nil, fmt.Errorf("Failed to find a certificate in %s", name)
 	}
 	cert.Crt, err = x509.ParseCertificate(b.Bytes)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse certificate " + name)
+		return nil, fmt.Errorf("Failed to parse certificate %s", name)
 	}
-	_, err = os.Stat(kname)
+	keyIn, err := storage.Get(kname)
 	if os.IsNotExist(err) {
 		return &cert, nil
-	}
-	keyIn, err := ioutil.ReadFile(kname)
-	if err != nil {
+	} else if err != nil {
 		return nil, fmt.Errorf("Failed to open "+kname+" for reading: %s", err)
 	}
 	kb, _ := pem.Decode(keyIn)
 	if kb == nil {
-		return nil, fmt.Errorf("Failed to find a key in " + kname)
+		return nil, fmt.Errorf("Failed to find a key in %s", kname)
 	}
-	cert.Key, err = x509.ParsePKCS1PrivateKey(kb.Bytes)
+	cert.Key, err = openKey(kb)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse key " + kname)
+		return nil, fmt.Errorf("Failed to parse key %s: %s", kname, err)
 	}
 	return &cert, nil
 }
 
 // NewCertree generates an empty Certree
 func newCertree() *Certree {
-	return &Certree{make(map[string]*Cert), make([]*Cert, 0), make([]*Cert, 0)}
+	return &Certree{make(map[string]*Cert), make(map[string]*Cert), make(map[string]*Cert),
+		make([]*Cert, 0), make([]*Cert, 0), make([]*Cert, 0)}
 }
 
 // loadCertree will load all found .pem certs and keys on a Certree
 func loadCertree(dir string) *Certree {
 	ct := newCertree()
-	fi, err := os.Lstat(dir)
-	if err != nil {
-		log.Printf("(Warning) Failed to check path "+dir+":", err)
-		return nil
-	}
-	if !fi.IsDir() {
-		log.Printf("(Warning) Path " + dir + " is not a directory!")
-		return nil
-	}
-	f, err := os.Open(dir)
+	names, err := storage.List(dir)
 	if err != nil {
-		log.Printf("(Warning) Can't open "+dir+" for reading:", err)
+		log.Printf("(Warning) Can't read dir %s: %s", dir, err)
 		return nil
 	}
-	defer f.Close()
-	for fis, err := f.Readdir(100); err == nil; fis, err = f.Readdir(100) {
-		for _, fi := range fis {
-			if !fi.IsDir() && strings.HasSuffix(fi.Name(), CERT_SUFFIX) &&
-				!strings.HasSuffix(fi.Name(), KEY_SUFFIX) {
-				if crt, err := readCert(fi.Name()); err == nil {
-					ct.add(crt)
-				} else {
-					log.Printf("(Warning) %s", err)
-				}
+	for _, name := range names {
+		if strings.HasSuffix(name, CERT_SUFFIX) && !strings.HasSuffix(name, KEY_SUFFIX) {
+			if crt, err := readCert(path.Join(dir, name)); err == nil {
+				ct.add(crt)
+			} else {
+				log.Printf("(Warning) %s", err)
 			}
 		}
 	}
-	if err != nil {
-		log.Printf("(Warning) Can't read dir "+dir+":", err)
-		return nil
-	}
 	if len(ct.roots) == 0 && len(ct.foreign) == 0 {
 		return nil
 	}
+	ct.indexExpiries()
 	return ct
 }
 
@@ -319,9 +477,16 @@ func (ct *Certree) add(crt *Cert) {
 		ct.names[crt.Crt.Subject.CommonName] = crt
 		cn = crt
 	} else { // update cert info otherwise
+		delete(ct.fingerprints, fingerprintKey(Fingerprint(cn.Crt)))
 		cn.Crt = crt.Crt
 		cn.Key = crt.Key
 	}
+	if crt.Crt.SerialNumber != nil {
+		ct.serials[serialKey(crt.Crt.SerialNumber)] = cn
+	}
+	if len(crt.Crt.Raw) > 0 {
+		ct.fingerprints[fingerprintKey(Fingerprint(crt.Crt))] = cn
+	}
 	// if root just place it and we are done
 	if crt.Crt.Subject.CommonName == crt.Crt.Issuer.CommonName {
 		cn.Parent = cn
@@ -385,6 +550,66 @@ func remove(childs []*Cert, kid *Cert) []*Cert {
 	return childs // not found, we return the same list
 }
 
+// CertNode is a certificate of the inventory tree with the ones issued under it
+type CertNode struct {
+	*Cert
+	CanIssue bool        // a CA with its key, so more certificates can be added under it
+	Nodes    []*CertNode // issued CAs first, then leaf certificates, each by name
+}
+
+// Tree returns the inventory as the trees of the local roots and the foreign ones, each holding
+// its intermediate CAs and leaf certificates
+func (ct *Certree) Tree() (local, foreign []*CertNode) {
+	local, foreign = make([]*CertNode, 0), make([]*CertNode, 0)
+	if ct == nil {
+		return local, foreign
+	}
+	scerts.RLock()
+	defer scerts.RUnlock()
+	seen := make(map[*Cert]bool)
+	for _, c := range ct.roots {
+		local = append(local, treeNode(c, seen))
+	}
+	for _, c := range ct.foreign {
+		if !seen[c] {
+			foreign = append(foreign, treeNode(c, seen))
+		}
+	}
+	return local, foreign
+}
+
+// Subtree returns the tree of the certificate and the ones below it
+func Subtree(cert *Cert) *CertNode {
+	scerts.RLock()
+	defer scerts.RUnlock()
+	return treeNode(cert, make(map[*Cert]bool))
+}
+
+// Size returns the number of certificates of the tree
+func (n *CertNode) Size() int {
+	size := 1
+	for _, child := range n.Nodes {
+		size += child.Size()
+	}
+	return size
+}
+
+// treeNode returns the node of the certificate with its children's, skipping the ones already
+// seen so re-parented certificates are only shown once
+func treeNode(c *Cert, seen map[*Cert]bool) *CertNode {
+	seen[c] = true
+	node := &CertNode{Cert: c, CanIssue: c.Crt.IsCA && c.Key != nil, Nodes: make([]*CertNode, 0)}
+	for _, child := range c.Childs {
+		if !seen[child] {
+			node.Nodes = append(node.Nodes, treeNode(child, seen))
+		}
+	}
+	sort.SliceStable(node.Nodes, func(i, j int) bool {
+		return node.Nodes[i].Crt.IsCA && !node.Nodes[j].Crt.IsCA
+	})
+	return node
+}
+
 // String will return the recursive string representation for a Cert
 func (c *Cert) String() string {
 	return printCert(c, "  ")
@@ -421,7 +646,7 @@ func (ct *Certree) String() string {
 // handleFatal will show the fatal error and exit inmediatelly
 func handleFatal(err error) {
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatalf("(Error) %s", err)
 	}
 }
 
@@ -435,15 +660,23 @@ func keyFile(crt Cert) string {
 	return filename(crt.Crt.Subject.CommonName) + KEY_SUFFIX
 }
 
-// filename filters a name to make sure is a legal filename
+// filename returns the name as a legal filename of the top directory, escaping as %XX the path
+// separators, the characters forbidden by some file systems, the escape itself and a leading dot,
+// so that different names never share a file
 func filename(name string) string {
-	return name // TODO ensure result is a proper filename without forbidden chars
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < ' ' || c == 0x7f || strings.IndexByte(`/\%:*?"<>|`, c) >= 0 || (i == 0 && c == '.') {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
 }
 
 // showPeriod shows the period of a Certificate
 func showPeriod(crt *x509.Certificate) string {
-	from := crt.NotBefore.Format(MYFMT)
-	to := crt.NotAfter.Format(MYFMT)
-	duration := int(crt.NotAfter.Sub(time.Now()).Hours() / 24)
-	return tr("From %s to %s (%ddays to go)", from, to, duration)
+	return catalog(nil).showPeriod(crt, time.Local)
 }
@@ -1,10 +1,16 @@
 package webca
 
 import (
+	"bytes"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func NewCert(name string, childs ...*Cert) *Cert {
@@ -15,7 +21,7 @@ func NewCert(name string, childs ...*Cert) *Cert {
 }
 
 func loadTestData() *Certree {
-	ct := NewCertree()
+	ct := newCertree()
 	ct.roots = []*Cert{
 		NewCert("TestCA1",
 			NewCert("Intermediate1",
@@ -36,38 +42,50 @@ func loadTestData() *Certree {
 	return ct
 }
 
-func gen(t *testing.T, cert *Cert) *Cert {
+func genTree(t *testing.T, cert *Cert) *Cert {
 	var gcert *Cert
 	var err error
 	if cert.Parent == nil {
-		gcert, err = GenCACert(cert.Crt.Subject, 1095)
+		gcert, err = GenCACert(cert.Crt.Subject, ForDays(1095))
 		dieOnError(t, err)
 	} else {
-		gcert, err = GenCert(cert.Parent, cert.Crt.Subject.CommonName, 1095)
+		gcert, err = GenCert(cert.Parent, cert.Crt.Subject.CommonName, ForDays(1095))
 		dieOnError(t, err)
 	}
 	for i, crt := range cert.Childs {
 		crt.Parent = gcert
-		cert.Childs[i] = gen(t, crt)
+		cert.Childs[i] = genTree(t, crt)
 	}
 	cert.Crt = gcert.Crt
 	cert.Key = gcert.Key
 	return cert
 }
 
+// inTestDir runs the test in a new tests directory, removed once the test is over, without the
+// certificates loaded by the previous tests
+func inTestDir(t *testing.T) {
+	dieOnError(t, os.MkdirAll("tests", 0750))
+	dieOnError(t, os.Chdir("tests"))
+	certree = nil
+	t.Cleanup(func() {
+		dieOnError(t, os.Chdir(".."))
+		dieOnError(t, os.RemoveAll("tests"))
+	})
+}
+
 func TestCA(t *testing.T) {
 	ct0 := loadTestData()
 	dieOnError(t, os.MkdirAll("tests", 0750))
 	dieOnError(t, os.Chdir("tests"))
 	for i, crt := range ct0.roots {
-		ct0.roots[i] = gen(t, crt)
+		ct0.roots[i] = genTree(t, crt)
 	}
 	for _, crt := range ct0.foreign {
-		gen(t, crt)
+		genTree(t, crt)
 	}
 	dieOnError(t, os.Remove("SomeCA0.key.pem"))
 	dieOnError(t, os.Remove("SomeCA1.key.pem"))
-	ct := LoadCertree(".")
+	ct := loadCertree(".")
 	s0 := ct0.String()
 	s := ct.String()
 	if s != s0 {
@@ -85,3 +103,261 @@ func TestCA(t *testing.T) {
 	//certTree = LoadCertTree(".")
 	//log.Print("Renewed CertTree:\n", certTree)
 }
+
+func TestFilename(t *testing.T) {
+	inTestDir(t)
+	for name, file := range map[string]string{"www.example.com": "www.example.com", "a/b": "a%2Fb",
+		"a%2Fb": "a%252Fb", "..": "%2E.", `..\..\x`: "%2E.%5C..%5Cx", "C:x*": "C%3Ax%2A"} {
+		if filename(name) != file {
+			t.Errorf("Wrong filename of %q: %q", name, filename(name))
+		}
+	}
+	defer func(saved *Certree) { certree = saved }(certree)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "../FileCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "a/b", ForDays(30))
+	dieOnError(t, err)
+	for _, file := range []string{"%2E.%2FFileCA" + CERT_SUFFIX, "%2E.%2FFileCA" + KEY_SUFFIX, "a%2Fb" + CERT_SUFFIX} {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("The certificate was not stored in its own file: %v", err)
+		}
+	}
+	certree = nil
+	if c := FindCert("a/b"); c == nil || c.Parent == nil || c.Parent.Crt.Subject.CommonName != "../FileCA" {
+		t.Fatalf("The certificates were not loaded back: %v", c)
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	cs := &CertSetup{Duration: 12, Unit: HOURS}
+	p, err := cs.Period()
+	dieOnError(t, err)
+	if p.Duration() != 12*time.Hour {
+		t.Fatalf("Expected 12h validity but got %v", p.Duration())
+	}
+	if !p.NotBefore.Before(time.Now().Add(-BACKDATE / 2)) {
+		t.Fatal("NotBefore was not backdated to tolerate clock skew")
+	}
+	from := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	cs = &CertSetup{NotBefore: from, NotAfter: from.AddDate(0, 1, 0)}
+	p, err = cs.Period()
+	dieOnError(t, err)
+	if !p.NotBefore.Equal(from) || !p.NotAfter.Equal(from.AddDate(0, 1, 0)) || p.Duration() != 31*24*time.Hour {
+		t.Fatalf("Explicit validity was not respected: %v %v", p, p.Duration())
+	}
+	cs = &CertSetup{NotBefore: from, NotAfter: from.Add(-time.Hour)}
+	if _, err = cs.Period(); err == nil {
+		t.Fatal("Accepted a validity period ending before it starts!")
+	}
+
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "PeriodCA"}, ForDays(365))
+	dieOnError(t, err)
+	if d := certPeriod(ca.Crt).Duration(); d != 365*24*time.Hour && d != (365*24-1)*time.Hour && d != (365*24+1)*time.Hour {
+		t.Errorf("Wrong duration of the issued certificate: %v", d)
+	}
+	now := time.Now().Truncate(time.Second)
+	crt, err := GenCert(ca, "period.example.com", Period{NotBefore: now, NotAfter: now.Add(90*time.Minute + time.Second)})
+	dieOnError(t, err)
+	for i := 0; i < 2; i++ {
+		if d := certPeriod(crt.Crt).Duration(); d != 90*time.Minute+time.Second {
+			t.Fatalf("Wrong duration of the explicit period after %d renewals: %v", i, d)
+		}
+		crt, err = RenewCert(crt, false)
+		dieOnError(t, err)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "RenewCA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "renewserver", ForDays(30))
+	dieOnError(t, err)
+	renewed, err := RenewCert(crt, false)
+	dieOnError(t, err)
+	if !sameKey(renewed.Key, crt.Key) {
+		t.Fatal("Renewal without rekey changed the key pair!")
+	}
+	if renewed.Crt.SerialNumber.Cmp(crt.Crt.SerialNumber) == 0 {
+		t.Fatal("Renewal reused the serial number!")
+	}
+	rekeyed, err := RenewCert(renewed, true)
+	dieOnError(t, err)
+	if sameKey(rekeyed.Key, renewed.Key) {
+		t.Fatal("Renewal with rekey kept the same key pair!")
+	}
+	previous := PreviousCerts(rekeyed)
+	if len(previous) != 2 {
+		t.Fatalf("Expected the 2 previous versions to be archived but got %v", previous)
+	}
+	for _, p := range previous {
+		if p.Key == nil || !sameKey(p.Key, renewed.Key) {
+			t.Fatal("The replaced key pair was not archived!")
+		}
+	}
+	rootRenewed, err := RenewCert(FindCert("RenewCA"), false)
+	dieOnError(t, err)
+	if !rootRenewed.Crt.IsCA {
+		t.Fatal("Renewed CA is no longer a CA!")
+	}
+}
+
+func TestRenewKeepsExtensions(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "ExtCA"}, ForDays(365))
+	dieOnError(t, err)
+	tmpl := newTemplate(pkix.Name{CommonName: "extserver"}, ForDays(30),
+		[]string{"extserver.example.com", "10.0.0.1", "admin@example.com"})
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	custom := pkix.Extension{Id: []int{1, 3, 6, 1, 4, 1, 99999, 1}, Value: []byte{5, 0}}
+	tmpl.ExtraExtensions = []pkix.Extension{custom}
+	crt, err := genCert(ca, tmpl, nil)
+	dieOnError(t, err)
+	for _, change := range certChanges(crt.Crt, RenewTemplate(crt, false)) {
+		if change.Changed() && change.Name != "Valid From" && change.Name != "Valid Until" {
+			t.Errorf("Renewal would change %s from %q to %q", change.Name, change.Before, change.After)
+		}
+	}
+	renewed, err := RenewCert(crt, true)
+	dieOnError(t, err)
+	if strings.Join(SANs(renewed.Crt), ",") != "extserver.example.com,10.0.0.1,admin@example.com" {
+		t.Fatalf("Renewal lost the alternative names: %v", SANs(renewed.Crt))
+	}
+	if len(renewed.Crt.ExtKeyUsage) != 1 || renewed.Crt.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Fatalf("Renewal lost the extended key usage: %v", renewed.Crt.ExtKeyUsage)
+	}
+	exts := customExtensions(renewed.Crt)
+	if len(exts) != 1 || !exts[0].Id.Equal(custom.Id) {
+		t.Fatalf("Renewal lost the custom extension: %v", exts)
+	}
+}
+
+func TestCertServerDER(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "DERCA"}, ForDays(365))
+	dieOnError(t, err)
+	h := certServer(storage)
+	for _, file := range []string{"DERCA.der", "DERCA.crt"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/"+file, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-type") != "application/pkix-cert" ||
+			!bytes.Equal(w.Body.Bytes(), ca.Crt.Raw) {
+			t.Fatalf("%s was not served as DER: %d %s", file, w.Code, w.Header())
+		}
+	}
+	for _, file := range []string{"DERCA.key.der", "missing.der"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/"+file, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s should not be found but got %d", file, w.Code)
+		}
+	}
+}
+
+func TestCertTree(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	root, err := GenCACert(pkix.Name{CommonName: "TreeCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(root, "Alpha", ForDays(30))
+	dieOnError(t, err)
+	tmpl := newTemplate(pkix.Name{CommonName: "Middle CA"}, ForDays(90), nil)
+	tmpl.BasicConstraintsValid, tmpl.IsCA = true, true
+	tmpl.KeyUsage |= x509.KeyUsageCertSign
+	middle, err := genCert(root, tmpl, nil)
+	dieOnError(t, err)
+	_, err = GenCert(middle, "inner", ForDays(30))
+	dieOnError(t, err)
+	other, err := GenCACert(pkix.Name{CommonName: "OtherCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(other, "outside", ForDays(30))
+	dieOnError(t, err)
+	dieOnError(t, os.Remove(keyFile(*other)))
+	certree = nil
+
+	names := func(nodes []*CertNode) string {
+		ns := make([]string, 0)
+		for _, n := range nodes {
+			ns = append(ns, n.Crt.Subject.CommonName)
+		}
+		return strings.Join(ns, ",")
+	}
+	local, foreign := ListCerts().Tree()
+	if names(local) != "TreeCA" || !local[0].CanIssue || names(local[0].Nodes) != "Middle CA,Alpha" {
+		t.Fatalf("Wrong local tree: %s %v", names(local), local)
+	}
+	if m := local[0].Nodes[0]; !m.CanIssue || names(m.Nodes) != "inner" || local[0].Nodes[1].CanIssue {
+		t.Fatalf("Wrong intermediate: %s", names(m.Nodes))
+	}
+	if names(foreign) != "OtherCA" || foreign[0].CanIssue || names(foreign[0].Nodes) != "outside" {
+		t.Fatalf("Wrong foreign tree: %s", names(foreign))
+	}
+	var buf bytes.Buffer
+	dieOnError(t, templates.ExecuteTemplate(&buf, "certTree", local))
+	if page := buf.String(); strings.Count(page, "<details open>") != 2 ||
+		!strings.Contains(page, "Add more Certificates to Middle CA...") {
+		t.Fatalf("Wrong tree rendering:\n%s", page)
+	}
+	if l, f := (*Certree)(nil).Tree(); len(l) != 0 || len(f) != 0 {
+		t.Fatal("An empty inventory has some tree")
+	}
+}
+
+func TestDeleteTree(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{}
+	certree = nil
+	root, err := GenCACert(pkix.Name{CommonName: "DoomedCA"}, ForDays(365))
+	dieOnError(t, err)
+	tmpl := newTemplate(pkix.Name{CommonName: "DoomedSub"}, ForDays(90), nil)
+	tmpl.BasicConstraintsValid, tmpl.IsCA = true, true
+	tmpl.KeyUsage |= x509.KeyUsageCertSign
+	sub, err := genCert(root, tmpl, nil)
+	dieOnError(t, err)
+	_, err = GenCert(sub, "deep", ForDays(30))
+	dieOnError(t, err)
+	_, err = GenCert(root, "shallow", ForDays(30))
+	dieOnError(t, err)
+	_, err = GenCACert(pkix.Name{CommonName: "SafeCA"}, ForDays(365))
+	dieOnError(t, err)
+
+	names := make([]string, 0)
+	for _, c := range subtree(FindCert("DoomedCA"), make(map[*Cert]bool)) {
+		names = append(names, c.Crt.Subject.CommonName)
+	}
+	if strings.Join(names, ",") != "deep,DoomedSub,shallow,DoomedCA" {
+		t.Fatalf("Wrong deletion order %v", names)
+	}
+	call := func(method, confirm string) *httptest.ResponseRecorder {
+		form := url.Values{"cert": {"DoomedCA"}, "confirm": {confirm}}
+		req := httptest.NewRequest(method, "/delTree?"+form.Encode(), nil)
+		w := httptest.NewRecorder()
+		delTree(w, req)
+		return w
+	}
+	if page := call("GET", "").Body.String(); !strings.Contains(page, "These 4 certificates") ||
+		!strings.Contains(page, "deep") {
+		t.Fatalf("The subtree is not shown:\n%s", page)
+	}
+	if page := call("POST", "doomedca").Body.String(); !strings.Contains(page, "Type DoomedCA to confirm the deletion!") ||
+		FindCert("deep") == nil {
+		t.Fatal("Deleted without the typed confirmation")
+	}
+	if w := call("POST", "DoomedCA"); w.Code != http.StatusFound {
+		t.Fatalf("Not deleted: %d %s", w.Code, w.Body)
+	}
+	for _, name := range names {
+		if c := FindCert(name); c != nil && len(c.Crt.Raw) > 0 {
+			t.Errorf("%s not deleted", name)
+		}
+		if _, err := os.Stat(name + CERT_SUFFIX); !os.IsNotExist(err) {
+			t.Errorf("%s file not deleted", name)
+		}
+	}
+	if FindCert("SafeCA") == nil {
+		t.Fatal("Deleted another CA")
+	}
+}
@@ -0,0 +1,124 @@
+package webca
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A minimal CBOR (RFC 8949) decoder for the WebAuthn attestations and COSE keys: integers, byte
+// and text strings, arrays, maps and simple values, all of definite length
+
+const CBOR_MAX_DEPTH = 16
+
+// cborDecode returns the first CBOR item of data and the bytes following it. Integers are int64,
+// byte strings []byte, text strings string, arrays []interface{}, maps map[interface{}]interface{}
+// and simple values bool or nil
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborItem(data, 0)
+}
+
+// cborItem decodes an item at the given nesting depth
+func cborItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > CBOR_MAX_DEPTH {
+		return nil, nil, fmt.Errorf("CBOR nested too deep")
+	}
+	major, n, rest, err := cborHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if n > 1<<63-1 {
+			return nil, nil, fmt.Errorf("CBOR integer too big")
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > 1<<63-1 {
+			return nil, nil, fmt.Errorf("CBOR integer too big")
+		}
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if n > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("CBOR string truncated")
+		}
+		if major == 3 {
+			return string(rest[:n]), rest[n:], nil
+		}
+		return append([]byte{}, rest[:n]...), rest[n:], nil
+	case 4:
+		if n > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("CBOR array truncated")
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			if item, rest, err = cborItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if n > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("CBOR map truncated")
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			if k, rest, err = cborItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("CBOR map key not supported")
+			}
+			if v, rest, err = cborItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, rest, nil
+	case 7:
+		switch n {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("CBOR major type %d (%d) not supported", major, n)
+}
+
+// cborHead decodes the initial byte and argument of an item
+func cborHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, fmt.Errorf("CBOR item truncated")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return 0, 0, nil, fmt.Errorf("CBOR item truncated")
+		}
+		var n uint64
+		switch size {
+		case 1:
+			n = uint64(data[0])
+		case 2:
+			n = uint64(binary.BigEndian.Uint16(data))
+		case 4:
+			n = uint64(binary.BigEndian.Uint32(data))
+		default:
+			n = binary.BigEndian.Uint64(data)
+		}
+		return major, n, data[size:], nil
+	}
+	return 0, 0, nil, fmt.Errorf("CBOR indefinite lengths not supported")
+}
@@ -0,0 +1,152 @@
+package webca
+
+import (
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CERTINDEX_BATCH = 100 // changed files applied one by one at most, the Certree is reloaded beyond
+)
+
+var (
+	// changedCertFiles holds the certificate files written or deleted since the Certree was
+	// brought up to date
+	changedCertFiles = make(map[string]bool)
+	// changedCertFiles lock
+	schangedCertFiles sync.Mutex
+)
+
+// certFilesChanged records the certificate and key files among the names, for the Certree to pick
+// them up next time it is used; the storage backends call it once their changes are committed
+func certFilesChanged(names ...string) {
+	schangedCertFiles.Lock()
+	defer schangedCertFiles.Unlock()
+	for _, name := range names {
+		name = path.Clean(name)
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, CERT_SUFFIX) {
+			continue // not a certificate of the tree (e.g. archived or trashed)
+		}
+		if strings.HasSuffix(name, KEY_SUFFIX) {
+			name = strings.TrimSuffix(name, KEY_SUFFIX) + CERT_SUFFIX
+		}
+		changedCertFiles[name] = true
+	}
+}
+
+// takeCertChanges returns the changed certificate files recorded so far, forgetting them
+func takeCertChanges() []string {
+	schangedCertFiles.Lock()
+	defer schangedCertFiles.Unlock()
+	files := make([]string, 0, len(changedCertFiles))
+	for file := range changedCertFiles {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	changedCertFiles = make(map[string]bool)
+	return files
+}
+
+// update brings the tree up to date with the changed certificate files, false if it has to be
+// reloaded instead. The lists shared with the readers are copied before being changed.
+func (ct *Certree) update(files []string) bool {
+	if len(files) > CERTINDEX_BATCH {
+		return false
+	}
+	added := make(map[string]*Cert)
+	for _, file := range files {
+		if _, err := storage.Get(file); os.IsNotExist(err) {
+			if c := ct.byFile(file); c != nil && !ct.drop(c) {
+				return false
+			}
+			continue
+		}
+		c, err := readCert(file)
+		if err != nil {
+			log.Printf("(Warning) %s", err)
+			return false
+		}
+		if old := ct.names[c.Crt.Subject.CommonName]; old != nil {
+			// placeholders of unknown issuers and CAs with certificates below are relinked by a reload
+			if old.Crt.SerialNumber == nil || len(old.Childs) > 0 || !ct.drop(old) {
+				return false
+			}
+		}
+		if parent := ct.names[c.Crt.Issuer.CommonName]; parent != nil {
+			parent.Childs = append([]*Cert(nil), parent.Childs...)
+		}
+		ct.roots = append([]*Cert(nil), ct.roots...)
+		ct.foreign = append([]*Cert(nil), ct.foreign...)
+		ct.add(c)
+		if c.Crt.SerialNumber != nil {
+			added[serialKey(c.Crt.SerialNumber)] = c
+		}
+	}
+	ct.indexExpiries()
+	indexSerials(added)
+	return true
+}
+
+// byFile returns the certificate stored in the file, nil if it is not in the tree
+func (ct *Certree) byFile(file string) *Cert {
+	for _, c := range ct.names {
+		if c.Crt.SerialNumber != nil && certFile(*c) == file {
+			return c
+		}
+	}
+	return nil
+}
+
+// drop takes a certificate without certificates below it out of the tree, false if the tree has
+// to be reloaded instead
+func (ct *Certree) drop(c *Cert) bool {
+	if len(c.Childs) > 0 {
+		return false
+	}
+	delete(ct.names, c.Crt.Subject.CommonName)
+	if key := serialKey(c.Crt.SerialNumber); ct.serials[key] == c {
+		delete(ct.serials, key)
+	}
+	if key := fingerprintKey(Fingerprint(c.Crt)); ct.fingerprints[key] == c {
+		delete(ct.fingerprints, key)
+	}
+	parent := c.Parent
+	if parent == nil || parent == c {
+		ct.roots = remove(append([]*Cert(nil), ct.roots...), c)
+		ct.foreign = remove(append([]*Cert(nil), ct.foreign...), c)
+		return true
+	}
+	parent.Childs = remove(append([]*Cert(nil), parent.Childs...), c)
+	// a placeholder of an unknown issuer goes away with its last certificate
+	return parent.Crt.SerialNumber != nil || len(parent.Childs) > 0
+}
+
+// indexExpiries orders the certificates of the tree by expiry, the soonest first
+func (ct *Certree) indexExpiries() {
+	expiries := make([]*Cert, 0, len(ct.names))
+	for _, c := range ct.names {
+		if c.Crt.SerialNumber != nil { // not a placeholder
+			expiries = append(expiries, c)
+		}
+	}
+	sort.Slice(expiries, func(i, j int) bool {
+		if !expiries[i].Crt.NotAfter.Equal(expiries[j].Crt.NotAfter) {
+			return expiries[i].Crt.NotAfter.Before(expiries[j].Crt.NotAfter)
+		}
+		return expiries[i].Crt.Subject.CommonName < expiries[j].Crt.Subject.CommonName
+	})
+	ct.expiries = expiries
+}
+
+// expiringBy returns the certificates expiring at t at the latest, the soonest first
+func (ct *Certree) expiringBy(t time.Time) []*Cert {
+	n := sort.Search(len(ct.expiries), func(i int) bool {
+		return ct.expiries[i].Crt.NotAfter.After(t)
+	})
+	return ct.expiries[:n]
+}
@@ -0,0 +1,48 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestCertIndex(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "IndexCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "late.example.com", ForDays(200))
+	dieOnError(t, err)
+	tree := ListCerts()
+	soon, err := GenCert(ca, "soon.example.com", ForDays(10))
+	dieOnError(t, err)
+	if c := FindCert("soon.example.com"); c == nil || c.Parent.Crt.Subject.CommonName != "IndexCA" {
+		t.Fatal("New certificate not indexed")
+	}
+	if ListCerts() != tree {
+		t.Error("Tree reloaded for a new certificate")
+	}
+	if found := FindCerts(CertFilter{ExpiresBefore: time.Now().AddDate(0, 0, 30)}); len(found) != 1 || found[0].Crt.Subject.CommonName != "soon.example.com" {
+		t.Errorf("Wrong certificates expiring within 30 days: %v", found)
+	}
+	renewed, err := RenewCert(FindCert("soon.example.com"), false)
+	dieOnError(t, err)
+	if FindCertBySerial(soon.Crt.SerialNumber) != nil || FindCertBySerial(renewed.Crt.SerialNumber) == nil ||
+		FindCertByFingerprint(Fingerprint(renewed.Crt)) == nil || FindCertByFingerprint(Fingerprint(soon.Crt)) != nil {
+		t.Error("Renewed certificate not indexed by serial and fingerprint")
+	}
+	if cas := FindCert("IndexCA").Childs; len(cas) != 2 || cas[1].Crt.SerialNumber.Cmp(renewed.Crt.SerialNumber) != 0 {
+		t.Errorf("Renewed certificate not under its CA: %v", cas)
+	}
+	if !removeCert(FindCert("late.example.com")) || FindCert("late.example.com") != nil || len(FindCert("IndexCA").Childs) != 1 {
+		t.Error("Deleted certificate still indexed")
+	}
+	if ListCerts() != tree || len(ListCerts().expiries) != 2 {
+		t.Errorf("Tree reloaded or expiries not indexed: %v", ListCerts().expiries)
+	}
+	_, err = RenewCert(FindCert("IndexCA"), false)
+	dieOnError(t, err)
+	if ListCerts() == tree || FindCert("soon.example.com").Parent != FindCert("IndexCA") {
+		t.Error("Tree not reloaded for a renewed CA")
+	}
+}
@@ -0,0 +1,360 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CertField is a named certificate property, as shown on the web pages
+type CertField struct {
+	Name, Value string
+}
+
+// FieldChange compares a certificate property before and after a change
+type FieldChange struct {
+	Name, Before, After string
+}
+
+// Changed tells whether or not the property changed
+func (fc FieldChange) Changed() bool {
+	return fc.Before != fc.After
+}
+
+// generatedExtensions are the extensions x509.CreateCertificate builds from template fields
+var generatedExtensions = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14},                     // Subject Key Id
+	{2, 5, 29, 35},                     // Authority Key Id
+	{2, 5, 29, 15},                     // Key Usage
+	{2, 5, 29, 37},                     // Extended Key Usage
+	{2, 5, 29, 19},                     // Basic Constraints
+	{2, 5, 29, 17},                     // Subject Alternative Names
+	{2, 5, 29, 30},                     // Name Constraints
+	{2, 5, 29, 31},                     // CRL Distribution Points
+	{2, 5, 29, 32},                     // Certificate Policies
+	{1, 3, 6, 1, 5, 5, 7, 1, 1},        // Authority Information Access
+	{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}, // Signed Certificate Timestamps (embedded by the CT logging)
+}
+
+// extensionNames names the well known extensions, by OID
+var extensionNames = map[string]string{
+	"2.5.29.14":               "Subject Key Identifier",
+	"2.5.29.35":               "Authority Key Identifier",
+	"2.5.29.15":               "Key Usage",
+	"2.5.29.37":               "Extended Key Usage",
+	"2.5.29.19":               "Basic Constraints",
+	"2.5.29.17":               "Subject Alternative Name",
+	"2.5.29.30":               "Name Constraints",
+	"2.5.29.31":               "CRL Distribution Points",
+	"2.5.29.32":               "Certificate Policies",
+	"1.3.6.1.5.5.7.1.1":       "Authority Information Access",
+	"1.3.6.1.4.1.11129.2.4.2": "Signed Certificate Timestamps",
+	"1.3.6.1.4.1.11129.2.4.3": "Precertificate Poison",
+}
+
+// keyUsages names the key usage bits
+var keyUsages = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "Digital Signature"},
+	{x509.KeyUsageContentCommitment, "Content Commitment"},
+	{x509.KeyUsageKeyEncipherment, "Key Encipherment"},
+	{x509.KeyUsageDataEncipherment, "Data Encipherment"},
+	{x509.KeyUsageKeyAgreement, "Key Agreement"},
+	{x509.KeyUsageCertSign, "Certificate Sign"},
+	{x509.KeyUsageCRLSign, "CRL Sign"},
+	{x509.KeyUsageEncipherOnly, "Encipher Only"},
+	{x509.KeyUsageDecipherOnly, "Decipher Only"},
+}
+
+// extKeyUsages names the extended key usages
+var extKeyUsages = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "Server Authentication",
+	x509.ExtKeyUsageClientAuth:      "Client Authentication",
+	x509.ExtKeyUsageCodeSigning:     "Code Signing",
+	x509.ExtKeyUsageEmailProtection: "Email Protection",
+	x509.ExtKeyUsageIPSECEndSystem:  "IPSEC End System",
+	x509.ExtKeyUsageIPSECTunnel:     "IPSEC Tunnel",
+	x509.ExtKeyUsageIPSECUser:       "IPSEC User",
+	x509.ExtKeyUsageTimeStamping:    "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSP Signing",
+}
+
+// setSANs sorts the given alternative names into the template DNS names, IPs, emails and URIs
+func setSANs(tmpl *x509.Certificate, sans []string) {
+	for _, san := range sans {
+		san = strings.TrimSpace(san)
+		if san == "" {
+			continue
+		}
+		if ip := net.ParseIP(san); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if strings.Contains(san, "@") && !strings.Contains(san, ":") {
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, san)
+		} else if u, err := url.Parse(san); err == nil && u.Scheme != "" && u.Host != "" {
+			tmpl.URIs = append(tmpl.URIs, u)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+}
+
+// splitSANs splits a list of alternative names separated by commas, spaces or new lines
+func splitSANs(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+}
+
+// SANs returns all the Subject Alternative Names of a certificate as strings
+func SANs(crt *x509.Certificate) []string {
+	sans := make([]string, 0)
+	sans = append(sans, crt.DNSNames...)
+	for _, ip := range crt.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, crt.EmailAddresses...)
+	for _, u := range crt.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+// customExtensions returns the certificate (or template) extensions not generated from fields
+func customExtensions(crt *x509.Certificate) []pkix.Extension {
+	exts := make([]pkix.Extension, 0)
+	all := append(append([]pkix.Extension{}, crt.Extensions...), crt.ExtraExtensions...)
+	for _, ext := range all {
+		generated := false
+		for _, oid := range generatedExtensions {
+			if ext.Id.Equal(oid) {
+				generated = true
+				break
+			}
+		}
+		if !generated {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// keyUsageNames names the key usages of a certificate
+func keyUsageNames(crt *x509.Certificate) []string {
+	ku := make([]string, 0)
+	for _, u := range keyUsages {
+		if crt.KeyUsage&u.usage != 0 {
+			ku = append(ku, u.name)
+		}
+	}
+	return ku
+}
+
+// extKeyUsageNames names the extended key usages of a certificate, the unknown ones by OID
+func extKeyUsageNames(crt *x509.Certificate) []string {
+	eku := make([]string, 0)
+	for _, u := range crt.ExtKeyUsage {
+		eku = append(eku, extKeyUsages[u])
+	}
+	for _, oid := range crt.UnknownExtKeyUsage {
+		eku = append(eku, oid.String())
+	}
+	return eku
+}
+
+// certFields lists the relevant properties of a certificate (or template)
+func certFields(crt *x509.Certificate) []CertField {
+	ku, eku := keyUsageNames(crt), extKeyUsageNames(crt)
+	exts := make([]string, 0)
+	for _, ext := range customExtensions(crt) {
+		crit := ""
+		if ext.Critical {
+			crit = " (" + tr("critical") + ")"
+		}
+		exts = append(exts, ext.Id.String()+crit)
+	}
+	isCA := tr("No")
+	if crt.IsCA {
+		isCA = tr("Yes")
+	}
+	return []CertField{
+		{tr("Subject"), crt.Subject.String()},
+		{tr("Valid From"), crt.NotBefore.Format(MYFMT + " 15:04")},
+		{tr("Valid Until"), crt.NotAfter.Format(MYFMT + " 15:04")},
+		{tr("Duration"), showDuration(certPeriod(crt).Duration())},
+		{tr("Certificate Authority"), isCA},
+		{tr("Key Usage"), strings.Join(ku, ", ")},
+		{tr("Extended Key Usage"), strings.Join(eku, ", ")},
+		{tr("Alternative Names"), strings.Join(SANs(crt), ", ")},
+		{tr("Other Extensions"), strings.Join(exts, ", ")},
+	}
+}
+
+// certChanges compares the properties of two certificates (or templates)
+func certChanges(before, after *x509.Certificate) []FieldChange {
+	bf, af := certFields(before), certFields(after)
+	changes := make([]FieldChange, len(bf))
+	for i := range bf {
+		changes[i] = FieldChange{bf[i].Name, bf[i].Value, af[i].Value}
+	}
+	return changes
+}
+
+// showDuration shows a validity duration in days and hours
+func showDuration(d time.Duration) string {
+	days, hours := int(d.Hours())/24, int(d.Hours())%24
+	if hours == 0 {
+		return tr("%d days", days)
+	}
+	return tr("%d days %d hours", days, hours)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate as colon separated hex
+func Fingerprint(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.Raw)
+	return hexColons(sum[:])
+}
+
+// FingerprintSHA1 returns the legacy SHA-1 fingerprint of a certificate as colon separated hex
+func FingerprintSHA1(crt *x509.Certificate) string {
+	sum := sha1.Sum(crt.Raw)
+	return hexColons(sum[:])
+}
+
+// fingerprintKey returns the index key of a SHA-256 fingerprint given as hex, with or without
+// separators and in any case
+func fingerprintKey(fp string) string {
+	return strings.ToUpper(cleanSerial(fp))
+}
+
+// FindCertByFingerprint finds a certificate by its SHA-256 fingerprint
+func FindCertByFingerprint(fp string) *Cert {
+	autoload()
+	scerts.RLock()
+	defer scerts.RUnlock()
+	if certree == nil {
+		return nil
+	}
+	return certree.fingerprints[fingerprintKey(fp)]
+}
+
+// hexColons formats bytes as upper case hex pairs separated by colons
+func hexColons(data []byte) string {
+	pairs := make([]string, len(data))
+	for i, b := range data {
+		pairs[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(pairs, ":")
+}
+
+// CertExtension is an extension of a certificate, as shown on its details page
+type CertExtension struct {
+	OID, Name string
+	Critical  bool
+}
+
+// publicKeyInfo describes the algorithm and size of the public key of a certificate
+func publicKeyInfo(crt *x509.Certificate) string {
+	switch k := crt.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return crt.PublicKeyAlgorithm.String()
+}
+
+// detailFields lists all the parsed properties of a certificate but its validity and extensions,
+// translated with tr and leaving out the empty ones
+func detailFields(crt *x509.Certificate, tr func(string, ...interface{}) string) []CertField {
+	constraints := tr("End entity")
+	if crt.IsCA && (crt.MaxPathLen > 0 || crt.MaxPathLenZero) {
+		constraints = tr("Certificate Authority, up to %d intermediate CAs", crt.MaxPathLen)
+	} else if crt.IsCA {
+		constraints = tr("Certificate Authority")
+	}
+	policies := make([]string, 0)
+	for _, oid := range crt.PolicyIdentifiers {
+		policies = append(policies, oid.String())
+	}
+	permitted := append(append([]string{}, crt.PermittedDNSDomains...), crt.PermittedEmailAddresses...)
+	for _, n := range crt.PermittedIPRanges {
+		permitted = append(permitted, n.String())
+	}
+	excluded := append(append([]string{}, crt.ExcludedDNSDomains...), crt.ExcludedEmailAddresses...)
+	for _, n := range crt.ExcludedIPRanges {
+		excluded = append(excluded, n.String())
+	}
+	fields := []CertField{
+		{tr("Version"), fmt.Sprintf("%d", crt.Version)},
+		{tr("Serial"), fmt.Sprintf("%s (%s)", hexColons(crt.SerialNumber.Bytes()), crt.SerialNumber)},
+		{tr("Subject"), crt.Subject.String()},
+		{tr("Issuer"), crt.Issuer.String()},
+		{tr("Public Key"), publicKeyInfo(crt)},
+		{tr("Signature Algorithm"), crt.SignatureAlgorithm.String()},
+		{tr("Basic Constraints"), constraints},
+		{tr("Key Usage"), strings.Join(keyUsageNames(crt), ", ")},
+		{tr("Extended Key Usage"), strings.Join(extKeyUsageNames(crt), ", ")},
+		{tr("Alternative Names"), strings.Join(SANs(crt), ", ")},
+		{tr("Permitted Names"), strings.Join(permitted, ", ")},
+		{tr("Excluded Names"), strings.Join(excluded, ", ")},
+		{tr("Subject Key Identifier"), hexColons(crt.SubjectKeyId)},
+		{tr("Authority Key Identifier"), hexColons(crt.AuthorityKeyId)},
+		{tr("CRL Distribution Points"), strings.Join(crt.CRLDistributionPoints, ", ")},
+		{tr("OCSP Servers"), strings.Join(crt.OCSPServer, ", ")},
+		{tr("Issuing Certificate URLs"), strings.Join(crt.IssuingCertificateURL, ", ")},
+		{tr("Certificate Policies"), strings.Join(policies, ", ")},
+		{tr("SHA-256 Fingerprint"), Fingerprint(crt)},
+		{tr("SHA-1 Fingerprint"), FingerprintSHA1(crt)},
+	}
+	shown := make([]CertField, 0, len(fields))
+	for _, f := range fields {
+		if f.Value != "" {
+			shown = append(shown, f)
+		}
+	}
+	return shown
+}
+
+// certExtensions lists all the extensions of a certificate, named when well known
+func certExtensions(crt *x509.Certificate) []CertExtension {
+	exts := make([]CertExtension, len(crt.Extensions))
+	for i, ext := range crt.Extensions {
+		exts[i] = CertExtension{ext.Id.String(), extensionNames[ext.Id.String()], ext.Critical}
+	}
+	return exts
+}
+
+// certDetails shows the complete parsed certificate and its PEM
+func certDetails(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	ps["Cert"] = c
+	ps["Details"] = detailFields(c.Crt, ps.tr)
+	ps["Extensions"] = certExtensions(c.Crt)
+	ps["PEM"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Crt.Raw}))
+	err = templatesFor(r).ExecuteTemplate(w, "certDetails", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,47 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCertDetails(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Fullname: "Boss"}}}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "DetailsCA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "details.example.com", ForDays(30), "www.example.com")
+	dieOnError(t, err)
+	w := httptest.NewRecorder()
+	certDetails(w, httptest.NewRequest("GET", "/certDetails?cert=details.example.com", nil))
+	page := w.Body.String()
+	for _, want := range []string{Fingerprint(crt.Crt), FingerprintSHA1(crt.Crt), "BEGIN CERTIFICATE",
+		"Basic Constraints", "End entity", "Subject Key Identifier", "www.example.com", "2.5.29.17"} {
+		if !strings.Contains(page, template.HTMLEscapeString(want)) {
+			t.Fatalf("The details lack %q:\n%s", want, page)
+		}
+	}
+	for _, f := range detailFields(crt.Crt, tr) {
+		if f.Value == "" {
+			t.Fatalf("Empty field %s shown", f.Name)
+		}
+		if f.Name == "Basic Constraints" && f.Value != "End entity" {
+			t.Fatalf("Wrong constraints %s", f.Value)
+		}
+	}
+	caFields := detailFields(ca.Crt, tr)
+	if !strings.Contains(fmt.Sprint(caFields), "Certificate Authority") {
+		t.Fatalf("The CA is not shown as one: %v", caFields)
+	}
+	w = httptest.NewRecorder()
+	certDetails(w, httptest.NewRequest("GET", "/certDetails?cert=missing", nil))
+	if strings.Contains(w.Body.String(), "BEGIN CERTIFICATE") {
+		t.Fatal("Details shown for an unknown certificate")
+	}
+}
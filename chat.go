@@ -0,0 +1,137 @@
+package webca
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	SLACK        = "Slack"
+	TEAMS        = "Teams"
+	EVENT_EXPIRY = "expiry" // not a lifecycle event, sent by the expiry notifications
+)
+
+// ChatHook is a Slack or Microsoft Teams incoming webhook receiving notifications
+type ChatHook struct {
+	Kind   string   // SLACK or TEAMS
+	URL    string   // incoming webhook URL
+	Events []string // event types to notify (including EVENT_EXPIRY and EVENT_RENEW_FAILED), all if empty
+}
+
+func init() {
+	Subscribe(fireChatHooks)
+}
+
+// fireChatHooks notifies the lifecycle event in the background to the interested chat hooks
+func fireChatHooks(e Event) {
+	cfg := LoadConfig()
+	if cfg == nil {
+		return
+	}
+	title, text := eventMessage(e)
+	for _, ch := range cfg.ChatHooks {
+		if e.Matches(ch.Events) {
+			go func(ch ChatHook) {
+				if err := ch.notify(title, text); err != nil {
+					log.Printf("(Warning) %s notification failed: %s", ch.Kind, err)
+				}
+			}(ch)
+		}
+	}
+}
+
+// chatExpiring notifies the expiring certificates not notified yet to the interested chat hooks,
+// recording those sent in the index
+func chatExpiring(cfg *config, idx *notifiedIndex, notices []ExpiryNotice) error {
+	var errs []string
+	for _, ch := range cfg.ChatHooks {
+		if !(Event{Type: EVENT_EXPIRY}).Matches(ch.Events) {
+			continue
+		}
+		pending := idx.pending(notices, "chat:"+ch.URL)
+		if len(pending) == 0 {
+			continue
+		}
+		lines := make([]string, 0, len(pending))
+		for _, n := range pending {
+			lines = append(lines, fmt.Sprintf("%s (%s, %s)", n.Cert.Crt.Subject.CommonName,
+				n.Cert.Crt.NotAfter.Format(MYFMT+" 15:04"), tr("%d days left", n.DaysLeft)))
+		}
+		if err := ch.notify(tr("%d certificates about to expire", len(pending)), strings.Join(lines, "\n")); err != nil {
+			errs = append(errs, fmt.Sprintf("%s notification failed: %s", ch.Kind, err))
+		} else {
+			idx.sent(pending, "chat:"+ch.URL)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// eventMessage returns the chat title and text for a lifecycle event
+func eventMessage(e Event) (string, string) {
+	var title string
+	switch e.Type {
+	case EVENT_ISSUE:
+		title = tr("Certificate %s issued", e.Name)
+	case EVENT_RENEW:
+		title = tr("Certificate %s renewed", e.Name)
+	case EVENT_REVOKE:
+		title = tr("Certificate %s revoked", e.Name)
+	case EVENT_DELETE:
+		title = tr("Certificate %s deleted", e.Name)
+	case EVENT_CROSS:
+		title = tr("Certificate %s cross-signed by %s", e.Name, e.Issuer)
+	default:
+		title = tr("Certificate %s: %s", e.Name, e.Type)
+	}
+	text := tr("Issuer: %s, Serial: %s, Valid until: %s", e.Issuer, e.Serial, e.NotAfter.Format(MYFMT+" 15:04"))
+	if len(e.SANs) > 0 {
+		text += "\n" + tr("Alternative Names: %s", strings.Join(e.SANs, ", "))
+	}
+	return title, text
+}
+
+// notify posts a message to the chat, retrying on failure
+func (ch ChatHook) notify(title, text string) error {
+	body, err := json.Marshal(ch.message(title, text))
+	if err != nil {
+		return err
+	}
+	return retry(func() error {
+		req, err := http.NewRequest("POST", ch.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return send(req)
+	})
+}
+
+// message returns the chat specific message payload
+func (ch ChatHook) message(title, text string) interface{} {
+	if ch.Kind == TEAMS {
+		return map[string]string{
+			"@type":    "MessageCard",
+			"@context": "http://schema.org/extensions",
+			"summary":  title,
+			"title":    title,
+			"text":     strings.Replace(text, "\n", "<br/>", -1),
+		}
+	}
+	return map[string]string{"text": "*" + title + "*\n" + text}
+}
+
+// readChatHook reads a chat hook from the request
+func readChatHook(r *http.Request) (*ChatHook, error) {
+	ch := &ChatHook{Kind: SLACK, URL: strings.TrimSpace(r.FormValue("URL")), Events: r.Form["Events"]}
+	if r.FormValue("Kind") == TEAMS {
+		ch.Kind = TEAMS
+	}
+	return ch, checkURL(ch.URL)
+}
@@ -0,0 +1,43 @@
+package webca
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChatHooks(t *testing.T) {
+	var received []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := make(map[string]string)
+		json.NewDecoder(r.Body).Decode(&msg)
+		received = append(received, msg)
+	}))
+	defer srv.Close()
+	title, text := eventMessage(Event{Type: EVENT_RENEW, Name: "chat.example.com", Issuer: "ChatCA",
+		Serial: "0A", SANs: []string{"www.example.com"}})
+	if title != "Certificate chat.example.com renewed" || !strings.Contains(text, "www.example.com") {
+		t.Fatalf("Unexpected message %q: %q", title, text)
+	}
+	dieOnError(t, ChatHook{Kind: SLACK, URL: srv.URL}.notify(title, text))
+	dieOnError(t, ChatHook{Kind: TEAMS, URL: srv.URL}.notify(title, text))
+	if len(received) != 2 || !strings.HasPrefix(received[0]["text"], "*"+title+"*\n") ||
+		received[1]["@type"] != "MessageCard" || received[1]["title"] != title {
+		t.Fatalf("Unexpected chat messages: %v", received)
+	}
+	cfg := &config{ChatHooks: []ChatHook{
+		{Kind: SLACK, URL: srv.URL, Events: []string{EVENT_ISSUE}},
+		{Kind: TEAMS, URL: srv.URL, Events: []string{EVENT_EXPIRY}}}}
+	idx := &notifiedIndex{make(map[string]int), make(map[string]bool)}
+	notices := []ExpiryNotice{{Cert: NewCert("expiring.example.com"), Days: 7, DaysLeft: 6}}
+	dieOnError(t, chatExpiring(cfg, idx, notices))
+	if len(received) != 3 || !strings.Contains(received[2]["text"], "expiring.example.com") {
+		t.Fatalf("Expiry was not notified to Teams only: %v", received)
+	}
+	dieOnError(t, chatExpiring(cfg, idx, notices))
+	if len(received) != 3 {
+		t.Fatalf("Expiry was notified twice: %v", received)
+	}
+}
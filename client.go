@@ -0,0 +1,278 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	CLIENT_URL     = "WEBCA_URL"     // environment variable with the address of the WebCA the CLI calls
+	CLIENT_TOKEN   = "WEBCA_TOKEN"   // environment variable with the API token of the CLI
+	CLIENT_CA      = "WEBCA_CA_FILE" // environment variable with the PEM CAs the CLI trusts the WebCA with
+	CLIENT_TIMEOUT = 2 * time.Minute
+)
+
+// Client calls the REST API of a WebCA with an API token, for scripts and cron jobs
+type Client struct {
+	URL   string // e.g. https://ca.example.com/ with the base path, if any
+	Token string
+	HTTP  *http.Client
+}
+
+// NewClient returns a client of the WebCA at the URL, trusting the CAs of the PEM caFile (if
+// given) besides the system ones
+func NewClient(address, token, caFile string) (*Client, error) {
+	if address == "" {
+		return nil, fmt.Errorf("No WebCA address, use -url or %s", CLIENT_URL)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("No API token, use -token or %s", CLIENT_TOKEN)
+	}
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig.RootCAs, err = x509.SystemCertPool(); err != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No PEM certificates in %s", caFile)
+		}
+	}
+	return &Client{address, token,
+		&http.Client{Timeout: CLIENT_TIMEOUT, Transport: &http.Transport{TLSClientConfig: tlsConfig}}}, nil
+}
+
+// call sends the request as JSON (if any) and decodes the JSON reply into v, or copies it as is
+// if v is a *[]byte. Failed calls return the error of the API
+func (c *Client) call(method, path string, request, v interface{}) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.URL, "/")+API_PREFIX+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr apiError
+		if json.Unmarshal(data, &apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("%s", apiErr.Error)
+	}
+	if raw, ok := v.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// List returns all the certificates matching the filter query (the index search fields)
+func (c *Client) List(query url.Values) ([]CertInfo, error) {
+	certs := make([]CertInfo, 0)
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for page := 1; ; page++ {
+		q.Set("page", fmt.Sprint(page))
+		var list CertList
+		if err := c.call("GET", "certs?"+q.Encode(), nil, &list); err != nil {
+			return nil, err
+		}
+		certs = append(certs, list.Certs...)
+		if page >= list.Pages {
+			return certs, nil
+		}
+	}
+}
+
+// Issue issues a certificate, or a root CA when there is no parent
+func (c *Client) Issue(req IssueRequest) (CertInfo, error) {
+	var ci CertInfo
+	path := "certs"
+	if req.Parent == "" {
+		path = "cas"
+	}
+	return ci, c.call("POST", path, req, &ci)
+}
+
+// Renew renews a certificate, with a new key pair if rekey is set
+func (c *Client) Renew(name string, rekey bool) (CertInfo, error) {
+	var ci CertInfo
+	return ci, c.call("POST", "certs/"+url.PathEscape(name)+"/renew", RenewRequest{rekey}, &ci)
+}
+
+// Revoke revokes a certificate for the RFC 5280 reason
+func (c *Client) Revoke(name string, reason int) (CertInfo, error) {
+	var ci CertInfo
+	return ci, c.call("POST", "certs/"+url.PathEscape(name)+"/revoke", RevokeRequest{reason}, &ci)
+}
+
+// Backup returns the backup of the CA encrypted with the passphrase
+func (c *Client) Backup(passphrase string) ([]byte, error) {
+	var data []byte
+	return data, c.call("POST", "backup", BackupRequest{passphrase}, &data)
+}
+
+// CLICommands are the subcommands of the binary run by RunCLI instead of the server
+var CLICommands = []string{"issue", "list", "renew", "revoke", "backup"}
+
+// IsCLICommand tells whether or not the argument is one of the CLICommands
+func IsCLICommand(arg string) bool {
+	for _, cmd := range CLICommands {
+		if arg == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// RunCLI runs the CLI command in args[0] against the REST API with its flags in args[1:], writing
+// its output to out:
+//
+//	issue  -parent CA [-days N] [-profile P] [-san a,b] name   prints the PEM certificate
+//	list   [-name N] [-issuer CA] [-tag T] [-json]             prints the certificates
+//	renew  [-rekey] name...
+//	revoke [-reason N] name...
+//	backup -passphrase P [-out file]                           writes the encrypted backup
+//
+// The WebCA address, API token and trusted CAs come from -url, -token and -ca, or else from the
+// CLIENT_URL, CLIENT_TOKEN and CLIENT_CA environment variables
+func RunCLI(args []string, out io.Writer) error {
+	if len(args) == 0 || !IsCLICommand(args[0]) {
+		return fmt.Errorf("Usage: webca %s [flags]", strings.Join(CLICommands, "|"))
+	}
+	fs := flag.NewFlagSet("webca "+args[0], flag.ContinueOnError)
+	address := fs.String("url", os.Getenv(CLIENT_URL), "address of the WebCA, e.g. https://ca.example.com/")
+	token := fs.String("token", os.Getenv(CLIENT_TOKEN), "API token")
+	caFile := fs.String("ca", os.Getenv(CLIENT_CA), "PEM file with the CAs trusted for the WebCA")
+	var issue IssueRequest
+	var sans string
+	var rekey, asJSON bool
+	var reason int
+	var passphrase, file string
+	query := url.Values{}
+	filter := func(name, field, usage string) {
+		fs.Func(name, usage, func(v string) error { query.Set(field, v); return nil })
+	}
+	switch args[0] {
+	case "issue":
+		fs.StringVar(&issue.Parent, "parent", "", "CA issuing the certificate, a new root CA if empty")
+		fs.IntVar(&issue.Days, "days", 0, "days of validity, the default of the CA if 0")
+		fs.StringVar(&issue.Profile, "profile", "", "certificate profile")
+		fs.StringVar(&sans, "san", "", "comma separated alternative names")
+	case "list":
+		filter("name", "Name", "part of the name")
+		filter("issuer", "Issuer", "issuer name")
+		filter("tag", "Tag", "tag, e.g. env:prod")
+		fs.BoolVar(&asJSON, "json", false, "print JSON instead of a table")
+	case "renew":
+		fs.BoolVar(&rekey, "rekey", false, "renew with new key pairs")
+	case "revoke":
+		fs.IntVar(&reason, "reason", 0, "RFC 5280 revocation reason code")
+	case "backup":
+		fs.StringVar(&passphrase, "passphrase", "", "passphrase encrypting the backup")
+		fs.StringVar(&file, "out", "", "backup file, the standard output if empty")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	c, err := NewClient(*address, *token, *caFile)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "issue":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("Usage: webca issue [flags] name")
+		}
+		issue.Name = fs.Arg(0)
+		issue.SANs = splitSANs(sans)
+		ci, err := c.Issue(issue)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, ci.PEM)
+		return err
+	case "list":
+		certs, err := c.List(query)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			return enc.Encode(certs)
+		}
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSERIAL\tISSUER\tEXPIRES\tREVOKED")
+		for _, ci := range certs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\n", ci.Name, ci.Serial, ci.Issuer,
+				ci.NotAfter.UTC().Format("2006-01-02"), ci.Revoked != nil)
+		}
+		return tw.Flush()
+	case "renew", "revoke":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("Usage: webca %s [flags] name...", args[0])
+		}
+		failed := 0
+		for _, name := range fs.Args() {
+			var ci CertInfo
+			if args[0] == "renew" {
+				ci, err = c.Renew(name, rekey)
+			} else {
+				ci, err = c.Revoke(name, reason)
+			}
+			if err != nil {
+				failed++
+				fmt.Fprintf(out, "%s: %s\n", name, err)
+			} else {
+				fmt.Fprintf(out, "%s: %s\n", name, ci.Serial)
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d certificates failed", failed, fs.NArg())
+		}
+		return nil
+	}
+	data, err := c.Backup(passphrase)
+	if err != nil {
+		return err
+	}
+	if file != "" {
+		return ioutil.WriteFile(file, data, 0600)
+	}
+	_, err = out.Write(data)
+	return err
+}
@@ -0,0 +1,61 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"admin": {Username: "admin", Role: ROLE_ADMIN}}}
+	certree = nil
+	token, err := cachedCfg.NewAPIToken("admin", "cron")
+	dieOnError(t, err)
+	_, err = GenCACert(pkix.Name{CommonName: "ClientCA"}, ForDays(365))
+	dieOnError(t, err)
+	srv := httptest.NewTLSServer(apiAccess(api))
+	defer srv.Close()
+	dieOnError(t, ioutil.WriteFile("server.pem", pemCerts(srv.Certificate()), 0600))
+	run := func(cmd string, args ...string) (string, error) {
+		var out bytes.Buffer
+		args = append([]string{cmd, "-url", srv.URL, "-token", token, "-ca", "server.pem"}, args...)
+		err := RunCLI(args, &out)
+		return out.String(), err
+	}
+
+	out, err := run("issue", "-parent", "ClientCA", "-days", "30", "-san", "cli.example.com", "cli")
+	dieOnError(t, err)
+	if !strings.HasPrefix(out, "-----BEGIN CERTIFICATE-----") || FindCert("cli") == nil {
+		t.Fatalf("Certificate not issued: %s", out)
+	}
+	serial := serialKey(FindCert("cli").Crt.SerialNumber)
+	out, err = run("list", "-issuer", "ClientCA")
+	dieOnError(t, err)
+	if !strings.HasPrefix(out, "NAME") || !strings.Contains(out, "\ncli ") || !strings.Contains(out, serial) {
+		t.Fatalf("Wrong list:\n%s", out)
+	}
+	out, err = run("renew", "cli")
+	dieOnError(t, err)
+	if renewed := serialKey(FindCert("cli").Crt.SerialNumber); renewed == serial || !strings.Contains(out, renewed) {
+		t.Fatalf("Certificate not renewed: %s", out)
+	}
+	if out, err = run("revoke", "-reason", "4", "cli", "ghost"); err == nil || !strings.Contains(out, "ghost") ||
+		Revoked(FindCert("cli")) == nil {
+		t.Fatalf("Wrong revocations: %s %v", out, err)
+	}
+	_, err = run("backup", "-passphrase", "correct horse battery", "-out", "backup.bin")
+	dieOnError(t, err)
+	if data, err := ioutil.ReadFile("backup.bin"); err != nil || len(data) == 0 {
+		t.Fatalf("Backup not written: %v", err)
+	}
+	if err := RunCLI([]string{"list", "-url", srv.URL, "-token", "bad", "-ca", "server.pem"},
+		io.Discard); err == nil || !strings.Contains(err.Error(), "Invalid API token!") {
+		t.Fatalf("Wrong token accepted: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package webca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	CERT_MATCH_CN    = "cn"    // the common name is the username
+	CERT_MATCH_EMAIL = "email" // the email address is the one of the user
+)
+
+// ClientCerts logs in the web users presenting a certificate of the CA, without their password
+type ClientCerts struct {
+	CA    string // name of the CA whose certificates log in
+	Match string // how certificates name their user, CERT_MATCH_CN if empty
+}
+
+// certUser returns the enabled user named by the client certificate of the request, if any. The
+// certificate must still be valid, not revoked, issued by the current client CA for client
+// authentication and not a CA itself
+func (cfg *config) certUser(r *http.Request) (User, error) {
+	if cfg == nil || cfg.ClientCerts == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return User{}, fmt.Errorf("%s", tr("A client certificate is required!"))
+	}
+	crt := r.TLS.PeerCertificates[0]
+	ca := FindCert(cfg.ClientCerts.CA)
+	if ca == nil || crt.IsCA {
+		return User{}, fmt.Errorf("%s", tr("The client certificate is not valid!"))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Crt)
+	_, err := crt.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: time.Now(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		return User{}, fmt.Errorf("%s", tr("The client certificate is not valid!"))
+	}
+	if Revoked(&Cert{Crt: crt}) != nil {
+		return User{}, fmt.Errorf("%s", tr("The client certificate is revoked!"))
+	}
+	if cfg.ClientCerts.Match == CERT_MATCH_EMAIL {
+		for _, u := range cfg.userList() {
+			for _, email := range crt.EmailAddresses {
+				if u.Email != "" && email == u.Email && !u.Disabled {
+					return cfg.Users[u.Username], nil
+				}
+			}
+		}
+	} else if cfg.activeUser(crt.Subject.CommonName) {
+		return cfg.Users[crt.Subject.CommonName], nil
+	}
+	return User{}, fmt.Errorf("%s", tr("%v is not a user of this CA!", crt.Subject.CommonName))
+}
+
+// certLogin logs in the session with the client certificate of the request, if it names a user
+func certLogin(w http.ResponseWriter, r *http.Request, s session) bool {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.ClientCerts == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	crt := r.TLS.PeerCertificates[0]
+	u, err := cfg.certUser(r)
+	if err == nil {
+		err = admitLogin(u.Username, s.Id(), remoteAddr(r))
+	}
+	if err != nil {
+		audit(AUDIT_LOGIN_FAILED, crt.Subject.CommonName, remoteAddr(r), "certificate: "+err.Error())
+		return false
+	}
+	audit(AUDIT_LOGIN, u.Username, remoteAddr(r), "certificate "+crt.SerialNumber.Text(16))
+	s[LOGGEDUSER] = u
+	return s.Renew(w, r) == nil
+}
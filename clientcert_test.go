@@ -0,0 +1,73 @@
+package webca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientCertLogin(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	ca, err := GenCACert(pkix.Name{CommonName: "LoginCA"}, ForDays(365))
+	dieOnError(t, err)
+	other, err := GenCACert(pkix.Name{CommonName: "OtherCA"}, ForDays(365))
+	dieOnError(t, err)
+	alice, err := GenCert(ca, "alice", ForDays(30))
+	dieOnError(t, err)
+	mallory, err := GenCert(ca, "mallory", ForDays(30))
+	dieOnError(t, err)
+	forged, err := GenCert(other, "alice2", ForDays(30))
+	dieOnError(t, err)
+	forged.Crt.Subject.CommonName = "alice"
+	server, err := genCert(ca, &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}, NotBefore: time.Now().Add(-time.Minute),
+		NotAfter: time.Now().AddDate(0, 0, 30), ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, nil)
+	dieOnError(t, err)
+	sub, err := genCert(ca, &x509.Certificate{Subject: pkix.Name{CommonName: "carol"}, NotBefore: time.Now().Add(-time.Minute),
+		NotAfter: time.Now().AddDate(0, 0, 30), IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature}, nil)
+	dieOnError(t, err)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"alice": {Username: "alice", Email: "alice@example.com", Role: ROLE_VIEWER},
+		"bob": {Username: "bob", Role: ROLE_VIEWER}, "carol": {Username: "carol", Role: ROLE_VIEWER}},
+		ClientCerts: &ClientCerts{CA: "LoginCA"}}
+	if tc, err := webTLSConfig(nil); err != nil || tc == nil || tc.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatal("The web listener does not ask for client certificates")
+	}
+	visit := func(peer *Cert) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		if peer != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer.Crt}}
+		}
+		served := false
+		accessControl(func(w http.ResponseWriter, r *http.Request) { served = true }).ServeHTTP(httptest.NewRecorder(), req)
+		return served
+	}
+	if visit(nil) || visit(mallory) || visit(forged) {
+		t.Error("A certificate not naming a user of the client CA logged in")
+	}
+	if visit(server) || visit(sub) {
+		t.Error("A server or CA certificate logged in")
+	}
+	if !visit(alice) {
+		t.Fatal("The client certificate did not log in")
+	}
+	cachedCfg.ClientCerts.Match = CERT_MATCH_EMAIL
+	if visit(alice) {
+		t.Error("A certificate without the email address of the user logged in")
+	}
+	cachedCfg.ClientCerts.Match = CERT_MATCH_CN
+	dieOnError(t, RevokeCert(alice, 1))
+	if visit(alice) {
+		t.Error("A revoked client certificate logged in")
+	}
+	cachedCfg.ClientCerts = nil
+	if tc, _ := webTLSConfig(nil); tc != nil {
+		t.Error("The web listener asks for client certificates while disabled")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build sqlite
+
+// SQLite storage, built with -tags sqlite
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/charrea6/webca"
+	_ "modernc.org/sqlite"
+)
+
+// init keeps the CA data in the SQLite database file named by WEBCA_SQLITE, if set
+func init() {
+	if db := os.Getenv("WEBCA_SQLITE"); db != "" {
+		if err := webca.UseSQLite("sqlite", db); err != nil {
+			log.Fatalf("Could not open the database %s: %s", db, err)
+		}
+	}
+}
@@ -2,9 +2,30 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"github.com/charrea6/webca"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "encrypt-keys" { // migrates the plain private keys
+		if err := webca.LoadOptions(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		if err := webca.LoadMasterKey(); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := webca.EncryptStoredKeys(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && webca.IsCLICommand(os.Args[1]) { // headless calls to the REST API
+		if err := webca.RunCLI(os.Args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	webca.WebCA()
 }
@@ -1,6 +1,7 @@
 package webca
 
 import (
+	"crypto/rsa"
 	"encoding/gob"
 	"log"
 	"os"
@@ -20,22 +21,75 @@ var cachedCfg *config
 // User contains the App's User details
 type User struct {
 	Username, Fullname, Password, Email string
+	Role                                string    // ROLE_ADMIN if empty
+	Disabled                            bool      // can't log in nor use their API tokens
+	Passkeys                            []Passkey // WebAuthn credentials
+	SecondFactor                        bool      // a passkey is required after the password
+	Lang                                string    // language of the UI, negotiated if empty
+	Timezone                            string    // IANA time zone of the dates shown, the server's if empty
+	Org                                 string    // organization of the user, every one if empty
+	OIDCIssuer                          string    // single sign on provider the user is linked to, none if empty
+	OIDCSubject                         string    // sub claim of the user at OIDCIssuer
 }
 
 // config contains the App's Configuration
 type config struct {
-	Mailer  *Mailer
-	Advance int // days before the cert. expires that the notification will be sent
-	Users   map[string]User
-	WebCert *Cert
+	Mailer        *Mailer
+	Users         map[string]User
+	Invitations   []Invitation    // pending invitations to become a user
+	InviteKey     []byte          // signs the invitation links
+	Passwords     *PasswordPolicy // user password requirements, defaults if nil
+	Logins        *LoginLimits    // login throttling, defaults if nil
+	Rates         *RateLimits     // request rate limiting, defaults if nil
+	Sessions      *SessionLimits  // web session expiry, defaults if nil
+	Remembered    []RememberToken // devices kept logged in by remember me
+	OIDC          *OIDC           // single sign on provider, disabled if nil
+	ClientCerts   *ClientCerts    // certificate logins to the web UI, disabled if nil
+	TLS           *WebTLS         // web listener TLS hardening, Go defaults if nil
+	AuditSinks    *AuditSinks     // copies of the audit events, none if nil
+	Redis         *Redis          // shared session store, sessions kept in memory if nil
+	HSM           *HSM            // PKCS#11 token keeping the CA keys, stored with the rest if nil
+	WebCert       *Cert
+	Profiles      map[string]Profile    // issuance profiles by name
+	Notifications *Notifications        // expiry notification settings, defaults if nil
+	Webhooks      []Webhook             // lifecycle event receivers
+	ChatHooks     []ChatHook            // Slack or Teams notification receivers
+	DeployHooks   []DeployHook          // executables run after issuing or renewing
+	NoPlainKeys   bool                  // private keys can only be downloaded encrypted
+	APITokens     []APIToken            // API credentials of all users
+	GRPC          *GRPC                 // gRPC service settings, disabled if nil
+	ACME          *ACME                 // ACME server settings, disabled if nil
+	SCEP          *SCEP                 // SCEP enrollment settings, disabled if nil
+	Vault         *Vault                // Vault PKI compatible API settings, disabled if nil
+	Kubernetes    *Kubernetes           // cluster the Secrets are published to, disabled if nil
+	CT            *CT                   // Certificate Transparency logs, disabled if nil
+	Deliveries    map[string][]Delivery // SFTP targets by certificate name
+	AutoRenew     map[string]bool       // certificate names renewed automatically before expiry
+	AutoRenewDays int                   // days before expiry of the auto-renewal, AUTORENEW_DAYS if 0
+	Labels        map[string]CertLabels // tags and notes by certificate name
+	TrashDays     int                   // days the deleted certificates can be restored, TRASH_DAYS if 0
+	KeyPool       map[string]int        // pre-generated keys kept by kind (e.g. RSA-2048), none if empty
+	Backups       *BackupSchedule       // automatic backups, disabled if nil
+	Organizations []Organization        // teams isolated from each other, by name
+	CertRequests  []CertRequest         // pending certificate requests, oldest first
+	SubmitToken   string                // hash of the token of the unauthenticated requests, none if empty
+	DownloadLinks []DownloadLink        // pending one-time download links
+	Owners        map[string]string     // users that issued the certificates, by name
+}
+
+// init registers the key types the stored certificates may hold
+func init() {
+	gob.Register(&rsa.PublicKey{})
+	gob.Register(&rsa.PrivateKey{})
+	gob.Register(&hsmSigner{})
+	gob.Register(&kmsSigner{})
 }
 
 // New Config creates a new Config
 func NewConfig(u User, cacert *Cert, cert *Cert, m Mailer) *config {
-	log.Println("cert=", cert)
-	cfg := &config{Mailer: &m, Advance: 15, Users: make(map[string]User), WebCert: cert}
+	cfg := &config{Mailer: &m, Users: make(map[string]User), WebCert: cert}
+	u.Role = ROLE_ADMIN // the first user administers the CA
 	cfg.Users[u.Username] = u
-	log.Println("New Cfg=", cfg)
 	return cfg
 }
 
@@ -47,19 +101,11 @@ func LoadConfig() *config {
 	if cachedCfg != nil {
 		return cachedCfg
 	}
-	_, err := os.Stat(WEBCA_CFG)
+	cfg := &config{}
+	err := loadGob(WEBCA_CFG, cfg)
 	if os.IsNotExist(err) {
 		return nil
 	}
-	f, err := os.Open(WEBCA_CFG)
-	handleFatal(err)
-	defer f.Close()
-	dec := gob.NewDecoder(f)
-	if dec == nil {
-		log.Fatalf("(Warning) Could not decode " + WEBCA_CFG + "!")
-	}
-	cfg := &config{}
-	err = dec.Decode(cfg)
 	handleFatal(err)
 	cachedCfg = cfg
 	return cfg
@@ -70,14 +116,12 @@ func LoadConfig() *config {
 func (cfg *config) Save() error {
 	oneCfg.Lock()
 	defer oneCfg.Unlock()
-	f, err := os.OpenFile(WEBCA_CFG, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Println("can't open")
-		return err
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	err = enc.Encode(cfg)
+	return cfg.save()
+}
+
+// save stores the config, with the config lock held
+func (cfg *config) save() error {
+	err := saveGob(WEBCA_CFG, cfg)
 	if err != nil {
 		log.Println("can't save")
 		return err
@@ -85,6 +129,19 @@ func (cfg *config) Save() error {
 	return nil
 }
 
+// update changes the config with f and saves it, holding the config lock all along so that the
+// changes made from the background (e.g. the generation jobs) don't race nor get lost. f must not
+// load the config, and must replace the maps it changes instead of writing to them, since the
+// readers don't lock
+func (cfg *config) update(f func(cfg *config) error) error {
+	oneCfg.Lock()
+	defer oneCfg.Unlock()
+	if err := f(cfg); err != nil {
+		return err
+	}
+	return cfg.save()
+}
+
 // WebCert returns the current Web Certificate
 func (cfg *config) getWebCert() Cert {
 	return *cfg.WebCert
@@ -95,7 +152,7 @@ func (cfg *config) getUser(username string) User {
 	return cfg.Users[username]
 }
 
-// crypt transforms a password to a hashed form avoiding storing it in clear text
-func crypt(passwd string) string {
-	return passwd // TODO decide password encryption later (bcrypt?)
+// plainKeysAllowed tells whether or not private keys can be downloaded unencrypted
+func (cfg *config) plainKeysAllowed() bool {
+	return cfg == nil || !cfg.NoPlainKeys
 }
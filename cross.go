@@ -0,0 +1,90 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	CROSS_DIR = "cross"
+)
+
+// CrossSign issues a certificate for the existing CA's subject and public key signed by
+// another CA (signer), providing an alternate chain up to the signer's root
+func CrossSign(ca, signer *Cert, p Period) (*x509.Certificate, error) {
+	if !ca.Crt.IsCA {
+		return nil, fmt.Errorf("%s", tr("%s is not a Certificate Authority!", ca.Crt.Subject.CommonName))
+	}
+	if !signer.Crt.IsCA || signer.Key == nil {
+		return nil, fmt.Errorf("%s", tr("%s can't sign certificates!", signer.Crt.Subject.CommonName))
+	}
+	if signer.Crt.Subject.CommonName == ca.Crt.Subject.CommonName {
+		return nil, fmt.Errorf("%s", tr("A CA can't cross-sign itself!"))
+	}
+	tmpl := RenewTemplate(ca, false)
+	tmpl.NotBefore, tmpl.NotAfter = p.NotBefore, p.NotAfter
+	if !tmpl.NotAfter.After(tmpl.NotBefore) {
+		return nil, fmt.Errorf("%s", tr("The certificate must expire after it starts being valid!"))
+	}
+	serial, err := newSerial(ca.Crt.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	derBytes, err := x509.CreateCertificate(rand.Reader, tmpl, signer.Crt, ca.Crt.PublicKey, signer.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Certificate: %s", err)
+	}
+	name := crossFile(ca.Crt.Subject.CommonName, signer.Crt.Subject.CommonName)
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	if err := storage.Put(name, data, false); err != nil {
+		return nil, fmt.Errorf("Failed to write "+name+": %s", err)
+	}
+	crt, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+	publish(EVENT_CROSS, crt)
+	return crt, nil
+}
+
+// CrossCerts returns the certificates cross-signing the given CA, by signer name
+func CrossCerts(ca *Cert) []*x509.Certificate {
+	prefix := filename(ca.Crt.Subject.CommonName) + "@"
+	names, err := storage.List(CROSS_DIR)
+	if err != nil {
+		return nil
+	}
+	crosses := make([]*x509.Certificate, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, CERT_SUFFIX) {
+			continue
+		}
+		crt, err := readCert(path.Join(CROSS_DIR, name))
+		if err != nil {
+			log.Printf("(Warning) %s", err)
+			continue
+		}
+		crosses = append(crosses, crt.Crt)
+	}
+	sort.Slice(crosses, func(i, j int) bool {
+		return crosses[i].Issuer.CommonName < crosses[j].Issuer.CommonName
+	})
+	return crosses
+}
+
+// crossed returns the cross-signed certificate path (without suffix) for a CA and its signer
+func crossed(crt *x509.Certificate) string {
+	return strings.TrimSuffix(crossFile(crt.Subject.CommonName, crt.Issuer.CommonName), CERT_SUFFIX)
+}
+
+// crossFile returns the cross-signed certificate file for a CA and its signer
+func crossFile(caname, signername string) string {
+	return path.Join(CROSS_DIR, filename(caname)+"@"+filename(signername)+CERT_SUFFIX)
+}
@@ -0,0 +1,42 @@
+package webca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCrossSign(t *testing.T) {
+	inTestDir(t)
+	oldCA, err := GenCACert(pkix.Name{CommonName: "OldRoot"}, ForDays(365))
+	dieOnError(t, err)
+	newCA, err := GenCACert(pkix.Name{CommonName: "NewRoot"}, ForDays(365))
+	dieOnError(t, err)
+	leaf, err := GenCert(oldCA, "crossserver", ForDays(30), "crossserver")
+	dieOnError(t, err)
+	cross, err := CrossSign(oldCA, newCA, ForDays(90))
+	dieOnError(t, err)
+	if crosses := CrossCerts(oldCA); len(crosses) != 1 || !crosses[0].Equal(cross) {
+		t.Fatalf("Expected to find the cross-signed certificate but got %v", crosses)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(newCA.Crt)
+	intermediates.AddCert(cross)
+	_, err = leaf.Crt.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates,
+		DNSName: "crossserver"})
+	dieOnError(t, err)
+	if _, err := CrossSign(leaf, newCA, ForDays(90)); err == nil {
+		t.Fatal("Cross-signed a certificate that is not a CA!")
+	}
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{}
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	w := httptest.NewRecorder()
+	crossSign(w, httptest.NewRequest("GET", "/crossSign?cert=OldRoot&signer=NewRoot&Cert.Duration=90", nil))
+	if crosses := CrossCerts(oldCA); len(crosses) != 1 || w.Code != http.StatusOK {
+		t.Fatalf("Cross-signed on a GET (%d): %v", w.Code, crosses)
+	}
+}
@@ -0,0 +1,115 @@
+package webca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// ParseCSR parses a PKCS#10 certificate request, either PEM or DER encoded
+func ParseCSR(data []byte) (*x509.CertificateRequest, error) {
+	if b, _ := pem.Decode(data); b != nil {
+		data = b.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", tr("Wrong certificate request"), err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%s: %s", tr("Wrong certificate request signature"), err)
+	}
+	return csr, nil
+}
+
+// SignCSR issues a certificate for the request signed by parent, following the given profile
+// (if any). The private key stays with the requester, so only the certificate is stored
+func SignCSR(parent *Cert, csr *x509.CertificateRequest, p Period, prof *Profile) (*Cert, error) {
+	return signCSR(parent, csr, p, prof, nil)
+}
+
+// signCSR signs the request like SignCSR, replacing the old certificate with the same name if
+// given: it is archived and its files swapped with the new one at once, only once signed
+func signCSR(parent *Cert, csr *x509.CertificateRequest, p Period, prof *Profile, old *Cert) (*Cert, error) {
+	name := csr.Subject.CommonName
+	if name == "" {
+		return nil, fmt.Errorf("%s", tr("Can't create a certificate with no name!"))
+	}
+	if old == nil && FindCert(name) != nil {
+		return nil, fmt.Errorf("%s", tr("Certificate %s already exists!", name))
+	}
+	tmpl := newTemplate(csr.Subject, p, nil)
+	tmpl.DNSNames = csr.DNSNames
+	tmpl.IPAddresses = csr.IPAddresses
+	tmpl.EmailAddresses = csr.EmailAddresses
+	tmpl.URIs = csr.URIs
+	if prof != nil {
+		if err := prof.apply(tmpl); err != nil {
+			return nil, err
+		}
+	}
+	if keyType(csr.PublicKey) != RSA { // only RSA keys can encipher other keys
+		tmpl.KeyUsage &^= x509.KeyUsageKeyEncipherment
+	}
+	if !tmpl.NotAfter.After(tmpl.NotBefore) {
+		return nil, fmt.Errorf("%s", tr("The certificate must expire after it starts being valid!"))
+	}
+	serial, err := newSerial(name)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	der, err := createCertificate(tmpl, parent, csr.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Certificate: %s", err)
+	}
+	c := &Cert{Parent: parent}
+	if c.Crt, err = x509.ParseCertificate(der); err != nil {
+		return nil, fmt.Errorf("Failed to parse the new Certificate: %s", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err = storage.Tx(func(tx Storage) error {
+		if old != nil {
+			if err := archiveFiles(tx, old); err != nil {
+				return err
+			}
+			// the requester keeps the new key, the old one goes with the old certificate
+			if err := tx.Delete(keyFile(*old)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return tx.Put(certFile(*c), data, false)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write %s: %s", certFile(*c), err)
+	}
+	if old != nil {
+		purgeArchive()
+	}
+	publish(EVENT_ISSUE, c.Crt)
+	return c, nil
+}
+
+// ReplaceCSR signs the request like SignCSR, replacing the certificate with the same name if
+// parent issued it (renewals by ACME and SCEP clients). The old certificate stays until the new
+// one is signed
+func ReplaceCSR(parent *Cert, csr *x509.CertificateRequest, p Period, prof *Profile) (*Cert, error) {
+	old, err := replaceable(parent, csr.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	return signCSR(parent, csr, p, prof, old)
+}
+
+// replaceable returns the named certificate so that parent can issue a new one in its place, nil
+// if there is none, failing if another CA issued it or it has children
+func replaceable(parent *Cert, name string) (*Cert, error) {
+	old := FindCert(name)
+	if old == nil {
+		return nil, nil
+	}
+	if old.Parent != parent || len(old.Childs) > 0 {
+		return nil, fmt.Errorf("%s", tr("Certificate %s already exists!", name))
+	}
+	return old, nil
+}
@@ -0,0 +1,53 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func TestSignCSR(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "CSRCA"}, ForDays(365))
+	dieOnError(t, err)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "csr.example.com"},
+		DNSNames: []string{"csr.example.com", "www.example.com"},
+	}, key)
+	dieOnError(t, err)
+	csr, err := ParseCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	dieOnError(t, err)
+	c, err := SignCSR(ca, csr, ForDays(30), nil)
+	dieOnError(t, err)
+	if c.Key != nil || len(c.Crt.DNSNames) != 2 || c.Crt.CheckSignatureFrom(ca.Crt) != nil {
+		t.Fatalf("Unexpected certificate %v", c.Crt)
+	}
+	found := FindCert("csr.example.com")
+	if found == nil || found.Key != nil || found.Parent != FindCert("CSRCA") {
+		t.Fatal("Signed certificate not stored properly")
+	}
+	if _, err := SignCSR(ca, csr, ForDays(30), nil); err == nil {
+		t.Fatal("Certificate signed twice")
+	}
+	ca, now := FindCert("CSRCA"), time.Now()
+	if _, err := ReplaceCSR(ca, csr, Period{NotBefore: now, NotAfter: now.Add(-time.Hour)}, nil); err == nil ||
+		FindCert("csr.example.com").Crt.SerialNumber.Cmp(c.Crt.SerialNumber) != 0 || len(PreviousCerts(c)) != 0 {
+		t.Fatal("Certificate retired by a replacement that failed")
+	}
+	renewed, err := ReplaceCSR(ca, csr, ForDays(60), nil)
+	dieOnError(t, err)
+	found = FindCert("csr.example.com")
+	if found.Crt.SerialNumber.Cmp(renewed.Crt.SerialNumber) != 0 || len(PreviousCerts(found)) != 1 {
+		t.Fatal("Certificate not replaced and archived")
+	}
+	if !DeleteCert(found) {
+		t.Fatal("Could not delete a certificate without key")
+	}
+}
@@ -0,0 +1,58 @@
+package webca
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+)
+
+const (
+	CSRFTOKEN   = "goCSRFToken"  // session key of the anti-CSRF token
+	CSRF_FIELD  = "CSRFToken"    // form field carrying the token
+	CSRF_HEADER = "X-CSRF-Token" // header carrying the token, for the scripts
+)
+
+// CSRF returns the anti-CSRF token of the session of the page, for its forms and scripts
+func (ps PageStatus) CSRF() string {
+	r, ok := ps[REQUEST].(*http.Request)
+	if !ok {
+		return ""
+	}
+	cookie, err := r.Cookie(SESSIONID)
+	if err != nil {
+		return ""
+	}
+	token, _ := findSession(cookie.Value)[CSRFTOKEN].(string)
+	return token
+}
+
+// csrfControl invokes handler h ONLY IF the request carries the anti-CSRF token of its session, when
+// it is not a GET (the handlers only change the state on a POST), otherwise it shows the CSRF error
+// page
+func csrfControl(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := SessionFor(w, r) // also gives the pages of a new session their token
+		if handleError(w, r, err) {
+			return
+		}
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get(CSRF_HEADER)
+		if token == "" {
+			token = r.FormValue(CSRF_FIELD)
+		}
+		expected, _ := s[CSRFTOKEN].(string)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			log.Printf("(Warning) Rejected %s %s from %s without its CSRF token", r.Method, r.URL.Path, remoteAddr(r))
+			ps := newPageStatus(r)
+			ps[LOGGEDUSER] = s[LOGGEDUSER]
+			w.WriteHeader(http.StatusForbidden)
+			err := templatesFor(r).ExecuteTemplate(w, "csrfError", ps)
+			handleError(w, r, err)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{}}
+	w := httptest.NewRecorder()
+	csrfControl(accessControl(index)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("No session cookie: %v", cookies)
+	}
+	s := sessions[cookies[0].Value]
+	token, _ := s[CSRFTOKEN].(string)
+	if token == "" || !strings.Contains(w.Body.String(), `name="CSRFToken" value="`+token+`"`) {
+		t.Fatalf("The login form does not carry the CSRF token %q", token)
+	}
+
+	called := 0
+	h := csrfControl(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called++ }))
+	for _, test := range []struct {
+		method, url, token, header string
+		ok                         bool
+	}{
+		{"POST", "/gen", "", "", false},
+		{"POST", "/gen", "forged", "", false},
+		{"POST", "/gen", token, "", true},
+		{"POST", "/webauthn/register/begin", "", token, true},
+		{"GET", "/certControl?cert=x", "", "", true},
+		{"GET", "/del?cert=x", "", "", true}, // del itself only deletes on a POST
+		{"DELETE", "/del?cert=x", "", "", false},
+		{"PUT", "/labels", token, "", true},
+	} {
+		called = 0
+		r := httptest.NewRequest(test.method, test.url, strings.NewReader(url.Values{CSRF_FIELD: {test.token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header != "" {
+			r.Header.Set(CSRF_HEADER, test.header)
+		}
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if test.ok && (called != 1 || w.Code != http.StatusOK) {
+			t.Errorf("%s %s with the token was rejected: %d", test.method, test.url, w.Code)
+		} else if !test.ok && (called != 0 || w.Code != http.StatusForbidden) {
+			t.Errorf("%s %s without the token was accepted: %d", test.method, test.url, w.Code)
+		}
+	}
+	called = 0
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/gen", nil)) // a new session
+	if called != 0 || w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Request Rejected") {
+		t.Errorf("A post without a session was accepted: %d", w.Code)
+	}
+	for path, h := range map[string]http.HandlerFunc{"/gen": gen, "/del": del, "/logout": logout,
+		"/autoRenew": autoRenew, "/notifyOptOut": notifyOptOut, "/testMail": testMail,
+		"/webauthn/register/finish": passkeyRegisterFinish} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", path+"?cert=x", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s was not rejected: %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CT_TIMEOUT = 30 * time.Second
+	SCT_SUFFIX = ".sct.json"
+)
+
+var (
+	oidCTPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	oidSCTList  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// CT configures the Certificate Transparency (RFC 6962) logs the certificates issued by a CA are
+// submitted to
+type CT struct {
+	Logs  []string // log URLs, without the /ct/v1/ path
+	Embed bool     // get the SCTs for a precertificate before issuing and embed them in the certificate
+}
+
+// SCT is a Signed Certificate Timestamp returned by a log
+type SCT struct {
+	Log        string `json:"log"`
+	Version    uint8  `json:"sct_version"`
+	ID         []byte `json:"id"`
+	Timestamp  uint64 `json:"timestamp"` // milliseconds since the epoch
+	Extensions []byte `json:"extensions"`
+	Signature  []byte `json:"signature"` // TLS encoded digitally-signed struct
+}
+
+// sctRecord holds the SCTs of a certificate version
+type sctRecord struct {
+	Serial string `json:"serial"`
+	SCTs   []SCT  `json:"scts"`
+}
+
+// ctClient submits the certificates to the logs
+var ctClient = &http.Client{Timeout: CT_TIMEOUT}
+
+func init() {
+	Subscribe(logCerts)
+}
+
+// logs tells whether or not the certificate issued from tmpl by parent goes to the CT logs
+func (ct *CT) logs(tmpl *x509.Certificate, parent *Cert) bool {
+	return ct != nil && len(ct.Logs) > 0 && !tmpl.IsCA && parent != nil && parent.Crt != tmpl
+}
+
+// logCerts submits in the background the issued or renewed certificate to the CT logs, unless
+// the SCTs were already embedded
+func logCerts(e Event) {
+	if e.Type != EVENT_ISSUE && e.Type != EVENT_RENEW {
+		return
+	}
+	cfg := LoadConfig()
+	if cfg == nil || cfg.CT == nil || cfg.CT.Embed {
+		return
+	}
+	ct := *cfg.CT
+	go func() {
+		c := FindCert(e.Name)
+		if c == nil || !ct.logs(c.Crt, c.Parent) {
+			return
+		}
+		chain := [][]byte{c.Crt.Raw}
+		for _, crt := range Chain(c) {
+			chain = append(chain, crt.Raw)
+		}
+		scts, err := ct.submit("add-chain", chain)
+		if err == nil {
+			err = saveSCTs(c.Crt, scts)
+		}
+		if err != nil {
+			log.Printf("(Warning) CT logging of %s failed: %s", e.Name, err)
+		}
+	}()
+}
+
+// createCertificate signs the certificate for the template with the parent key. When the CT logs
+// are configured to embed them, the SCTs of a precertificate are first obtained and included
+func createCertificate(tmpl *x509.Certificate, parent *Cert, pub crypto.PublicKey) ([]byte, error) {
+	cfg := LoadConfig()
+	if cfg == nil || !cfg.CT.logs(tmpl, parent) || !cfg.CT.Embed {
+		return x509.CreateCertificate(rand.Reader, tmpl, parent.Crt, pub, parent.Key)
+	}
+	pre := *tmpl
+	pre.ExtraExtensions = append(append([]pkix.Extension{}, tmpl.ExtraExtensions...),
+		pkix.Extension{Id: oidCTPoison, Critical: true, Value: asn1.NullBytes})
+	der, err := x509.CreateCertificate(rand.Reader, &pre, parent.Crt, pub, parent.Key)
+	if err != nil {
+		return nil, err
+	}
+	chain := [][]byte{der, parent.Crt.Raw}
+	for _, crt := range Chain(parent) {
+		chain = append(chain, crt.Raw)
+	}
+	scts, err := cfg.CT.submit("add-pre-chain", chain)
+	if err != nil {
+		return nil, err
+	}
+	list, err := asn1.Marshal(marshalSCTList(scts))
+	if err != nil {
+		return nil, err
+	}
+	final := *tmpl
+	final.ExtraExtensions = append(append([]pkix.Extension{}, tmpl.ExtraExtensions...),
+		pkix.Extension{Id: oidSCTList, Value: list})
+	if der, err = x509.CreateCertificate(rand.Reader, &final, parent.Crt, pub, parent.Key); err != nil {
+		return nil, err
+	}
+	return der, saveSCTs(tmpl, scts)
+}
+
+// submit sends the chain to all the logs and returns their SCTs, failing only if no log took it
+func (ct CT) submit(path string, chain [][]byte) ([]SCT, error) {
+	body, err := json.Marshal(map[string][][]byte{"chain": chain})
+	if err != nil {
+		return nil, err
+	}
+	scts := make([]SCT, 0)
+	errs := make([]string, 0)
+	for _, l := range ct.Logs {
+		sct, err := submitSCT(l, path, body)
+		if err != nil {
+			log.Printf("(Warning) CT log %s failed: %s", l, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", l, err))
+			continue
+		}
+		scts = append(scts, *sct)
+	}
+	if len(scts) == 0 {
+		return nil, fmt.Errorf("%s: %s", tr("No CT log accepted the certificate"), strings.Join(errs, ", "))
+	}
+	return scts, nil
+}
+
+// submitSCT posts the request body to the log and returns its SCT
+func submitSCT(logURL, path string, body []byte) (*SCT, error) {
+	resp, err := ctClient.Post(strings.TrimSuffix(logURL, "/")+"/ct/v1/"+path, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	sct := &SCT{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, API_MAX_BODY)).Decode(sct); err != nil {
+		return nil, err
+	}
+	if len(sct.ID) != 32 || len(sct.Signature) == 0 {
+		return nil, fmt.Errorf("%s", tr("Wrong SCT"))
+	}
+	sct.Log = logURL
+	return sct, nil
+}
+
+// marshalSCTList returns the TLS encoded SignedCertificateTimestampList (RFC 6962 section 3.3)
+func marshalSCTList(scts []SCT) []byte {
+	list := &bytes.Buffer{}
+	for _, sct := range scts {
+		b := &bytes.Buffer{}
+		b.WriteByte(sct.Version)
+		b.Write(sct.ID)
+		binary.Write(b, binary.BigEndian, sct.Timestamp)
+		binary.Write(b, binary.BigEndian, uint16(len(sct.Extensions)))
+		b.Write(sct.Extensions)
+		b.Write(sct.Signature)
+		binary.Write(list, binary.BigEndian, uint16(b.Len()))
+		list.Write(b.Bytes())
+	}
+	out := &bytes.Buffer{}
+	binary.Write(out, binary.BigEndian, uint16(list.Len()))
+	out.Write(list.Bytes())
+	return out.Bytes()
+}
+
+// sctFile returns the SCTs filename for a given Certificate name
+func sctFile(name string) string {
+	return filename(name) + SCT_SUFFIX
+}
+
+// saveSCTs stores the SCTs of the certificate (or template) alongside it
+func saveSCTs(crt *x509.Certificate, scts []SCT) error {
+	data, err := json.MarshalIndent(sctRecord{serialKey(crt.SerialNumber), scts}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.Put(sctFile(crt.Subject.CommonName), data, false)
+}
+
+// SCTs returns the stored SCTs of the certificate, if they are about its current version
+func SCTs(c *Cert) []SCT {
+	data, err := storage.Get(sctFile(c.Crt.Subject.CommonName))
+	if err != nil {
+		return nil
+	}
+	var rec sctRecord
+	if json.Unmarshal(data, &rec) != nil || rec.Serial != serialKey(c.Crt.SerialNumber) {
+		return nil
+	}
+	return rec.SCTs
+}
+
+// Time returns the SCT timestamp
+func (sct SCT) Time() time.Time {
+	return time.Unix(0, int64(sct.Timestamp)*int64(time.Millisecond))
+}
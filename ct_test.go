@@ -0,0 +1,72 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCertificateTransparency(t *testing.T) {
+	inTestDir(t)
+	submitted := make(map[string]*x509.Certificate)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Chain [][]byte }
+		json.NewDecoder(r.Body).Decode(&req)
+		crt, err := x509.ParseCertificate(req.Chain[0])
+		if err != nil || len(req.Chain) != 2 {
+			http.Error(w, "bad chain", http.StatusBadRequest)
+			return
+		}
+		submitted[r.URL.Path] = crt
+		json.NewEncoder(w).Encode(SCT{ID: make([]byte, 32), Timestamp: uint64(time.Now().UnixNano() / 1e6),
+			Signature: []byte{4, 3, 0, 2, 0xab, 0xcd}})
+	}))
+	defer srv.Close()
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{CT: &CT{Logs: []string{srv.URL}, Embed: true}}
+	ca, err := GenCACert(pkix.Name{CommonName: "CTCA"}, ForDays(365))
+	dieOnError(t, err)
+	if len(submitted) != 0 {
+		t.Fatal("The CA was logged")
+	}
+	c, err := GenCert(ca, "ct.example.com", ForDays(30))
+	dieOnError(t, err)
+	pre := submitted["/ct/v1/add-pre-chain"]
+	if pre == nil || pre.SerialNumber.Cmp(c.Crt.SerialNumber) != 0 {
+		t.Fatalf("Unexpected precertificate %v", pre)
+	}
+	poisoned, embedded := false, false
+	for _, ext := range pre.Extensions {
+		poisoned = poisoned || (ext.Id.Equal(oidCTPoison) && ext.Critical)
+	}
+	for _, ext := range c.Crt.Extensions {
+		var list []byte
+		if ext.Id.Equal(oidSCTList) {
+			_, err := asn1.Unmarshal(ext.Value, &list)
+			embedded = err == nil && bytes.Equal(list, marshalSCTList(SCTs(c)))
+		}
+	}
+	if !poisoned || !embedded || len(SCTs(c)) != 1 || SCTs(c)[0].Log != srv.URL {
+		t.Fatalf("SCTs not embedded: poison %v, embedded %v, %v", poisoned, embedded, SCTs(c))
+	}
+	renewed, err := RenewCert(c, false)
+	dieOnError(t, err)
+	if len(customExtensions(renewed.Crt)) != 0 || len(SCTs(renewed)) != 1 {
+		t.Fatalf("The old SCTs were copied to the renewal: %v", customExtensions(renewed.Crt))
+	}
+	cachedCfg.CT.Embed = false
+	c, err = GenCert(ca, "logged.example.com", ForDays(30))
+	dieOnError(t, err)
+	for i := 0; i < 50 && SCTs(c) == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if crt := submitted["/ct/v1/add-chain"]; crt == nil || !bytes.Equal(crt.Raw, c.Crt.Raw) || len(SCTs(c)) != 1 {
+		t.Fatalf("Certificate not logged: %v", SCTs(c))
+	}
+}
@@ -0,0 +1,316 @@
+package webca
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCA_DELIVERIES     = ".webca.deliveries"
+	WEBCA_KNOWN_HOSTS    = ".webca.known_hosts"
+	DELIVERY_TIMEOUT     = 2 * time.Minute
+	DELIVERY_MAX_MESSAGE = 512 // bytes of the sftp output kept on failure
+)
+
+// Delivery is a remote server a certificate, its full chain and key are copied to over SFTP
+type Delivery struct {
+	Host string // host name, with the port if not 22
+	User string
+	Path string // remote directory
+	Key  string // PEM private SSH key of the user
+}
+
+// DeliveryStatus is the outcome of the last delivery to a target
+type DeliveryStatus struct {
+	Time   time.Time
+	Serial string // of the delivered certificate
+	Error  string
+}
+
+// deliveryView is a delivery target with its status, as shown to the web user
+type deliveryView struct {
+	Target string
+	Status *DeliveryStatus
+}
+
+// sftpCommand is the OpenSSH sftp client run for the deliveries (replaceable for testing)
+var sftpCommand = "sftp"
+
+// delivery statuses lock
+var sdeliveries sync.Mutex
+
+// deliveryLocks serialize the deliveries of each certificate to each target, for the last one to
+// copy the current certificate; the map is guarded by sdeliveries
+var deliveryLocks = make(map[string]*sync.Mutex)
+
+func init() {
+	Subscribe(deliverCerts)
+}
+
+// String identifies the target
+func (d Delivery) String() string {
+	return d.User + "@" + d.Host + ":" + d.Path
+}
+
+// deliverCerts copies in the background the issued or renewed certificate to its targets
+func deliverCerts(e Event) {
+	if e.Type != EVENT_ISSUE && e.Type != EVENT_RENEW {
+		return
+	}
+	cfg := LoadConfig()
+	if cfg == nil || len(cfg.Deliveries[e.Name]) == 0 {
+		return
+	}
+	for _, d := range cfg.Deliveries[e.Name] {
+		go func(d Delivery) {
+			l := deliveryLock(e.Name, d)
+			l.Lock()
+			defer l.Unlock()
+			c := FindCert(e.Name)
+			if c == nil {
+				return
+			}
+			if err := retry(func() error { return d.deliver(c) }); err != nil {
+				log.Printf("(Warning) Delivery of %s to %s failed: %s", e.Name, d, err)
+			}
+		}(d)
+	}
+}
+
+// deliveryLock returns the lock of the deliveries of the named certificate to the target
+func deliveryLock(name string, d Delivery) *sync.Mutex {
+	sdeliveries.Lock()
+	defer sdeliveries.Unlock()
+	key := name + " " + d.String()
+	if deliveryLocks[key] == nil {
+		deliveryLocks[key] = &sync.Mutex{}
+	}
+	return deliveryLocks[key]
+}
+
+// deliver copies the certificate files to the target and records the outcome
+func (d Delivery) deliver(c *Cert) error {
+	err := d.upload(c)
+	status := DeliveryStatus{Time: time.Now(), Serial: serialKey(c.Crt.SerialNumber)}
+	if err != nil {
+		status.Error = err.Error()
+		name := c.Crt.Subject.CommonName
+		addInboxItem(INBOX_DELIVERY_FAILED, name, tr("The delivery of %s to %s failed: %s", name, d, err))
+	}
+	if serr := saveDeliveryStatus(c.Crt.Subject.CommonName, d.String(), status); serr != nil {
+		log.Printf("(Warning) Could not save the delivery status: %s", serr)
+	}
+	return err
+}
+
+// upload runs sftp in batch mode to put the certificate, full chain and key in the remote
+// directory. Unknown host keys are accepted the first time and remembered in WEBCA_KNOWN_HOSTS
+func (d Delivery) upload(c *Cert) error {
+	if c.Key == nil {
+		return fmt.Errorf("%s", tr("There is no key for %s!", c.Crt.Subject.CommonName))
+	}
+	dir, err := ioutil.TempDir("", "webca-delivery")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	chain, err := FullChainPEM(c, false)
+	if err != nil {
+		return err
+	}
+	block, err := marshalKey(c.Key)
+	if err != nil {
+		return err
+	}
+	name := filename(c.Crt.Subject.CommonName)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{name + CERT_SUFFIX, pemCerts(c.Crt)},
+		{name + ".fullchain.pem", chain},
+		{name + KEY_SUFFIX, pem.EncodeToMemory(block)},
+		{"id", []byte(d.Key)},
+	}
+	batch := &bytes.Buffer{}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), f.data, 0600); err != nil {
+			return err
+		}
+		if f.name != "id" { // -p keeps the 0600 permissions
+			fmt.Fprintf(batch, "put -p \"%s\" \"%s\"\n", filepath.Join(dir, f.name), path.Join(d.Path, f.name))
+		}
+	}
+	knownHosts, err := filepath.Abs(dataPath(WEBCA_KNOWN_HOSTS))
+	if err != nil {
+		return err
+	}
+	host, port := d.Host, "22"
+	if h, p, err := net.SplitHostPort(d.Host); err == nil {
+		host, port = h, p
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DELIVERY_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, sftpCommand, "-b", "-", "-i", filepath.Join(dir, "id"), "-P", port,
+		"-o", "BatchMode=yes", "-o", "IdentitiesOnly=yes", "-o", "StrictHostKeyChecking=accept-new",
+		"-o", "UserKnownHostsFile="+knownHosts, d.User+"@"+host)
+	cmd.Stdin = batch
+	if out, err := cmd.CombinedOutput(); err != nil {
+		msg := strings.TrimSpace(string(out))
+		if len(msg) > DELIVERY_MAX_MESSAGE {
+			msg = msg[len(msg)-DELIVERY_MAX_MESSAGE:]
+		}
+		return fmt.Errorf("%s: %s", err, msg)
+	}
+	return nil
+}
+
+// setDeliveries saves the delivery targets of the named certificate, which must not share the
+// array of the current ones
+func (cfg *config) setDeliveries(name string, targets []Delivery) error {
+	return cfg.update(func(cfg *config) error {
+		deliveries := make(map[string][]Delivery, len(cfg.Deliveries)+1)
+		for n, t := range cfg.Deliveries {
+			deliveries[n] = t
+		}
+		if len(targets) == 0 {
+			delete(deliveries, name)
+		} else {
+			deliveries[name] = targets
+		}
+		cfg.Deliveries = deliveries
+		return nil
+	})
+}
+
+// Deliveries returns the delivery targets of the named certificate with their last outcome
+func Deliveries(name string) []deliveryView {
+	cfg := LoadConfig()
+	if cfg == nil || len(cfg.Deliveries[name]) == 0 {
+		return nil
+	}
+	sdeliveries.Lock()
+	defer sdeliveries.Unlock()
+	statuses, err := loadDeliveries()
+	if err != nil {
+		log.Printf("(Warning) %s", err)
+	}
+	views := make([]deliveryView, 0)
+	for _, d := range cfg.Deliveries[name] {
+		v := deliveryView{Target: d.String()}
+		if s, ok := statuses[name][v.Target]; ok {
+			v.Status = &s
+		}
+		views = append(views, v)
+	}
+	return views
+}
+
+// saveDeliveryStatus records the outcome of a delivery of the named certificate to the target
+func saveDeliveryStatus(name, target string, status DeliveryStatus) error {
+	sdeliveries.Lock()
+	defer sdeliveries.Unlock()
+	statuses, err := loadDeliveries()
+	if err != nil {
+		return err
+	}
+	if statuses[name] == nil {
+		statuses[name] = make(map[string]DeliveryStatus)
+	}
+	statuses[name][target] = status
+	return saveGob(WEBCA_DELIVERIES, statuses)
+}
+
+// loadDeliveries reads the delivery statuses by certificate and target from the storage
+// (the caller must hold sdeliveries)
+func loadDeliveries() (map[string]map[string]DeliveryStatus, error) {
+	statuses := make(map[string]map[string]DeliveryStatus)
+	if err := loadGob(WEBCA_DELIVERIES, &statuses); os.IsNotExist(err) {
+		return statuses, nil
+	} else if err != nil {
+		return make(map[string]map[string]DeliveryStatus), err
+	}
+	return statuses, nil
+}
+
+// readDelivery reads a delivery target from the request
+func readDelivery(r *http.Request) (*Delivery, error) {
+	d := &Delivery{Host: strings.TrimSpace(r.FormValue("Host")), User: strings.TrimSpace(r.FormValue("User")),
+		Path: strings.TrimSpace(r.FormValue("Path")), Key: strings.TrimSpace(r.FormValue("Key")) + "\n"}
+	if d.Host == "" || strings.ContainsAny(d.Host, "@/ ") {
+		return nil, fmt.Errorf("%s: %v", tr("Wrong host!"), d.Host)
+	}
+	if d.User == "" || strings.ContainsAny(d.User, "@: ") {
+		return nil, fmt.Errorf("%s: %v", tr("Wrong user!"), d.User)
+	}
+	if d.Path == "" || strings.ContainsAny(d.Path, "\"\n") {
+		return nil, fmt.Errorf("%s: %v", tr("Wrong remote directory!"), d.Path)
+	}
+	if block, _ := pem.Decode([]byte(d.Key)); block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("%s", tr("The SSH key must be a PEM private key!"))
+	}
+	return d, nil
+}
+
+// delivery allows the web user to manage and run the SFTP delivery targets of a certificate
+func delivery(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	cfg := LoadConfig()
+	cn := c.Crt.Subject.CommonName
+	if r.Method == "POST" {
+		i, _ := strconv.Atoi(r.FormValue("index"))
+		targets := cfg.Deliveries[cn]
+		switch r.FormValue("action") {
+		case "delete":
+			if i >= 0 && i < len(targets) {
+				err = cfg.setDeliveries(cn, append(targets[:i:i], targets[i+1:]...))
+			}
+		case "deliver":
+			if i >= 0 && i < len(targets) {
+				err = targets[i].deliver(c)
+			}
+		default:
+			var d *Delivery
+			if d, err = readDelivery(r); err == nil {
+				err = cfg.setDeliveries(cn, append(targets[:len(targets):len(targets)], *d))
+			}
+			if err == nil {
+				err = d.deliver(c)
+			}
+		}
+		if err == nil && r.FormValue("action") != "deliver" {
+			auditRequest(w, r, AUDIT_CONFIG, "delivery of "+cn)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/delivery?cert="+url.QueryEscape(cn), 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	ps["Cert"] = c
+	ps["Deliveries"] = Deliveries(cn)
+	err = templatesFor(r).ExecuteTemplate(w, "delivery", ps)
+	handleError(w, r, err)
+}
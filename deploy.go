@@ -0,0 +1,116 @@
+package webca
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEPLOY_TIMEOUT    = 5 * time.Minute
+	DEPLOY_MAX_OUTPUT = 4096 // bytes of the hook output logged
+)
+
+// DeployHook is an executable run after a certificate is issued or renewed, e.g. to reload a web
+// server. It gets the certificate details in WEBCA_* environment variables
+type DeployHook struct {
+	Path  string   // absolute path of the executable or script, run without a shell
+	Certs []string // names of the certificates deployed, all if empty
+}
+
+func init() {
+	Subscribe(runDeployHooks)
+}
+
+// runDeployHooks runs in the background the deploy hooks of the issued or renewed certificate
+func runDeployHooks(e Event) {
+	if e.Type != EVENT_ISSUE && e.Type != EVENT_RENEW {
+		return
+	}
+	cfg := LoadConfig()
+	if cfg == nil {
+		return
+	}
+	for _, dh := range cfg.DeployHooks {
+		if dh.deploys(e.Name) {
+			go func(dh DeployHook) {
+				out, err := dh.run(e)
+				if err != nil {
+					log.Printf("(Warning) Deploy hook %s for %s failed: %s\n%s", dh.Path, e.Name, err, out)
+				} else {
+					log.Printf("Deploy hook %s for %s done\n%s", dh.Path, e.Name, out)
+				}
+			}(dh)
+		}
+	}
+}
+
+// deploys tells whether or not the hook deploys the named certificate
+func (dh DeployHook) deploys(name string) bool {
+	if len(dh.Certs) == 0 {
+		return true
+	}
+	for _, c := range dh.Certs {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// run executes the hook for the event and returns its output, truncated to DEPLOY_MAX_OUTPUT
+func (dh DeployHook) run(e Event) (string, error) {
+	c := FindCert(e.Name)
+	if c == nil {
+		return "", fmt.Errorf("%s", tr("Certificate %s not found!", e.Name))
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DEPLOY_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, dh.Path)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"WEBCA_EVENT="+e.Type,
+		"WEBCA_CERT_NAME="+e.Name,
+		"WEBCA_CERT_FILE="+filepath.Join(dir, certFile(*c)),
+		"WEBCA_SERIAL="+e.Serial,
+		"WEBCA_ISSUER="+e.Issuer,
+		"WEBCA_NOT_AFTER="+e.NotAfter.Format(time.RFC3339),
+		"WEBCA_SANS="+strings.Join(e.SANs, ","),
+	)
+	if c.Key != nil {
+		cmd.Env = append(cmd.Env, "WEBCA_KEY_FILE="+filepath.Join(dir, keyFile(*c)))
+	}
+	if c.Parent != nil && c.Parent != c && len(c.Parent.Crt.Raw) > 0 {
+		cmd.Env = append(cmd.Env, "WEBCA_CA_FILE="+filepath.Join(dir, certFile(*c.Parent)))
+	}
+	out, err := cmd.CombinedOutput()
+	if len(out) > DEPLOY_MAX_OUTPUT {
+		out = append(out[:DEPLOY_MAX_OUTPUT], "..."...)
+	}
+	return string(out), err
+}
+
+// readDeployHook reads a deploy hook from the request
+func readDeployHook(r *http.Request) (*DeployHook, error) {
+	dh := &DeployHook{Path: strings.TrimSpace(r.FormValue("Path")), Certs: make([]string, 0)}
+	for _, name := range strings.Split(r.FormValue("Certs"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			dh.Certs = append(dh.Certs, name)
+		}
+	}
+	fi, err := os.Stat(dh.Path)
+	if !filepath.IsAbs(dh.Path) || err != nil || !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+		return nil, fmt.Errorf("%s: %v", tr("The hook must be the absolute path of an executable!"), dh.Path)
+	}
+	return dh, nil
+}
@@ -0,0 +1,38 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeployHook(t *testing.T) {
+	inTestDir(t)
+	dir, err := os.Getwd()
+	dieOnError(t, err)
+	script := filepath.Join(dir, "deploy.sh")
+	dieOnError(t, ioutil.WriteFile(script,
+		[]byte("#!/bin/sh\necho \"$WEBCA_EVENT $WEBCA_CERT_NAME\"\ncat \"$WEBCA_KEY_FILE\" > /dev/null\n"), 0700))
+	ca, err := GenCACert(pkix.Name{CommonName: "DeployCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "www.example.com", ForDays(30))
+	dieOnError(t, err)
+	certree = nil
+	dh := DeployHook{Path: script, Certs: []string{"www.example.com"}}
+	if dh.deploys("other.example.com") || !dh.deploys("www.example.com") {
+		t.Fatalf("Wrong certificates deployed by %v", dh)
+	}
+	out, err := dh.run(newEvent(EVENT_RENEW, FindCert("www.example.com").Crt))
+	dieOnError(t, err)
+	if strings.TrimSpace(out) != "renew www.example.com" {
+		t.Fatalf("Unexpected hook output %q", out)
+	}
+	dieOnError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho broken\nexit 3\n"), 0700))
+	out, err = dh.run(newEvent(EVENT_ISSUE, FindCert("www.example.com").Crt))
+	if err == nil || !strings.Contains(out, "broken") {
+		t.Fatalf("The hook failure was not reported: %v %q", err, out)
+	}
+}
@@ -1,17 +1,39 @@
 package webca
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
 	"net/smtp"
 	"strings"
+	"time"
 )
 
 const (
-	MAIL_LABEL = "WebCA"
+	MAIL_LABEL   = "WebCA"
+	MAIL_TIMEOUT = 30 * time.Second
+
+	MAIL_STARTTLS = "starttls" // STARTTLS required
+	MAIL_TLS      = "tls"      // implicit TLS from the start, as on port 465
+	MAIL_NO_TLS   = "none"     // plain text, only for the relays on the same host
+
+	MAIL_AUTH_PLAIN   = "PLAIN"
+	MAIL_AUTH_LOGIN   = "LOGIN"
+	MAIL_AUTH_CRAMMD5 = "CRAM-MD5"
 )
 
+// MailTLSModes are the TLS modes of the mailer, STARTTLS when offered if empty
+var MailTLSModes = []string{MAIL_STARTTLS, MAIL_TLS, MAIL_NO_TLS}
+
+// MailAuths are the SMTP authentication mechanisms, the first one that works if empty
+var MailAuths = []string{MAIL_AUTH_PLAIN, MAIL_AUTH_LOGIN, MAIL_AUTH_CRAMMD5}
+
 type Mailer struct {
 	Server, User, Passwd string
+	TLS                  string // one of MailTLSModes, STARTTLS when offered if empty
+	SkipVerify           bool   // don't verify the server certificate (self-signed relays)
+	Auth                 string // one of MailAuths, the first one that works if empty
 	bestAuth             smtp.Auth
 }
 
@@ -25,12 +47,11 @@ func (m *Mailer) SendMail(to, subject, body string) error {
 	msg := "from: \"" + MAIL_LABEL + "\" <" + m.User + ">\nto: " + to +
 		"\nsubject: (" + MAIL_LABEL + ") " + subject + "\n\n" + body
 	if m.bestAuth == nil {
-		auths = []smtp.Auth{smtp.CRAMMD5Auth(m.User, m.Passwd),
-			smtp.PlainAuth("", m.User, m.Passwd, host)}
+		auths = m.auths(host)
 	}
 	var errs error
 	for _, auth := range auths {
-		err := smtp.SendMail(m.Server, auth, m.User, []string{to}, ([]byte)(msg))
+		err := m.send(host, auth, to, ([]byte)(msg))
 		if err == nil {
 			m.bestAuth = auth
 			return nil
@@ -41,6 +62,158 @@ func (m *Mailer) SendMail(to, subject, body string) error {
 	return errs
 }
 
+// validMailOption tells whether or not the option is one of the options
+func validMailOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOptions fails if the TLS mode or the authentication mechanism is not known
+func (m *Mailer) checkOptions() error {
+	if m.TLS != "" && !validMailOption(MailTLSModes, m.TLS) {
+		return fmt.Errorf("%s: %v", tr("Wrong TLS mode!"), m.TLS)
+	}
+	if m.Auth != "" && !validMailOption(MailAuths, m.Auth) {
+		return fmt.Errorf("%s: %v", tr("Wrong authentication mechanism!"), m.Auth)
+	}
+	return nil
+}
+
+// auths returns the authentications to try in order, the configured one only if any, none
+// without a password
+func (m *Mailer) auths(host string) []smtp.Auth {
+	if m.Passwd == "" {
+		return []smtp.Auth{nil}
+	}
+	all := map[string]smtp.Auth{
+		MAIL_AUTH_PLAIN:   smtp.PlainAuth("", m.User, m.Passwd, host),
+		MAIL_AUTH_LOGIN:   &loginAuth{m.User, m.Passwd, host},
+		MAIL_AUTH_CRAMMD5: smtp.CRAMMD5Auth(m.User, m.Passwd),
+	}
+	if auth, ok := all[m.Auth]; ok {
+		return []smtp.Auth{auth}
+	}
+	return []smtp.Auth{all[MAIL_AUTH_CRAMMD5], all[MAIL_AUTH_PLAIN], all[MAIL_AUTH_LOGIN]}
+}
+
+// dial connects to the mail server with the TLS mode of the mailer
+func (m *Mailer) dial(host string) (*smtp.Client, error) {
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: m.SkipVerify}
+	dialer := &net.Dialer{Timeout: MAIL_TIMEOUT}
+	if m.TLS == MAIL_TLS {
+		conn, err := tls.DialWithDialer(dialer, "tcp", m.Server, config)
+		if err != nil {
+			return nil, err
+		}
+		return smtp.NewClient(conn, host)
+	}
+	conn, err := dialer.Dial("tcp", m.Server)
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if m.TLS == MAIL_NO_TLS {
+		return c, nil
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if m.TLS == MAIL_STARTTLS {
+			c.Close()
+			return nil, fmt.Errorf("%s", tr("The mail server %s does not offer STARTTLS!", m.Server))
+		}
+		return c, nil
+	}
+	if err := c.StartTLS(config); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// send sends the message through a new connection, authenticated unless auth is nil
+func (m *Mailer) send(host string, auth smtp.Auth, to string, msg []byte) error {
+	c, err := m.dial(host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.User); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// replyTestMail sends a test message through the mailer and replies with its outcome in plain
+// text, with the answer of the mail server when it fails
+func replyTestMail(w http.ResponseWriter, m *Mailer, to string) {
+	if to == "" {
+		http.Error(w, tr("There is nobody to send the test message to!"), http.StatusBadRequest)
+		return
+	}
+	err := sendMail(m, to, tr("Test message"), tr("This message tests the mail settings of the WebCA."))
+	if err != nil {
+		http.Error(w, tr("The test message could not be sent:")+"\n"+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, tr("Test message sent to %s through %s", to, m.Server))
+}
+
+// loginAuth is the LOGIN authentication many corporate relays still require, like PLAIN only
+// over TLS or to the local host
+type loginAuth struct {
+	user, passwd, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	local := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+	if !server.TLS && !local {
+		return "", nil, fmt.Errorf("%s", tr("Unencrypted connection to the mail server!"))
+	}
+	if server.Name != a.host {
+		return "", nil, fmt.Errorf("%s", tr("Wrong mail server name!"))
+	}
+	return MAIL_AUTH_LOGIN, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.user), nil
+	case "password:":
+		return []byte(a.passwd), nil
+	}
+	return nil, fmt.Errorf("%s: %q", tr("Unexpected LOGIN challenge"), fromServer)
+}
+
 /*
 func read(msg string, ptr interface{}) {
 	fmt.Print(msg)
@@ -0,0 +1,167 @@
+package webca
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP serves one SMTP session without STARTTLS nor TLS, accepting AUTH LOGIN, and returns
+// what it received
+func fakeSMTP(t *testing.T) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	got := make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			got <- nil
+			return
+		}
+		defer conn.Close()
+		lines := make([]string, 0)
+		in := bufio.NewReader(conn)
+		reply := func(s string) { fmt.Fprintf(conn, "%s\r\n", s) }
+		read := func() string {
+			line, _ := in.ReadString('\n')
+			return strings.TrimRight(line, "\r\n")
+		}
+		reply("220 localhost ESMTP")
+		for {
+			line := read()
+			lines = append(lines, line)
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO":
+				reply("250-localhost\r\n250 AUTH LOGIN PLAIN")
+			case "AUTH":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user, _ := base64.StdEncoding.DecodeString(read())
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				passwd, _ := base64.StdEncoding.DecodeString(read())
+				lines = append(lines, string(user)+":"+string(passwd))
+				reply("235 Authenticated")
+			case "DATA":
+				reply("354 Go ahead")
+				for line := read(); line != "."; line = read() {
+					lines = append(lines, line)
+				}
+				reply("250 Queued")
+			case "QUIT", "":
+				reply("221 Bye")
+				got <- lines
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestMailerOptions(t *testing.T) {
+	cfg := &config{}
+	if err := cfg.setMailer(Mailer{Server: "smtp.example.com:465", TLS: "ssl"}); err == nil {
+		t.Fatal("Unknown TLS mode accepted")
+	}
+	if err := cfg.setMailer(Mailer{Server: "smtp.example.com:465", Auth: "NTLM"}); err == nil {
+		t.Fatal("Unknown auth mechanism accepted")
+	}
+	dieOnError(t, cfg.setMailer(Mailer{Server: "smtp.example.com:465", User: "ca@example.com", Passwd: "s3cret",
+		TLS: MAIL_TLS, SkipVerify: true, Auth: MAIL_AUTH_LOGIN}))
+	dieOnError(t, cfg.setMailer(Mailer{Server: "smtp.example.com:587", User: "ca@example.com", TLS: MAIL_STARTTLS}))
+	if m := cfg.Mailer; m.Passwd != "s3cret" || m.TLS != MAIL_STARTTLS || m.SkipVerify || m.Auth != "" {
+		t.Fatalf("Unexpected mailer %+v", m)
+	}
+
+	addr, got := fakeSMTP(t)
+	m := &Mailer{Server: addr, User: "ca@example.com", Passwd: "s3cret", TLS: MAIL_NO_TLS, Auth: MAIL_AUTH_LOGIN}
+	dieOnError(t, m.SendMail("admin@example.com", "Hello", "Body"))
+	lines := strings.Join(<-got, "\n")
+	for _, s := range []string{"AUTH LOGIN", "ca@example.com:s3cret", "RCPT TO:<admin@example.com>", "subject: (WebCA) Hello"} {
+		if !strings.Contains(lines, s) {
+			t.Fatalf("%q not sent in %s", s, lines)
+		}
+	}
+
+	addr, got = fakeSMTP(t)
+	m = &Mailer{Server: addr, User: "ca@example.com", Passwd: "s3cret", TLS: MAIL_STARTTLS}
+	if err := m.SendMail("admin@example.com", "Hello", "Body"); err == nil {
+		t.Fatal("Sent without the required STARTTLS")
+	}
+	if lines := strings.Join(<-got, "\n"); strings.Contains(lines, "MAIL FROM") {
+		t.Fatalf("Mail sent in clear: %s", lines)
+	}
+}
+
+func TestTestMail(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Mailer: &Mailer{Server: "smtp.example.com:25", User: "ca@example.com", Passwd: "saved"},
+		Users: map[string]User{"tara": {Username: "tara", Email: "tara@example.com", Role: ROLE_ADMIN},
+			"omar": {Username: "omar", Role: ROLE_OPERATOR}}}
+	var sent *Mailer
+	var sentTo string
+	var failure error
+	defer func(saved func(m *Mailer, to, subject, body string) error) { sendMail = saved }(sendMail)
+	sendMail = func(m *Mailer, to, subject, body string) error {
+		sent, sentTo = m, to
+		return failure
+	}
+	post := func(h http.Handler, username string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/testMail", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if username != "" {
+			s, err := SessionFor(httptest.NewRecorder(), req)
+			dieOnError(t, err)
+			s[LOGGEDUSER] = cachedCfg.Users[username]
+			s.Save()
+			defer dropSession(s.Id())
+			req.AddCookie(&http.Cookie{Name: SESSIONID, Value: s.Id()})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	form := url.Values{"MailServer": {"smtp.test.com:465"}, "MailUser": {"ca@example.com"}, "MailTLS": {MAIL_TLS}}
+	w := post(instanceControl(testMail), "tara", form)
+	if w.Code != http.StatusOK || sentTo != "tara@example.com" || sent.Server != "smtp.test.com:465" ||
+		sent.Passwd != "saved" || sent.TLS != MAIL_TLS {
+		t.Fatalf("Test mail not sent: %d %s %+v", w.Code, w.Body, sent)
+	}
+	if m := cachedCfg.Mailer; m.Server != "smtp.example.com:25" || m.TLS != "" {
+		t.Fatalf("Test mail settings saved: %+v", m)
+	}
+	failure = fmt.Errorf("535 5.7.8 Authentication failed")
+	if w := post(instanceControl(testMail), "tara", form); w.Code != http.StatusBadGateway ||
+		!strings.Contains(w.Body.String(), "535 5.7.8") {
+		t.Fatalf("Failure not reported: %d %s", w.Code, w.Body)
+	}
+	failure = nil
+	if w := post(instanceControl(testMail), "tara", url.Values{"MailServer": {"smtp.test.com"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("Test mail without port: %d", w.Code)
+	}
+	if w := post(instanceControl(testMail), "omar", form); w.Code != http.StatusForbidden {
+		t.Fatalf("Test mail allowed to an operator: %d", w.Code)
+	}
+
+	defer func(saved bool) { setupDone = saved }(setupDone)
+	setupDone = false
+	w = post(http.HandlerFunc(setupTestMail), "", url.Values{"M.Server": {"smtp.setup.com"}, "M.Port": {"587"},
+		"M.User": {"ca@setup.com"}, "M.Auth": {MAIL_AUTH_LOGIN}, "Email": {"first@setup.com"}})
+	if w.Code != http.StatusOK || sentTo != "first@setup.com" || sent.Server != "smtp.setup.com:587" || sent.Auth != MAIL_AUTH_LOGIN {
+		t.Fatalf("Setup test mail not sent: %d %s %+v", w.Code, w.Body, sent)
+	}
+	setupDone = true
+	if w := post(http.HandlerFunc(setupTestMail), "", url.Values{"M.Server": {"smtp.setup.com"}, "M.Port": {"587"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("Setup test mail after the setup: %d", w.Code)
+	}
+}
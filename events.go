@@ -0,0 +1,81 @@
+package webca
+
+import (
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_ISSUE  = "issue"
+	EVENT_RENEW  = "renew"
+	EVENT_REVOKE = "revoke"
+	EVENT_DELETE = "delete"
+	EVENT_CROSS  = "cross-sign"
+)
+
+// EventTypes lists all the lifecycle event types
+var EventTypes = []string{EVENT_ISSUE, EVENT_RENEW, EVENT_REVOKE, EVENT_DELETE, EVENT_CROSS}
+
+// Event is a certificate lifecycle change
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name"`
+	Serial   string    `json:"serial"`
+	Issuer   string    `json:"issuer"`
+	IsCA     bool      `json:"isCA"`
+	SANs     []string  `json:"sans,omitempty"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// listeners get all published events
+var listeners []func(Event)
+
+// listeners lock
+var slisteners sync.RWMutex
+
+// Subscribe registers a function to be called on every lifecycle event.
+// Listeners are called synchronously, so they should not block for long
+func Subscribe(listener func(Event)) {
+	slisteners.Lock()
+	defer slisteners.Unlock()
+	listeners = append(listeners, listener)
+}
+
+// newEvent returns an event of the given type about the certificate crt
+func newEvent(eventType string, crt *x509.Certificate) Event {
+	return Event{
+		Type:     eventType,
+		Time:     time.Now(),
+		Name:     crt.Subject.CommonName,
+		Serial:   serialKey(crt.SerialNumber),
+		Issuer:   crt.Issuer.CommonName,
+		IsCA:     crt.IsCA,
+		SANs:     SANs(crt),
+		NotAfter: crt.NotAfter,
+	}
+}
+
+// publish sends an event about crt to all listeners
+func publish(eventType string, crt *x509.Certificate) {
+	e := newEvent(eventType, crt)
+	slisteners.RLock()
+	defer slisteners.RUnlock()
+	for _, listener := range listeners {
+		listener(e)
+	}
+}
+
+// Matches tells whether or not the event is of any of the given types (all if none given)
+func (e Event) Matches(types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
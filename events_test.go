@@ -0,0 +1,32 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	inTestDir(t)
+	var events []string
+	recording := true
+	Subscribe(func(e Event) {
+		if recording {
+			events = append(events, e.Type+" "+e.Name)
+		}
+	})
+	defer func() { recording = false }()
+	ca, err := GenCACert(pkix.Name{CommonName: "EventCA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "event.example.com", ForDays(30))
+	dieOnError(t, err)
+	crt, err = RenewCert(crt, false)
+	dieOnError(t, err)
+	if !DeleteCert(crt) {
+		t.Fatal("Could not delete the certificate!")
+	}
+	expected := "issue EventCA,issue event.example.com,renew event.example.com,delete event.example.com"
+	if strings.Join(events, ",") != expected {
+		t.Fatalf("Expected events %q but got %q", expected, strings.Join(events, ","))
+	}
+}
@@ -0,0 +1,66 @@
+package webca
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ExpiryBucket groups the certificates expiring within the same time frame
+type ExpiryBucket struct {
+	Name   string
+	Within time.Duration // upper limit of the time left, 0 for the already expired
+	Certs  []*Cert
+}
+
+// expiryLimits are the dashboard time frames, from the most urgent
+var expiryLimits = []struct {
+	name   string
+	within time.Duration
+}{
+	{"Expired", 0},
+	{"Expiring in less than 7 days", 7 * 24 * time.Hour},
+	{"Expiring in less than 30 days", 30 * 24 * time.Hour},
+	{"Expiring in less than 90 days", 90 * 24 * time.Hour},
+}
+
+// ExpiringCerts buckets the certificates expiring within 90 days (or already expired) from now
+// by time left, the soonest to expire first within each bucket
+func ExpiringCerts(now time.Time) []*ExpiryBucket {
+	return expiringIn(now, "")
+}
+
+// expiringIn buckets the expiring certificates the users of the organization can see
+func expiringIn(now time.Time, org string) []*ExpiryBucket {
+	buckets := make([]*ExpiryBucket, len(expiryLimits))
+	for i, l := range expiryLimits {
+		buckets[i] = &ExpiryBucket{Name: tr("%s", l.name), Within: l.within, Certs: make([]*Cert, 0)}
+	}
+	last := expiryLimits[len(expiryLimits)-1].within
+	for _, c := range FindCerts(CertFilter{ExpiresBefore: now.Add(last), Org: org}) {
+		left := c.Crt.NotAfter.Sub(now)
+		for _, b := range buckets {
+			if left <= b.Within {
+				b.Certs = append(b.Certs, c)
+				break
+			}
+		}
+	}
+	for _, b := range buckets {
+		sort.SliceStable(b.Certs, func(i, j int) bool {
+			return b.Certs[i].Crt.NotAfter.Before(b.Certs[j].Crt.NotAfter)
+		})
+	}
+	return buckets
+}
+
+// expiring shows the expiry dashboard
+func expiring(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	ps["Buckets"] = expiringIn(time.Now(), requestOrg(r))
+	err := templatesFor(r).ExecuteTemplate(w, "expiring", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,30 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiringCerts(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "ExpiryCA"}, ForDays(365))
+	dieOnError(t, err)
+	for name, days := range map[string]int{"week": 3, "month": 20, "quarter": 60, "year": 200} {
+		_, err := GenCert(ca, name, ForDays(days))
+		dieOnError(t, err)
+	}
+	buckets := ExpiringCerts(time.Now().AddDate(0, 0, 10))
+	expected := []string{"week", "", "month", "quarter"}
+	for i, b := range buckets {
+		names := make([]string, 0)
+		for _, c := range b.Certs {
+			names = append(names, c.Crt.Subject.CommonName)
+		}
+		if strings.Join(names, ",") != expected[i] {
+			t.Fatalf("Bucket %s expected %q but got %v", b.Name, expected[i], names)
+		}
+	}
+}
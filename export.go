@@ -0,0 +1,250 @@
+package webca
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Chain returns the CA certificates above cert, from its issuer up to the root
+func Chain(cert *Cert) []*x509.Certificate {
+	chain := make([]*x509.Certificate, 0)
+	for c := cert; c.Parent != nil && c.Parent != c; c = c.Parent {
+		if len(c.Parent.Crt.Raw) == 0 { // unknown issuer
+			break
+		}
+		chain = append(chain, c.Parent.Crt)
+	}
+	return chain
+}
+
+// download sends data as an attachment with the given file name and content type
+func download(w http.ResponseWriter, name, contentType string, data []byte) {
+	w.Header().Set("Content-disposition", "attachment; filename="+strconv.Quote(name))
+	w.Header().Set("Content-type", contentType)
+	w.Write(data)
+}
+
+// p12 allows the web user to download a certificate with its key and chain as PKCS#12
+func p12(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	if c.Key == nil {
+		handleError(w, r, fmt.Errorf("%s", tr("There is no key for %s!", c.Crt.Subject.CommonName)))
+		return
+	}
+	if !keyAllowed(w, r, c.Crt.Subject.CommonName) {
+		return
+	}
+	if r.Method == "POST" {
+		password := r.FormValue("Password")
+		if password != r.FormValue("Confirm") {
+			err = fmt.Errorf("%s", tr("Passwords don't match!"))
+		}
+		var data []byte
+		if err == nil {
+			data, err = PKCS12(c.Crt, c.Key, Chain(c), password)
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_KEY_DOWNLOAD, certObject(c.Crt)+" p12")
+			download(w, filename(c.Crt.Subject.CommonName)+".p12", "application/x-pkcs12", data)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	ps["Cert"] = c
+	err = templatesFor(r).ExecuteTemplate(w, "p12", ps)
+	handleError(w, r, err)
+}
+
+// p7b downloads a certificate with its chain up to the root as a PKCS#7 bundle
+func p7b(w http.ResponseWriter, r *http.Request) {
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	data, err := PKCS7(append([]*x509.Certificate{c.Crt}, Chain(c)...))
+	if handleError(w, r, err) {
+		return
+	}
+	download(w, filename(c.Crt.Subject.CommonName)+".p7b", "application/x-pkcs7-certificates", data)
+}
+
+// FullChainPEM returns the PEM certificate followed by all its issuing CAs in order and,
+// if withKey is set, its private key (the single file bundle HAProxy and others expect)
+func FullChainPEM(c *Cert, withKey bool) ([]byte, error) {
+	data := pemCerts(append([]*x509.Certificate{c.Crt}, Chain(c)...)...)
+	if !withKey {
+		return data, nil
+	}
+	if c.Key == nil {
+		return nil, fmt.Errorf("%s", tr("There is no key for %s!", c.Crt.Subject.CommonName))
+	}
+	block, err := marshalKey(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, pem.EncodeToMemory(block)...), nil
+}
+
+// fullchain downloads a certificate with its chain, and optionally its key, as a PEM bundle
+func fullchain(w http.ResponseWriter, r *http.Request) {
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	withKey := r.FormValue("key") != ""
+	if withKey && !LoadConfig().plainKeysAllowed() {
+		handleError(w, r, fmt.Errorf("%s", tr("Unencrypted private key downloads are disabled!")))
+		return
+	}
+	if withKey && !keyAllowed(w, r, c.Crt.Subject.CommonName) {
+		return
+	}
+	data, err := FullChainPEM(c, withKey)
+	if handleError(w, r, err) {
+		return
+	}
+	if withKey {
+		auditRequest(w, r, AUDIT_KEY_DOWNLOAD, certObject(c.Crt)+" bundle")
+	}
+	suffix := ".fullchain.pem"
+	if withKey {
+		suffix = ".bundle.pem"
+	}
+	download(w, filename(c.Crt.Subject.CommonName)+suffix, "application/x-pem-file", data)
+}
+
+// CertPackage returns a ZIP file with the certificate, its key (if available and withKey is set),
+// chain, full chain and a README with their fingerprints
+func CertPackage(c *Cert, withKey bool) ([]byte, error) {
+	type file struct {
+		name string
+		data []byte
+	}
+	chain := Chain(c)
+	files := []file{{"cert.pem", pemCerts(c.Crt)}}
+	if withKey && c.Key != nil {
+		block, err := marshalKey(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file{"key.pem", pem.EncodeToMemory(block)})
+	}
+	files = append(files,
+		file{"chain.pem", pemCerts(chain...)},
+		file{"fullchain.pem", pemCerts(append([]*x509.Certificate{c.Crt}, chain...)...)},
+		file{"README.txt", packageReadme(c, chain, withKey && c.Key != nil)})
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pemCerts encodes the certificates as concatenated PEM blocks
+func pemCerts(crts ...*x509.Certificate) []byte {
+	data := make([]byte, 0)
+	for _, crt := range crts {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})...)
+	}
+	return data
+}
+
+// packageReadme describes the package contents and fingerprints
+func packageReadme(c *Cert, chain []*x509.Certificate, withKey bool) []byte {
+	lines := []string{
+		tr("Certificate package for %s", c.Crt.Subject.CommonName), "",
+		"cert.pem       " + tr("the certificate"),
+	}
+	if withKey {
+		lines = append(lines, "key.pem        "+tr("its private key, keep it secret!"))
+	}
+	lines = append(lines,
+		"chain.pem      "+tr("the issuing CA certificates, up to the root"),
+		"fullchain.pem  "+tr("the certificate followed by the chain"), "")
+	for _, crt := range append([]*x509.Certificate{c.Crt}, chain...) {
+		lines = append(lines, crt.Subject.CommonName,
+			"  "+tr("Valid until")+": "+crt.NotAfter.Format(MYFMT+" 15:04"),
+			"  SHA-256: "+Fingerprint(crt),
+			"  SHA-1:   "+FingerprintSHA1(crt), "")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// certPackage downloads the certificate package ZIP
+func certPackage(w http.ResponseWriter, r *http.Request) {
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	withKey := keysAllowed(w, r, c.Crt.Subject.CommonName)
+	data, err := CertPackage(c, withKey)
+	if handleError(w, r, err) {
+		return
+	}
+	if withKey && c.Key != nil {
+		auditRequest(w, r, AUDIT_KEY_DOWNLOAD, certObject(c.Crt)+" package")
+	}
+	download(w, filename(c.Crt.Subject.CommonName)+".zip", "application/zip", data)
+}
+
+// keyExport allows the web user to download a private key encrypted with a passphrase
+func keyExport(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	if c.Key == nil {
+		handleError(w, r, fmt.Errorf("%s", tr("There is no key for %s!", c.Crt.Subject.CommonName)))
+		return
+	}
+	if !keyAllowed(w, r, c.Crt.Subject.CommonName) {
+		return
+	}
+	if r.Method == "POST" {
+		passphrase := r.FormValue("Password")
+		if passphrase != r.FormValue("Confirm") {
+			err = fmt.Errorf("%s", tr("Passwords don't match!"))
+		}
+		var block *pem.Block
+		if err == nil {
+			block, err = EncryptKey(c.Key, passphrase)
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_KEY_DOWNLOAD, certObject(c.Crt)+" encrypted")
+			download(w, filename(c.Crt.Subject.CommonName)+KEY_SUFFIX, "application/x-pem-file",
+				pem.EncodeToMemory(block))
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	ps["Cert"] = c
+	err = templatesFor(r).ExecuteTemplate(w, "keyExport", ps)
+	handleError(w, r, err)
+}
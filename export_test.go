@@ -0,0 +1,106 @@
+package webca
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFullChainPEM(t *testing.T) {
+	inTestDir(t)
+	root, err := GenCACert(pkix.Name{CommonName: "ChainRoot"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = IssueCert(root, pkix.Name{CommonName: "ChainSub"}, ForDays(300), nil)
+	dieOnError(t, err)
+	_, err = GenCert(FindCert("ChainSub"), "chain.example.com", ForDays(30))
+	dieOnError(t, err)
+	leaf := FindCert("chain.example.com") // reloaded, linked to its parents
+	data, err := FullChainPEM(leaf, true)
+	dieOnError(t, err)
+	names := make([]string, 0)
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			crt, err := x509.ParseCertificate(block.Bytes)
+			dieOnError(t, err)
+			names = append(names, crt.Subject.CommonName)
+		} else {
+			names = append(names, block.Type)
+		}
+	}
+	if strings.Join(names, ",") != "chain.example.com,ChainSub,ChainRoot,RSA PRIVATE KEY" {
+		t.Fatalf("Unexpected bundle contents: %v", names)
+	}
+}
+
+func TestCertPackage(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "ZipCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "zip.example.com", ForDays(30))
+	dieOnError(t, err)
+	crt := FindCert("zip.example.com")
+	data, err := CertPackage(crt, true)
+	dieOnError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	dieOnError(t, err)
+	names := make([]string, 0)
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name == "README.txt" {
+			rc, err := f.Open()
+			dieOnError(t, err)
+			readme, err := ioutil.ReadAll(rc)
+			dieOnError(t, err)
+			if !strings.Contains(string(readme), Fingerprint(crt.Crt)) ||
+				!strings.Contains(string(readme), Fingerprint(ca.Crt)) {
+				t.Fatalf("README lacks the fingerprints:\n%s", readme)
+			}
+		}
+	}
+	if strings.Join(names, ",") != "cert.pem,key.pem,chain.pem,fullchain.pem,README.txt" {
+		t.Fatalf("Unexpected package contents: %v", names)
+	}
+	if fp := Fingerprint(crt.Crt); len(fp) != 95 || strings.ToUpper(fp) != fp {
+		t.Fatalf("Unexpected fingerprint format %s", fp)
+	}
+}
+
+func TestEncryptKey(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "KeyCA"}, ForDays(365))
+	dieOnError(t, err)
+	if _, err := EncryptKey(ca.Key, ""); err == nil {
+		t.Fatal("Empty passphrase accepted")
+	}
+	block, err := EncryptKey(ca.Key, "s3cret ñ")
+	dieOnError(t, err)
+	if block.Type != ENCRYPTED_KEY_TYPE {
+		t.Fatalf("Unexpected PEM type %s", block.Type)
+	}
+	if _, err := DecryptKey(block, "wrong"); err == nil {
+		t.Fatal("Wrong passphrase accepted")
+	}
+	key, err := DecryptKey(block, "s3cret ñ")
+	dieOnError(t, err)
+	want, err := x509.MarshalPKCS8PrivateKey(ca.Key)
+	dieOnError(t, err)
+	got, err := x509.MarshalPKCS8PrivateKey(key)
+	dieOnError(t, err)
+	if !bytes.Equal(want, got) {
+		t.Fatal("Decrypted key differs from the original")
+	}
+	data, err := CertPackage(ca, false)
+	dieOnError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	dieOnError(t, err)
+	for _, f := range zr.File {
+		if f.Name == "key.pem" {
+			t.Fatal("Package includes the key with plain keys disabled")
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package webca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	GRPC_PORT        = 9443
+	GRPC_SERVICE     = "/webca.v1.Certificates/"
+	GRPC_MAX_MESSAGE = 4 << 20
+)
+
+// gRPC status codes
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcAlreadyExists    = 6
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnauthenticated  = 16
+)
+
+// audit actions of the gRPC methods changing certificates
+var grpcAudit = map[string]string{"Issue": AUDIT_ISSUE, "Sign": AUDIT_ISSUE, "Renew": AUDIT_RENEW, "Revoke": AUDIT_REVOKE}
+
+// GRPC configures the gRPC service (see webca.proto)
+type GRPC struct {
+	Port     int    // listening port, GRPC_PORT if 0
+	ClientCA string // name of the CA whose certificates authenticate the clients
+}
+
+// StartGRPC serves the gRPC service in the background, if configured
+func StartGRPC(cfg *config) {
+	if cfg == nil || cfg.GRPC == nil || cfg.GRPC.ClientCA == "" {
+		return
+	}
+	ca := FindCert(cfg.GRPC.ClientCA)
+	if ca == nil {
+		log.Printf("(Warning) gRPC client CA %s not found, gRPC is disabled", cfg.GRPC.ClientCA)
+		return
+	}
+	port := cfg.GRPC.Port
+	if port == 0 {
+		port = GRPC_PORT
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Crt)
+	tlsConfig := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool,
+		GetCertificate: webCertificate} // rotated along with the web listener one
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   http.HandlerFunc(grpcHandler),
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		log.Printf("Starting gRPC on port %d...", port)
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			log.Printf("(Warning) gRPC stopped: %s", err)
+		}
+	}()
+}
+
+// grpcHandler serves the gRPC unary calls over HTTP/2
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		grpcStatus(w, grpcUnauthenticated, fmt.Errorf("%s", tr("A client certificate is required!")))
+		return
+	}
+	if Revoked(&Cert{Crt: r.TLS.PeerCertificates[0]}) != nil {
+		grpcStatus(w, grpcPermissionDenied, fmt.Errorf("%s", tr("The client certificate is revoked!")))
+		return
+	}
+	in, err := grpcRead(r.Body)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err)
+		return
+	}
+	fields, err := pbParse(in)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err)
+		return
+	}
+	out, code, err := grpcCall(strings.TrimPrefix(r.URL.Path, GRPC_SERVICE), fields, r)
+	if err == nil {
+		frame := make([]byte, 5, 5+len(out))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(out)))
+		w.Write(append(frame, out...))
+	}
+	grpcStatus(w, code, err)
+}
+
+// grpcCall runs the named method of the request with the decoded fields and returns the encoded
+// response, or the gRPC status code of the failure
+func grpcCall(method string, fields []pbField, r *http.Request) ([]byte, int, error) {
+	var c *Cert
+	var status int
+	var err error
+	switch method {
+	case "Issue":
+		var req IssueRequest
+		for _, f := range fields {
+			switch f.Num {
+			case 1:
+				req.Name = string(f.Bytes)
+			case 2:
+				req.Parent = string(f.Bytes)
+			case 3:
+				req.SANs = append(req.SANs, string(f.Bytes))
+			case 4:
+				req.Days = int(int32(f.Varint))
+			case 5:
+				req.Profile = string(f.Bytes)
+			}
+		}
+		c, status, err = issueRequest(req, false)
+	case "Sign":
+		var req SignRequest
+		for _, f := range fields {
+			switch f.Num {
+			case 1:
+				req.Parent = string(f.Bytes)
+			case 2:
+				req.CSR = string(f.Bytes)
+			case 3:
+				req.Days = int(int32(f.Varint))
+			case 4:
+				req.Profile = string(f.Bytes)
+			}
+		}
+		c, status, err = signRequest(req)
+	case "Renew", "Revoke":
+		var name string
+		var arg uint64
+		for _, f := range fields {
+			switch f.Num {
+			case 1:
+				name = string(f.Bytes)
+			case 2:
+				arg = f.Varint
+			}
+		}
+		if c, err = FindCertOrFail(name); err != nil {
+			return nil, grpcNotFound, err
+		}
+		if method == "Renew" {
+			c, err = RenewCert(c, arg != 0)
+			status = http.StatusInternalServerError
+		} else {
+			err = RevokeCert(c, int(int32(arg)))
+			status = http.StatusConflict
+		}
+	case "List":
+		var f CertFilter
+		var number, size int
+		for _, field := range fields {
+			switch field.Num {
+			case 1:
+				f.Name = string(field.Bytes)
+			case 2:
+				f.SAN = string(field.Bytes)
+			case 3:
+				f.Serial = string(field.Bytes)
+			case 4:
+				f.Issuer = string(field.Bytes)
+			case 5:
+				number = int(int32(field.Varint))
+			case 6:
+				size = int(int32(field.Varint))
+			}
+		}
+		if size > MAX_PAGE_SIZE {
+			size = MAX_PAGE_SIZE
+		}
+		list := listCerts(f, number, size)
+		var pw pbWriter
+		for _, ci := range list.Certs {
+			pw.message(1, pbCertificate(ci))
+		}
+		pw.int(2, int64(list.Page))
+		pw.int(3, int64(list.Pages))
+		pw.int(4, int64(list.Total))
+		return pw.buf, grpcOK, nil
+	default:
+		return nil, grpcUnimplemented, fmt.Errorf("%s", tr("Unknown gRPC method %s", method))
+	}
+	if err != nil {
+		return nil, grpcCode(status), err
+	}
+	audit(grpcAudit[method], "grpc:"+r.TLS.PeerCertificates[0].Subject.CommonName, remoteAddr(r), certObject(c.Crt))
+	return pbCertificate(newCertInfo(c, true)), grpcOK, nil
+}
+
+// pbCertificate encodes the certificate as a Certificate message
+func pbCertificate(ci CertInfo) []byte {
+	var pw pbWriter
+	pw.string(1, ci.Name)
+	pw.string(2, ci.Serial)
+	pw.string(3, ci.Issuer)
+	pw.bool(4, ci.IsCA)
+	pw.int(5, ci.NotBefore.Unix())
+	pw.int(6, ci.NotAfter.Unix())
+	pw.strings(7, ci.SANs)
+	pw.string(8, ci.Fingerprint)
+	pw.bool(9, ci.HasKey)
+	pw.bool(10, ci.Revoked != nil)
+	pw.string(11, ci.PEM)
+	return pw.buf
+}
+
+// grpcRead reads a length prefixed gRPC message
+func grpcRead(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("Wrong gRPC message: %s", err)
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("Compressed gRPC messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > GRPC_MAX_MESSAGE {
+		return nil, fmt.Errorf("gRPC message too big")
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("Wrong gRPC message: %s", err)
+	}
+	return msg, nil
+}
+
+// grpcStatus sets the call status trailers
+func grpcStatus(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if err != nil {
+		w.Header().Set("Grpc-Message", grpcEscape(err.Error()))
+	}
+}
+
+// grpcCode returns the gRPC status code equivalent to an HTTP status
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcAlreadyExists
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	}
+	return grpcInternal
+}
+
+// grpcEscape percent encodes a status message as the gRPC protocol requires
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,72 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGRPC(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "GRPCCA"}, ForDays(365))
+	dieOnError(t, err)
+	client, err := GenCert(ca, "client", ForDays(30))
+	dieOnError(t, err)
+	call := func(method string, pw pbWriter, peer *Cert) (string, []pbField) {
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(pw.buf)))
+		req := httptest.NewRequest("POST", GRPC_SERVICE+method, bytes.NewReader(append(frame, pw.buf...)))
+		req.Header.Set("Content-Type", "application/grpc")
+		if peer != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer.Crt}}
+		}
+		w := httptest.NewRecorder()
+		grpcHandler(w, req)
+		res := w.Result()
+		var fields []pbField
+		if msg, err := grpcRead(res.Body); err == nil {
+			fields, err = pbParse(msg)
+			dieOnError(t, err)
+		}
+		return res.Trailer.Get("Grpc-Status"), fields
+	}
+	var issue pbWriter
+	issue.string(1, "grpc.example.com")
+	issue.string(2, "GRPCCA")
+	issue.strings(3, []string{"grpc.example.com"})
+	issue.int(4, 30)
+	if status, _ := call("Issue", issue, nil); status != "16" {
+		t.Fatalf("Unauthenticated call got status %s", status)
+	}
+	status, fields := call("Issue", issue, client)
+	if status != "0" || len(fields) == 0 || fields[0].Num != 1 || string(fields[0].Bytes) != "grpc.example.com" {
+		t.Fatalf("Issue failed with status %s: %v", status, fields)
+	}
+	if status, _ := call("Issue", issue, client); status != "6" {
+		t.Fatalf("Duplicated issue got status %s", status)
+	}
+	var list pbWriter
+	list.string(4, "GRPCCA")
+	status, fields = call("List", list, client)
+	certs := 0
+	for _, f := range fields {
+		if f.Num == 1 {
+			certs++
+		}
+	}
+	if status != "0" || certs != 3 { // the CA is self issued
+		t.Fatalf("List failed with status %s: %d certificates", status, certs)
+	}
+	var revoke pbWriter
+	revoke.string(1, "client")
+	if status, _ := call("Revoke", revoke, client); status != "0" {
+		t.Fatalf("Revoke failed with status %s", status)
+	}
+	if status, _ := call("List", list, client); status != "7" {
+		t.Fatalf("Revoked client got status %s", status)
+	}
+}
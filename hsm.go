@@ -0,0 +1,245 @@
+package webca
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HSM_TOOL        = "pkcs11-tool"   // OpenSC's, talking to the PKCS#11 module
+	HSM_PIN_ENV     = "WEBCA_HSM_PIN" // passes the PIN to the tool, kept out of its command line
+	HSM_TIMEOUT     = 30 * time.Second
+	PKCS11_KEY_TYPE = "PKCS11 KEY REFERENCE" // stored instead of the key, with its public key
+	PKCS11_LABEL    = "Label"
+	PKCS11_ID       = "ID"
+)
+
+// DigestInfo prefixes of the digests signed with RSA PKCS#1 v1.5 (RFC 8017 section 9.2)
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// HSM is a PKCS#11 token (an HSM or SoftHSM) keeping the CA private keys, which never leave it
+type HSM struct {
+	Module string // path of the PKCS#11 module library
+	Slot   string // slot ID of the token, the first one if empty
+	PIN    string // user PIN
+	Tool   string // pkcs11-tool path, HSM_TOOL if empty
+}
+
+// hsmSigner signs with a private key kept in the token
+type hsmSigner struct {
+	hsm   HSM
+	label string
+	id    string // hex object ID
+	pub   crypto.PublicKey
+}
+
+// newKey generates the key pair of a new certificate, in the token if it is a CA and there is one
+func newKey(name string, ca bool, keyType string, bits int) (crypto.Signer, error) {
+	if cfg := LoadConfig(); ca && cfg != nil && cfg.HSM != nil {
+		return cfg.HSM.genKey(name, keyType, bits)
+	}
+	return genKey(keyType, bits)
+}
+
+// run runs the tool on the token with the given arguments, the input and the output going
+// through temporary files
+func (h HSM) run(input []byte, output bool, args ...string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "webca-hsm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	full := []string{"--module", h.Module}
+	if h.Slot != "" {
+		full = append(full, "--slot", h.Slot)
+	}
+	if h.PIN != "" {
+		full = append(full, "--login", "--pin", "env:"+HSM_PIN_ENV)
+	}
+	full = append(full, args...)
+	if input != nil {
+		if err := ioutil.WriteFile(in, input, 0600); err != nil {
+			return nil, err
+		}
+		full = append(full, "--input-file", in)
+	}
+	if output {
+		full = append(full, "--output-file", out)
+	}
+	tool := h.Tool
+	if tool == "" {
+		tool = HSM_TOOL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HSM_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, tool, full...)
+	cmd.Env = append(os.Environ(), HSM_PIN_ENV+"="+h.PIN)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s %s: %s", tool, err, strings.TrimSpace(string(msg)))
+	}
+	if !output {
+		return nil, nil
+	}
+	return ioutil.ReadFile(out)
+}
+
+// genKey generates a key pair in the token, labeled with the certificate name
+func (h HSM) genKey(label, keyType string, bits int) (crypto.Signer, error) {
+	if err := checkKey(keyType, bits); err != nil {
+		return nil, err
+	}
+	spec := "rsa:" + strconv.Itoa(DEFAULT_KEY_BITS)
+	switch {
+	case keyType == ECDSA && bits == 384:
+		spec = "EC:secp384r1"
+	case keyType == ECDSA && bits == 521:
+		spec = "EC:secp521r1"
+	case keyType == ECDSA:
+		spec = "EC:prime256v1"
+	case bits != 0:
+		spec = "rsa:" + strconv.Itoa(bits)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	s := &hsmSigner{hsm: h, label: label, id: hex.EncodeToString(id)}
+	if _, err := h.run(nil, false, "--keypairgen", "--key-type", spec, "--label", label, "--id", s.id); err != nil {
+		return nil, fmt.Errorf("Failed to generate the key in the HSM: %s", err)
+	}
+	der, err := h.run(nil, true, "--read-object", "--type", "pubkey", "--id", s.id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the public key from the HSM: %s", err)
+	}
+	if s.pub, err = x509.ParsePKIXPublicKey(der); err != nil {
+		if s.pub, err = x509.ParsePKCS1PublicKey(der); err != nil {
+			return nil, fmt.Errorf("Failed to parse the public key from the HSM: %s", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *hsmSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs the digest in the token, RSA with PKCS#1 v1.5 and ECDSA in ASN.1
+func (s *hsmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		if _, pss := opts.(*rsa.PSSOptions); pss {
+			return nil, fmt.Errorf("%s", tr("RSA-PSS signatures are not supported by the HSM keys!"))
+		}
+		prefix, ok := pkcs1Prefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("%s", tr("Unsupported hash %v for the HSM keys!", opts.HashFunc()))
+		}
+		return s.hsm.run(append(append([]byte{}, prefix...), digest...), true,
+			"--sign", "--mechanism", "RSA-PKCS", "--id", s.id)
+	case *ecdsa.PublicKey:
+		return s.hsm.run(digest, true, "--sign", "--mechanism", "ECDSA", "--signature-format", "openssl", "--id", s.id)
+	}
+	return nil, fmt.Errorf("%s", tr("Unsupported private key type!"))
+}
+
+// reference returns the PEM block stored instead of the private key
+func (s *hsmSigner) reference() (*pem.Block, error) {
+	der, err := x509.MarshalPKIXPublicKey(s.pub)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: PKCS11_KEY_TYPE, Headers: map[string]string{PKCS11_LABEL: s.label, PKCS11_ID: s.id},
+		Bytes: der}, nil
+}
+
+// hsmGob is how the signer is kept in the config, along the web certificate chain
+type hsmGob struct {
+	HSM       HSM
+	Reference []byte // PEM
+}
+
+func (s *hsmSigner) GobEncode() ([]byte, error) {
+	b, err := s.reference()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(hsmGob{s.hsm, pem.EncodeToMemory(b)})
+	return buf.Bytes(), err
+}
+
+func (s *hsmSigner) GobDecode(data []byte) error {
+	var g hsmGob
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	b, _ := pem.Decode(g.Reference)
+	if b == nil || b.Type != PKCS11_KEY_TYPE {
+		return fmt.Errorf("Wrong HSM key reference")
+	}
+	pub, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return err
+	}
+	*s = hsmSigner{hsm: g.HSM, label: b.Headers[PKCS11_LABEL], id: b.Headers[PKCS11_ID], pub: pub}
+	return nil
+}
+
+// hsmKey returns the signer of the key referenced by the stored PEM block, in the token of the config
+func hsmKey(b *pem.Block) (crypto.Signer, error) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.HSM == nil {
+		return nil, fmt.Errorf("%s", tr("The private key is in an HSM but none is configured!"))
+	}
+	pub, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &hsmSigner{hsm: *cfg.HSM, label: b.Headers[PKCS11_LABEL], id: b.Headers[PKCS11_ID], pub: pub}, nil
+}
+
+// genCACert generates a self signed CA certificate with its key in the token, for the setup
+func (h HSM) genCACert(name pkix.Name, p Period) (*Cert, error) {
+	key, err := h.genKey(name.CommonName, DEFAULT_KEY_TYPE, DEFAULT_KEY_BITS)
+	if err != nil {
+		return nil, err
+	}
+	return issueCert(nil, name, p, nil, key)
+}
+
+// readHSM reads the token of the setup form, nil if no module is given, checking it can be used
+func readHSM(r *http.Request) (*HSM, error) {
+	h := &HSM{Module: strings.TrimSpace(r.FormValue("HSMModule")), Slot: strings.TrimSpace(r.FormValue("HSMSlot")),
+		PIN: r.FormValue("HSMPIN"), Tool: strings.TrimSpace(r.FormValue("HSMTool"))}
+	if h.Module == "" {
+		return nil, nil
+	}
+	if _, err := h.run(nil, false, "--list-objects"); err != nil {
+		return nil, fmt.Errorf("%s: %s", tr("Cannot use the HSM!"), err)
+	}
+	return h, nil
+}
@@ -0,0 +1,135 @@
+package webca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHSMHelper plays pkcs11-tool for TestHSM, keeping the token keys as files
+func TestHSMHelper(t *testing.T) {
+	dir := os.Getenv("WEBCA_FAKE_HSM")
+	if dir == "" {
+		return
+	}
+	args := map[string]string{}
+	flags := os.Args
+	for i := range flags {
+		if strings.HasPrefix(flags[i], "--") && i+1 < len(flags) {
+			args[flags[i]] = flags[i+1]
+		}
+	}
+	if _, ok := args["--module"]; !ok || args["--pin"] != "env:"+HSM_PIN_ENV || os.Getenv(HSM_PIN_ENV) != "1234" {
+		fmt.Fprintln(os.Stderr, "login failed")
+		os.Exit(1)
+	}
+	file := filepath.Join(dir, args["--id"]+".key")
+	switch {
+	case strings.Contains(strings.Join(flags, " "), "--keypairgen"):
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if args["--key-type"] != "EC:prime256v1" {
+			var rkey *rsa.PrivateKey
+			rkey, err = rsa.GenerateKey(rand.Reader, 2048)
+			dieOnError(t, err)
+			der, _ := x509.MarshalPKCS8PrivateKey(rkey)
+			dieOnError(t, ioutil.WriteFile(file, der, 0600))
+			break
+		}
+		dieOnError(t, err)
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		dieOnError(t, ioutil.WriteFile(file, der, 0600))
+	case args["--type"] == "pubkey":
+		der, err := ioutil.ReadFile(file)
+		dieOnError(t, err)
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		dieOnError(t, err)
+		pub, _ := x509.MarshalPKIXPublicKey(key.(crypto.Signer).Public())
+		dieOnError(t, ioutil.WriteFile(args["--output-file"], pub, 0600))
+	case args["--mechanism"] != "":
+		der, err := ioutil.ReadFile(file)
+		dieOnError(t, err)
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		dieOnError(t, err)
+		in, err := ioutil.ReadFile(args["--input-file"])
+		dieOnError(t, err)
+		var sig []byte
+		if args["--mechanism"] == "RSA-PKCS" {
+			sig, err = rsa.SignPKCS1v15(nil, key.(*rsa.PrivateKey), 0, in) // in is the DigestInfo
+		} else {
+			sig, err = ecdsa.SignASN1(rand.Reader, key.(*ecdsa.PrivateKey), in)
+		}
+		dieOnError(t, err)
+		dieOnError(t, ioutil.WriteFile(args["--output-file"], sig, 0600))
+	}
+	os.Exit(0)
+}
+
+func TestHSM(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *Certree) { certree = saved }(certree)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	token, err := filepath.Abs("token")
+	dieOnError(t, err)
+	dieOnError(t, os.MkdirAll(token, 0700))
+	os.Setenv("WEBCA_FAKE_HSM", token)
+	defer os.Unsetenv("WEBCA_FAKE_HSM")
+	pkg, err := filepath.Abs("..") // for the templates of the init
+	dieOnError(t, err)
+	tool := filepath.Join(token, "pkcs11-tool")
+	dieOnError(t, ioutil.WriteFile(tool, []byte("#!/bin/sh\ncd "+pkg+" && exec "+os.Args[0]+
+		" -test.run=^TestHSMHelper$ -- \"$@\"\n"), 0700))
+
+	hsm := &HSM{Module: "softhsm.so", PIN: "1234", Tool: tool}
+	cachedCfg = &config{HSM: hsm}
+	certree = nil
+	ca, err := hsm.genCACert(pkix.Name{CommonName: "TokenCA"}, ForDays(365))
+	dieOnError(t, err)
+	stored, err := storage.Get(keyFile(*ca))
+	dieOnError(t, err)
+	if b, _ := pem.Decode(stored); b == nil || b.Type != PKCS11_KEY_TYPE || b.Headers[PKCS11_LABEL] != "TokenCA" {
+		t.Fatalf("The key reference was not stored: %s", stored)
+	}
+	if _, err := ReadCertKey(ca); err == nil {
+		t.Error("The key in the HSM was downloaded")
+	}
+
+	certree = nil
+	loaded := FindCert("TokenCA")
+	if loaded == nil {
+		t.Fatal("The CA was not loaded")
+	}
+	if _, ok := loaded.Key.(*hsmSigner); !ok || !sameKey(loaded.Key, ca.Key) {
+		t.Fatal("The CA key is not the one of the HSM")
+	}
+	sub, err := genCert(loaded, newTemplate(pkix.Name{CommonName: "token.example.com"}, ForDays(100), nil), nil)
+	dieOnError(t, err)
+	if _, ok := sub.Key.(*hsmSigner); ok {
+		t.Error("A leaf key was generated in the HSM")
+	}
+	dieOnError(t, sub.Crt.CheckSignatureFrom(ca.Crt))
+
+	sub.Parent = ca // as in the setup, loaded roots being their own parents
+	cachedCfg.WebCert = sub
+	dieOnError(t, saveGob(WEBCA_CFG, cachedCfg))
+	var cfg config
+	dieOnError(t, loadGob(WEBCA_CFG, &cfg))
+	if s, ok := cfg.WebCert.Parent.Key.(*hsmSigner); !ok || s.hsm.PIN != "1234" || !sameKey(s, ca.Key) {
+		t.Error("The HSM key was not kept in the config")
+	}
+
+	hsm.PIN = "4321"
+	if _, err := hsm.genKey("Wrong", DEFAULT_KEY_TYPE, DEFAULT_KEY_BITS); err == nil {
+		t.Error("A key was generated with a wrong PIN")
+	}
+}
@@ -0,0 +1,361 @@
+package webca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOCALES_DIR  = "locales" // message catalogs <lang>.json, in the working directory and the theme one
+	DEFAULT_LANG = "en"      // language of the messages in the code, which needs no catalog
+	LANG_NAME    = "@name"   // catalog entry naming its language, in it
+	LANG_COOKIE  = "lang"    // language picked by the user
+	TZ_COOKIE    = "tz"      // time zone of the logged user's preferences
+)
+
+// langTag matches the language tags the catalogs can be named after, e.g. es or pt-br
+var langTag = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// catalog are the translations of the messages of a language, by message
+type catalog map[string]string
+
+// tr translates the message, then formats it with the args like the app translation function
+func (c catalog) tr(s string, args ...interface{}) string {
+	if t, ok := c[s]; ok && t != "" {
+		s = t
+	}
+	return tr(s, args...)
+}
+
+// showPeriod shows the period of a certificate translated, with its dates in the location
+func (c catalog) showPeriod(crt *x509.Certificate, loc *time.Location) string {
+	from := crt.NotBefore.In(loc).Format(MYFMT)
+	to := crt.NotAfter.In(loc).Format(MYFMT)
+	duration := int(crt.NotAfter.Sub(time.Now()).Hours() / 24)
+	return c.tr("From %s to %s (%ddays to go)", from, to, duration)
+}
+
+// Language is one of the languages of the UI, for the users to pick
+type Language struct {
+	Tag, Name string
+}
+
+// catalogs are the catalogs of the languages of the localized templates
+var catalogs = map[string]catalog{}
+
+// localized are the templates translated to each language, DEFAULT_LANG's being the templates
+var localized = map[string]*template.Template{}
+
+// master are the templates localized and zoned from, never executed as only those can be cloned
+var master *template.Template
+
+// zoned are the translated templates showing the dates in the time zones of the users, by language
+// and zone, cloned when first needed
+var zoned = struct {
+	sync.Mutex
+	m map[string]*template.Template
+}{m: make(map[string]*template.Template)}
+
+// languages are the available languages, sorted by tag
+var languages = []Language{{DEFAULT_LANG, "English"}}
+
+// loadCatalogs reads the <lang>.json catalogs of the dirs, the entries of the later ones
+// overriding the former ones'
+func loadCatalogs(dirs ...string) (map[string]catalog, error) {
+	cs := map[string]catalog{}
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+			if !langTag.MatchString(lang) {
+				return nil, fmt.Errorf("Wrong catalog name %s", file)
+			}
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			c := catalog{}
+			if err := json.Unmarshal(data, &c); err != nil {
+				return nil, fmt.Errorf("Wrong catalog %s: %s", file, err)
+			}
+			if cs[lang] == nil {
+				cs[lang] = catalog{}
+			}
+			for msg, t := range c {
+				cs[lang][msg] = t
+			}
+		}
+	}
+	return cs, nil
+}
+
+// localFuncs are the template functions translating to the language of the catalog and showing
+// the dates in the location
+func localFuncs(lang string, c catalog, loc *time.Location) template.FuncMap {
+	return template.FuncMap{
+		"tr":         c.tr,
+		"lang":       func() string { return lang },
+		"showPeriod": func(crt *x509.Certificate) string { return c.showPeriod(crt, loc) },
+		"inZone":     func(t time.Time) time.Time { return t.In(loc) },
+	}
+}
+
+// localize clones the templates for each language of the catalogs, with their own functions
+func localize(t *template.Template, cs map[string]catalog) (map[string]*template.Template, []Language, error) {
+	base, err := t.Clone()
+	if err != nil {
+		return nil, nil, err
+	}
+	ts := map[string]*template.Template{DEFAULT_LANG: base}
+	langs := []Language{{DEFAULT_LANG, "English"}}
+	for lang, c := range cs {
+		lt, err := t.Clone()
+		if err != nil {
+			return nil, nil, err
+		}
+		lt.Funcs(localFuncs(lang, c, time.Local))
+		ts[lang] = lt
+		if lang == DEFAULT_LANG {
+			langs[0].Name = c.tr(langs[0].Name)
+		} else {
+			langs = append(langs, Language{lang, c.tr(LANG_NAME)})
+		}
+	}
+	sort.Slice(langs, func(i, j int) bool { return langs[i].Tag < langs[j].Tag })
+	return ts, langs, nil
+}
+
+// useTemplates localizes the templates with the catalogs in the locales directories of the
+// working directory and the theme, and serves them. The ones in use are kept if they are wrong
+func useTemplates(t *template.Template, theme string) error {
+	dirs := []string{LOCALES_DIR}
+	if theme != "" {
+		dirs = append(dirs, filepath.Join(theme, LOCALES_DIR))
+	}
+	cs, err := loadCatalogs(dirs...)
+	if err != nil {
+		return err
+	}
+	ts, langs, err := localize(t, cs)
+	if err != nil {
+		return err
+	}
+	zoned.Lock()
+	zoned.m = make(map[string]*template.Template)
+	zoned.Unlock()
+	templates, localized, languages, catalogs, master = ts[DEFAULT_LANG], ts, langs, cs, t
+	return nil
+}
+
+// zonedTemplates returns the templates translated to the language and showing the dates in the
+// time zone, or just translated if the zone is unknown
+func zonedTemplates(lang, zone string) *template.Template {
+	zoned.Lock()
+	defer zoned.Unlock()
+	key := lang + " " + zone
+	if t := zoned.m[key]; t != nil {
+		return t
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return localized[lang]
+	}
+	t, err := master.Clone()
+	if err != nil {
+		return localized[lang]
+	}
+	t.Funcs(localFuncs(lang, catalogs[lang], loc))
+	zoned.m[key] = t
+	return t
+}
+
+// lang returns the language of the templates, DEFAULT_LANG unless translated
+func lang() string {
+	return DEFAULT_LANG
+}
+
+// inZone returns the time in the time zone of the templates, unchanged unless zoned
+func inZone(t time.Time) time.Time {
+	return t
+}
+
+// uiLanguages returns the languages of the UI to the templates, for the users to pick
+func uiLanguages() []Language {
+	return languages
+}
+
+// requestLang returns the language of the request: the one picked by the user, else the best one
+// of its Accept-Language header, else DEFAULT_LANG
+func requestLang(r *http.Request) string {
+	if c, err := r.Cookie(LANG_COOKIE); err == nil && localized[c.Value] != nil {
+		return c.Value
+	}
+	return acceptLanguage(r.Header.Get("Accept-Language"))
+}
+
+// acceptLanguage negotiates the available language with the highest quality in the
+// Accept-Language header, falling back from the regional ones to their language (es-ES to es)
+func acceptLanguage(header string) string {
+	best, bestQ := DEFAULT_LANG, 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, q := strings.ToLower(strings.TrimSpace(part)), 1.0
+		if i := strings.Index(tag, ";"); i >= 0 {
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(tag[i+1:]), "q="), 64); err == nil {
+				q = v
+			}
+			tag = strings.TrimSpace(tag[:i])
+		}
+		for q > bestQ && tag != "" {
+			if localized[tag] != nil {
+				best, bestQ = tag, q
+				break
+			}
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return best
+}
+
+// templatesFor returns the templates translated to the language of the request, and showing the
+// dates in the time zone of the logged user, if chosen
+func templatesFor(r *http.Request) *template.Template {
+	lang := requestLang(r)
+	if c, err := r.Cookie(TZ_COOKIE); err == nil && c.Value != "" && master != nil {
+		if t := zonedTemplates(lang, c.Value); t != nil {
+			return t
+		}
+	}
+	if t := localized[lang]; t != nil {
+		return t
+	}
+	return templates
+}
+
+// trFor translates the message to the language of the request, for the texts the handlers
+// give the templates
+func trFor(r *http.Request, s string, args ...interface{}) string {
+	return catalogs[requestLang(r)].tr(s, args...)
+}
+
+// tr translates the message to the language of the page's request, if any
+func (ps PageStatus) tr(s string, args ...interface{}) string {
+	if r, ok := ps[REQUEST].(*http.Request); ok {
+		return trFor(r, s, args...)
+	}
+	return tr(s, args...)
+}
+
+// setLanguage keeps the language picked by the user in a cookie and goes back to the page
+func setLanguage(w http.ResponseWriter, r *http.Request) {
+	tag := r.FormValue("lang")
+	if localized[tag] == nil {
+		http.Error(w, trFor(r, "Unknown language %q", tag), http.StatusBadRequest)
+		return
+	}
+	setPrefCookie(w, r, LANG_COOKIE, tag)
+	back := "/"
+	if u, err := url.Parse(r.Referer()); err == nil && u.Host == r.Host && u.Path != "" {
+		back = strings.TrimPrefix(u.RequestURI(), options.basePath())
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// setPrefCookie sends the cookie of a preference, dropping it if empty, and makes the request carry
+// it for the templates
+func setPrefCookie(w http.ResponseWriter, r *http.Request, name, value string) {
+	cookie := &http.Cookie{Name: name, Value: value, Path: options.basePath() + "/", HttpOnly: true,
+		Secure: requestScheme(r) == "https", SameSite: http.SameSiteLaxMode}
+	if value == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = time.Now().AddDate(1, 0, 0)
+	}
+	http.SetCookie(w, cookie)
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	if value != "" {
+		r.AddCookie(cookie)
+	}
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// usePreferences makes the pages of the request use the language and time zone of the user, the
+// language picked or negotiated being kept if the user has none
+func usePreferences(w http.ResponseWriter, r *http.Request, u User) {
+	cookie := func(name string) string {
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	if u.Lang != "" && localized[u.Lang] != nil && cookie(LANG_COOKIE) != u.Lang {
+		setPrefCookie(w, r, LANG_COOKIE, u.Lang)
+	}
+	if cookie(TZ_COOKIE) != u.Timezone {
+		setPrefCookie(w, r, TZ_COOKIE, u.Timezone)
+	}
+}
+
+// preferences saves the language and time zone of the logged user
+func preferences(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	if r.Method == "POST" {
+		u := requestUser(w, r)
+		lang, zone := r.FormValue("Lang"), strings.TrimSpace(r.FormValue("Timezone"))
+		var stored User
+		var err error
+		if lang != "" && localized[lang] == nil {
+			err = fmt.Errorf("%s", ps.tr("Unknown language %q", lang))
+		} else if _, e := time.LoadLocation(zone); e != nil {
+			err = fmt.Errorf("%s", ps.tr("Unknown time zone %q", zone))
+		}
+		if err == nil {
+			err = LoadConfig().update(func(cfg *config) error {
+				var ok bool
+				if stored, ok = cfg.Users[u.Username]; !ok {
+					return fmt.Errorf("%s", ps.tr("User %s not found!", u.Username))
+				}
+				stored.Lang, stored.Timezone = lang, zone
+				users := copyUsers(cfg.Users)
+				users[u.Username] = stored
+				cfg.Users = users
+				return nil
+			})
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+		} else {
+			if lang == "" {
+				setPrefCookie(w, r, LANG_COOKIE, "")
+			}
+			usePreferences(w, r, stored)
+		}
+	}
+	showSettings(w, r, ps)
+}
@@ -0,0 +1,161 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/x509"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestI18n(t *testing.T) {
+	defer func() {
+		dieOnError(t, useTemplates(template.Must(parseTemplates("")), ""))
+	}()
+	es, err := loadCatalogs(LOCALES_DIR)
+	dieOnError(t, err)
+	msgs := regexp.MustCompile(`{{tr "([^"]*)"`).FindAllStringSubmatch(htmlTemplates+jsTemplates+pages, -1)
+	for _, m := range msgs {
+		if es["es"][m[1]] == "" {
+			t.Errorf("%q is not translated to Spanish", m[1])
+		}
+	}
+
+	for header, want := range map[string]string{"": "en", "es-ES,es;q=0.9,en;q=0.8": "es", "fr, en;q=0.5, es;q=0.4": "en",
+		"de-DE": "en", "en-US;q=0.2, ES-mx;q=0.7": "es"} {
+		if got := acceptLanguage(header); got != want {
+			t.Errorf("Accept-Language %q negotiated %s instead of %s", header, got, want)
+		}
+	}
+	login := func(r *http.Request) string {
+		var buf bytes.Buffer
+		dieOnError(t, templatesFor(r).ExecuteTemplate(&buf, "login", PageStatus{}))
+		return buf.String()
+	}
+	r := httptest.NewRequest("GET", "http://webca.internal/login", nil)
+	r.Header.Set("Accept-Language", "es-ES,es;q=0.9")
+	if page := login(r); !strings.Contains(page, "Iniciar sesión") || !strings.Contains(page, `hreflang="en"`) {
+		t.Error("The login page is not in Spanish")
+	}
+	if msg := newPageStatus(r).tr("Access Denied"); msg != "Acceso denegado" {
+		t.Errorf("The texts of the handlers are not translated: %s", msg)
+	}
+
+	rr := httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "http://webca.internal/language?lang=en", nil)
+	r.Header.Set("Referer", "http://webca.internal/login?x=1")
+	setLanguage(rr, r)
+	cookies := rr.Result().Cookies()
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/login?x=1" || len(cookies) != 1 {
+		t.Fatalf("The language was not picked: %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	r = httptest.NewRequest("GET", "http://webca.internal/login", nil)
+	r.Header.Set("Accept-Language", "es")
+	r.AddCookie(cookies[0])
+	if page := login(r); strings.Contains(page, "Iniciar sesión") {
+		t.Error("The picked language is not preferred to the Accept-Language one")
+	}
+	rr = httptest.NewRecorder()
+	setLanguage(rr, httptest.NewRequest("GET", "http://webca.internal/language?lang=xx", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("An unknown language was picked: %d", rr.Code)
+	}
+
+	theme := filepath.Join("tests", "theme")
+	dieOnError(t, os.MkdirAll(filepath.Join(theme, LOCALES_DIR), 0750))
+	defer func() {
+		dieOnError(t, os.RemoveAll("tests"))
+	}()
+	dieOnError(t, ioutil.WriteFile(filepath.Join(theme, LOCALES_DIR, "es.json"), []byte(`{"Login": "Entrar"}`), 0640))
+	dieOnError(t, ioutil.WriteFile(filepath.Join(theme, LOCALES_DIR, "gl.json"), []byte(`{"@name": "Galego"}`), 0640))
+	tmpl, err := parseTemplates(theme)
+	dieOnError(t, err)
+	dieOnError(t, useTemplates(tmpl, theme))
+	r = httptest.NewRequest("GET", "http://webca.internal/login", nil)
+	r.Header.Set("Accept-Language", "es")
+	if page := login(r); !strings.Contains(page, "Entrar") || !strings.Contains(page, "Galego") {
+		t.Error("The catalogs of the theme are not used")
+	}
+	dieOnError(t, ioutil.WriteFile(filepath.Join(theme, LOCALES_DIR, "gl.json"), []byte(`{"@name":`), 0640))
+	if err := useTemplates(tmpl, theme); err == nil || localized["gl"] == nil {
+		t.Errorf("A wrong catalog was taken: %v", err)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Fullname: "Boss"}}}
+	id, err := genId()
+	dieOnError(t, err)
+	req := httptest.NewRequest("GET", "/settings", nil)
+	req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+	s, err := SessionFor(httptest.NewRecorder(), req)
+	dieOnError(t, err)
+	s[LOGGEDUSER] = cachedCfg.Users["boss"]
+	s.Save()
+	call := func(h http.HandlerFunc, form string, cookies ...*http.Cookie) (*httptest.ResponseRecorder, map[string]*http.Cookie) {
+		req := httptest.NewRequest("GET", "/settings", nil)
+		if form != "" {
+			req = httptest.NewRequest("POST", "/preferences", strings.NewReader(form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		set := map[string]*http.Cookie{}
+		for _, c := range w.Result().Cookies() {
+			set[c.Name] = c
+		}
+		return w, set
+	}
+
+	w, set := call(preferences, "Lang=es&Timezone=Pacific/Kiritimati")
+	if u := cachedCfg.Users["boss"]; u.Lang != "es" || u.Timezone != "Pacific/Kiritimati" {
+		t.Fatalf("The preferences were not saved: %+v", u)
+	}
+	if !strings.Contains(w.Body.String(), "Preferencias") || set[LANG_COOKIE] == nil || set[TZ_COOKIE] == nil {
+		t.Errorf("The preferences are not used right away: %v", set)
+	}
+	w, _ = call(preferences, "Lang=es&Timezone=Mars/Olympus")
+	if !strings.Contains(w.Body.String(), "Zona horaria desconocida") ||
+		cachedCfg.Users["boss"].Timezone != "Pacific/Kiritimati" {
+		t.Error("A wrong time zone was saved")
+	}
+	w, set = call(settings, "", &http.Cookie{Name: LANG_COOKIE, Value: "en"})
+	if !strings.Contains(w.Body.String(), "Preferencias") || set[LANG_COOKIE].Value != "es" {
+		t.Error("The language of the user is not preferred")
+	}
+
+	crt := &x509.Certificate{NotBefore: time.Date(2030, 1, 1, 23, 0, 0, 0, time.UTC),
+		NotAfter: time.Date(2031, 1, 1, 23, 0, 0, 0, time.UTC)}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(set[LANG_COOKIE])
+	r.AddCookie(set[TZ_COOKIE])
+	var buf bytes.Buffer
+	dieOnError(t, templatesFor(r).ExecuteTemplate(&buf, "certTree", []*CertNode{{Cert: &Cert{Crt: crt}}}))
+	if !strings.Contains(buf.String(), "Del 2030/01/02 al 2031/01/02") {
+		t.Errorf("The validity is not shown in the time zone of the user: %s", buf.String())
+	}
+
+	w, set = call(preferences, "Lang=&Timezone=", r.Cookies()...)
+	if u := cachedCfg.Users["boss"]; u.Lang != "" || u.Timezone != "" || set[LANG_COOKIE] == nil ||
+		set[LANG_COOKIE].MaxAge >= 0 || set[TZ_COOKIE] == nil || set[TZ_COOKIE].MaxAge >= 0 {
+		t.Errorf("The preferences were not cleared: %v", set)
+	}
+	if strings.Contains(w.Body.String(), "Preferencias") {
+		t.Error("The page is still in the language of the user")
+	}
+}
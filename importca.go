@@ -0,0 +1,104 @@
+package webca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	IMPORT_MAX_UPLOAD = 1 << 20 // PEM certificates and keys are way smaller
+)
+
+// ImportCA stores an existing CA from its PEM certificate, optionally followed by the chain of
+// its issuers (stored without keys), and its unencrypted PEM private key
+func ImportCA(certPEM, keyPEM []byte) (*Cert, error) {
+	crts := make([]*x509.Certificate, 0)
+	for rest := certPEM; ; {
+		var b *pem.Block
+		if b, rest = pem.Decode(rest); b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", tr("Wrong CA certificate!"), err)
+		}
+		crts = append(crts, crt)
+	}
+	if len(crts) == 0 {
+		return nil, fmt.Errorf("%s", tr("Wrong CA certificate!"))
+	}
+	if !crts[0].IsCA || crts[0].KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("%s", tr("%s is not a CA certificate!", crts[0].Subject.CommonName))
+	}
+	b, _ := pem.Decode(keyPEM)
+	if b == nil {
+		return nil, fmt.Errorf("%s", tr("Wrong CA private key!"))
+	}
+	if _, ok := b.Headers["DEK-Info"]; ok || b.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("%s", tr("The CA private key must not be encrypted!"))
+	}
+	key, err := parseKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", tr("Wrong CA private key!"), err)
+	}
+	if !sameKey(key, crts[0].PublicKey) {
+		return nil, fmt.Errorf("%s", tr("The private key does not belong to the CA certificate!"))
+	}
+	for _, crt := range crts {
+		if c := FindCert(crt.Subject.CommonName); c != nil && len(c.Crt.Raw) > 0 {
+			return nil, fmt.Errorf("%s", tr("Certificate %s already exists!", crt.Subject.CommonName))
+		}
+	}
+	ca := &Cert{Crt: crts[0], Key: key}
+	block, err := sealKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.Tx(func(tx Storage) error {
+		for _, crt := range crts {
+			if err := tx.Put(certFile(Cert{Crt: crt}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+				Bytes: crt.Raw}), false); err != nil {
+				return err
+			}
+		}
+		return tx.Put(keyFile(*ca), pem.EncodeToMemory(block), true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(crts) > 1 {
+		ca.Parent = &Cert{Crt: crts[1]}
+	}
+	return ca, nil
+}
+
+// readImportedCA imports the CA uploaded as prefix.CertFile and prefix.KeyFile, returning nil if
+// there is none
+func readImportedCA(prefix string, r *http.Request) (*Cert, error) {
+	certFile, _, err := r.FormFile(prefix + ".CertFile")
+	if err != nil {
+		return nil, nil
+	}
+	defer certFile.Close()
+	certPEM, err := ioutil.ReadAll(io.LimitReader(certFile, IMPORT_MAX_UPLOAD))
+	if err != nil {
+		return nil, err
+	}
+	keyFile, _, err := r.FormFile(prefix + ".KeyFile")
+	if err != nil {
+		return nil, fmt.Errorf("%s", tr("Wrong CA private key!"))
+	}
+	defer keyFile.Close()
+	keyPEM, err := ioutil.ReadAll(io.LimitReader(keyFile, IMPORT_MAX_UPLOAD))
+	if err != nil {
+		return nil, err
+	}
+	return ImportCA(certPEM, keyPEM)
+}
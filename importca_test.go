@@ -0,0 +1,65 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestImportCA(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	key, err := genKey(ECDSA, 256)
+	dieOnError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(42), Subject: pkix.Name{CommonName: "Imported CA"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour), IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	dieOnError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	block, err := marshalKey(key)
+	dieOnError(t, err)
+	keyPEM := pem.EncodeToMemory(block)
+	other, err := genKey(ECDSA, 256)
+	dieOnError(t, err)
+	block, err = marshalKey(other)
+	dieOnError(t, err)
+	if _, err := ImportCA(certPEM, pem.EncodeToMemory(block)); err == nil {
+		t.Fatal("Imported a CA with another key")
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for field, data := range map[string][]byte{"CA.CertFile": certPEM, "CA.KeyFile": keyPEM} {
+		fw, err := mw.CreateFormFile(field, field)
+		dieOnError(t, err)
+		fw.Write(data)
+	}
+	dieOnError(t, mw.Close())
+	req := httptest.NewRequest("POST", "/setup", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	ca, err := readImportedCA("CA", req)
+	dieOnError(t, err)
+	if ca == nil || ca.Crt.SerialNumber.Int64() != 42 {
+		t.Fatalf("CA not imported: %v", ca)
+	}
+	web, err := GenCert(FindCert("Imported CA"), "web.example.com", ForDays(30))
+	dieOnError(t, err)
+	dieOnError(t, web.Crt.CheckSignatureFrom(ca.Crt))
+	if _, err := ImportCA(certPEM, keyPEM); err == nil {
+		t.Fatal("CA imported twice")
+	}
+	if _, err := ImportCA(pemCerts(web.Crt), keyPEM); err == nil {
+		t.Fatal("Imported a certificate that is not a CA")
+	}
+	if ca, err := readImportedCA("CA", httptest.NewRequest("POST", "/setup", nil)); ca != nil || err != nil {
+		t.Fatalf("Imported a CA without uploads: %v", err)
+	}
+}
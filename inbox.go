@@ -0,0 +1,236 @@
+package webca
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCA_INBOX           = ".webca.inbox"
+	INBOX_HISTORY         = 500 // items kept at most
+	INBOX_DAYS            = 30  // days the items are kept
+	INBOX_DELIVERY_FAILED = "delivery-failed"
+)
+
+// InboxItem is an event shown to the users in the WebCA, with their read state
+type InboxItem struct {
+	ID    string
+	Time  time.Time
+	Kind  string // EVENT_EXPIRY, EVENT_RENEW, EVENT_RENEW_FAILED or INBOX_DELIVERY_FAILED
+	Cert  string // name of the certificate it is about
+	Text  string
+	Users []string        // usernames it is for, all those who see the certificate if empty
+	Read  map[string]bool // usernames that read it
+}
+
+// inbox keeps the latest items, oldest first
+type inbox struct {
+	Items []InboxItem
+}
+
+// inbox lock
+var sinbox sync.Mutex
+
+func init() {
+	Subscribe(inboxRenewals)
+}
+
+// loadInbox loads the inbox items
+func loadInbox() (*inbox, error) {
+	in := &inbox{}
+	if err := loadGob(WEBCA_INBOX, in); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return in, nil
+}
+
+// save stores the inbox items
+func (in *inbox) save() error {
+	return saveGob(WEBCA_INBOX, in)
+}
+
+// addInboxItem records the item for the users, only logging failures since the events happen in
+// the background
+func addInboxItem(kind, cert, text string, users ...string) {
+	id, err := genId()
+	if err != nil {
+		log.Printf("(Warning) Could not record the %s of %s in the inbox: %s", kind, cert, err)
+		return
+	}
+	sinbox.Lock()
+	defer sinbox.Unlock()
+	in, err := loadInbox()
+	if err == nil {
+		now := time.Now()
+		kept := make([]InboxItem, 0, len(in.Items)+1)
+		for _, item := range in.Items {
+			if now.Sub(item.Time) < INBOX_DAYS*24*time.Hour {
+				kept = append(kept, item)
+			}
+		}
+		kept = append(kept, InboxItem{ID: id, Time: now, Kind: kind, Cert: cert, Text: text, Users: users})
+		if len(kept) > INBOX_HISTORY {
+			kept = kept[len(kept)-INBOX_HISTORY:]
+		}
+		in.Items = kept
+		err = in.save()
+	}
+	if err != nil {
+		log.Printf("(Warning) Could not record the %s of %s in the inbox: %s", kind, cert, err)
+	}
+}
+
+// inboxRenewals records the renewals in the inbox
+func inboxRenewals(e Event) {
+	if e.Type != EVENT_RENEW {
+		return
+	}
+	addInboxItem(EVENT_RENEW, e.Name, tr("%s was renewed, it now expires on %s", e.Name,
+		e.NotAfter.Format(MYFMT+" 15:04")))
+}
+
+// inboxExpiring records the certificates about to expire not recorded yet in the inbox, for the
+// users they are notified to
+func inboxExpiring(cfg *config, idx *notifiedIndex, notices []ExpiryNotice) {
+	pending := idx.pending(notices, "inbox")
+	for _, n := range pending {
+		name := n.Cert.Crt.Subject.CommonName
+		addInboxItem(EVENT_EXPIRY, name, tr("%s expires on %s, %d days left", name,
+			n.Cert.Crt.NotAfter.Format(MYFMT+" 15:04"), n.DaysLeft), cfg.usersByEmail(cfg.certRecipients(n.Cert))...)
+	}
+	idx.sent(pending, "inbox")
+}
+
+// usersByEmail returns the usernames of the users with any of the emails
+func (cfg *config) usersByEmail(emails []string) []string {
+	wanted := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		wanted[email] = true
+	}
+	users := make([]string, 0)
+	for _, u := range cfg.Users {
+		if u.Email != "" && wanted[u.Email] {
+			users = append(users, u.Username)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// relevantTo tells whether or not the item is for the user: one of its users, or anyone who sees
+// its certificate when it has none
+func (item InboxItem) relevantTo(cfg *config, u User) bool {
+	if len(item.Users) > 0 {
+		found := false
+		for _, username := range item.Users {
+			found = found || username == u.Username
+		}
+		if !found {
+			return false
+		}
+	}
+	if u.Org == "" {
+		return true
+	}
+	c := FindCert(item.Cert)
+	return c != nil && cfg.visibleIn(u.Org, c)
+}
+
+// inboxFor returns the items for the user, newest first
+func inboxFor(u User) ([]InboxItem, error) {
+	sinbox.Lock()
+	defer sinbox.Unlock()
+	in, err := loadInbox()
+	if err != nil {
+		return nil, err
+	}
+	cfg := LoadConfig()
+	items := make([]InboxItem, 0)
+	for i := len(in.Items) - 1; i >= 0; i-- {
+		if in.Items[i].relevantTo(cfg, u) {
+			items = append(items, in.Items[i])
+		}
+	}
+	return items, nil
+}
+
+// unreadInbox returns how many items for the user they did not read
+func unreadInbox(u User) int {
+	items, err := inboxFor(u)
+	if err != nil {
+		return 0
+	}
+	unread := 0
+	for _, item := range items {
+		if !item.Read[u.Username] {
+			unread++
+		}
+	}
+	return unread
+}
+
+// markInboxRead marks the item with the id as read by the user, all of their items if id is empty
+func markInboxRead(u User, id string) error {
+	sinbox.Lock()
+	defer sinbox.Unlock()
+	in, err := loadInbox()
+	if err != nil {
+		return err
+	}
+	cfg := LoadConfig()
+	found := false
+	for i, item := range in.Items {
+		if (id == "" || item.ID == id) && item.relevantTo(cfg, u) {
+			if item.Read == nil {
+				in.Items[i].Read = make(map[string]bool)
+			}
+			in.Items[i].Read[u.Username] = true
+			found = true
+		}
+	}
+	if id != "" && !found {
+		return fmt.Errorf("%s", tr("Notification not found!"))
+	}
+	return in.save()
+}
+
+// Unread returns how many inbox items the logged user of the page did not read
+func (ps PageStatus) Unread() int {
+	u, ok := ps[LOGGEDUSER].(User)
+	if !ok {
+		return 0
+	}
+	return unreadInbox(u)
+}
+
+// inboxPage lists the recent events for the web user and lets them mark them as read
+func inboxPage(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	u, _ := ps[LOGGEDUSER].(User)
+	u = currentUser(u)
+	if r.Method == "POST" {
+		if err := markInboxRead(u, r.FormValue("id")); err != nil {
+			ps["Error"] = err.Error()
+		} else {
+			http.Redirect(w, r, "/inbox", http.StatusFound)
+			return
+		}
+	}
+	items, err := inboxFor(u)
+	if handleError(w, r, err) {
+		return
+	}
+	ps["Items"] = items
+	ps["Username"] = u.Username
+	ps["Days"] = INBOX_DAYS
+	err = templatesFor(r).ExecuteTemplate(w, "inbox", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,86 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInbox(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{
+		"ines": {Username: "ines", Email: "ines@example.com", Role: ROLE_ADMIN},
+		"ivan": {Username: "ivan", Email: "ivan@example.com", Role: ROLE_VIEWER},
+		"iris": {Username: "iris", Email: "iris@example.com", Role: ROLE_VIEWER, Org: "green"}},
+		Organizations: []Organization{{Name: "green", CAs: []string{"GreenCA"}}},
+		Notifications: &Notifications{Recipients: []string{"ines@example.com"}}}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "InboxCA"}, ForDays(365))
+	dieOnError(t, err)
+	green, err := GenCACert(pkix.Name{CommonName: "GreenCA"}, ForDays(365))
+	dieOnError(t, err)
+	c, err := GenCert(ca, "inbox.example.com", ForDays(10))
+	dieOnError(t, err)
+	_, err = GenCert(green, "green.example.com", ForDays(100))
+	dieOnError(t, err)
+	dieOnError(t, NotifyExpiring(time.Now()))
+	_, err = RenewCert(c, false)
+	dieOnError(t, err)
+	addInboxItem(INBOX_DELIVERY_FAILED, "green.example.com", "Delivery failed")
+
+	kinds := func(username string) string {
+		items, err := inboxFor(cachedCfg.Users[username])
+		dieOnError(t, err)
+		ks := make([]string, 0, len(items))
+		for _, item := range items {
+			ks = append(ks, item.Kind+" "+item.Cert)
+		}
+		return strings.Join(ks, ", ")
+	}
+	for username, expected := range map[string]string{
+		"ines": "delivery-failed green.example.com, renew inbox.example.com, expiry inbox.example.com",
+		"ivan": "delivery-failed green.example.com, renew inbox.example.com",
+		"iris": "delivery-failed green.example.com"} {
+		if got := kinds(username); got != expected {
+			t.Errorf("Wrong inbox of %s: %s", username, got)
+		}
+	}
+
+	s, err := SessionFor(httptest.NewRecorder(), httptest.NewRequest("GET", "/inbox", nil))
+	dieOnError(t, err)
+	s[LOGGEDUSER] = cachedCfg.Users["ivan"]
+	s.Save()
+	defer dropSession(s.Id())
+	call := func(method string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/inbox", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: s.Id()})
+		w := httptest.NewRecorder()
+		accessControl(inboxPage).ServeHTTP(w, req)
+		return w
+	}
+	if out := call("GET", nil).Body.String(); !strings.Contains(out, `<span class="unread">2</span>`) ||
+		!strings.Contains(out, "Delivery failed") {
+		t.Fatalf("Unexpected inbox page:\n%s", out)
+	}
+	items, err := inboxFor(cachedCfg.Users["ivan"])
+	dieOnError(t, err)
+	if w := call("POST", url.Values{"id": {items[0].ID}}); w.Code != http.StatusFound ||
+		unreadInbox(cachedCfg.Users["ivan"]) != 1 || unreadInbox(cachedCfg.Users["iris"]) != 1 {
+		t.Fatalf("Not marked as read: %d", w.Code)
+	}
+	if w := call("POST", url.Values{"id": {"nothing"}}); !strings.Contains(w.Body.String(), "Notification not found!") {
+		t.Fatal("Unknown notification marked as read")
+	}
+	call("POST", url.Values{})
+	if unreadInbox(cachedCfg.Users["ivan"]) != 0 || unreadInbox(cachedCfg.Users["ines"]) != 3 {
+		t.Fatal("Not all marked as read")
+	}
+}
@@ -0,0 +1,129 @@
+package webca
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	STATUS_VALID   = "valid"
+	STATUS_PENDING = "not yet valid"
+	STATUS_EXPIRED = "expired"
+	STATUS_REVOKED = "revoked"
+	STATUS_HOLD    = "on hold"
+)
+
+// InventoryEntry is a certificate of the exported inventory
+type InventoryEntry struct {
+	Name        string    `json:"name"`
+	Serial      string    `json:"serial"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Fingerprint string    `json:"fingerprint"`
+	Status      string    `json:"status"`
+	Tags        []string  `json:"tags"`
+	Notes       string    `json:"notes,omitempty"`
+}
+
+// inventoryColumns are the CSV header of the inventory, in the InventoryEntry field order
+var inventoryColumns = []string{"name", "serial", "issuer", "notBefore", "notAfter", "fingerprint", "status",
+	"tags", "notes"}
+
+// certStatus returns whether the certificate is revoked, on hold, expired, not yet valid or valid
+// at now
+func certStatus(c *Cert, now time.Time) string {
+	rv := Revoked(c)
+	switch {
+	case rv != nil && rv.OnHold():
+		return STATUS_HOLD
+	case rv != nil:
+		return STATUS_REVOKED
+	case now.After(c.Crt.NotAfter):
+		return STATUS_EXPIRED
+	case now.Before(c.Crt.NotBefore):
+		return STATUS_PENDING
+	}
+	return STATUS_VALID
+}
+
+// Inventory returns the certificates matching the filter (all for an empty one) as inventory
+// entries, ordered by name
+func Inventory(f CertFilter) []InventoryEntry {
+	now := time.Now()
+	cfg := LoadConfig()
+	entries := make([]InventoryEntry, 0)
+	for _, c := range FindCerts(f) {
+		labels := cfg.certLabels(c.Crt.Subject.CommonName)
+		if labels.Tags == nil {
+			labels.Tags = []string{}
+		}
+		entries = append(entries, InventoryEntry{
+			Name:        c.Crt.Subject.CommonName,
+			Serial:      serialKey(c.Crt.SerialNumber),
+			Issuer:      c.Crt.Issuer.CommonName,
+			NotBefore:   c.Crt.NotBefore.UTC(),
+			NotAfter:    c.Crt.NotAfter.UTC(),
+			Fingerprint: Fingerprint(c.Crt),
+			Status:      certStatus(c, now),
+			Tags:        labels.Tags,
+			Notes:       labels.Notes,
+		})
+	}
+	return entries
+}
+
+// InventoryCSV returns the inventory entries as CSV with a header line, the dates in RFC 3339 and
+// the tags separated by spaces
+func InventoryCSV(entries []InventoryEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(inventoryColumns)
+	for _, e := range entries {
+		cw.Write([]string{e.Name, e.Serial, e.Issuer, e.NotBefore.Format(time.RFC3339),
+			e.NotAfter.Format(time.RFC3339), e.Fingerprint, e.Status, strings.Join(e.Tags, " "), e.Notes})
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// ExportURL returns the link exporting the certificates of the search in the format
+func (p *CertPage) ExportURL(format string) template.URL {
+	q := url.Values{}
+	for k, v := range p.query {
+		q[k] = v
+	}
+	q.Set("format", format)
+	return template.URL("/export?" + q.Encode())
+}
+
+// export downloads the certificate inventory, or the certificates matching the search filter,
+// as CSV or JSON
+func export(w http.ResponseWriter, r *http.Request) {
+	f, err := readCertFilter(r)
+	if handleError(w, r, err) {
+		return
+	}
+	entries := Inventory(f)
+	var data []byte
+	switch format := r.FormValue("format"); format {
+	case "", "csv":
+		if data, err = InventoryCSV(entries); err == nil {
+			download(w, "inventory.csv", "text/csv", data)
+		}
+	case "json":
+		if data, err = json.MarshalIndent(entries, "", "  "); err == nil {
+			download(w, "inventory.json", "application/json", data)
+		}
+	default:
+		err = fmt.Errorf("%s", trFor(r, "Unknown export format %q", format))
+	}
+	handleError(w, r, err)
+}
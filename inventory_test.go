@@ -0,0 +1,58 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInventoryExport(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "InventoryCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "good", ForDays(30))
+	dieOnError(t, err)
+	bad, err := GenCert(ca, "bad", ForDays(30))
+	dieOnError(t, err)
+	dieOnError(t, RevokeCert(bad, 1))
+	now := time.Now()
+	_, err = GenCert(ca, "old", Period{NotBefore: now.AddDate(0, 0, -20), NotAfter: now.AddDate(0, 0, -10)})
+	dieOnError(t, err)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		export(w, httptest.NewRequest("GET", "/export?"+query, nil))
+		return w
+	}
+	w := get("format=csv")
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	dieOnError(t, err)
+	if len(rows) != 5 || strings.Join(rows[0], ",") != "name,serial,issuer,notBefore,notAfter,fingerprint,status,tags,notes" {
+		t.Fatalf("Unexpected CSV inventory: %v", rows)
+	}
+	status := map[string]string{}
+	for _, row := range rows[1:] {
+		status[row[0]] = row[6]
+	}
+	if status["InventoryCA"] != STATUS_VALID || status["good"] != STATUS_VALID ||
+		status["bad"] != STATUS_REVOKED || status["old"] != STATUS_EXPIRED {
+		t.Fatalf("Wrong statuses: %v", status)
+	}
+	if !strings.Contains(w.Header().Get("Content-disposition"), "inventory.csv") {
+		t.Fatalf("Not downloaded: %v", w.Header())
+	}
+	var entries []InventoryEntry
+	dieOnError(t, json.Unmarshal(get("format=json&Name=goo").Body.Bytes(), &entries))
+	if len(entries) != 1 || entries[0].Name != "good" || entries[0].Fingerprint != Fingerprint(FindCert("good").Crt) ||
+		entries[0].Issuer != "InventoryCA" {
+		t.Fatalf("Unexpected JSON inventory: %v", entries)
+	}
+	if w := get("format=xml"); strings.Contains(w.Body.String(), "good") || w.Header().Get("Content-disposition") != "" {
+		t.Fatal("Exported in an unknown format")
+	}
+}
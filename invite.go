@@ -0,0 +1,178 @@
+package webca
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	INVITE_DAYS      = 7 // days an invitation link is valid
+	INVITE_KEY_BYTES = 32
+)
+
+// Invitation lets the owner of the email create their own user with the given role, once
+type Invitation struct {
+	ID      string
+	Email   string
+	Role    string
+	By      string // the inviting admin
+	Expires time.Time
+}
+
+// signature returns the HMAC-SHA256 of the invitation with the key, in hex
+func (inv Invitation) signature(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", inv.ID, inv.Email, inv.Role, inv.Expires.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Invite emails a signed link to join as a user with the given role, base is the WebCA URL
+func (cfg *config) Invite(email, role, by, base string) error {
+	email = strings.TrimSpace(email)
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return fmt.Errorf("%s: %v", tr("Wrong email!"), email)
+	}
+	if roleRank(role) == 0 {
+		return fmt.Errorf("%s: %v", tr("Wrong role!"), role)
+	}
+	if cfg.Mailer == nil || cfg.Mailer.Server == "" {
+		return fmt.Errorf("%s", tr("There is no mail server configured!"))
+	}
+	var key []byte
+	err := cfg.update(func(cfg *config) error {
+		if len(cfg.InviteKey) == 0 {
+			k := make([]byte, INVITE_KEY_BYTES)
+			if _, err := rand.Read(k); err != nil {
+				return err
+			}
+			cfg.InviteKey = k
+		}
+		key = cfg.InviteKey
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	id, err := genId()
+	if err != nil {
+		return err
+	}
+	inv := Invitation{ID: id, Email: email, Role: role, By: by, Expires: time.Now().AddDate(0, 0, INVITE_DAYS)}
+	link := base + "/invite?" + url.Values{"id": {inv.ID}, "sig": {inv.signature(key)}}.Encode()
+	body := tr("%s invites you to WebCA as %s.", by, tr("%s", role)) + "\n\n" +
+		tr("Follow this link before %s to choose your username and password:", inv.Expires.Format(MYFMT)) +
+		"\n\n  " + link + "\n"
+	if err := sendMail(cfg.Mailer, email, tr("Invitation"), body); err != nil {
+		return err
+	}
+	return cfg.update(func(cfg *config) error {
+		cfg.Invitations = append(cfg.pendingInvitations(), inv) // a new slice
+		return nil
+	})
+}
+
+// pendingInvitations returns the invitations that did not expire
+func (cfg *config) pendingInvitations() []Invitation {
+	pending := make([]Invitation, 0)
+	for _, inv := range cfg.Invitations {
+		if time.Now().Before(inv.Expires) {
+			pending = append(pending, inv)
+		}
+	}
+	return pending
+}
+
+// invitation returns the pending invitation with the id if the signature matches, or nil
+func (cfg *config) invitation(id, sig string) *Invitation {
+	if cfg == nil || len(cfg.InviteKey) == 0 {
+		return nil
+	}
+	for _, inv := range cfg.pendingInvitations() {
+		if inv.ID == id && hmac.Equal([]byte(inv.signature(cfg.InviteKey)), []byte(sig)) {
+			return &inv
+		}
+	}
+	return nil
+}
+
+// DeleteInvitation revokes the invitation with the given id
+func (cfg *config) DeleteInvitation(id string) error {
+	return cfg.update(func(cfg *config) error {
+		for i, inv := range cfg.Invitations {
+			if inv.ID == id {
+				cfg.Invitations = append(cfg.Invitations[:i:i], cfg.Invitations[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s", tr("Invitation not found!"))
+	})
+}
+
+// AcceptInvitation creates the invited user, with the email and role of the invitation that
+// can't be used again
+func (cfg *config) AcceptInvitation(inv Invitation, u User) error {
+	u.Email, u.Role, u.Disabled = inv.Email, inv.Role, false
+	if err := cfg.SaveUser(u, true); err != nil {
+		return err
+	}
+	return cfg.DeleteInvitation(inv.ID)
+}
+
+// webBase returns the WebCA URL as seen by the browser, under the base path
+func webBase(r *http.Request) string {
+	return webOrigin(r) + options.basePath()
+}
+
+// webOrigin returns the scheme and host of the WebCA as seen by the browser
+func webOrigin(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host
+}
+
+// invite lets the invitee of a valid link choose their username and password, and logs them in
+func invite(w http.ResponseWriter, r *http.Request) {
+	ps := newPageStatus(r)
+	cfg := LoadConfig()
+	inv := cfg.invitation(r.FormValue("id"), r.FormValue("sig"))
+	if inv == nil {
+		http.Error(w, tr("This invitation is not valid or has expired!"), http.StatusNotFound)
+		return
+	}
+	u := readUser(r)
+	if r.Method == "POST" {
+		var err error
+		if u.Password != r.FormValue("Confirm") {
+			err = fmt.Errorf("%s", tr("The passwords do not match!"))
+		} else {
+			err = cfg.AcceptInvitation(*inv, u)
+		}
+		if err == nil {
+			s, err := SessionFor(w, r)
+			if handleError(w, r, err) {
+				return
+			}
+			s[LOGGEDUSER] = cfg.getUser(u.Username)
+			if handleError(w, r, s.Renew(w, r)) {
+				return
+			}
+			http.Redirect(w, r, "/", 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	} else {
+		u.Username = strings.Split(inv.Email, "@")[0]
+	}
+	ps["Invitation"] = inv
+	ps["U"] = u
+	ps["Sig"] = r.FormValue("sig")
+	ps["Policy"] = cfg.passwordPolicy()
+	err := templatesFor(r).ExecuteTemplate(w, "invite", ps)
+	handleError(w, r, err)
+}
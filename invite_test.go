@@ -0,0 +1,53 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInvitation(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss"}}, Mailer: &Mailer{Server: "smtp.example.com"}}
+	var to, body string
+	defer func(saved func(m *Mailer, to, subject, body string) error) { sendMail = saved }(sendMail)
+	sendMail = func(m *Mailer, rcpt, subject, text string) error {
+		to, body = rcpt, text
+		return nil
+	}
+	if err := cachedCfg.Invite("bad address\nBcc: x@example.com", ROLE_VIEWER, "boss", "https://ca"); err == nil {
+		t.Fatal("A wrong email was invited")
+	}
+	dieOnError(t, cachedCfg.Invite("alice@example.com", ROLE_OPERATOR, "boss", "https://ca.example.com"))
+	i := strings.Index(body, "https://ca.example.com/invite?")
+	if to != "alice@example.com" || i < 0 || len(cachedCfg.pendingInvitations()) != 1 {
+		t.Fatalf("Wrong invitation to %s: %s", to, body)
+	}
+	link := strings.Fields(body[i:])[0]
+	post := func(query, form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/invite?"+query, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		invite(w, req)
+		return w
+	}
+	query := link[strings.Index(link, "?")+1:]
+	if w := post(query+"0", "Username=alice&Password=Corr3ct-horse&Confirm=Corr3ct-horse"); w.Code != http.StatusNotFound {
+		t.Errorf("A forged invitation was accepted: %d", w.Code)
+	}
+	if w := post(query, "Username=alice&Password=Corr3ct-horse&Confirm=other"); w.Code != http.StatusOK {
+		t.Errorf("Mismatched passwords were accepted: %d", w.Code)
+	}
+	if w := post(query, "Username=alice&Fullname=Alice&Password=Corr3ct-horse&Confirm=Corr3ct-horse"); w.Code != http.StatusFound {
+		t.Fatalf("The invitation could not be accepted: %d %s", w.Code, w.Body)
+	}
+	u := cachedCfg.Users["alice"]
+	if u.Email != "alice@example.com" || u.Role != ROLE_OPERATOR || !checkPassword(u.Password, "Corr3ct-horse") {
+		t.Fatalf("Wrong invited user %+v", u)
+	}
+	if w := post(query, "Username=alice2&Password=Corr3ct-horse&Confirm=Corr3ct-horse"); w.Code != http.StatusNotFound {
+		t.Errorf("The invitation was used twice: %d", w.Code)
+	}
+}
@@ -0,0 +1,178 @@
+package webca
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_WORKERS = 2         // certificates generated at the same time
+	JOB_QUEUE   = 100       // jobs waiting at most
+	JOB_KEEP    = time.Hour // finished jobs are kept to be looked at
+
+	JOB_QUEUED  = "queued"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+)
+
+// Job generates a certificate in the background, so that slow key generations (e.g. RSA 4096)
+// don't tie up the web requests
+type Job struct {
+	ID       string
+	User     string // who queued it, the only one to see it
+	Name     string // of the certificate to generate
+	State    string // JOB_QUEUED, JOB_RUNNING, JOB_DONE or JOB_FAILED
+	Error    string
+	Queued   time.Time
+	Finished time.Time
+	Download bool // the key is not stored: it is downloaded once from the job
+	cert     *Cert
+	run      func() (*Cert, error)
+}
+
+// JobStatus is the state of a job polled by its progress page
+type JobStatus struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	Cert  string `json:"cert,omitempty"` // name of the generated certificate when done
+	Key   bool   `json:"key"`            // its key is still to be downloaded from the job
+}
+
+var (
+	// jobs by ID, with the finished ones for JOB_KEEP
+	jobs = make(map[string]*Job)
+	// jobs lock
+	sjobs sync.Mutex
+	// jobQueue feeds the workers
+	jobQueue = make(chan *Job, JOB_QUEUE)
+	// startWorkers starts the workers with the first job
+	startWorkers sync.Once
+)
+
+// enqueueJob queues run to generate the named certificate for the user
+func enqueueJob(user, name string, download bool, run func() (*Cert, error)) (*Job, error) {
+	startWorkers.Do(func() {
+		for i := 0; i < JOB_WORKERS; i++ {
+			go jobWorker()
+		}
+	})
+	id, err := genId()
+	if err != nil {
+		return nil, err
+	}
+	j := &Job{ID: id, User: user, Name: name, State: JOB_QUEUED, Queued: time.Now(), Download: download, run: run}
+	sjobs.Lock()
+	defer sjobs.Unlock()
+	for id, old := range jobs {
+		if !old.Finished.IsZero() && time.Since(old.Finished) > JOB_KEEP {
+			delete(jobs, id)
+		}
+	}
+	select {
+	case jobQueue <- j:
+		jobs[j.ID] = j
+		return j, nil
+	default:
+		return nil, fmt.Errorf("%s", tr("Too many certificates being generated, try again later!"))
+	}
+}
+
+// jobWorker runs the queued jobs one after another
+func jobWorker() {
+	for j := range jobQueue {
+		sjobs.Lock()
+		j.State = JOB_RUNNING
+		sjobs.Unlock()
+		c, err := j.run()
+		sjobs.Lock()
+		j.Finished = time.Now()
+		if err != nil {
+			j.State, j.Error = JOB_FAILED, err.Error()
+			log.Printf("(Warning) Generation of %s failed: %s", j.Name, err)
+		} else {
+			j.State, j.cert = JOB_DONE, c
+		}
+		sjobs.Unlock()
+	}
+}
+
+// jobStatus returns the status of the job of the user, nil if they have no such job
+func jobStatus(id, user string) *JobStatus {
+	sjobs.Lock()
+	defer sjobs.Unlock()
+	j := jobs[id]
+	if j == nil || j.User != user {
+		return nil
+	}
+	st := &JobStatus{ID: j.ID, Name: j.Name, State: j.State, Error: j.Error}
+	if j.cert != nil {
+		st.Cert = j.cert.Crt.Subject.CommonName
+		st.Key = j.Download && j.cert.Key != nil
+	}
+	return st
+}
+
+// takeJobCert returns the certificate of the job of the user with what pack makes of it with its
+// key, removing the key from the job once pack succeeds: the key that is not stored can only be
+// taken once
+func takeJobCert(id, user string, pack func(c *Cert) ([]byte, error)) (*Cert, []byte, error) {
+	sjobs.Lock()
+	defer sjobs.Unlock()
+	j := jobs[id]
+	if j == nil || j.User != user || !j.Download || j.cert == nil || j.cert.Key == nil {
+		return nil, nil, fmt.Errorf("%s", tr("There is nothing to download from this job!"))
+	}
+	c := *j.cert
+	data, err := pack(&c)
+	if err != nil {
+		return nil, nil, err
+	}
+	j.cert.Key = nil
+	return &c, data, nil
+}
+
+// jobPage shows the progress of a certificate generation until it is done, and gives the key that
+// is not stored, once
+func jobPage(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	id, user := r.FormValue("id"), requestUser(w, r).Username
+	if r.Method == "POST" {
+		c, data, err := takeJobCert(id, user, func(c *Cert) ([]byte, error) {
+			return CertPackage(c, true)
+		})
+		if err == nil {
+			auditRequest(w, r, AUDIT_KEY_DOWNLOAD, certObject(c.Crt)+" not stored")
+			download(w, filename(c.Crt.Subject.CommonName)+".zip", "application/zip", data)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	st := jobStatus(id, user)
+	if st == nil {
+		http.Error(w, tr("Job not found!"), http.StatusNotFound)
+		return
+	}
+	ps["Job"] = st
+	err := templatesFor(r).ExecuteTemplate(w, "job", ps)
+	handleError(w, r, err)
+}
+
+// jobStatusPage replies with the status of a job in JSON, for its progress page
+func jobStatusPage(w http.ResponseWriter, r *http.Request) {
+	st := jobStatus(r.FormValue("id"), requestUser(w, r).Username)
+	if st == nil {
+		http.Error(w, tr("Job not found!"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	apiReply(w, http.StatusOK, st)
+}
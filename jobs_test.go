@@ -0,0 +1,98 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitJob waits for the job the response redirected to to finish, returning its ID
+func waitJob(t *testing.T, w *httptest.ResponseRecorder, user string) string {
+	loc := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(loc, "/job?id=") {
+		t.Fatalf("Not redirected to the job: %d %s", w.Code, w.Body)
+	}
+	id := strings.TrimPrefix(loc, "/job?id=")
+	for i := 0; i < 300; i++ {
+		if st := jobStatus(id, user); st == nil || st.State == JOB_DONE || st.State == JOB_FAILED {
+			return id
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Job %s not finished", id)
+	return id
+}
+
+func TestJobs(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{}}
+	certree = nil
+	_, err := GenCACert(pkix.Name{CommonName: "JobCA"}, ForDays(365))
+	dieOnError(t, err)
+	post := func(h http.Handler, target string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	w := post(accessControl(gen), "/gen", url.Values{"parent": {"JobCA"}, "Cert.CommonName": {"job.example.com"}, "Cert.Duration": {"30"}})
+	id := waitJob(t, w, "fuser")
+	if st := jobStatus(id, "fuser"); st.State != JOB_DONE || st.Cert != "job.example.com" || st.Key || FindCert("job.example.com") == nil {
+		t.Fatalf("Certificate not generated: %+v", st)
+	}
+	if LoadConfig().Owners["job.example.com"] != "fuser" {
+		t.Error("Owner of the generated certificate not recorded")
+	}
+	w = httptest.NewRecorder()
+	accessControl(jobStatusPage).ServeHTTP(w, httptest.NewRequest("GET", "/jobStatus?id="+id, nil))
+	var st JobStatus
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &st) != nil || st.State != JOB_DONE {
+		t.Fatalf("Wrong job status: %d %s", w.Code, w.Body)
+	}
+	if jobStatus(id, "someone") != nil {
+		t.Error("Job shown to another user")
+	}
+	w = httptest.NewRecorder()
+	accessControl(jobPage).ServeHTTP(w, httptest.NewRequest("GET", "/job?id="+id, nil))
+	if !strings.Contains(w.Body.String(), "certControl?cert=job.example.com") {
+		t.Fatalf("No link to the generated certificate:\n%s", w.Body)
+	}
+
+	done := make(chan bool)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			dieOnError(t, LoadConfig().setOwner(fmt.Sprintf("c%d.example.com", i), "fuser"))
+			done <- User{Username: "fuser", Role: ROLE_OPERATOR}.ownsKey("job.example.com")
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		if !<-done {
+			t.Error("Owner lost while others were recorded")
+		}
+	}
+	if len(LoadConfig().Owners) != 21 {
+		t.Errorf("Owners recorded concurrently lost: %v", LoadConfig().Owners)
+	}
+
+	cachedCfg.NoPlainKeys = true
+	w = post(accessControl(gen), "/gen", url.Values{"parent": {"JobCA"}, "Cert.CommonName": {"once.example.com"},
+		"Cert.Duration": {"30"}, "NoStoredKey": {"1"}})
+	id = waitJob(t, w, "fuser")
+	if st := jobStatus(id, "fuser"); st.State != JOB_FAILED || st.Error == "" {
+		t.Fatalf("Key that can't be downloaded generated: %+v", st)
+	}
+	if w := post(accessControl(gen), "/gen", url.Values{"parent": {"NoCA"}, "Cert.CommonName": {"no.example.com"},
+		"Cert.Duration": {"30"}}); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "NoCA") {
+		t.Fatalf("Wrong parent queued: %d", w.Code)
+	}
+}
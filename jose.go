@@ -0,0 +1,179 @@
+package webca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JWS is a JSON Web Signature in flattened JSON serialization (RFC 7515), as used by ACME
+type JWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// JWSHeader is the protected header of an ACME JWS (RFC 8555 section 6.2)
+type JWSHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	KID   string          `json:"kid,omitempty"`
+	JWK   json.RawMessage `json:"jwk,omitempty"`
+}
+
+// JWK is a public JSON Web Key (RFC 7517), only RSA and EC keys are supported
+type JWK struct {
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// b64 encodes as unpadded base64url
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// unb64 decodes unpadded base64url
+func unb64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// Header decodes the protected header
+func (jws *JWS) Header() (*JWSHeader, error) {
+	data, err := unb64(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+	h := &JWSHeader{}
+	return h, json.Unmarshal(data, h)
+}
+
+// Verify checks the signature with the given key and returns the decoded payload
+func (jws *JWS) Verify(alg string, key crypto.PublicKey) ([]byte, error) {
+	sig, err := unb64(jws.Signature)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(jws.Protected + "." + jws.Payload)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return nil, fmt.Errorf("Unsupported algorithm %s for an RSA key", alg)
+		}
+		sum := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig); err != nil {
+			return nil, fmt.Errorf("Wrong JWS signature")
+		}
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case alg == "ES256" && k.Curve == elliptic.P256():
+			sum := sha256.Sum256(signed)
+			digest = sum[:]
+		case alg == "ES384" && k.Curve == elliptic.P384():
+			sum := sha512.Sum384(signed)
+			digest = sum[:]
+		default:
+			return nil, fmt.Errorf("Unsupported algorithm %s for an EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return nil, fmt.Errorf("Wrong JWS signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return nil, fmt.Errorf("Wrong JWS signature")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported key type")
+	}
+	return unb64(jws.Payload)
+}
+
+// PublicKey returns the key described by the JWK
+func (jwk *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err1 := unb64(jwk.N)
+		e, err2 := unb64(jwk.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("Wrong RSA JWK")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must have at least 2048 bits")
+		}
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s", jwk.Crv)
+		}
+		x, err1 := unb64(jwk.X)
+		y, err2 := unb64(jwk.Y)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Wrong EC JWK")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("Wrong EC JWK")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", jwk.Kty)
+}
+
+// Thumbprint returns the base64url SHA-256 thumbprint of the key (RFC 7638)
+func (jwk *JWK) Thumbprint() string {
+	var canonical string
+	if jwk.Kty == "RSA" {
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	} else {
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:])
+}
+
+// ecJWK returns the JWK of a P-256 key
+func ecJWK(key *ecdsa.PublicKey) JWK {
+	return JWK{Kty: "EC", Crv: "P-256", X: b64(key.X.FillBytes(make([]byte, 32))),
+		Y: b64(key.Y.FillBytes(make([]byte, 32)))}
+}
+
+// signJWS signs the payload (none for POST-as-GET) with the header and a P-256 key, as ES256
+func signJWS(key *ecdsa.PrivateKey, h JWSHeader, payload []byte) (*JWS, error) {
+	h.Alg = "ES256"
+	protected, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	jws := &JWS{Protected: b64(protected)}
+	if payload != nil {
+		jws.Payload = b64(payload)
+	}
+	sum := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	jws.Signature = b64(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	return jws, nil
+}
@@ -0,0 +1,184 @@
+package webca
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KEYPOOL_MAX    = 100             // keys kept at most per kind
+	KEYPOOL_PERIOD = 5 * time.Minute // the pools are checked against the settings at least this often
+)
+
+var (
+	// keyPools keeps the pre-generated keys by kind, in memory only
+	keyPools = make(map[string][]crypto.Signer)
+	// keyPools lock
+	skeyPools sync.Mutex
+	// keyPoolRefill wakes up the refilling after a key is drawn or the settings change
+	keyPoolRefill = make(chan struct{}, 1)
+)
+
+// keyKind returns the pool a key of the type and size (0 meaning the default size) is kept in,
+// e.g. RSA-2048 or ECDSA-256
+func keyKind(keyType string, bits int) string {
+	if keyType == "" {
+		keyType = RSA
+	}
+	if bits == 0 {
+		bits = DEFAULT_KEY_BITS
+		if keyType == ECDSA {
+			bits = 256
+		}
+	}
+	return fmt.Sprintf("%s-%d", keyType, bits)
+}
+
+// parseKeyKind returns the key type and size of the pool kind
+func parseKeyKind(kind string) (string, int, error) {
+	keyType, b, _ := strings.Cut(strings.ToUpper(strings.TrimSpace(kind)), "-")
+	bits, err := strconv.Atoi(b)
+	if err == nil {
+		err = checkKey(keyType, bits)
+	} else {
+		err = fmt.Errorf("%s: %v", tr("Wrong key kind!"), kind)
+	}
+	return keyType, bits, err
+}
+
+// drawKey takes a pre-generated key of the type and size out of its pool, nil if there is none
+// left; a key is never handed out twice
+func drawKey(keyType string, bits int) crypto.Signer {
+	skeyPools.Lock()
+	defer skeyPools.Unlock()
+	kind := keyKind(keyType, bits)
+	pool := keyPools[kind]
+	if len(pool) == 0 {
+		return nil
+	}
+	key := pool[len(pool)-1]
+	pool[len(pool)-1] = nil
+	keyPools[kind] = pool[:len(pool)-1]
+	wakeKeyPool()
+	return key
+}
+
+// wakeKeyPool asks for the pools to be refilled, without waiting
+func wakeKeyPool() {
+	select {
+	case keyPoolRefill <- struct{}{}:
+	default:
+	}
+}
+
+// keyPoolLevels returns how many keys are ready by kind
+func keyPoolLevels() map[string]int {
+	skeyPools.Lock()
+	defer skeyPools.Unlock()
+	levels := make(map[string]int, len(keyPools))
+	for kind, pool := range keyPools {
+		levels[kind] = len(pool)
+	}
+	return levels
+}
+
+// FillKeyPools generates the keys missing from the pools of the settings, one at a time so that
+// the pools can be drawn from meanwhile, and drops those of the kinds no longer wanted
+func FillKeyPools() error {
+	cfg := LoadConfig()
+	if cfg == nil {
+		return nil
+	}
+	skeyPools.Lock()
+	for kind, pool := range keyPools {
+		if len(pool) > cfg.KeyPool[kind] {
+			keyPools[kind] = pool[:cfg.KeyPool[kind]]
+		}
+	}
+	skeyPools.Unlock()
+	kinds := make([]string, 0, len(cfg.KeyPool))
+	for kind := range cfg.KeyPool {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		keyType, bits, err := parseKeyKind(kind)
+		if err != nil {
+			return err
+		}
+		for {
+			skeyPools.Lock()
+			missing := len(keyPools[kind]) < cfg.KeyPool[kind]
+			skeyPools.Unlock()
+			if !missing {
+				break
+			}
+			key, err := generateKey(keyType, bits)
+			if err != nil {
+				return err
+			}
+			skeyPools.Lock()
+			keyPools[kind] = append(keyPools[kind], key)
+			skeyPools.Unlock()
+		}
+	}
+	return nil
+}
+
+// ScheduleKeyPool starts keeping the key pools full in the background
+func ScheduleKeyPool() {
+	go func() {
+		for {
+			if err := FillKeyPools(); err != nil {
+				log.Printf("(Warning) Key pool refill failed: %s", err)
+			}
+			select {
+			case <-keyPoolRefill:
+			case <-time.After(KEYPOOL_PERIOD):
+			}
+		}
+	}()
+}
+
+// readKeyPool reads the pool sizes by kind from the request, as "RSA-2048:10 ECDSA-256:5"
+func readKeyPool(cfg *config, r *http.Request) error {
+	pools := make(map[string]int)
+	for _, p := range strings.FieldsFunc(r.FormValue("KeyPool"), func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t'
+	}) {
+		kind, n, _ := strings.Cut(p, ":")
+		keyType, bits, err := parseKeyKind(kind)
+		if err != nil {
+			return err
+		}
+		size, err := strconv.Atoi(n)
+		if err != nil || size < 0 || size > KEYPOOL_MAX {
+			return fmt.Errorf("%s: %v", tr("Wrong pool size, %d keys at most!", KEYPOOL_MAX), p)
+		}
+		if size > 0 {
+			pools[keyKind(keyType, bits)] = size
+		}
+	}
+	cfg.KeyPool = nil
+	if len(pools) > 0 {
+		cfg.KeyPool = pools
+	}
+	return nil
+}
+
+// KeyPoolText returns the pool sizes of the settings as read by readKeyPool
+func (cfg *config) KeyPoolText() string {
+	pools := make([]string, 0, len(cfg.KeyPool))
+	for kind, size := range cfg.KeyPool {
+		pools = append(pools, fmt.Sprintf("%s:%d", kind, size))
+	}
+	sort.Strings(pools)
+	return strings.Join(pools, " ")
+}
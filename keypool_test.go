@@ -0,0 +1,64 @@
+package webca
+
+import (
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestKeyPool(t *testing.T) {
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{}
+	defer func() {
+		skeyPools.Lock()
+		keyPools = make(map[string][]crypto.Signer)
+		skeyPools.Unlock()
+	}()
+	form := func(pool string) *http.Request {
+		return httptest.NewRequest("GET", "/settings?"+url.Values{"KeyPool": {pool}}.Encode(), nil)
+	}
+	for _, wrong := range []string{"RSA-1024:2", "DSA-2048:1", "ECDSA-300:1", "ECDSA-256:x", "RSA-2048:1000"} {
+		if readKeyPool(cachedCfg, form(wrong)) == nil {
+			t.Errorf("Wrong key pool accepted: %s", wrong)
+		}
+	}
+	dieOnError(t, readKeyPool(cachedCfg, form("ecdsa-256:3, ECDSA-384:0")))
+	if len(cachedCfg.KeyPool) != 1 || cachedCfg.KeyPool["ECDSA-256"] != 3 || cachedCfg.KeyPoolText() != "ECDSA-256:3" {
+		t.Fatalf("Wrong key pool read: %v", cachedCfg.KeyPool)
+	}
+	dieOnError(t, FillKeyPools())
+	if keyPoolLevels()["ECDSA-256"] != 3 {
+		t.Fatalf("Key pool not filled: %v", keyPoolLevels())
+	}
+	drawn := make(chan crypto.Signer, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			key, err := genKey(ECDSA, 0)
+			if err != nil {
+				t.Error(err)
+			}
+			drawn <- key
+		}()
+	}
+	keys := make(map[crypto.Signer]bool)
+	for i := 0; i < 3; i++ {
+		keys[<-drawn] = true
+	}
+	if len(keys) != 3 || keyPoolLevels()["ECDSA-256"] != 0 {
+		t.Errorf("Pooled keys not drawn once each: %d keys, %v left", len(keys), keyPoolLevels())
+	}
+	if key := drawKey(ECDSA, 256); key != nil {
+		t.Error("Key drawn from an empty pool")
+	}
+	if key, err := genKey(ECDSA, 256); err != nil || keys[key] {
+		t.Errorf("No new key generated with an empty pool: %v", err)
+	}
+	dieOnError(t, FillKeyPools())
+	cachedCfg.KeyPool = nil
+	dieOnError(t, FillKeyPools())
+	if keyPoolLevels()["ECDSA-256"] != 0 {
+		t.Errorf("Key pool not dropped: %v", keyPoolLevels())
+	}
+}
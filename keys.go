@@ -0,0 +1,131 @@
+package webca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+const (
+	RSA              = "RSA"
+	ECDSA            = "ECDSA"
+	DEFAULT_KEY_TYPE = RSA
+	DEFAULT_KEY_BITS = 2048
+)
+
+// genKey returns a new private key of the given type and size
+// (RSA modulus bits or ECDSA curve size: 256, 384 or 521), from the key pool when it has one
+func genKey(keyType string, bits int) (crypto.Signer, error) {
+	if key := drawKey(keyType, bits); key != nil {
+		return key, nil
+	}
+	return generateKey(keyType, bits)
+}
+
+// generateKey generates a new private key of the given type and size
+func generateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case "", RSA:
+		if bits == 0 {
+			bits = DEFAULT_KEY_BITS
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case ECDSA:
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%s", tr("Unsupported ECDSA key size %d!", bits))
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	return nil, fmt.Errorf("%s", tr("Unsupported key type %s!", keyType))
+}
+
+// checkKey validates a key type and size (0 meaning the default size) without generating it
+func checkKey(keyType string, bits int) error {
+	switch keyType {
+	case "", RSA:
+		if bits != 0 && bits < DEFAULT_KEY_BITS {
+			return fmt.Errorf("%s", tr("RSA keys must be %d bits or more!", DEFAULT_KEY_BITS))
+		}
+		return nil
+	case ECDSA:
+		if bits != 0 && bits != 256 && bits != 384 && bits != 521 {
+			return fmt.Errorf("%s", tr("Unsupported ECDSA key size %d!", bits))
+		}
+		return nil
+	}
+	return fmt.Errorf("%s", tr("Unsupported key type %s!", keyType))
+}
+
+// keyType returns the type of a private or public key
+func keyType(key interface{}) string {
+	switch key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return RSA
+	case *ecdsa.PrivateKey, *ecdsa.PublicKey:
+		return ECDSA
+	}
+	return ""
+}
+
+// marshalKey returns the PEM block for a private key
+func marshalKey(key crypto.Signer) (*pem.Block, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
+
+// parseKey parses the private key on a PEM block
+func parseKey(b *pem.Block) (crypto.Signer, error) {
+	switch b.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(b.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(b.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s", tr("Unsupported private key type!"))
+	}
+	return signer, nil
+}
+
+// sameKey tells whether or not two keys (private or public) belong to the same key pair
+func sameKey(a, b interface{}) bool {
+	if s, ok := a.(crypto.Signer); ok {
+		a = s.Public()
+	}
+	if s, ok := b.(crypto.Signer); ok {
+		b = s.Public()
+	}
+	pub, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(b)
+}
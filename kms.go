@@ -0,0 +1,281 @@
+package webca
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	KMS_AWS      = "aws"
+	KMS_GCP      = "gcp"
+	KMS_AZURE    = "azure"
+	KMS_TIMEOUT  = 30 * time.Second
+	KMS_KEY_TYPE = "KMS KEY REFERENCE" // stored instead of the key, with its public key
+	KMS_PROVIDER = "Provider"
+	KMS_KEY      = "Key"
+)
+
+// kmsProvider is a cloud KMS a CA key can be kept in, reached with the credentials of its command
+// line tool
+type kmsProvider struct {
+	ID   string
+	Name string
+	Tool string
+}
+
+// kmsProviders lists the cloud KMS in display order
+var kmsProviders = []kmsProvider{
+	{KMS_AWS, "AWS KMS", "aws"},
+	{KMS_GCP, "Google Cloud KMS", "gcloud"},
+	{KMS_AZURE, "Azure Key Vault", "az"},
+}
+
+// gcpKMSAPI is the Cloud KMS REST API, used as gcloud only signs whole messages and not digests
+var gcpKMSAPI = "https://cloudkms.googleapis.com/v1/"
+
+var gcpKMSClient = &http.Client{Timeout: KMS_TIMEOUT}
+
+// kmsSigner signs with a private key kept in a cloud KMS, which never leaves it
+type kmsSigner struct {
+	provider string
+	key      string // AWS key ARN or alias, GCP key version resource name or Azure key identifier URL
+	pub      crypto.PublicKey
+}
+
+// kmsChoice is the cloud KMS key chosen in the forms for a new CA, a generated one if Key is empty
+type kmsChoice struct {
+	Provider string
+	Key      string
+}
+
+// readKMS reads the cloud KMS key chosen in the form
+func readKMS(r *http.Request) kmsChoice {
+	return kmsChoice{Provider: r.FormValue("KMSProvider"), Key: strings.TrimSpace(r.FormValue("KMSKey"))}
+}
+
+// Providers lists the cloud KMS to choose from
+func (k kmsChoice) Providers() []kmsProvider {
+	return kmsProviders
+}
+
+// signer returns the signer of the chosen key, nil if none was chosen
+func (k kmsChoice) signer() (crypto.Signer, error) {
+	if k.Key == "" {
+		return nil, nil
+	}
+	s, err := kmsKey(k.Provider, k.Key)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// kmsRun runs the tool of the provider with the given arguments and returns its output
+func kmsRun(provider string, args ...string) ([]byte, error) {
+	tool := ""
+	for _, p := range kmsProviders {
+		if p.ID == provider {
+			tool = p.Tool
+		}
+	}
+	if tool == "" {
+		return nil, fmt.Errorf("%s", tr("Unknown KMS %s!", provider))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), KMS_TIMEOUT)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, tool, args...).Output()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("%s %s: %s", tool, err, strings.TrimSpace(string(ee.Stderr)))
+	}
+	return out, err
+}
+
+// gcpKMS calls the Cloud KMS API on the resource with the access token of gcloud, decoding the
+// answer into v
+func gcpKMS(method, resource string, body, v interface{}) error {
+	token, err := kmsRun(KMS_GCP, "auth", "print-access-token")
+	if err != nil {
+		return err
+	}
+	var in io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, gcpKMSAPI+resource, in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := gcpKMSClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Cloud KMS answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// kmsKey returns the signer of the key in the KMS of the provider, fetching its public key
+func kmsKey(provider, key string) (*kmsSigner, error) {
+	s := &kmsSigner{provider: provider, key: key}
+	var der []byte
+	var err error
+	switch provider {
+	case KMS_AWS:
+		var out []byte
+		out, err = kmsRun(provider, "kms", "get-public-key", "--key-id", key, "--output", "text", "--query", "PublicKey")
+		if err == nil {
+			der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+		}
+	case KMS_GCP:
+		var res struct {
+			Pem string `json:"pem"`
+		}
+		if err = gcpKMS(http.MethodGet, key+"/publicKey", nil, &res); err == nil {
+			if b, _ := pem.Decode([]byte(res.Pem)); b != nil {
+				der = b.Bytes
+			} else {
+				err = fmt.Errorf("No public key found")
+			}
+		}
+	case KMS_AZURE:
+		var out []byte
+		if out, err = kmsRun(provider, "keyvault", "key", "show", "--id", key, "--query", "key", "--output", "json"); err == nil {
+			var jwk JWK
+			if err = json.Unmarshal(out, &jwk); err == nil {
+				jwk.Kty = strings.TrimSuffix(jwk.Kty, "-HSM")
+				s.pub, err = jwk.PublicKey()
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s", tr("Unknown KMS %s!", provider))
+	}
+	if err == nil && s.pub == nil {
+		s.pub, err = x509.ParsePKIXPublicKey(der)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", tr("Cannot use the KMS key %s", key), err)
+	}
+	return s, nil
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs the digest in the KMS, RSA with PKCS#1 v1.5 and ECDSA in ASN.1
+func (s *kmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, pss := opts.(*rsa.PSSOptions); pss {
+		return nil, fmt.Errorf("%s", tr("RSA-PSS signatures are not supported by the KMS keys!"))
+	}
+	size := map[crypto.Hash]string{crypto.SHA256: "256", crypto.SHA384: "384", crypto.SHA512: "512"}[opts.HashFunc()]
+	if size == "" {
+		return nil, fmt.Errorf("%s", tr("Unsupported hash %v for the KMS keys!", opts.HashFunc()))
+	}
+	_, ec := s.pub.(*ecdsa.PublicKey)
+	switch s.provider {
+	case KMS_AWS:
+		alg := "RSASSA_PKCS1_V1_5_SHA_" + size
+		if ec {
+			alg = "ECDSA_SHA_" + size
+		}
+		// the AWS CLI v2 takes the blobs in base64
+		out, err := kmsRun(s.provider, "kms", "sign", "--key-id", s.key, "--message", base64.StdEncoding.EncodeToString(digest),
+			"--message-type", "DIGEST", "--signing-algorithm", alg, "--output", "text", "--query", "Signature")
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	case KMS_GCP:
+		var res struct {
+			Signature []byte `json:"signature"`
+		}
+		req := map[string]map[string][]byte{"digest": {"sha" + size: digest}}
+		if err := gcpKMS(http.MethodPost, s.key+":asymmetricSign", req, &res); err != nil {
+			return nil, err
+		}
+		return res.Signature, nil
+	case KMS_AZURE:
+		alg := "RS" + size
+		if ec {
+			alg = "ES" + size
+		}
+		out, err := kmsRun(s.provider, "keyvault", "key", "sign", "--id", s.key, "--algorithm", alg,
+			"--digest", base64.StdEncoding.EncodeToString(digest), "--query", "result", "--output", "tsv")
+		if err != nil {
+			return nil, err
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(string(out)), "="))
+		if err != nil || !ec {
+			return sig, err
+		}
+		// Key Vault gives the ECDSA signatures as in JWS, r and s concatenated
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:])})
+	}
+	return nil, fmt.Errorf("%s", tr("Unknown KMS %s!", s.provider))
+}
+
+// reference returns the PEM block stored instead of the private key
+func (s *kmsSigner) reference() (*pem.Block, error) {
+	der, err := x509.MarshalPKIXPublicKey(s.pub)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: KMS_KEY_TYPE, Headers: map[string]string{KMS_PROVIDER: s.provider, KMS_KEY: s.key},
+		Bytes: der}, nil
+}
+
+func (s *kmsSigner) GobEncode() ([]byte, error) {
+	b, err := s.reference()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(b), nil
+}
+
+func (s *kmsSigner) GobDecode(data []byte) error {
+	b, _ := pem.Decode(data)
+	if b == nil || b.Type != KMS_KEY_TYPE {
+		return fmt.Errorf("Wrong KMS key reference")
+	}
+	k, err := kmsRef(b)
+	if err != nil {
+		return err
+	}
+	*s = *k
+	return nil
+}
+
+// kmsRef returns the signer of the key referenced by the stored PEM block
+func kmsRef(b *pem.Block) (*kmsSigner, error) {
+	pub, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &kmsSigner{provider: b.Headers[KMS_PROVIDER], key: b.Headers[KMS_KEY], pub: pub}, nil
+}
@@ -0,0 +1,172 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestKMSHelper plays the aws, az and gcloud tools for TestKMS, with the keys of its files
+func TestKMSHelper(t *testing.T) {
+	dir := os.Getenv("WEBCA_FAKE_KMS")
+	if dir == "" {
+		return
+	}
+	tool, args := "", map[string]string{}
+	for i, arg := range os.Args {
+		if arg == "--" && i+1 < len(os.Args) {
+			tool = os.Args[i+1]
+		} else if strings.HasPrefix(arg, "--") && i+1 < len(os.Args) {
+			args[arg] = os.Args[i+1]
+		}
+	}
+	cmd := strings.Join(os.Args, " ")
+	if tool == "gcloud" {
+		fmt.Println("gcp-token")
+		os.Exit(0)
+	}
+	der, err := ioutil.ReadFile(filepath.Join(dir, tool+".key"))
+	dieOnError(t, err)
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	dieOnError(t, err)
+	switch {
+	case strings.Contains(cmd, "get-public-key"):
+		pub, _ := x509.MarshalPKIXPublicKey(key.(crypto.Signer).Public())
+		fmt.Println(base64.StdEncoding.EncodeToString(pub))
+	case strings.Contains(cmd, "kms sign") && args["--message-type"] == "DIGEST" &&
+		args["--signing-algorithm"] == "RSASSA_PKCS1_V1_5_SHA_256":
+		digest, _ := base64.StdEncoding.DecodeString(args["--message"])
+		sig, err := rsa.SignPKCS1v15(nil, key.(*rsa.PrivateKey), crypto.SHA256, digest)
+		dieOnError(t, err)
+		fmt.Println(base64.StdEncoding.EncodeToString(sig))
+	case strings.Contains(cmd, "key show"):
+		pub := key.(*ecdsa.PrivateKey).PublicKey
+		fmt.Printf(`{"kty": "EC-HSM", "crv": "P-256", "x": %q, "y": %q}`+"\n",
+			b64(pub.X.FillBytes(make([]byte, 32))), b64(pub.Y.FillBytes(make([]byte, 32))))
+	case strings.Contains(cmd, "key sign") && args["--algorithm"] == "ES256":
+		digest, _ := base64.StdEncoding.DecodeString(args["--digest"])
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest)
+		dieOnError(t, err)
+		fmt.Println(b64(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)))
+	default:
+		fmt.Fprintln(os.Stderr, "unexpected", cmd)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestKMS(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *Certree) { certree = saved }(certree)
+	defer func(saved []kmsProvider, api string) { kmsProviders, gcpKMSAPI = saved, api }(kmsProviders, gcpKMSAPI)
+	keys, err := filepath.Abs("kms")
+	dieOnError(t, err)
+	dieOnError(t, os.MkdirAll(keys, 0700))
+	os.Setenv("WEBCA_FAKE_KMS", keys)
+	defer os.Unsetenv("WEBCA_FAKE_KMS")
+	pkg, err := filepath.Abs("..") // for the templates of the init
+	dieOnError(t, err)
+	kmsProviders = append([]kmsProvider{}, kmsProviders...)
+	for i, p := range kmsProviders {
+		kmsProviders[i].Tool = filepath.Join(keys, p.Tool)
+		dieOnError(t, ioutil.WriteFile(kmsProviders[i].Tool, []byte("#!/bin/sh\ncd "+pkg+" && exec "+os.Args[0]+
+			" -test.run=^TestKMSHelper$ -- "+p.Tool+" \"$@\"\n"), 0700))
+	}
+	rkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	dieOnError(t, err)
+	der, _ := x509.MarshalPKCS8PrivateKey(rkey)
+	dieOnError(t, ioutil.WriteFile(filepath.Join(keys, "aws.key"), der, 0600))
+	ekey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	der, _ = x509.MarshalPKCS8PrivateKey(ekey)
+	dieOnError(t, ioutil.WriteFile(filepath.Join(keys, "az.key"), der, 0600))
+	gkey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	dieOnError(t, err)
+	version := "projects/p/locations/global/keyRings/r/cryptoKeys/ca/cryptoKeyVersions/1"
+	gcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gcp-token" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/" + version + "/publicKey":
+			pub, _ := x509.MarshalPKIXPublicKey(&gkey.PublicKey)
+			json.NewEncoder(w).Encode(map[string]string{"pem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))})
+		case "/" + version + ":asymmetricSign":
+			var req struct {
+				Digest struct {
+					SHA384 []byte `json:"sha384"`
+				} `json:"digest"`
+			}
+			dieOnError(t, json.NewDecoder(r.Body).Decode(&req))
+			sig, err := ecdsa.SignASN1(rand.Reader, gkey, req.Digest.SHA384)
+			dieOnError(t, err)
+			json.NewEncoder(w).Encode(map[string][]byte{"signature": sig})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gcp.Close()
+	gcpKMSAPI = gcp.URL + "/"
+
+	certree = nil
+	for _, choice := range []kmsChoice{{KMS_AWS, "alias/webca"}, {KMS_AZURE, "https://v.vault.azure.net/keys/ca/1"},
+		{KMS_GCP, version}} {
+		key, err := choice.signer()
+		dieOnError(t, err)
+		ca, err := issueCert(nil, pkix.Name{CommonName: choice.Provider + "CA"}, ForDays(365), nil, key)
+		dieOnError(t, err)
+		stored, err := storage.Get(keyFile(*ca))
+		dieOnError(t, err)
+		if b, _ := pem.Decode(stored); b == nil || b.Type != KMS_KEY_TYPE || b.Headers[KMS_KEY] != choice.Key {
+			t.Fatalf("The key reference was not stored: %s", stored)
+		}
+		if _, err := ReadCertKey(ca); err == nil {
+			t.Error("The key in the KMS was downloaded")
+		}
+		certree = nil
+		loaded := FindCert(choice.Provider + "CA")
+		if loaded == nil || !sameKey(loaded.Key, key) {
+			t.Fatalf("The %s CA was not loaded with its key", choice.Provider)
+		}
+		leaf, err := GenCert(loaded, choice.Provider+".example.com", ForDays(30))
+		dieOnError(t, err)
+		if err := leaf.Crt.CheckSignatureFrom(ca.Crt); err != nil {
+			t.Errorf("Wrong signature by the %s key: %s", choice.Provider, err)
+		}
+		if _, err := issueCert(loaded, pkix.Name{CommonName: "leaf"}, ForDays(30), nil, key); err == nil {
+			t.Error("A leaf certificate got a KMS key")
+		}
+
+		var data bytes.Buffer
+		dieOnError(t, gob.NewEncoder(&data).Encode(struct{ Key crypto.Signer }{key}))
+		var decoded struct{ Key crypto.Signer }
+		dieOnError(t, gob.NewDecoder(&data).Decode(&decoded))
+		if s, ok := decoded.Key.(*kmsSigner); !ok || s.key != choice.Key || !sameKey(s, key) {
+			t.Errorf("The %s key was not kept in the gob", choice.Provider)
+		}
+	}
+	if _, err := (kmsChoice{KMS_AWS, ""}).signer(); err != nil {
+		t.Error("No key chosen should generate one")
+	}
+	if _, err := (kmsChoice{"other", "key"}).signer(); err == nil {
+		t.Error("An unknown KMS was accepted")
+	}
+}
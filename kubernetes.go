@@ -0,0 +1,245 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	KUBE_TIMEOUT       = 10 * time.Second
+	KUBE_SERVICE_HOST  = "KUBERNETES_SERVICE_HOST"
+	KUBE_SERVICE_PORT  = "KUBERNETES_SERVICE_PORT"
+	KUBE_ACCOUNT_DIR   = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	KUBE_MANAGED_LABEL = "app.kubernetes.io/managed-by"
+)
+
+// secretName matches valid Secret names (DNS-1123 subdomains)
+var secretName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// Kubernetes configures the cluster the certificates are published to as kubernetes.io/tls Secrets
+type Kubernetes struct {
+	Server    string            // API server URL, the in-cluster one if empty
+	Token     string            // bearer token, the service account one if empty
+	CA        string            // PEM certificates to verify the API server, the service account one if empty
+	Namespace string            // namespace of the Secrets
+	Secrets   map[string]string // Secret names by certificate name
+}
+
+// kubeSecret is the subset of the Secret resource written
+type kubeSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubeMetadata      `json:"metadata"`
+	Type       string            `json:"type"`
+	Data       map[string][]byte `json:"data"`
+}
+
+type kubeMetadata struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+func init() {
+	Subscribe(publishSecrets)
+}
+
+// publishSecrets updates in the background the Secret of the issued or renewed certificate, if any
+func publishSecrets(e Event) {
+	if e.Type != EVENT_ISSUE && e.Type != EVENT_RENEW {
+		return
+	}
+	cfg := LoadConfig()
+	if cfg == nil || cfg.Kubernetes == nil || cfg.Kubernetes.Secrets[e.Name] == "" {
+		return
+	}
+	k := *cfg.Kubernetes
+	go func() {
+		c := FindCert(e.Name)
+		if c == nil {
+			return
+		}
+		if err := retry(func() error { return k.Publish(c) }); err != nil {
+			log.Printf("(Warning) Kubernetes Secret %s failed: %s", k.Secrets[e.Name], err)
+		}
+	}()
+}
+
+// Publish creates or updates the certificate Secret with its chain and key
+func (k Kubernetes) Publish(c *Cert) error {
+	name := k.Secrets[c.Crt.Subject.CommonName]
+	if name == "" {
+		return fmt.Errorf("%s", tr("No Secret for %s!", c.Crt.Subject.CommonName))
+	}
+	if c.Key == nil {
+		return fmt.Errorf("%s", tr("There is no key for %s!", c.Crt.Subject.CommonName))
+	}
+	crt, err := FullChainPEM(c, false)
+	if err != nil {
+		return err
+	}
+	block, err := marshalKey(c.Key)
+	if err != nil {
+		return err
+	}
+	secret := kubeSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: kubeMetadata{Name: name, Namespace: k.Namespace,
+			Labels: map[string]string{KUBE_MANAGED_LABEL: "webca"}},
+		Type: "kubernetes.io/tls",
+		Data: map[string][]byte{
+			"tls.crt": crt,
+			"tls.key": pem.EncodeToMemory(block),
+			"ca.crt":  pemCerts(Chain(c)...),
+		},
+	}
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	secrets := "/api/v1/namespaces/" + url.PathEscape(k.Namespace) + "/secrets"
+	status, err := k.call("PUT", secrets+"/"+url.PathEscape(name), body)
+	if err == nil && status == http.StatusNotFound {
+		status, err = k.call("POST", secrets, body)
+	}
+	if err == nil && (status < 200 || status > 299) {
+		err = fmt.Errorf("%s", http.StatusText(status))
+	}
+	return err
+}
+
+// call sends a request to the API server and returns the response status
+func (k Kubernetes) call(method, path string, body []byte) (int, error) {
+	server, token, ca := k.Server, k.Token, k.CA
+	if server == "" && os.Getenv(KUBE_SERVICE_HOST) != "" {
+		server = "https://" + os.Getenv(KUBE_SERVICE_HOST) + ":" + os.Getenv(KUBE_SERVICE_PORT)
+	}
+	if server == "" {
+		return 0, fmt.Errorf("%s", tr("No Kubernetes API server configured!"))
+	}
+	if token == "" {
+		data, _ := ioutil.ReadFile(KUBE_ACCOUNT_DIR + "token")
+		token = strings.TrimSpace(string(data))
+	}
+	if ca == "" {
+		data, _ := ioutil.ReadFile(KUBE_ACCOUNT_DIR + "ca.crt")
+		ca = string(data)
+	}
+	tlsConfig := &tls.Config{}
+	if ca != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(ca)) {
+			return 0, fmt.Errorf("%s", tr("Wrong Kubernetes CA certificate!"))
+		}
+	}
+	client := &http.Client{Timeout: KUBE_TIMEOUT, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	req, err := http.NewRequest(method, strings.TrimSuffix(server, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// defaultSecretName returns a valid Secret name for the certificate
+func defaultSecretName(cn string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(strings.TrimPrefix(cn, "*.")))
+	return strings.Trim(name, "-.") + "-tls"
+}
+
+// setSecret saves the name of the Secret the named certificate is published as, none if empty
+func (cfg *config) setSecret(cn, name string) error {
+	return cfg.update(func(cfg *config) error {
+		if cfg.Kubernetes == nil {
+			return fmt.Errorf("%s", tr("Kubernetes is not configured!"))
+		}
+		k := *cfg.Kubernetes
+		k.Secrets = make(map[string]string, len(cfg.Kubernetes.Secrets)+1)
+		for cert, secret := range cfg.Kubernetes.Secrets {
+			k.Secrets[cert] = secret
+		}
+		if name == "" {
+			delete(k.Secrets, cn)
+		} else {
+			k.Secrets[cn] = name
+		}
+		cfg.Kubernetes = &k
+		return nil
+	})
+}
+
+// kubernetes allows the web user to publish a certificate as a Secret, now and on every renewal
+func kubernetes(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	cfg := LoadConfig()
+	if cfg.Kubernetes == nil {
+		handleError(w, r, fmt.Errorf("%s", tr("Kubernetes is not configured!")))
+		return
+	}
+	cn := c.Crt.Subject.CommonName
+	name := cfg.Kubernetes.Secrets[cn]
+	if r.Method == "POST" {
+		if r.FormValue("stop") != "" {
+			err = cfg.setSecret(cn, "")
+		} else {
+			name = strings.TrimSpace(r.FormValue("Secret"))
+			if !secretName.MatchString(name) || len(name) > 253 {
+				err = fmt.Errorf("%s: %v", tr("Wrong Secret name!"), name)
+			}
+			if err == nil {
+				err = cfg.setSecret(cn, name)
+			}
+			if err == nil {
+				err = cfg.Kubernetes.Publish(c)
+			}
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_CONFIG, "kubernetes secret of "+cn)
+			http.Redirect(w, r, "/certControl?cert="+url.QueryEscape(cn), 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	if name == "" {
+		name = defaultSecretName(cn)
+	}
+	ps["Cert"] = c
+	ps["Secret"] = name
+	ps["Published"] = cfg.Kubernetes.Secrets[cn] != ""
+	ps["Namespace"] = cfg.Kubernetes.Namespace
+	err = templatesFor(r).ExecuteTemplate(w, "kubernetes", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,73 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKubernetesSecret(t *testing.T) {
+	inTestDir(t)
+	secrets := make(map[string]kubeSecret)
+	published := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer kube-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var s kubeSecret
+		json.NewDecoder(r.Body).Decode(&s)
+		path := "/api/v1/namespaces/certs/secrets/" + s.Metadata.Name
+		switch {
+		case r.Method == "PUT" && r.URL.Path == path && secrets[s.Metadata.Name].Type != "":
+		case r.Method == "POST" && r.URL.Path == "/api/v1/namespaces/certs/secrets":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		secrets[s.Metadata.Name] = s
+		published <- r.Method
+	}))
+	defer srv.Close()
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Kubernetes: &Kubernetes{Server: srv.URL, Token: "kube-token", Namespace: "certs",
+		CA: string(pemCerts(srv.Certificate())), Secrets: map[string]string{"kube.example.com": "kube-tls"}}}
+	ca, err := GenCACert(pkix.Name{CommonName: "KubeCA"}, ForDays(365))
+	dieOnError(t, err)
+	c, err := GenCert(ca, "kube.example.com", ForDays(30))
+	dieOnError(t, err)
+	if method := <-published; method != "POST" {
+		t.Fatalf("Secret created with %s", method)
+	}
+	s := secrets["kube-tls"]
+	if s.Type != "kubernetes.io/tls" || s.Metadata.Namespace != "certs" ||
+		!bytes.Equal(s.Data["tls.crt"], append(pemCerts(c.Crt), pemCerts(ca.Crt)...)) ||
+		!bytes.Contains(s.Data["tls.key"], []byte("PRIVATE KEY")) {
+		t.Fatalf("Unexpected Secret %+v", s)
+	}
+	renewed, err := RenewCert(c, false)
+	dieOnError(t, err)
+	if method := <-published; method != "PUT" {
+		t.Fatalf("Secret updated with %s", method)
+	}
+	if !bytes.HasPrefix(secrets["kube-tls"].Data["tls.crt"], pemCerts(renewed.Crt)) {
+		t.Fatal("Secret not updated on renewal")
+	}
+	if defaultSecretName("*.Web_Server.example.com") != "web-server.example.com-tls" {
+		t.Fatalf("Unexpected Secret name %s", defaultSecretName("*.Web_Server.example.com"))
+	}
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	before := cachedCfg.Kubernetes.Secrets
+	req := httptest.NewRequest("POST", "/kubernetes", strings.NewReader("cert=kube.example.com&stop=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	kubernetes(httptest.NewRecorder(), req)
+	if _, ok := cachedCfg.Kubernetes.Secrets["kube.example.com"]; ok || before["kube.example.com"] != "kube-tls" {
+		t.Fatalf("Wrong Secrets %v, before %v", cachedCfg.Kubernetes.Secrets, before)
+	}
+}
@@ -0,0 +1,114 @@
+package webca
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	MAX_TAGS  = 20
+	MAX_NOTES = 4096
+)
+
+// CertLabels are the tags and the notes the users attach to a certificate
+type CertLabels struct {
+	Tags  []string // e.g. env:prod or team:payments, sorted
+	Notes string
+}
+
+// tagSyntax matches the tags: a key with an optional value after a colon
+var tagSyntax = regexp.MustCompile(`^[a-z0-9_.-]+(:[a-z0-9_./-]+)?$`)
+
+// certLabels returns the labels of the certificate, none if the configuration has none
+func (cfg *config) certLabels(name string) CertLabels {
+	if cfg == nil {
+		return CertLabels{}
+	}
+	return cfg.Labels[name]
+}
+
+// certTags returns the tags of the certificate, for the templates
+func certTags(c *Cert) []string {
+	return LoadConfig().certLabels(c.Crt.Subject.CommonName).Tags
+}
+
+// parseTags reads the tags separated by commas or spaces, lower cased, sorted and without
+// duplicates
+func parseTags(s string) ([]string, error) {
+	seen := make(map[string]bool)
+	tags := make([]string, 0)
+	for _, tag := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !tagSyntax.MatchString(tag) {
+			return nil, fmt.Errorf("%s: %v", tr("Wrong tag!"), tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > MAX_TAGS {
+		return nil, fmt.Errorf("%s", tr("No more than %d tags!", MAX_TAGS))
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// hasTag tells whether or not the tags include the one searched, which matches any value of its key
+// when it has none (env matches env:prod)
+func hasTag(tags []string, search string) bool {
+	search = strings.ToLower(search)
+	for _, tag := range tags {
+		if tag == search || (!strings.Contains(search, ":") && strings.HasPrefix(tag, search+":")) {
+			return true
+		}
+	}
+	return false
+}
+
+// labels saves the tags and notes of a certificate
+func labels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	tags, err := parseTags(r.FormValue("Tags"))
+	notes := strings.TrimSpace(r.FormValue("Notes"))
+	if err == nil && len(notes) > MAX_NOTES {
+		err = fmt.Errorf("%s", ps.tr("Notes can't be longer than %d characters!", MAX_NOTES))
+	}
+	if err == nil {
+		err = LoadConfig().update(func(cfg *config) error {
+			labels := make(map[string]CertLabels, len(cfg.Labels)+1)
+			for n, l := range cfg.Labels {
+				labels[n] = l
+			}
+			if len(tags) == 0 && notes == "" {
+				delete(labels, name)
+			} else {
+				labels[name] = CertLabels{tags, notes}
+			}
+			cfg.Labels = labels
+			return nil
+		})
+	}
+	if err != nil {
+		ps["Error"] = err.Error()
+	} else {
+		auditRequest(w, r, AUDIT_CONFIG, "labels of "+name)
+	}
+	setCertControl(ps, c)
+	err = templatesFor(r).ExecuteTemplate(w, "certControl", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,63 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "LabelsCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "tagged", ForDays(30))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "plain", ForDays(30))
+	dieOnError(t, err)
+	post := func(form url.Values) string {
+		req := httptest.NewRequest("POST", "/labels", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		labels(w, req)
+		return w.Body.String()
+	}
+
+	page := post(url.Values{"cert": {"tagged"}, "Tags": {"env:prod, Team:Payments env:prod"},
+		"Notes": {"Owned by payments"}})
+	if l := cachedCfg.Labels["tagged"]; strings.Join(l.Tags, " ") != "env:prod team:payments" ||
+		l.Notes != "Owned by payments" {
+		t.Fatalf("Labels not saved: %v", l)
+	}
+	if !strings.Contains(page, "Owned by payments") || !strings.Contains(page, "?Tag=team%3apayments") {
+		t.Fatalf("Labels not shown:\n%s", page)
+	}
+	if page := post(url.Values{"cert": {"tagged"}, "Tags": {"what?"}}); !strings.Contains(page, "Wrong tag!") ||
+		len(cachedCfg.Labels["tagged"].Tags) != 2 {
+		t.Fatal("Wrong tag accepted")
+	}
+	for tag, want := range map[string]int{"env": 1, "env:prod": 1, "ENV:PROD": 1, "env:dev": 0, "en": 0} {
+		if found := FindCerts(CertFilter{Tag: tag}); len(found) != want {
+			t.Errorf("Tag %s found %d certificates", tag, len(found))
+		}
+	}
+	for _, e := range Inventory(CertFilter{}) {
+		if (e.Name == "tagged") != (len(e.Tags) == 2 && e.Notes != "") {
+			t.Errorf("Wrong exported labels %v", e)
+		}
+	}
+	w := httptest.NewRecorder()
+	labels(w, httptest.NewRequest("GET", "/labels?cert=tagged&Tags=&Notes=", nil))
+	if _, ok := cachedCfg.Labels["tagged"]; !ok || w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Labels cleared on a GET: %d", w.Code)
+	}
+	post(url.Values{"cert": {"tagged"}, "Tags": {""}, "Notes": {" "}})
+	if _, ok := cachedCfg.Labels["tagged"]; ok {
+		t.Fatal("Labels not cleared")
+	}
+}
@@ -0,0 +1,287 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DOWNLOAD_LINK_PATH      = "/download"
+	DOWNLOAD_LINK_HOURS     = 24     // hours a download link is valid by default
+	DOWNLOAD_LINK_MAX_HOURS = 7 * 24 // hours a download link is valid at most
+)
+
+// DownloadLinkFormats are the bundles with the private key a download link may deliver
+var DownloadLinkFormats = []string{"zip", "pem"}
+
+// DownloadLink lets whoever has its URL download a certificate with its key, once
+type DownloadLink struct {
+	ID      string // shown to the operators to revoke it
+	Hash    string // of the secret token of the URL
+	Cert    string
+	Format  string // one of DownloadLinkFormats
+	By      string // the operator that created it
+	Expires time.Time
+}
+
+// LinkRequest asks the API for a one-time download link of a certificate
+type LinkRequest struct {
+	Format string `json:"format"` // zip if empty
+	Hours  int    `json:"hours"`  // DOWNLOAD_LINK_HOURS if 0
+}
+
+// LinkReply is the one-time download link created by the API
+type LinkReply struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// download links lock, so that a link can't be used twice at the same time
+var sdownloadLinks sync.Mutex
+
+// validLinkFormat tells whether or not the format is one of DownloadLinkFormats
+func validLinkFormat(format string) bool {
+	for _, f := range DownloadLinkFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadLinkURL returns the URL of the download link with the token, base is the WebCA URL
+func downloadLinkURL(base, token string) string {
+	return base + DOWNLOAD_LINK_PATH + "?" + url.Values{"t": {token}}.Encode()
+}
+
+// NewDownloadLink creates a link valid for the hours to download the certificate with its key in
+// the format, returning its token in clear, the only time it is available
+func (cfg *config) NewDownloadLink(cert, format, by string, hours int) (string, *DownloadLink, error) {
+	c, err := FindCertOrFail(cert)
+	if err != nil {
+		return "", nil, err
+	}
+	if c.Key == nil {
+		return "", nil, fmt.Errorf("%s", tr("There is no key for %s!", cert))
+	}
+	if !cfg.plainKeysAllowed() {
+		return "", nil, fmt.Errorf("%s", tr("Unencrypted private key downloads are disabled!"))
+	}
+	if format == "" {
+		format = DownloadLinkFormats[0]
+	}
+	if !validLinkFormat(format) {
+		return "", nil, fmt.Errorf("%s: %v", tr("Wrong format!"), format)
+	}
+	if hours == 0 {
+		hours = DOWNLOAD_LINK_HOURS
+	}
+	if hours < 0 || hours > DOWNLOAD_LINK_MAX_HOURS {
+		return "", nil, fmt.Errorf("%s", tr("A download link is valid from 1 to %d hours!", DOWNLOAD_LINK_MAX_HOURS))
+	}
+	secret := make([]byte, TOKEN_BYTES)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	id, err := genId()
+	if err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(secret)
+	link := DownloadLink{ID: id, Hash: hashToken(token), Cert: cert, Format: format, By: by,
+		Expires: time.Now().Add(time.Duration(hours) * time.Hour)}
+	sdownloadLinks.Lock()
+	defer sdownloadLinks.Unlock()
+	return token, &link, cfg.update(func(cfg *config) error {
+		cfg.DownloadLinks = append(cfg.pendingDownloadLinks(), link) // a new slice
+		return nil
+	})
+}
+
+// pendingDownloadLinks returns the download links that did not expire
+func (cfg *config) pendingDownloadLinks() []DownloadLink {
+	pending := make([]DownloadLink, 0)
+	for _, l := range cfg.DownloadLinks {
+		if time.Now().Before(l.Expires) {
+			pending = append(pending, l)
+		}
+	}
+	return pending
+}
+
+// certDownloadLinks returns the pending download links of the certificate
+func (cfg *config) certDownloadLinks(cert string) []DownloadLink {
+	links := make([]DownloadLink, 0)
+	for _, l := range cfg.pendingDownloadLinks() {
+		if l.Cert == cert {
+			links = append(links, l)
+		}
+	}
+	return links
+}
+
+// downloadLink returns the pending download link with the token, or nil
+func (cfg *config) downloadLink(token string) *DownloadLink {
+	if cfg == nil || token == "" {
+		return nil
+	}
+	hash := hashToken(token)
+	for _, l := range cfg.pendingDownloadLinks() {
+		if subtle.ConstantTimeCompare([]byte(l.Hash), []byte(hash)) == 1 {
+			return &l
+		}
+	}
+	return nil
+}
+
+// dropDownloadLink removes the download link of the named certificate with the id, telling whether
+// or not it was there
+func (cfg *config) dropDownloadLink(cert, id string) (bool, error) {
+	found := false
+	err := cfg.update(func(cfg *config) error {
+		kept := make([]DownloadLink, 0, len(cfg.DownloadLinks))
+		for _, l := range cfg.DownloadLinks {
+			if l.ID == id && l.Cert == cert {
+				found = true
+			} else {
+				kept = append(kept, l)
+			}
+		}
+		cfg.DownloadLinks = kept
+		return nil
+	})
+	return found, err
+}
+
+// RevokeDownloadLink invalidates the download link of the named certificate with the id before
+// it is used
+func (cfg *config) RevokeDownloadLink(cert, id string) error {
+	sdownloadLinks.Lock()
+	defer sdownloadLinks.Unlock()
+	found, err := cfg.dropDownloadLink(cert, id)
+	if err == nil && !found {
+		err = fmt.Errorf("%s", tr("Download link not found!"))
+	}
+	return err
+}
+
+// useDownloadLink invalidates the download link with the token, returning it if it was valid
+func (cfg *config) useDownloadLink(token string) (*DownloadLink, error) {
+	sdownloadLinks.Lock()
+	defer sdownloadLinks.Unlock()
+	l := cfg.downloadLink(token)
+	if l == nil {
+		return nil, fmt.Errorf("%s", tr("This download link is not valid, was used or has expired!"))
+	}
+	if _, err := cfg.dropDownloadLink(l.Cert, l.ID); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// linkedDownload returns the file name, content type and contents the download link delivers
+func linkedDownload(l *DownloadLink) (string, string, []byte, error) {
+	c, err := FindCertOrFail(l.Cert)
+	if err != nil {
+		return "", "", nil, err
+	}
+	name := filename(c.Crt.Subject.CommonName)
+	if l.Format == "pem" {
+		data, err := FullChainPEM(c, true)
+		return name + ".bundle.pem", "application/x-pem-file", data, err
+	}
+	data, err := CertPackage(c, true)
+	return name + ".zip", "application/zip", data, err
+}
+
+// downloadLinks allows the operators to create the one-time download links of a certificate and
+// to revoke them
+func downloadLinks(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	if !keyAllowed(w, r, name) {
+		return
+	}
+	cfg := LoadConfig()
+	if r.Method == "POST" {
+		switch action := r.FormValue("action"); action {
+		case "create":
+			var hours int
+			if hours, err = strconv.Atoi(strings.TrimSpace(r.FormValue("Hours"))); err != nil {
+				err = fmt.Errorf("%s: %v", tr("Wrong hours!"), r.FormValue("Hours"))
+				break
+			}
+			var token string
+			var l *DownloadLink
+			if token, l, err = cfg.NewDownloadLink(name, r.FormValue("Format"), requestUser(w, r).Username, hours); err == nil {
+				auditRequest(w, r, AUDIT_CONFIG, "download link "+l.ID+" of "+certObject(c.Crt))
+				ps["NewLink"] = downloadLinkURL(webBase(r), token)
+			}
+		case "revoke":
+			id := r.FormValue("id")
+			if err = cfg.RevokeDownloadLink(name, id); err == nil {
+				auditRequest(w, r, AUDIT_CONFIG, "download link "+id+" of "+certObject(c.Crt)+" revoked")
+				http.Redirect(w, r, "/downloadLinks?cert="+url.QueryEscape(name), http.StatusFound)
+				return
+			}
+		default:
+			err = fmt.Errorf("%s", tr("Unknown action %s!", action))
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+		}
+	}
+	ps["Cert"] = c
+	ps["Links"] = cfg.certDownloadLinks(name)
+	ps["Formats"] = DownloadLinkFormats
+	ps["Hours"] = DOWNLOAD_LINK_HOURS
+	ps["PlainKeys"] = cfg.plainKeysAllowed()
+	err = templatesFor(r).ExecuteTemplate(w, "downloadLinks", ps)
+	handleError(w, r, err)
+}
+
+// downloadByLink lets anyone with a valid link download its certificate and key: a GET shows what
+// the link delivers, so that link previews don't use it, and a POST downloads it
+func downloadByLink(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	token := r.FormValue("t")
+	if r.Method != "POST" {
+		l := cfg.downloadLink(token)
+		if l == nil {
+			http.Error(w, tr("This download link is not valid, was used or has expired!"), http.StatusNotFound)
+			return
+		}
+		ps := newPageStatus(r)
+		ps["Link"] = l
+		ps["Token"] = token
+		err := templatesFor(r).ExecuteTemplate(w, "downloadLink", ps)
+		handleError(w, r, err)
+		return
+	}
+	l, err := cfg.useDownloadLink(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	name, contentType, data, err := linkedDownload(l)
+	if handleError(w, r, err) {
+		return
+	}
+	audit(AUDIT_KEY_DOWNLOAD, "", remoteAddr(r), l.Cert+" link "+l.ID+" of "+l.By)
+	download(w, name, contentType, data)
+}
@@ -0,0 +1,68 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDownloadLinks(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"otto": {Username: "otto", Role: ROLE_OPERATOR}},
+		Owners: map[string]string{"linked.example.com": "otto"}}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "LinkCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "linked.example.com", ForDays(30))
+	dieOnError(t, err)
+	if _, _, err := cachedCfg.NewDownloadLink("linked.example.com", "pem", "otto", DOWNLOAD_LINK_MAX_HOURS+1); err == nil {
+		t.Error("Download link valid for too long")
+	}
+	token, err := cachedCfg.NewAPIToken("otto", "ci")
+	dieOnError(t, err)
+	req := httptest.NewRequest("POST", API_PREFIX+"certs/linked.example.com/link", strings.NewReader(`{"format": "pem"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	apiAccess(api).ServeHTTP(w, req)
+	var reply LinkReply
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &reply) != nil ||
+		!strings.Contains(reply.URL, DOWNLOAD_LINK_PATH+"?t=") {
+		t.Fatalf("Download link not created: %d %s", w.Code, w.Body.String())
+	}
+	fetch := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		downloadByLink(w, httptest.NewRequest(method, reply.URL, nil))
+		return w
+	}
+	if w = fetch("GET"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "linked.example.com") {
+		t.Fatalf("Download link page not shown: %d", w.Code)
+	}
+	w = fetch("POST")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "BEGIN CERTIFICATE") ||
+		!strings.Contains(w.Body.String(), "PRIVATE KEY") {
+		t.Fatalf("Certificate and key not downloaded: %d %s", w.Code, w.Body.String())
+	}
+	if w = fetch("POST"); w.Code != http.StatusNotFound {
+		t.Errorf("Download link used twice: %d", w.Code)
+	}
+	if w = fetch("GET"); w.Code != http.StatusNotFound {
+		t.Errorf("Used download link still shown: %d", w.Code)
+	}
+	_, l, err := cachedCfg.NewDownloadLink("linked.example.com", "", "otto", 1)
+	dieOnError(t, err)
+	if cachedCfg.RevokeDownloadLink("other.example.com", l.ID) == nil {
+		t.Error("Download link revoked through another certificate")
+	}
+	dieOnError(t, cachedCfg.RevokeDownloadLink("linked.example.com", l.ID))
+	if len(cachedCfg.certDownloadLinks("linked.example.com")) != 0 {
+		t.Error("Download link not revoked")
+	}
+	cachedCfg.NoPlainKeys = true
+	if _, _, err := cachedCfg.NewDownloadLink("linked.example.com", "zip", "otto", 1); err == nil {
+		t.Error("Download link created with the unencrypted key downloads disabled")
+	}
+}
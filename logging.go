@@ -0,0 +1,141 @@
+package webca
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// log levels, the lines being tagged (Debug), (Warning) or (Error) unless they are just informative
+const (
+	LOG_DEBUG   = "debug"
+	LOG_INFO    = "info"
+	LOG_WARNING = "warning"
+	LOG_ERROR   = "error"
+)
+
+// log formats
+const (
+	LOG_TEXT = "text" // key=value pairs
+	LOG_JSON = "json" // one object per line
+)
+
+// logLevels are the log levels from the lowest, with the tag of their lines
+var logLevels = []struct {
+	name, tag string
+	level     slog.Level
+}{
+	{LOG_DEBUG, "(Debug)", slog.LevelDebug}, {LOG_INFO, "", slog.LevelInfo},
+	{LOG_WARNING, "(Warning)", slog.LevelWarn}, {LOG_ERROR, "(Error)", slog.LevelError},
+}
+
+// logger writes the structured log, which gets the lines of the standard one once the options are
+// loaded
+var logger = slog.Default()
+
+// logLevel returns the index of the named level in logLevels, LOG_INFO's if empty and -1 if unknown
+func logLevel(name string) int {
+	if name == "" {
+		name = LOG_INFO
+	}
+	for i, l := range logLevels {
+		if strings.EqualFold(l.name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// newLogger returns the logger writing to w the records from the named level on in the format
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	i := logLevel(level)
+	if i < 0 {
+		return nil, fmt.Errorf("Wrong log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: logLevels[i].level}
+	switch strings.ToLower(format) {
+	case "", LOG_TEXT:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LOG_JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("Wrong log format %q", format)
+}
+
+// useLogger makes l the logger of the app, the standard log lines included
+func useLogger(l *slog.Logger) {
+	logger = l
+	log.SetFlags(0) // the records have their time
+	log.SetOutput(logWriter{l})
+}
+
+// logWriter turns the lines of the standard log into records at the level of their tag
+type logWriter struct {
+	l *slog.Logger
+}
+
+func (lw logWriter) Write(p []byte) (int, error) {
+	msg, level := strings.TrimSpace(string(p)), slog.LevelInfo
+	for _, l := range logLevels {
+		if l.tag != "" && strings.Contains(msg, l.tag) {
+			msg, level = strings.TrimSpace(strings.Replace(msg, l.tag, "", 1)), l.level
+		}
+	}
+	lw.l.Log(context.Background(), level, msg)
+	return len(p), nil
+}
+
+// requestLog keeps the fields of a request logged once it is served
+type requestLog struct {
+	http.ResponseWriter
+	status int
+	user   string
+}
+
+// requestLogKey is the context key of the requestLog
+type requestLogKey struct{}
+
+func (rl *requestLog) WriteHeader(code int) {
+	if rl.status == 0 {
+		rl.status = code
+	}
+	rl.ResponseWriter.WriteHeader(code)
+}
+
+func (rl *requestLog) Write(p []byte) (int, error) {
+	if rl.status == 0 {
+		rl.status = http.StatusOK
+	}
+	return rl.ResponseWriter.Write(p)
+}
+
+// Unwrap gives http.ResponseController the original writer
+func (rl *requestLog) Unwrap() http.ResponseWriter {
+	return rl.ResponseWriter
+}
+
+// logUser adds the user to the record of the request, if it is logged
+func logUser(r *http.Request, username string) {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		rl.user = username
+	}
+}
+
+// logRequests logs every request served by h with its user, path and status
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, rl := time.Now(), &requestLog{ResponseWriter: w}
+		h.ServeHTTP(rl, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+		if rl.status == 0 {
+			rl.status = http.StatusOK
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request", slog.String("method", r.Method),
+			slog.String("path", r.URL.Path), slog.Int("status", rl.status), slog.String("user", rl.user),
+			slog.String("addr", remoteAddr(r)), slog.Duration("duration", time.Since(start)))
+	})
+}
@@ -0,0 +1,129 @@
+package webca
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// DEFAULT_NOTICE_SUBJECT is the subject of the expiry emails unless overridden
+	DEFAULT_NOTICE_SUBJECT = `{{tr "%d certificates about to expire" (len .Certs)}}`
+	// DEFAULT_NOTICE_BODY is the body of the expiry emails unless overridden
+	DEFAULT_NOTICE_BODY = `{{tr "The following certificates are about to expire:"}}
+
+{{range .Certs}}  {{.CN}} ({{.Expires}}) - {{tr "%d days left" .DaysLeft}}{{with .Link}}
+    {{.}}{{end}}
+{{end}}
+{{tr "Renew them at your WebCA."}}{{with .WebURL}} {{.}}{{end}}`
+)
+
+// NoticeMail is what the expiry email templates are executed with
+type NoticeMail struct {
+	Certs  []NoticeCert
+	WebURL string // of the WebCA, empty if not configured
+}
+
+// NoticeCert is a certificate about to expire, as seen by the expiry email templates
+type NoticeCert struct {
+	CN       string
+	Expires  string // date and time of expiry
+	Days     int    // notification threshold reached
+	DaysLeft int
+	Serial   string
+	Link     string // page of the certificate at the WebCA, empty without WebURL
+	Download string // PEM of the certificate, empty without WebURL
+}
+
+// linkedTo returns the certificate with its links at the WebCA URL, none if it is empty
+func (nc NoticeCert) linkedTo(webURL string) NoticeCert {
+	if webURL != "" {
+		nc.Link = webURL + "/certControl?" + url.Values{"cert": {nc.CN}}.Encode()
+		nc.Download = webURL + "/cert/" + url.PathEscape(filename(nc.CN)) + CERT_SUFFIX
+	}
+	return nc
+}
+
+// noticeMail returns the expiry email variables of the notices with links to the WebCA URL
+func noticeMail(notices []ExpiryNotice, webURL string) NoticeMail {
+	webURL = strings.TrimRight(webURL, "/")
+	m := NoticeMail{Certs: make([]NoticeCert, 0, len(notices)), WebURL: webURL}
+	for _, n := range notices {
+		name := n.Cert.Crt.Subject.CommonName
+		nc := NoticeCert{CN: name, Expires: n.Cert.Crt.NotAfter.Format(MYFMT + " 15:04"),
+			Days: n.Days, DaysLeft: n.DaysLeft, Serial: serialKey(n.Cert.Crt.SerialNumber)}
+		m.Certs = append(m.Certs, nc.linkedTo(webURL))
+	}
+	return m
+}
+
+// sampleNoticeMail returns the expiry email variables of made up certificates, for the previews
+func sampleNoticeMail(webURL string) NoticeMail {
+	now := time.Now()
+	webURL = strings.TrimRight(webURL, "/")
+	m := NoticeMail{WebURL: webURL}
+	for _, days := range []int{14, 7} {
+		name := fmt.Sprintf("www%d.example.com", days)
+		nc := NoticeCert{CN: name, Expires: now.AddDate(0, 0, days).Format(MYFMT + " 15:04"),
+			Days: days, DaysLeft: days, Serial: fmt.Sprintf("%x", days)}
+		m.Certs = append(m.Certs, nc.linkedTo(webURL))
+	}
+	return m
+}
+
+// execMailTemplate executes the email template text with the variables
+func execMailTemplate(name, text string, vars interface{}) (string, error) {
+	t, err := template.New(name).Funcs(template.FuncMap{"tr": tr, "join": strings.Join}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// noticeTemplates returns the subject and body templates of the expiry emails, the default ones
+// unless overridden
+func (n Notifications) noticeTemplates() (string, string) {
+	subject, body := n.Subject, n.Body
+	if strings.TrimSpace(subject) == "" {
+		subject = DEFAULT_NOTICE_SUBJECT
+	}
+	if strings.TrimSpace(body) == "" {
+		body = DEFAULT_NOTICE_BODY
+	}
+	return subject, body
+}
+
+// renderNotice returns the subject, in a single line, and body of the expiry email with the
+// variables
+func (n Notifications) renderNotice(m NoticeMail) (string, string, error) {
+	subjectText, bodyText := n.noticeTemplates()
+	subject, err := execMailTemplate("subject", subjectText, m)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", tr("Wrong subject template!"), err)
+	}
+	body, err := execMailTemplate("body", bodyText, m)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", tr("Wrong body template!"), err)
+	}
+	return strings.Join(strings.Fields(subject), " "), body, nil
+}
+
+// noticeEmail returns the subject and body of the expiry email of the notices, with the default
+// templates if the overridden ones fail
+func (n Notifications) noticeEmail(notices []ExpiryNotice) (string, string) {
+	m := noticeMail(notices, n.WebURL)
+	subject, body, err := n.renderNotice(m)
+	if err != nil {
+		log.Printf("(Warning) Expiry email templates failed, using the default ones: %s", err)
+		subject, body, _ = Notifications{}.renderNotice(m)
+	}
+	return subject, body
+}
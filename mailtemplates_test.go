@@ -0,0 +1,71 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNoticeTemplates(t *testing.T) {
+	inTestDir(t)
+	var subjects, bodies []string
+	defer func(saved func(m *Mailer, to, subject, body string) error) { sendMail = saved }(sendMail)
+	sendMail = func(m *Mailer, to, subject, body string) error {
+		subjects, bodies = append(subjects, subject), append(bodies, body)
+		return nil
+	}
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Mailer: &Mailer{Server: "smtp.example.com"},
+		Users: map[string]User{"admin": {Username: "admin", Email: "admin@example.com"}},
+		Notifications: &Notifications{Subject: "Expiring:{{range .Certs}}\n{{.CN}}{{end}}",
+			Body: "{{range .Certs}}{{.CN}} in {{.DaysLeft}} days: {{.Download}}\n{{end}}", WebURL: "https://ca.example.com/webca"}}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "TemplatedCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "soon.example.com", ForDays(10))
+	dieOnError(t, err)
+	dieOnError(t, NotifyExpiring(time.Now()))
+	if len(bodies) != 1 || subjects[0] != "Expiring: soon.example.com" ||
+		bodies[0] != "soon.example.com in 9 days: https://ca.example.com/webca/cert/soon.example.com.pem\n" {
+		t.Fatalf("Unexpected templated notification: %q %q", subjects, bodies)
+	}
+
+	subject, body, err := Notifications{}.renderNotice(sampleNoticeMail(""))
+	dieOnError(t, err)
+	if subject != "2 certificates about to expire" || !strings.Contains(body, "www7.example.com") ||
+		!strings.HasSuffix(body, "Renew them at your WebCA.") {
+		t.Fatalf("Unexpected default notification: %q %q", subject, body)
+	}
+	for _, form := range []url.Values{{"Body": {"{{range .Certs}}"}}, {"Subject": {"{{.Nothing}}"}}, {"WebURL": {"ca.example.com"}}} {
+		req := httptest.NewRequest("POST", "/notifications", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if _, err := readNotifications(req, Notifications{}); err == nil {
+			t.Errorf("Wrong notification settings accepted: %v", form)
+		}
+	}
+
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	form := url.Values{"Days": {"30"}, "Subject": {DEFAULT_NOTICE_SUBJECT}, "Body": {"Hello {{len .Certs}}"}, "action": {"preview"}}
+	req := httptest.NewRequest("POST", "/notifications", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	notifications(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Hello 2") {
+		t.Fatalf("No preview: %d %s", w.Code, w.Body)
+	}
+	if cachedCfg.Notifications.Body == "Hello {{len .Certs}}" {
+		t.Fatal("Previewed templates saved")
+	}
+	form.Del("action")
+	req = httptest.NewRequest("POST", "/notifications", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	notifications(httptest.NewRecorder(), req)
+	if n := cachedCfg.Notifications; n.Body != "Hello {{len .Certs}}" || n.Subject != "" {
+		t.Fatalf("Templates not saved: %+v", n)
+	}
+}
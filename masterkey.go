@@ -0,0 +1,176 @@
+package webca
+
+import (
+	"crypto"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	MASTER_KEY         = "WEBCA_MASTER_KEY"     // environment variable with the master passphrase
+	MASTER_KEY_FILE    = "WEBCA_MASTER_KEYFILE" // environment variable naming a file holding it
+	MASTER_KEY_COMMAND = "WEBCA_MASTER_KEY_CMD" // environment variable with a command printing it, e.g. a KMS decryption
+)
+
+// the master passphrase the stored private keys are encrypted with, none keeps them in plain PEM
+var (
+	smaster   sync.RWMutex
+	masterKey string
+)
+
+// SetMasterKey sets the master passphrase, so the private keys are stored encrypted from then on
+func SetMasterKey(passphrase string) {
+	smaster.Lock()
+	defer smaster.Unlock()
+	masterKey = passphrase
+}
+
+// LoadMasterKey sets the master passphrase from the environment: given, read from a keyfile or
+// printed by a command. Without any the private keys are stored in plain PEM
+func LoadMasterKey() error {
+	passphrase := os.Getenv(MASTER_KEY)
+	if file := os.Getenv(MASTER_KEY_FILE); file != "" && passphrase == "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("Could not read the master key file %s: %s", file, err)
+		}
+		passphrase = strings.TrimSpace(string(data))
+	}
+	if command := os.Getenv(MASTER_KEY_COMMAND); command != "" && passphrase == "" {
+		out, err := exec.Command("/bin/sh", "-c", command).Output()
+		if err != nil {
+			return fmt.Errorf("Could not get the master key from %q: %s", command, err)
+		}
+		passphrase = strings.TrimSpace(string(out))
+	}
+	SetMasterKey(passphrase)
+	return nil
+}
+
+// keyReference is a signer whose private key is kept out of webca, in an HSM or a cloud KMS, only
+// a reference to it being stored
+type keyReference interface {
+	crypto.Signer
+	reference() (*pem.Block, error)
+}
+
+// sealKey returns the PEM block to store the private key with, encrypted with the master key if any, or
+// the reference of a key kept out of webca
+func sealKey(key crypto.Signer) (*pem.Block, error) {
+	if s, ok := key.(keyReference); ok {
+		return s.reference()
+	}
+	smaster.RLock()
+	passphrase := masterKey
+	smaster.RUnlock()
+	if passphrase == "" {
+		return marshalKey(key)
+	}
+	return EncryptKey(key, passphrase)
+}
+
+// openKey parses the stored private key, decrypting it with the master key if it is encrypted, or
+// returns the signer of the key kept out of webca
+func openKey(b *pem.Block) (crypto.Signer, error) {
+	switch b.Type {
+	case PKCS11_KEY_TYPE:
+		return hsmKey(b)
+	case KMS_KEY_TYPE:
+		s, err := kmsRef(b)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case ENCRYPTED_KEY_TYPE:
+	default:
+		return parseKey(b)
+	}
+	smaster.RLock()
+	passphrase := masterKey
+	smaster.RUnlock()
+	if passphrase == "" {
+		return nil, fmt.Errorf("%s", tr("The private key is encrypted but no master key was given!"))
+	}
+	return DecryptKey(b, passphrase)
+}
+
+// plainKey returns the stored private key file as a plain PEM, for its downloads
+func plainKey(data []byte) ([]byte, error) {
+	b, _ := pem.Decode(data)
+	if b == nil {
+		return nil, fmt.Errorf("%s", tr("No private key found!"))
+	}
+	if b.Type == PKCS11_KEY_TYPE {
+		return nil, fmt.Errorf("%s", tr("The private key is kept in the HSM!"))
+	} else if b.Type == KMS_KEY_TYPE {
+		return nil, fmt.Errorf("%s", tr("The private key is kept in the KMS!"))
+	} else if b.Type != ENCRYPTED_KEY_TYPE {
+		return data, nil
+	}
+	key, err := openKey(b)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = marshalKey(key); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(b), nil
+}
+
+// EncryptStoredKeys encrypts with the master key the private keys still stored in plain PEM,
+// current and archived, all or none, and returns how many it did
+func EncryptStoredKeys() (int, error) {
+	smaster.RLock()
+	passphrase := masterKey
+	smaster.RUnlock()
+	if passphrase == "" {
+		return 0, fmt.Errorf("%s", tr("No master key was given!"))
+	}
+	count := 0
+	err := storage.Tx(func(tx Storage) error {
+		for _, dir := range []string{"", ARCHIVE_DIR} {
+			names, err := tx.List(dir)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if !strings.HasSuffix(name, KEY_SUFFIX) {
+					continue
+				}
+				name = path.Join(dir, name)
+				data, err := tx.Get(name)
+				if err != nil {
+					return err
+				}
+				b, _ := pem.Decode(data)
+				if b == nil || b.Type == ENCRYPTED_KEY_TYPE || b.Type == PKCS11_KEY_TYPE || b.Type == KMS_KEY_TYPE {
+					continue
+				}
+				key, err := parseKey(b)
+				if err != nil {
+					return fmt.Errorf("Failed to parse key %s: %s", name, err)
+				}
+				if b, err = EncryptKey(key, passphrase); err != nil {
+					return err
+				}
+				if err := tx.Put(name, pem.EncodeToMemory(b), true); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Encrypted %d private keys with the master key", count)
+	return count, nil
+}
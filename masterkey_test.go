@@ -0,0 +1,50 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestMasterKey(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *Certree) { certree = saved }(certree)
+	defer SetMasterKey("")
+	certree = nil
+	plain, err := GenCACert(pkix.Name{CommonName: "PlainCA"}, ForDays(365))
+	dieOnError(t, err)
+	SetMasterKey("Master-passphrase")
+	ca, err := GenCACert(pkix.Name{CommonName: "SealedCA"}, ForDays(365))
+	dieOnError(t, err)
+	stored, err := storage.Get(keyFile(*ca))
+	dieOnError(t, err)
+	if b, _ := pem.Decode(stored); b == nil || b.Type != ENCRYPTED_KEY_TYPE {
+		t.Fatal("The private key was stored in plain")
+	}
+	certree = nil
+	if c := FindCert("SealedCA"); c == nil || c.Key == nil || !sameKey(c.Key, ca.Key) {
+		t.Fatal("The encrypted key was not loaded")
+	}
+	data, err := ReadCertKey(ca)
+	dieOnError(t, err)
+	if b, _ := pem.Decode(data); b == nil || b.Type == ENCRYPTED_KEY_TYPE {
+		t.Error("The key download is not in plain")
+	}
+
+	n, err := EncryptStoredKeys()
+	dieOnError(t, err)
+	if stored, _ = storage.Get(keyFile(*plain)); n != 1 || !strings.Contains(string(stored), ENCRYPTED_KEY_TYPE) {
+		t.Fatalf("The plain key was not migrated: %d", n)
+	}
+	SetMasterKey("")
+	certree = nil
+	if c := FindCert("PlainCA"); c != nil {
+		t.Error("An encrypted key was loaded without the master key")
+	}
+	SetMasterKey("Master-passphrase")
+	certree = nil
+	if c := FindCert("PlainCA"); c == nil || !sameKey(c.Key, plain.Key) {
+		t.Error("The migrated key was not loaded")
+	}
+}
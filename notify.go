@@ -0,0 +1,451 @@
+package webca
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCA_NOTIFIED = ".webca.notified"
+	NOTIFY_PERIOD  = 24 * time.Hour
+)
+
+// DEFAULT_NOTIFY_DAYS are the days before expiry when notifications are sent by default
+var DEFAULT_NOTIFY_DAYS = []int{30, 14, 7, 1}
+
+// Notifications configures the expiry notification emails
+type Notifications struct {
+	Recipients []string              // empty means all users
+	Days       []int                 // days before expiry when to notify, in any order
+	OptOut     map[string]bool       // certificate names not to notify about
+	Subject    string                // template of the email subjects, DEFAULT_NOTICE_SUBJECT if empty
+	Body       string                // template of the email bodies, DEFAULT_NOTICE_BODY if empty
+	WebURL     string                // the WebCA is reached at, for the links of the emails, none if empty
+	PerCert    map[string]CertNotify // by certificate name, those of a CA apply to the certificates below
+}
+
+// CertNotify are the expiry notifications of a certificate, or of those below a CA, overriding
+// the general ones when not empty
+type CertNotify struct {
+	Recipients []string
+	Days       []int // days before expiry when to notify, in any order
+}
+
+// ExpiryNotice is a certificate about to expire to be notified
+type ExpiryNotice struct {
+	Cert     *Cert
+	Days     int // notification threshold reached
+	DaysLeft int
+}
+
+// notifiedIndex remembers the lowest threshold already notified for each certificate serial
+type notifiedIndex struct {
+	Serials map[string]int
+	Sent    map[string]bool // recipients and channels already notified of the thresholds not done yet
+}
+
+// notification state lock
+var snotify sync.Mutex
+
+// sendMail sends an email through the mailer (replaceable for testing)
+var sendMail = func(m *Mailer, to, subject, body string) error {
+	return m.SendMail(to, subject, body)
+}
+
+// ScheduleNotifications checks for expiring certificates in the background now and daily
+func ScheduleNotifications() {
+	go func() {
+		for {
+			if err := NotifyExpiring(time.Now()); err != nil {
+				log.Printf("(Warning) Expiry notifications failed: %s", err)
+			}
+			time.Sleep(NOTIFY_PERIOD)
+		}
+	}()
+}
+
+// NotifyExpiring emails the configured recipients and tells the inbox about the certificates
+// reaching a notification threshold since last time
+func NotifyExpiring(now time.Time) error {
+	snotify.Lock()
+	defer snotify.Unlock()
+	cfg := LoadConfig()
+	if cfg == nil {
+		return nil
+	}
+	mail := cfg.Mailer != nil && cfg.Mailer.Server != ""
+	idx, err := loadNotified()
+	if err != nil {
+		return err
+	}
+	notices := dueNotices(cfg.getNotifications(), idx, now)
+	if len(notices) == 0 {
+		return nil
+	}
+	due := make(map[string]bool, len(notices))
+	for _, n := range notices {
+		due[notifiedKey(n, "")] = true
+	}
+	for key := range idx.Sent {
+		if parts := strings.SplitN(key, "/", 3); len(parts) < 3 || !due[parts[0]+"/"+parts[1]+"/"] {
+			delete(idx.Sent, key) // the threshold is no longer due, e.g. the certificate was renewed
+		}
+	}
+	var errs []string
+	if mail {
+		byRecipient := make(map[string][]ExpiryNotice)
+		for _, n := range notices {
+			for _, to := range cfg.certRecipients(n.Cert) {
+				if !idx.Sent[notifiedKey(n, "mail:"+to)] {
+					byRecipient[to] = append(byRecipient[to], n)
+				}
+			}
+		}
+		recipients := make([]string, 0, len(byRecipient))
+		for to := range byRecipient {
+			recipients = append(recipients, to)
+		}
+		sort.Strings(recipients)
+		for _, to := range recipients {
+			subject, body := cfg.getNotifications().noticeEmail(byRecipient[to])
+			if err := sendMail(cfg.Mailer, to, subject, body); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", to, err))
+			} else {
+				idx.sent(byRecipient[to], "mail:"+to)
+			}
+		}
+	}
+	if err := chatExpiring(cfg, idx, notices); err != nil {
+		errs = append(errs, err.Error())
+	}
+	inboxExpiring(cfg, idx, notices)
+	if len(errs) > 0 {
+		// what was sent is kept for the next attempt to send only the rest
+		if err := idx.save(); err != nil {
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	for _, n := range notices {
+		idx.Serials[serialKey(n.Cert.Crt.SerialNumber)] = n.Days
+	}
+	idx.Sent = make(map[string]bool)
+	return idx.save()
+}
+
+// notifiedKey identifies the notice of a threshold sent to a recipient or channel
+func notifiedKey(n ExpiryNotice, to string) string {
+	return fmt.Sprintf("%s/%d/%s", serialKey(n.Cert.Crt.SerialNumber), n.Days, to)
+}
+
+// pending returns the notices not sent yet to the recipient or channel
+func (idx *notifiedIndex) pending(notices []ExpiryNotice, to string) []ExpiryNotice {
+	pending := make([]ExpiryNotice, 0, len(notices))
+	for _, n := range notices {
+		if !idx.Sent[notifiedKey(n, to)] {
+			pending = append(pending, n)
+		}
+	}
+	return pending
+}
+
+// sent records the notices as sent to the recipient or channel
+func (idx *notifiedIndex) sent(notices []ExpiryNotice, to string) {
+	for _, n := range notices {
+		idx.Sent[notifiedKey(n, to)] = true
+	}
+}
+
+// dueNotices returns the certificates that reached a new notification threshold
+func dueNotices(n Notifications, idx *notifiedIndex, now time.Time) []ExpiryNotice {
+	notices := make([]ExpiryNotice, 0)
+	all := append([]int{}, n.Days...)
+	for _, cn := range n.PerCert {
+		all = append(all, cn.Days...)
+	}
+	longest := 0
+	for _, d := range all {
+		if d > longest {
+			longest = d
+		}
+	}
+	if longest == 0 {
+		return notices
+	}
+	horizon := now.Add(time.Duration(longest) * 24 * time.Hour)
+	for _, c := range FindCerts(CertFilter{ExpiresAfter: now, ExpiresBefore: horizon}) {
+		if n.OptOut[c.Crt.Subject.CommonName] {
+			continue
+		}
+		days := n.certDays(c)
+		left := c.Crt.NotAfter.Sub(now)
+		for _, d := range days {
+			if left > time.Duration(d)*24*time.Hour {
+				continue
+			}
+			if last, ok := idx.Serials[serialKey(c.Crt.SerialNumber)]; !ok || d < last {
+				notices = append(notices, ExpiryNotice{c, d, int(left.Hours()) / 24})
+			}
+			break
+		}
+	}
+	sort.Slice(notices, func(i, j int) bool {
+		return notices[i].Cert.Crt.NotAfter.Before(notices[j].Cert.Crt.NotAfter)
+	})
+	return notices
+}
+
+// certNotify returns the notifications of the certificate, or of the closest CA above it with
+// them, each field on its own: empty ones follow the general settings
+func (n Notifications) certNotify(c *Cert) CertNotify {
+	cn := CertNotify{}
+	for ; c != nil && c.Crt != nil; c = c.Parent {
+		own := n.PerCert[c.Crt.Subject.CommonName]
+		if len(cn.Recipients) == 0 {
+			cn.Recipients = own.Recipients
+		}
+		if len(cn.Days) == 0 {
+			cn.Days = own.Days
+		}
+		if c.Parent == c {
+			break
+		}
+	}
+	return cn
+}
+
+// certDays returns the days before expiry when to notify about the certificate, sorted
+func (n Notifications) certDays(c *Cert) []int {
+	days := n.certNotify(c).Days
+	if len(days) == 0 {
+		days = n.Days
+	}
+	days = append([]int{}, days...)
+	sort.Ints(days)
+	return days
+}
+
+// certRecipients returns who to notify about the certificate, the general recipients unless it
+// or a CA above it has its own
+func (cfg *config) certRecipients(c *Cert) []string {
+	if recipients := cfg.getNotifications().certNotify(c).Recipients; len(recipients) > 0 {
+		return recipients
+	}
+	return cfg.notifyRecipients()
+}
+
+// getNotifications returns the notification settings, with defaults if not configured
+func (cfg *config) getNotifications() Notifications {
+	n := Notifications{}
+	if cfg != nil && cfg.Notifications != nil {
+		n = *cfg.Notifications
+	}
+	if n.Days == nil {
+		n.Days = DEFAULT_NOTIFY_DAYS
+	}
+	if n.OptOut == nil {
+		n.OptOut = make(map[string]bool)
+	}
+	return n
+}
+
+// notifyRecipients returns the notification recipients, all users' emails by default
+func (cfg *config) notifyRecipients() []string {
+	if n := cfg.getNotifications(); len(n.Recipients) > 0 {
+		return n.Recipients
+	}
+	recipients := make([]string, 0)
+	for _, u := range cfg.Users {
+		if u.Email != "" {
+			recipients = append(recipients, u.Email)
+		}
+	}
+	sort.Strings(recipients)
+	return recipients
+}
+
+// loadNotified loads the already notified certificates
+func loadNotified() (*notifiedIndex, error) {
+	idx := &notifiedIndex{make(map[string]int), make(map[string]bool)}
+	if err := loadGob(WEBCA_NOTIFIED, idx); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// save stores the already notified certificates
+func (idx *notifiedIndex) save() error {
+	return saveGob(WEBCA_NOTIFIED, idx)
+}
+
+// readNotifications reads the notification settings from the request
+func readNotifications(r *http.Request, previous Notifications) (*Notifications, error) {
+	n := &Notifications{Recipients: splitSANs(r.FormValue("Recipients")), OptOut: previous.OptOut, PerCert: previous.PerCert,
+		Subject: strings.TrimSpace(r.FormValue("Subject")), Body: strings.Replace(r.FormValue("Body"), "\r\n", "\n", -1),
+		WebURL: strings.TrimRight(strings.TrimSpace(r.FormValue("WebURL")), "/")}
+	if n.Subject == DEFAULT_NOTICE_SUBJECT {
+		n.Subject = ""
+	}
+	if n.Body == DEFAULT_NOTICE_BODY {
+		n.Body = ""
+	}
+	if n.WebURL != "" {
+		if u, err := url.Parse(n.WebURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("%s: %v", tr("Wrong URL!"), n.WebURL)
+		}
+	}
+	if _, _, err := n.renderNotice(sampleNoticeMail(n.WebURL)); err != nil {
+		return nil, err
+	}
+	days, err := parseDays(r.FormValue("Days"))
+	if err != nil {
+		return nil, err
+	}
+	n.Days = days
+	return n, nil
+}
+
+// parseDays reads the days before expiry separated by commas or spaces, in decreasing order
+func parseDays(s string) ([]int, error) {
+	var days []int
+	for _, d := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		day, err := strconv.Atoi(d)
+		if err != nil || day <= 0 {
+			return nil, fmt.Errorf("%s: %v", tr("Wrong number of days!"), d)
+		}
+		days = append(days, day)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	return days, nil
+}
+
+// notifications allows the web user to configure the expiry notification emails
+func notifications(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	n := cfg.getNotifications()
+	if r.Method == "POST" {
+		nn, err := readNotifications(r, n)
+		if err == nil && r.FormValue("action") == "preview" {
+			n = *nn
+			ps["PreviewSubject"], ps["PreviewBody"], _ = n.renderNotice(sampleNoticeMail(n.WebURL))
+		} else {
+			if err == nil {
+				err = cfg.update(func(cfg *config) error {
+					current := cfg.getNotifications() // the certificate settings may have changed meanwhile
+					nn.OptOut, nn.PerCert = current.OptOut, current.PerCert
+					cfg.Notifications = nn
+					return nil
+				})
+			}
+			if err == nil {
+				auditRequest(w, r, AUDIT_CONFIG, "notifications")
+				http.Redirect(w, r, "/notifications", 302)
+				return
+			}
+			ps["Error"] = err.Error()
+		}
+	}
+	ps["Notifications"] = n
+	ps["Subject"], ps["Body"] = n.noticeTemplates()
+	ps["WebURL"] = webBase(r)
+	ps["Recipients"] = cfg.notifyRecipients()
+	err := templatesFor(r).ExecuteTemplate(w, "notifications", ps)
+	handleError(w, r, err)
+}
+
+// notifyOptOut enables or disables the expiry notifications for a certificate
+func notifyOptOut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	err = LoadConfig().update(func(cfg *config) error {
+		n := cfg.getNotifications()
+		optOut := make(map[string]bool, len(n.OptOut)+1)
+		for cert := range n.OptOut {
+			optOut[cert] = true
+		}
+		if r.FormValue("optout") != "" {
+			optOut[name] = true
+		} else {
+			delete(optOut, name)
+		}
+		n.OptOut = optOut
+		cfg.Notifications = &n
+		return nil
+	})
+	if handleError(w, r, err) {
+		return
+	}
+	setCertControl(ps, c)
+	err = templatesFor(r).ExecuteTemplate(w, "certControl", ps)
+	handleError(w, r, err)
+}
+
+// certNotifications sets who to notify about the expiry of a certificate, or of those below a CA,
+// and when
+func certNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	days, err := parseDays(r.FormValue("NotifyDays"))
+	if err == nil {
+		cn := CertNotify{Recipients: splitSANs(r.FormValue("NotifyRecipients")), Days: days}
+		err = LoadConfig().update(func(cfg *config) error {
+			n := cfg.getNotifications()
+			perCert := make(map[string]CertNotify, len(n.PerCert)+1)
+			for cert, notify := range n.PerCert {
+				perCert[cert] = notify
+			}
+			if len(cn.Recipients) == 0 && len(cn.Days) == 0 {
+				delete(perCert, name)
+			} else {
+				perCert[name] = cn
+			}
+			n.PerCert = perCert
+			cfg.Notifications = &n
+			return nil
+		})
+	}
+	if err != nil {
+		ps["Error"] = err.Error()
+	} else {
+		auditRequest(w, r, AUDIT_CONFIG, "notifications of "+name)
+	}
+	setCertControl(ps, c)
+	err = templatesFor(r).ExecuteTemplate(w, "certControl", ps)
+	handleError(w, r, err)
+}
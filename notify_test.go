@@ -0,0 +1,149 @@
+package webca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyExpiring(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	sent := make([]string, 0)
+	defer func(saved func(m *Mailer, to, subject, body string) error) { sendMail = saved }(sendMail)
+	sendMail = func(m *Mailer, to, subject, body string) error {
+		sent = append(sent, to+": "+body)
+		return nil
+	}
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Mailer: &Mailer{Server: "smtp.example.com"},
+		Users:         map[string]User{"admin": {Username: "admin", Email: "admin@example.com"}},
+		Notifications: &Notifications{OptOut: map[string]bool{"quiet": true}}}
+	ca, err := GenCACert(pkix.Name{CommonName: "NotifyCA"}, ForDays(365))
+	dieOnError(t, err)
+	for name, days := range map[string]int{"soon": 10, "quiet": 10, "later": 100} {
+		_, err := GenCert(ca, name, ForDays(days))
+		dieOnError(t, err)
+	}
+	now := time.Now()
+	dieOnError(t, NotifyExpiring(now))
+	if len(sent) != 1 || !strings.Contains(sent[0], "soon") || strings.Contains(sent[0], "quiet") ||
+		strings.Contains(sent[0], "later") || !strings.HasPrefix(sent[0], "admin@example.com") {
+		t.Fatalf("Unexpected notifications: %v", sent)
+	}
+	dieOnError(t, NotifyExpiring(now.Add(time.Hour)))
+	if len(sent) != 1 {
+		t.Fatalf("The same threshold was notified twice: %v", sent)
+	}
+	dieOnError(t, NotifyExpiring(now.AddDate(0, 0, 4)))
+	if len(sent) != 2 || !strings.Contains(sent[1], "soon") {
+		t.Fatalf("The 7 days threshold was not notified: %v", sent)
+	}
+	// a failed recipient is retried alone, the others are not notified twice
+	inboxItems := func() int {
+		in, err := loadInbox()
+		dieOnError(t, err)
+		return len(in.Items)
+	}
+	last := now.AddDate(0, 0, 9).Add(12 * time.Hour)
+	cachedCfg.Users["ops"] = User{Username: "ops", Email: "ops@example.com"}
+	sendMail = func(m *Mailer, to, subject, body string) error {
+		if to == "ops@example.com" {
+			return fmt.Errorf("mailbox unavailable")
+		}
+		sent = append(sent, to+": "+body)
+		return nil
+	}
+	if err := NotifyExpiring(last); err == nil || !strings.Contains(err.Error(), "ops@example.com") {
+		t.Fatalf("The failed recipient was not reported: %v", err)
+	}
+	if len(sent) != 3 || !strings.HasPrefix(sent[2], "admin@example.com") || inboxItems() != 3 {
+		t.Fatalf("The 1 day threshold was not notified: %v", sent)
+	}
+	sendMail = func(m *Mailer, to, subject, body string) error {
+		sent = append(sent, to+": "+body)
+		return nil
+	}
+	dieOnError(t, NotifyExpiring(last.Add(time.Hour)))
+	if len(sent) != 4 || !strings.HasPrefix(sent[3], "ops@example.com") || inboxItems() != 3 {
+		t.Fatalf("Only the failed recipient should have been notified again: %v", sent)
+	}
+	dieOnError(t, NotifyExpiring(last.Add(2*time.Hour)))
+	if len(sent) != 4 {
+		t.Fatalf("The 1 day threshold was notified twice: %v", sent)
+	}
+}
+
+func TestCertNotifications(t *testing.T) {
+	inTestDir(t)
+	sent := make(map[string]string)
+	defer func(saved func(m *Mailer, to, subject, body string) error) { sendMail = saved }(sendMail)
+	sendMail = func(m *Mailer, to, subject, body string) error {
+		sent[to] += body
+		return nil
+	}
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Mailer: &Mailer{Server: "smtp.example.com"},
+		Users: map[string]User{"admin": {Username: "admin", Email: "admin@example.com"}},
+		Notifications: &Notifications{Days: []int{30}, PerCert: map[string]CertNotify{
+			"TeamCA":            {Recipients: []string{"team@example.com"}, Days: []int{60}},
+			"owned.example.com": {Recipients: []string{"owner@example.com"}}}}}
+	certree = nil
+	team, err := GenCACert(pkix.Name{CommonName: "TeamCA"}, ForDays(365))
+	dieOnError(t, err)
+	sub, err := genCert(team, &x509.Certificate{Subject: pkix.Name{CommonName: "TeamSubCA"}, IsCA: true,
+		BasicConstraintsValid: true, NotBefore: time.Now(), NotAfter: time.Now().AddDate(0, 0, 300),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign}, nil)
+	dieOnError(t, err)
+	other, err := GenCACert(pkix.Name{CommonName: "OtherCA"}, ForDays(365))
+	dieOnError(t, err)
+	for name, parent := range map[string]*Cert{"team.example.com": sub, "owned.example.com": sub, "other.example.com": other} {
+		_, err := GenCert(parent, name, ForDays(50))
+		dieOnError(t, err)
+	}
+	_, err = GenCert(other, "soon.example.com", ForDays(20))
+	dieOnError(t, err)
+	dieOnError(t, NotifyExpiring(time.Now()))
+	if len(sent) != 3 || !strings.Contains(sent["team@example.com"], "team.example.com") ||
+		strings.Contains(sent["team@example.com"], "owned.example.com") ||
+		!strings.Contains(sent["owner@example.com"], "owned.example.com") ||
+		!strings.Contains(sent["admin@example.com"], "soon.example.com") ||
+		strings.Contains(sent["admin@example.com"], "other.example.com") {
+		t.Fatalf("Unexpected notifications: %v", sent)
+	}
+
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/certNotifications", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		certNotifications(w, req)
+		return w
+	}
+	post(url.Values{"cert": {"OtherCA"}, "NotifyRecipients": {"ops@example.com, sec@example.com"}, "NotifyDays": {"7 45"}})
+	if cn := cachedCfg.Notifications.PerCert["OtherCA"]; len(cn.Recipients) != 2 || len(cn.Days) != 2 || cn.Days[0] != 45 {
+		t.Fatalf("Certificate notifications not saved: %+v", cn)
+	}
+	if r := cachedCfg.certRecipients(FindCert("other.example.com")); len(r) != 2 || r[0] != "ops@example.com" {
+		t.Fatalf("CA recipients not inherited: %v", r)
+	}
+	if w := post(url.Values{"cert": {"OtherCA"}, "NotifyDays": {"soon"}}); !strings.Contains(w.Body.String(), "Wrong number of days!") {
+		t.Fatal("Wrong days accepted")
+	}
+	w := httptest.NewRecorder()
+	certNotifications(w, httptest.NewRequest("GET", "/certNotifications?cert=OtherCA", nil))
+	if _, ok := cachedCfg.Notifications.PerCert["OtherCA"]; !ok || w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Certificate notifications removed on a GET: %d", w.Code)
+	}
+	post(url.Values{"cert": {"OtherCA"}})
+	if _, ok := cachedCfg.Notifications.PerCert["OtherCA"]; ok {
+		t.Fatal("Certificate notifications not removed")
+	}
+}
@@ -0,0 +1,476 @@
+package webca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDC_TIMEOUT      = 10 * time.Second
+	OIDC_CACHE        = time.Hour // the discovery document and keys are fetched again after it
+	OIDC_MAX_RESPONSE = 1 << 20
+	OIDC_SKEW         = 2 * time.Minute // clock difference allowed with the provider
+	OIDC_STATE        = "OIDCState"     // session key of the sign in in progress
+	OIDC_CALLBACK     = "/oidc/callback"
+)
+
+// OIDC is the OpenID Connect provider users can sign in with instead of their password
+type OIDC struct {
+	Name          string            // shown on the login page
+	Issuer        string            // its discovery document is fetched from <Issuer>/.well-known/openid-configuration
+	ClientID      string            // registered with the callback <webca>/oidc/callback
+	ClientSecret  string            // empty for public clients
+	Scopes        string            // requested besides openid, "profile email" if empty
+	UsernameClaim string            // preferred_username if empty
+	RolesClaim    string            // claim whose values are mapped to roles, groups if empty
+	Roles         map[string]string // role by claim value, the most privileged applies
+	DefaultRole   string            // of new users without a mapped value, none rejects them
+	CreateUsers   bool              // unknown users are created on their first sign in
+}
+
+// oidcProvider is the discovery document (OpenID Connect Discovery 1.0) and keys of an issuer
+type oidcProvider struct {
+	Issuer   string                      `json:"issuer"`
+	AuthURL  string                      `json:"authorization_endpoint"`
+	TokenURL string                      `json:"token_endpoint"`
+	JWKSURL  string                      `json:"jwks_uri"`
+	keys     map[string]crypto.PublicKey // by key ID
+	fetched  time.Time
+}
+
+// oidcKey is a key of the provider's JWK set
+type oidcKey struct {
+	JWK
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+}
+
+// oidcState is the sign in sent to the provider, checked when it comes back
+type oidcState struct {
+	State    string
+	Nonce    string
+	Verifier string // PKCE (RFC 7636)
+	URL      string // where to go once signed in
+	Link     string // logged in user the provider account is linked to, a sign in if empty
+}
+
+// providers by issuer, in memory
+var oidcProviders = make(map[string]*oidcProvider)
+
+// providers lock
+var soidc sync.Mutex
+
+var oidcClient = &http.Client{Timeout: OIDC_TIMEOUT}
+
+// SSO returns the name of the single sign on provider offered on the login page, if any
+func (ps PageStatus) SSO() string {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.OIDC == nil {
+		return ""
+	}
+	if cfg.OIDC.Name == "" {
+		return cfg.OIDC.Issuer
+	}
+	return cfg.OIDC.Name
+}
+
+// oidcGet decodes the JSON document at the URL into v
+func oidcGet(u string, v interface{}) error {
+	res, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, OIDC_MAX_RESPONSE)).Decode(v)
+}
+
+// provider returns the discovery document and keys of the issuer, fetching them if they are
+// not cached, too old or refresh is set (a key may have been rotated)
+func (o *OIDC) provider(refresh bool) (*oidcProvider, error) {
+	soidc.Lock()
+	defer soidc.Unlock()
+	if p := oidcProviders[o.Issuer]; p != nil && !refresh && time.Since(p.fetched) < OIDC_CACHE {
+		return p, nil
+	}
+	p := &oidcProvider{}
+	if err := oidcGet(strings.TrimSuffix(o.Issuer, "/")+"/.well-known/openid-configuration", p); err != nil {
+		return nil, err
+	}
+	if p.Issuer != o.Issuer || checkURL(p.AuthURL) != nil || checkURL(p.TokenURL) != nil ||
+		checkURL(p.JWKSURL) != nil {
+		return nil, fmt.Errorf("Wrong OpenID Connect discovery document of %s", o.Issuer)
+	}
+	var set struct {
+		Keys []oidcKey `json:"keys"`
+	}
+	if err := oidcGet(p.JWKSURL, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.PublicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+	p.fetched = time.Now()
+	oidcProviders[o.Issuer] = p
+	return p, nil
+}
+
+// randomB64 returns n random bytes in base64url
+func randomB64(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return b64(data), nil
+}
+
+// oidcRedirect returns the callback URL of the sign ins
+func oidcRedirect(r *http.Request) string {
+	return webBase(r) + OIDC_CALLBACK
+}
+
+// oidcLogin sends the browser to the provider to sign in (authorization code flow with PKCE)
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	oidcStart(w, r, oidcState{URL: localURL(r.FormValue("URL"))})
+}
+
+// oidcLink sends the web user to the provider to link their account there to theirs, so that
+// they can sign in with it
+func oidcLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	oidcStart(w, r, oidcState{URL: "/settings", Link: requestUser(w, r).Username})
+}
+
+// oidcStart sends the browser to the provider with the sign in state
+func oidcStart(w http.ResponseWriter, r *http.Request, st oidcState) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := cfg.OIDC.provider(false)
+	if handleError(w, r, err) {
+		return
+	}
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	for _, v := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+		if *v, err = randomB64(32); handleError(w, r, err) {
+			return
+		}
+	}
+	s[OIDC_STATE] = st
+	s.Save()
+	scopes := cfg.OIDC.Scopes
+	if scopes == "" {
+		scopes = "profile email"
+	}
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{"response_type": {"code"}, "client_id": {cfg.OIDC.ClientID}, "redirect_uri": {oidcRedirect(r)},
+		"scope": {"openid " + scopes}, "state": {st.State}, "nonce": {st.Nonce},
+		"code_challenge": {b64(challenge[:])}, "code_challenge_method": {"S256"}}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthURL+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcCallback signs in the user the provider sent back, falling back to the login page
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	st, ok := s[OIDC_STATE].(oidcState)
+	delete(s, OIDC_STATE)
+	s.Save()
+	addr := remoteAddr(r)
+	var u User
+	switch {
+	case !ok || subtle.ConstantTimeCompare([]byte(st.State), []byte(r.FormValue("state"))) != 1:
+		err = fmt.Errorf("%s", tr("The sign in is not valid or has expired!"))
+	case r.FormValue("error") != "":
+		err = fmt.Errorf("%s", tr("The identity provider refused the sign in: %s",
+			strings.TrimSpace(r.FormValue("error")+" "+r.FormValue("error_description"))))
+	default:
+		var claims map[string]interface{}
+		if claims, err = cfg.OIDC.exchange(r.FormValue("code"), st, oidcRedirect(r)); err == nil && st.Link != "" {
+			u, err = cfg.linkOIDC(st.Link, claims)
+		} else if err == nil {
+			u, err = cfg.oidcUser(claims)
+		}
+	}
+	if err == nil {
+		err = admitLogin(u.Username, s.Id(), addr)
+	}
+	if err != nil {
+		audit(AUDIT_LOGIN_FAILED, u.Username, addr, "oidc: "+err.Error())
+		ps := newPageStatus(r)
+		ps[SESSIONID] = s.Id()
+		ps["URL"] = st.URL
+		ps["Error"] = err.Error()
+		w.WriteHeader(http.StatusUnauthorized)
+		err = templatesFor(r).ExecuteTemplate(w, "login", ps)
+		handleError(w, r, err)
+		return
+	}
+	audit(AUDIT_LOGIN, u.Username, addr, "oidc "+cfg.OIDC.Issuer)
+	s[LOGGEDUSER] = u
+	if handleError(w, r, s.Renew(w, r)) {
+		return
+	}
+	http.Redirect(w, r, st.URL, http.StatusFound)
+}
+
+// exchange redeems the authorization code at the token endpoint and returns the claims of the
+// verified ID token
+func (o *OIDC) exchange(code string, st oidcState, redirect string) (map[string]interface{}, error) {
+	p, err := o.provider(false)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirect},
+		"code_verifier": {st.Verifier}}
+	if o.ClientSecret == "" {
+		form.Set("client_id", o.ClientID)
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(res.Body, OIDC_MAX_RESPONSE)).Decode(&tokens)
+	if res.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("%s", tr("The identity provider refused the sign in: %s",
+			strings.TrimSpace(res.Status+" "+tokens.Error)))
+	}
+	return o.verifyIDToken(p, tokens.IDToken, st.Nonce, time.Now())
+}
+
+// verifyIDToken checks the signature, issuer, audience, lifetime and nonce of the ID token and
+// returns its claims
+func (o *OIDC) verifyIDToken(p *oidcProvider, token, nonce string, now time.Time) (map[string]interface{}, error) {
+	wrong := fmt.Errorf("%s", tr("The identity provider sent a wrong ID token!"))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, wrong
+	}
+	jws := &JWS{Protected: parts[0], Payload: parts[1], Signature: parts[2]}
+	h, err := jws.Header()
+	if err != nil {
+		return nil, wrong
+	}
+	key, found := p.keys[h.KID]
+	if !found && time.Since(p.fetched) > time.Minute { // rotated, but don't let tokens make us refetch often
+		if p, err = o.provider(true); err != nil {
+			return nil, err
+		}
+		key, found = p.keys[h.KID]
+	}
+	if !found {
+		return nil, wrong
+	}
+	payload, err := jws.Verify(h.Alg, key)
+	if err != nil {
+		return nil, wrong
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, wrong
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, wrong
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == o.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == o.ClientID
+		}
+		if azp, ok := claims["azp"].(string); ok && azp != o.ClientID {
+			audience = false
+		}
+	}
+	exp, _ := claims["exp"].(float64)
+	iat, _ := claims["iat"].(float64)
+	n, _ := claims["nonce"].(string)
+	if !audience || now.Add(-OIDC_SKEW).After(time.Unix(int64(exp), 0)) ||
+		now.Add(OIDC_SKEW).Before(time.Unix(int64(iat), 0)) || subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, wrong
+	}
+	return claims, nil
+}
+
+// role returns the most privileged role mapped from the claims, the default one if none is
+func (o *OIDC) role(claims map[string]interface{}) string {
+	name := o.RolesClaim
+	if name == "" {
+		name = "groups"
+	}
+	var values []interface{}
+	switch v := claims[name].(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	role := ""
+	for _, v := range values {
+		if s, ok := v.(string); ok && roleRank(o.Roles[s]) > roleRank(role) {
+			role = o.Roles[s]
+		}
+	}
+	if role == "" {
+		return o.DefaultRole
+	}
+	return role
+}
+
+// oidcSubject returns the issuer and subject of the claims, identifying the provider account
+func oidcSubject(claims map[string]interface{}) (string, string, error) {
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	if iss == "" || sub == "" {
+		return "", "", fmt.Errorf("%s", tr("The identity provider did not identify the account!"))
+	}
+	return iss, sub, nil
+}
+
+// oidcLinked returns the user linked to the provider account, false if none is
+func (cfg *config) oidcLinked(iss, sub string) (User, bool) {
+	for _, u := range cfg.Users {
+		if u.OIDCIssuer == iss && u.OIDCSubject == sub {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// linkOIDC links the provider account of the claims to the named user, unless it is linked to
+// another one
+func (cfg *config) linkOIDC(username string, claims map[string]interface{}) (User, error) {
+	iss, sub, err := oidcSubject(claims)
+	if err != nil {
+		return User{}, err
+	}
+	var u User
+	err = cfg.update(func(cfg *config) error {
+		var exists bool
+		u, exists = cfg.Users[username]
+		if linked, ok := cfg.oidcLinked(iss, sub); !exists || u.Disabled || ok && linked.Username != username {
+			return fmt.Errorf("%s", tr("This account of the identity provider is linked to another user!"))
+		}
+		u.OIDCIssuer, u.OIDCSubject = iss, sub
+		users := copyUsers(cfg.Users)
+		users[username] = u
+		cfg.Users = users
+		return nil
+	})
+	return u, err
+}
+
+// oidcUser returns the user the claims sign in, the one linked to the provider account (by issuer
+// and subject, the username claim being neither unique nor stable), created if it is unknown and
+// the provider may, with the role mapped from the claims. Existing users without a password are
+// linked on their first sign in, having been created through the provider before the links; the
+// others have to link their account from their settings
+func (cfg *config) oidcUser(claims map[string]interface{}) (User, error) {
+	iss, sub, err := oidcSubject(claims)
+	if err != nil {
+		return User{}, err
+	}
+	u, exists := cfg.oidcLinked(iss, sub)
+	username := u.Username
+	if !exists {
+		claim := cfg.OIDC.UsernameClaim
+		if claim == "" {
+			claim = "preferred_username"
+		}
+		username, _ = claims[claim].(string)
+		if !validUsername.MatchString(username) {
+			return User{}, fmt.Errorf("%s: %v", tr("Wrong username!"), username)
+		}
+		if u, exists = cfg.Users[username]; exists && (u.OIDCIssuer != "" || u.Password != "") {
+			return User{Username: username}, fmt.Errorf("%s", tr("%v is not linked to this account of the identity provider!", username))
+		}
+	}
+	role := cfg.OIDC.role(claims)
+	switch {
+	case exists && u.Disabled:
+		return u, fmt.Errorf("%s", tr("Access Denied"))
+	case !exists && (!cfg.OIDC.CreateUsers || role == ""):
+		return User{Username: username}, fmt.Errorf("%s", tr("%v is not a user of this CA!", username))
+	}
+	updated := u
+	updated.Username = username
+	updated.OIDCIssuer, updated.OIDCSubject = iss, sub
+	if role != "" {
+		updated.Role = role
+	}
+	if name, _ := claims["name"].(string); updated.Fullname == "" {
+		updated.Fullname = name
+	}
+	if email, _ := claims["email"].(string); updated.Email == "" {
+		updated.Email = email
+	}
+	if !exists || updated.Role != u.Role || updated.Fullname != u.Fullname || updated.Email != u.Email ||
+		updated.OIDCSubject != u.OIDCSubject {
+		err := cfg.update(func(cfg *config) error {
+			if !cfg.keepsAdmin(username, &updated) {
+				return fmt.Errorf("%s", tr("There must be at least one enabled admin!"))
+			}
+			users := copyUsers(cfg.Users)
+			users[username] = updated
+			cfg.Users = users
+			return nil
+		})
+		if err != nil {
+			return u, err
+		}
+	}
+	return updated, nil
+}
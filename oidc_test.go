@@ -0,0 +1,163 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOIDC(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved map[string]*oidcProvider) { oidcProviders = saved }(oidcProviders)
+	oidcProviders = make(map[string]*oidcProvider)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	var claims map[string]interface{}
+	var challenge string
+	mux := http.NewServeMux()
+	idp := httptest.NewServer(mux)
+	defer idp.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": idp.URL, "authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint": idp.URL + "/token", "jwks_uri": idp.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk := map[string]string{"kty": "EC", "crv": "P-256", "kid": "k1", "use": "sig",
+			"x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if id != "webca" || secret != "s3cret" || r.FormValue("code") != "code" || b64(verifier[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		payload, _ := json.Marshal(claims)
+		signed := b64([]byte(`{"alg":"ES256","kid":"k1"}`)) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r1, s1, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		dieOnError(t, err)
+		sig := append(r1.FillBytes(make([]byte, 32)), s1.FillBytes(make([]byte, 32))...)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + b64(sig)})
+	})
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Password: "hash", Role: ROLE_ADMIN}},
+		OIDC: &OIDC{Issuer: idp.URL, ClientID: "webca", ClientSecret: "s3cret", DefaultRole: ROLE_VIEWER,
+			Roles: map[string]string{"pki-admins": ROLE_ADMIN, "staff": ROLE_VIEWER}, CreateUsers: true}}
+	id, err := genId()
+	dieOnError(t, err)
+	get := func(h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+		w := httptest.NewRecorder()
+		h(w, req)
+		id = followSession(id, w)
+		return w
+	}
+	start := func(set map[string]interface{}, w *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+		location, err := url.Parse(w.Header().Get("Location"))
+		dieOnError(t, err)
+		q := location.Query()
+		if w.Code != http.StatusFound || !strings.HasPrefix(location.String(), idp.URL+"/authorize?") ||
+			q.Get("redirect_uri") != "http://example.com/oidc/callback" || q.Get("code_challenge_method") != "S256" {
+			t.Fatalf("Wrong redirection to the provider: %d %s", w.Code, location)
+		}
+		challenge = q.Get("code_challenge")
+		claims = map[string]interface{}{"iss": idp.URL, "aud": "webca", "exp": time.Now().Add(time.Minute).Unix(),
+			"iat": time.Now().Unix(), "nonce": q.Get("nonce"), "sub": "a1", "preferred_username": "alice",
+			"email": "alice@example.com"}
+		for k, v := range set {
+			claims[k] = v
+		}
+		return get(oidcCallback, "/oidc/callback?code=code&state="+url.QueryEscape(q.Get("state")))
+	}
+	signIn := func(set map[string]interface{}) *httptest.ResponseRecorder {
+		return start(set, get(oidcLogin, "/oidc/login?URL=/certs"))
+	}
+	current := func() session {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+		s, err := SessionFor(httptest.NewRecorder(), req)
+		dieOnError(t, err)
+		return s
+	}
+
+	if w := signIn(map[string]interface{}{"groups": []string{"staff"}}); w.Code != http.StatusFound ||
+		w.Header().Get("Location") != "/certs" {
+		t.Fatalf("Could not sign in with OpenID Connect: %d %s", w.Code, w.Body)
+	}
+	if u, ok := current()[LOGGEDUSER].(User); !ok || u.Username != "alice" || u.Role != ROLE_VIEWER ||
+		cachedCfg.Users["alice"].Email != "alice@example.com" {
+		t.Fatalf("Wrong signed in user: %+v", u)
+	}
+	if w := get(oidcCallback, "/oidc/callback?code=code&state=x"); w.Code != http.StatusUnauthorized {
+		t.Errorf("A sign in was accepted without its state: %d", w.Code)
+	}
+	signIn(map[string]interface{}{"groups": []string{"staff", "pki-admins"}})
+	if cachedCfg.Users["alice"].Role != ROLE_ADMIN {
+		t.Errorf("The role was not mapped from the groups: %s", cachedCfg.Users["alice"].Role)
+	}
+	signIn(map[string]interface{}{"preferred_username": "alicia"})
+	if u, ok := current()[LOGGEDUSER].(User); !ok || u.Username != "alice" || cachedCfg.Users["alicia"].Username != "" {
+		t.Errorf("The linked user was not signed in by subject: %+v", u)
+	}
+	for name, set := range map[string]map[string]interface{}{
+		"audience": {"aud": "other"},
+		"issuer":   {"iss": "https://evil.example.com"},
+		"nonce":    {"nonce": "replayed"},
+		"expiry":   {"exp": time.Now().Add(-time.Hour).Unix()},
+		"username": {"preferred_username": "bob", "sub": "b1"},
+		"subject":  {"sub": nil},
+		"local":    {"preferred_username": "boss", "sub": "b2", "groups": []string{"pki-admins"}},
+	} {
+		if name == "username" {
+			cachedCfg.OIDC.CreateUsers = false
+		}
+		s := current()
+		delete(s, LOGGEDUSER)
+		s.Save()
+		if w := signIn(set); w.Code != http.StatusUnauthorized || current()[LOGGEDUSER] != nil {
+			t.Errorf("A sign in with a wrong %s was accepted: %d", name, w.Code)
+		}
+	}
+	if _, ok := cachedCfg.Users["bob"]; ok {
+		t.Error("An unknown user was created")
+	}
+	s := current()
+	s[LOGGEDUSER] = cachedCfg.Users["boss"]
+	s.Save()
+	req := httptest.NewRequest("POST", "/oidc/link", nil)
+	req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+	w := httptest.NewRecorder()
+	oidcLink(w, req)
+	id = followSession(id, w)
+	if w := start(map[string]interface{}{"sub": "a1"}, w); w.Code != http.StatusUnauthorized || cachedCfg.Users["boss"].OIDCSubject != "" {
+		t.Fatalf("An account linked to another user was linked: %d", w.Code)
+	}
+	s = current()
+	s[LOGGEDUSER] = cachedCfg.Users["boss"]
+	s.Save()
+	req = httptest.NewRequest("POST", "/oidc/link", nil)
+	req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+	w = httptest.NewRecorder()
+	oidcLink(w, req)
+	id = followSession(id, w)
+	if w := start(map[string]interface{}{"sub": "b2", "preferred_username": "someone"}, w); w.Code != http.StatusFound ||
+		cachedCfg.Users["boss"].OIDCSubject != "b2" {
+		t.Fatalf("The account was not linked: %d %s", w.Code, w.Body)
+	}
+	if w := signIn(map[string]interface{}{"sub": "b2", "groups": []string{"pki-admins"}}); w.Code != http.StatusFound || current()[LOGGEDUSER].(User).Username != "boss" {
+		t.Errorf("Could not sign in with the linked account: %d", w.Code)
+	}
+}
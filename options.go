@@ -0,0 +1,265 @@
+package webca
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	WEBCA_OPTIONS = "WEBCA_CONFIG" // environment variable naming the options file
+	OPTIONS_FILE  = "webca.toml"   // options file read, if any, when there is no such variable
+)
+
+// Options are the startup settings of the server, read from a TOML file (plain key = value
+// lines) and overridden by the environment, so deployments can be configured declaratively
+type Options struct {
+	Port           int    `toml:"port" env:"WEBCA_PORT"`                       // HTTPS port, PORT if 0
+	PortFix        int    `toml:"port_fix" env:"WEBCA_PORT_FIX"`               // added to the ports if they can't be used, PORTFIX if 0
+	Bind           string `toml:"bind" env:"WEBCA_BIND"`                       // listening address or unix:path socket, the web certificate name if empty
+	SetupBind      string `toml:"setup_bind" env:"WEBCA_SETUP_BIND"`           // address or unix:path socket of the setup wizard, SETUPADDR if empty
+	SetupPort      int    `toml:"setup_port" env:"WEBCA_SETUP_PORT"`           // port of the setup wizard, SETUPPORT if 0
+	DataDir        string `toml:"data_dir" env:"WEBCA_DATA_DIR"`               // CA data, audit log and known hosts, the working directory if empty
+	CertFile       string `toml:"cert_file" env:"WEBCA_CERT_FILE"`             // PEM certificate served instead of the web certificate
+	KeyFile        string `toml:"key_file" env:"WEBCA_KEY_FILE"`               // PEM key of the CertFile, in it if empty
+	LogLevel       string `toml:"log_level" env:"WEBCA_LOG_LEVEL"`             // lowest level logged, LOG_INFO if empty
+	LogFormat      string `toml:"log_format" env:"WEBCA_LOG_FORMAT"`           // LOG_TEXT or LOG_JSON, LOG_TEXT if empty
+	SocketMode     string `toml:"socket_mode" env:"WEBCA_SOCKET_MODE"`         // octal permissions of the Unix socket, SOCKET_MODE if empty
+	RedirectPort   int    `toml:"redirect_port" env:"WEBCA_REDIRECT_PORT"`     // plain HTTP port redirected to HTTPS, none if 0
+	TrustedProxies string `toml:"trusted_proxies" env:"WEBCA_TRUSTED_PROXIES"` // addresses or networks of the proxies whose X-Forwarded-* headers are used
+	BasePath       string `toml:"base_path" env:"WEBCA_BASE_PATH"`             // URL prefix the app is served under by the proxy, e.g. /webca/
+	AutocertHost   string `toml:"autocert_host" env:"WEBCA_AUTOCERT_HOST"`     // public host name whose web certificate is got through ACME, self-issued if empty
+	AutocertDir    string `toml:"autocert_dir" env:"WEBCA_AUTOCERT_DIR"`       // ACME account key and web certificate, AUTOCERT_DIR in the data directory if empty
+	AutocertURL    string `toml:"autocert_url" env:"WEBCA_AUTOCERT_URL"`       // ACME directory, LETSENCRYPT_URL if empty
+	AutocertEmail  string `toml:"autocert_email" env:"WEBCA_AUTOCERT_EMAIL"`   // contact of the ACME account, if any
+	ThemeDir       string `toml:"theme_dir" env:"WEBCA_THEME_DIR"`             // templates and CSS overriding the embedded ones, re-read on SIGHUP
+	Headless       bool   `toml:"headless" env:"WEBCA_HEADLESS"`               // only the JSON API and the protocol endpoints, without the HTML UI
+}
+
+// options are the startup settings in use
+var options Options
+
+// LoadOptions reads the options file, the environment and the command line flags in args, in
+// increasing precedence, then keeps the CA data in the data directory unless another storage was
+// chosen. It returns flag.ErrHelp once the help was shown
+func LoadOptions(args []string) error {
+	o := Options{}
+	file, required := os.Getenv(WEBCA_OPTIONS), true
+	if file == "" {
+		file, required = OPTIONS_FILE, false
+	}
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		if err = parseOptions(data, &o); err != nil {
+			return fmt.Errorf("Wrong options file %s: %s", file, err)
+		}
+		log.Printf("Options read from %s", file)
+	} else if required || !os.IsNotExist(err) {
+		return err
+	}
+	if err := fromEnv(&o); err != nil {
+		return err
+	}
+	if err := o.fromFlags(args); err != nil {
+		return err
+	}
+	l, err := newLogger(os.Stderr, o.LogFormat, o.LogLevel)
+	if err != nil {
+		return err
+	}
+	if _, err := o.socketMode(); err != nil {
+		return err
+	}
+	proxies, err := parseProxies(o.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if o.ThemeDir != "" {
+		t, err := parseTemplates(o.ThemeDir)
+		if err == nil {
+			err = useTemplates(t, o.ThemeDir)
+		}
+		if err != nil {
+			return fmt.Errorf("Wrong theme %s: %s", o.ThemeDir, err)
+		}
+	}
+	options, trustedProxies = o, proxies
+	if _, ok := storage.(dirStorage); ok && o.DataDir != "" {
+		storage = dirStorage(o.DataDir)
+	}
+	useLogger(l)
+	return nil
+}
+
+// fromFlags overrides the options given as command line flags
+func (o *Options) fromFlags(args []string) error {
+	fs := flag.NewFlagSet("webca", flag.ContinueOnError)
+	fs.StringVar(&o.Bind, "addr", o.Bind, "listening `address`, or unix:path for a Unix socket behind a proxy, the web "+
+		"certificate name if empty")
+	fs.StringVar(&o.SocketMode, "socket-mode", o.SocketMode, "octal `permissions` of the Unix socket, "+
+		strconv.FormatInt(SOCKET_MODE, 8)+" if empty")
+	fs.IntVar(&o.Port, "port", o.Port, "HTTPS `port`, "+strconv.Itoa(PORT)+" if 0 (plus "+strconv.Itoa(PORTFIX)+
+		" if it can't be used)")
+	fs.IntVar(&o.RedirectPort, "redirect-port", o.RedirectPort, "plain HTTP `port` redirected to HTTPS, e.g. 80 (plus "+
+		"the fix of the HTTPS one), none if 0")
+	fs.StringVar(&o.TrustedProxies, "trusted-proxies", o.TrustedProxies, "comma separated `addresses` or networks of "+
+		"the proxies whose X-Forwarded-* headers are used")
+	fs.StringVar(&o.BasePath, "base-path", o.BasePath, "URL `prefix` the proxy serves the app under, e.g. /webca/")
+	fs.StringVar(&o.AutocertHost, "autocert", o.AutocertHost, "public `host` name whose web certificate is got from "+
+		"Let's Encrypt, answering its challenges on port 80")
+	fs.StringVar(&o.ThemeDir, "theme", o.ThemeDir, "`directory` of the templates (*.html) and style (style.css) "+
+		"overriding the embedded ones")
+	fs.StringVar(&o.CertFile, "cert", o.CertFile, "PEM certificate `file` served instead of the web certificate")
+	fs.StringVar(&o.KeyFile, "key", o.KeyFile, "PEM private key `file` of the -cert one, in it if empty")
+	fs.StringVar(&o.DataDir, "data", o.DataDir, "`directory` of the CA data, the working directory if empty")
+	fs.StringVar(&o.LogLevel, "log-level", o.LogLevel, "lowest `level` logged: debug, info, warning or error")
+	fs.StringVar(&o.LogFormat, "log-format", o.LogFormat, "log `format`: text or json")
+	fs.BoolVar(&o.Headless, "headless", o.Headless, "serve only the JSON API and the ACME, SCEP and Vault endpoints, "+
+		"without the HTML UI (the setup wizard still runs when not configured)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: webca [flags]\n\n"+
+			"Runs the WebCA server, or its setup wizard on http://%s if it is not configured yet.\n"+
+			"The flags override the options file (%s or the one in $%s) and the WEBCA_* environment variables.\n\n",
+			o.setupAddr(), OPTIONS_FILE, WEBCA_OPTIONS)
+		fs.PrintDefaults()
+	}
+	return fs.Parse(args)
+}
+
+// explicitPort tells whether or not the ports were chosen, so they are not fixed when they can't
+// be used
+func (o Options) explicitPort() bool {
+	return o.Port != 0 || o.SetupPort != 0
+}
+
+// optionField returns the field of the options struct o points to named by the tag, if any
+func optionField(o interface{}, tag, name string) (reflect.Value, bool) {
+	v := reflect.ValueOf(o).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get(tag) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// setOption sets the field from its text
+func setOption(f reflect.Value, name, s string) error {
+	switch f.Kind() {
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Wrong number %q for %s", s, name)
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("Wrong boolean %q for %s", s, name)
+		}
+		f.SetBool(b)
+	default:
+		f.SetString(s)
+	}
+	return nil
+}
+
+// parseOptions reads the key = value lines of the options file into the struct o points to, with
+// # comments and basic or literal strings
+func parseOptions(data []byte, o interface{}) error {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("line %d: key = value expected", n)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		f, ok := optionField(o, "toml", key)
+		if !ok {
+			return fmt.Errorf("line %d: unknown option %s", n, key)
+		}
+		switch {
+		case strings.HasPrefix(value, `"`):
+			end := strings.LastIndex(value, `"`)
+			s, err := strconv.Unquote(value[:end+1])
+			if err != nil || end == 0 || !strings.HasPrefix(strings.TrimSpace(value[end+1:])+"#", "#") {
+				return fmt.Errorf("line %d: wrong string %s", n, value)
+			}
+			value = s
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'") + 1
+			if end == 0 || !strings.HasPrefix(strings.TrimSpace(value[end+1:])+"#", "#") {
+				return fmt.Errorf("line %d: wrong string %s", n, value)
+			}
+			value = value[1:end]
+		default:
+			value = strings.TrimSpace(strings.SplitN(value, "#", 2)[0])
+		}
+		if err := setOption(f, key, value); err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	return sc.Err()
+}
+
+// fromEnv overrides the options of the struct o points to set in the environment
+func fromEnv(o interface{}) error {
+	t := reflect.TypeOf(o).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if s, ok := os.LookupEnv(name); ok {
+			if err := setOption(reflect.ValueOf(o).Elem().Field(i), name, strings.TrimSpace(s)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// port returns the HTTPS port
+func (o Options) port() int {
+	if o.Port > 0 {
+		return o.Port
+	}
+	return PORT
+}
+
+// portFix returns the correction of the ports when low ports are not permitted
+func (o Options) portFix() int {
+	if o.PortFix > 0 {
+		return o.PortFix
+	}
+	return PORTFIX
+}
+
+// setupAddr returns the listening address of the setup wizard
+func (o Options) setupAddr() string {
+	addr, port := o.SetupBind, o.SetupPort
+	if strings.HasPrefix(addr, UNIX_PREFIX) {
+		return addr
+	}
+	if addr == "" {
+		addr = SETUPADDR
+	}
+	if port == 0 {
+		port = SETUPPORT
+	}
+	return fmt.Sprintf("%s:%v", addr, port+portFix)
+}
+
+// dataPath returns the path of a file kept in the data directory, outside of the storage
+func dataPath(name string) string {
+	return filepath.Join(options.DataDir, name)
+}
@@ -0,0 +1,137 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHeadless(t *testing.T) {
+	inTestDir(t)
+	defer func(saved Options) { options = saved }(options)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	ca, err := GenCACert(pkix.Name{CommonName: "HeadlessCA"}, ForDays(365))
+	dieOnError(t, err)
+	web, err := GenCert(ca, "localhost", ForDays(30))
+	dieOnError(t, err)
+	cachedCfg = &config{WebCert: web}
+	var o Options
+	dieOnError(t, parseOptions([]byte("headless = true\n"), &o))
+	if !o.Headless {
+		t.Fatal("Headless option not read")
+	}
+	options = o
+	get := func(smux *http.ServeMux, path string) int {
+		w := httptest.NewRecorder()
+		smux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	smux := http.NewServeMux()
+	PrepareServer(smux)
+	for path, code := range map[string]int{"/": http.StatusNotFound, "/login": http.StatusNotFound,
+		"/certControl?cert=localhost": http.StatusNotFound, "/api/v1/cas": http.StatusUnauthorized,
+		"/ca-bundle.pem": http.StatusOK} {
+		if got := get(smux, path); got != code {
+			t.Errorf("Headless %s got %d instead of %d", path, got, code)
+		}
+	}
+	options.Headless = false
+	smux = http.NewServeMux()
+	PrepareServer(smux)
+	if got := get(smux, "/login"); got != http.StatusOK {
+		t.Errorf("The HTML UI is not served: %d", got)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	inTestDir(t)
+	defer func(saved Options, st Storage) { options, storage = saved, st }(options, storage)
+	dieOnError(t, ioutil.WriteFile("webca.toml", []byte(`# deployment options
+port = 8443
+bind = "0.0.0.0" # all interfaces
+setup_bind = '127.0.0.1'
+data_dir = "data"
+`), 0600))
+	os.Setenv("WEBCA_PORT", "9443")
+	defer os.Unsetenv("WEBCA_PORT")
+	dieOnError(t, LoadOptions(nil))
+	if options.Port != 9443 || options.Bind != "0.0.0.0" || options.SetupBind != "127.0.0.1" || options.DataDir != "data" {
+		t.Errorf("Wrong options: %+v", options)
+	}
+	if options.portFix() != PORTFIX || options.setupAddr() != "127.0.0.1:80" {
+		t.Errorf("Wrong defaults: %d %s", options.portFix(), options.setupAddr())
+	}
+	if st, ok := storage.(dirStorage); !ok || st != "data" || dataPath(WEBCA_AUDIT) != "data/"+WEBCA_AUDIT {
+		t.Errorf("The data directory is not used: %v", storage)
+	}
+
+	defer func(saved *slog.Logger) {
+		logger = saved
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	}(logger)
+	dieOnError(t, LoadOptions([]string{"-port", "7443", "-data", "flags", "-log-level", "warning", "-log-format", "json"}))
+	if options.Port != 7443 || options.Bind != "0.0.0.0" || storage != dirStorage("flags") {
+		t.Errorf("The flags did not override the options: %+v", options)
+	}
+	var logged bytes.Buffer
+	l, err := newLogger(&logged, options.LogFormat, options.LogLevel)
+	dieOnError(t, err)
+	useLogger(l)
+	for _, line := range []string{"(Debug) details", "informative", "(Warning) warned", "(Error) failed"} {
+		log.Print(line)
+	}
+	records := []map[string]interface{}{}
+	for dec := json.NewDecoder(&logged); dec.More(); {
+		rec := map[string]interface{}{}
+		dieOnError(t, dec.Decode(&rec))
+		records = append(records, rec)
+	}
+	if len(records) != 2 || records[0]["level"] != "WARN" || records[0]["msg"] != "warned" ||
+		records[1]["level"] != "ERROR" || records[1]["msg"] != "failed" {
+		t.Errorf("Wrong records logged at warning level: %v", records)
+	}
+
+	logged.Reset()
+	l, err = newLogger(&logged, LOG_JSON, LOG_INFO)
+	dieOnError(t, err)
+	useLogger(l)
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logUser(r, "alice")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/cert?id=1", nil))
+	rec := map[string]interface{}{}
+	dieOnError(t, json.Unmarshal(logged.Bytes(), &rec))
+	if rec["msg"] != "request" || rec["path"] != "/cert" || rec["user"] != "alice" || rec["status"] != float64(http.StatusTeapot) {
+		t.Errorf("Wrong request record: %v", rec)
+	}
+	if _, err := newLogger(&logged, "yaml", ""); err == nil {
+		t.Error("A wrong log format was accepted")
+	}
+	if err := LoadOptions([]string{"-h"}); err != flag.ErrHelp {
+		t.Errorf("No help shown: %v", err)
+	}
+	if err := LoadOptions([]string{"-log-level", "chatty"}); err == nil {
+		t.Error("A wrong log level was accepted")
+	}
+
+	for _, wrong := range []string{"port = many", "unknown = 1", "bind = \"open", "[table]"} {
+		if err := parseOptions([]byte(wrong), &Options{}); err == nil {
+			t.Errorf("Wrong options were accepted: %s", wrong)
+		}
+	}
+	os.Setenv(WEBCA_OPTIONS, "missing.toml")
+	defer os.Unsetenv(WEBCA_OPTIONS)
+	if err := LoadOptions(nil); err == nil {
+		t.Error("A missing options file was accepted")
+	}
+}
@@ -0,0 +1,333 @@
+package webca
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Organization isolates a team in the WebCA: its users only see the trees of its root CAs
+type Organization struct {
+	Name string
+	CAs  []string // root CAs, every certificate they issue belongs to the organization too
+}
+
+// orgParams are the request parameters naming certificates, checked against the organization
+var orgParams = []string{"cert", "parent", "signer", "name"}
+
+// orgKey keys the organization of the request user in the request context
+type orgKey struct{}
+
+// findOrg returns the named organization, nil if there is none
+func (cfg *config) findOrg(name string) *Organization {
+	if cfg == nil {
+		return nil
+	}
+	for i := range cfg.Organizations {
+		if cfg.Organizations[i].Name == name {
+			return &cfg.Organizations[i]
+		}
+	}
+	return nil
+}
+
+// certOrg returns the organization of the root CA of the certificate, empty if it has none
+func (cfg *config) certOrg(c *Cert) string {
+	for c.Parent != nil && c.Parent != c {
+		c = c.Parent
+	}
+	if cfg == nil || c.Crt == nil {
+		return ""
+	}
+	for _, org := range cfg.Organizations {
+		for _, ca := range org.CAs {
+			if ca == c.Crt.Subject.CommonName {
+				return org.Name
+			}
+		}
+	}
+	return ""
+}
+
+// visibleIn tells whether or not the users of the organization can see the certificate, users
+// of no organization see all of them
+func (cfg *config) visibleIn(org string, c *Cert) bool {
+	return org == "" || cfg.certOrg(c) == org
+}
+
+// visibleCerts returns the certificates the users of the organization can see
+func visibleCerts(org string, certs []*Cert) []*Cert {
+	if org == "" {
+		return certs
+	}
+	cfg := LoadConfig()
+	visible := make([]*Cert, 0, len(certs))
+	for _, c := range certs {
+		if cfg.visibleIn(org, c) {
+			visible = append(visible, c)
+		}
+	}
+	return visible
+}
+
+// visibleTree returns the certificate trees the users of the organization can see
+func visibleTree(org string, nodes []*CertNode) []*CertNode {
+	if org == "" {
+		return nodes
+	}
+	cfg := LoadConfig()
+	visible := make([]*CertNode, 0, len(nodes))
+	for _, n := range nodes {
+		if cfg.visibleIn(org, n.Cert) {
+			visible = append(visible, n)
+		}
+	}
+	return visible
+}
+
+// requestOrg returns the organization of the request user, empty if they see every certificate
+func requestOrg(r *http.Request) string {
+	org, _ := r.Context().Value(orgKey{}).(string)
+	return org
+}
+
+// orgHides tells whether or not the named certificate exists but the request user cannot see it
+func orgHides(r *http.Request, name string) bool {
+	c := FindCert(name)
+	return c != nil && !LoadConfig().visibleIn(requestOrg(r), c)
+}
+
+// certByFile returns the certificate stored with the file name (without suffixes), if any
+func certByFile(name string) *Cert {
+	for _, c := range FindCerts(CertFilter{}) {
+		if filename(c.Crt.Subject.CommonName) == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// requestedCerts returns the names of the certificates the request acts on: those of the web
+// forms, of the API paths and of the downloads
+func requestedCerts(r *http.Request) []string {
+	names := make([]string, 0)
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, API_PREFIX):
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(path, API_PREFIX), "/"), "/")
+		if len(parts) > 1 && parts[0] == "certs" && parts[1] != "by-fingerprint" {
+			names = append(names, parts[1])
+		}
+	case strings.HasPrefix(path, "/cert/"):
+		file := strings.TrimPrefix(path, "/cert/")
+		for _, suffix := range []string{KEY_SUFFIX, CERT_SUFFIX, DER_SUFFIX, CRT_SUFFIX} {
+			file = strings.TrimSuffix(file, suffix)
+		}
+		if c := certByFile(file); c != nil {
+			names = append(names, c.Crt.Subject.CommonName)
+		}
+	default:
+		r.ParseMultipartForm(BULK_MAX_UPLOAD) // also parses the plain forms
+		for _, param := range orgParams {
+			names = append(names, r.Form[param]...)
+		}
+	}
+	return names
+}
+
+// orgControl fails if the request user belongs to an organization and the request acts on a
+// certificate of another one or on the whole instance, otherwise returns the request carrying
+// their organization for the listings
+func orgControl(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	u := requestUser(w, r)
+	if u == nil || u.Org == "" {
+		return r, nil
+	}
+	denied := fmt.Errorf("%s", tr("Access Denied"))
+	if strings.HasPrefix(r.URL.Path, API_PREFIX) {
+		switch strings.Split(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/")[0] {
+		case "users", "backup", "settings":
+			return r, denied
+		}
+	}
+	cfg := LoadConfig()
+	for _, name := range requestedCerts(r) {
+		if c := FindCert(name); c != nil && !cfg.visibleIn(u.Org, c) {
+			return r, denied
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), orgKey{}, u.Org)), nil
+}
+
+// serveOrg serves the request with h if orgControl allows it, otherwise fails with a 403
+func serveOrg(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	r, err := orgControl(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// instanceAdmin tells whether or not the user administers the whole WebCA, not an organization
+func (u User) instanceAdmin() bool {
+	return u.can(ROLE_ADMIN) && u.Org == ""
+}
+
+// Instance tells whether or not the logged user of the page administers the whole WebCA
+func (ps PageStatus) Instance() bool {
+	u, ok := ps[LOGGEDUSER].(User)
+	return ok && currentUser(u).instanceAdmin()
+}
+
+// instanceAllowed tells whether or not the request user administers the whole WebCA, failing
+// with a 403 if not
+func instanceAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if u := requestUser(w, r); u != nil && u.instanceAdmin() {
+		return true
+	}
+	http.Error(w, tr("Access Denied"), http.StatusForbidden)
+	return false
+}
+
+// instanceControl invokes f only for the admins of the whole WebCA
+func instanceControl(f func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return accessControl(func(w http.ResponseWriter, r *http.Request) {
+		if !instanceAllowed(w, r) {
+			return
+		}
+		f(w, r)
+	})
+}
+
+// assignCA makes the root CA part of the organization, if any, and of no other one
+func (cfg *config) assignCA(org, ca string) error {
+	if org == "" {
+		return nil
+	}
+	c := FindCert(ca)
+	if c == nil || c.Parent != c {
+		return fmt.Errorf("%s", tr("%v is not a root CA!", ca))
+	}
+	return cfg.update(func(cfg *config) error {
+		if cfg.findOrg(org) == nil {
+			return fmt.Errorf("%s", tr("Organization %s not found!", org))
+		}
+		cfg.releaseCA(ca)
+		o := cfg.findOrg(org) // in the new organizations
+		o.CAs = append(o.CAs, ca)
+		sort.Strings(o.CAs)
+		return nil
+	})
+}
+
+// releaseCA removes the root CA from its organization, if any, without saving. The organizations
+// and their CAs are replaced by new slices
+func (cfg *config) releaseCA(ca string) {
+	orgs := make([]Organization, len(cfg.Organizations))
+	for i, o := range cfg.Organizations {
+		kept := make([]string, 0, len(o.CAs)+1)
+		for _, name := range o.CAs {
+			if name != ca {
+				kept = append(kept, name)
+			}
+		}
+		o.CAs = kept
+		orgs[i] = o
+	}
+	cfg.Organizations = orgs
+}
+
+// AddOrganization creates an organization with no CAs nor users
+func (cfg *config) AddOrganization(name string) error {
+	name = strings.TrimSpace(name)
+	if !validUsername.MatchString(name) {
+		return fmt.Errorf("%s: %v", tr("Wrong organization name!"), name)
+	}
+	return cfg.update(func(cfg *config) error {
+		if cfg.findOrg(name) != nil {
+			return fmt.Errorf("%s", tr("Organization %s already exists!", name))
+		}
+		n := len(cfg.Organizations)
+		orgs := append(cfg.Organizations[:n:n], Organization{Name: name, CAs: []string{}})
+		sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+		cfg.Organizations = orgs
+		return nil
+	})
+}
+
+// DeleteOrganization removes an organization without users, its CAs become visible to the
+// admins of the whole WebCA only
+func (cfg *config) DeleteOrganization(name string) error {
+	return cfg.update(func(cfg *config) error {
+		if cfg.findOrg(name) == nil {
+			return fmt.Errorf("%s", tr("Organization %s not found!", name))
+		}
+		for _, u := range cfg.Users {
+			if u.Org == name {
+				return fmt.Errorf("%s", tr("Organization %s still has users!", name))
+			}
+		}
+		kept := make([]Organization, 0, len(cfg.Organizations))
+		for _, o := range cfg.Organizations {
+			if o.Name != name {
+				kept = append(kept, o)
+			}
+		}
+		cfg.Organizations = kept
+		return nil
+	})
+}
+
+// orgUsers returns how many users each organization has
+func (cfg *config) orgUsers() map[string]int {
+	count := make(map[string]int)
+	for _, u := range cfg.Users {
+		if u.Org != "" {
+			count[u.Org]++
+		}
+	}
+	return count
+}
+
+// organizations allows the admins of the whole WebCA to create and delete the organizations and
+// to assign them their root CAs
+func organizations(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	if r.Method == "POST" {
+		name, ca, action := r.FormValue("Org"), r.FormValue("CA"), r.FormValue("action")
+		var err error
+		switch action {
+		case "create":
+			err = cfg.AddOrganization(name)
+		case "delete":
+			err = cfg.DeleteOrganization(name)
+		case "assign":
+			err = cfg.assignCA(name, ca)
+		case "release":
+			err = cfg.update(func(cfg *config) error {
+				cfg.releaseCA(ca)
+				return nil
+			})
+		default:
+			err = fmt.Errorf("%s", tr("Unknown action %s!", action))
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_CONFIG, strings.TrimSpace("organization "+name+" "+action+" "+ca))
+			http.Redirect(w, r, "/organizations", http.StatusFound)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	roots, _ := ListCerts().Tree()
+	ps["Organizations"] = cfg.Organizations
+	ps["OrgUsers"] = cfg.orgUsers()
+	ps["Roots"] = roots
+	err := templatesFor(r).ExecuteTemplate(w, "organizations", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,108 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOrganizations(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"root": {Username: "root", Role: ROLE_ADMIN},
+		"erin": {Username: "erin", Role: ROLE_ADMIN, Org: "red"}}}
+	certree = nil
+	dieOnError(t, cachedCfg.AddOrganization("red"))
+	dieOnError(t, cachedCfg.AddOrganization("blue"))
+	red, err := GenCACert(pkix.Name{CommonName: "RedCA"}, ForDays(365))
+	dieOnError(t, err)
+	blue, err := GenCACert(pkix.Name{CommonName: "BlueCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(red, "red.example.com", ForDays(30))
+	dieOnError(t, err)
+	_, err = GenCert(blue, "blue.example.com", ForDays(30))
+	dieOnError(t, err)
+	dieOnError(t, cachedCfg.assignCA("red", "RedCA"))
+	dieOnError(t, cachedCfg.assignCA("blue", "BlueCA"))
+	if org := cachedCfg.certOrg(FindCert("blue.example.com")); org != "blue" {
+		t.Fatalf("Wrong organization of an issued certificate: %q", org)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	s, err := SessionFor(httptest.NewRecorder(), r)
+	dieOnError(t, err)
+	s[LOGGEDUSER] = cachedCfg.Users["erin"]
+	s.Save()
+	get := func(h http.Handler, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: s.Id()})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	defer dropSession(s.Id())
+	out := get(accessControl(index), "/").Body.String()
+	if !strings.Contains(out, "red.example.com") || strings.Contains(out, "blue.example.com") {
+		t.Errorf("Wrong certificates shown to an organization:\n%s", out)
+	}
+	if out = get(accessControl(index), "/?Name=example").Body.String(); strings.Contains(out, "blue.example.com") {
+		t.Error("A search found the certificates of another organization")
+	}
+	for _, target := range []string{"/certControl?cert=blue.example.com", "/cert/BlueCA.pem", "/users"} {
+		h := accessControl(certControl)
+		if strings.HasPrefix(target, "/cert/") {
+			h = authCertServer("/cert/", storage)
+		} else if target == "/users" {
+			h = instanceControl(users)
+		}
+		if w := get(h, target); w.Code != http.StatusForbidden {
+			t.Errorf("%s allowed to another organization: %d", target, w.Code)
+		}
+	}
+	if w := get(accessControl(certControl), "/certControl?cert=red.example.com"); w.Code != http.StatusOK {
+		t.Errorf("Own certificate denied: %d", w.Code)
+	}
+
+	token, err := cachedCfg.NewAPIToken("erin", "ci")
+	dieOnError(t, err)
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		apiAccess(api).ServeHTTP(w, req)
+		return w
+	}
+	var list CertList
+	dieOnError(t, json.Unmarshal(call("GET", "/api/v1/certs", "").Body.Bytes(), &list))
+	for _, ci := range list.Certs {
+		if ci.Name == "blue.example.com" || ci.Name == "BlueCA" {
+			t.Errorf("The API listed %s to another organization", ci.Name)
+		}
+	}
+	if w := call("GET", "/api/v1/certs/blue.example.com", ""); w.Code != http.StatusForbidden {
+		t.Errorf("The API showed a certificate to another organization: %d", w.Code)
+	}
+	if w := call("POST", "/api/v1/certs", `{"name":"evil.example.com","parent":"BlueCA"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("The API issued under the CA of another organization: %d", w.Code)
+	}
+	if w := call("POST", "/api/v1/cas", `{"name":"RedCA2","days":365}`); w.Code != http.StatusCreated ||
+		cachedCfg.certOrg(FindCert("RedCA2")) != "red" {
+		t.Errorf("A new root CA did not join the organization: %d", w.Code)
+	}
+
+	if err := cachedCfg.SaveUser(User{Username: "root", Role: ROLE_ADMIN, Org: "red"}, false); err == nil {
+		t.Error("The last admin of the whole WebCA joined an organization")
+	}
+	if err := cachedCfg.DeleteOrganization("red"); err == nil {
+		t.Error("An organization with users was deleted")
+	}
+	dieOnError(t, cachedCfg.DeleteOrganization("blue"))
+	if cachedCfg.certOrg(FindCert("blue.example.com")) != "" {
+		t.Error("The CAs of a deleted organization kept it")
+	}
+}
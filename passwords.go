@@ -0,0 +1,167 @@
+package webca
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	PASSWORD_SCHEME      = "argon2id"
+	PASSWORD_TIME        = 2         // passes over the memory
+	PASSWORD_MEMORY      = 19 * 1024 // KiB
+	PASSWORD_THREADS     = 1
+	PASSWORD_KEY_BYTES   = 32
+	PASSWORD_SALT_BYTES  = 16
+	PASSWORD_MIN_LENGTH  = 10 // characters, if there is no policy
+	PASSWORD_MIN_CLASSES = 2  // character classes, if there is no policy
+	PASSWORD_MAX_LENGTH  = 128
+	PBKDF2_SCHEME        = "pbkdf2-sha256" // former hashes, upgraded on login
+)
+
+// PasswordPolicy are the requirements of the user passwords
+type PasswordPolicy struct {
+	MinLength  int // characters
+	MinClasses int // of lowercase, uppercase, digits and symbols
+}
+
+// passwordPolicy returns the configured password policy or the default one
+func (cfg *config) passwordPolicy() PasswordPolicy {
+	if cfg == nil || cfg.Passwords == nil {
+		return PasswordPolicy{PASSWORD_MIN_LENGTH, PASSWORD_MIN_CLASSES}
+	}
+	return *cfg.Passwords
+}
+
+// check fails if the password of the user does not follow the policy
+func (p PasswordPolicy) check(username, passwd string) error {
+	if n := utf8.RuneCountInString(passwd); n < p.MinLength || n > PASSWORD_MAX_LENGTH {
+		return fmt.Errorf("%s", tr("The password must have between %d and %d characters!", p.MinLength,
+			PASSWORD_MAX_LENGTH))
+	}
+	var lower, upper, digit, symbol int
+	for _, r := range passwd {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < p.MinClasses {
+		return fmt.Errorf("%s", tr("The password must mix at least %d of lowercase, uppercase, digits and symbols!",
+			p.MinClasses))
+	}
+	if username != "" && strings.Contains(strings.ToLower(passwd), strings.ToLower(username)) {
+		return fmt.Errorf("%s", tr("The password must not contain the username!"))
+	}
+	return nil
+}
+
+// hashPassword returns the $argon2id$v=19$m=...,t=...,p=...$salt$key form of the password to store
+func hashPassword(passwd string) (string, error) {
+	salt := make([]byte, PASSWORD_SALT_BYTES)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(passwd), salt, PASSWORD_TIME, PASSWORD_MEMORY, PASSWORD_THREADS, PASSWORD_KEY_BYTES)
+	return passwordParams(PASSWORD_TIME, PASSWORD_MEMORY, PASSWORD_THREADS) + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+// passwordParams returns the hash prefix with the Argon2id parameters
+func passwordParams(time, memory uint32, threads uint8) string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d", PASSWORD_SCHEME, argon2.Version, memory, time, threads)
+}
+
+// checkPassword tells whether or not passwd matches the stored hash. Users from before hashing
+// still have their password in clear, and some in PBKDF2
+func checkPassword(hash, passwd string) bool {
+	if strings.HasPrefix(hash, "$"+PASSWORD_SCHEME+"$") {
+		parts := strings.Split(hash, "$") // "", scheme, version, params, salt, key
+		var time, memory uint32
+		var threads uint8
+		if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil ||
+			time == 0 || threads == 0 {
+			return false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false
+		}
+		stored, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil || len(stored) == 0 {
+			return false
+		}
+		key := argon2.IDKey([]byte(passwd), salt, time, memory, threads, uint32(len(stored)))
+		return subtle.ConstantTimeCompare(key, stored) == 1
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != PBKDF2_SCHEME {
+		return hash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(passwd)) == 1
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	stored, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, passwd, salt, iterations, len(stored))
+	return err == nil && subtle.ConstantTimeCompare(key, stored) == 1
+}
+
+// needsRehash tells whether or not the stored hash is not Argon2id with the current parameters
+func needsRehash(hash string) bool {
+	return !strings.HasPrefix(hash, passwordParams(PASSWORD_TIME, PASSWORD_MEMORY, PASSWORD_THREADS)+"$")
+}
+
+// upgradePassword stores the hash of the password just checked if the user has an outdated one
+func (cfg *config) upgradePassword(u User, passwd string) User {
+	if !needsRehash(u.Password) {
+		return u
+	}
+	hash, err := hashPassword(passwd)
+	if err != nil {
+		log.Printf("(Warning) Could not rehash the password of %s: %s", u.Username, err)
+		return u
+	}
+	u.Password = hash
+	err = cfg.update(func(cfg *config) error {
+		stored, ok := cfg.Users[u.Username]
+		if !ok {
+			return fmt.Errorf("%s", tr("User %s not found!", u.Username))
+		}
+		stored.Password = hash
+		users := copyUsers(cfg.Users)
+		users[u.Username] = stored
+		cfg.Users = users
+		return nil
+	})
+	if err != nil {
+		log.Printf("(Warning) Could not save the rehashed password of %s: %s", u.Username, err)
+	}
+	return u
+}
@@ -0,0 +1,50 @@
+package webca
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPasswords(t *testing.T) {
+	inTestDir(t)
+	// encoded by the reference implementation
+	if !checkPassword("$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", "password") {
+		t.Fatal("The reference Argon2id hash was not checked")
+	}
+	policy := PasswordPolicy{MinLength: 8, MinClasses: 3}
+	for passwd, ok := range map[string]bool{"Sh0rt": false, "alllowercase1": false, "Has-Symbols": true,
+		"MyNameIsBoss1": false, "Ünïcödé-Pässwörd": true} {
+		if err := policy.check("boss", passwd); (err == nil) != ok {
+			t.Errorf("Wrong policy check of %s: %v", passwd, err)
+		}
+	}
+	key, err := pbkdf2.Key(sha256.New, "Legacy-pbkdf2", []byte("salt"), 1000, 32)
+	dieOnError(t, err)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{
+		"boss": {Username: "boss", Password: "Legacy-clear"},
+		"op": {Username: "op", Role: ROLE_OPERATOR,
+			Password: PBKDF2_SCHEME + "$1000$c2FsdA$" + base64.RawStdEncoding.EncodeToString(key)},
+	}}
+	for name, passwd := range map[string]string{"boss": "Legacy-clear", "op": "Legacy-pbkdf2"} {
+		if !needsRehash(cachedCfg.Users[name].Password) || !checkPassword(cachedCfg.Users[name].Password, passwd) {
+			t.Fatalf("The legacy password of %s is not checked", name)
+		}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader("Username="+name+"&Password="+passwd))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		login(w, req)
+		if u := cachedCfg.Users[name]; w.Code != http.StatusFound || needsRehash(u.Password) || !checkPassword(u.Password, passwd) {
+			t.Errorf("The password of %s was not rehashed on login: %d %s", name, w.Code, u.Password)
+		}
+	}
+	cachedCfg.Passwords = &policy
+	if err := cachedCfg.SaveUser(User{Username: "view", Role: ROLE_VIEWER, Password: "weakpassword"}, true); err == nil {
+		t.Error("A password against the policy was accepted")
+	}
+}
@@ -0,0 +1,303 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"unicode/utf16"
+)
+
+const (
+	P12_ITERATIONS = 2048
+	P12_SALT_SIZE  = 8
+)
+
+// PKCS#12 (RFC 7292) object identifiers
+var (
+	oidData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidPBEWithSHAAnd3DES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidShroudedKeyBag    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+)
+
+// key derivation material kinds (RFC 7292 appendix B.3)
+const (
+	p12KeyMaterial byte = 1
+	p12IVMaterial  byte = 2
+	p12MACMaterial byte = 3
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT, see explicit()
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue     // [0] EXPLICIT, see explicit()
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue // SET, see set()
+}
+
+type certBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"explicit,tag:0"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// PKCS12 encodes the certificate, its private key and the CA chain as a password protected
+// PKCS#12 file. The key is encrypted with 3DES and the file authenticated with HMAC-SHA1,
+// the most widely supported choices (Windows, Java and most appliances)
+func PKCS12(crt *x509.Certificate, key crypto.Signer, chain []*x509.Certificate, password string) ([]byte, error) {
+	if password == "" {
+		return nil, fmt.Errorf("%s", tr("A password is required!"))
+	}
+	pass := append(bmpString(password), 0, 0) // null terminated
+	localKeyID := crt.SubjectKeyId
+	if len(localKeyID) == 0 {
+		sum := sha1.Sum(crt.Raw)
+		localKeyID = sum[:]
+	}
+	attrs, err := p12Attributes(crt.Subject.CommonName, localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	certBags := make([]safeBag, 0, len(chain)+1)
+	for i, c := range append([]*x509.Certificate{crt}, chain...) {
+		bag, err := newCertBag(c)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			bag.Attributes = attrs
+		}
+		certBags = append(certBags, *bag)
+	}
+	keyBag, err := newShroudedKeyBag(key, pass)
+	if err != nil {
+		return nil, err
+	}
+	keyBag.Attributes = attrs
+	var safes []contentInfo
+	for _, bags := range [][]safeBag{certBags, {*keyBag}} {
+		ci, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		safes = append(safes, *ci)
+	}
+	authSafe, err := asn1.Marshal(safes)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := newMacData(authSafe, pass)
+	if err != nil {
+		return nil, err
+	}
+	content, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfx{
+		Version:  3,
+		AuthSafe: contentInfo{oidData, asn1.RawValue{FullBytes: explicit(content)}},
+		MacData:  *mac,
+	})
+}
+
+// p12Attributes returns the friendly name and local key id bag attributes
+func p12Attributes(name string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	keyID, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	friendly, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(name)})
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		{oidFriendlyName, asn1.RawValue{FullBytes: set(friendly)}},
+		{oidLocalKeyID, asn1.RawValue{FullBytes: set(keyID)}},
+	}, nil
+}
+
+// newCertBag returns a safe bag containing the certificate
+func newCertBag(crt *x509.Certificate) (*safeBag, error) {
+	der, err := asn1.Marshal(certBag{oidX509Certificate, crt.Raw})
+	if err != nil {
+		return nil, err
+	}
+	return &safeBag{Id: oidCertBag, Value: asn1.RawValue{FullBytes: explicit(der)}}, nil
+}
+
+// newShroudedKeyBag returns a safe bag containing the private key encrypted with the password
+func newShroudedKeyBag(key crypto.Signer, pass []byte) (*safeBag, error) {
+	plain, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, P12_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbeParams{salt, P12_ITERATIONS})
+	if err != nil {
+		return nil, err
+	}
+	block, err := des.NewTripleDESCipher(pbkdf(pass, salt, p12KeyMaterial, P12_ITERATIONS, 24))
+	if err != nil {
+		return nil, err
+	}
+	iv := pbkdf(pass, salt, p12IVMaterial, P12_ITERATIONS, block.BlockSize())
+	encrypted := pad(plain, block.BlockSize())
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3DES, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &safeBag{Id: oidShroudedKeyBag, Value: asn1.RawValue{FullBytes: explicit(der)}}, nil
+}
+
+// dataContentInfo wraps the safe bags into a plain data content info
+func dataContentInfo(bags []safeBag) (*contentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return nil, err
+	}
+	content, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return nil, err
+	}
+	return &contentInfo{oidData, asn1.RawValue{FullBytes: explicit(content)}}, nil
+}
+
+// newMacData authenticates the content with HMAC-SHA1 keyed from the password
+func newMacData(content, pass []byte) (*macData, error) {
+	salt := make([]byte, P12_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pbkdf(pass, salt, p12MACMaterial, P12_ITERATIONS, sha1.Size))
+	mac.Write(content)
+	return &macData{
+		Mac: digestInfo{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+			Digest:    mac.Sum(nil),
+		},
+		MacSalt:    salt,
+		Iterations: P12_ITERATIONS,
+	}, nil
+}
+
+// pbkdf derives size bytes of the given material kind (key, iv or mac) from the password
+// (null terminated BMPString) and salt using SHA1, as described on RFC 7292 appendix B.2
+func pbkdf(pass, salt []byte, id byte, iterations, size int) []byte {
+	const u, v = sha1.Size, 64
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt, v), fill(pass, v)...)
+	out := make([]byte, 0, size+u)
+	for len(out) < size {
+		a := sha1.Sum(append(append([]byte{}, d...), i...))
+		for r := 1; r < iterations; r++ {
+			a = sha1.Sum(a[:])
+		}
+		out = append(out, a[:]...)
+		b := fill(a[:], v)
+		for j := 0; j < len(i); j += v { // I_j = (I_j + B + 1) mod 2^(v*8)
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[j+k]) + int(b[k]) + carry
+				i[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out[:size]
+}
+
+// fill repeats data up to the next multiple of v bytes (empty if there is no data)
+func fill(data []byte, v int) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	out := make([]byte, v*((len(data)+v-1)/v))
+	for i := range out {
+		out[i] = data[i%len(data)]
+	}
+	return out
+}
+
+// bmpString encodes a string as big endian UTF-16
+func bmpString(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	out := make([]byte, 0, 2*len(u))
+	for _, r := range u {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return out
+}
+
+// pad adds the PKCS#7 padding to a block size
+func pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	return append(append([]byte{}, data...), bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+// explicit wraps DER content in a context specific [0] explicit tag
+func explicit(der []byte) []byte {
+	raw, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+		IsCompound: true, Bytes: der})
+	return raw
+}
+
+// set wraps DER content in a SET
+func set(der []byte) []byte {
+	raw, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet,
+		IsCompound: true, Bytes: der})
+	return raw
+}
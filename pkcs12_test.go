@@ -0,0 +1,66 @@
+package webca
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestPKCS12(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "P12CA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "p12.example.com", ForDays(30))
+	dieOnError(t, err)
+	if chain := Chain(crt); len(chain) != 1 || chain[0].Subject.CommonName != "P12CA" {
+		t.Fatalf("Unexpected chain %v", chain)
+	}
+	data, err := PKCS12(crt.Crt, crt.Key, Chain(crt), "secret")
+	dieOnError(t, err)
+	// verify the MAC and decrypt the key back
+	var p pfx
+	_, err = asn1.Unmarshal(data, &p)
+	dieOnError(t, err)
+	var authSafe []byte
+	_, err = asn1.Unmarshal(p.AuthSafe.Content.Bytes, &authSafe)
+	dieOnError(t, err)
+	pass := append(bmpString("secret"), 0, 0)
+	mac := hmac.New(sha1.New, pbkdf(pass, p.MacData.MacSalt, p12MACMaterial, p.MacData.Iterations, 20))
+	mac.Write(authSafe)
+	if !hmac.Equal(mac.Sum(nil), p.MacData.Mac.Digest) {
+		t.Fatal("Wrong PKCS#12 MAC!")
+	}
+	var safes []contentInfo
+	_, err = asn1.Unmarshal(authSafe, &safes)
+	dieOnError(t, err)
+	var safeContents []byte
+	_, err = asn1.Unmarshal(safes[1].Content.Bytes, &safeContents)
+	dieOnError(t, err)
+	var bags []safeBag
+	_, err = asn1.Unmarshal(safeContents, &bags)
+	dieOnError(t, err)
+	var epki encryptedPrivateKeyInfo
+	_, err = asn1.Unmarshal(bags[0].Value.Bytes, &epki)
+	dieOnError(t, err)
+	var params pbeParams
+	_, err = asn1.Unmarshal(epki.Algorithm.Parameters.FullBytes, &params)
+	dieOnError(t, err)
+	block, err := des.NewTripleDESCipher(pbkdf(pass, params.Salt, p12KeyMaterial, params.Iterations, 24))
+	dieOnError(t, err)
+	plain := make([]byte, len(epki.EncryptedData))
+	iv := pbkdf(pass, params.Salt, p12IVMaterial, params.Iterations, 8)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, epki.EncryptedData)
+	key, err := x509.ParsePKCS8PrivateKey(plain[:len(plain)-int(plain[len(plain)-1])])
+	dieOnError(t, err)
+	if !sameKey(key, crt.Key) {
+		t.Fatal("The PKCS#12 key does not match the certificate key!")
+	}
+	if _, err := PKCS12(crt.Crt, crt.Key, nil, ""); err == nil {
+		t.Fatal("PKCS#12 files without password should not be allowed!")
+	}
+}
@@ -0,0 +1,371 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2} // PKCS#7 (RFC 2315) content types
+	oidEnvelopedData   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA512          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidDESEDE3CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+)
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue // SET, empty
+	ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+	Certificates     asn1.RawValue // [0] IMPLICIT SET OF Certificate
+	SignerInfos      asn1.RawValue // SET, empty
+}
+
+// PKCS7 encodes the certificates as a degenerate (certificates only, no signers) PKCS#7
+// signed data, the usual .p7b chain bundle format
+func PKCS7(certs []*x509.Certificate) ([]byte, error) {
+	raw := make([]byte, 0)
+	for _, crt := range certs {
+		raw = append(raw, crt.Raw...)
+	}
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      emptySet,
+	}
+	sd.ContentInfo.ContentType = oidData
+	der, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{oidSignedData, asn1.RawValue{FullBytes: explicit(der)}})
+}
+
+type fullSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      innerContent
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"` // IMPLICIT SET OF Certificate
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type innerContent struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"` // IMPLICIT SET OF Attribute
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"optional,tag:0"`
+}
+
+// signedMessage is a verified PKCS#7 signed data
+type signedMessage struct {
+	Content    []byte
+	Signer     *x509.Certificate
+	Attributes map[string]asn1.RawValue // authenticated attribute values by OID
+}
+
+// attrString returns the string value of an authenticated attribute
+func (m *signedMessage) attrString(oid asn1.ObjectIdentifier) string {
+	var s string
+	v := m.Attributes[oid.String()]
+	asn1.Unmarshal(v.FullBytes, &s)
+	return s
+}
+
+// attrBytes returns the octet string value of an authenticated attribute
+func (m *signedMessage) attrBytes(oid asn1.ObjectIdentifier) []byte {
+	var b []byte
+	v := m.Attributes[oid.String()]
+	asn1.Unmarshal(v.FullBytes, &b)
+	return b
+}
+
+// ParseSigned decodes a PKCS#7 signed data and verifies its signature by the certificate it
+// carries. Only the single signer with authenticated attributes form (SCEP's) is supported
+func ParseSigned(der []byte) (*signedMessage, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("Not a PKCS#7 signed data")
+	}
+	var sd fullSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("Wrong PKCS#7 signed data: %s", err)
+	}
+	if len(sd.SignerInfos) != 1 || len(sd.SignerInfos[0].AuthenticatedAttributes.Bytes) == 0 {
+		return nil, fmt.Errorf("A single signer with authenticated attributes is required")
+	}
+	si := sd.SignerInfos[0]
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong PKCS#7 certificates: %s", err)
+	}
+	m := &signedMessage{Content: sd.ContentInfo.Content, Attributes: make(map[string]asn1.RawValue)}
+	for _, crt := range certs {
+		if bytes.Equal(crt.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) &&
+			crt.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 {
+			m.Signer = crt
+		}
+	}
+	if m.Signer == nil {
+		return nil, fmt.Errorf("The PKCS#7 signer certificate is missing")
+	}
+	for rest := si.AuthenticatedAttributes.Bytes; len(rest) > 0; {
+		var attr pkcs12Attribute
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, fmt.Errorf("Wrong PKCS#7 attributes: %s", err)
+		}
+		var v asn1.RawValue
+		asn1.Unmarshal(attr.Value.Bytes, &v)
+		m.Attributes[attr.Id.String()] = v
+	}
+	hash := digestHash(si.DigestAlgorithm.Algorithm)
+	if hash == 0 {
+		return nil, fmt.Errorf("Unsupported PKCS#7 digest %v", si.DigestAlgorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(m.Content)
+	if !bytes.Equal(m.attrBytes(oidMessageDigest), h.Sum(nil)) {
+		return nil, fmt.Errorf("Wrong PKCS#7 message digest")
+	}
+	h = hash.New()
+	h.Write(set(si.AuthenticatedAttributes.Bytes)) // signed as an explicit SET
+	switch pub := m.Signer.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), si.EncryptedDigest)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, h.Sum(nil), si.EncryptedDigest) {
+			err = fmt.Errorf("ECDSA verification failure")
+		}
+	default:
+		err = fmt.Errorf("unsupported key")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Wrong PKCS#7 signature: %s", err)
+	}
+	return m, nil
+}
+
+// digestHash returns the hash function of a digest algorithm, 0 if unsupported
+func digestHash(oid asn1.ObjectIdentifier) crypto.Hash {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512
+	}
+	return 0
+}
+
+// SignData returns the PKCS#7 signed data of content (omitted if nil) by crt with SHA-256,
+// adding the content type and digest to the given authenticated attributes
+func SignData(content []byte, crt *x509.Certificate, key crypto.Signer, attrs []pkcs12Attribute) ([]byte, error) {
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+	ct, _ := asn1.Marshal(oidData)
+	md, _ := asn1.Marshal(digest.Sum(nil))
+	attrs = append(attrs, pkcs12Attribute{oidContentType, asn1.RawValue{FullBytes: set(ct)}},
+		pkcs12Attribute{oidMessageDigest, asn1.RawValue{FullBytes: set(md)}})
+	encoded := make([][]byte, 0, len(attrs))
+	for _, attr := range attrs {
+		der, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, der)
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 }) // DER SET OF order
+	signed := bytes.Join(encoded, nil)
+	h := crypto.SHA256.New()
+	h.Write(set(signed))
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg := oidRSAEncryption
+	if keyType(key.Public()) != RSA {
+		sigAlg = oidECDSAWithSHA256
+	}
+	sha256 := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	sd := fullSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256},
+		ContentInfo:      innerContent{oidData, content},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: crt.Raw},
+		SignerInfos: []signerInfo{{
+			Version:                   1,
+			IssuerAndSerialNumber:     issuerAndSerial{asn1.RawValue{FullBytes: crt.RawIssuer}, crt.SerialNumber},
+			DigestAlgorithm:           sha256,
+			AuthenticatedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signed},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg, Parameters: asn1.NullRawValue},
+			EncryptedDigest:           sig,
+		}},
+	}
+	der, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{oidSignedData, asn1.RawValue{FullBytes: explicit(der)}})
+}
+
+// contentCipher returns the block cipher of a content encryption algorithm and its key size
+func contentCipher(oid asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case oid.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	case oid.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case oid.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	}
+	return nil, 0, fmt.Errorf("Unsupported PKCS#7 content encryption %v", oid)
+}
+
+// Envelope encrypts content for the recipient certificate, whose key must be RSA, as a PKCS#7
+// enveloped data using the given content encryption algorithm
+func Envelope(content []byte, recipient *x509.Certificate, alg asn1.ObjectIdentifier) ([]byte, error) {
+	pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Only RSA recipients are supported")
+	}
+	newCipher, size, err := contentCipher(alg)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	data := pad(content, block.BlockSize())
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	ivParam, _ := asn1.Marshal(iv)
+	der, err := asn1.Marshal(envelopedData{
+		RecipientInfos: []recipientInfo{{
+			IssuerAndSerialNumber:  issuerAndSerial{asn1.RawValue{FullBytes: recipient.RawIssuer}, recipient.SerialNumber},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           data,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{oidEnvelopedData, asn1.RawValue{FullBytes: explicit(der)}})
+}
+
+// OpenEnvelope decrypts a PKCS#7 enveloped data with the recipient RSA key, and returns the
+// content with its encryption algorithm
+func OpenEnvelope(der []byte, key crypto.Signer) ([]byte, asn1.ObjectIdentifier, error) {
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("Only RSA recipients are supported")
+	}
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, nil, fmt.Errorf("Not a PKCS#7 enveloped data")
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil || len(ed.RecipientInfos) == 0 {
+		return nil, nil, fmt.Errorf("Wrong PKCS#7 enveloped data: %v", err)
+	}
+	eci := ed.EncryptedContentInfo
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	newCipher, size, err := contentCipher(alg)
+	if err != nil {
+		return nil, nil, err
+	}
+	var contentKey []byte
+	for _, ri := range ed.RecipientInfos {
+		if contentKey, err = rsa.DecryptPKCS1v15(nil, priv, ri.EncryptedKey); err == nil && len(contentKey) == size {
+			break
+		}
+	}
+	if len(contentKey) != size {
+		return nil, nil, fmt.Errorf("The PKCS#7 content key could not be decrypted")
+	}
+	block, _ := newCipher(contentKey)
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil ||
+		len(iv) != block.BlockSize() {
+		return nil, nil, fmt.Errorf("Wrong PKCS#7 content encryption parameters")
+	}
+	data := eci.EncryptedContent
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, nil, fmt.Errorf("Wrong PKCS#7 encrypted content")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > block.BlockSize() || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, nil, fmt.Errorf("Wrong PKCS#7 encrypted content")
+	}
+	return plain[:len(plain)-n], alg, nil
+}
@@ -0,0 +1,30 @@
+package webca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestPKCS7(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "P7CA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "p7.example.com", ForDays(30))
+	dieOnError(t, err)
+	data, err := PKCS7(append([]*x509.Certificate{crt.Crt}, Chain(crt)...))
+	dieOnError(t, err)
+	var ci contentInfo
+	_, err = asn1.Unmarshal(data, &ci)
+	dieOnError(t, err)
+	var sd signedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	dieOnError(t, err)
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	dieOnError(t, err)
+	if !ci.ContentType.Equal(oidSignedData) || len(certs) != 2 ||
+		certs[0].Subject.CommonName != "p7.example.com" || certs[1].Subject.CommonName != "P7CA" {
+		t.Fatalf("Unexpected PKCS#7 contents: %v", certs)
+	}
+}
@@ -0,0 +1,139 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+)
+
+const (
+	KEY_EXPORT_ITERATIONS = 100000
+	ENCRYPTED_KEY_TYPE    = "ENCRYPTED PRIVATE KEY"
+)
+
+// PKCS#5 v2 (RFC 8018) object identifiers
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	PRF        pkix.AlgorithmIdentifier
+}
+
+// EncryptKey returns the private key as an encrypted PKCS#8 PEM block, protected with
+// AES-256-CBC and a key derived from the passphrase with PBKDF2-HMAC-SHA256
+func EncryptKey(key crypto.Signer, passphrase string) (*pem.Block, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("%s", tr("A passphrase is required!"))
+	}
+	plain, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := pbes2Cipher(passphrase, salt, KEY_EXPORT_ITERATIONS)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := pad(plain, block.BlockSize())
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	kdf, err := asn1.Marshal(pbkdf2Params{salt, KEY_EXPORT_ITERATIONS,
+		pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue}})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: ENCRYPTED_KEY_TYPE, Bytes: der}, nil
+}
+
+// DecryptKey decrypts an encrypted PKCS#8 PEM block as produced by EncryptKey
+func DecryptKey(b *pem.Block, passphrase string) (crypto.Signer, error) {
+	wrongKey := fmt.Errorf("%s", tr("Wrong passphrase or unsupported key encryption!"))
+	var epki encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(b.Bytes, &epki); err != nil || !epki.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, wrongKey
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(epki.Algorithm.Parameters.FullBytes, &params); err != nil ||
+		!params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) ||
+		!params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, wrongKey
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil ||
+		!kdf.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, wrongKey
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil ||
+		len(iv) != aes.BlockSize {
+		return nil, wrongKey
+	}
+	block, err := pbes2Cipher(passphrase, kdf.Salt, kdf.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	data := epki.EncryptedData
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, wrongKey
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > block.BlockSize() || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, wrongKey
+	}
+	return parseKey(&pem.Block{Type: "PRIVATE KEY", Bytes: plain[:len(plain)-n]})
+}
+
+// pbes2Cipher returns the AES-256 cipher keyed from the passphrase with PBKDF2-HMAC-SHA256
+func pbes2Cipher(passphrase string, salt []byte, iterations int) (cipher.Block, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	return aes.NewCipher(key)
+}
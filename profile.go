@@ -0,0 +1,90 @@
+package webca
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// updateProfile changes the full name and email of the user and, if newPasswd is given, their
+// password, which requires the current one
+func (cfg *config) updateProfile(username, fullname, email, oldPasswd, newPasswd string) (User, error) {
+	u, ok := cfg.Users[username]
+	if !ok {
+		return User{}, fmt.Errorf("%s", tr("User %s not found!", username))
+	}
+	u.Fullname, u.Email = strings.TrimSpace(fullname), strings.TrimSpace(email)
+	if newPasswd != "" {
+		if !checkPassword(u.Password, oldPasswd) {
+			return User{}, fmt.Errorf("%s", tr("Wrong current password!"))
+		}
+		if err := cfg.passwordPolicy().check(username, newPasswd); err != nil {
+			return User{}, err
+		}
+		hash, err := hashPassword(newPasswd)
+		if err != nil {
+			return User{}, err
+		}
+		u.Password = hash
+	}
+	err := cfg.update(func(cfg *config) error {
+		stored, ok := cfg.Users[username]
+		if !ok {
+			return fmt.Errorf("%s", tr("User %s not found!", username))
+		}
+		stored.Fullname, stored.Email = u.Fullname, u.Email
+		if newPasswd != "" {
+			stored.Password = u.Password
+		}
+		users := copyUsers(cfg.Users)
+		users[username] = stored
+		cfg.Users = users
+		u = stored
+		return nil
+	})
+	return u, err
+}
+
+// profile lets the logged user change their full name, email and password. A new password logs
+// out their other sessions and forgets their remembered devices
+func profile(w http.ResponseWriter, r *http.Request) {
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	me := requestUser(w, r)
+	u := *me
+	if r.Method == "POST" {
+		passwd := r.FormValue("Password")
+		if passwd != r.FormValue("Confirm") {
+			err = fmt.Errorf("%s", ps.tr("The passwords do not match!"))
+		} else {
+			u, err = cfg.updateProfile(me.Username, r.FormValue("Fullname"), r.FormValue("Email"),
+				r.FormValue("OldPassword"), passwd)
+		}
+		if err == nil {
+			s[LOGGEDUSER] = u
+			s.Save()
+			ps[LOGGEDUSER] = u
+			auditRequest(w, r, AUDIT_CONFIG, "user "+u.Username+" profile")
+			if passwd != "" {
+				err = logoutOthers(u.Username, s.Id())
+				cfg.forgetUser(u.Username)
+				auditRequest(w, r, AUDIT_SESSION_REVOKED, "other sessions of "+u.Username)
+			}
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+			u = *me
+		}
+	}
+	ps["U"] = u
+	ps["Policy"] = cfg.passwordPolicy()
+	err = templatesFor(r).ExecuteTemplate(w, "profile", ps)
+	handleError(w, r, err)
+}
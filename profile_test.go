@@ -0,0 +1,69 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	hash, err := hashPassword("Old-passwd-1")
+	dieOnError(t, err)
+	cachedCfg = &config{Users: map[string]User{"dave": {Username: "dave", Password: hash, Role: ROLE_OPERATOR}}}
+	login := func() *http.Request {
+		r := httptest.NewRequest("GET", "/profile", nil)
+		s, err := SessionFor(httptest.NewRecorder(), r)
+		dieOnError(t, err)
+		s[LOGGEDUSER] = cachedCfg.Users["dave"]
+		s.Save()
+		return r
+	}
+	current, other := login(), login()
+	defer logoutEverywhere("dave")
+	id := func(r *http.Request) string {
+		c, err := r.Cookie(SESSIONID)
+		dieOnError(t, err)
+		return c.Value
+	}
+	post := func(form string) string {
+		req := httptest.NewRequest("POST", "/profile", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id(current)})
+		w := httptest.NewRecorder()
+		profile(w, req)
+		return w.Body.String()
+	}
+
+	post("Fullname=Dave+C&Email=dave@example.com")
+	u := cachedCfg.Users["dave"]
+	if u.Fullname != "Dave C" || u.Email != "dave@example.com" || u.Password != hash {
+		t.Fatalf("Wrong profile saved: %+v", u)
+	}
+	if s := findSession(id(current)); s[LOGGEDUSER].(User).Fullname != "Dave C" {
+		t.Error("The session kept the former profile")
+	}
+	if findSession(id(other)) == nil {
+		t.Error("A profile change logged out the other sessions")
+	}
+	for _, form := range []string{
+		"Fullname=Dave&OldPassword=Wrong-passwd-1&Password=New-passwd-2&Confirm=New-passwd-2",
+		"Fullname=Dave&OldPassword=Old-passwd-1&Password=New-passwd-2&Confirm=New-passwd-3",
+		"Fullname=Dave&OldPassword=Old-passwd-1&Password=short&Confirm=short",
+	} {
+		if out := post(form); !strings.Contains(out, `class="notice"`) || cachedCfg.Users["dave"].Fullname != "Dave C" {
+			t.Errorf("The profile was saved: %s", form)
+		}
+	}
+	post("Fullname=Dave&Email=dave@example.com&OldPassword=Old-passwd-1&Password=New-passwd-2&Confirm=New-passwd-2")
+	if u = cachedCfg.Users["dave"]; !checkPassword(u.Password, "New-passwd-2") || u.Fullname != "Dave" {
+		t.Fatalf("The password was not changed: %+v", u)
+	}
+	if findSession(id(other)) != nil || findSession(id(current)) == nil {
+		t.Error("Wrong sessions logged out on a password change")
+	}
+}
@@ -0,0 +1,283 @@
+package webca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Profile is a named set of issuance settings, so they don't need to be entered every time
+type Profile struct {
+	Name           string
+	KeyType        string // RSA or ECDSA
+	KeyBits        int    // RSA modulus size or ECDSA curve size
+	ExtKeyUsage    []x509.ExtKeyUsage
+	Duration       int
+	Unit           string   // DAYS or HOURS
+	CNAsSAN        bool     // add the common name as a DNS alternative name
+	RequireSAN     bool     // refuse certificates with no alternative names
+	AllowedDomains []string // DNS alternative names must be within these domains (if any)
+}
+
+// ekuOptions lists the extended key usages a profile can choose from, in display order
+var ekuOptions = []x509.ExtKeyUsage{
+	x509.ExtKeyUsageServerAuth,
+	x509.ExtKeyUsageClientAuth,
+	x509.ExtKeyUsageCodeSigning,
+	x509.ExtKeyUsageEmailProtection,
+	x509.ExtKeyUsageTimeStamping,
+	x509.ExtKeyUsageOCSPSigning,
+}
+
+// IssueCert generates a Certificate named name signed by parent (or a self signed CA if
+// there is no parent) following the given issuance profile (if any)
+func IssueCert(parent *Cert, name pkix.Name, p Period, prof *Profile, sans ...string) (*Cert, error) {
+	return issueCert(parent, name, p, prof, nil, sans...)
+}
+
+// issueCert is IssueCert with the key of the certificate, generated if nil, which only a CA
+// can have kept out of webca
+func issueCert(parent *Cert, name pkix.Name, p Period, prof *Profile, key crypto.Signer, sans ...string) (*Cert, error) {
+	tmpl := newTemplate(name, p, sans)
+	if prof != nil {
+		if err := prof.apply(tmpl); err != nil {
+			return nil, err
+		}
+	}
+	if key != nil && parent != nil && !tmpl.IsCA {
+		return nil, fmt.Errorf("%s", tr("Only the CA keys can be kept in a KMS!"))
+	}
+	if prof != nil && key == nil {
+		var err error
+		if key, err = newKey(name.CommonName, parent == nil || tmpl.IsCA, prof.KeyType, prof.KeyBits); err != nil {
+			return nil, fmt.Errorf("Failed to generate private key: %s", err)
+		}
+	}
+	cert, err := genCert(parent, tmpl, key)
+	if err != nil {
+		return nil, err
+	}
+	publish(EVENT_ISSUE, cert.Crt)
+	return cert, nil
+}
+
+// IssueCertOnce is IssueCert for a certificate signed by parent whose generated key is returned
+// and never stored, for the policies that forbid keeping the keys on the server
+func IssueCertOnce(parent *Cert, name pkix.Name, p Period, prof *Profile, sans ...string) (*Cert, crypto.Signer, error) {
+	if parent == nil {
+		return nil, nil, fmt.Errorf("%s", tr("The key of a root CA must be stored!"))
+	}
+	if !LoadConfig().plainKeysAllowed() {
+		return nil, nil, fmt.Errorf("%s", tr("Unencrypted private key downloads are disabled!"))
+	}
+	keyType, bits := DEFAULT_KEY_TYPE, DEFAULT_KEY_BITS
+	if prof != nil {
+		keyType, bits = prof.KeyType, prof.KeyBits
+	}
+	key, err := genKey(keyType, bits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate private key: %s", err)
+	}
+	tmpl := newTemplate(name, p, sans)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: name,
+		DNSNames: tmpl.DNSNames, IPAddresses: tmpl.IPAddresses, EmailAddresses: tmpl.EmailAddresses,
+		URIs: tmpl.URIs}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := SignCSR(parent, csr, p, prof)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, key, nil
+}
+
+// check verifies the profile settings are usable
+func (p *Profile) check() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("%s", tr("The profile needs a name!"))
+	}
+	if p.Duration < 0 {
+		return fmt.Errorf("%s", tr("Wrong duration!"))
+	}
+	return checkKey(p.KeyType, p.KeyBits)
+}
+
+// apply enforces the profile on a certificate template
+func (p *Profile) apply(tmpl *x509.Certificate) error {
+	tmpl.ExtKeyUsage = p.ExtKeyUsage
+	if p.CNAsSAN && tmpl.Subject.CommonName != "" {
+		found := false
+		for _, dns := range tmpl.DNSNames {
+			found = found || dns == tmpl.Subject.CommonName
+		}
+		if !found {
+			tmpl.DNSNames = append([]string{tmpl.Subject.CommonName}, tmpl.DNSNames...)
+		}
+	}
+	if p.RequireSAN && len(SANs(tmpl)) == 0 {
+		return fmt.Errorf("%s", tr("Profile %s requires some alternative names!", p.Name))
+	}
+	if len(p.AllowedDomains) == 0 {
+		return nil
+	}
+	for _, dns := range tmpl.DNSNames {
+		if !p.allowed(dns) {
+			return fmt.Errorf("%s", tr("Profile %s does not allow %s!", p.Name, dns))
+		}
+	}
+	return nil
+}
+
+// allowed tells whether or not a DNS name is within the profile's allowed domains
+func (p *Profile) allowed(dns string) bool {
+	dns = strings.ToLower(strings.TrimSuffix(dns, "."))
+	for _, domain := range p.AllowedDomains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(domain, "."), "*."))
+		if dns == domain || strings.HasSuffix(dns, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasEKU tells whether or not the profile includes the given extended key usage
+func (p *Profile) HasEKU(eku x509.ExtKeyUsage) bool {
+	for _, u := range p.ExtKeyUsage {
+		if u == eku {
+			return true
+		}
+	}
+	return false
+}
+
+// certSetup returns a CertSetup prefilled with the profile validity
+func (p *Profile) certSetup(name pkix.Name) *CertSetup {
+	return &CertSetup{Name: name, Duration: p.Duration, Unit: p.Unit}
+}
+
+// getProfile returns the named profile or nil if there is no such profile
+func (cfg *config) getProfile(name string) *Profile {
+	if cfg == nil || cfg.Profiles == nil {
+		return nil
+	}
+	if p, ok := cfg.Profiles[name]; ok {
+		return &p
+	}
+	return nil
+}
+
+// profileNames returns the names of all configured profiles in order
+func (cfg *config) profileNames() []string {
+	names := make([]string, 0)
+	if cfg == nil {
+		return names
+	}
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readProfile reads a profile from the request
+func readProfile(r *http.Request) (*Profile, error) {
+	p := &Profile{Name: strings.TrimSpace(r.FormValue("Name")), KeyType: r.FormValue("KeyType")}
+	var err error
+	if bits := r.FormValue("KeyBits"); bits != "" {
+		if p.KeyBits, err = strconv.Atoi(bits); err != nil {
+			return nil, fmt.Errorf("%s: %v", tr("Wrong key size!"), bits)
+		}
+	}
+	for _, eku := range r.Form["ExtKeyUsage"] {
+		u, err := strconv.Atoi(eku)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tr("Wrong key usage!"), eku)
+		}
+		p.ExtKeyUsage = append(p.ExtKeyUsage, x509.ExtKeyUsage(u))
+	}
+	if duration := r.FormValue("Duration"); duration != "" {
+		if p.Duration, err = strconv.Atoi(duration); err != nil {
+			return nil, fmt.Errorf("%s: %v", tr("Wrong duration!"), duration)
+		}
+	}
+	p.Unit = DAYS
+	if r.FormValue("Unit") == HOURS {
+		p.Unit = HOURS
+	}
+	p.CNAsSAN = r.FormValue("CNAsSAN") != ""
+	p.RequireSAN = r.FormValue("RequireSAN") != ""
+	p.AllowedDomains = splitSANs(r.FormValue("AllowedDomains"))
+	return p, p.check()
+}
+
+// setProfile saves the named profile, or deletes it if nil
+func (cfg *config) setProfile(name string, prof *Profile) error {
+	return cfg.update(func(cfg *config) error {
+		profiles := make(map[string]Profile, len(cfg.Profiles)+1)
+		for n, p := range cfg.Profiles {
+			profiles[n] = p
+		}
+		if prof == nil {
+			delete(profiles, name)
+		} else {
+			profiles[name] = *prof
+		}
+		cfg.Profiles = profiles
+		return nil
+	})
+}
+
+// profiles allows the web user to list, create, edit and delete issuance profiles
+func profiles(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	prof := &Profile{KeyType: DEFAULT_KEY_TYPE, KeyBits: DEFAULT_KEY_BITS, Duration: 365, Unit: DAYS,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	if r.Method == "POST" {
+		var err error
+		switch r.FormValue("action") {
+		case "delete":
+			err = cfg.setProfile(r.FormValue("Name"), nil)
+		default:
+			var p *Profile
+			if p, err = readProfile(r); p != nil {
+				prof = p
+			}
+			if err == nil {
+				err = cfg.setProfile(prof.Name, prof)
+			}
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_CONFIG, strings.TrimSpace("profile "+r.FormValue("Name")+" "+r.FormValue("action")))
+			http.Redirect(w, r, "/profiles", 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	} else if p := cfg.getProfile(r.FormValue("name")); p != nil {
+		prof = p
+	}
+	ps["Profile"] = prof
+	ps["Profiles"] = cfg.Profiles
+	ps["EKUs"] = ekuOptions
+	err := templatesFor(r).ExecuteTemplate(w, "profiles", ps)
+	handleError(w, r, err)
+}
+
+// ekuName returns the display name for an extended key usage
+func ekuName(eku x509.ExtKeyUsage) string {
+	return tr("%s", extKeyUsages[eku])
+}
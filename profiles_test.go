@@ -0,0 +1,113 @@
+package webca
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "ProfileCA"}, ForDays(365))
+	dieOnError(t, err)
+	prof := &Profile{Name: "web", KeyType: ECDSA, KeyBits: 384, CNAsSAN: true,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, AllowedDomains: []string{"example.com"}}
+	dieOnError(t, prof.check())
+	crt, err := IssueCert(ca, pkix.Name{CommonName: "www.example.com"}, ForDays(30), prof, "api.example.com")
+	dieOnError(t, err)
+	if keyType(crt.Key) != ECDSA {
+		t.Fatalf("Expected an ECDSA key but got %T", crt.Key)
+	}
+	if strings.Join(crt.Crt.DNSNames, ",") != "www.example.com,api.example.com" {
+		t.Fatalf("The common name was not added as alternative name: %v", crt.Crt.DNSNames)
+	}
+	reloaded, err := readCert("www.example.com")
+	dieOnError(t, err)
+	if !sameKey(reloaded.Key, crt.Key) {
+		t.Fatal("The ECDSA key did not survive a reload!")
+	}
+	if _, err := IssueCert(ca, pkix.Name{CommonName: "www.example.org"}, ForDays(30), prof); err == nil {
+		t.Fatal("The profile allowed a domain out of its allowed domains!")
+	}
+	weak := &Profile{Name: "weak", KeyType: RSA, KeyBits: 1024}
+	if weak.check() == nil {
+		t.Fatal("The profile allowed a weak RSA key!")
+	}
+}
+
+func TestNoStoredKey(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{}}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "OnceCA"}, ForDays(365))
+	dieOnError(t, err)
+	if _, _, err := IssueCertOnce(nil, pkix.Name{CommonName: "OnceRoot"}, ForDays(30), nil); err == nil {
+		t.Error("Root CA issued without storing its key")
+	}
+
+	form := url.Values{"parent": {"OnceCA"}, "Cert.CommonName": {"once.example.com"}, "Cert.Duration": {"30"},
+		"NoStoredKey": {"1"}}
+	req := httptest.NewRequest("POST", "/gen", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	accessControl(gen).ServeHTTP(w, req)
+	id := waitJob(t, w, "fuser")
+	failed := fmt.Errorf("failed")
+	if _, _, err := takeJobCert(id, "fuser", func(c *Cert) ([]byte, error) { return nil, failed }); err != failed {
+		t.Fatalf("The packaging error was lost: %v", err)
+	}
+	if st := jobStatus(id, "fuser"); st == nil || !st.Key {
+		t.Fatal("The key that is not stored was lost by a failed download")
+	}
+	req = httptest.NewRequest("POST", "/job", strings.NewReader(url.Values{"id": {id}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	accessControl(jobPage).ServeHTTP(w, req)
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Certificate package not downloaded: %d %v", w.Code, err)
+	}
+	if _, _, err := takeJobCert(id, "fuser", func(c *Cert) ([]byte, error) { return nil, nil }); err == nil {
+		t.Error("The key that is not stored was downloaded twice")
+	}
+	keys := 0
+	for _, f := range zr.File {
+		if f.Name == "key.pem" {
+			keys++
+		}
+	}
+	c := FindCert("once.example.com")
+	if keys != 1 || c == nil || c.Key != nil || c.Crt.CheckSignatureFrom(ca.Crt) != nil {
+		t.Fatalf("Wrong issuance without stored key: %d keys, %v", keys, c)
+	}
+	if _, err := storage.Get(keyFile(*c)); err == nil {
+		t.Error("The key was stored")
+	}
+
+	w = httptest.NewRecorder()
+	api(w, httptest.NewRequest("POST", API_PREFIX+"certs",
+		strings.NewReader(`{"name": "api-once.example.com", "parent": "OnceCA", "days": 30, "noStoredKey": true}`)))
+	var info CertInfo
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &info) != nil ||
+		!strings.Contains(info.Key, "PRIVATE KEY") || info.HasKey {
+		t.Fatalf("Key not returned by the API: %d %s", w.Code, w.Body.String())
+	}
+	if c := FindCert("api-once.example.com"); c == nil || c.Key != nil {
+		t.Errorf("The key of the API certificate was stored: %v", c)
+	}
+	cachedCfg.NoPlainKeys = true
+	if _, _, err := IssueCertOnce(ca, pkix.Name{CommonName: "plain.example.com"}, ForDays(30), nil); err == nil {
+		t.Error("Key returned with the unencrypted key downloads disabled")
+	}
+}
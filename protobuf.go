@@ -0,0 +1,118 @@
+package webca
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// protobuf wire types
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// pbField is a decoded protobuf field, either a varint or a length delimited value
+type pbField struct {
+	Num    int
+	Varint uint64
+	Bytes  []byte
+}
+
+// pbWriter encodes protobuf messages, skipping the fields with default values as proto3 does
+type pbWriter struct {
+	buf []byte
+}
+
+// tag writes a field key
+func (w *pbWriter) tag(num, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(num<<3|wireType))
+}
+
+// uint writes a varint field
+func (w *pbWriter) uint(num int, v uint64) {
+	if v != 0 {
+		w.tag(num, pbVarint)
+		w.buf = binary.AppendUvarint(w.buf, v)
+	}
+}
+
+// int writes a signed (int32 or int64, not zigzag) varint field
+func (w *pbWriter) int(num int, v int64) {
+	w.uint(num, uint64(v))
+}
+
+// bool writes a bool field
+func (w *pbWriter) bool(num int, v bool) {
+	if v {
+		w.uint(num, 1)
+	}
+}
+
+// bytes writes a bytes field
+func (w *pbWriter) bytes(num int, v []byte) {
+	if len(v) > 0 {
+		w.message(num, v)
+	}
+}
+
+// string writes a string field
+func (w *pbWriter) string(num int, v string) {
+	w.bytes(num, []byte(v))
+}
+
+// strings writes a repeated string field
+func (w *pbWriter) strings(num int, vs []string) {
+	for _, v := range vs {
+		w.message(num, []byte(v))
+	}
+}
+
+// message writes an embedded message field, even if empty
+func (w *pbWriter) message(num int, v []byte) {
+	w.tag(num, pbBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// pbParse decodes all the fields of a protobuf message
+func pbParse(b []byte) ([]pbField, error) {
+	fields := make([]pbField, 0)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("Wrong protobuf field key")
+		}
+		b = b[n:]
+		f := pbField{Num: int(key >> 3)}
+		switch key & 7 {
+		case pbVarint:
+			if f.Varint, n = binary.Uvarint(b); n <= 0 {
+				return nil, fmt.Errorf("Wrong protobuf varint on field %d", f.Num)
+			}
+			b = b[n:]
+		case pbBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, fmt.Errorf("Wrong protobuf length on field %d", f.Num)
+			}
+			f.Bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case pbFixed64, pbFixed32:
+			size := 8
+			if key&7 == pbFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, fmt.Errorf("Wrong protobuf fixed size on field %d", f.Num)
+			}
+			b = b[size:]
+			continue // not used by WebCA messages
+		default:
+			return nil, fmt.Errorf("Unsupported protobuf wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
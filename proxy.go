@@ -0,0 +1,143 @@
+package webca
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// trustedProxies are the networks of the proxies whose X-Forwarded-* headers are believed
+var trustedProxies []*net.IPNet
+
+// parseProxies reads the comma separated addresses or CIDR networks of the trusted proxies
+func parseProxies(list string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Wrong trusted proxy %q", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong trusted proxy %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trusted tells whether or not the address is a trusted proxy's
+func trusted(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	for _, n := range trustedProxies {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// basePath returns the URL prefix the app is served under, without the trailing slash
+func (o Options) basePath() string {
+	p := strings.Trim(o.BasePath, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// base returns the base path to the templates, for their links
+func base() string {
+	return options.basePath()
+}
+
+// behindProxy takes the client address, scheme and host from the X-Forwarded-* headers of the
+// trusted proxies and serves h under the base path, which the redirects get back
+func behindProxy(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if trusted(r.RemoteAddr) {
+			forwarded(r)
+		}
+		base := options.basePath()
+		if base == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path != base && !strings.HasPrefix(r.URL.Path, base+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, base), "/")
+		r2.URL.RawPath = ""
+		h.ServeHTTP(&basePathWriter{w, base}, r2)
+	})
+}
+
+// forwarded applies the X-Forwarded-* headers to the request, the client being the last address
+// added by a proxy that is not trusted
+func forwarded(r *http.Request) {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			r.RemoteAddr = hop
+			if !trusted(hop) {
+				break
+			}
+		}
+	}
+	if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "https" || proto == "http" {
+		r.URL.Scheme = proto
+	}
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		r.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+	}
+}
+
+// requestScheme returns the scheme the client used, told by the proxy if trusted
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.URL.Scheme == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// basePathWriter adds the base path to the local redirections
+type basePathWriter struct {
+	http.ResponseWriter
+	base string
+}
+
+func (bw *basePathWriter) WriteHeader(code int) {
+	if loc := bw.Header().Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		bw.Header().Set("Location", bw.base+loc)
+	}
+	bw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap gives http.ResponseController the original writer
+func (bw *basePathWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
@@ -0,0 +1,66 @@
+package webca
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	if _, err := parseProxies("10.0.0.1, nonsense"); err == nil {
+		t.Error("A wrong proxy was accepted")
+	}
+	defer func(saved Options, proxies []*net.IPNet) { options, trustedProxies = saved, proxies }(options, trustedProxies)
+	proxies, err := parseProxies("10.0.0.0/8, ::1")
+	dieOnError(t, err)
+	options, trustedProxies = Options{BasePath: "/webca/"}, proxies
+	var got *http.Request
+	h := behindProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}))
+
+	r := httptest.NewRequest("GET", "http://webca.internal/webca/cert?id=1", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.9.9.9")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "ca.example.com")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if got == nil || got.URL.Path != "/cert" || remoteAddr(got) != "203.0.113.7" || got.Host != "ca.example.com" {
+		t.Fatalf("Wrong proxied request: %+v", got)
+	}
+	if webBase(got) != "https://ca.example.com/webca" || webOrigin(got) != "https://ca.example.com" {
+		t.Errorf("Wrong URLs: %s %s", webBase(got), webOrigin(got))
+	}
+	if c := sessionCookie(got, "id"); c.Path != "/webca/" || !c.Secure {
+		t.Errorf("Wrong session cookie: %v", c)
+	}
+	if loc := rr.Header().Get("Location"); loc != "/webca/login" {
+		t.Errorf("The redirection is not under the base path: %s", loc)
+	}
+
+	got = nil
+	r = httptest.NewRequest("GET", "http://webca.internal/webca/", nil)
+	r.RemoteAddr = "192.0.2.1:4567"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got == nil || got.URL.Path != "/" || remoteAddr(got) != "192.0.2.1" || requestScheme(got) != "http" {
+		t.Errorf("The headers of an untrusted client were used: %+v", got)
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "http://webca.internal/other/", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("A path out of the base one was served: %d", rr.Code)
+	}
+
+	var buf bytes.Buffer
+	dieOnError(t, templates.ExecuteTemplate(&buf, "login", PageStatus{}))
+	if !strings.Contains(buf.String(), `action="/webca/login"`) {
+		t.Error("The links are not under the base path")
+	}
+}
@@ -0,0 +1,124 @@
+package webca
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_REQUESTS  = 600 // requests per minute from an address, if there are no limits
+	RATE_BURST     = 100 // requests over the rate allowed at once, if there are no limits
+	RATE_LOGINS    = 10  // logins per minute from an address, if there are no limits
+	RATE_DOWNLOADS = 60  // downloads per minute from an address, if there are no limits
+)
+
+// RateLimits throttle the requests of every IP address, with stricter limits for the logins and the
+// downloads. 0 never limits them
+type RateLimits struct {
+	Requests  int // requests per minute
+	Burst     int // requests over the rate allowed at once
+	Logins    int // logins per minute, all at once at most
+	Downloads int // certificate, key and bundle downloads per minute, all at once at most
+}
+
+// rate limited paths, the prefixes ending in /
+var (
+	loginPaths    = []string{"/login", "/webauthn/login/", "/oidc/login"}
+	downloadPaths = []string{"/cert/", "/p12", "/p7b", "/fullchain", "/package", "/keyExport", "/bulkZip",
+		DOWNLOAD_LINK_PATH, "/ca-bundle.pem", "/ca-bundle.der", "/ca-bundle.p7b"}
+)
+
+// bucket holds the tokens an address has to spend in requests
+type bucket struct {
+	tokens     float64
+	last, full time.Time // when it was last used, and will be full again
+}
+
+// buckets by "class ip", in memory
+var buckets = make(map[string]*bucket)
+
+// buckets lock, and when they were last pruned
+var (
+	sbuckets sync.Mutex
+	pruned   time.Time
+)
+
+// rateLimits returns the configured rate limits or the default ones
+func (cfg *config) rateLimits() RateLimits {
+	if cfg == nil || cfg.Rates == nil {
+		return RateLimits{RATE_REQUESTS, RATE_BURST, RATE_LOGINS, RATE_DOWNLOADS}
+	}
+	return *cfg.Rates
+}
+
+// matches tells whether or not the path is one of paths or under one of their prefixes
+func matches(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow spends a token of the address in the class, refilled at rate per minute up to size. It
+// returns how long until there is one when there are none left
+func allow(class, addr string, rate, size int, now time.Time) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+	perToken := time.Minute / time.Duration(rate)
+	sbuckets.Lock()
+	defer sbuckets.Unlock()
+	if now.Sub(pruned) > time.Minute { // forget the full ones
+		for key, b := range buckets {
+			if now.After(b.full) {
+				delete(buckets, key)
+			}
+		}
+		pruned = now
+	}
+	key := class + " " + addr
+	b := buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(size), last: now}
+		buckets[key] = b
+	}
+	b.tokens = math.Min(float64(size), b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(size) - b.tokens) * float64(perToken)))
+	return true, 0
+}
+
+// rateLimit rejects the requests of the addresses over their limits, with a page telling them
+// when to try again
+func rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, addr, now := LoadConfig().rateLimits(), remoteAddr(r), time.Now()
+		ok, wait := allow("all", addr, l.Requests, l.Requests+l.Burst, now)
+		if ok && matches(r.URL.Path, loginPaths) {
+			ok, wait = allow("login", addr, l.Logins, l.Logins, now)
+		} else if ok && matches(r.URL.Path, downloadPaths) {
+			ok, wait = allow("download", addr, l.Downloads, l.Downloads, now)
+		}
+		if ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.WriteHeader(http.StatusTooManyRequests)
+		ps := newPageStatus(r)
+		ps["Wait"] = seconds
+		err := templatesFor(r).ExecuteTemplate(w, "tooManyRequests", ps)
+		handleError(w, r, err)
+	})
+}
@@ -0,0 +1,56 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	defer func() { buckets = make(map[string]*bucket) }()
+	cachedCfg = &config{Rates: &RateLimits{Requests: 60, Burst: 2, Logins: 2}}
+	h := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(path, addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = addr + ":1234"
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		return rr
+	}
+	for i := 0; i < 2; i++ {
+		if rr := get("/login", "192.0.2.1"); rr.Code != http.StatusOK {
+			t.Fatalf("Login %d was limited: %d", i, rr.Code)
+		}
+	}
+	rr := get("/login", "192.0.2.1")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "30" ||
+		!strings.Contains(rr.Body.String(), "30 seconds") {
+		t.Errorf("Too many logins were not limited: %d %s", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if rr := get("/login", "192.0.2.2"); rr.Code != http.StatusOK {
+		t.Errorf("Another address was limited: %d", rr.Code)
+	}
+	for i := 0; i < 62; i++ { // the rate plus the burst, downloads not being limited
+		get("/cert/x.pem", "192.0.2.3")
+	}
+	if rr := get("/", "192.0.2.3"); rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Too many requests were not limited: %d %s", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	now := time.Now()
+	if ok, _ := allow("test", "a", 60, 1, now); !ok {
+		t.Fatal("The first request was not allowed")
+	}
+	if ok, wait := allow("test", "a", 60, 1, now.Add(500*time.Millisecond)); ok || wait != 500*time.Millisecond {
+		t.Errorf("Wrong wait: %v %v", ok, wait)
+	}
+	if ok, _ := allow("test", "a", 60, 1, now.Add(1500*time.Millisecond)); !ok {
+		t.Error("The bucket was not refilled")
+	}
+	if ok, _ := allow("test", "a", 0, 0, now); !ok {
+		t.Error("A request was limited without limits")
+	}
+}
@@ -0,0 +1,55 @@
+package webca
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// startRedirect serves, in the background, the plain HTTP port of the options redirecting
+// everything to the HTTPS address, so the bare host name reaches the UI. It is port 80 when the
+// web certificate is got through ACME, to answer its challenges
+func startRedirect(a address) {
+	redirectPort := options.RedirectPort
+	if redirectPort == 0 && options.AutocertHost != "" {
+		redirectPort = 80
+	}
+	if redirectPort == 0 {
+		return
+	}
+	host, port, err := net.SplitHostPort(a.addr)
+	if err != nil {
+		log.Printf("(Warning) No HTTP redirection to %v: %s", a, err)
+		return
+	}
+	if options.Bind == "" {
+		host = "" // the certificate name may not resolve to a local address
+	}
+	listen := net.JoinHostPort(host, strconv.Itoa(redirectPort+portFix))
+	go func() {
+		log.Printf("Redirecting http://%s to HTTPS port %s...", listen, port)
+		if err := http.ListenAndServe(listen, redirectHandler(port)); err != nil {
+			log.Printf("(Warning) HTTP redirection stopped: %s", err)
+		}
+	}()
+}
+
+// redirectHandler moves the requests permanently to the same URL with HTTPS on the port, but for
+// the ACME challenges
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if serveChallenge(w, r) {
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != fmt.Sprint(PORT) {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,41 @@
+package webca
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRedirect(t *testing.T) {
+	for port, want := range map[string]string{"443": "https://webca.test/cert?id=1", "8443": "https://webca.test:8443/cert?id=1"} {
+		rr := httptest.NewRecorder()
+		redirectHandler(port).ServeHTTP(rr, httptest.NewRequest("GET", "http://webca.test:80/cert?id=1", nil))
+		if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != want {
+			t.Errorf("Wrong redirection to port %s: %d %s", port, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	defer func(saved Options) { options = saved }(options)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	options = Options{Bind: "127.0.0.1", RedirectPort: port}
+	startRedirect(address{addr: "127.0.0.1:8443", tls: true})
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d/", port)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dieOnError(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://127.0.0.1:8443/" {
+		t.Errorf("Wrong redirection: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,268 @@
+package webca
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REDIS_TIMEOUT   = 5 * time.Second
+	REDIS_PREFIX    = "webca:session:" // of the session keys
+	REDIS_MAX_BULK  = 1 << 20          // bytes of a session
+	REDIS_MAX_DEPTH = 4                // nesting of the arrays replied
+)
+
+// Redis shares the web sessions among the WebCA instances behind a load balancer
+type Redis struct {
+	Addr     string // host:port of the server
+	Password string // AUTH password, none if empty
+	DB       int    // database number
+	TLS      bool   // connects over TLS
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisStore keeps the sessions in Redis, expiring them with the session limits. It talks
+// RESP over a single connection, dialed again when it breaks
+type redisStore struct {
+	Redis
+	mutex sync.Mutex
+	conn  net.Conn
+	rd    *bufio.Reader
+}
+
+// the store of the current Redis settings
+var (
+	sredis        sync.Mutex
+	redisSessions *redisStore
+)
+
+// init registers the types the sessions hold
+func init() {
+	gob.Register(User{})
+	gob.Register(oidcState{})
+	gob.Register(time.Time{})
+}
+
+// sharedStore returns the Redis store of the config, nil if the sessions stay in memory
+func sharedStore() sessionStore {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.Redis == nil {
+		return nil
+	}
+	sredis.Lock()
+	defer sredis.Unlock()
+	if redisSessions == nil || redisSessions.Redis != *cfg.Redis {
+		if redisSessions != nil {
+			redisSessions.close()
+		}
+		redisSessions = &redisStore{Redis: *cfg.Redis}
+	}
+	return redisSessions
+}
+
+// load returns the session stored under the ID, nil if there is none or it has expired
+func (rs *redisStore) load(id string) (session, error) {
+	reply, err := rs.do("GET", REDIS_PREFIX+id)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected Redis reply %v", reply)
+	}
+	s := make(session)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// store saves the session until it expires
+func (rs *redisStore) store(s session) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		return err
+	}
+	ttl := LoadConfig().sessionLimits().ttl(s, time.Now())
+	if ttl < time.Second {
+		return rs.remove(s.Id())
+	}
+	_, err := rs.do("SET", REDIS_PREFIX+s.Id(), buf.String(), "EX", strconv.Itoa(int(ttl/time.Second)))
+	return err
+}
+
+// remove deletes the session
+func (rs *redisStore) remove(id string) error {
+	_, err := rs.do("DEL", REDIS_PREFIX+id)
+	return err
+}
+
+// list returns all the stored sessions, scanning their keys
+func (rs *redisStore) list() ([]session, error) {
+	list := make([]session, 0)
+	for cursor := "0"; ; {
+		reply, err := rs.do("SCAN", cursor, "MATCH", REDIS_PREFIX+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("Unexpected Redis reply %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			k, _ := key.([]byte)
+			s, err := rs.load(strings.TrimPrefix(string(k), REDIS_PREFIX))
+			if err != nil {
+				return nil, err
+			} else if s != nil { // expired since the scan
+				list = append(list, s)
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return list, nil
+		}
+	}
+}
+
+// do sends the command and returns its reply: a string, an int64, a []byte, an []interface{} or nil. A broken
+// connection is dialed again once
+func (rs *redisStore) do(args ...string) (interface{}, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	for retry := false; ; retry = true {
+		if rs.conn == nil {
+			if err := rs.dial(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := rs.roundTrip(args)
+		if _, replied := err.(redisError); err == nil || replied || retry {
+			return reply, err
+		}
+		rs.conn.Close()
+		rs.conn = nil
+	}
+}
+
+// dial connects, authenticates and selects the database
+func (rs *redisStore) dial() error {
+	dialer := &net.Dialer{Timeout: REDIS_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if rs.TLS {
+		host, _, _ := net.SplitHostPort(rs.Addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", rs.Addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", rs.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	rs.conn, rs.rd = conn, bufio.NewReader(conn)
+	if rs.Password != "" {
+		_, err = rs.roundTrip([]string{"AUTH", rs.Password})
+	}
+	if err == nil && rs.DB != 0 {
+		_, err = rs.roundTrip([]string{"SELECT", strconv.Itoa(rs.DB)})
+	}
+	if err != nil {
+		rs.conn.Close()
+		rs.conn = nil
+	}
+	return err
+}
+
+// close drops the connection
+func (rs *redisStore) close() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if rs.conn != nil {
+		rs.conn.Close()
+		rs.conn = nil
+	}
+}
+
+// roundTrip writes the command as an array of bulk strings and reads its reply
+func (rs *redisStore) roundTrip(args []string) (interface{}, error) {
+	rs.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := rs.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRESP(rs.rd)
+}
+
+// readRESP reads a simple string, error, integer, bulk string or array reply
+func readRESP(rd *bufio.Reader) (interface{}, error) {
+	return readRESPItem(rd, 0)
+}
+
+// readRESPItem reads a reply nested in arrays at the given depth
+func readRESPItem(rd *bufio.Reader, depth int) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("Wrong Redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n > REDIS_MAX_BULK {
+			return nil, fmt.Errorf("Wrong Redis bulk length %q", value)
+		} else if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n > REDIS_MAX_BULK || depth > REDIS_MAX_DEPTH {
+			return nil, fmt.Errorf("Wrong Redis array length %q", value)
+		} else if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readRESPItem(rd, depth+1)
+			if _, replied := err.(redisError); err != nil && !replied {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("Unexpected Redis reply %q", line)
+}
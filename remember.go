@@ -0,0 +1,191 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	REMEMBERME      = "goRememberMe"    // cookie of the remember me token, "series:validator"
+	REMEMBER_DAYS   = 30                // days a device stays logged in
+	PENDINGREMEMBER = "PendingRemember" // session key: remember the device once the passkey confirms the login
+)
+
+// RememberToken keeps a user logged in on a device. Its validator changes on every use and only
+// its hash is stored, so a stolen cookie used by someone else shows up as a reused validator
+type RememberToken struct {
+	Series   string // public identifier of the device, kept across the rotations
+	Username string
+	Hash     string // SHA-256 of the current validator, in hex
+	Expires  time.Time
+}
+
+// rememberCookie returns the remember me cookie, with the attributes of the session one
+func rememberCookie(r *http.Request, value string, expires time.Time) *http.Cookie {
+	cookie := sessionCookie(r, value)
+	cookie.Name = REMEMBERME
+	cookie.MaxAge = int(time.Until(expires) / time.Second)
+	if cookie.MaxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// newValidator returns a random validator in hex
+func newValidator() (string, error) {
+	secret := make([]byte, TOKEN_BYTES)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// remember issues a remember me token for the user on the device of the request
+func (cfg *config) remember(w http.ResponseWriter, r *http.Request, username string) error {
+	series, err := newValidator()
+	if err != nil {
+		return err
+	}
+	validator, err := newValidator()
+	if err != nil {
+		return err
+	}
+	t := RememberToken{Series: series[:32], Username: username, Hash: hashToken(validator),
+		Expires: time.Now().AddDate(0, 0, REMEMBER_DAYS)}
+	err = cfg.update(func(cfg *config) error {
+		kept := make([]RememberToken, 0, len(cfg.Remembered)+1)
+		for _, old := range cfg.Remembered {
+			if time.Now().Before(old.Expires) {
+				kept = append(kept, old)
+			}
+		}
+		cfg.Remembered = append(kept, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, rememberCookie(r, t.Series+":"+validator, t.Expires))
+	return nil
+}
+
+// rememberedUser returns the user remembered on the device of the request, and rotates its
+// validator. A reused validator forgets all the devices of the user
+func (cfg *config) rememberedUser(w http.ResponseWriter, r *http.Request) (User, error) {
+	cookie, err := r.Cookie(REMEMBERME)
+	if err != nil || cfg == nil {
+		return User{}, err
+	}
+	validator, err := newValidator()
+	if err != nil {
+		return User{}, err
+	}
+	parts := strings.SplitN(cookie.Value, ":", 2)
+	invalid := fmt.Errorf("%s", tr("The remember me token is not valid!"))
+	var t RememberToken
+	var reused bool
+	err = cfg.update(func(cfg *config) error {
+		for i, rt := range cfg.Remembered {
+			if len(parts) != 2 || rt.Series != parts[0] {
+				continue
+			}
+			t = rt
+			if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(parts[1]))) != 1 {
+				reused = true
+				cfg.Remembered = cfg.rememberedBut(t.Username)
+				return nil
+			}
+			if time.Now().After(t.Expires) || !cfg.activeUser(t.Username) {
+				break
+			}
+			remembered := append([]RememberToken(nil), cfg.Remembered...)
+			remembered[i].Hash = hashToken(validator)
+			cfg.Remembered = remembered
+			return nil
+		}
+		return invalid
+	})
+	if reused {
+		log.Printf("(Warning) Remember me token of %s reused, forgetting all their devices", t.Username)
+		http.SetCookie(w, rememberCookie(r, "", time.Time{}))
+		return User{}, fmt.Errorf("%s", tr("The remember me token was already used!"))
+	}
+	if err == invalid {
+		http.SetCookie(w, rememberCookie(r, "", time.Time{}))
+	}
+	if err != nil {
+		return User{}, err
+	}
+	http.SetCookie(w, rememberCookie(r, t.Series+":"+validator, t.Expires))
+	return cfg.getUser(t.Username), nil
+}
+
+// rememberLogin logs in the session with the remember me token of the request, if it has a valid one
+func rememberLogin(w http.ResponseWriter, r *http.Request, s session) bool {
+	if _, err := r.Cookie(REMEMBERME); err != nil {
+		return false
+	}
+	u, err := LoadConfig().rememberedUser(w, r)
+	if err == nil {
+		err = admitLogin(u.Username, s.Id(), remoteAddr(r))
+	}
+	if err != nil {
+		audit(AUDIT_LOGIN_FAILED, "", remoteAddr(r), "remember me: "+err.Error())
+		return false
+	}
+	audit(AUDIT_LOGIN, u.Username, remoteAddr(r), "remember me")
+	s[LOGGEDUSER] = u
+	return s.Renew(w, r) == nil
+}
+
+// forget drops the remember me token of the device of the request, on logout
+func (cfg *config) forget(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(REMEMBERME)
+	if err != nil || cfg == nil {
+		return
+	}
+	series := strings.SplitN(cookie.Value, ":", 2)[0]
+	var username string
+	err = cfg.update(func(cfg *config) error {
+		for i, t := range cfg.Remembered {
+			if t.Series == series {
+				username = t.Username
+				cfg.Remembered = append(cfg.Remembered[:i:i], cfg.Remembered[i+1:]...)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("(Warning) Could not forget the device of %s: %s", username, err)
+	}
+	http.SetCookie(w, rememberCookie(r, "", time.Time{}))
+}
+
+// forgetUser drops the remember me tokens of all the devices of the user
+func (cfg *config) forgetUser(username string) {
+	err := cfg.update(func(cfg *config) error {
+		cfg.Remembered = cfg.rememberedBut(username)
+		return nil
+	})
+	if err != nil {
+		log.Printf("(Warning) Could not forget the devices of %s: %s", username, err)
+	}
+}
+
+// rememberedBut returns the remember me tokens of the devices of the other users, in a new slice
+func (cfg *config) rememberedBut(username string) []RememberToken {
+	kept := make([]RememberToken, 0, len(cfg.Remembered))
+	for _, t := range cfg.Remembered {
+		if t.Username != username {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
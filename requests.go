@@ -0,0 +1,379 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SUBMIT_PATH     = "/submit" // unauthenticated certificate requests with the submit token
+	REQUESTS_MAX    = 1000      // pending certificate requests, so anonymous submitters can't fill the config
+	REQUEST_MAX_CSR = 64 << 10  // bytes of the PEM certificate request
+)
+
+// CertRequest is a certificate request waiting for an operator to approve or reject it
+type CertRequest struct {
+	ID        string
+	CSR       string // PEM, the private key stays with the submitter
+	Name      string // of the certificate, the common name of the CSR unless edited
+	Parent    string // CA issuing the certificate, chosen on approval if empty
+	Days      int    // of validity, the profile ones if 0
+	Profile   string
+	By        string // submitting user, empty for the submit token
+	Email     string // notified of the outcome, if any
+	Org       string // organization of the submitting user
+	Submitted time.Time
+}
+
+// SubmitRequest asks the submit endpoint for a certificate, with the submit token as bearer
+type SubmitRequest struct {
+	CSR     string `json:"csr"` // PEM
+	Parent  string `json:"parent"`
+	Days    int    `json:"days"`
+	Profile string `json:"profile"`
+	Email   string `json:"email"`
+}
+
+// SubmitReply is the answer to a submitted request
+type SubmitReply struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// SubmitRequest queues the certificate request and emails the operators who can approve it
+func (cfg *config) SubmitRequest(req CertRequest) (*CertRequest, error) {
+	if len(cfg.CertRequests) >= REQUESTS_MAX {
+		return nil, fmt.Errorf("%s", tr("Too many pending certificate requests!"))
+	}
+	if len(req.CSR) > REQUEST_MAX_CSR {
+		return nil, fmt.Errorf("%s", tr("Wrong certificate request"))
+	}
+	csr, err := ParseCSR([]byte(req.CSR))
+	if err != nil {
+		return nil, err
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if addr, err := mail.ParseAddress(req.Email); req.Email != "" && (err != nil || addr.Address != req.Email) {
+		return nil, fmt.Errorf("%s: %v", tr("Wrong email!"), req.Email)
+	}
+	if req.Name = csr.Subject.CommonName; req.Name == "" {
+		return nil, fmt.Errorf("%s", tr("Can't create a certificate with no name!"))
+	}
+	if err := cfg.requestable(req.Name, ""); err != nil {
+		return nil, err
+	}
+	if req.ID, err = genId(); err != nil {
+		return nil, err
+	}
+	req.CSR = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	req.Submitted = time.Now()
+	err = cfg.update(func(cfg *config) error {
+		if err := cfg.requestable(req.Name, ""); err != nil {
+			return err
+		}
+		n := len(cfg.CertRequests)
+		cfg.CertRequests = append(cfg.CertRequests[:n:n], req)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	subject := tr("Certificate request for %s", req.Name)
+	body := tr("%s requested a certificate for %s, approve or reject it at /requests.", req.submitter(), req.Name)
+	for _, u := range cfg.Users {
+		if u.Email != "" && !u.Disabled && u.can(ROLE_OPERATOR) && (u.Org == "" || u.Org == req.Org) {
+			cfg.mailRequest(u.Email, subject, body)
+		}
+	}
+	return &req, nil
+}
+
+// requestable fails if the certificate name is taken or requested by another request than id
+func (cfg *config) requestable(name, id string) error {
+	if FindCert(name) != nil {
+		return fmt.Errorf("%s", tr("Certificate %s already exists!", name))
+	}
+	for _, pending := range cfg.CertRequests {
+		if pending.Name == name && pending.ID != id {
+			return fmt.Errorf("%s", tr("Certificate %s is already requested!", name))
+		}
+	}
+	return nil
+}
+
+// submitter names who submitted the request
+func (req CertRequest) submitter() string {
+	if req.By == "" {
+		return tr("The submit token")
+	}
+	return req.By
+}
+
+// mailRequest emails about a certificate request, if there is a mail server, only logging the
+// failures as the request itself went fine
+func (cfg *config) mailRequest(to, subject, body string) {
+	if to == "" || cfg.Mailer == nil || cfg.Mailer.Server == "" {
+		return
+	}
+	if err := sendMail(cfg.Mailer, to, subject, body); err != nil {
+		log.Printf("(Warning) Could not email %s about a certificate request: %s", to, err)
+	}
+}
+
+// pendingRequests returns the requests the operators of the organization can see, oldest first
+func (cfg *config) pendingRequests(org string) []CertRequest {
+	list := make([]CertRequest, 0, len(cfg.CertRequests))
+	for _, req := range cfg.CertRequests {
+		if org == "" || req.Org == org {
+			list = append(list, req)
+		}
+	}
+	return list
+}
+
+// userRequests returns the pending requests submitted by the user
+func (cfg *config) userRequests(username string) []CertRequest {
+	list := make([]CertRequest, 0)
+	for _, req := range cfg.CertRequests {
+		if req.By == username {
+			list = append(list, req)
+		}
+	}
+	return list
+}
+
+// findRequest returns the index of the pending request the operators of the organization can
+// see, or fails
+func (cfg *config) findRequest(id, org string) (int, error) {
+	for i, req := range cfg.CertRequests {
+		if req.ID == id && (org == "" || req.Org == org) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%s", tr("Certificate request not found!"))
+}
+
+// EditRequest changes the name, issuer, validity and profile of the pending request
+func (cfg *config) EditRequest(id, org string, edit CertRequest) error {
+	edit.Name = strings.TrimSpace(edit.Name)
+	if edit.Name == "" {
+		return fmt.Errorf("%s", tr("Can't create a certificate with no name!"))
+	}
+	return cfg.update(func(cfg *config) error {
+		i, err := cfg.findRequest(id, org)
+		if err != nil {
+			return err
+		}
+		if err := cfg.requestable(edit.Name, id); err != nil {
+			return err
+		}
+		requests := append([]CertRequest(nil), cfg.CertRequests...)
+		req := &requests[i]
+		req.Name, req.Parent, req.Days, req.Profile = edit.Name, edit.Parent, edit.Days, edit.Profile
+		cfg.CertRequests = requests
+		return nil
+	})
+}
+
+// ApproveRequest issues the certificate of the pending request and emails it to the submitter
+func (cfg *config) ApproveRequest(id, org string) (*Cert, error) {
+	i, err := cfg.findRequest(id, org)
+	if err != nil {
+		return nil, err
+	}
+	req := cfg.CertRequests[i]
+	parent, err := findIssuer(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := ParseCSR([]byte(req.CSR))
+	if err != nil {
+		return nil, err
+	}
+	csr.Subject.CommonName = req.Name
+	prof := cfg.getProfile(req.Profile)
+	period, err := requestPeriod(req.Days, prof)
+	if err != nil {
+		return nil, err
+	}
+	c, err := SignCSR(parent, csr, period, prof)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.dropRequest(id); err != nil {
+		return nil, err
+	}
+	cfg.mailRequest(req.Email, tr("Certificate %s issued", req.Name),
+		tr("Your certificate request was approved, this is the certificate:")+"\n\n"+
+			string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Crt.Raw})))
+	return c, nil
+}
+
+// RejectRequest drops the pending request and emails the reason to the submitter
+func (cfg *config) RejectRequest(id, org, reason string) error {
+	i, err := cfg.findRequest(id, org)
+	if err != nil {
+		return err
+	}
+	req := cfg.CertRequests[i]
+	if err := cfg.dropRequest(id); err != nil {
+		return err
+	}
+	body := tr("Your certificate request for %s was rejected.", req.Name)
+	if reason = strings.TrimSpace(reason); reason != "" {
+		body += "\n\n" + reason
+	}
+	cfg.mailRequest(req.Email, tr("Certificate request for %s rejected", req.Name), body)
+	return nil
+}
+
+// dropRequest removes the request with the id from the pending ones, if still there
+func (cfg *config) dropRequest(id string) error {
+	return cfg.update(func(cfg *config) error {
+		kept := make([]CertRequest, 0, len(cfg.CertRequests))
+		for _, req := range cfg.CertRequests {
+			if req.ID != id {
+				kept = append(kept, req)
+			}
+		}
+		cfg.CertRequests = kept
+		return nil
+	})
+}
+
+// NewSubmitToken replaces the submit token and returns it in clear, the only time it is available
+func (cfg *config) NewSubmitToken() (string, error) {
+	secret := make([]byte, TOKEN_BYTES)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := TOKEN_PREFIX + hex.EncodeToString(secret)
+	return token, cfg.update(func(cfg *config) error {
+		cfg.SubmitToken = hashToken(token)
+		return nil
+	})
+}
+
+// submitAllowed tells whether or not the token is the submit token
+func (cfg *config) submitAllowed(token string) bool {
+	return cfg != nil && cfg.SubmitToken != "" && token != "" &&
+		subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(cfg.SubmitToken)) == 1
+}
+
+// readRequestEdit reads the fields of a request the operators may change
+func readRequestEdit(r *http.Request) (CertRequest, error) {
+	edit := CertRequest{Name: r.FormValue("Name"), Parent: r.FormValue("parent"), Profile: r.FormValue("profile")}
+	if days := strings.TrimSpace(r.FormValue("Days")); days != "" {
+		var err error
+		if edit.Days, err = strconv.Atoi(days); err != nil || edit.Days < 0 {
+			return edit, fmt.Errorf("%s: %v", tr("Wrong days!"), days)
+		}
+	}
+	return edit, nil
+}
+
+// certRequests lets every user submit certificate requests and see their pending ones, and the
+// operators edit, approve or reject all of them
+func certRequests(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	me := requestUser(w, r)
+	org := requestOrg(r)
+	if r.Method == "POST" {
+		id, action := r.FormValue("id"), r.FormValue("action")
+		if action != "submit" && !allowed(w, r, ROLE_OPERATOR) {
+			return
+		}
+		var err error
+		switch action {
+		case "token":
+			if !instanceAllowed(w, r) {
+				return
+			}
+			var token string
+			if token, err = cfg.NewSubmitToken(); err == nil {
+				auditRequest(w, r, AUDIT_CONFIG, "submit token")
+				ps["NewToken"] = token
+			}
+		case "submit":
+			var req CertRequest
+			if req, err = readRequestEdit(r); err == nil {
+				req.CSR, req.By, req.Email, req.Org = r.FormValue("CSR"), me.Username, me.Email, me.Org
+				var queued *CertRequest
+				if queued, err = cfg.SubmitRequest(req); err == nil {
+					auditRequest(w, r, AUDIT_REQUEST, queued.Name+" "+queued.ID)
+				}
+			}
+		case "save":
+			var edit CertRequest
+			if edit, err = readRequestEdit(r); err == nil {
+				err = cfg.EditRequest(id, org, edit)
+			}
+		case "approve":
+			var c *Cert
+			if c, err = cfg.ApproveRequest(id, org); err == nil {
+				auditRequest(w, r, AUDIT_ISSUE, certObject(c.Crt))
+			}
+		case "reject":
+			if err = cfg.RejectRequest(id, org, r.FormValue("reason")); err == nil {
+				auditRequest(w, r, AUDIT_REJECT, "request "+id)
+			}
+		default:
+			err = fmt.Errorf("%s", tr("Unknown action %s!", action))
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+		} else if action != "token" {
+			http.Redirect(w, r, "/requests", http.StatusFound)
+			return
+		}
+	}
+	if me.can(ROLE_OPERATOR) {
+		ps["Requests"] = cfg.pendingRequests(org)
+	} else {
+		ps["Requests"] = cfg.userRequests(me.Username)
+	}
+	ps["CAs"] = visibleCerts(org, Authorities())
+	setProfiles(ps, "")
+	err := templatesFor(r).ExecuteTemplate(w, "requests", ps)
+	handleError(w, r, err)
+}
+
+// submitCertRequest queues the JSON SubmitRequest of a submitter with the submit token, who
+// needs no user
+func submitCertRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiFail(w, http.StatusMethodNotAllowed, fmt.Errorf("%s", tr("Unknown API call %s %s", r.Method, r.URL.Path)))
+		return
+	}
+	cfg := LoadConfig()
+	if !cfg.submitAllowed(bearerToken(r)) {
+		apiFail(w, http.StatusUnauthorized, fmt.Errorf("%s", tr("Invalid API token!")))
+		return
+	}
+	var sr SubmitRequest
+	if err := apiRead(r, &sr); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	req, err := cfg.SubmitRequest(CertRequest{CSR: sr.CSR, Parent: sr.Parent, Days: sr.Days, Profile: sr.Profile,
+		Email: sr.Email})
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	audit(AUDIT_REQUEST, "", remoteAddr(r), req.Name+" "+req.ID)
+	apiReply(w, http.StatusAccepted, SubmitReply{ID: req.ID, Name: req.Name})
+}
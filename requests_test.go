@@ -0,0 +1,112 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertRequests(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Mailer: &Mailer{Server: "smtp.example.com:25"},
+		Users: map[string]User{"vic": {Username: "vic", Email: "vic@example.com", Role: ROLE_VIEWER},
+			"olga": {Username: "olga", Email: "olga@example.com", Role: ROLE_OPERATOR}}}
+	mails := make(map[string][]string)
+	defer func(saved func(m *Mailer, to, subject, body string) error) { sendMail = saved }(sendMail)
+	sendMail = func(m *Mailer, to, subject, body string) error {
+		mails[to] = append(mails[to], subject+"\n"+body)
+		return nil
+	}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "ReqCA"}, ForDays(365))
+	dieOnError(t, err)
+	newCSR := func(name string) string {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		dieOnError(t, err)
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: name}}, key)
+		dieOnError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	}
+	login := func(username string) string {
+		s, err := SessionFor(httptest.NewRecorder(), httptest.NewRequest("GET", "/requests", nil))
+		dieOnError(t, err)
+		s[LOGGEDUSER] = cachedCfg.Users[username]
+		s.Save()
+		return s.Id()
+	}
+	vic, olga := login("vic"), login("olga")
+	defer logoutEverywhere("vic")
+	defer logoutEverywhere("olga")
+	post := func(session string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/requests", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: session})
+		w := httptest.NewRecorder()
+		accessControl(certRequests).ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(vic, url.Values{"action": {"submit"}, "CSR": {newCSR("asked.example.com")}, "parent": {"ReqCA"}})
+	if w.Code != http.StatusFound || len(cachedCfg.CertRequests) != 1 || len(mails["olga@example.com"]) != 1 {
+		t.Fatalf("Request not queued: %d %v", w.Code, mails)
+	}
+	id := cachedCfg.CertRequests[0].ID
+	if _, err := cachedCfg.SubmitRequest(CertRequest{CSR: newCSR("asked.example.com")}); err == nil {
+		t.Error("The same certificate was requested twice")
+	}
+	if w = post(vic, url.Values{"action": {"approve"}, "id": {id}}); w.Code != http.StatusForbidden {
+		t.Errorf("A viewer approved a request: %d", w.Code)
+	}
+	post(olga, url.Values{"action": {"save"}, "id": {id}, "Name": {"edited.example.com"}, "parent": {"ReqCA"},
+		"Days": {"10"}})
+	if w = post(olga, url.Values{"action": {"approve"}, "id": {id}}); w.Code != http.StatusFound {
+		t.Fatalf("Request not approved: %d\n%s", w.Code, w.Body.String())
+	}
+	c := FindCert("edited.example.com")
+	if c == nil || c.Crt.CheckSignatureFrom(ca.Crt) != nil || c.Crt.NotAfter.After(time.Now().AddDate(0, 0, 11)) {
+		t.Fatalf("Wrong certificate issued on approval: %v", c)
+	}
+	if len(cachedCfg.CertRequests) != 0 || len(mails["vic@example.com"]) != 1 ||
+		!strings.Contains(mails["vic@example.com"][0], "BEGIN CERTIFICATE") {
+		t.Fatalf("The submitter did not get the certificate: %v", mails["vic@example.com"])
+	}
+
+	post(vic, url.Values{"action": {"submit"}, "CSR": {newCSR("denied.example.com")}})
+	post(olga, url.Values{"action": {"reject"}, "id": {cachedCfg.CertRequests[0].ID}, "reason": {"Not ours"}})
+	if len(cachedCfg.CertRequests) != 0 || FindCert("denied.example.com") != nil ||
+		!strings.Contains(mails["vic@example.com"][1], "Not ours") {
+		t.Fatalf("Request not rejected: %v", mails["vic@example.com"])
+	}
+
+	submit := func(token string) int {
+		req := httptest.NewRequest("POST", SUBMIT_PATH, strings.NewReader(
+			`{"csr": `+strconv.Quote(newCSR("anonymous.example.com"))+`, "parent": "ReqCA"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		submitCertRequest(w, req)
+		return w.Code
+	}
+	if code := submit("webca_nope"); code != http.StatusUnauthorized {
+		t.Errorf("Request submitted without the submit token: %d", code)
+	}
+	token, err := cachedCfg.NewSubmitToken()
+	dieOnError(t, err)
+	if code := submit(token); code != http.StatusAccepted || len(cachedCfg.CertRequests) != 1 ||
+		cachedCfg.CertRequests[0].By != "" {
+		t.Errorf("Request not submitted with the submit token: %d", code)
+	}
+}
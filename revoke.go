@@ -0,0 +1,241 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCA_REVOKED = ".webca.revoked"
+	CRL_VALIDITY  = 24 * time.Hour
+	REASON_HOLD   = 6 // certificateHold, the only revocation that can be undone
+)
+
+// RevocationReason is an RFC 5280 CRLReason code and its name
+type RevocationReason struct {
+	Code int
+	Name string
+}
+
+// RevocationReasons are the reasons a certificate can be revoked for, removeFromCRL (8) being what
+// unholding does instead
+var RevocationReasons = []RevocationReason{
+	{0, "Unspecified"},
+	{1, "Key compromise"},
+	{2, "CA compromise"},
+	{3, "Affiliation changed"},
+	{4, "Superseded"},
+	{5, "Cessation of operation"},
+	{REASON_HOLD, "Certificate hold"},
+	{9, "Privilege withdrawn"},
+	{10, "AA compromise"},
+}
+
+// Revocation records a revoked certificate
+type Revocation struct {
+	Serial string    `json:"serial"` // hex, as serialKey
+	Name   string    `json:"name"`
+	Issuer string    `json:"issuer"`
+	Time   time.Time `json:"time"`
+	Reason int       `json:"reason"` // RFC 5280 CRLReason code
+}
+
+// ReasonName returns the name of the reason of the revocation, for the templates to translate
+func (rv Revocation) ReasonName() string {
+	for _, reason := range RevocationReasons {
+		if reason.Code == rv.Reason {
+			return reason.Name
+		}
+	}
+	return fmt.Sprintf("%d", rv.Reason)
+}
+
+// OnHold tells whether or not the certificate is only suspended, so it can be unheld
+func (rv Revocation) OnHold() bool {
+	return rv.Reason == REASON_HOLD
+}
+
+// revokedObject returns the audited object of a revocation, with its reason unless unspecified
+func revokedObject(c *Cert, reason int) string {
+	if reason == 0 {
+		return certObject(c.Crt)
+	}
+	return fmt.Sprintf("%s reason %d", certObject(c.Crt), reason)
+}
+
+// validReason tells whether or not a certificate can be revoked for the reason
+func validReason(reason int) bool {
+	for _, r := range RevocationReasons {
+		if r.Code == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// revokedIndex holds all the revocations by serial
+type revokedIndex struct {
+	Serials map[string]Revocation
+}
+
+// revocation state lock
+var srevoked sync.Mutex
+
+// RevokeCert marks the certificate as revoked for the given reason, which can also revoke for good
+// a certificate on hold
+func RevokeCert(cert *Cert, reason int) error {
+	if !validReason(reason) {
+		return fmt.Errorf("%s", tr("Wrong revocation reason %d!", reason))
+	}
+	serial := serialKey(cert.Crt.SerialNumber)
+	srevoked.Lock()
+	idx, err := loadRevoked()
+	if err == nil {
+		if rv, ok := idx.Serials[serial]; ok && (!rv.OnHold() || reason == REASON_HOLD) {
+			err = fmt.Errorf("%s", tr("Certificate %s is already revoked!", cert.Crt.Subject.CommonName))
+		}
+	}
+	if err == nil {
+		idx.Serials[serial] = Revocation{
+			Serial: serial,
+			Name:   cert.Crt.Subject.CommonName,
+			Issuer: cert.Crt.Issuer.CommonName,
+			Time:   time.Now().UTC(),
+			Reason: reason,
+		}
+		err = idx.save()
+	}
+	srevoked.Unlock()
+	if err != nil {
+		return err
+	}
+	publish(EVENT_REVOKE, cert.Crt)
+	return nil
+}
+
+// UnholdCert reinstates a certificate on hold, which leaves the revocation lists
+func UnholdCert(cert *Cert) error {
+	serial := serialKey(cert.Crt.SerialNumber)
+	srevoked.Lock()
+	defer srevoked.Unlock()
+	idx, err := loadRevoked()
+	if err != nil {
+		return err
+	}
+	if rv, ok := idx.Serials[serial]; !ok || !rv.OnHold() {
+		return fmt.Errorf("%s", tr("Certificate %s is not on hold!", cert.Crt.Subject.CommonName))
+	}
+	delete(idx.Serials, serial)
+	return idx.save()
+}
+
+// Revoked returns the revocation of the certificate, or nil if it was not revoked
+func Revoked(cert *Cert) *Revocation {
+	srevoked.Lock()
+	defer srevoked.Unlock()
+	idx, err := loadRevoked()
+	if err != nil || cert.Crt.SerialNumber == nil {
+		return nil
+	}
+	if rv, ok := idx.Serials[serialKey(cert.Crt.SerialNumber)]; ok {
+		return &rv
+	}
+	return nil
+}
+
+// Revocations returns all the revocations of certificates issued by the named CA, oldest first
+func Revocations(issuer string) ([]Revocation, error) {
+	srevoked.Lock()
+	defer srevoked.Unlock()
+	idx, err := loadRevoked()
+	if err != nil {
+		return nil, err
+	}
+	rvs := make([]Revocation, 0)
+	for _, rv := range idx.Serials {
+		if rv.Issuer == issuer {
+			rvs = append(rvs, rv)
+		}
+	}
+	sort.Slice(rvs, func(i, j int) bool { return rvs[i].Time.Before(rvs[j].Time) })
+	return rvs, nil
+}
+
+// CRL returns the DER encoded revocation list of the CA, valid for CRL_VALIDITY
+func CRL(ca *Cert) ([]byte, error) {
+	if ca.Key == nil || ca.Crt.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, fmt.Errorf("%s", tr("%s can't sign revocation lists!", ca.Crt.Subject.CommonName))
+	}
+	rvs, err := Revocations(ca.Crt.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]x509.RevocationListEntry, 0, len(rvs))
+	for _, rv := range rvs {
+		if serial, ok := new(big.Int).SetString(rv.Serial, 16); ok {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: serial,
+				RevocationTime: rv.Time, ReasonCode: rv.Reason})
+		}
+	}
+	now := time.Now().UTC()
+	return x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(CRL_VALIDITY),
+	}, ca.Crt, ca.Key)
+}
+
+// loadRevoked reads the revocations from the storage (the caller must hold srevoked)
+func loadRevoked() (*revokedIndex, error) {
+	idx := &revokedIndex{make(map[string]Revocation)}
+	if err := loadGob(WEBCA_REVOKED, idx); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// save stores the revocations (the caller must hold srevoked)
+func (idx *revokedIndex) save() error {
+	return saveGob(WEBCA_REVOKED, idx)
+}
+
+// revoke allows the web user to revoke a certificate after confirmation
+func revoke(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	if c.Crt.IsCA && !allowed(w, r, ROLE_ADMIN) {
+		return
+	}
+	if r.Method == "POST" && r.FormValue("unhold") != "" {
+		if err := UnholdCert(c); err != nil {
+			ps["Error"] = err.Error()
+		} else {
+			auditRequest(w, r, AUDIT_UNHOLD, certObject(c.Crt))
+		}
+	} else if r.Method == "POST" && r.FormValue("confirm") != "" {
+		reason, _ := strconv.Atoi(r.FormValue("reason"))
+		if err := RevokeCert(c, reason); err != nil {
+			ps["Error"] = err.Error()
+		} else {
+			auditRequest(w, r, AUDIT_REVOKE, revokedObject(c, reason))
+		}
+	}
+	setCertControl(ps, c)
+	err = templatesFor(r).ExecuteTemplate(w, "certControl", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,83 @@
+package webca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevokeCert(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "RevokeCA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "revoked.example.com", ForDays(30))
+	dieOnError(t, err)
+	if Revoked(crt) != nil {
+		t.Fatal("New certificate already revoked")
+	}
+	dieOnError(t, RevokeCert(crt, 1))
+	if err := RevokeCert(crt, 1); err == nil {
+		t.Fatal("Certificate revoked twice")
+	}
+	rv := Revoked(crt)
+	if rv == nil || rv.Reason != 1 || rv.Name != "revoked.example.com" {
+		t.Fatalf("Unexpected revocation %v", rv)
+	}
+	rvs, err := Revocations("RevokeCA")
+	dieOnError(t, err)
+	if len(rvs) != 1 || rvs[0].Serial != serialKey(crt.Crt.SerialNumber) {
+		t.Fatalf("Unexpected revocations %v", rvs)
+	}
+}
+
+func TestRevocationReasons(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "HoldCA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "held.example.com", ForDays(30))
+	dieOnError(t, err)
+	if err := RevokeCert(crt, 7); err == nil {
+		t.Fatal("Revoked for an unknown reason")
+	}
+	dieOnError(t, RevokeCert(crt, REASON_HOLD))
+	if rv := Revoked(crt); rv == nil || !rv.OnHold() || certStatus(crt, time.Now()) != STATUS_HOLD {
+		t.Fatalf("Certificate not on hold: %v", rv)
+	}
+	der, err := CRL(ca)
+	dieOnError(t, err)
+	crl, err := x509.ParseRevocationList(der)
+	dieOnError(t, err)
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].ReasonCode != REASON_HOLD {
+		t.Fatalf("Unexpected CRL entries %v", crl.RevokedCertificateEntries)
+	}
+	post := func(form url.Values) string {
+		req := httptest.NewRequest("POST", "/revoke", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		revoke(w, req)
+		return w.Body.String()
+	}
+	post(url.Values{"cert": {"held.example.com"}, "unhold": {"1"}})
+	if Revoked(crt) != nil {
+		t.Fatal("Certificate not unheld")
+	}
+	if err := UnholdCert(crt); err == nil {
+		t.Fatal("Unheld a certificate not on hold")
+	}
+	dieOnError(t, RevokeCert(crt, REASON_HOLD))
+	post(url.Values{"cert": {"held.example.com"}, "confirm": {"1"}, "reason": {"1"}})
+	if rv := Revoked(crt); rv == nil || rv.Reason != 1 || rv.ReasonName() != "Key compromise" {
+		t.Fatalf("Certificate on hold not revoked for good: %v", rv)
+	}
+	if page := post(url.Values{"cert": {"held.example.com"}, "unhold": {"1"}}); !strings.Contains(page,
+		"is not on hold!") || Revoked(crt) == nil {
+		t.Fatal("Revoked certificate unheld")
+	}
+}
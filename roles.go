@@ -0,0 +1,150 @@
+package webca
+
+import (
+	"net/http"
+)
+
+const (
+	ROLE_ADMIN    = "admin"    // manages the users, the CAs and the settings
+	ROLE_OPERATOR = "operator" // issues, renews, revokes and deletes certificates, downloads the keys it issued
+	ROLE_VIEWER   = "viewer"   // browses and downloads the public certificates
+)
+
+// Roles lists the user roles, the most privileged first
+var Roles = []string{ROLE_ADMIN, ROLE_OPERATOR, ROLE_VIEWER}
+
+// role returns the user role, users from before roles existed are admins
+func (u User) role() string {
+	if u.Role == "" {
+		return ROLE_ADMIN
+	}
+	return u.Role
+}
+
+// can tells whether or not the user has the given role or a more privileged one
+func (u User) can(role string) bool {
+	return roleRank(u.role()) >= roleRank(role)
+}
+
+// roleRank returns the privilege level of the role, 0 if unknown
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return len(Roles) - i
+		}
+	}
+	return 0
+}
+
+// currentUser returns the stored version of the logged user, so role changes apply right away
+func currentUser(u User) User {
+	if cu, ok := LoadConfig().Users[u.Username]; ok {
+		return cu
+	}
+	return u
+}
+
+// Can tells whether or not the logged user of the page has the given role
+func (ps PageStatus) Can(role string) bool {
+	u, ok := ps[LOGGEDUSER].(User)
+	return ok && currentUser(u).can(role)
+}
+
+// requestUser returns the user of the API token or the session of the request, if any
+func requestUser(w http.ResponseWriter, r *http.Request) *User {
+	if token := bearerToken(r); token != "" {
+		u := LoadConfig().tokenUser(token)
+		if u != nil {
+			logUser(r, u.Username)
+		}
+		return u
+	}
+	s, err := SessionFor(w, r)
+	if err != nil {
+		return nil
+	}
+	if u, ok := s[LOGGEDUSER].(User); ok {
+		if u = currentUser(u); u.Disabled {
+			return nil
+		}
+		logUser(r, u.Username)
+		return &u
+	}
+	if fakedLogin {
+		return &User{Username: "fuser", Role: ROLE_ADMIN}
+	}
+	return nil
+}
+
+// roleControl invokes handler f ONLY IF we are logged in with the given role or a more privileged
+// one, otherwise the login page or a 403
+func roleControl(role string, f func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return accessControl(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(w, r, role) {
+			return
+		}
+		f(w, r)
+	})
+}
+
+// allowed tells whether or not the request user has the role, failing with a 403 if not
+func allowed(w http.ResponseWriter, r *http.Request, role string) bool {
+	if u := requestUser(w, r); u != nil && u.can(role) {
+		return true
+	}
+	http.Error(w, tr("Access Denied"), http.StatusForbidden)
+	return false
+}
+
+// ownsKey tells whether or not the user may download the private key of the named certificate:
+// admins any of them, operators those of the certificates they issued
+func (u User) ownsKey(name string) bool {
+	if u.can(ROLE_ADMIN) {
+		return true
+	}
+	return u.can(ROLE_OPERATOR) && LoadConfig().owner(name) == u.Username
+}
+
+// owner returns the user that issued the named certificate, read under the config lock since the
+// generation jobs record them from the background
+func (cfg *config) owner(name string) string {
+	if cfg == nil {
+		return ""
+	}
+	oneCfg.RLock()
+	defer oneCfg.RUnlock()
+	return cfg.Owners[name]
+}
+
+// keyAllowed tells whether or not the request user may download the private key of the named
+// certificate, failing with a 403 if not
+func keyAllowed(w http.ResponseWriter, r *http.Request, name string) bool {
+	if u := requestUser(w, r); u != nil && u.ownsKey(name) {
+		return true
+	}
+	http.Error(w, tr("Access Denied"), http.StatusForbidden)
+	return false
+}
+
+// keysAllowed tells whether or not the request user may download the unencrypted private key of
+// the named certificate
+func keysAllowed(w http.ResponseWriter, r *http.Request, name string) bool {
+	u := requestUser(w, r)
+	return LoadConfig().plainKeysAllowed() && u != nil && u.ownsKey(name)
+}
+
+// setOwner records the user that issued the named certificate, who may download its key
+func (cfg *config) setOwner(name, username string) error {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.update(func(cfg *config) error {
+		owners := make(map[string]string, len(cfg.Owners)+1)
+		for certname, owner := range cfg.Owners {
+			owners[certname] = owner
+		}
+		owners[name] = username
+		cfg.Owners = owners
+		return nil
+	})
+}
@@ -0,0 +1,89 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{
+		"boss": {Username: "boss"}, // users from before roles are admins
+		"op":   {Username: "op", Role: ROLE_OPERATOR},
+		"op2":  {Username: "op2", Role: ROLE_OPERATOR},
+		"view": {Username: "view", Role: ROLE_VIEWER},
+	}, Owners: map[string]string{"roles.example.com": "op"}}
+	ca, err := GenCACert(pkix.Name{CommonName: "RolesCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "roles.example.com", ForDays(30))
+	dieOnError(t, err)
+	certree = nil
+	tokens := make(map[string]string)
+	for name := range cachedCfg.Users {
+		tokens[name], err = cachedCfg.NewAPIToken(name, "test")
+		dieOnError(t, err)
+	}
+	call := func(h http.Handler, user, method, url, body string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if strings.HasPrefix(url, API_PREFIX) {
+			req.Header.Set("Authorization", "Bearer "+tokens[user])
+		} else {
+			id, _ := genId()
+			req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+			s, err := SessionFor(httptest.NewRecorder(), req)
+			dieOnError(t, err)
+			s[LOGGEDUSER] = cachedCfg.Users[user]
+			s.Save()
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	apis := apiAccess(api)
+	files := authCertServer("/cert/", storage)
+	for _, c := range []struct {
+		h                 http.Handler
+		user, method, url string
+		code              int
+	}{
+		{apis, "view", "GET", "/api/v1/certs", http.StatusOK},
+		{apis, "view", "POST", "/api/v1/certs/roles.example.com/renew", http.StatusForbidden},
+		{apis, "op", "POST", "/api/v1/certs/roles.example.com/renew", http.StatusOK},
+		{apis, "op", "POST", "/api/v1/cas", http.StatusForbidden},
+		{apis, "op", "POST", "/api/v1/certs/RolesCA/revoke", http.StatusForbidden},
+		{apis, "boss", "POST", "/api/v1/cas", http.StatusBadRequest}, // allowed but empty
+		{files, "view", "GET", "/cert/roles.example.com.pem", http.StatusOK},
+		{files, "view", "GET", "/cert/roles.example.com.key.pem", http.StatusForbidden},
+		{files, "op", "GET", "/cert/roles.example.com.key.pem", http.StatusOK},
+		{files, "op2", "GET", "/cert/roles.example.com.key.pem", http.StatusForbidden}, // not the owner
+		{files, "boss", "GET", "/cert/roles.example.com.key.pem", http.StatusOK},
+		{files, "op2", "GET", "/cert/RolesCA.pem", http.StatusOK},
+		{roleControl(ROLE_OPERATOR, fullchain), "op2", "GET", "/fullchain?cert=roles.example.com&key=1", http.StatusForbidden},
+		{accessControl(p12), "op2", "GET", "/p12?cert=roles.example.com", http.StatusForbidden},
+		{accessControl(p12), "op", "GET", "/p12?cert=roles.example.com", http.StatusOK},
+		{apis, "op2", "POST", "/api/v1/certs/roles.example.com/link", http.StatusForbidden},
+		{roleControl(ROLE_OPERATOR, del), "view", "POST", "/del?cert=roles.example.com", http.StatusForbidden},
+		{roleControl(ROLE_OPERATOR, del), "op", "POST", "/del?cert=RolesCA", http.StatusForbidden},
+		{roleControl(ROLE_OPERATOR, gen), "op", "POST", "/gen?Cert.CommonName=NewRoot", http.StatusForbidden},
+		{roleControl(ROLE_ADMIN, webhooks), "op", "GET", "/webhooks", http.StatusForbidden},
+	} {
+		if code := call(c.h, c.user, c.method, c.url, "{}"); code != c.code {
+			t.Errorf("%s %s %s -> %d (expected %d)", c.user, c.method, c.url, code, c.code)
+		}
+	}
+	if FindCert("RolesCA") == nil || FindCert("NewRoot") != nil {
+		t.Fatal("A CA was changed without the admin role")
+	}
+	if code := call(apis, "op2", "POST", "/api/v1/certs", `{"name": "owned.example.com", "parent": "RolesCA", "days": 30}`); code != http.StatusCreated {
+		t.Fatalf("Certificate not issued: %d", code)
+	}
+	if code := call(files, "op2", "GET", "/cert/owned.example.com.key.pem", ""); code != http.StatusOK {
+		t.Errorf("The owner can't download the key: %d", code)
+	}
+}
@@ -0,0 +1,168 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	S3_REGION  = "us-east-1"
+	S3_TIMEOUT = 5 * time.Minute
+)
+
+// S3Bucket is an S3 (or compatible, like MinIO) bucket, reached with path style URLs and
+// AWS Signature Version 4
+type S3Bucket struct {
+	Endpoint  string // e.g. https://minio.example.com:9000, AWS's of the region if empty
+	Region    string // S3_REGION if empty
+	Bucket    string
+	Prefix    string // of the object keys, e.g. webca/
+	AccessKey string
+	SecretKey string
+}
+
+var s3Client = &http.Client{Timeout: S3_TIMEOUT}
+
+// region returns the region of the bucket
+func (s *S3Bucket) region() string {
+	if s.Region != "" {
+		return s.Region
+	}
+	return S3_REGION
+}
+
+// s3Escape URI encodes s as SigV4 wants it, keeping the slashes unless it is a query value
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !slash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3HMAC returns the HMAC-SHA256 of data with key
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// do sends the signed request for the object key (the bucket itself if empty) and returns the
+// body of the successful answers
+func (s *S3Bucket) do(method, key string, query map[string]string, body []byte) ([]byte, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region() + ".amazonaws.com"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := make([]string, 0, len(names))
+	for _, name := range names {
+		params = append(params, s3Escape(name, true)+"="+s3Escape(query[name], true))
+	}
+	u.RawQuery = strings.Join(params, "&")
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	stamp, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	req.Header.Set("x-amz-date", stamp)
+	req.Header.Set("x-amz-content-sha256", payload)
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{method, u.RawPath, u.RawQuery, "host:" + u.Host,
+		"x-amz-content-sha256:" + payload, "x-amz-date:" + stamp, "", signed, payload}, "\n")
+	scope := day + "/" + s.region() + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	k := s3HMAC([]byte("AWS4"+s.SecretKey), day)
+	for _, part := range []string{s.region(), "s3", "aws4_request"} {
+		k = s3HMAC(k, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		s.AccessKey, scope, signed, s3HMAC(k, toSign)))
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, BACKUP_MAX_UPLOAD))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("S3 answered %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// Put stores the object
+func (s *S3Bucket) Put(name string, data []byte) error {
+	_, err := s.do(http.MethodPut, s.Prefix+name, nil, data)
+	return err
+}
+
+// List returns the names of the objects under the prefix, without it
+func (s *S3Bucket) List() ([]string, error) {
+	names := make([]string, 0)
+	query := map[string]string{"list-type": "2", "prefix": s.Prefix}
+	for {
+		data, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(data, &res); err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, s.Prefix))
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return names, nil
+		}
+		query["continuation-token"] = res.NextContinuationToken
+	}
+}
+
+// Remove deletes the object
+func (s *S3Bucket) Remove(name string) error {
+	_, err := s.do(http.MethodDelete, s.Prefix+name, nil, nil)
+	return err
+}
@@ -0,0 +1,232 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SCEP_PATH         = "/scep"
+	SCEP_DEFAULT_DAYS = 365
+	SCEP_MAX_MESSAGE  = 1 << 16
+	SCEP_CAPS         = "AES\nDES3\nPOSTPKIOperation\nRenewal\nSHA-1\nSHA-256\nSHA-512\nSCEPStandard\n"
+)
+
+// SCEP message types, statuses and failure reasons (RFC 8894 section 3.2.1)
+const (
+	scepCertRep         = "3"
+	scepRenewalReq      = "17"
+	scepPKCSReq         = "19"
+	scepSuccess         = "0"
+	scepFailure         = "2"
+	scepBadMessageCheck = "1"
+	scepBadRequest      = "2"
+)
+
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+	oidChallengePassword  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+// SCEP configures the SCEP enrollment endpoint
+type SCEP struct {
+	CA        string // name of the CA issuing the device certificates, it must have an RSA key
+	Challenge string // enrollment password the devices send in their requests
+	Profile   string // issuance profile, if any
+	Days      int    // certificate validity, the profile one (or SCEP_DEFAULT_DAYS) if 0
+}
+
+// scep serves the SCEP (RFC 8894) operations, devices authenticate with the challenge password
+// or, to renew, with their current certificate
+func scep(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.SCEP == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ca, err := findIssuer(cfg.SCEP.CA)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	switch query.Get("operation") {
+	case "GetCACaps":
+		w.Header().Set("Content-type", "text/plain")
+		io.WriteString(w, SCEP_CAPS)
+	case "GetCACert":
+		chain := Chain(ca)
+		if len(chain) == 0 {
+			w.Header().Set("Content-type", "application/x-x509-ca-cert")
+			w.Write(ca.Crt.Raw)
+			return
+		}
+		data, err := PKCS7(append([]*x509.Certificate{ca.Crt}, chain...))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-type", "application/x-x509-ca-ra-cert")
+		w.Write(data)
+	case "PKIOperation":
+		var msg []byte
+		if r.Method == "POST" {
+			msg, err = ioutil.ReadAll(io.LimitReader(r.Body, SCEP_MAX_MESSAGE))
+		} else { // some clients don't escape the '+' of the base64 message
+			msg, err = base64.StdEncoding.DecodeString(strings.Replace(query.Get("message"), " ", "+", -1))
+		}
+		var reply []byte
+		if err == nil {
+			reply, err = scepOperation(cfg.SCEP, ca, msg, remoteAddr(r))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-type", "application/x-pki-message")
+		w.Write(reply)
+	default:
+		http.Error(w, tr("Unknown SCEP operation"), http.StatusBadRequest)
+	}
+}
+
+// scepOperation handles a PKI message from the address and returns the CertRep reply. Messages
+// that can't be authenticated are errors, refused requests get a failure reply
+func scepOperation(cfg *SCEP, ca *Cert, msg []byte, addr string) ([]byte, error) {
+	req, err := ParseSigned(msg)
+	if err != nil {
+		return nil, err
+	}
+	if req.attrString(oidSCEPTransactionID) == "" || len(req.attrBytes(oidSCEPSenderNonce)) == 0 {
+		return nil, fmt.Errorf("%s", tr("SCEP transaction id and nonce are required"))
+	}
+	csrDER, alg, err := OpenEnvelope(req.Content, ca.Key)
+	if err != nil {
+		log.Printf("SCEP request %s: %s", req.attrString(oidSCEPTransactionID), err)
+		return scepReply(ca, req, scepBadMessageCheck, nil, nil)
+	}
+	c, err := scepEnroll(cfg, ca, req, csrDER)
+	if err != nil {
+		log.Printf("SCEP request %s refused: %s", req.attrString(oidSCEPTransactionID), err)
+		return scepReply(ca, req, scepBadRequest, nil, nil)
+	}
+	audit(AUDIT_ISSUE, "scep:"+req.attrString(oidSCEPTransactionID), addr, certObject(c.Crt))
+	return scepReply(ca, req, "", c.Crt, alg)
+}
+
+// scepEnroll checks the request is authorized and issues its certificate
+func scepEnroll(cfg *SCEP, ca *Cert, req *signedMessage, csrDER []byte) (*Cert, error) {
+	csr, err := ParseCSR(csrDER)
+	if err != nil {
+		return nil, err
+	}
+	switch req.attrString(oidSCEPMessageType) {
+	case scepPKCSReq:
+		if cfg.Challenge == "" ||
+			subtle.ConstantTimeCompare([]byte(challengePassword(csr)), []byte(cfg.Challenge)) != 1 {
+			return nil, fmt.Errorf("%s", tr("Wrong challenge password"))
+		}
+	case scepRenewalReq:
+		signer := req.Signer
+		if signer.CheckSignatureFrom(ca.Crt) != nil || time.Now().After(signer.NotAfter) ||
+			Revoked(&Cert{Crt: signer}) != nil || signer.Subject.CommonName != csr.Subject.CommonName {
+			return nil, fmt.Errorf("%s", tr("The renewal must be signed by the current certificate"))
+		}
+	default:
+		return nil, fmt.Errorf("%s", tr("Unsupported SCEP message type %s", req.attrString(oidSCEPMessageType)))
+	}
+	prof := LoadConfig().getProfile(cfg.Profile)
+	days := cfg.Days
+	if days <= 0 && (prof == nil || prof.Duration <= 0) {
+		days = SCEP_DEFAULT_DAYS
+	}
+	period, err := requestPeriod(days, prof)
+	if err != nil {
+		return nil, err
+	}
+	if req.attrString(oidSCEPMessageType) == scepRenewalReq { // only the holder replaces it
+		return ReplaceCSR(ca, csr, period, prof)
+	}
+	return SignCSR(ca, csr, period, prof)
+}
+
+// scepReply returns a CertRep signed by the CA with the issued certificate encrypted for the
+// requester, or the failure reason if the certificate is nil
+func scepReply(ca *Cert, req *signedMessage, failInfo string, crt *x509.Certificate,
+	alg asn1.ObjectIdentifier) ([]byte, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	status := scepSuccess
+	if crt == nil {
+		status = scepFailure
+	}
+	attrs := []pkcs12Attribute{
+		printableAttribute(oidSCEPMessageType, scepCertRep),
+		printableAttribute(oidSCEPPKIStatus, status),
+		printableAttribute(oidSCEPTransactionID, req.attrString(oidSCEPTransactionID)),
+		octetsAttribute(oidSCEPSenderNonce, nonce),
+		octetsAttribute(oidSCEPRecipientNonce, req.attrBytes(oidSCEPSenderNonce)),
+	}
+	var content []byte
+	if crt == nil {
+		attrs = append(attrs, printableAttribute(oidSCEPFailInfo, failInfo))
+	} else {
+		p7, err := PKCS7([]*x509.Certificate{crt})
+		if err != nil {
+			return nil, err
+		}
+		if content, err = Envelope(p7, req.Signer, alg); err != nil {
+			return nil, err
+		}
+	}
+	return SignData(content, ca.Crt, ca.Key, attrs)
+}
+
+// printableAttribute returns a PKCS#7 attribute with a PrintableString value
+func printableAttribute(oid asn1.ObjectIdentifier, s string) pkcs12Attribute {
+	der, _ := asn1.MarshalWithParams(s, "printable")
+	return pkcs12Attribute{oid, asn1.RawValue{FullBytes: set(der)}}
+}
+
+// octetsAttribute returns a PKCS#7 attribute with an OCTET STRING value
+func octetsAttribute(oid asn1.ObjectIdentifier, b []byte) pkcs12Attribute {
+	der, _ := asn1.Marshal(b)
+	return pkcs12Attribute{oid, asn1.RawValue{FullBytes: set(der)}}
+}
+
+// challengePassword returns the challenge password attribute of the request, if any
+func challengePassword(csr *x509.CertificateRequest) string {
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []pkcs12Attribute `asn1:"tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return ""
+	}
+	for _, attr := range tbs.Attributes {
+		var password string
+		if attr.Id.Equal(oidChallengePassword) {
+			if _, err := asn1.Unmarshal(attr.Value.Bytes, &password); err == nil {
+				return password
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSCEP(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{SCEP: &SCEP{CA: "SCEPCA", Challenge: "secret"}}
+	ca, err := GenCACert(pkix.Name{CommonName: "SCEPCA"}, ForDays(365))
+	dieOnError(t, err)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	dieOnError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "device"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)},
+		&x509.Certificate{Subject: pkix.Name{CommonName: "device"}}, key.Public(), key)
+	dieOnError(t, err)
+	self, err := x509.ParseCertificate(der)
+	dieOnError(t, err)
+	// builds a CSR with a challenge password, which x509 can't add
+	csr := func(password string) []byte {
+		pub, err := x509.MarshalPKIXPublicKey(key.Public())
+		dieOnError(t, err)
+		subject, err := asn1.Marshal(pkix.Name{CommonName: "device"}.ToRDNSequence())
+		dieOnError(t, err)
+		tbs, err := asn1.Marshal(struct {
+			Version    int
+			Subject    asn1.RawValue
+			PublicKey  asn1.RawValue
+			Attributes []pkcs12Attribute `asn1:"tag:0"`
+		}{0, asn1.RawValue{FullBytes: subject}, asn1.RawValue{FullBytes: pub},
+			[]pkcs12Attribute{printableAttribute(oidChallengePassword, password)}})
+		dieOnError(t, err)
+		sum := sha256.Sum256(tbs)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		dieOnError(t, err)
+		der, err := asn1.Marshal(struct {
+			TBS       asn1.RawValue
+			Algorithm pkix.AlgorithmIdentifier
+			Signature asn1.BitString
+		}{asn1.RawValue{FullBytes: tbs},
+			pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, Parameters: asn1.NullRawValue},
+			asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}})
+		dieOnError(t, err)
+		return der
+	}
+	enroll := func(msgType, password string, signer *x509.Certificate) *signedMessage {
+		content, err := Envelope(csr(password), ca.Crt, oidAES256CBC)
+		dieOnError(t, err)
+		msg, err := SignData(content, signer, key, []pkcs12Attribute{
+			printableAttribute(oidSCEPMessageType, msgType),
+			printableAttribute(oidSCEPTransactionID, "t1"),
+			octetsAttribute(oidSCEPSenderNonce, []byte("0123456789abcdef")),
+		})
+		dieOnError(t, err)
+		w := httptest.NewRecorder()
+		scep(w, httptest.NewRequest("POST", "/scep?operation=PKIOperation", bytes.NewReader(msg)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("PKIOperation -> %d: %s", w.Code, w.Body)
+		}
+		rep, err := ParseSigned(w.Body.Bytes())
+		dieOnError(t, err)
+		if rep.Signer.Subject.CommonName != "SCEPCA" || rep.attrString(oidSCEPMessageType) != scepCertRep ||
+			rep.attrString(oidSCEPTransactionID) != "t1" ||
+			string(rep.attrBytes(oidSCEPRecipientNonce)) != "0123456789abcdef" {
+			t.Fatalf("Unexpected CertRep attributes %v", rep.Attributes)
+		}
+		return rep
+	}
+	w := httptest.NewRecorder()
+	scep(w, httptest.NewRequest("GET", "/scep?operation=GetCACert", nil))
+	if !bytes.Equal(w.Body.Bytes(), ca.Crt.Raw) {
+		t.Fatal("GetCACert didn't return the CA certificate")
+	}
+	if rep := enroll(scepPKCSReq, "wrong", self); rep.attrString(oidSCEPPKIStatus) != scepFailure {
+		t.Fatal("Enrolled with a wrong challenge password")
+	}
+	rep := enroll(scepPKCSReq, "secret", self)
+	if rep.attrString(oidSCEPPKIStatus) != scepSuccess {
+		t.Fatalf("Enrollment failed: %s", rep.attrString(oidSCEPFailInfo))
+	}
+	p7, _, err := OpenEnvelope(rep.Content, key)
+	dieOnError(t, err)
+	var ci contentInfo
+	_, err = asn1.Unmarshal(p7, &ci)
+	dieOnError(t, err)
+	var sd signedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	dieOnError(t, err)
+	issued, err := x509.ParseCertificate(sd.Certificates.Bytes)
+	dieOnError(t, err)
+	if issued.Subject.CommonName != "device" || issued.CheckSignatureFrom(ca.Crt) != nil {
+		t.Fatalf("Unexpected certificate %v", issued.Subject)
+	}
+	if rep := enroll(scepPKCSReq, "secret", self); rep.attrString(oidSCEPPKIStatus) != scepFailure ||
+		FindCert("device").Crt.SerialNumber.Cmp(issued.SerialNumber) != 0 {
+		t.Fatal("Certificate replaced with the challenge password")
+	}
+	if rep := enroll(scepRenewalReq, "", self); rep.attrString(oidSCEPPKIStatus) != scepFailure {
+		t.Fatal("Renewed with a self-signed certificate")
+	}
+	if rep := enroll(scepRenewalReq, "", issued); rep.attrString(oidSCEPPKIStatus) != scepSuccess {
+		t.Fatalf("Renewal failed: %s", rep.attrString(oidSCEPFailInfo))
+	}
+	if c := FindCert("device"); c == nil || c.Crt.SerialNumber.Cmp(issued.SerialNumber) == 0 {
+		t.Fatal("Certificate not replaced on renewal")
+	}
+}
@@ -0,0 +1,254 @@
+package webca
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PAGE_SIZE     = 50
+	MAX_PAGE_SIZE = 500
+)
+
+// sha256Hex matches the fingerprint keys of the SHA-256 fingerprints
+var sha256Hex = regexp.MustCompile(`^[0-9A-F]{64}$`)
+
+// CertFilter selects certificates by name, alternative name, serial, issuer, fingerprint, tag and
+// expiry. Empty fields match any certificate, text matches are case insensitive substrings
+type CertFilter struct {
+	Name          string
+	SAN           string
+	Serial        string
+	Issuer        string
+	Fingerprint   string // SHA-256, matched whole
+	Tag           string // matched whole, or any value of the key if it has none
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	Org           string // organization of the user searching rather than a search criterion
+}
+
+// IsEmpty tells whether or not the filter has no criteria at all
+func (f CertFilter) IsEmpty() bool {
+	return f.Name == "" && f.SAN == "" && f.Serial == "" && f.Issuer == "" && f.Fingerprint == "" &&
+		f.Tag == "" && f.ExpiresAfter.IsZero() && f.ExpiresBefore.IsZero()
+}
+
+// query returns the filter as URL query parameters, as read by readCertFilter
+func (f CertFilter) query() url.Values {
+	q := url.Values{}
+	for k, v := range map[string]string{"Name": f.Name, "SAN": f.SAN, "Serial": f.Serial, "Issuer": f.Issuer,
+		"Fingerprint": f.Fingerprint, "Tag": f.Tag} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if !f.ExpiresAfter.IsZero() {
+		q.Set("ExpiresAfter", f.ExpiresAfter.Format(FORMDATE))
+	}
+	if !f.ExpiresBefore.IsZero() {
+		q.Set("ExpiresBefore", f.ExpiresBefore.Format(FORMDATE))
+	}
+	return q
+}
+
+// Match tells whether or not the certificate passes the filter
+func (f CertFilter) Match(c *Cert) bool {
+	crt := c.Crt
+	if crt == nil || crt.SerialNumber == nil { // placeholder for an unknown issuer
+		return false
+	}
+	if !contains(crt.Subject.CommonName, f.Name) || !contains(crt.Issuer.CommonName, f.Issuer) {
+		return false
+	}
+	if f.SAN != "" && !anyContains(SANs(crt), f.SAN) {
+		return false
+	}
+	if f.Serial != "" && !contains(serialKey(crt.SerialNumber), cleanSerial(f.Serial)) {
+		return false
+	}
+	if f.Fingerprint != "" && fingerprintKey(Fingerprint(crt)) != fingerprintKey(f.Fingerprint) {
+		return false
+	}
+	if f.Tag != "" && !hasTag(LoadConfig().certLabels(crt.Subject.CommonName).Tags, f.Tag) {
+		return false
+	}
+	if !f.ExpiresAfter.IsZero() && crt.NotAfter.Before(f.ExpiresAfter) {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && crt.NotAfter.After(f.ExpiresBefore) {
+		return false
+	}
+	return LoadConfig().visibleIn(f.Org, c)
+}
+
+// FindCerts returns all the certificates matching the filter, ordered by name
+func FindCerts(f CertFilter) []*Cert {
+	autoload()
+	scerts.RLock()
+	defer scerts.RUnlock()
+	found := make([]*Cert, 0)
+	if certree == nil {
+		return found
+	}
+	if f.Fingerprint != "" { // indexed, a single certificate at most
+		if c := certree.fingerprints[fingerprintKey(f.Fingerprint)]; c != nil && f.Match(c) {
+			found = append(found, c)
+		}
+		return found
+	}
+	if !f.ExpiresBefore.IsZero() { // indexed, only the ones expiring by then
+		for _, c := range certree.expiringBy(f.ExpiresBefore) {
+			if f.Match(c) {
+				found = append(found, c)
+			}
+		}
+	} else {
+		for _, c := range certree.names {
+			if f.Match(c) {
+				found = append(found, c)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Crt.Subject.CommonName < found[j].Crt.Subject.CommonName
+	})
+	return found
+}
+
+// CertPage is a page of a certificate listing
+type CertPage struct {
+	Certs  []*Cert
+	Number int // current page, starting at 1
+	Size   int // certificates per page
+	Total  int // certificates on all pages
+	query  url.Values
+}
+
+// PageCerts returns the given page (starting at 1) of size certificates matching the filter
+func PageCerts(f CertFilter, number, size int) *CertPage {
+	if size <= 0 {
+		size = PAGE_SIZE
+	}
+	all := FindCerts(f)
+	p := &CertPage{Number: number, Size: size, Total: len(all), query: f.query()}
+	if p.Number > p.Pages() {
+		p.Number = p.Pages()
+	}
+	if p.Number < 1 {
+		p.Number = 1
+	}
+	start := (p.Number - 1) * size
+	end := start + size
+	if end > len(all) {
+		end = len(all)
+	}
+	p.Certs = all[start:end]
+	return p
+}
+
+// Pages returns the number of pages (at least one, even if empty)
+func (p *CertPage) Pages() int {
+	if p.Total == 0 {
+		return 1
+	}
+	return (p.Total + p.Size - 1) / p.Size
+}
+
+// HasPrev tells whether or not there is a previous page
+func (p *CertPage) HasPrev() bool {
+	return p.Number > 1
+}
+
+// HasNext tells whether or not there is a next page
+func (p *CertPage) HasNext() bool {
+	return p.Number < p.Pages()
+}
+
+// Prev returns the previous page number
+func (p *CertPage) Prev() int {
+	return p.Number - 1
+}
+
+// Next returns the next page number
+func (p *CertPage) Next() int {
+	return p.Number + 1
+}
+
+// URL returns the index link to page number n keeping the current search
+func (p *CertPage) URL(n int) template.URL {
+	q := url.Values{}
+	for k, v := range p.query {
+		q[k] = v
+	}
+	q.Set("page", strconv.Itoa(n))
+	if p.Size != PAGE_SIZE {
+		q.Set("size", strconv.Itoa(p.Size))
+	}
+	return template.URL("/?" + q.Encode())
+}
+
+// readPaging reads the requested page number and size, 0 meaning the default
+func readPaging(r *http.Request) (number, size int) {
+	number, _ = strconv.Atoi(r.FormValue("page"))
+	size, _ = strconv.Atoi(r.FormValue("size"))
+	if size > MAX_PAGE_SIZE {
+		size = MAX_PAGE_SIZE
+	}
+	return number, size
+}
+
+// contains tells whether s contains sub ignoring case
+func contains(s, sub string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+}
+
+// anyContains tells whether any of the strings contains sub ignoring case
+func anyContains(ss []string, sub string) bool {
+	for _, s := range ss {
+		if contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanSerial removes the usual separators from a serial number written in hexadecimal
+func cleanSerial(serial string) string {
+	return strings.NewReplacer(":", "", " ", "", "-", "").Replace(strings.TrimSpace(serial))
+}
+
+// readCertFilter reads the search filter from the request
+func readCertFilter(r *http.Request) (CertFilter, error) {
+	f := CertFilter{
+		Name:        strings.TrimSpace(r.FormValue("Name")),
+		SAN:         strings.TrimSpace(r.FormValue("SAN")),
+		Serial:      strings.TrimSpace(r.FormValue("Serial")),
+		Issuer:      strings.TrimSpace(r.FormValue("Issuer")),
+		Fingerprint: strings.TrimSpace(r.FormValue("Fingerprint")),
+		Tag:         strings.TrimSpace(r.FormValue("Tag")),
+		Org:         requestOrg(r),
+	}
+	if f.Fingerprint != "" && !sha256Hex.MatchString(fingerprintKey(f.Fingerprint)) {
+		return f, fmt.Errorf("%s: %v", tr("Wrong SHA-256 fingerprint!"), f.Fingerprint)
+	}
+	var err error
+	if after := r.FormValue("ExpiresAfter"); after != "" {
+		if f.ExpiresAfter, err = time.ParseInLocation(FORMDATE, after, time.Local); err != nil {
+			return f, fmt.Errorf("%s: %v", tr("Wrong date!"), after)
+		}
+	}
+	if before := r.FormValue("ExpiresBefore"); before != "" {
+		if f.ExpiresBefore, err = time.ParseInLocation(FORMDATE, before, time.Local); err != nil {
+			return f, fmt.Errorf("%s: %v", tr("Wrong date!"), before)
+		}
+		f.ExpiresBefore = f.ExpiresBefore.Add(24*time.Hour - time.Second) // the whole day
+	}
+	return f, nil
+}
@@ -0,0 +1,63 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindCerts(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "SearchCA"}, ForDays(365))
+	dieOnError(t, err)
+	web, err := GenCert(ca, "web.example.com", ForDays(30), "www.example.com")
+	dieOnError(t, err)
+	_, err = GenCert(ca, "mail.example.com", ForDays(300))
+	dieOnError(t, err)
+	names := func(certs []*Cert) string {
+		s := make([]string, 0)
+		for _, c := range certs {
+			s = append(s, c.Crt.Subject.CommonName)
+		}
+		return strings.Join(s, ",")
+	}
+	for _, tc := range []struct {
+		f        CertFilter
+		expected string
+	}{
+		{CertFilter{Name: "EXAMPLE"}, "mail.example.com,web.example.com"},
+		{CertFilter{SAN: "www."}, "web.example.com"},
+		{CertFilter{Issuer: "searchca"}, "SearchCA,mail.example.com,web.example.com"},
+		{CertFilter{Serial: serialKey(web.Crt.SerialNumber)[:8]}, "web.example.com"},
+		{CertFilter{ExpiresBefore: time.Now().AddDate(0, 0, 60)}, "web.example.com"},
+		{CertFilter{ExpiresAfter: time.Now().AddDate(0, 0, 60), Name: "example"}, "mail.example.com"},
+	} {
+		if found := names(FindCerts(tc.f)); found != tc.expected {
+			t.Fatalf("Filter %+v expected %q but got %q", tc.f, tc.expected, found)
+		}
+	}
+}
+
+func TestPageCerts(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "PageCA"}, ForDays(365))
+	dieOnError(t, err)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		_, err := GenCert(ca, name+".example.com", ForDays(30))
+		dieOnError(t, err)
+	}
+	f := CertFilter{Name: "example"}
+	page := PageCerts(f, 2, 3)
+	if page.Total != 4 || page.Pages() != 2 || len(page.Certs) != 1 ||
+		page.Certs[0].Crt.Subject.CommonName != "d.example.com" || page.HasNext() || !page.HasPrev() {
+		t.Fatalf("Unexpected page: %+v", page)
+	}
+	if url := string(page.URL(page.Prev())); url != "/?Name=example&page=1&size=3" {
+		t.Fatalf("Unexpected page link %s", url)
+	}
+	if page := PageCerts(f, 7, 0); page.Number != 1 || len(page.Certs) != 4 {
+		t.Fatalf("Out of range pages should show the last one: %+v", page)
+	}
+}
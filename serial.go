@@ -0,0 +1,133 @@
+package webca
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+)
+
+const (
+	WEBCA_SERIALS = ".webca.serials"
+	SERIAL_BITS   = 128
+)
+
+// serialIndex remembers every serial number ever issued (or found) by this WebCA
+type serialIndex struct {
+	Serials map[string]string // serial (hex) -> certificate common name
+}
+
+// serials is the persistent serial index, loaded on first use
+var serials *serialIndex
+
+// serials access lock
+var sserials sync.Mutex
+
+// newSerial returns a random 128 bit serial number not used before and reserves it for certname
+func newSerial(certname string) (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), SERIAL_BITS)
+	for {
+		serial, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate random serial number: %s", err)
+		}
+		if serial.Sign() == 0 { // serials must be positive
+			continue
+		}
+		err = registerSerial(serial, certname)
+		if err == nil {
+			return serial, nil
+		}
+		if _, dup := err.(duplicateSerial); !dup {
+			return nil, err
+		}
+	}
+}
+
+// duplicateSerial is the error returned when a serial number is already taken
+type duplicateSerial string
+
+func (d duplicateSerial) Error() string {
+	return string(d)
+}
+
+// registerSerial records serial as used by certname or fails if it was already taken
+func registerSerial(serial *big.Int, certname string) error {
+	sserials.Lock()
+	defer sserials.Unlock()
+	idx, err := loadSerials()
+	if err != nil {
+		return err
+	}
+	key := serialKey(serial)
+	if owner, ok := idx.Serials[key]; ok {
+		return duplicateSerial(tr("Serial %s already used by %s", key, owner))
+	}
+	idx.Serials[key] = certname
+	return idx.save()
+}
+
+// indexSerials makes sure all the certificates, by serial key, are in the serial index
+func indexSerials(serials map[string]*Cert) {
+	sserials.Lock()
+	defer sserials.Unlock()
+	idx, err := loadSerials()
+	if err != nil {
+		log.Printf("(Warning) Can't load serial index: %s", err)
+		return
+	}
+	changed := false
+	for key, crt := range serials {
+		owner, ok := idx.Serials[key]
+		if !ok {
+			idx.Serials[key] = crt.Crt.Subject.CommonName
+			changed = true
+		} else if owner != crt.Crt.Subject.CommonName {
+			log.Printf("(Warning) Serial %s is shared by %s and %s", key, owner,
+				crt.Crt.Subject.CommonName)
+		}
+	}
+	if changed {
+		if err := idx.save(); err != nil {
+			log.Printf("(Warning) Can't save serial index: %s", err)
+		}
+	}
+}
+
+// FindCertBySerial finds a certificate by serial number
+func FindCertBySerial(serial *big.Int) *Cert {
+	autoload()
+	scerts.RLock()
+	defer scerts.RUnlock()
+	if certree == nil {
+		return nil
+	}
+	return certree.serials[serialKey(serial)]
+}
+
+// serialKey returns the index key for a serial number
+func serialKey(serial *big.Int) string {
+	return fmt.Sprintf("%X", serial)
+}
+
+// loadSerials returns the serial index, reading it from the storage if needed
+// (the caller must hold sserials)
+func loadSerials() (*serialIndex, error) {
+	if serials != nil {
+		return serials, nil
+	}
+	idx := &serialIndex{Serials: make(map[string]string)}
+	if err := loadGob(WEBCA_SERIALS, idx); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	serials = idx
+	return serials, nil
+}
+
+// save puts the serial index into persistent storage
+// (the caller must hold sserials)
+func (idx *serialIndex) save() error {
+	return saveGob(WEBCA_SERIALS, idx)
+}
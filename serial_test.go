@@ -0,0 +1,81 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSerials(t *testing.T) {
+	inTestDir(t)
+	serials = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "SerialCA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "serialserver", ForDays(365))
+	dieOnError(t, err)
+	if ca.Crt.SerialNumber.Cmp(crt.Crt.SerialNumber) == 0 {
+		t.Fatal("Two certificates got the same serial number!")
+	}
+	if crt.Crt.SerialNumber.BitLen() > SERIAL_BITS {
+		t.Fatalf("Serial %v is longer than %d bits", crt.Crt.SerialNumber, SERIAL_BITS)
+	}
+	if err := registerSerial(crt.Crt.SerialNumber, "other"); err == nil {
+		t.Fatal("Duplicated serial number was accepted!")
+	}
+	found := FindCertBySerial(crt.Crt.SerialNumber)
+	if found == nil || found.Crt.Subject.CommonName != "serialserver" {
+		t.Fatalf("Expected to find serialserver by serial but got %v", found)
+	}
+	serials = nil // the index must survive a reload
+	if err := registerSerial(ca.Crt.SerialNumber, "other"); err == nil {
+		t.Fatal("Reloaded serial index accepted a duplicated serial number!")
+	}
+}
+
+func TestAPICertBySerial(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"vera": {Username: "vera", Role: ROLE_VIEWER},
+		"erin": {Username: "erin", Role: ROLE_VIEWER, Org: "red"}, "gus": {Username: "gus", Role: "guest"}}}
+	certree = nil
+	dieOnError(t, cachedCfg.AddOrganization("red"))
+	ca, err := GenCACert(pkix.Name{CommonName: "SerialCA"}, ForDays(365))
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "serial.example.com", ForDays(30))
+	dieOnError(t, err)
+	call := func(username, serial string) (int, CertInfo) {
+		token, err := cachedCfg.NewAPIToken(username, "ci")
+		dieOnError(t, err)
+		req := httptest.NewRequest("GET", "/api/v1/certs?serial="+url.QueryEscape(serial), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		apiAccess(api).ServeHTTP(w, req)
+		var ci CertInfo
+		json.Unmarshal(w.Body.Bytes(), &ci)
+		return w.Code, ci
+	}
+
+	serial := serialKey(crt.Crt.SerialNumber)
+	if code, ci := call("vera", strings.ToLower(serial)); code != http.StatusOK || ci.Name != "serial.example.com" ||
+		ci.PEM == "" {
+		t.Fatalf("Certificate not found by serial: %d %+v", code, ci)
+	}
+	if code, _ := call("erin", serial); code != http.StatusNotFound {
+		t.Errorf("Certificate of no organization shown to one: %d", code)
+	}
+	if code, _ := call("gus", serial); code != http.StatusForbidden {
+		t.Errorf("Certificate shown without a role: %d", code)
+	}
+	if code, _ := call("vera", "zz"); code != http.StatusBadRequest {
+		t.Errorf("Wrong serial accepted: %d", code)
+	}
+	if code, _ := call("vera", "1"); code != http.StatusNotFound {
+		t.Errorf("Unknown serial found: %d", code)
+	}
+}
@@ -0,0 +1,68 @@
+package webca
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// SHUTDOWN_TIMEOUT is how long the requests in progress are waited for when terminating
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// serve runs srv with start until it fails or the process is interrupted or terminated, draining
+// the requests in progress then. SIGHUP reloads the config and the web certificate meanwhile
+func serve(srv *http.Server, start func() error) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(sig)
+		close(sig)
+	}()
+	done := make(chan error, 1)
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				if err := Reload(); err != nil {
+					log.Printf("(Warning) Could not reload: %s", err)
+				}
+				continue
+			}
+			log.Printf("Got %v, shutting down...", s)
+			ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+			done <- srv.Shutdown(ctx) // closes the listeners, removing the Unix socket
+			cancel()
+			return
+		}
+	}()
+	if err := start(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
+
+// Reload reads the theme and the config again, dropping the cached one and the CA tree, and the web
+// certificate to serve. The old ones are kept if they can't be read
+func Reload() error {
+	if err := reloadTheme(); err != nil {
+		log.Printf("(Warning) Could not reload the theme: %s", err)
+	}
+	cfg := &config{}
+	if err := loadGob(WEBCA_CFG, cfg); os.IsNotExist(err) {
+		return nil // still in the setup
+	} else if err != nil {
+		return err
+	}
+	oneCfg.Lock()
+	cachedCfg = cfg
+	oneCfg.Unlock()
+	certree = nil // forces full reload later
+	log.Printf("Config reloaded")
+	if cfg.WebCert == nil {
+		return nil
+	}
+	return serveWebCert(certFile(cfg.getWebCert()), keyFile(cfg.getWebCert()))
+}
@@ -0,0 +1,92 @@
+package webca
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *Certree) { certree = saved }(certree)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	defer func(saved *tls.Certificate) { served.crt = saved }(served.crt)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "ReloadCA"}, ForDays(365))
+	dieOnError(t, err)
+	web, err := GenCert(ca, "reload.example.com", ForDays(30))
+	dieOnError(t, err)
+	dieOnError(t, NewConfig(User{Username: "admin"}, ca, web, Mailer{}).Save())
+	cachedCfg, served.crt = &config{}, nil // stale
+
+	started, release := make(chan bool), make(chan bool)
+	smux := http.NewServeMux()
+	smux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "up") })
+	smux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		fmt.Fprint(w, "drained")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	srv := &http.Server{Handler: smux}
+	done := make(chan error)
+	go func() { done <- serve(srv, func() error { return srv.Serve(ln) }) }()
+	addr := "http://" + ln.Addr().String()
+	for i := 0; i < 100; i++ { // the signals are handled once it serves
+		if resp, err := http.Get(addr); err == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p, err := os.FindProcess(os.Getpid())
+	dieOnError(t, err)
+	dieOnError(t, p.Signal(syscall.SIGHUP))
+	for i := 0; i < 100 && LoadConfig().WebCert == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cfg := LoadConfig(); cfg.WebCert == nil || cfg.getWebCert().Crt.Subject.CommonName != "reload.example.com" {
+		t.Fatal("The config was not reloaded")
+	}
+	if crt, err := webCertificate(nil); err != nil || crt == nil {
+		t.Errorf("The web certificate was not reloaded: %v", err)
+	}
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get(addr + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(data)
+	}()
+	<-started
+	dieOnError(t, p.Signal(syscall.SIGTERM))
+	select {
+	case err := <-done:
+		t.Fatalf("The server stopped with a request in progress: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if b := <-body; b != "drained" {
+		t.Errorf("The request in progress was dropped: %s", b)
+	}
+	select {
+	case err := <-done:
+		dieOnError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server did not stop")
+	}
+}
@@ -10,36 +10,78 @@ import (
 )
 
 const (
-	SESSIONID     = "goSessionId"
-	LASTUSED      = "goLastUsed"
-	CLEANUPDELAY  = time.Minute
-	MAXSESSIONAGE = 30 * time.Minute
+	SESSIONID      = "goSessionId"
+	LASTUSED       = "goLastUsed"
+	ADDR           = "goAddr"         // IP address of the last request
+	STARTED        = "goStarted"      // of the session, or of its login
+	CLEANUPDELAY   = time.Minute      // between the reaps of the expired sessions, if there are no limits
+	MAXSESSIONAGE  = 30 * time.Minute // idle timeout, if there are no limits
+	MAXSESSIONLIFE = time.Duration(0) // lifetime from the login, if there are no limits (none)
 )
 
+// SessionLimits expire the web sessions when idle and, with a lifetime, some time after the login
+// whatever their use, and cap the sessions a user may have open at once
+type SessionLimits struct {
+	Idle     int  // minutes without requests before the session expires
+	Lifetime int  // minutes from the login before a new one is required, no limit if 0
+	Cleanup  int  // minutes between the reaps of the expired sessions
+	PerUser  int  // simultaneous sessions of a user, no limit if 0
+	Evict    bool // logs out the oldest session of the user over the limit, instead of refusing the login
+}
+
 // session type
 type session map[string]interface{}
 
+// sessionStore keeps the sessions out of this instance, so that several instances share them
+type sessionStore interface {
+	load(id string) (session, error) // nil if there is no such session
+	store(s session) error           // until it expires
+	remove(id string) error
+	list() ([]session, error) // all the sessions not expired yet
+}
+
 // sessions holds all sessions
 var sessions map[string]session
 
 // mutex lock for session access
 var smutex sync.RWMutex
 
+// sessionLimits returns the configured session limits or the default ones
+func (cfg *config) sessionLimits() SessionLimits {
+	if cfg == nil || cfg.Sessions == nil {
+		return SessionLimits{Idle: int(MAXSESSIONAGE / time.Minute), Lifetime: int(MAXSESSIONLIFE / time.Minute),
+			Cleanup: int(CLEANUPDELAY / time.Minute)}
+	}
+	return *cfg.Sessions
+}
+
+// ttl returns how long the session has before it expires
+func (l SessionLimits) ttl(s session, now time.Time) time.Duration {
+	ttl := time.Duration(l.Idle) * time.Minute
+	if started, ok := s[STARTED].(time.Time); ok && l.Lifetime > 0 {
+		if left := started.Add(time.Duration(l.Lifetime) * time.Minute).Sub(now); left < ttl {
+			ttl = left
+		}
+	}
+	return ttl
+}
+
 func ReapSessions() {
 	go func() {
 		for {
-			time.Sleep(CLEANUPDELAY)
+			time.Sleep(time.Duration(LoadConfig().sessionLimits().Cleanup) * time.Minute)
 			cleanupSessions()
 		}
 	}()
 }
 
 func cleanupSessions() {
-	smutex.RLock()
-	defer smutex.RUnlock()
+	smutex.Lock()
+	defer smutex.Unlock()
 
+	l := LoadConfig().sessionLimits()
 	for k, s := range sessions {
-		if s.expired() {
+		if s.expired(l) {
 			log.Printf("Session %s has expired, removing...", k)
 			delete(sessions, k)
 		}
@@ -57,44 +99,144 @@ func requestSessionId(w http.ResponseWriter, r *http.Request) (string, error) {
 		if e != nil {
 			return "", e
 		}
-		cookie = &http.Cookie{Name: SESSIONID, Value: id, Path: "/", MaxAge: 0}
-		http.SetCookie(w, cookie)
-		r.AddCookie(cookie) // for future references of this request
+		setSessionCookie(w, r, id)
+		return id, nil
 	}
 	return cookie.Value, nil
 }
 
+// sessionCookie returns the session ID cookie, kept from the scripts and other sites and only sent
+// back over HTTPS when the request came that way, for the paths of the app
+func sessionCookie(r *http.Request, id string) *http.Cookie {
+	return &http.Cookie{Name: SESSIONID, Value: id, Path: options.basePath() + "/", HttpOnly: true,
+		Secure: requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode}
+}
+
+// setSessionCookie sends the session ID cookie and makes the request carry it for future references
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	cookie := sessionCookie(r, id)
+	http.SetCookie(w, cookie)
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	r.AddCookie(cookie)
+	for _, c := range cookies {
+		if c.Name != SESSIONID {
+			r.AddCookie(c)
+		}
+	}
+}
+
 // SessionFor gets a session bound to a Request by Session ID
 func SessionFor(w http.ResponseWriter, r *http.Request) (session, error) {
 	id, e := requestSessionId(w, r)
 	if e != nil {
 		return nil, e
 	}
-	smutex.RLock()
-	defer smutex.RUnlock()
+	l := LoadConfig().sessionLimits()
+	if st := sharedStore(); st != nil {
+		s, e := st.load(id)
+		if e == nil && (s == nil || s.expired(l)) {
+			s, e = newSession(id)
+		}
+		if e != nil {
+			return nil, e
+		}
+		s[LASTUSED], s[ADDR] = time.Now(), remoteAddr(r)
+		return s, st.store(s) // also pushes back the expiry
+	}
+	smutex.Lock()
+	defer smutex.Unlock()
 	if sessions == nil {
 		sessions = make(map[string]session)
 	}
 	s := sessions[id]
-	if s == nil {
-		s = make(session)
-		s[SESSIONID] = id
+	if s == nil || s.expired(l) {
+		s, e = newSession(id)
+		if e != nil {
+			return nil, e
+		}
 		sessions[id] = s
 	}
-	s[LASTUSED] = time.Now()
+	s[LASTUSED], s[ADDR] = time.Now(), remoteAddr(r)
 	return s.clone(), nil // this copy allows concurrent session access
 }
 
+// newSession returns a new session with its anti-CSRF token
+func newSession(id string) (session, error) {
+	token, e := genId()
+	if e != nil {
+		return nil, e
+	}
+	s := make(session)
+	s[SESSIONID] = id
+	s[CSRFTOKEN] = token // proves the forms posted come from our pages
+	s[STARTED] = time.Now()
+	return s, nil
+}
+
+// findSession returns the session with the ID, nil if there is none
+func findSession(id string) session {
+	if st := sharedStore(); st != nil {
+		s, err := st.load(id)
+		if err != nil {
+			log.Printf("(Warning) Could not load session %s: %s", id, err)
+		}
+		return s
+	}
+	smutex.RLock()
+	defer smutex.RUnlock()
+	if s := sessions[id]; s != nil {
+		return s.clone()
+	}
+	return nil
+}
+
+// listSessions returns all the sessions not expired yet
+func listSessions() ([]session, error) {
+	if st := sharedStore(); st != nil {
+		return st.list()
+	}
+	l := LoadConfig().sessionLimits()
+	smutex.RLock()
+	defer smutex.RUnlock()
+	list := make([]session, 0, len(sessions))
+	for _, s := range sessions {
+		if !s.expired(l) {
+			list = append(list, s.clone())
+		}
+	}
+	return list, nil
+}
+
+// dropSession deletes the session with the ID, logging it out wherever it is used
+func dropSession(id string) error {
+	if st := sharedStore(); st != nil {
+		return st.remove(id)
+	}
+	smutex.Lock()
+	defer smutex.Unlock()
+	delete(sessions, id)
+	return nil
+}
+
 // RemoveSession deletes a session from the map and removes the cookie
 func RemoveSession(w http.ResponseWriter, r *http.Request) {
 	cookie, e := r.Cookie(SESSIONID)
 	if e != nil {
 		return
 	}
-	smutex.RLock()
-	defer smutex.RUnlock()
-	delete(sessions, cookie.Value)
-	cookie.MaxAge = 0
+	if st := sharedStore(); st != nil {
+		if e = st.remove(cookie.Value); e != nil {
+			log.Printf("(Warning) Could not remove session %s: %s", cookie.Value, e)
+		}
+	} else {
+		smutex.Lock()
+		delete(sessions, cookie.Value)
+		smutex.Unlock()
+	}
+	cookie = sessionCookie(r, "")
+	cookie.MaxAge = -1
 	http.SetCookie(w, cookie)
 }
 
@@ -108,11 +250,48 @@ func (s session) Id() string {
 
 // Save stores the session state
 func (s session) Save() {
+	if st := sharedStore(); st != nil {
+		if err := st.store(s); err != nil {
+			log.Printf("(Warning) Could not save session %s: %s", s.Id(), err)
+		}
+		return
+	}
 	smutex.Lock()
 	defer smutex.Unlock()
 	sessions[s.Id()] = s.clone()
 }
 
+// Renew stores the session under a new ID and anti-CSRF token, on login, so that an ID planted
+// before (session fixation) doesn't get its access
+func (s session) Renew(w http.ResponseWriter, r *http.Request) error {
+	id, err := genId()
+	if err != nil {
+		return err
+	}
+	token, err := genId()
+	if err != nil {
+		return err
+	}
+	old := s.Id()
+	s[SESSIONID], s[CSRFTOKEN], s[STARTED] = id, token, time.Now() // the lifetime counts from the login
+	if st := sharedStore(); st != nil {
+		if err = st.store(s); err == nil {
+			err = st.remove(old)
+		}
+		if err != nil {
+			return err
+		}
+		setSessionCookie(w, r, id)
+		return nil
+	}
+	smutex.Lock()
+	delete(sessions, old)
+	sessions[id] = s.clone()
+	smutex.Unlock()
+	setSessionCookie(w, r, id)
+	return nil
+}
+
 // clone makes a copy of a session and returns it
 func (s session) clone() session {
 	c := make(session, len(s))
@@ -122,9 +301,13 @@ func (s session) clone() session {
 	return c
 }
 
-func (s session) expired() bool {
+// expired tells whether the session was idle for too long or has outlived its login
+func (s session) expired(l SessionLimits) bool {
 	now := time.Now()
-	return now.Sub(s[LASTUSED].(time.Time)) >= MAXSESSIONAGE
+	if last, ok := s[LASTUSED].(time.Time); ok && now.Sub(last) >= time.Duration(l.Idle)*time.Minute {
+		return true
+	}
+	return l.ttl(s, now) <= 0
 }
 
 // genId generates a new session ID
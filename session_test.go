@@ -1,8 +1,17 @@
 package webca
 
 import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func dieOnError(t *testing.T, err error) {
@@ -16,7 +25,7 @@ func equal(s1, s2 session) bool {
 		return false
 	}
 	for k,_:=range s1 {
-		if s1[k]!=s2[k] {
+		if k!=LASTUSED && s1[k]!=s2[k] {
 			return false
 		}
 	}
@@ -26,14 +35,412 @@ func equal(s1, s2 session) bool {
 func TestSessions(t *testing.T) {
 	r,err := http.NewRequest("get", "/", nil)
 	dieOnError(t, err)
-	s, err := SessionFor(r)
+	s, err := SessionFor(httptest.NewRecorder(), r)
 	dieOnError(t, err)
 	s["a"] = "A"
 	s.Save()
-	s2, err := SessionFor(r)
+	s2, err := SessionFor(httptest.NewRecorder(), r)
 	dieOnError(t, err)
 	if !equal(s,s2) {
-		t.Fatal("Session save failed! s=%v vs s2=%v\n", s, s2)
+		t.Fatalf("Session save failed! s=%v vs s2=%v\n", s, s2)
 	}
 }
 
+// followSession returns the session ID the response moved the session to, if any
+func followSession(id string, w *httptest.ResponseRecorder) string {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SESSIONID {
+			id = c.Value // the last one, after the rotations
+		}
+	}
+	return id
+}
+
+func TestSessionCookies(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Password: "Boss-passwd"}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	planted, err := SessionFor(w, r)
+	dieOnError(t, err)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Secure || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Wrong session cookie: %+v", cookies)
+	}
+
+	r = httptest.NewRequest("POST", "/login", strings.NewReader("Username=boss&Password=Boss-passwd"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: SESSIONID, Value: planted.Id()})
+	w = httptest.NewRecorder()
+	login(w, r)
+	id := followSession(planted.Id(), w)
+	if w.Code != http.StatusFound || id == planted.Id() {
+		t.Fatalf("The session ID was kept on login: %d", w.Code)
+	}
+	if cookies = w.Result().Cookies(); cookies[0].Secure || !cookies[0].HttpOnly {
+		t.Errorf("Wrong session cookie over HTTP: %+v", cookies[0])
+	}
+	smutex.RLock()
+	old, renewed := sessions[planted.Id()], sessions[id]
+	smutex.RUnlock()
+	if old != nil || renewed[LOGGEDUSER] == nil || renewed[CSRFTOKEN] == planted[CSRFTOKEN] {
+		t.Error("The planted session was not replaced on login")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Password: "Boss-passwd"}}}
+	w := httptest.NewRecorder()
+	s, err := SessionFor(w, httptest.NewRequest("GET", "/", nil))
+	dieOnError(t, err)
+	s[LOGGEDUSER] = cachedCfg.Users["boss"]
+	s.Save()
+
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(&http.Cookie{Name: SESSIONID, Value: s.Id()})
+	w = httptest.NewRecorder()
+	logout(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login" {
+		t.Fatalf("Logout did not go to the login page: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 || cookies[len(cookies)-1].Name != SESSIONID || cookies[len(cookies)-1].MaxAge >= 0 {
+		t.Errorf("The session cookie was not expired: %+v", cookies)
+	}
+	if findSession(s.Id()) != nil {
+		t.Error("The session survived the logout")
+	}
+	entries, err := ReadAudit()
+	dieOnError(t, err)
+	if len(entries) != 1 || entries[0].Action != AUDIT_LOGOUT || entries[0].User != "boss" {
+		t.Errorf("Wrong audit of the logout: %+v", entries)
+	}
+
+	w = httptest.NewRecorder()
+	login(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `action="/login"`) {
+		t.Errorf("The login page is not shown: %d", w.Code)
+	}
+	if entries, _ = ReadAudit(); len(entries) != 1 {
+		t.Errorf("Showing the login page was audited: %+v", entries)
+	}
+}
+
+// fakeRedis serves GET, SET, DEL, SCAN (in one page), AUTH, SELECT and PING from a map, checking the password
+func fakeRedis(t *testing.T, password string, data map[string]string, ttls map[string]string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	var mutex sync.Mutex
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					var n int
+					if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+						return
+					}
+					args := make([]string, n)
+					for i := range args {
+						var size int
+						if _, err := fmt.Fscanf(rd, "$%d\r\n", &size); err != nil {
+							return
+						}
+						buf := make([]byte, size+2)
+						if _, err := io.ReadFull(rd, buf); err != nil {
+							return
+						}
+						args[i] = string(buf[:size])
+					}
+					mutex.Lock()
+					switch {
+					case args[0] == "AUTH" && args[1] == password:
+						authed = true
+						fmt.Fprint(conn, "+OK\r\n")
+					case !authed:
+						fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+					case args[0] == "GET":
+						if v, ok := data[args[1]]; ok {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+						} else {
+							fmt.Fprint(conn, "$-1\r\n")
+						}
+					case args[0] == "SET":
+						data[args[1]], ttls[args[1]] = args[2], args[4]
+						fmt.Fprint(conn, "+OK\r\n")
+					case args[0] == "DEL":
+						delete(data, args[1])
+						fmt.Fprint(conn, ":1\r\n")
+					case args[0] == "SCAN":
+						keys := make([]string, 0)
+						for k := range data {
+							keys = append(keys, k)
+						}
+						fmt.Fprintf(conn, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+						for _, k := range keys {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(k), k)
+						}
+					case args[0] == "PING":
+						fmt.Fprint(conn, "+PONG\r\n")
+					default:
+						fmt.Fprint(conn, "+OK\r\n")
+					}
+					mutex.Unlock()
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestRedisSessions(t *testing.T) {
+	data, ttls := make(map[string]string), make(map[string]string)
+	ln := fakeRedis(t, "s3cret", data, ttls)
+	defer ln.Close()
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Password: "Boss-passwd"}}}
+	defer func() { redisSessions = nil }()
+
+	r := httptest.NewRequest("POST", "/settings", strings.NewReader("RedisAddr="+ln.Addr().String()+"&RedisDB=2"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := readRedis(cachedCfg, r); err == nil {
+		t.Fatal("A Redis server was accepted without its password")
+	}
+	r = httptest.NewRequest("POST", "/settings",
+		strings.NewReader("RedisAddr="+ln.Addr().String()+"&RedisDB=2&RedisPassword=s3cret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	dieOnError(t, readRedis(cachedCfg, r))
+
+	r = httptest.NewRequest("GET", "/", nil)
+	s, err := SessionFor(httptest.NewRecorder(), r)
+	dieOnError(t, err)
+	s[LOGGEDUSER] = cachedCfg.Users["boss"]
+	s.Save()
+	id := s.Id()
+	if _, ok := data[REDIS_PREFIX+id]; !ok || ttls[REDIS_PREFIX+id] != "1800" || sessions[id] != nil {
+		t.Fatalf("The session is not in Redis for %s: %v", MAXSESSIONAGE, ttls)
+	}
+	redisSessions = nil // another instance
+	shared, err := SessionFor(httptest.NewRecorder(), r)
+	dieOnError(t, err)
+	if u, ok := shared[LOGGEDUSER].(User); !ok || u.Username != "boss" || shared[CSRFTOKEN] != s[CSRFTOKEN] {
+		t.Fatalf("The session is not shared: %v", shared)
+	}
+
+	if list, err := listSessions(); err != nil || len(list) != 1 || list[0].Id() != id {
+		t.Errorf("Wrong shared sessions: %v %v", list, err)
+	}
+
+	dieOnError(t, shared.Renew(httptest.NewRecorder(), r))
+	if _, ok := data[REDIS_PREFIX+id]; ok || findSession(shared.Id())[LOGGEDUSER] == nil {
+		t.Error("The session was not moved to its new ID")
+	}
+	RemoveSession(httptest.NewRecorder(), r)
+	if len(data) != 0 {
+		t.Errorf("The session was not removed: %v", data)
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{}}
+	r := httptest.NewRequest("POST", "/settings", strings.NewReader("SessionIdle=0"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := readSessionLimits(cachedCfg, r); err == nil {
+		t.Error("An idle timeout of 0 was accepted")
+	}
+	r = httptest.NewRequest("POST", "/settings", strings.NewReader("SessionIdle=10&SessionLifetime=60"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	dieOnError(t, readSessionLimits(cachedCfg, r))
+	if l := *cachedCfg.Sessions; l.Idle != 10 || l.Lifetime != 60 || l.Cleanup != 1 {
+		t.Fatalf("Wrong session limits: %+v", l)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	now := time.Now()
+	for _, test := range []struct {
+		name            string
+		lastUsed, start time.Duration // ago
+		kept            bool
+	}{
+		{"active", time.Minute, 30 * time.Minute, true},
+		{"idle", 11 * time.Minute, 30 * time.Minute, false},
+		{"outlived", time.Minute, 61 * time.Minute, false},
+	} {
+		s, err := SessionFor(httptest.NewRecorder(), r)
+		dieOnError(t, err)
+		s[LOGGEDUSER] = User{Username: "boss"}
+		s[LASTUSED], s[STARTED] = now.Add(-test.lastUsed), now.Add(-test.start)
+		s.Save()
+		if ttl := cachedCfg.sessionLimits().ttl(s, now); test.kept && ttl != 10*time.Minute {
+			t.Errorf("Wrong time to live of the %s session: %s", test.name, ttl)
+		}
+		if s, err = SessionFor(httptest.NewRecorder(), r); s[LOGGEDUSER] != nil != test.kept {
+			t.Errorf("The %s session was kept: %v", test.name, s[LOGGEDUSER] != nil)
+		}
+	}
+	s, err := SessionFor(httptest.NewRecorder(), r)
+	dieOnError(t, err)
+	s[STARTED] = now.Add(-55 * time.Minute)
+	if ttl := cachedCfg.sessionLimits().ttl(s, now); ttl != 5*time.Minute {
+		t.Errorf("The time to live does not end with the lifetime: %s", ttl)
+	}
+	s[LASTUSED] = now.Add(-time.Hour)
+	s.Save()
+	cleanupSessions()
+	if findSession(s.Id()) != nil {
+		t.Error("An expired session was not reaped")
+	}
+}
+
+func TestRememberMe(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Password: "Boss-passwd"}}}
+	cookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == REMEMBERME {
+				return c
+			}
+		}
+		return nil
+	}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader("Username=boss&Password=Boss-passwd&Remember=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	login(w, r)
+	issued := cookie(w)
+	if issued == nil || !issued.HttpOnly || issued.MaxAge < (REMEMBER_DAYS-1)*24*3600 || len(cachedCfg.Remembered) != 1 ||
+		strings.Contains(issued.Value, cachedCfg.Remembered[0].Hash) {
+		t.Fatalf("Wrong remember me cookie: %+v", issued)
+	}
+
+	visit := func(c *http.Cookie) (*httptest.ResponseRecorder, bool) {
+		logged := false
+		r := httptest.NewRequest("GET", "/certs", nil)
+		r.AddCookie(c)
+		w := httptest.NewRecorder()
+		accessControl(func(w http.ResponseWriter, r *http.Request) { logged = true }).ServeHTTP(w, r)
+		return w, logged
+	}
+	w, logged := visit(issued)
+	rotated := cookie(w)
+	if !logged || rotated == nil || rotated.Value == issued.Value ||
+		strings.Split(rotated.Value, ":")[0] != strings.Split(issued.Value, ":")[0] {
+		t.Fatalf("The remembered device was not logged in with a new validator: %+v", rotated)
+	}
+	if _, logged = visit(issued); logged || len(cachedCfg.Remembered) != 0 {
+		t.Fatal("A reused remember me token logged in")
+	}
+	if _, logged = visit(rotated); logged {
+		t.Error("The devices were not forgotten after a token reuse")
+	}
+
+	w = httptest.NewRecorder()
+	dieOnError(t, cachedCfg.remember(w, r, "boss"))
+	r = httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(cookie(w))
+	logout(httptest.NewRecorder(), r)
+	if len(cachedCfg.Remembered) != 0 {
+		t.Error("The device was remembered after logging out")
+	}
+}
+
+func TestActiveSessions(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"alice": {Username: "alice", Role: ROLE_ADMIN},
+		"bob": {Username: "bob", Role: ROLE_OPERATOR}}}
+	login := func(username string) *http.Request {
+		r := httptest.NewRequest("GET", "/sessions", nil)
+		s, err := SessionFor(httptest.NewRecorder(), r)
+		dieOnError(t, err)
+		s[LOGGEDUSER] = cachedCfg.Users[username]
+		s.Save()
+		return r
+	}
+	alice, bob, bob2 := login("alice"), login("bob"), login("bob")
+	id := func(r *http.Request) string {
+		c, err := r.Cookie(SESSIONID)
+		dieOnError(t, err)
+		return c.Value
+	}
+	post := func(r *http.Request, form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/sessions", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id(r)})
+		w := httptest.NewRecorder()
+		activeSessionsPage(w, req)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	activeSessionsPage(w, bob)
+	if out := w.Body.String(); strings.Contains(out, sessionKey(id(alice))) || !strings.Contains(out, sessionKey(id(bob2))) ||
+		strings.Contains(out, id(bob2)) {
+		t.Error("Wrong sessions shown to an operator")
+	}
+	if post(bob, "action=revoke&key="+sessionKey(id(alice))); findSession(id(alice)) == nil {
+		t.Error("An operator revoked the session of another user")
+	}
+	if post(alice, "action=revoke&key="+sessionKey(id(bob))); findSession(id(bob)) != nil {
+		t.Error("An admin could not revoke a session")
+	}
+	login("bob")
+	if w = post(bob2, "action=logoutAll"); w.Code != http.StatusFound || findSession(id(bob2)) != nil {
+		t.Fatalf("Could not log out everywhere: %d", w.Code)
+	}
+	active, _, err := activeSessions("", "")
+	dieOnError(t, err)
+	for _, a := range active {
+		if a.User == "bob" {
+			t.Error("A session was left logged in everywhere")
+		}
+	}
+}
+
+func TestSessionsPerUser(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"carol": {Username: "carol", Password: "Carol-passwd"}},
+		Sessions: &SessionLimits{Idle: 10, Cleanup: 1, PerUser: 1}}
+	login := func() (*httptest.ResponseRecorder, string) {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader("Username=carol&Password=Carol-passwd"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		login(w, r)
+		return w, followSession("", w)
+	}
+
+	w, first := login()
+	if w.Code != http.StatusFound {
+		t.Fatalf("The first login failed: %d", w.Code)
+	}
+	if w, _ = login(); w.Code != http.StatusForbidden || findSession(first) == nil {
+		t.Errorf("A login over the limit was not refused: %d", w.Code)
+	}
+	cachedCfg.Sessions.Evict = true
+	w, second := login()
+	if w.Code != http.StatusFound || findSession(first) != nil || findSession(second) == nil {
+		t.Errorf("The oldest session was not logged out over the limit: %d", w.Code)
+	}
+	active, _, err := activeSessions("carol", "")
+	dieOnError(t, err)
+	if len(active) != 1 {
+		t.Errorf("Wrong sessions left: %+v", active)
+	}
+}
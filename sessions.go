@@ -0,0 +1,161 @@
+package webca
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ActiveSession describes a logged in session without its ID, which would let anyone use it
+type ActiveSession struct {
+	Key      string // identifies the session in the forms, the first hash characters of its ID
+	User     string
+	Addr     string // of the last request
+	Started  time.Time
+	LastUsed time.Time
+	Current  bool // the session of the page
+}
+
+// sessionKey returns the key of the session with the ID
+func sessionKey(id string) string {
+	return hashToken(id)[:16]
+}
+
+// activeSessions returns the logged in sessions of the user, or of every user if empty, most
+// recently used first, and their IDs by key
+func activeSessions(username, current string) ([]ActiveSession, map[string]string, error) {
+	list, err := listSessions()
+	if err != nil {
+		return nil, nil, err
+	}
+	active := make([]ActiveSession, 0, len(list))
+	ids := make(map[string]string, len(list))
+	for _, s := range list {
+		u, ok := s[LOGGEDUSER].(User)
+		if !ok || username != "" && u.Username != username {
+			continue
+		}
+		a := ActiveSession{Key: sessionKey(s.Id()), User: u.Username, Current: s.Id() == current}
+		a.Addr, _ = s[ADDR].(string)
+		a.Started, _ = s[STARTED].(time.Time)
+		a.LastUsed, _ = s[LASTUSED].(time.Time)
+		active = append(active, a)
+		ids[a.Key] = s.Id()
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].LastUsed.After(active[j].LastUsed) })
+	return active, ids, nil
+}
+
+// activeSessionsPage lists the logged in sessions, of every user for the admins and their own for
+// the others, and revokes them one by one or all those of the user ("log out everywhere")
+func activeSessionsPage(w http.ResponseWriter, r *http.Request) {
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	u, _ := ps[LOGGEDUSER].(User)
+	username := u.Username
+	if currentUser(u).can(ROLE_ADMIN) {
+		username = ""
+	}
+	if r.Method == "POST" {
+		if r.FormValue("action") == "logoutAll" {
+			err = logoutEverywhere(u.Username)
+			if err == nil {
+				audit(AUDIT_SESSION_REVOKED, u.Username, remoteAddr(r), "all sessions of "+u.Username)
+				LoadConfig().forgetUser(u.Username)
+				RemoveSession(w, r)
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+		} else {
+			err = revokeSession(username, r.FormValue("key"))
+			if err == nil {
+				auditRequest(w, r, AUDIT_SESSION_REVOKED, "session "+r.FormValue("key"))
+			}
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+		}
+	}
+	active, _, err := activeSessions(username, s.Id())
+	if err != nil {
+		ps["Error"] = err.Error()
+	}
+	ps["Sessions"] = active
+	ps["AllUsers"] = username == ""
+	err = templatesFor(r).ExecuteTemplate(w, "sessions", ps)
+	handleError(w, r, err)
+}
+
+// admitLogin makes room for one more session of the user besides the current one, logging out their
+// oldest sessions when over the limit if so configured, or refusing the login otherwise
+func admitLogin(username, current, addr string) error {
+	l := LoadConfig().sessionLimits()
+	if l.PerUser <= 0 {
+		return nil
+	}
+	active, ids, err := activeSessions(username, current)
+	if err != nil {
+		return err
+	}
+	others := make([]ActiveSession, 0, len(active))
+	for _, a := range active {
+		if !a.Current {
+			others = append(others, a)
+		}
+	}
+	if len(others) < l.PerUser {
+		return nil
+	}
+	if !l.Evict {
+		return fmt.Errorf("%s", tr("Too many sessions open, log out of one of them first!"))
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].Started.Before(others[j].Started) })
+	for _, a := range others[:len(others)-l.PerUser+1] {
+		if err := dropSession(ids[a.Key]); err != nil {
+			return err
+		}
+		audit(AUDIT_SESSION_REVOKED, username, addr, "session "+a.Key+" over the limit")
+	}
+	return nil
+}
+
+// revokeSession logs out the session with the key, if it belongs to the user (any user if empty)
+func revokeSession(username, key string) error {
+	_, ids, err := activeSessions(username, "")
+	if err != nil {
+		return err
+	}
+	id, ok := ids[key]
+	if !ok {
+		return fmt.Errorf("%s", tr("Session not found!"))
+	}
+	return dropSession(id)
+}
+
+// logoutEverywhere logs out all the sessions of the user
+func logoutEverywhere(username string) error {
+	return logoutOthers(username, "")
+}
+
+// logoutOthers logs out all the sessions of the user but the current one, if any
+func logoutOthers(username, current string) error {
+	_, ids, err := activeSessions(username, current)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id != current {
+			if err := dropSession(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
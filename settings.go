@@ -0,0 +1,626 @@
+package webca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SettingsRequest is the part of the settings read and changed through the API, the fields not
+// given keeping their values
+type SettingsRequest struct {
+	MailServer     string `json:"mailServer"` // host:port, no mail if empty
+	MailUser       string `json:"mailUser"`
+	MailPassword   string `json:"mailPassword,omitempty"` // never returned, kept if empty
+	MailTLS        string `json:"mailTLS"`                // one of MailTLSModes, STARTTLS when offered if empty
+	MailSkipVerify bool   `json:"mailSkipVerify"`
+	MailAuth       string `json:"mailAuth"` // one of MailAuths, the first one that works if empty
+	WebCert        string `json:"webCert"`  // name of the certificate the WebCA is served with
+	NoPlainKeys    bool   `json:"noPlainKeys"`
+	AutoRenewDays  int    `json:"autoRenewDays"` // default if 0
+}
+
+// settings allows the web user to change the security and protocol settings and manage their API tokens
+func settings(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	if r.Method == "POST" {
+		if !instanceAllowed(w, r) {
+			return
+		}
+		var web *Cert
+		err := cfg.update(func(cfg *config) error {
+			next := &config{} // applied only if all the settings are right
+			*next = *cfg
+			next.NoPlainKeys = r.FormValue("NoPlainKeys") != ""
+			err := readAutoRenewDays(next, r)
+			if err == nil {
+				err = readKeyPool(next, r)
+			}
+			if err == nil {
+				err = next.setMailer(Mailer{Server: r.FormValue("MailServer"), User: r.FormValue("MailUser"),
+					Passwd: r.FormValue("MailPassword"), TLS: r.FormValue("MailTLS"),
+					SkipVerify: r.FormValue("MailSkipVerify") != "", Auth: r.FormValue("MailAuth")})
+			}
+			if name := r.FormValue("WebCert"); err == nil && name != "" &&
+				(next.WebCert == nil || name != next.WebCert.Crt.Subject.CommonName) {
+				web, err = next.setWebCert(name)
+			}
+			if err == nil {
+				err = readGRPC(next, r)
+			}
+			if err == nil {
+				err = readACME(next, r)
+			}
+			if err == nil {
+				err = readSCEP(next, r)
+			}
+			if err == nil {
+				err = readVault(next, r)
+			}
+			if err == nil {
+				err = readKubernetes(next, r)
+			}
+			if err == nil {
+				err = readCT(next, r)
+			}
+			if err == nil {
+				err = readPasswordPolicy(next, r)
+			}
+			if err == nil {
+				err = readLoginLimits(next, r)
+			}
+			if err == nil {
+				err = readRateLimits(next, r)
+			}
+			if err == nil {
+				err = readSessionLimits(next, r)
+			}
+			if err == nil {
+				err = readOIDC(next, r)
+			}
+			if err == nil {
+				err = readClientCerts(next, r)
+			}
+			if err == nil {
+				err = readWebTLS(next, r)
+			}
+			if err == nil {
+				err = readRedis(next, r)
+			}
+			if err == nil {
+				var sinks *AuditSinks
+				if sinks, err = readAuditSinks(r); err == nil {
+					next.AuditSinks = sinks
+				}
+			}
+			if err == nil {
+				*cfg = *next
+			}
+			return err
+		})
+		if err == nil {
+			wakeKeyPool()
+		}
+		if err == nil && web != nil {
+			err = serveWebCert(certFile(*web), keyFile(*web))
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_CONFIG, "settings")
+			http.Redirect(w, r, "/settings", 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	showSettings(w, r, ps)
+}
+
+// showSettings renders the settings page
+func showSettings(w http.ResponseWriter, r *http.Request, ps PageStatus) {
+	cfg := LoadConfig()
+	ps["Settings"] = cfg
+	ps["CAs"] = Authorities()
+	ps["WebCerts"] = webCertCandidates()
+	ps["Profiles"] = cfg.profileNames()
+	ps["Policy"] = cfg.passwordPolicy()
+	ps["Limits"] = cfg.loginLimits()
+	ps["Rates"] = cfg.rateLimits()
+	ps["TLSVersions"] = []string{"1.2", "1.3"}
+	ps["SessionLimits"] = cfg.sessionLimits()
+	ps["Roles"] = Roles
+	ps["KeyPoolLevels"] = keyPoolLevels()
+	if u, ok := ps[LOGGEDUSER].(User); ok {
+		ps["Tokens"] = cfg.userTokens(u.Username)
+		ps["Passkeys"] = cfg.getUser(u.Username).Passkeys
+		ps["SecondFactor"] = cfg.getUser(u.Username).SecondFactor
+		ps["Lang"] = cfg.getUser(u.Username).Lang
+		ps["Timezone"] = cfg.getUser(u.Username).Timezone
+		ps["OIDCLinked"] = cfg.getUser(u.Username).OIDCSubject != ""
+	}
+	err := templatesFor(r).ExecuteTemplate(w, "settings", ps)
+	handleError(w, r, err)
+}
+
+// apiSettings gets or changes the mailer, web certificate and general settings
+func apiSettings(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	req := SettingsRequest{NoPlainKeys: cfg.NoPlainKeys, AutoRenewDays: cfg.AutoRenewDays}
+	if cfg.Mailer != nil {
+		req.MailServer, req.MailUser = cfg.Mailer.Server, cfg.Mailer.User
+		req.MailTLS, req.MailSkipVerify, req.MailAuth = cfg.Mailer.TLS, cfg.Mailer.SkipVerify, cfg.Mailer.Auth
+	}
+	if cfg.WebCert != nil {
+		req.WebCert = cfg.WebCert.Crt.Subject.CommonName
+	}
+	if r.Method == "GET" {
+		apiReply(w, http.StatusOK, req)
+		return
+	}
+	if err := apiRead(r, &req); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.AutoRenewDays < 0 {
+		apiFail(w, http.StatusBadRequest, fmt.Errorf("%s", tr("Wrong duration!")))
+		return
+	}
+	var web *Cert
+	var wrong bool
+	err := cfg.update(func(cfg *config) error {
+		next := &config{} // applied only if all the settings are right
+		*next = *cfg
+		err := next.setMailer(Mailer{Server: req.MailServer, User: req.MailUser, Passwd: req.MailPassword,
+			TLS: req.MailTLS, SkipVerify: req.MailSkipVerify, Auth: req.MailAuth})
+		if err == nil && (next.WebCert == nil || req.WebCert != next.WebCert.Crt.Subject.CommonName) {
+			web, err = next.setWebCert(req.WebCert)
+		}
+		if err != nil {
+			wrong = true
+			return err
+		}
+		next.NoPlainKeys, next.AutoRenewDays = req.NoPlainKeys, req.AutoRenewDays
+		*cfg = *next
+		return nil
+	})
+	if err == nil && web != nil {
+		err = serveWebCert(certFile(*web), keyFile(*web))
+	}
+	if wrong {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	auditRequest(w, r, AUDIT_CONFIG, "settings")
+	req.MailPassword = ""
+	apiReply(w, http.StatusOK, req)
+}
+
+// setMailer sets the SMTP server (host:port, none disables the mail), its account and transport
+// options, keeping the password when none is given for the same account
+func (cfg *config) setMailer(m Mailer) error {
+	m.Server, m.User = strings.TrimSpace(m.Server), strings.TrimSpace(m.User)
+	if m.Server == "" {
+		cfg.Mailer = nil
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(m.Server); err != nil || port == "" {
+		return fmt.Errorf("%s: %v", tr("The mail server must be host:port!"), m.Server)
+	}
+	if err := m.checkOptions(); err != nil {
+		return err
+	}
+	if m.Passwd == "" && cfg.Mailer != nil && cfg.Mailer.User == m.User {
+		m.Passwd = cfg.Mailer.Passwd
+	}
+	m.bestAuth = nil
+	cfg.Mailer = &m
+	return nil
+}
+
+// testMail sends a test message with the mailer settings of the form, without saving them, to the
+// admin, or to the mail account when they have no email
+func testMail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := LoadConfig()
+	test := &config{Mailer: cfg.Mailer}
+	err := test.setMailer(Mailer{Server: r.FormValue("MailServer"), User: r.FormValue("MailUser"),
+		Passwd: r.FormValue("MailPassword"), TLS: r.FormValue("MailTLS"),
+		SkipVerify: r.FormValue("MailSkipVerify") != "", Auth: r.FormValue("MailAuth")})
+	if err == nil && test.Mailer == nil {
+		err = fmt.Errorf("%s", tr("There is no mail server!"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := test.Mailer.User
+	if u := requestUser(w, r); u != nil && cfg.getUser(u.Username).Email != "" {
+		to = cfg.getUser(u.Username).Email
+	}
+	auditRequest(w, r, AUDIT_CONFIG, "test mail to "+to)
+	replyTestMail(w, test.Mailer, to)
+}
+
+// readAutoRenewDays reads the days before expiry of the automatic renewals
+func readAutoRenewDays(cfg *config, r *http.Request) error {
+	cfg.AutoRenewDays = 0
+	if d := strings.TrimSpace(r.FormValue("AutoRenewDays")); d != "" {
+		days, err := strconv.Atoi(d)
+		if err != nil || days <= 0 {
+			return fmt.Errorf("%s: %v", tr("Wrong duration!"), d)
+		}
+		cfg.AutoRenewDays = days
+	}
+	return nil
+}
+
+// readGRPC reads the gRPC settings from the request (no client CA disables it)
+func readGRPC(cfg *config, r *http.Request) error {
+	ca := r.FormValue("GRPCClientCA")
+	if ca == "" {
+		cfg.GRPC = nil
+		return nil
+	}
+	port := 0
+	if p := strings.TrimSpace(r.FormValue("GRPCPort")); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("%s: %v", tr("Wrong port!"), p)
+		}
+	}
+	if _, err := FindCertOrFail(ca); err != nil {
+		return err
+	}
+	cfg.GRPC = &GRPC{Port: port, ClientCA: ca}
+	return nil
+}
+
+// readACME reads the ACME server settings from the request (no CA disables it)
+func readACME(cfg *config, r *http.Request) error {
+	ca := r.FormValue("ACMECA")
+	if ca == "" {
+		cfg.ACME = nil
+		return nil
+	}
+	days := 0
+	if d := strings.TrimSpace(r.FormValue("ACMEDays")); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil || days <= 0 {
+			return fmt.Errorf("%s: %v", tr("Wrong duration!"), d)
+		}
+	}
+	if _, err := findIssuer(ca); err != nil {
+		return err
+	}
+	profile := r.FormValue("ACMEProfile")
+	if profile != "" && cfg.getProfile(profile) == nil {
+		return fmt.Errorf("%s", tr("Unknown profile %s!", profile))
+	}
+	cfg.ACME = &ACME{CA: ca, Profile: profile, Days: days}
+	return nil
+}
+
+// readSCEP reads the SCEP enrollment settings from the request (no CA disables it)
+func readSCEP(cfg *config, r *http.Request) error {
+	ca := r.FormValue("SCEPCA")
+	if ca == "" {
+		cfg.SCEP = nil
+		return nil
+	}
+	days := 0
+	if d := strings.TrimSpace(r.FormValue("SCEPDays")); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil || days <= 0 {
+			return fmt.Errorf("%s: %v", tr("Wrong duration!"), d)
+		}
+	}
+	issuer, err := findIssuer(ca)
+	if err != nil {
+		return err
+	}
+	if keyType(issuer.Key.Public()) != RSA {
+		return fmt.Errorf("%s", tr("SCEP requires a CA with an RSA key!"))
+	}
+	challenge := r.FormValue("SCEPChallenge")
+	if challenge == "" && cfg.SCEP != nil { // kept if not changed
+		challenge = cfg.SCEP.Challenge
+	}
+	if challenge == "" {
+		return fmt.Errorf("%s", tr("SCEP requires a challenge password!"))
+	}
+	profile := r.FormValue("SCEPProfile")
+	if profile != "" && cfg.getProfile(profile) == nil {
+		return fmt.Errorf("%s", tr("Unknown profile %s!", profile))
+	}
+	cfg.SCEP = &SCEP{CA: ca, Challenge: challenge, Profile: profile, Days: days}
+	return nil
+}
+
+// readVault reads the Vault compatible API settings from the request (no CA disables it)
+func readVault(cfg *config, r *http.Request) error {
+	ca := r.FormValue("VaultCA")
+	if ca == "" {
+		cfg.Vault = nil
+		return nil
+	}
+	if _, err := findIssuer(ca); err != nil {
+		return err
+	}
+	mount := strings.Trim(strings.TrimSpace(r.FormValue("VaultMount")), "/")
+	if mount == VAULT_MOUNT {
+		mount = ""
+	}
+	cfg.Vault = &Vault{Mount: mount, CA: ca}
+	return nil
+}
+
+// readKubernetes reads the Kubernetes cluster settings from the request, keeping the published Secrets
+func readKubernetes(cfg *config, r *http.Request) error {
+	if r.FormValue("Kubernetes") == "" {
+		cfg.Kubernetes = nil
+		return nil
+	}
+	k := Kubernetes{Server: strings.TrimSpace(r.FormValue("KubeServer")),
+		Token: strings.TrimSpace(r.FormValue("KubeToken")), CA: strings.TrimSpace(r.FormValue("KubeCA")),
+		Namespace: strings.TrimSpace(r.FormValue("KubeNamespace"))}
+	if k.Server != "" {
+		if err := checkURL(k.Server); err != nil {
+			return err
+		}
+	}
+	if k.CA != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(k.CA)) {
+		return fmt.Errorf("%s", tr("Wrong Kubernetes CA certificate!"))
+	}
+	if !secretName.MatchString(k.Namespace) {
+		return fmt.Errorf("%s: %v", tr("Wrong namespace!"), k.Namespace)
+	}
+	if cfg.Kubernetes != nil {
+		if k.Token == "" { // kept if not changed
+			k.Token = cfg.Kubernetes.Token
+		}
+		k.Secrets = cfg.Kubernetes.Secrets
+	}
+	cfg.Kubernetes = &k
+	return nil
+}
+
+// readPasswordPolicy reads the user password requirements from the request (none for the defaults)
+func readPasswordPolicy(cfg *config, r *http.Request) error {
+	l, c := strings.TrimSpace(r.FormValue("PasswordMinLength")), strings.TrimSpace(r.FormValue("PasswordMinClasses"))
+	if l == "" && c == "" {
+		cfg.Passwords = nil
+		return nil
+	}
+	p := cfg.passwordPolicy()
+	var err error
+	if l != "" {
+		if p.MinLength, err = strconv.Atoi(l); err != nil || p.MinLength < 1 || p.MinLength > PASSWORD_MAX_LENGTH {
+			return fmt.Errorf("%s: %v", tr("Wrong minimum length!"), l)
+		}
+	}
+	if c != "" {
+		if p.MinClasses, err = strconv.Atoi(c); err != nil || p.MinClasses < 0 || p.MinClasses > 4 {
+			return fmt.Errorf("%s: %v", tr("Wrong number of character classes!"), c)
+		}
+	}
+	cfg.Passwords = &p
+	return nil
+}
+
+// readLoginLimits reads the login throttling from the request (none for the defaults)
+func readLoginLimits(cfg *config, r *http.Request) error {
+	l := cfg.loginLimits()
+	set := false
+	for name, value := range map[string]*int{"LoginAccountFailures": &l.AccountFailures,
+		"LoginAddressFailures": &l.AddressFailures, "LoginWindow": &l.Window, "LoginLockout": &l.Lockout} {
+		v := strings.TrimSpace(r.FormValue(name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s: %v", tr("Wrong login limit!"), v)
+		}
+		*value, set = n, true
+	}
+	if l.Window <= 0 || l.Lockout <= 0 {
+		return fmt.Errorf("%s", tr("The login window and lockout must be at least a minute!"))
+	}
+	cfg.Logins = nil
+	if set {
+		cfg.Logins = &l
+	}
+	return nil
+}
+
+// readRateLimits reads the request rate limits from the request (none for the defaults)
+func readRateLimits(cfg *config, r *http.Request) error {
+	l := cfg.rateLimits()
+	set := false
+	for name, value := range map[string]*int{"RateRequests": &l.Requests, "RateBurst": &l.Burst,
+		"RateLogins": &l.Logins, "RateDownloads": &l.Downloads} {
+		v := strings.TrimSpace(r.FormValue(name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s: %v", tr("Wrong rate limit!"), v)
+		}
+		*value, set = n, true
+	}
+	cfg.Rates = nil
+	if set {
+		cfg.Rates = &l
+	}
+	return nil
+}
+
+// readSessionLimits reads the session expiry and the sessions per user from the request (none for the defaults)
+func readSessionLimits(cfg *config, r *http.Request) error {
+	l := cfg.sessionLimits()
+	set := false
+	for name, value := range map[string]*int{"SessionIdle": &l.Idle, "SessionLifetime": &l.Lifetime,
+		"SessionCleanup": &l.Cleanup, "SessionPerUser": &l.PerUser} {
+		v := strings.TrimSpace(r.FormValue(name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s: %v", tr("Wrong session limit!"), v)
+		}
+		*value, set = n, true
+	}
+	if evict := r.FormValue("SessionOverflow") == "evict"; evict != l.Evict {
+		l.Evict, set = evict, true
+	}
+	if l.Idle <= 0 || l.Cleanup <= 0 {
+		return fmt.Errorf("%s", tr("The idle timeout and the cleanup period must be at least a minute!"))
+	}
+	cfg.Sessions = nil
+	if set {
+		cfg.Sessions = &l
+	}
+	return nil
+}
+
+// readOIDC reads the single sign on provider from the request (no issuer disables it), keeping the
+// client secret if none is given
+func readOIDC(cfg *config, r *http.Request) error {
+	issuer := strings.TrimSpace(r.FormValue("OIDCIssuer"))
+	if issuer == "" {
+		cfg.OIDC = nil
+		return nil
+	}
+	if err := checkURL(issuer); err != nil {
+		return err
+	}
+	o := OIDC{Name: strings.TrimSpace(r.FormValue("OIDCName")), Issuer: issuer,
+		ClientID: strings.TrimSpace(r.FormValue("OIDCClientID")), ClientSecret: r.FormValue("OIDCClientSecret"),
+		Scopes: strings.TrimSpace(r.FormValue("OIDCScopes")), UsernameClaim: strings.TrimSpace(r.FormValue("OIDCUsernameClaim")),
+		RolesClaim: strings.TrimSpace(r.FormValue("OIDCRolesClaim")), DefaultRole: r.FormValue("OIDCDefaultRole"),
+		CreateUsers: r.FormValue("OIDCCreateUsers") != ""}
+	if o.ClientID == "" {
+		return fmt.Errorf("%s", tr("The OpenID Connect client ID is required!"))
+	}
+	if o.ClientSecret == "" && cfg.OIDC != nil && cfg.OIDC.Issuer == issuer {
+		o.ClientSecret = cfg.OIDC.ClientSecret
+	}
+	if o.DefaultRole != "" && roleRank(o.DefaultRole) == 0 {
+		return fmt.Errorf("%s: %v", tr("Wrong role!"), o.DefaultRole)
+	}
+	for _, l := range strings.Split(r.FormValue("OIDCRoles"), "\n") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		i := strings.LastIndex(l, "=")
+		if i <= 0 || roleRank(strings.TrimSpace(l[i+1:])) == 0 {
+			return fmt.Errorf("%s: %v", tr("Wrong role mapping!"), l)
+		}
+		if o.Roles == nil {
+			o.Roles = make(map[string]string)
+		}
+		o.Roles[strings.TrimSpace(l[:i])] = strings.TrimSpace(l[i+1:])
+	}
+	cfg.OIDC = &o
+	return nil
+}
+
+// readClientCerts reads the CA whose certificates log in to the web UI (none disables it)
+func readClientCerts(cfg *config, r *http.Request) error {
+	ca := r.FormValue("ClientCertCA")
+	if ca == "" {
+		cfg.ClientCerts = nil
+		return nil
+	}
+	if _, err := findIssuer(ca); err != nil {
+		return err
+	}
+	match := r.FormValue("ClientCertMatch")
+	if match != CERT_MATCH_EMAIL {
+		match = CERT_MATCH_CN
+	}
+	cfg.ClientCerts = &ClientCerts{CA: ca, Match: match}
+	return nil
+}
+
+// readWebTLS reads the TLS hardening of the web listener (nothing set for the Go defaults), the
+// comma separated cipher suites and curves being checked
+func readWebTLS(cfg *config, r *http.Request) error {
+	wt := WebTLS{MinVersion: r.FormValue("TLSMinVersion")}
+	for name, list := range map[string]*[]string{"TLSCipherSuites": &wt.CipherSuites, "TLSCurves": &wt.Curves} {
+		for _, s := range strings.Split(r.FormValue(name), ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*list = append(*list, s)
+			}
+		}
+	}
+	if err := wt.apply(&tls.Config{}); err != nil {
+		return err
+	}
+	cfg.TLS = nil
+	if wt.MinVersion != "" || len(wt.CipherSuites) > 0 || len(wt.Curves) > 0 {
+		cfg.TLS = &wt
+	}
+	return nil
+}
+
+// readRedis reads the shared session store (no address keeps the sessions in memory), keeping the
+// password when it is left blank, and checks that it answers
+func readRedis(cfg *config, r *http.Request) error {
+	addr := strings.TrimSpace(r.FormValue("RedisAddr"))
+	if addr == "" {
+		cfg.Redis = nil
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return fmt.Errorf("%s: %v", tr("The Redis server must be host:port!"), addr)
+	}
+	db, err := strconv.Atoi(strings.TrimSpace(r.FormValue("RedisDB")))
+	if err != nil || db < 0 {
+		return fmt.Errorf("%s: %v", tr("Wrong Redis database!"), r.FormValue("RedisDB"))
+	}
+	rd := Redis{Addr: addr, Password: r.FormValue("RedisPassword"), DB: db, TLS: r.FormValue("RedisTLS") != ""}
+	if rd.Password == "" && cfg.Redis != nil && cfg.Redis.Addr == addr {
+		rd.Password = cfg.Redis.Password
+	}
+	rs := &redisStore{Redis: rd}
+	defer rs.close()
+	if _, err := rs.do("PING"); err != nil {
+		return fmt.Errorf("%s: %v", tr("Cannot connect to Redis!"), err)
+	}
+	cfg.Redis = &rd
+	return nil
+}
+
+// readCT reads the Certificate Transparency logs, one URL per line (none disables the logging)
+func readCT(cfg *config, r *http.Request) error {
+	ct := &CT{Embed: r.FormValue("CTEmbed") != ""}
+	for _, l := range strings.Split(r.FormValue("CTLogs"), "\n") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		if err := checkURL(l); err != nil {
+			return err
+		}
+		ct.Logs = append(ct.Logs, l)
+	}
+	cfg.CT = nil
+	if len(ct.Logs) > 0 {
+		cfg.CT = ct
+	}
+	return nil
+}
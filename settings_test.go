@@ -0,0 +1,72 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReconfiguration(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	defer func(saved *tls.Certificate) { served.crt = saved }(served.crt)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "ReconfCA"}, ForDays(365))
+	dieOnError(t, err)
+	old, err := GenCert(ca, "old.example.com", ForDays(30))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "new.example.com", ForDays(30))
+	dieOnError(t, err)
+	cachedCfg = &config{Users: map[string]User{"admin": {Username: "admin", Role: ROLE_ADMIN}},
+		Mailer:  &Mailer{Server: "smtp.example.com:25", User: "ca@example.com", Passwd: "s3cret"},
+		WebCert: &Cert{Crt: old.Crt, Parent: &Cert{Crt: ca.Crt}}}
+	token, err := cachedCfg.NewAPIToken("admin", "iac")
+	dieOnError(t, err)
+	call := func(method, body string) (int, SettingsRequest) {
+		req := httptest.NewRequest(method, "/api/v1/settings", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		apiAccess(api).ServeHTTP(w, req)
+		var reply SettingsRequest
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return w.Code, reply
+	}
+
+	if code, got := call("GET", ""); code != http.StatusOK || got.MailServer != "smtp.example.com:25" ||
+		got.MailPassword != "" || got.WebCert != "old.example.com" {
+		t.Fatalf("Wrong settings %d %+v", code, got)
+	}
+	code, got := call("PUT", `{"mailServer": "mail.example.com:587", "webCert": "new.example.com"}`)
+	if code != http.StatusOK || got.MailUser != "ca@example.com" || cachedCfg.Mailer.Passwd != "s3cret" ||
+		cachedCfg.getWebCert().Crt.Subject.CommonName != "new.example.com" {
+		t.Fatalf("Settings not changed %d %+v", code, got)
+	}
+	crt, err := webCertificate(nil)
+	dieOnError(t, err)
+	if !bytes.Equal(crt.Certificate[0], FindCert("new.example.com").Crt.Raw) {
+		t.Fatal("The new web certificate is not served")
+	}
+	for _, wrong := range []string{`{"webCert": "ReconfCA"}`, `{"mailServer": "mail.example.com"}`} {
+		if code, _ := call("PUT", wrong); code != http.StatusBadRequest {
+			t.Errorf("Wrong settings %s accepted with %d", wrong, code)
+		}
+	}
+	if cachedCfg.Mailer == nil || cachedCfg.Mailer.Server != "mail.example.com:587" {
+		t.Fatalf("Wrong settings partly applied: %+v", cachedCfg.Mailer)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/settings", nil)
+	ps := newPageStatus(r)
+	ps[LOGGEDUSER] = cachedCfg.Users["admin"]
+	showSettings(w, r, ps)
+	if page := w.Body.String(); !strings.Contains(page, `value="mail.example.com:587"`) ||
+		!strings.Contains(page, "<option selected\n     >new.example.com</option>") {
+		t.Fatalf("Settings not shown:\n%s", page)
+	}
+}
@@ -4,19 +4,47 @@ import (
 	"crypto/x509/pkix"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 )
 
 const (
 	SETUPADDR = "127.0.0.1"
 	SETUPPORT = 80
+	DAYS      = "days"
+	HOURS     = "hours"
 )
 
 // CertSetup contains the config to generate a certificate
 type CertSetup struct {
-	Name     pkix.Name
-	Duration int
+	Name                pkix.Name
+	Duration            int
+	Unit                string    // DAYS (default) or HOURS
+	SANs                []string  // Subject Alternative Names
+	NotBefore, NotAfter time.Time // explicit validity, overrides Duration when NotAfter is set
+}
+
+// Period returns the validity Period requested by the CertSetup
+func (cs *CertSetup) Period() (Period, error) {
+	if !cs.NotAfter.IsZero() {
+		p := Period{NotBefore: cs.NotBefore.UTC(), NotAfter: cs.NotAfter.UTC()}
+		if cs.NotBefore.IsZero() {
+			p.NotBefore, p.Backdate = time.Now().Add(-BACKDATE).UTC(), BACKDATE
+		}
+		if !p.NotAfter.After(p.NotBefore) {
+			return p, fmt.Errorf("%s", tr("Not After must be later than Not Before!"))
+		}
+		return p, nil
+	}
+	if cs.Duration <= 0 {
+		return Period{}, fmt.Errorf("%s", tr("Wrong duration!"))
+	}
+	if cs.Unit == HOURS {
+		return ForDuration(time.Duration(cs.Duration) * time.Hour), nil
+	}
+	return ForDays(cs.Duration), nil
 }
 
 // oneSetup holds the setup lock
@@ -32,13 +60,16 @@ var rootFunc func(w http.ResponseWriter, r *http.Request)
 func PrepareSetup(smux *http.ServeMux) address {
 	log.Printf("(Warning) Starting WebCA setup...")
 	rootFunc = showSetup
-	smux.HandleFunc("/", smartSwitch)
+	smux.Handle("/", csrfControl(http.HandlerFunc(smartSwitch)))
 	smux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir("img"))))
 	smux.Handle("/favicon.ico", http.FileServer(http.Dir("img")))
-	smux.Handle("/crt/", http.StripPrefix("/crt/", certServer(http.Dir("."))))
-	smux.HandleFunc("/setup", setup)
+	smux.HandleFunc("/language", setLanguage)
+	smux.Handle("/crt/", http.StripPrefix("/crt/", certServer(storage)))
+	smux.Handle("/setup", csrfControl(http.HandlerFunc(setup)))
+	smux.Handle("/testMail", csrfControl(http.HandlerFunc(setupTestMail)))
+	smux.Handle("/restore", csrfControl(http.HandlerFunc(restore)))
 	smux.HandleFunc("/restart", restart)
-	return address{addr: fmt.Sprintf("%s:%v", SETUPADDR, SETUPPORT), tls: false}
+	return address{addr: options.setupAddr(), tls: false}
 }
 
 // smartSwitch redirects to showSetup or index depending on whether the setup is done or not
@@ -55,13 +86,43 @@ func showSetup(w http.ResponseWriter, r *http.Request) {
 		"Cert":   &CertSetup{},
 		"U":      &User{},
 		"M":      &Mailer{},
+		"Sinks":  &AuditSinks{},
+		"HSM":    &HSM{},
+		"KMS":    kmsChoice{},
+		REQUEST:  r,
 	}
-	err := templates.ExecuteTemplate(w, "setup", ps)
+	err := templatesFor(r).ExecuteTemplate(w, "setup", ps)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// setupTestMail sends a test message with the mailer of the setup wizard form to the first user, or
+// to the mail account when they have no email, before the setup is done
+func setupTestMail(w http.ResponseWriter, r *http.Request) {
+	oneSetup.Lock()
+	done := setupDone
+	oneSetup.Unlock()
+	if done {
+		http.Error(w, tr("Setup is done!"), http.StatusForbidden)
+		return
+	}
+	m := readMailer(r)
+	if err := m.checkOptions(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, port, err := net.SplitHostPort(m.Server); err != nil || port == "" {
+		http.Error(w, tr("The mail server must be host:port!")+": "+m.Server, http.StatusBadRequest)
+		return
+	}
+	to := r.FormValue("Email")
+	if to == "" {
+		to = m.User
+	}
+	replyTestMail(w, &m, to)
+}
+
 // setup checks and saves the initial setup from the wizard form
 func setup(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Checking whether to do setup or not...")
@@ -74,26 +135,80 @@ func setup(w http.ResponseWriter, r *http.Request) {
 			crt, err := readCertSetup(prefix, r)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 			certs[prefix] = crt
 		}
 		mailer := readMailer(r)
+		if err := mailer.checkOptions(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sinks, err := readAuditSinks(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		ca, c := certs["CA"], certs["Cert"]
-		user.Password = crypt(user.Password)
-		log.Printf("Running setup...\nuser=%s\nca=%s\nc=%s\nmailer%s\n", user, ca, c, mailer)
-		cacert, err := GenCACert(ca.Name, ca.Duration)
+		if err := LoadConfig().passwordPolicy().check(user.Username, user.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, err := hashPassword(user.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		user.Password = hash
+		log.Printf("Running setup...")
+		caPeriod, err := ca.Period()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		certPeriod, err := c.Period()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hsm, err := readHSM(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		kms, err := readKMS(r).signer()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cacert, err := readImportedCA("CA", r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cacert != nil {
+			log.Printf("Imported CA %s", cacert.Crt.Subject.CommonName)
+		} else if kms != nil {
+			cacert, err = issueCert(nil, ca.Name, caPeriod, nil, kms)
+		} else if hsm != nil {
+			cacert, err = hsm.genCACert(ca.Name, caPeriod)
+		} else {
+			cacert, err = GenCACert(ca.Name, caPeriod)
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		cert, err := GenCert(cacert, c.Name.CommonName, c.Duration)
+		cert, err := GenCert(cacert, c.Name.CommonName, certPeriod, c.SANs...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		log.Printf("CA=%s\nCert=%s\n", cacert, cert)
 		log.Printf("Saving config...")
-		if err = NewConfig(user, cacert, cert, mailer).Save(); err != nil {
+		cfg := NewConfig(user, cacert, cert, mailer)
+		cfg.AuditSinks = sinks
+		cfg.HSM = hsm
+		if err = cfg.Save(); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -107,12 +222,12 @@ func setup(w http.ResponseWriter, r *http.Request) {
 // restart tells the user the setup is already done so she can proceed to the WebCA
 func restart(w http.ResponseWriter, r *http.Request) {
 	cfg := LoadConfig()
-	ps := PageStatus{}
-	ps["Message"] = tr("Setup is done!")
+	ps := newPageStatus(r)
+	ps["Message"] = ps.tr("Setup is done!")
 	ps["CAName"] = cfg.getWebCert().Parent.Crt.Subject.CommonName
 	ps["CertName"] = cfg.getWebCert().Crt.Subject.CommonName
 	ps["WebCAURL"] = webCAURL(cfg)
-	err := templates.ExecuteTemplate(w, "restart", ps)
+	err := templatesFor(r).ExecuteTemplate(w, "restart", ps)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
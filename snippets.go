@@ -0,0 +1,68 @@
+package webca
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	SNIPPET_DIR = "/etc/ssl/webca" // directory of the downloaded files in the snippets by default
+)
+
+// Snippet is what the web server configuration snippets of a certificate are made from
+type Snippet struct {
+	Name        string
+	Dir         string   // where the downloaded files are
+	File        string   // the file name of the downloads, without suffix
+	ServerNames []string // the DNS names of the certificate, or its name if it has none
+	CA          bool     // verify the client certificates it issues instead of serving it
+	Depth       int      // CA certificates above the client certificates
+}
+
+// newSnippet returns the snippet of the certificate with its files in the directory
+func newSnippet(c *Cert, dir string) Snippet {
+	s := Snippet{
+		Name:        c.Crt.Subject.CommonName,
+		Dir:         dir,
+		File:        filename(c.Crt.Subject.CommonName),
+		ServerNames: c.Crt.DNSNames,
+		CA:          c.Crt.IsCA,
+		Depth:       len(Chain(c)) + 1,
+	}
+	if len(s.ServerNames) == 0 {
+		s.ServerNames = []string{s.Name}
+	}
+	return s
+}
+
+// Path returns the path of the downloaded file with the suffix: .fullchain.pem for the
+// certificate followed by its chain, .key.pem for its key and .bundle.pem for both
+func (s Snippet) Path(suffix string) string {
+	return path.Join(s.Dir, s.File+suffix)
+}
+
+// Aliases returns the server names after the first one
+func (s Snippet) Aliases() []string {
+	return s.ServerNames[1:]
+}
+
+// snippets shows the nginx, Apache and HAProxy configuration of the certificate files
+func snippets(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	dir := strings.TrimSpace(r.FormValue("dir"))
+	if dir == "" {
+		dir = SNIPPET_DIR
+	}
+	ps["Cert"] = c
+	ps["Snippet"] = newSnippet(c, dir)
+	err = templatesFor(r).ExecuteTemplate(w, "snippets", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,59 @@
+package webca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSnippets(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	FakeLogin()
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{}}
+	certree = nil
+	root, err := GenCACert(pkix.Name{CommonName: "SnippetRoot"}, ForDays(365))
+	dieOnError(t, err)
+	p := ForDays(180)
+	ca, err := genCert(root, &x509.Certificate{Subject: pkix.Name{CommonName: "SnippetCA"},
+		NotBefore: p.NotBefore, NotAfter: p.NotAfter, BasicConstraintsValid: true, IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign}, nil)
+	dieOnError(t, err)
+	certree = nil
+	_, err = GenCert(ca, "snippet.example.com", ForDays(30), "snippet.example.com", "www.snippet.example.com")
+	dieOnError(t, err)
+	show := func(target string) string {
+		w := httptest.NewRecorder()
+		accessControl(snippets).ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s -> %d", target, w.Code)
+		}
+		return w.Body.String()
+	}
+	out := show("/snippets?cert=snippet.example.com&dir=/srv/tls")
+	for _, line := range []string{
+		"server_name snippet.example.com www.snippet.example.com;",
+		"ssl_certificate     /srv/tls/snippet.example.com.fullchain.pem;",
+		"ssl_certificate_key /srv/tls/snippet.example.com.key.pem;",
+		"ServerName snippet.example.com", "ServerAlias www.snippet.example.com",
+		"SSLCertificateFile    /srv/tls/snippet.example.com.fullchain.pem",
+		"bind :443 ssl crt /srv/tls/snippet.example.com.bundle.pem",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Missing %q in the server snippets", line)
+		}
+	}
+	out = show("/snippets?cert=SnippetCA")
+	for _, line := range []string{
+		"ssl_client_certificate " + SNIPPET_DIR + "/SnippetCA.fullchain.pem;", "ssl_verify_depth 2;",
+		"SSLVerifyClient require", "ca-file " + SNIPPET_DIR + "/SnippetCA.fullchain.pem verify required",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Missing %q in the client verification snippets", line)
+		}
+	}
+}
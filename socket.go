@@ -0,0 +1,65 @@
+package webca
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	UNIX_PREFIX = "unix:" // prefix of the Unix socket addresses, e.g. unix:/run/webca.sock
+	SOCKET_MODE = 0660    // default permissions of the Unix socket, for the proxy group to connect
+)
+
+// socket returns the path of the Unix socket this address is, if it is one. TLS is left to the
+// proxy in front of it
+func (a address) socket() (string, bool) {
+	if !strings.HasPrefix(a.addr, UNIX_PREFIX) {
+		return "", false
+	}
+	return strings.TrimPrefix(a.addr, UNIX_PREFIX), true
+}
+
+// socketMode returns the permissions of the Unix socket, given in octal
+func (o Options) socketMode() (os.FileMode, error) {
+	if o.SocketMode == "" {
+		return SOCKET_MODE, nil
+	}
+	mode, err := strconv.ParseUint(o.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Wrong socket mode %q", o.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listenSocket listens on the Unix socket at path with the permissions of the options, replacing
+// the one left behind by a previous run unless someone is still listening on it
+func listenSocket(path string) (net.Listener, error) {
+	mode, err := options.socketMode()
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,78 @@
+package webca
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	inTestDir(t)
+	defer func(saved Options) { options = saved }(options)
+	options = Options{SetupBind: UNIX_PREFIX + "webca.sock", SocketMode: "0600"}
+	addr := serverAddress() // of the setup wizard, with no config
+	if path, ok := addr.socket(); !ok || path != "webca.sock" || addr.String() != "unix:webca.sock" {
+		t.Fatalf("Wrong socket address: %v", addr)
+	}
+	dieOnError(t, ioutil.WriteFile("webca.sock", nil, 0600))
+	if err := addr.listenAndServe(http.NewServeMux()); err == nil {
+		t.Error("A file that is not a socket was replaced")
+	}
+	dieOnError(t, os.Remove("webca.sock"))
+	stale, err := net.Listen("unix", "webca.sock")
+	dieOnError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	smux := http.NewServeMux()
+	smux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "socket") })
+	done := make(chan error)
+	go func() { done <- addr.listenAndServe(smux) }()
+	var fi os.FileInfo
+	for i := 0; i < 100; i++ {
+		if fi, err = os.Stat("webca.sock"); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", "webca.sock"); err == nil {
+				conn.Close()
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fi == nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Wrong socket: %v", fi)
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", "webca.sock")
+	}}}
+	resp, err := client.Get("http://webca/")
+	dieOnError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "socket" {
+		t.Errorf("Wrong response through the socket: %s", body)
+	}
+	if err := addr.listenAndServe(smux); err == nil {
+		t.Error("A socket in use was replaced")
+	}
+
+	p, err := os.FindProcess(os.Getpid())
+	dieOnError(t, err)
+	dieOnError(t, p.Signal(os.Interrupt))
+	select {
+	case err := <-done:
+		dieOnError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server did not stop")
+	}
+	if _, err := os.Stat("webca.sock"); !os.IsNotExist(err) {
+		t.Errorf("The socket was not removed: %v", err)
+	}
+	if err := LoadOptions([]string{"-socket-mode", "999"}); err == nil {
+		t.Error("A wrong socket mode was accepted")
+	}
+}
@@ -0,0 +1,424 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/x509"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	SQLITE_SCHEMA = `CREATE TABLE IF NOT EXISTS files (
+	name   TEXT PRIMARY KEY,
+	dir    TEXT NOT NULL,
+	data   BLOB NOT NULL,
+	secret INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS files_dir ON files (dir, name);
+CREATE TABLE IF NOT EXISTS certs (
+	name      TEXT PRIMARY KEY,
+	dir       TEXT NOT NULL,
+	cn        TEXT NOT NULL,
+	serial    TEXT NOT NULL,
+	issuer    TEXT NOT NULL,
+	not_after INTEGER NOT NULL,
+	data      BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS certs_dir ON certs (dir, name);
+CREATE INDEX IF NOT EXISTS certs_serial ON certs (serial);
+CREATE INDEX IF NOT EXISTS certs_not_after ON certs (not_after);
+CREATE TABLE IF NOT EXISTS keys (
+	name TEXT PRIMARY KEY,
+	dir  TEXT NOT NULL,
+	data BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS keys_dir ON keys (dir, name);
+CREATE TABLE IF NOT EXISTS users (
+	username TEXT PRIMARY KEY,
+	role     TEXT NOT NULL,
+	org      TEXT NOT NULL,
+	data     BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS revocations (
+	serial  TEXT PRIMARY KEY,
+	name    TEXT NOT NULL,
+	issuer  TEXT NOT NULL,
+	revoked TEXT NOT NULL,
+	reason  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS revocations_issuer ON revocations (issuer);
+CREATE TABLE IF NOT EXISTS audit (
+	seq      INTEGER PRIMARY KEY,
+	action   TEXT NOT NULL,
+	username TEXT NOT NULL,
+	entry    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_action ON audit (action, seq);
+CREATE INDEX IF NOT EXISTS audit_username ON audit (username, seq);`
+)
+
+// sqlRunner runs the statements of a database or of one of its transactions
+type sqlRunner interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlStorage keeps the CA data in a single SQLite database, with real transactions and queries.
+// The certificates, keys, users, revocations and audit log have tables of their own, the users and
+// revocations being split from and joined back to the config and revocation index files, and the
+// rest of the state files are rows of the files table
+type sqlStorage struct {
+	db      sqlRunner
+	changed *[]string // names written within the transaction, notified once committed
+}
+
+// UseSQLite keeps the CA data in the SQLite database of the dsn, through the database/sql driver
+// registered under that name by the main package (e.g. "sqlite" or "sqlite3")
+func UseSQLite(driver, dsn string) error {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1) // SQLite writes one at a time anyway
+	if _, err := db.Exec(SQLITE_SCHEMA); err != nil {
+		db.Close()
+		return fmt.Errorf("Failed to prepare the database %s: %s", dsn, err)
+	}
+	storage = sqlStorage{db: db}
+	return nil
+}
+
+// sqlName returns the name cleaned as the key of its table, "" being the top directory
+func sqlName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// sqlTable returns the table of the file of the (clean) name, other than the config and the
+// revocation index
+func sqlTable(name string) string {
+	switch {
+	case strings.HasSuffix(name, KEY_SUFFIX):
+		return "keys"
+	case strings.HasSuffix(name, CERT_SUFFIX):
+		return "certs"
+	}
+	return "files"
+}
+
+// notExist is the error of a missing file
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (s sqlStorage) Get(name string) ([]byte, error) {
+	name = sqlName(name)
+	switch name {
+	case WEBCA_CFG:
+		var data []byte
+		err := s.Tx(func(tx Storage) error {
+			var err error
+			data, err = tx.(sqlStorage).getConfig()
+			return err
+		})
+		return data, err
+	case WEBCA_REVOKED:
+		return s.getRevocations()
+	}
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM "+sqlTable(name)+" WHERE name = ?", name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, notExist("get", name)
+	}
+	return data, err
+}
+
+func (s sqlStorage) Put(name string, data []byte, secret bool) error {
+	if data == nil {
+		data = []byte{}
+	}
+	name = sqlName(name)
+	var err error
+	switch table := sqlTable(name); {
+	case name == WEBCA_CFG:
+		err = s.Tx(func(tx Storage) error { return tx.(sqlStorage).putConfig(data, secret) })
+	case name == WEBCA_REVOKED:
+		err = s.Tx(func(tx Storage) error { return tx.(sqlStorage).putRevocations(data) })
+	case table == "certs":
+		var cn, serial, issuer string
+		var notAfter int64
+		if block, _ := pem.Decode(data); block != nil && block.Type == "CERTIFICATE" {
+			if crt, err := x509.ParseCertificate(block.Bytes); err == nil {
+				cn, serial, issuer = crt.Subject.CommonName, serialKey(crt.SerialNumber), crt.Issuer.CommonName
+				notAfter = crt.NotAfter.Unix()
+			}
+		}
+		_, err = s.db.Exec("INSERT OR REPLACE INTO certs (name, dir, cn, serial, issuer, not_after, data) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?)", name, sqlName(path.Dir(name)), cn, serial, issuer, notAfter, data)
+	case table == "keys": // always secret
+		_, err = s.db.Exec("INSERT OR REPLACE INTO keys (name, dir, data) VALUES (?, ?, ?)",
+			name, sqlName(path.Dir(name)), data)
+	default:
+		_, err = s.db.Exec("INSERT OR REPLACE INTO files (name, dir, data, secret) VALUES (?, ?, ?, ?)",
+			name, sqlName(path.Dir(name)), data, secret)
+	}
+	if err == nil {
+		s.notify(name)
+	}
+	return err
+}
+
+// notify records the name as changed, for the Certree, once the transaction if any is committed
+func (s sqlStorage) notify(name string) {
+	if s.changed != nil {
+		*s.changed = append(*s.changed, name)
+	} else {
+		certFilesChanged(name)
+	}
+}
+
+func (s sqlStorage) List(dir string) ([]string, error) {
+	dir = sqlName(dir)
+	rows, err := s.db.Query("SELECT name FROM files WHERE dir = ? UNION ALL SELECT name FROM certs WHERE dir = ? "+
+		"UNION ALL SELECT name FROM keys WHERE dir = ? ORDER BY name", dir, dir, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, path.Base(name))
+	}
+	return names, rows.Err()
+}
+
+// Delete removes the file, the users with the config and all the revocations with their index, in
+// a transaction
+func (s sqlStorage) Delete(name string) error {
+	name = sqlName(name)
+	err := s.Tx(func(tx Storage) error {
+		db := tx.(sqlStorage).db
+		var res sql.Result
+		var err error
+		switch name {
+		case WEBCA_CFG:
+			if _, err = db.Exec("DELETE FROM users"); err == nil {
+				res, err = db.Exec("DELETE FROM files WHERE name = ?", name)
+			}
+		case WEBCA_REVOKED:
+			res, err = db.Exec("DELETE FROM revocations")
+		default:
+			res, err = db.Exec("DELETE FROM "+sqlTable(name)+" WHERE name = ?", name)
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return notExist("delete", name)
+		}
+		return nil
+	})
+	if err == nil {
+		s.notify(name)
+	}
+	return err
+}
+
+func (s sqlStorage) Tx(f func(tx Storage) error) error {
+	db, ok := s.db.(*sql.DB)
+	if !ok {
+		return f(s) // joins the running transaction
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	changed := make([]string, 0)
+	if err := f(sqlStorage{db: tx, changed: &changed}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	certFilesChanged(changed...)
+	return nil
+}
+
+// getConfig joins the users to the config file
+func (s sqlStorage) getConfig() ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM files WHERE name = ?", WEBCA_CFG).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, notExist("get", WEBCA_CFG)
+	} else if err != nil {
+		return nil, err
+	}
+	cfg := &config{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("Could not decode %s: %s", WEBCA_CFG, err)
+	}
+	rows, err := s.db.Query("SELECT data FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&u); err != nil {
+			return nil, fmt.Errorf("Could not decode a user: %s", err)
+		}
+		if cfg.Users == nil {
+			cfg.Users = make(map[string]User)
+		}
+		cfg.Users[u.Username] = u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(cfg)
+	return buf.Bytes(), err
+}
+
+// putConfig saves the users of the config in the users table and the rest in the config file
+// (within a transaction)
+func (s sqlStorage) putConfig(data []byte, secret bool) error {
+	cfg := &config{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(cfg); err != nil {
+		return fmt.Errorf("Could not decode %s: %s", WEBCA_CFG, err)
+	}
+	if _, err := s.db.Exec("DELETE FROM users"); err != nil {
+		return err
+	}
+	for _, u := range cfg.Users {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(u); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec("INSERT INTO users (username, role, org, data) VALUES (?, ?, ?, ?)",
+			u.Username, u.Role, u.Org, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	cfg.Users = nil
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("INSERT OR REPLACE INTO files (name, dir, data, secret) VALUES (?, ?, ?, ?)",
+		WEBCA_CFG, "", buf.Bytes(), secret)
+	return err
+}
+
+// getRevocations returns the revocation index made of the revocations table, none if empty
+func (s sqlStorage) getRevocations() ([]byte, error) {
+	rows, err := s.db.Query("SELECT serial, name, issuer, revoked, reason FROM revocations ORDER BY serial")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	idx := &revokedIndex{Serials: make(map[string]Revocation)}
+	for rows.Next() {
+		var rv Revocation
+		var revoked string
+		if err := rows.Scan(&rv.Serial, &rv.Name, &rv.Issuer, &revoked, &rv.Reason); err != nil {
+			return nil, err
+		}
+		if rv.Time, err = time.Parse(time.RFC3339Nano, revoked); err != nil {
+			return nil, err
+		}
+		idx.Serials[rv.Serial] = rv
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(idx.Serials) == 0 {
+		return nil, notExist("get", WEBCA_REVOKED)
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(idx)
+	return buf.Bytes(), err
+}
+
+// putRevocations replaces the revocations table with the revocation index (within a transaction)
+func (s sqlStorage) putRevocations(data []byte) error {
+	idx := &revokedIndex{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(idx); err != nil {
+		return fmt.Errorf("Could not decode %s: %s", WEBCA_REVOKED, err)
+	}
+	if _, err := s.db.Exec("DELETE FROM revocations"); err != nil {
+		return err
+	}
+	for serial, rv := range idx.Serials {
+		if _, err := s.db.Exec("INSERT INTO revocations (serial, name, issuer, revoked, reason) VALUES (?, ?, ?, ?, ?)",
+			serial, rv.Name, rv.Issuer, rv.Time.Format(time.RFC3339Nano), rv.Reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s sqlStorage) AppendAudit(e AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO audit (seq, action, username, entry) VALUES (?, ?, ?, ?)",
+		e.Seq, e.Action, e.User, string(data))
+	return err
+}
+
+func (s sqlStorage) LastAudit() (AuditEntry, error) {
+	var last AuditEntry
+	var data string
+	err := s.db.QueryRow("SELECT entry FROM audit ORDER BY seq DESC LIMIT 1").Scan(&data)
+	if err == sql.ErrNoRows {
+		return last, nil
+	} else if err != nil {
+		return last, err
+	}
+	if err := json.Unmarshal([]byte(data), &last); err != nil {
+		return last, fmt.Errorf("Corrupted audit entry: %s", err)
+	}
+	return last, nil
+}
+
+func (s sqlStorage) AuditEntries(action, user string, offset, limit int) ([]AuditEntry, error) {
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	rows, err := s.db.Query("SELECT entry FROM audit WHERE (? = '' OR action = ?) AND (? = '' OR username = ?) "+
+		"ORDER BY seq DESC LIMIT ? OFFSET ?", action, action, user, user, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var data string
+		var e AuditEntry
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return entries, fmt.Errorf("Corrupted audit entry: %s", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,377 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSQL is an in-memory database/sql driver running just the statements of sqlStorage, its
+// tables being the rows by key (the first column) and column
+type fakeSQL struct {
+	sync.Mutex
+	tables map[string]fakeTable
+}
+
+type fakeTable map[string]map[string]driver.Value
+
+var fakeDB = &fakeSQL{}
+
+// reset empties the tables
+func (db *fakeSQL) reset() {
+	db.tables = make(map[string]fakeTable)
+	for _, table := range []string{"files", "certs", "keys", "users", "revocations", "audit"} {
+		db.tables[table] = make(fakeTable)
+	}
+}
+
+func init() {
+	fakeDB.reset()
+	sql.Register("webca-fake", fakeDB)
+}
+
+func (db *fakeSQL) Open(dsn string) (driver.Conn, error) {
+	return &fakeConn{db: db}, nil
+}
+
+// fakeConn is a connection to the fakeSQL database, and its running transaction
+type fakeConn struct {
+	db *fakeSQL
+	tx map[string]fakeTable // tables as changed by the transaction, nil out of one
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c, query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.Lock()
+	defer c.db.Unlock()
+	c.tx = make(map[string]fakeTable, len(c.db.tables))
+	for name, table := range c.db.tables {
+		c.tx[name] = make(fakeTable, len(table))
+		for key, row := range table {
+			c.tx[name][key] = row
+		}
+	}
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.Lock()
+	defer c.db.Unlock()
+	c.db.tables, c.tx = c.tx, nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.tx = nil
+	return nil
+}
+
+// tables returns the tables seen by the connection
+func (c *fakeConn) tables() map[string]fakeTable {
+	if c.tx != nil {
+		return c.tx
+	}
+	return c.db.tables
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+var (
+	fakeInsert = regexp.MustCompile(`^INSERT (OR REPLACE )?INTO (\w+) \(([\w, ]+)\) VALUES`)
+	fakeDelete = regexp.MustCompile(`^DELETE FROM (\w+)( WHERE name = \?)?$`)
+	fakeSelect = regexp.MustCompile(`^SELECT ([\w, ]+) FROM (\w+)( WHERE name = \?)?( ORDER BY \w+)?$`)
+)
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.db.Lock()
+	defer s.c.db.Unlock()
+	tables := s.c.tables()
+	if s.query == SQLITE_SCHEMA {
+		return driver.ResultNoRows, nil
+	} else if m := fakeInsert.FindStringSubmatch(s.query); m != nil {
+		key := fmt.Sprint(args[0])
+		if _, ok := tables[m[2]][key]; ok && m[1] == "" {
+			return nil, fmt.Errorf("UNIQUE constraint failed: %s", m[2])
+		}
+		row := make(map[string]driver.Value)
+		for i, column := range strings.Split(m[3], ", ") {
+			row[column] = args[i]
+		}
+		tables[m[2]][key] = row
+		return driver.RowsAffected(1), nil
+	} else if m := fakeDelete.FindStringSubmatch(s.query); m != nil {
+		table := tables[m[1]]
+		if m[2] == "" {
+			tables[m[1]] = make(fakeTable)
+			return driver.RowsAffected(len(table)), nil
+		}
+		if _, ok := table[args[0].(string)]; !ok {
+			return driver.RowsAffected(0), nil
+		}
+		delete(table, args[0].(string))
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unexpected statement %s", s.query)
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.db.Lock()
+	defer s.c.db.Unlock()
+	tables := s.c.tables()
+	rows := &fakeRows{}
+	var keys []string
+	switch {
+	case strings.HasPrefix(s.query, "SELECT name FROM files WHERE dir = ? UNION ALL "):
+		rows.columns = []string{"name"}
+		for _, table := range []string{"files", "certs", "keys"} {
+			for key, row := range tables[table] {
+				if row["dir"] == args[0] {
+					keys = append(keys, key)
+				}
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			rows.values = append(rows.values, []driver.Value{key})
+		}
+	case strings.HasPrefix(s.query, "SELECT entry FROM audit "):
+		rows.columns = []string{"entry"}
+		for key := range tables["audit"] {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { // latest first
+			return tables["audit"][keys[i]]["seq"].(int64) > tables["audit"][keys[j]]["seq"].(int64)
+		})
+		action, user, limit, offset := "", "", int64(1), int64(0)
+		if len(args) > 0 {
+			action, user, limit, offset = args[0].(string), args[2].(string), args[4].(int64), args[5].(int64)
+		}
+		for _, key := range keys {
+			row := tables["audit"][key]
+			if (action == "" || row["action"] == action) && (user == "" || row["username"] == user) {
+				if offset > 0 {
+					offset--
+				} else if limit < 0 || int64(len(rows.values)) < limit {
+					rows.values = append(rows.values, []driver.Value{row["entry"]})
+				}
+			}
+		}
+	default:
+		m := fakeSelect.FindStringSubmatch(s.query)
+		if m == nil {
+			return nil, fmt.Errorf("unexpected query %s", s.query)
+		}
+		rows.columns = strings.Split(m[1], ", ")
+		for key := range tables[m[2]] {
+			if m[3] == "" || key == args[0] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			values := make([]driver.Value, len(rows.columns))
+			for i, column := range rows.columns {
+				values[i] = tables[m[2]][key][column]
+			}
+			rows.values = append(rows.values, values)
+		}
+	}
+	return rows, nil
+}
+
+// fakeRows are the results of a query
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestSQLStorage(t *testing.T) {
+	defer func(saved Storage) { storage = saved }(storage)
+	fakeDB.reset()
+	dieOnError(t, UseSQLite("webca-fake", "tests.db"))
+	dieOnError(t, storage.Put("a.pem", []byte("public"), false))
+	dieOnError(t, storage.Put("old/b.key.pem", []byte("secret"), true))
+	if row, ok := fakeDB.tables["keys"]["old/b.key.pem"]; !ok || row["dir"] != "old" {
+		t.Errorf("The key is not kept in the keys table: %+v", row)
+	}
+	if row, ok := fakeDB.tables["certs"]["a.pem"]; !ok || row["cn"] != "" {
+		t.Errorf("A file that is no certificate was indexed as one: %+v", row)
+	}
+	if data, err := storage.Get("/old/../a.pem"); err != nil || string(data) != "public" {
+		t.Errorf("Wrong file read: %q %v", data, err)
+	}
+	if names, err := storage.List(""); err != nil || strings.Join(names, ",") != "a.pem" {
+		t.Errorf("Wrong files listed: %v %v", names, err)
+	}
+	if names, err := storage.List("old"); err != nil || strings.Join(names, ",") != "b.key.pem" {
+		t.Errorf("Wrong files listed in old: %v %v", names, err)
+	}
+	if _, err := storage.Get("c.pem"); !os.IsNotExist(err) {
+		t.Errorf("A missing file was read: %v", err)
+	}
+	if err := storage.Delete("c.pem"); !os.IsNotExist(err) {
+		t.Errorf("A missing file was deleted: %v", err)
+	}
+
+	failed := fmt.Errorf("failed")
+	err := storage.Tx(func(tx Storage) error {
+		dieOnError(t, tx.Put("c.pem", []byte("new"), false))
+		dieOnError(t, tx.Delete("a.pem"))
+		if names, _ := tx.List(""); strings.Join(names, ",") != "c.pem" {
+			t.Errorf("The transaction does not see its changes: %v", names)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("The transaction error was lost: %v", err)
+	}
+	if _, err := storage.Get("c.pem"); !os.IsNotExist(err) {
+		t.Error("A failed transaction was applied")
+	}
+	if names, _ := storage.List(""); strings.Join(names, ",") != "a.pem" {
+		t.Errorf("A failed transaction left changes behind: %v", names)
+	}
+	dieOnError(t, storage.Tx(func(tx Storage) error {
+		if err := tx.Delete("a.pem"); err != nil {
+			return err
+		}
+		return tx.Put("old/c.pem", []byte("new"), false)
+	}))
+	if _, err := storage.Get("a.pem"); !os.IsNotExist(err) {
+		t.Error("The transaction did not delete")
+	}
+	if data, err := storage.Get("old/c.pem"); err != nil || string(data) != "new" {
+		t.Errorf("The transaction did not write: %q %v", data, err)
+	}
+
+	defer func(saved *Certree) { certree = saved }(certree)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "SQLCA"}, ForDays(365))
+	dieOnError(t, err)
+	if _, ok := fakeDB.tables["keys"]["SQLCA"+KEY_SUFFIX]; !ok {
+		t.Fatal("The CA key was not kept in the database")
+	}
+	if row := fakeDB.tables["certs"]["SQLCA"+CERT_SUFFIX]; row["cn"] != "SQLCA" ||
+		row["serial"] != serialKey(ca.Crt.SerialNumber) || row["not_after"] != ca.Crt.NotAfter.Unix() {
+		t.Fatalf("The CA certificate was not indexed: %+v", row)
+	}
+	certree = nil
+	if c := FindCert("SQLCA"); c == nil || c.Key == nil || !c.Crt.Equal(ca.Crt) {
+		t.Error("The CA was not loaded from the database")
+	}
+	if names, err := storage.List(""); err != nil ||
+		strings.Join(names, ",") != WEBCA_SERIALS+",SQLCA"+KEY_SUFFIX+",SQLCA"+CERT_SUFFIX {
+		t.Errorf("Wrong certificates and keys listed: %v %v", names, err)
+	}
+}
+
+func TestSQLStorageTables(t *testing.T) {
+	defer func(saved Storage) { storage = saved }(storage)
+	fakeDB.reset()
+	dieOnError(t, UseSQLite("webca-fake", "tests.db"))
+
+	cfg := &config{Users: map[string]User{"ann": {Username: "ann", Role: ROLE_ADMIN},
+		"bob": {Username: "bob", Role: ROLE_VIEWER, Org: "blue"}}, TrashDays: 7}
+	dieOnError(t, saveGob(WEBCA_CFG, cfg))
+	if row := fakeDB.tables["users"]["bob"]; row["role"] != ROLE_VIEWER || row["org"] != "blue" {
+		t.Fatalf("The users were not kept in their table: %+v", row)
+	}
+	loaded := &config{}
+	dieOnError(t, loadGob(WEBCA_CFG, loaded))
+	if len(loaded.Users) != 2 || loaded.Users["bob"].Org != "blue" || loaded.TrashDays != 7 {
+		t.Fatalf("The config was not joined back to its users: %+v", loaded)
+	}
+	delete(cfg.Users, "bob")
+	dieOnError(t, saveGob(WEBCA_CFG, cfg))
+	if _, ok := fakeDB.tables["users"]["bob"]; ok {
+		t.Error("A deleted user was kept")
+	}
+
+	idx := &revokedIndex{Serials: map[string]Revocation{"0A": {Serial: "0A", Name: "a.example.com",
+		Issuer: "CA", Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Reason: 1}}}
+	dieOnError(t, saveGob(WEBCA_REVOKED, idx))
+	if row := fakeDB.tables["revocations"]["0A"]; row["issuer"] != "CA" {
+		t.Fatalf("The revocation was not kept in its table: %+v", row)
+	}
+	got := &revokedIndex{}
+	dieOnError(t, loadGob(WEBCA_REVOKED, got))
+	if rv := got.Serials["0A"]; len(got.Serials) != 1 || rv.Name != "a.example.com" || !rv.Time.Equal(idx.Serials["0A"].Time) {
+		t.Fatalf("Wrong revocations read: %+v", got)
+	}
+	dieOnError(t, storage.Delete(WEBCA_REVOKED))
+	if _, err := storage.Get(WEBCA_REVOKED); !os.IsNotExist(err) {
+		t.Errorf("The revocations were not deleted: %v", err)
+	}
+
+	for _, e := range []AuditEntry{{Seq: 1, Action: AUDIT_LOGIN, User: "ann"}, {Seq: 2, Action: AUDIT_ISSUE, User: "ann"},
+		{Seq: 3, Action: AUDIT_LOGIN, User: "bob"}, {Seq: 4, Action: AUDIT_LOGIN, User: "ann"}} {
+		dieOnError(t, storage.AppendAudit(e))
+	}
+	if err := storage.AppendAudit(AuditEntry{Seq: 4}); err == nil {
+		t.Error("An audit entry was written twice")
+	}
+	if last, err := storage.LastAudit(); err != nil || last.Seq != 4 {
+		t.Errorf("Wrong last audit entry: %+v %v", last, err)
+	}
+	seqs := func(entries []AuditEntry) string {
+		s := make([]string, 0)
+		for _, e := range entries {
+			s = append(s, fmt.Sprint(e.Seq))
+		}
+		return strings.Join(s, ",")
+	}
+	for _, c := range []struct {
+		action, user  string
+		offset, limit int
+		want          string
+	}{{"", "", 0, 0, "4,3,2,1"}, {AUDIT_LOGIN, "", 0, 0, "4,3,1"}, {AUDIT_LOGIN, "ann", 0, 0, "4,1"},
+		{"", "", 1, 2, "3,2"}, {"", "bob", 0, 1, "3"}} {
+		if entries, err := storage.AuditEntries(c.action, c.user, c.offset, c.limit); err != nil || seqs(entries) != c.want {
+			t.Errorf("Wrong audit entries for %+v: %s %v", c, seqs(entries), err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package webca
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Storage keeps the certificates, keys, config and state files of the CA by name, a slash separated
+// path relative to the data directory, so that other backends can replace the working directory
+type Storage interface {
+	Get(name string) ([]byte, error)                 // an os.ErrNotExist error if there is no such file
+	Put(name string, data []byte, secret bool) error // secret files are kept from any other reader
+	List(dir string) ([]string, error)               // names of the files directly in dir, "" being the top
+	Delete(name string) error                        // an os.ErrNotExist error if there is no such file
+	Tx(f func(tx Storage) error) error               // applies all the changes of f, none if it fails
+
+	// the audit log, whose entries are appended right away, out of the transactions
+	AppendAudit(e AuditEntry) error                                            // after the last entry
+	LastAudit() (AuditEntry, error)                                            // an empty entry if there is none
+	AuditEntries(action, user string, offset, limit int) ([]AuditEntry, error) // latest first, all if limit <= 0
+}
+
+// storage holds the CA data, in the working directory unless replaced
+var storage Storage = dirStorage(".")
+
+// dirStorage keeps the files in a directory, each one written atomically
+type dirStorage string
+
+// path returns the file path of the name
+func (d dirStorage) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (d dirStorage) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(d.path(name))
+}
+
+func (d dirStorage) Put(name string, data []byte, secret bool) error {
+	file := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if secret {
+		perm = 0600
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // if the rename failed
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err == nil {
+		certFilesChanged(name)
+	}
+	return err
+}
+
+func (d dirStorage) List(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(d.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if !fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d dirStorage) Delete(name string) error {
+	err := os.Remove(d.path(name))
+	if err == nil {
+		certFilesChanged(name)
+	}
+	return err
+}
+
+func (d dirStorage) Tx(f func(tx Storage) error) error {
+	return runTx(d, f)
+}
+
+// txChange is a pending write, or a deletion if data is nil
+type txChange struct {
+	data   []byte
+	secret bool
+}
+
+// txStorage holds the changes of a transaction over a storage until they are committed
+type txStorage struct {
+	base    Storage
+	order   []string
+	changes map[string]txChange
+}
+
+// runTx runs f over a transaction of the storage, applying its changes only if it succeeds, for the
+// backends without transactions of their own
+func runTx(base Storage, f func(tx Storage) error) error {
+	tx := &txStorage{base: base, changes: make(map[string]txChange)}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for _, name := range tx.order {
+		var err error
+		if c := tx.changes[name]; c.data != nil {
+			err = base.Put(name, c.data, c.secret)
+		} else if err = base.Delete(name); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to commit %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// change records a change of the name
+func (tx *txStorage) change(name string, c txChange) {
+	name = path.Clean(name)
+	if _, ok := tx.changes[name]; !ok {
+		tx.order = append(tx.order, name)
+	}
+	tx.changes[name] = c
+}
+
+func (tx *txStorage) Get(name string) ([]byte, error) {
+	if c, ok := tx.changes[path.Clean(name)]; ok {
+		if c.data == nil {
+			return nil, &os.PathError{Op: "get", Path: name, Err: os.ErrNotExist}
+		}
+		return c.data, nil
+	}
+	return tx.base.Get(name)
+}
+
+func (tx *txStorage) Put(name string, data []byte, secret bool) error {
+	if data == nil {
+		data = []byte{}
+	}
+	tx.change(name, txChange{data, secret})
+	return nil
+}
+
+func (tx *txStorage) List(dir string) ([]string, error) {
+	names, err := tx.base.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	for _, name := range names {
+		listed[name] = true
+	}
+	for name, c := range tx.changes {
+		if path.Dir(name) == path.Clean("./"+dir) {
+			listed[path.Base(name)] = c.data != nil
+		}
+	}
+	names = names[:0]
+	for name, ok := range listed {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (tx *txStorage) Delete(name string) error {
+	if _, err := tx.Get(name); err != nil {
+		return err
+	}
+	tx.change(name, txChange{})
+	return nil
+}
+
+func (tx *txStorage) Tx(f func(tx Storage) error) error {
+	return f(tx) // joins the running transaction
+}
+
+func (tx *txStorage) AppendAudit(e AuditEntry) error {
+	return tx.base.AppendAudit(e)
+}
+
+func (tx *txStorage) LastAudit() (AuditEntry, error) {
+	return tx.base.LastAudit()
+}
+
+func (tx *txStorage) AuditEntries(action, user string, offset, limit int) ([]AuditEntry, error) {
+	return tx.base.AuditEntries(action, user, offset, limit)
+}
+
+// loadGob decodes the stored file into v, with an os.ErrNotExist error if there is none
+func loadGob(name string, v interface{}) error {
+	data, err := storage.Get(name)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(v); err != nil {
+		return fmt.Errorf("Could not decode "+name+": %s", err)
+	}
+	return nil
+}
+
+// saveGob encodes v into the stored file, kept secret
+func saveGob(name string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return storage.Put(name, buf.Bytes(), true)
+}
@@ -0,0 +1,66 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStorage(t *testing.T) {
+	dieOnError(t, os.MkdirAll("tests", 0750))
+	defer func() { dieOnError(t, os.RemoveAll("tests")) }()
+	defer func(saved Storage) { storage = saved }(storage)
+	storage = dirStorage("tests")
+	dieOnError(t, storage.Put("a.pem", []byte("public"), false))
+	dieOnError(t, storage.Put("old/b.key.pem", []byte("secret"), true))
+	if fi, err := os.Stat("tests/old/b.key.pem"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("The secret file is not kept secret: %v %v", fi, err)
+	}
+	if names, err := storage.List(""); err != nil || strings.Join(names, ",") != "a.pem" {
+		t.Errorf("Wrong files listed: %v %v", names, err)
+	}
+	if _, err := storage.Get("../ca_test.go"); !os.IsNotExist(err) {
+		t.Errorf("A file out of the storage was read: %v", err)
+	}
+
+	failed := fmt.Errorf("failed")
+	err := storage.Tx(func(tx Storage) error {
+		dieOnError(t, tx.Put("c.pem", []byte("new"), false))
+		dieOnError(t, tx.Delete("a.pem"))
+		if names, _ := tx.List(""); strings.Join(names, ",") != "c.pem" {
+			t.Errorf("The transaction does not see its changes: %v", names)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("The transaction error was lost: %v", err)
+	}
+	if _, err := storage.Get("c.pem"); !os.IsNotExist(err) {
+		t.Error("A failed transaction was applied")
+	}
+	dieOnError(t, storage.Tx(func(tx Storage) error {
+		if err := tx.Delete("a.pem"); err != nil {
+			return err
+		}
+		return tx.Put("old/c.pem", []byte("new"), false)
+	}))
+	if _, err := storage.Get("a.pem"); !os.IsNotExist(err) {
+		t.Error("The transaction did not delete")
+	}
+	if data, err := storage.Get("old/c.pem"); err != nil || string(data) != "new" {
+		t.Errorf("The transaction did not write: %q %v", data, err)
+	}
+
+	defer func(saved *Certree) { certree = saved }(certree)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "StoredCA"}, ForDays(365))
+	dieOnError(t, err)
+	if _, err := os.Stat("tests/StoredCA" + KEY_SUFFIX); err != nil {
+		t.Fatalf("The CA was not kept in the storage: %v", err)
+	}
+	if c := FindCert("StoredCA"); c == nil || c.Key == nil || !c.Crt.Equal(ca.Crt) {
+		t.Error("The CA was not loaded from the storage")
+	}
+}
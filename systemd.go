@@ -0,0 +1,69 @@
+package webca
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+var listenFDsStart = 3
+
+// activated keeps the listeners passed by systemd, read once as the variables are unset then
+var activated struct {
+	sync.Once
+	lns []net.Listener
+	err error
+}
+
+// systemdListeners returns the listeners systemd bound for this process (LISTEN_PID and
+// LISTEN_FDS), so privileged ports can be served without running as root
+func systemdListeners() ([]net.Listener, error) {
+	activated.Do(func() {
+		activated.lns, activated.err = listenFDs()
+	})
+	return activated.lns, activated.err
+}
+
+// listenFDs turns the file descriptors passed by systemd into listeners, unsetting the variables
+// so child processes do not take them as theirs
+func listenFDs() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	lns := []net.Listener{}
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f) // a dup, so the file is not needed anymore
+		f.Close()
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// serveListeners serves TLS with srv on all the listeners until one of them fails
+func serveListeners(srv *http.Server, lns []net.Listener) error {
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			errs <- srv.ServeTLS(ln, "", "")
+		}(ln)
+	}
+	return <-errs
+}
@@ -0,0 +1,50 @@
+package webca
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	if lns, err := listenFDs(); err != nil || lns != nil {
+		t.Fatalf("Listeners without socket activation: %v %v", lns, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	dieOnError(t, err)
+	defer f.Close()
+	defer func(saved int) { listenFDsStart = saved }(listenFDsStart)
+	listenFDsStart = int(f.Fd())
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	if lns, _ := listenFDs(); lns != nil || os.Getenv("LISTEN_FDS") != "1" {
+		t.Error("The sockets of another process were taken")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	lns, err := listenFDs()
+	dieOnError(t, err)
+	if len(lns) != 1 || lns[0].Addr().String() != ln.Addr().String() {
+		t.Fatalf("Wrong listeners: %v", lns)
+	}
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+		t.Error("The variables were not unset")
+	}
+	addr := ln.Addr().String()
+	ln.Close() // only the passed one accepts then
+	defer lns[0].Close()
+	go http.Serve(lns[0], http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "activated") }))
+	resp, err := http.Get("http://" + addr)
+	dieOnError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "activated" {
+		t.Errorf("Wrong response through the passed socket: %s", body)
+	}
+}
@@ -7,9 +7,9 @@ const (
 	//
 	//
 	htmlTemplates = `{{define "setuphtmlheader"}}
-<html>
+<html lang="{{lang}}">
 <head>
-<title>WebCA (Setup)</title>
+<title>WebCA ({{tr "Setup"}})</title>
 <style type="text/css">
 {{template "style.css"}}
 </style>
@@ -20,12 +20,12 @@ const (
 <tr>
 <td>
 <h1>
-<img height="80px" src="/img/CASeal.png"/>
+<img height="80px" src="{{base}}/img/CASeal.png"/>
 </h1>
 </td>
 <td class="titleCell">
 <h1>
-WebCA Setup:
+WebCA {{tr "Setup"}}:
 <label class="activated" id="Step1">
 <label class="bigger">1</label>
 <label class="explanation">{{tr "First User & Mailer Configuration"}}</label>
@@ -50,17 +50,28 @@ WebCA Setup:
 {{template "JSSetupNavigation"}}
 {{template "JSToggleOps"}}
 {{template "JSCheckpasswd"}}
+{{template "JSTestMail"}}
 </script>
 {{end}}
 
 {{define "htmlheader"}}
 <div class="topbar">
-<a href="/"><h1><img height="80px" src="/img/CASeal.png"/>WebCA</h1></a>
+<a href="{{base}}/"><h1><img height="80px" src="{{base}}/img/CASeal.png"/>WebCA</h1></a>
 <style type="text/css">
 {{template "style.css"}}
 </style>
   <div class="loggedUser">
-{{if .LoggedUser}} Logged as: {{.LoggedUser.Fullname}} (<a href="/logout">logout</a>)
+{{if .LoggedUser}} <a class="bell" href="{{base}}/inbox" title='{{tr "Inbox"}}'>&#128276;{{with .Unread}}<span class="unread">{{.}}</span>{{end}}</a>
+{{tr "Logged as"}}: {{.LoggedUser.Fullname}} (<form class="inline" action="{{base}}/logout" method="post">{{template "csrf" .}}<button type="submit" class="link"
+>{{tr "logout"}}</button></form>)
+<br/><a href="{{base}}/expiring">{{tr "Expiring"}}</a> |
+{{if .Instance}}<a href="{{base}}/notifications">{{tr "Notifications"}}</a> |
+<a href="{{base}}/profiles">{{tr "Profiles"}}</a> | <a href="{{base}}/webhooks">{{tr "Webhooks"}}</a> |
+<a href="{{base}}/users">{{tr "Users"}}</a> | <a href="{{base}}/organizations">{{tr "Organizations"}}</a> | <a href="{{base}}/audit">{{tr "Audit"}}</a> |
+<a href="{{base}}/backups">{{tr "Backups"}}</a> | <a href="{{base}}/trash">{{tr "Trash"}}</a> |{{end}}
+<a href="{{base}}/requests">{{tr "Requests"}}</a> |
+<a href="{{base}}/settings">{{tr "Settings"}}</a> | <a href="{{base}}/sessions">{{tr "Sessions"}}</a> |
+<a href="{{base}}/profile">{{tr "Profile"}}</a>
 {{end}}
   </div>
 </div>
@@ -72,12 +83,14 @@ WebCA Setup:
 
 {{define "htmlfooter"}}
 <div class="footer">
-	<a href="http://github.com/josvazg/webca">Hosted on GitHub</a><br/>
+	{{range $i, $l := languages}}{{if $i}} | {{end}}<a href="{{base}}/language?lang={{$l.Tag}}" hreflang="{{$l.Tag}}"
+	   lang="{{$l.Tag}}">{{$l.Name}}</a>{{end}}<br/>
+	<a href="http://github.com/josvazg/webca">{{tr "Hosted on GitHub"}}</a><br/>
 	<a rel="license" href="http://creativecommons.org/licenses/by/3.0/"><img 
-       alt="Licencia Creative Commons" style="border-width:0" src="/img/ccby.png" />
+       alt="Licencia Creative Commons" style="border-width:0" src="{{base}}/img/ccby.png" />
     </a><br /><a rel="license" href="http://creativecommons.org/licenses/by/3.0/">
-    Creative Commons Attribution 3.0 License</a>.
-    <div>Icons made by <a href="https://www.freepik.com/?__hstc=57440181.eb47fcd240644e16c7809b3861793c2e.1558013566347.1558013566347.1558019646753.2&__hssc=57440181.1.1558019646753&__hsfp=3787192423" title="Freepik">Freepik</a> from <a href="https://www.flaticon.com/" 			    title="Flaticon">www.flaticon.com</a> is licensed by <a href="http://creativecommons.org/licenses/by/3.0/" 			    title="Creative Commons BY 3.0" target="_blank">CC 3.0 BY</a></div>
+    {{tr "Creative Commons Attribution 3.0 License"}}</a>.
+    <div>{{tr "Icons made by"}} <a href="https://www.freepik.com/?__hstc=57440181.eb47fcd240644e16c7809b3861793c2e.1558013566347.1558013566347.1558019646753.2&__hssc=57440181.1.1558019646753&__hsfp=3787192423" title="Freepik">Freepik</a> {{tr "from"}} <a href="https://www.flaticon.com/" 			    title="Flaticon">www.flaticon.com</a> {{tr "is licensed by"}} <a href="http://creativecommons.org/licenses/by/3.0/" 			    title="Creative Commons BY 3.0" target="_blank">CC 3.0 BY</a></div>
 </div>
 </body>
 </html>
@@ -126,6 +139,14 @@ WebCA Setup:
 <tr class="ops"><td class="label">{{tr "Country"}}:</td>
     <td><input type="text" name="{{.Prfx}}.Country" id="{{.Prfx}}.Country"
                            value="{{indexOf .Crt.Name.Country 0}}"></td></tr>
+<tr class="ops"><td class="label">{{tr "Alternative Names"}}:</td>
+    <td><textarea name="{{.Prfx}}.SANs" id="{{.Prfx}}.SANs" rows="2" cols="40"
+        title='{{tr "DNS names, IPs, emails or URIs separated by commas or spaces"}}'
+        >{{join .Crt.SANs ", "}}</textarea></td></tr>
+{{template "certValidity" .}}
+{{end}}
+
+{{define "certValidity"}}
 <tr class="ops"><td class="label">{{tr "Duration in Days"}}:</td>
     <td><select id="{{.Prfx}}.Duration" name="{{.Prfx}}.Duration">
             <option value='30' 
@@ -147,6 +168,19 @@ WebCA Setup:
             <option value='3650' 
                     {{if .IsSelected 3650}}selected="selected"{{end}}>{{tr "10 Years"}}</option>
 	</select></td></tr>
+<tr class="ops"><td class="label">{{tr "Or Custom Duration"}}:</td>
+    <td><input type="text" size="6" name="{{.Prfx}}.Custom" id="{{.Prfx}}.Custom"
+               value="{{if eq .Crt.Unit "hours"}}{{.Crt.Duration}}{{end}}">
+        <select id="{{.Prfx}}.Unit" name="{{.Prfx}}.Unit">
+            <option value='days'>{{tr "Days"}}</option>
+            <option value='hours' {{if eq .Crt.Unit "hours"}}selected="selected"{{end}}>{{tr "Hours"}}</option>
+	</select></td></tr>
+<tr class="ops"><td class="label">{{tr "Or Valid From"}}:</td>
+    <td><input type="datetime-local" name="{{.Prfx}}.NotBefore" id="{{.Prfx}}.NotBefore"
+               value="{{if not .Crt.NotBefore.IsZero}}{{.Crt.NotBefore.Format "2006-01-02T15:04"}}{{end}}"></td></tr>
+<tr class="ops"><td class="label">{{tr "Valid Until"}}:</td>
+    <td><input type="datetime-local" name="{{.Prfx}}.NotAfter" id="{{.Prfx}}.NotAfter"
+               value="{{if not .Crt.NotAfter.IsZero}}{{.Crt.NotAfter.Format "2006-01-02T15:04"}}{{end}}"></td></tr>
 {{end}}
 
 {{define "mailerDetails"}}
@@ -161,18 +195,76 @@ WebCA Setup:
 <tr><td class="label">{{tr "Repeat Password"}}:</td>
     <td class="label"><input type="password" id="M.Password2" name="M.Password2" 
         onkeyup="checkPassword(this)"></td></tr>
+<tr><td class="label">{{tr "TLS"}}:</td>
+    <td class="label"><select name="M.TLS">
+        <option value=""{{if eq .M.TLS ""}} selected{{end}}>{{tr "STARTTLS when offered"}}</option>
+        <option value="starttls"{{if eq .M.TLS "starttls"}} selected{{end}}>{{tr "STARTTLS required"}}</option>
+        <option value="tls"{{if eq .M.TLS "tls"}} selected{{end}}>{{tr "Implicit TLS (port 465)"}}</option>
+        <option value="none"{{if eq .M.TLS "none"}} selected{{end}}>{{tr "No TLS"}}</option></select></td></tr>
+<tr><td class="label">{{tr "Authentication"}}:</td>
+    <td class="label"><select name="M.Auth">
+        <option value=""{{if eq .M.Auth ""}} selected{{end}}>{{tr "The first one that works"}}</option>
+        <option{{if eq .M.Auth "PLAIN"}} selected{{end}}>PLAIN</option>
+        <option{{if eq .M.Auth "LOGIN"}} selected{{end}}>LOGIN</option>
+        <option{{if eq .M.Auth "CRAM-MD5"}} selected{{end}}>CRAM-MD5</option></select></td></tr>
+<tr><td colspan="2"><input type="checkbox" name="M.SkipVerify" value="1"{{if .M.SkipVerify}} checked{{end}}>
+{{tr "Don't verify the certificate of the mail server"}}</td></tr>
+<tr><td colspan="2"><input type="button" value='{{tr "Send test email"}}' onclick="testMail(this.form)">
+<pre id="mailTest"></pre></td></tr>
 {{end}}
 
-{{define "certNode"}}
-<div class="indent">
+{{define "auditSinksDetails"}}
+<tr><td class="label">{{tr "Syslog Server"}}:</td>
+    <td class="label"><input type="text" name="AuditSyslog" placeholder="host:514"
+        value="{{with .}}{{.Syslog}}{{end}}"><select name="AuditNetwork">
+        <option value="udp">UDP</option>
+        <option value="tcp"{{with .}}{{if eq .Network "tcp"}} selected{{end}}{{end}}>TCP</option></select></td></tr>
+<tr><td class="label">{{tr "JSON Lines File"}}:</td>
+    <td class="label"><input type="text" name="AuditJSONFile" value="{{with .}}{{.JSONFile}}{{end}}"></td></tr>
+{{end}}
+
+{{define "hsmDetails"}}
+<tr><td class="label">{{tr "PKCS#11 Module"}}:</td>
+    <td class="label"><input type="text" name="HSMModule" placeholder="/usr/lib/softhsm/libsofthsm2.so"
+        value="{{.Module}}"></td></tr>
+<tr><td class="label">{{tr "Slot"}}:</td>
+    <td class="label"><input type="text" name="HSMSlot" value="{{.Slot}}"></td></tr>
+<tr><td class="label">{{tr "PIN"}}:</td>
+    <td class="label"><input type="password" name="HSMPIN"></td></tr>
+<tr><td class="label">{{tr "pkcs11-tool"}}:</td>
+    <td class="label"><input type="text" name="HSMTool" placeholder="pkcs11-tool" value="{{.Tool}}"></td></tr>
+{{end}}
+
+{{define "kmsDetails"}}
+<tr><td class="label">{{tr "CA key in"}}:</td>
+    <td class="label"><select name="KMSProvider">
+{{range .Providers}}
+        <option value="{{.ID}}" {{if eq .ID $.Provider}}selected="selected"{{end}}>{{.Name}}</option>
+{{end}}
+    </select></td></tr>
+<tr><td class="label">{{tr "KMS Key"}}:</td>
+    <td class="label"><input type="text" name="KMSKey" placeholder="{{tr "Generated by webca if empty"}}"
+        value="{{.Key}}"></td></tr>
+{{end}}
+
+{{define "certTree"}}
+<ul class="tree">
 {{range .}}
-<span class="Cert">
-<a href="certControl?cert={{.Crt.Subject.CommonName}}">{{.Crt.Subject.CommonName}}</a>
-</span>
+<li>{{if or .Nodes .CanIssue}}<details open><summary>{{end}}
+{{if not .Crt.NotAfter.IsZero}}<input type="checkbox" name="cert" value="{{.Crt.Subject.CommonName}}" form="batch">
+<a href="{{base}}/certControl?cert={{qEsc .Crt.Subject.CommonName}}"
+   ><span class="{{if .Crt.IsCA}}CA{{else}}Cert{{end}}">{{.Crt.Subject.CommonName}}</span></a>
 <span class="period">{{showPeriod .Crt}}</span>
-{{template "certNode" .Childs}}
+{{else}}<span class="CA">{{.Crt.Subject.CommonName}}</span>{{end}}
+{{if or .Nodes .CanIssue}}</summary>
+{{template "certTree" .Nodes}}
+{{if .CanIssue}}<div class="indent"><a href="{{base}}/cert?parent={{qEsc .Crt.Subject.CommonName}}"
+     >+ {{tr "Add more Certificates to %s..." .Crt.Subject.CommonName}}</a>
+     <a href="{{base}}/bulk?parent={{qEsc .Crt.Subject.CommonName}}">{{tr "Bulk..."}}</a></div>{{end}}
+</details>{{end}}
+</li>
 {{end}}
-</div>
+</ul>
 {{end}}
 `
 
@@ -186,6 +278,64 @@ function $(id) {
 	return document.getElementById(id);
 }
 {{end}}
+{{define "JSWebAuthn"}}
+function b64urlToBuf(s) {
+	s = s.replace(/-/g, '+').replace(/_/g, '/');
+	while (s.length % 4) s += '=';
+	var bin = atob(s), buf = new Uint8Array(bin.length);
+	for (var i = 0; i < bin.length; i++) buf[i] = bin.charCodeAt(i);
+	return buf.buffer;
+}
+function bufToB64url(buf) {
+	var bytes = new Uint8Array(buf), bin = '';
+	for (var i = 0; i < bytes.length; i++) bin += String.fromCharCode(bytes[i]);
+	return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+function webauthnPost(url, body) {
+	return fetch(url, {method: 'POST', credentials: 'same-origin',
+		headers: {'Content-Type': 'application/json', 'X-CSRF-Token': '{{.CSRF}}'},
+		body: JSON.stringify(body)})
+	.then(function(resp) {
+		return resp.json().then(function(v) {
+			if (!resp.ok) throw new Error(v.error);
+			return v;
+		});
+	});
+}
+function passkeyRegister(name) {
+	webauthnPost('{{base}}/webauthn/register/begin', {}).then(function(o) {
+		o.challenge = b64urlToBuf(o.challenge);
+		o.user.id = b64urlToBuf(o.user.id);
+		o.excludeCredentials.forEach(function(c) { c.id = b64urlToBuf(c.id); });
+		return navigator.credentials.create({publicKey: o});
+	}).then(function(c) {
+		return webauthnPost('{{base}}/webauthn/register/finish', {id: c.id, name: name,
+			clientDataJSON: bufToB64url(c.response.clientDataJSON),
+			attestationObject: bufToB64url(c.response.attestationObject)});
+	}).then(function() { location.reload(); }).catch(function(e) { alert(e.message); });
+}
+function passkeyLogin(username, url) {
+	webauthnPost('{{base}}/webauthn/login/begin', {username: username}).then(function(o) {
+		o.challenge = b64urlToBuf(o.challenge);
+		o.allowCredentials.forEach(function(c) { c.id = b64urlToBuf(c.id); });
+		return navigator.credentials.get({publicKey: o});
+	}).then(function(c) {
+		return webauthnPost('{{base}}/webauthn/login/finish', {id: c.id, url: url,
+			clientDataJSON: bufToB64url(c.response.clientDataJSON),
+			authenticatorData: bufToB64url(c.response.authenticatorData),
+			signature: bufToB64url(c.response.signature)});
+	}).then(function(r) { location.href = r.url; }).catch(function(e) { alert(e.message); });
+}
+{{end}}
+{{define "JSTestMail"}}
+function testMail(form) {
+	$('mailTest').textContent = '{{tr "Sending..."}}';
+	fetch('{{base}}/testMail', {method: 'POST', credentials: 'same-origin', body: new FormData(form)})
+	.then(function(resp) { return resp.text(); })
+	.then(function(t) { $('mailTest').textContent = t; })
+	.catch(function(e) { $('mailTest').textContent = e.message; });
+}
+{{end}}
 {{define "JSEvents"}}
 function addEvent (x,y,z) { 
 	if (document.addEventListener){ 
@@ -334,7 +484,7 @@ function checkPassword(el) {
 	//
 	pages = `{{define "setup"}}
 {{template "setuphtmlheader" .}}
-<form action="/setup" method="post">
+<form action="{{base}}/setup" method="post" enctype="multipart/form-data">{{template "csrf" $}}
 <table style="width: 100%; height: 500px">
 <tr>
 <td class="huge">
@@ -348,6 +498,7 @@ function checkPassword(el) {
 <h2>{{tr "First User & Mailer Configuration"}}</h2>
 <div class="explanation">
 {{tr "You'll need a user and a password in order to use this application."}} <br/>
+{{tr "Next you'll create a new CA or import an existing one, or you can restore a backup below instead."}}
 </div>
 <table class="form">
 {{template "userDetails" .}}
@@ -359,6 +510,12 @@ function checkPassword(el) {
 <table class="form">
 {{template "mailerDetails" .}}
 </table>
+<div class="explanation">
+{{tr "The audit events can also be sent to a syslog server or written to a file for your SIEM tooling"}}
+</div>
+<table class="form">
+{{template "auditSinksDetails" .Sinks}}
+</table>
 </div>
 <div id="form2" style="display: none">
 <h2>{{tr "Certificate Authority"}}</h2>
@@ -373,6 +530,27 @@ function checkPassword(el) {
 {{.LoadCrt .CA "CA" 1095}}
 {{template "certCommonFields" .}}
 </table>
+<div class="explanation">
+{{tr "The CA keys can live in an HSM or SoftHSM instead, through its PKCS#11 module and OpenSC's pkcs11-tool"}}
+</div>
+<table class="form">
+{{template "hsmDetails" .HSM}}
+</table>
+<div class="explanation">
+{{tr "Or in a cloud KMS, with the credentials of its command line tool"}}
+</div>
+<table class="form">
+{{template "kmsDetails" .KMS}}
+</table>
+<div class="explanation">
+{{tr "Or import an existing CA from its PEM certificate (followed by its chain, if any) and private key"}}
+</div>
+<table class="form">
+<tr><td class="label">{{tr "CA Certificate"}}:</td>
+    <td><input type="file" name="CA.CertFile" accept=".pem,.crt"></td></tr>
+<tr><td class="label">{{tr "CA Private Key"}}:</td>
+    <td><input type="file" name="CA.KeyFile" accept=".pem,.key"></td></tr>
+</table>
 </div>
 <div id="form3" style="display: none">
 <h2>{{tr "WebCA's Server Certificate"}}</h2>
@@ -400,6 +578,18 @@ function checkPassword(el) {
 </tr>
 </table>
 </form>
+<form action="{{base}}/restore" method="post" enctype="multipart/form-data">{{template "csrf" $}}
+<div class="explanation">
+{{tr "Or restore the backup of another WebCA instead"}}
+</div>
+<table class="form">
+<tr><td class="label">{{tr "Backup"}}:</td>
+    <td><input type="file" name="Backup"></td></tr>
+<tr><td class="label">{{tr "Passphrase"}}:</td>
+    <td><input type="password" name="BackupPassphrase">
+    <input type="submit" value='{{tr "Restore"}}'></td></tr>
+</table>
+</form>
 {{template "htmlfooter"}}
 {{end}}
 
@@ -433,16 +623,18 @@ function checkPassword(el) {
 <label class="notice" id="noticeText">{{.Error}}<label>
 </div>
 {{end}}
-<form action="/login" method="post">
+<form action="{{base}}/login" method="post">{{template "csrf" $}}
 <input type="hidden" id="_SESSION_ID" name="_SESSION_ID" value="{{._SESSION_ID}}"/>
 <input type="hidden" id="URL" name="URL" value="{{.URL}}"/>
 <table class="form">
 <tr><td class="label">{{tr "Username"}}:</td>
-    <td><input type="text" class="main" name="Username" value="{{.Username}}">
+    <td><input type="text" class="main" id="Username" name="Username" value="{{.Username}}">
     </td></tr>
 <tr><td class="label">{{tr "Password"}}:</td>
     <td><input type="password" class="main" name="Password" value="{{.Password}}">
     </td></tr>
+<tr><td colspan="2" style="text-align: center"><input type="checkbox" name="Remember" value="1">
+    {{tr "Keep me logged in on this computer"}}</td></tr>
 </tr>
 <td class="label" colspan="2" style="text-align: center">
 <input type="submit" id="submit" name="submit" value='{{tr "Login"}}'>
@@ -450,6 +642,17 @@ function checkPassword(el) {
 </tr>
 </table>
 </form>
+<p><a href="#" onclick="passkeyLogin($('Username').value, {{.URL}}); return false;">{{tr "Sign in with a passkey"}}</a></p>
+{{with .SSO}}<p><a href="{{base}}/oidc/login?URL={{$.URL}}">{{tr "Sign in with %s" .}}</a></p>{{end}}
+{{with .SSO}}
+<h2>{{tr "Single sign on"}}</h2>
+<form action="{{base}}/oidc/link" method="post">{{template "csrf" $}}
+{{if $.OIDCLinked}}{{tr "Your account is linked to %s." .}}{{else}}{{tr "Link your account to %s to sign in with it." .}}{{end}}
+<input type="submit" value='{{if $.OIDCLinked}}{{tr "Link again"}}{{else}}{{tr "Link"}}{{end}}'></form>
+{{end}}
+<script type="text/javascript">
+{{template "JSWebAuthn" .}}
+</script>
 
 {{template "htmlfooter"}}
 {{end}}
@@ -458,36 +661,91 @@ function checkPassword(el) {
 {{define "index"}}
 {{template "htmlheader" .}}
 <h2>{{tr "WebCA's Index"}}</h2>
+<form action="{{base}}/" method="get">
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+{{with .Filter}}
+<table class="form">
+<tr><td class="label">{{tr "Name"}}:</td>
+    <td><input type="text" name="Name" value="{{.Name}}"></td>
+    <td class="label">{{tr "Alternative Name"}}:</td>
+    <td><input type="text" name="SAN" value="{{.SAN}}"></td>
+    <td class="label">{{tr "Serial"}}:</td>
+    <td><input type="text" name="Serial" value="{{.Serial}}"></td></tr>
+<tr><td class="label">{{tr "Tag"}}:</td>
+    <td><input type="text" name="Tag" value="{{.Tag}}" placeholder="env:prod"></td>
+    <td class="label">{{tr "SHA-256 Fingerprint"}}:</td>
+    <td colspan="3"><input type="text" name="Fingerprint" value="{{.Fingerprint}}" size="60"
+                           placeholder="AB:CD:..."></td></tr>
+<tr><td class="label">{{tr "Issuer"}}:</td>
+    <td><input type="text" name="Issuer" value="{{.Issuer}}"></td>
+    <td class="label">{{tr "Expires after"}}:</td>
+    <td><input type="date" name="ExpiresAfter"
+               value="{{if not .ExpiresAfter.IsZero}}{{.ExpiresAfter.Format "2006-01-02"}}{{end}}"></td>
+    <td class="label">{{tr "Expires before"}}:</td>
+    <td><input type="date" name="ExpiresBefore"
+               value="{{if not .ExpiresBefore.IsZero}}{{.ExpiresBefore.Format "2006-01-02"}}{{end}}"></td></tr>
+<tr><td colspan="6"><input type="submit" value='{{tr "Search"}}'>
+{{if not .IsEmpty}}<a href="{{base}}/">{{tr "Show all"}}</a>{{end}}</td></tr>
+</table>
+{{end}}
+</form>
+{{with .Page}}
 <div class="data">
-<div class="CATitle">{{tr "Local CAs:"}}</div>
-{{range .CAs}}
-<a href="/certControl?cert={{.Crt.Subject.CommonName}}"><span class="CA">
-{{.Crt.Subject.CommonName}}
-</span></a>
-<span class="period">{{showPeriod .Crt}}</span></span>
-{{template "certNode" .Childs}}
-<div class="Cert"><a href="/cert?parent={{qEsc .Crt.Subject.CommonName}}"
-     >+ {{tr "Add more Certificates to %s..." .Crt.Subject.CommonName}}</a></div><br/>
+<div class="CATitle">{{if $.Filter.IsEmpty}}{{tr "All Certificates:"}}{{else}}{{tr "Search Results:"}}{{end}}</div>
+{{range .Certs}}
+<div class="Cert"><input type="checkbox" name="cert" value="{{.Crt.Subject.CommonName}}" form="batch">
+<a href="{{base}}/certControl?cert={{qEsc .Crt.Subject.CommonName}}">{{.Crt.Subject.CommonName}}</a>
+<span class="period">{{showPeriod .Crt}}</span>
+{{tr "issued by %s" .Crt.Issuer.CommonName}} ({{.Crt.SerialNumber | printf "%X"}})
+{{range tags .}}<a class="tag" href="{{base}}/?Tag={{.}}">{{.}}</a> {{end}}
+</div>
+{{else}}
+<div class="explanation">{{tr "No certificates found."}}</div>
 {{end}}
-<p/>
-<div class="CA"><a href="/cert">+ {{tr "Add more CAs..."}}</a></div>
-<!--
+<div class="paging">
+{{if .HasPrev}}<a href="{{.URL 1}}">&lt;&lt;</a> <a href="{{.URL .Prev}}">&lt;</a>{{end}}
+{{tr "Page %d of %d (%d certificates)" .Number .Pages .Total}}
+{{if .HasNext}}<a href="{{.URL .Next}}">&gt;</a> <a href="{{.URL .Pages}}">&gt;&gt;</a>{{end}}
+</div>
+<div class="explanation">{{tr "Export these certificates"}}:
+<a href="{{base}}{{.ExportURL "csv"}}">CSV</a> <a href="{{base}}{{.ExportURL "json"}}">JSON</a></div>
+</div>
+{{else}}
+<div class="data">
+<div class="CATitle">{{tr "Local CAs:"}}</div>
+{{template "certTree" .CAs}}
+<div class="CA"><a href="{{base}}/cert">+ {{tr "Add more CAs..."}}</a></div>
+<div class="explanation">{{tr "Trust bundle with all the CAs (no login required)"}}:
+<a href="{{base}}/ca-bundle.pem">ca-bundle.pem</a> <a href="{{base}}/ca-bundle.der">ca-bundle.der</a>
+<a href="{{base}}/ca-bundle.p7b">ca-bundle.p7b</a></div>
+<div class="explanation">{{tr "Export the whole inventory"}}:
+<a href="{{base}}/export?format=csv">CSV</a> <a href="{{base}}/export?format=json">JSON</a></div>
+{{with .Others}}
 <div class="CATitle">{{tr "Externally Managed Certificates:"}}</div>
-{{range .Others}}
-<span class="CA"><a href="/cert">{{.Crt.Subject.CommonName}}</a></span>
-<span class="period">{{showPeriod .Crt}}</span>
-{{template "certNode" .Childs}}
+{{template "certTree" .}}
 {{end}}
-<div class="CA"><a href="/import">+ {{tr "Import more..."}}</a></div>
 </div>
--->
+{{end}}
+<form id="batch" action="{{base}}/batch" method="post">{{template "csrf" $}}
+<div class="explanation">{{tr "Selected certificates"}}:
+<button type="submit" name="action" value="renew">{{tr "Renew"}}</button>
+<label><input type="checkbox" name="rekey" value="1"> {{tr "New key pair"}}</label> |
+<select name="reason">{{range .Reasons}}<option value="{{.Code}}">{{tr .Name}}</option>{{end}}</select>
+<button type="submit" name="action" value="revoke"
+        onclick="return confirm('{{tr "Are you sure you want to revoke the selected certificates?"}}')"
+        >{{tr "Revoke"}}</button></div>
+</form>
 {{template "htmlfooter"}}
 {{end}}
 
 {{define "cert"}}
 {{template "htmlheader" .}}
 <h2>{{.Title}}</h2>
-<form action="/gen" method="post">
+<form action="{{base}}/gen" method="post">{{template "csrf" $}}
 <table class="form">
 <input type="hidden" name="parent" value="{{.parent}}"/>
 {{if .Error}}
@@ -495,12 +753,27 @@ function checkPassword(el) {
 <label class="notice" id="noticeText">{{.Error}}<label>
 </div>
 {{end}}
+{{if .Profiles}}
+<tr><td class="label">{{tr "Profile"}}:</td>
+    <td><select name="profile"
+         onchange="location='{{base}}/cert?parent={{qEsc .parent}}&profile='+encodeURIComponent(this.value)">
+            <option value="">{{tr "None"}}</option>
+{{range .Profiles}}
+            <option value="{{.}}" {{if eq . $.ProfileName}}selected="selected"{{end}}>{{.}}</option>
+{{end}}
+	</select></td></tr>
+{{end}}
 <tr><td class="mainlabel">{{.CommonName}}:</td>
     <td><input type="text" class="main" name="Cert.CommonName" 
                                         value="{{.Cert.Name.CommonName}}"></td>
 </tr>
 {{.LoadCrt .Cert "Cert" 365}}
 {{template "certCommonFields" .}}
+{{template "kmsDetails" .KMS}}
+{{if and .parent .PlainKeys}}
+<tr><td colspan="2"><input type="checkbox" name="NoStoredKey" value="1"{{if .NoStoredKey}} checked{{end}}>
+    {{tr "Don't store the key: download it now with the certificate, it won't be available later"}}</td></tr>
+{{end}}
 <tr>
 <td colspan="2"><input type="submit" id="submit" name="submit" value='{{.Action}}'></td>
 </tr>
@@ -512,10 +785,19 @@ function checkPassword(el) {
 {{define "certControl"}}
 {{template "htmlheader" .}}
 <h2>{{.Title}}</h2>
-<form action="/ctrl" method="post">
+<form action="{{base}}/ctrl" method="post">{{template "csrf" $}}
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
 <table class="form">
 <tr><td colspan="4" class="bigger">{{.Cert.Crt.Subject.CommonName}}</td></tr>
 <tr><td colspan="4"><span class="period">{{showPeriod .Cert.Crt}}</span></td></tr>
+{{with .Revoked}}
+<tr><td colspan="4" class="revoked">{{if .OnHold}}{{tr "On hold since %s" ((inZone .Time).Format "2006/01/02 15:04")}}{{else}}
+{{tr "Revoked on %s" ((inZone .Time).Format "2006/01/02 15:04")}} ({{tr .ReasonName}}){{end}}</td></tr>
+{{end}}
 {{with .Cert.Crt.Subject}}
 <tr><td colspan="4">{{indexOf .OrganizationalUnit 0}}</td></tr>
 <tr><td colspan="4">{{indexOf .Organization 0}}</td></tr>
@@ -523,38 +805,1838 @@ function checkPassword(el) {
 <tr><td colspan="4">{{indexOf .PostalCode 0}}, {{indexOf .Locality 0}} ({{indexOf .Province 0}})
  {{indexOf .Country 0}}</td></tr>
 <tr>
-<td><a href="/cert/{{.CommonName}}.pem" title='{{tr "Download"}}'>
-<img width="64px" src="/img/download.png"/></a></td>
+<td><a href="{{base}}/cert/{{.CommonName}}.pem" title='{{tr "Download"}}'>
+<img width="64px" src="{{base}}/img/download.png"/></a></td>
 {{end}}
 {{if .Cert.Childs}}
-{{else}}
-<td><a href="/cert/{{.CommonName}}.key.pem" title='{{tr "Download Key"}}'>
-<img width="64px" src="/img/key.png"/></a></td>
+{{else if .PlainKeys}}
+<td><a href="{{base}}/cert/{{.CommonName}}.key.pem" title='{{tr "Download Key"}}'>
+<img width="64px" src="{{base}}/img/key.png"/></a></td>
 {{end}}
 {{with .Cert.Crt.Subject}}
-<td><a href="/renew?cert={{.CommonName}}" title='{{tr "Renew"}}'>
-<img width="64px" src="/img/renew.png"/></a></td>
-<td><a href="/clone?cert={{.CommonName}}" title='{{tr "Clone"}}'>
-<img width="64px" src="/img/copy.png"/></a></td>
+<td><a href="{{base}}/renew?cert={{.CommonName}}" title='{{tr "Renew"}}'>
+<img width="64px" src="{{base}}/img/renew.png"/></a></td>
+<td><a href="{{base}}/clone?cert={{.CommonName}}" title='{{tr "Clone"}}'>
+<img width="64px" src="{{base}}/img/copy.png"/></a></td>
 {{end}}
 {{if .Cert.Childs}}
 {{with .Cert.Crt.Subject}}
 <td>
-<img width="64px" src="/img/delete.png" style="opacity:0.4; filter:alpha(opacity=40);" 
+<img width="64px" src="{{base}}/img/delete.png" style="opacity:0.4; filter:alpha(opacity=40);" 
      title='{{tr "Can't delete Certificate with Children Certificates"}}'/>
 </td>
 {{end}}
 {{else}}
 {{with .Cert.Crt.Subject}}
-<td><a href="/del?cert={{.CommonName}}" title='{{tr "Delete"}}'
+<td><button type="submit" form="delForm" class="icon" title='{{tr "Delete"}}'
        onclick="return confirm('{{tr "Are you sure you want to delete this Certificate?"}}')">
-<img width="64px" src="/img/delete.png"/></a></td>
+<img width="64px" src="{{base}}/img/delete.png"/></button></td>
+{{end}}
+{{end}}
+</tr>
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4"><a class="control" href="{{base}}/certDetails?cert={{qEsc .CommonName}}"
+       >{{tr "Details"}}...</a></td></tr>
+<tr><td colspan="4"><a class="control" href="{{base}}/package?cert={{qEsc .CommonName}}"
+       >{{tr "Download everything as ZIP"}}</a></td></tr>
+<tr><td colspan="4"><a class="control" href="{{base}}/cert/{{.CommonName}}.der"
+       >{{tr "Download as DER"}}</a> (<a class="control" href="{{base}}/cert/{{.CommonName}}.crt">.crt</a>)</td></tr>
+<tr><td colspan="4"><a class="control" href="{{base}}/fullchain?cert={{qEsc .CommonName}}"
+       >{{tr "Download full chain (fullchain.pem)"}}</a>
+{{if and $.Cert.Key $.KeyOwner $.PlainKeys}}(<a class="control" href="{{base}}/fullchain?cert={{qEsc .CommonName}}&key=1"
+       >{{tr "with key, for HAProxy"}}</a>){{end}}</td></tr>
+<tr><td colspan="4"><a class="control" href="{{base}}/p7b?cert={{qEsc .CommonName}}"
+       >{{tr "Download chain as PKCS#7 (.p7b)"}}</a></td></tr>
+<tr><td colspan="4"><a class="control" href="{{base}}/snippets?cert={{qEsc .CommonName}}"
+       >{{tr "Web server configuration"}}...</a></td></tr>
+{{end}}
+{{if and .Cert.Key .KeyOwner}}
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4"><a class="control" href="{{base}}/p12?cert={{qEsc .CommonName}}"
+       >{{tr "Download as PKCS#12 (.p12/.pfx)"}}...</a></td></tr>
+<tr><td colspan="4"><a class="control" href="{{base}}/keyExport?cert={{qEsc .CommonName}}"
+       >{{tr "Download key encrypted with a passphrase"}}...</a></td></tr>
+{{if $.PlainKeys}}<tr><td colspan="4"><a class="control" href="{{base}}/downloadLinks?cert={{qEsc .CommonName}}"
+       >{{tr "One-time download links"}}...</a></td></tr>{{end}}
+{{end}}
+{{end}}
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4"><a class="control" href="{{base}}/renew?cert={{.CommonName}}&rekey=1"
+       >{{tr "Renew with a new key pair"}}...</a></td></tr>
+{{end}}
+{{if .Kubernetes}}
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4">{{if $.Secret}}{{tr "Published as Secret %s" $.Secret}}
+<a class="control" href="{{base}}/kubernetes?cert={{qEsc .CommonName}}">{{tr "Change"}}...</a>{{else}}
+<a class="control" href="{{base}}/kubernetes?cert={{qEsc .CommonName}}"
+       >{{tr "Publish to Kubernetes"}}...</a>{{end}}</td></tr>
+{{end}}
+{{end}}
+{{if .Cert.Key}}
+{{range $d := .Deliveries}}
+<tr><td colspan="4">{{with .Status}}{{if .Error}}<span class="revoked">{{tr "Delivery to %s failed on %s: %s" $d.Target ((inZone .Time).Format "2006/01/02 15:04") .Error}}</span>
+{{else}}{{tr "Delivered to %s on %s" $d.Target ((inZone .Time).Format "2006/01/02 15:04")}}{{end}}{{else}}{{tr "Not delivered to %s yet" $d.Target}}{{end}}</td></tr>
+{{end}}
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4"><a class="control" href="{{base}}/delivery?cert={{qEsc .CommonName}}"
+       >{{tr "Deliver over SFTP"}}...</a></td></tr>
+{{end}}
+{{end}}
+{{if .Revocable}}
+<tr><td colspan="4"><select name="reason" form="revokeForm">
+{{range .Reasons}}<option value="{{.Code}}">{{tr .Name}}</option>{{end}}
+</select>
+<input type="submit" form="revokeForm" value='{{tr "Revoke"}}'
+       onclick="return confirm('{{tr "Are you sure you want to revoke this Certificate?"}}')"></td></tr>
+{{end}}
+{{with .Revoked}}{{if .OnHold}}
+<tr><td colspan="4"><input type="submit" form="unholdForm" value='{{tr "Unhold"}}'></td></tr>
+{{end}}{{end}}
+{{if .Cert.Childs}}
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4"><a class="control" href="{{base}}/delTree?cert={{qEsc .CommonName}}"
+       >{{tr "Delete with all the certificates below"}}...</a></td></tr>
+{{end}}
+{{end}}
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4">{{if $.AutoRenew}}{{tr "Renewed automatically %d days before expiry." $.AutoRenewDays}}
+<button type="submit" form="autoRenewForm" name="off" value="1" class="control">{{tr "Don't renew automatically"}}</button>{{else}}
+<button type="submit" form="autoRenewForm" class="control">{{tr "Renew automatically"}}</button>{{end}}</td></tr>
+{{end}}
+{{range .SCTs}}
+<tr><td colspan="4">{{tr "Logged in %s on %s" .Log ((inZone .Time).Format "2006/01/02 15:04")}}</td></tr>
+{{end}}
+{{with .Renewal}}
+<tr><td colspan="4">{{if .Error}}<span class="revoked">{{tr "Automatic renewal failed on %s: %s" ((inZone .Time).Format "2006/01/02 15:04") .Error}}</span>
+{{else}}{{tr "Automatically renewed on %s" ((inZone .Time).Format "2006/01/02 15:04")}}{{end}}</td></tr>
+{{end}}
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4">{{if $.OptOut}}{{tr "No expiry notifications for this certificate."}}
+<button type="submit" form="notifyOptOutForm" class="control">{{tr "Notify"}}</button>{{else}}
+<button type="submit" form="notifyOptOutForm" name="optout" value="1" class="control"
+   >{{tr "Don't notify about expiry"}}</button>{{end}}</td></tr>
+{{end}}
+{{if not .OptOut}}
+<tr><td class="label">{{tr "Notified"}}:</td>
+    <td colspan="3"><input type="text" name="NotifyRecipients" form="certNotifications" size="50"
+                           value="{{join .CertNotify.Recipients ", "}}" placeholder="{{join .NotifyRecipients ", "}}"></td></tr>
+<tr><td class="label">{{tr "Days before expiry"}}:</td>
+    <td colspan="3"><input type="text" name="NotifyDays" form="certNotifications"
+                           value="{{range $i, $d := .CertNotify.Days}}{{if $i}}, {{end}}{{$d}}{{end}}"
+                           placeholder="{{range $i, $d := .NotifyDays}}{{if $i}}, {{end}}{{$d}}{{end}}">
+        <input type="submit" form="certNotifications" value='{{tr "Save"}}'></td></tr>
+{{if .Cert.Crt.IsCA}}<tr><td colspan="4"><div class="explanation">
+{{tr "They also apply to the certificates below this CA without their own."}}
+</div></td></tr>{{end}}
+{{end}}
+<tr><td colspan="4" class="bigger">{{tr "Tags and Notes"}}</td></tr>
+{{with .Labels.Tags}}
+<tr><td colspan="4">{{range .}}<a class="tag" href="{{base}}/?Tag={{.}}">{{.}}</a> {{end}}</td></tr>
+{{end}}
+<tr><td class="label">{{tr "Tags"}}:</td>
+    <td colspan="3"><input type="text" name="Tags" form="labels" value="{{join .Labels.Tags ", "}}" size="50"
+                           placeholder="env:prod, team:payments"></td></tr>
+<tr><td class="label">{{tr "Notes"}}:</td>
+    <td colspan="3"><textarea name="Notes" form="labels" rows="4" cols="50">{{.Labels.Notes}}</textarea></td></tr>
+<tr><td colspan="4"><input type="submit" form="labels" value='{{tr "Save"}}'></td></tr>
+{{if .Cert.Crt.IsCA}}
+{{with .Cert.Crt.Subject}}
+<tr><td colspan="4"><a class="control" href="{{base}}/crossSign?cert={{qEsc .CommonName}}"
+       >{{tr "Cross-sign with another CA"}}...</a></td></tr>
+{{end}}
+{{end}}
+{{if .Crosses}}
+<tr><td colspan="4" class="bigger">{{tr "Cross-signed versions"}}</td></tr>
+{{range .Crosses}}
+<tr><td colspan="4">{{tr "Signed by %s" .Issuer.CommonName}}
+<span class="period">{{showPeriod .}}</span>
+<a href="{{base}}/cert/{{crossed .}}.pem">{{tr "Download"}}</a>
+</td></tr>
+{{end}}
+{{end}}
+{{if .Previous}}
+<tr><td colspan="4" class="bigger">{{tr "Previous versions"}}</td></tr>
+{{range .Previous}}
+<tr><td colspan="4"><span class="period">{{showPeriod .Crt}}</span>
+<a href="{{base}}/cert/{{archived .}}.pem">{{tr "Download"}}</a>
+{{if and .Key $.PlainKeys $.KeyOwner}}<a href="{{base}}/cert/{{archived .}}.key.pem">{{tr "Download Key"}}</a>{{end}}
+</td></tr>
+{{end}}
+{{end}}
+</table>
+</form>
+<form id="labels" action="{{base}}/labels" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}">
+</form>
+<form id="certNotifications" action="{{base}}/certNotifications" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}">
+</form>
+<form id="revokeForm" action="{{base}}/revoke" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}">
+<input type="hidden" name="confirm" value="1">
+</form>
+<form id="unholdForm" action="{{base}}/revoke" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}">
+<input type="hidden" name="unhold" value="1">
+</form>
+<form id="delForm" action="{{base}}/del" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}">
+</form>
+<form id="autoRenewForm" action="{{base}}/autoRenew" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}">
+</form>
+<form id="notifyOptOutForm" action="{{base}}/notifyOptOut" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}">
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "certDetails"}}
+{{template "htmlheader" .}}
+<h2>{{.Cert.Crt.Subject.CommonName}}</h2>
+<table class="form">
+<tr><td class="label">{{tr "Valid From"}}:</td><td>{{(inZone .Cert.Crt.NotBefore).Format "2006/01/02 15:04:05 MST"}}</td></tr>
+<tr><td class="label">{{tr "Valid Until"}}:</td><td>{{(inZone .Cert.Crt.NotAfter).Format "2006/01/02 15:04:05 MST"}}</td></tr>
+{{range .Details}}
+<tr><td class="label">{{.Name}}:</td><td>{{.Value}}</td></tr>
+{{end}}
+<tr><td colspan="2" class="bigger">{{tr "Extensions"}}</td></tr>
+{{range .Extensions}}
+<tr><td class="label">{{with .Name}}{{tr .}}{{else}}{{tr "Unknown"}}{{end}}:</td>
+    <td>{{.OID}}{{if .Critical}} ({{tr "critical"}}){{end}}</td></tr>
+{{end}}
+<tr><td colspan="2"><textarea id="PEM" rows="16" cols="66" readonly>{{.PEM}}</textarea></td></tr>
+<tr><td colspan="2"><input type="button" value='{{tr "Copy"}}'
+    onclick="navigator.clipboard.writeText($('PEM').value)">
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Go back"}}</a></td></tr>
+</table>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "snippets"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Web server configuration for %s" .Cert.Crt.Subject.CommonName}}</h2>
+<div class="explanation">
+{{if .Snippet.CA}}{{tr "Require the client certificates issued by this CA, with its full chain downloaded as %s." (.Snippet.Path ".fullchain.pem")}}
+{{else}}{{tr "Serve this certificate with its full chain and key, downloaded to %s." .Snippet.Dir}}{{end}}
+</div>
+<form action="{{base}}/snippets" method="get">
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<table class="form">
+<tr><td class="label">{{tr "Directory"}}:</td>
+    <td><input type="text" name="dir" value="{{.Snippet.Dir}}"> <input type="submit" value='{{tr "Change"}}'></td></tr>
+<tr><td colspan="2" class="bigger">nginx</td></tr>
+<tr><td colspan="2"><textarea id="nginx" rows="10" cols="66" readonly>{{template "nginxSnippet" .Snippet}}</textarea></td></tr>
+<tr><td colspan="2"><input type="button" value='{{tr "Copy"}}'
+    onclick="navigator.clipboard.writeText($('nginx').value)"></td></tr>
+<tr><td colspan="2" class="bigger">Apache</td></tr>
+<tr><td colspan="2"><textarea id="apache" rows="10" cols="66" readonly>{{template "apacheSnippet" .Snippet}}</textarea></td></tr>
+<tr><td colspan="2"><input type="button" value='{{tr "Copy"}}'
+    onclick="navigator.clipboard.writeText($('apache').value)"></td></tr>
+<tr><td colspan="2" class="bigger">HAProxy</td></tr>
+<tr><td colspan="2"><textarea id="haproxy" rows="6" cols="66" readonly>{{template "haproxySnippet" .Snippet}}</textarea></td></tr>
+<tr><td colspan="2"><input type="button" value='{{tr "Copy"}}'
+    onclick="navigator.clipboard.writeText($('haproxy').value)">
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Go back"}}</a></td></tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "nginxSnippet"}}{{if .CA}}# {{tr "in the server block"}}
+ssl_client_certificate {{.Path ".fullchain.pem"}};
+ssl_verify_client on;
+ssl_verify_depth {{.Depth}};
+{{else}}server {
+    listen 443 ssl;
+    listen [::]:443 ssl;
+    server_name {{join .ServerNames " "}};
+
+    ssl_certificate     {{.Path ".fullchain.pem"}};
+    ssl_certificate_key {{.Path ".key.pem"}};
+}
+{{end}}{{end}}
+
+{{define "apacheSnippet"}}{{if .CA}}# {{tr "in the VirtualHost"}}
+SSLCACertificateFile {{.Path ".fullchain.pem"}}
+SSLVerifyClient require
+SSLVerifyDepth {{.Depth}}
+{{else}}&lt;VirtualHost *:443&gt;
+    ServerName {{index .ServerNames 0}}
+{{range .Aliases}}    ServerAlias {{.}}
+{{end}}
+    SSLEngine on
+    # Apache 2.4.8+ {{tr "reads the chain after the certificate"}}
+    SSLCertificateFile    {{.Path ".fullchain.pem"}}
+    SSLCertificateKeyFile {{.Path ".key.pem"}}
+&lt;/VirtualHost&gt;
+{{end}}{{end}}
+
+{{define "haproxySnippet"}}{{if .CA}}frontend https
+    # {{tr "server.bundle.pem is the full chain with key of the server certificate"}}
+    bind :443 ssl crt {{.Dir}}/server.bundle.pem ca-file {{.Path ".fullchain.pem"}} verify required
+{{else}}frontend https
+    # {{tr "the full chain with key"}}
+    bind :443 ssl crt {{.Path ".bundle.pem"}}
+{{end}}{{end}}
+
+{{define "delTree"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Delete %s" .Cert.Crt.Subject.CommonName}}</h2>
+<form action="{{base}}/delTree" method="post">{{template "csrf" $}}
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}">
+<div class="explanation">{{tr "These %d certificates and their keys will be moved to the trash:" .Tree.Size}}</div>
+<div class="data">{{template "subtree" .Tree}}</div>
+<table class="form">
+<tr><td class="label">{{tr "Type %s to confirm" .Cert.Crt.Subject.CommonName}}:</td>
+    <td><input type="text" name="confirm" autocomplete="off" required></td></tr>
+<tr><td colspan="2"><input type="submit" value='{{tr "Delete"}}'>
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Cancel"}}</a></td></tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "subtree"}}
+<ul class="tree">
+<li><span class="{{if .Crt.IsCA}}CA{{else}}Cert{{end}}">{{.Crt.Subject.CommonName}}</span>
+<span class="period">{{showPeriod .Crt}}</span>
+{{range .Nodes}}{{template "subtree" .}}{{end}}
+</li>
+</ul>
+{{end}}
+
+{{define "renew"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Renew %s" .Cert.Crt.Subject.CommonName}}</h2>
+<form action="{{base}}/renew" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="confirm" value="1"/>
+{{if .Rekey}}<input type="hidden" name="rekey" value="1"/>{{end}}
+<table class="form">
+<tr><td class="label"></td><td class="label">{{tr "Current"}}</td><td class="label">{{tr "Renewed"}}</td></tr>
+{{range .Changes}}
+<tr><td class="label">{{.Name}}:</td><td>{{.Before}}</td>
+    <td>{{if .Changed}}<b>{{.After}}</b>{{else}}{{.After}}{{end}}</td></tr>
+{{end}}
+<tr><td class="label">{{tr "Key Pair"}}:</td><td></td>
+    <td>{{if .Rekey}}<b>{{tr "New key pair"}}</b>{{else}}{{tr "Same key pair"}}{{end}}</td></tr>
+{{if .Rekey}}
+<tr><td colspan="3" class="explanation">
+{{tr "The current certificate and key will stay available until they expire."}}</td></tr>
+{{end}}
+<tr><td colspan="3">
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Cancel"}}</a>
+<input type="submit" id="submit" name="submit" value='{{tr "Renew"}}'></td></tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "crossSign"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Cross-sign %s" .Cert.Crt.Subject.CommonName}}</h2>
+<div class="explanation">
+{{tr "Issue an alternate certificate for this CA's name and key, signed by another CA."}}
+</div>
+<form action="{{base}}/crossSign" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+<tr><td class="mainlabel">{{tr "Signing CA"}}:</td>
+    <td><select name="signer">
+{{range .Signers}}
+            <option value="{{.Crt.Subject.CommonName}}">{{.Crt.Subject.CommonName}}</option>
+{{end}}
+	</select></td></tr>
+{{.LoadCrt .Validity "Cert" 1825}}
+{{template "certValidity" .}}
+<tr>
+<td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Cross-sign"}}'></td>
+</tr>
+</table>
+</form>
+{{template "htmlfooter"}}
 {{end}}
+
+{{define "profiles"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Issuance Profiles"}}</h2>
+<table class="form">
+{{range $name, $p := .Profiles}}
+<tr><td class="label"><a href="{{base}}/profiles?name={{qEsc $name}}">{{$name}}</a></td>
+    <td>{{$p.KeyType}} {{$p.KeyBits}}</td>
+    <td>{{$p.Duration}} {{$p.Unit}}</td>
+    <td>{{range $p.ExtKeyUsage}}{{ekuName .}} {{end}}</td>
+    <td><form action="{{base}}/profiles" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="delete"/>
+        <input type="hidden" name="Name" value="{{$name}}"/>
+        <input type="submit" value='{{tr "Delete"}}'
+               onclick="return confirm('{{tr "Are you sure you want to delete this profile?"}}')">
+        </form></td></tr>
+{{else}}
+<tr><td class="explanation">{{tr "There are no profiles yet."}}</td></tr>
+{{end}}
+</table>
+<h2>{{tr "Create or Edit a Profile"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<form action="{{base}}/profiles" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="save"/>
+<table class="form">
+{{with .Profile}}
+<tr><td class="mainlabel">{{tr "Name"}}:</td>
+    <td><input type="text" class="main" name="Name" value="{{.Name}}"></td></tr>
+<tr><td class="label">{{tr "Key"}}:</td>
+    <td><select name="KeyType">
+            <option value="RSA">RSA</option>
+            <option value="ECDSA" {{if eq .KeyType "ECDSA"}}selected="selected"{{end}}>ECDSA</option>
+	</select>
+	<select name="KeyBits">
+{{$bits := .KeyBits}}
+{{range $b := intList 2048 3072 4096 256 384 521}}
+            <option value="{{$b}}" {{if eq $b $bits}}selected="selected"{{end}}>{{$b}}</option>
+{{end}}
+	</select></td></tr>
+<tr><td class="label">{{tr "Duration"}}:</td>
+    <td><input type="text" size="6" name="Duration" value="{{.Duration}}">
+        <select name="Unit">
+            <option value='days'>{{tr "Days"}}</option>
+            <option value='hours' {{if eq .Unit "hours"}}selected="selected"{{end}}>{{tr "Hours"}}</option>
+	</select></td></tr>
+<tr><td class="label">{{tr "Extended Key Usage"}}:</td>
+    <td>
+{{$p := .}}
+{{range $.EKUs}}
+    <input type="checkbox" name="ExtKeyUsage" value="{{printf "%d" .}}"
+           {{if $p.HasEKU .}}checked="checked"{{end}}>{{ekuName .}}<br/>
+{{end}}
+    </td></tr>
+<tr><td class="label">{{tr "Alternative Names"}}:</td>
+    <td><input type="checkbox" name="CNAsSAN" value="1" {{if .CNAsSAN}}checked="checked"{{end}}
+        >{{tr "Always include the certificate name"}}<br/>
+        <input type="checkbox" name="RequireSAN" value="1" {{if .RequireSAN}}checked="checked"{{end}}
+        >{{tr "Required"}}</td></tr>
+<tr><td class="label">{{tr "Allowed Domains"}}:</td>
+    <td><input type="text" size="40" name="AllowedDomains" value="{{join .AllowedDomains ", "}}"
+         title='{{tr "Leave empty to allow any domain"}}'></td></tr>
+{{end}}
+<tr>
+<td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Save"}}'></td>
+</tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "bulk"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Bulk Certificate Issuance"}}</h2>
+<div class="explanation">
+{{tr "One certificate per CSV line: the certificate name followed by its alternative names."}}
+</div>
+<form action="{{base}}/bulk" method="post" enctype="multipart/form-data">{{template "csrf" $}}
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+<tr><td class="mainlabel">{{tr "Signing CA"}}:</td>
+    <td><select name="parent">
+{{range .CAs}}
+            <option value="{{.Crt.Subject.CommonName}}"
+                    {{if eq .Crt.Subject.CommonName $.parent}}selected="selected"{{end}}
+                    >{{.Crt.Subject.CommonName}}</option>
+{{end}}
+	</select></td></tr>
+{{if .Profiles}}
+<tr><td class="label">{{tr "Profile"}}:</td>
+    <td><select name="profile">
+            <option value="">{{tr "None"}}</option>
+{{range .Profiles}}
+            <option value="{{.}}" {{if eq . $.ProfileName}}selected="selected"{{end}}>{{.}}</option>
+{{end}}
+	</select></td></tr>
+{{end}}
+<tr><td class="label">{{tr "CSV File"}}:</td>
+    <td><input type="file" name="CSVFile" accept=".csv,text/csv,text/plain"></td></tr>
+<tr><td class="label">{{tr "Or paste the CSV"}}:</td>
+    <td><textarea name="CSV" rows="10" cols="60"
+         placeholder="www.example.com, example.com, 10.0.0.1">{{.CSV}}</textarea></td></tr>
+{{.LoadCrt .Validity "Cert" 365}}
+{{template "certValidity" .}}
+<tr>
+<td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Issue"}}'></td>
+</tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "bulkResults"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Bulk Issuance under %s" .CA.Crt.Subject.CommonName}}</h2>
+<div class="explanation">{{tr "%d of %d certificates issued." .Issued (len .Results)}}</div>
+<form action="{{base}}/bulkZip" method="post">{{template "csrf" $}}
+<table class="form">
+{{range .Results}}
+<tr><td class="label">{{.Name}}</td>
+    <td>{{join .SANs ", "}}</td>
+{{if .Error}}
+    <td class="notice">{{.Error}}</td>
+{{else}}
+    <td><input type="hidden" name="name" value="{{.Name}}"/>
+        <a href="{{base}}/certControl?cert={{qEsc .Name}}">{{tr "Issued"}}</a></td>
 {{end}}
 </tr>
+{{end}}
+<tr><td colspan="3">
+<a href="{{base}}/bulk?parent={{qEsc .CA.Crt.Subject.CommonName}}">{{tr "Issue more"}}...</a>
+{{if .Issued}}<input type="submit" id="submit" name="submit" value='{{tr "Download all as ZIP"}}'>{{end}}
+</td></tr>
 </table>
 </form>
 {{template "htmlfooter"}}
 {{end}}
+
+{{define "batchResults"}}
+{{template "htmlheader" .}}
+<h2>{{.Title}}</h2>
+<div class="explanation">{{tr "%d of %d certificates done." .Done (len .Results)}}</div>
+<table class="form">
+{{range .Results}}
+<tr><td class="label"><a href="{{base}}/certControl?cert={{qEsc .Name}}">{{.Name}}</a></td>
+{{if .Error}}
+    <td class="notice">{{.Error}}</td>
+{{else}}
+    <td>{{tr "Done"}}</td>
+{{end}}
+</tr>
+{{end}}
+<tr><td colspan="2"><a href="{{base}}/">{{tr "Back to the index"}}</a></td></tr>
+</table>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "expiring"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Expiring Certificates"}}</h2>
+<div class="data">
+{{range .Buckets}}
+<div class="CATitle">{{.Name}} ({{len .Certs}})</div>
+<div class="indent">
+{{range .Certs}}
+<div class="Cert"><a href="{{base}}/certControl?cert={{qEsc .Crt.Subject.CommonName}}"
+     >{{.Crt.Subject.CommonName}}</a>
+<span class="period">{{showPeriod .Crt}}</span>
+{{if .Key}}<a class="control" href="{{base}}/renew?cert={{qEsc .Crt.Subject.CommonName}}">{{tr "Renew"}}...</a>{{end}}
+</div>
+{{else}}
+<div class="explanation">{{tr "None"}}</div>
+{{end}}
+</div>
+{{end}}
+</div>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "notifications"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Expiry Notifications"}}</h2>
+<div class="explanation">
+{{tr "Emails are sent daily when certificates reach any of these days before expiry."}}
+</div>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<form action="{{base}}/notifications" method="post">{{template "csrf" $}}
+<table class="form">
+{{with .Notifications}}
+<tr><td class="label">{{tr "Days before expiry"}}:</td>
+    <td><input type="text" name="Days" value="{{range $i, $d := .Days}}{{if $i}}, {{end}}{{$d}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Recipients"}}:</td>
+    <td><textarea name="Recipients" rows="3" cols="40"
+         placeholder='{{tr "All users"}}'>{{join .Recipients "\n"}}</textarea></td></tr>
+{{end}}
+<tr><td class="label">{{tr "Currently sent to"}}:</td><td>{{join .Recipients ", "}}</td></tr>
+{{if .Notifications.PerCert}}
+<tr><td class="label">{{tr "Own notifications"}}:</td>
+    <td>{{range $name, $v := .Notifications.PerCert}}
+        <a href="{{base}}/certControl?cert={{qEsc $name}}">{{$name}}</a> {{end}}</td></tr>
+{{end}}
+{{if .Notifications.OptOut}}
+<tr><td class="label">{{tr "Not notified"}}:</td>
+    <td>{{range $name, $v := .Notifications.OptOut}}
+        <a href="{{base}}/certControl?cert={{qEsc $name}}">{{$name}}</a> {{end}}</td></tr>
+{{end}}
+<tr><td colspan="2" class="bigger">{{tr "Email templates"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "The templates use the Go text/template syntax: .Certs are the certificates, each with .CN, .Expires, .DaysLeft, .Days, .Serial, .Link and .Download, and .WebURL the WebCA."}}
+</div></td></tr>
+<tr><td class="label">{{tr "WebCA URL"}}:</td>
+    <td><input type="text" name="WebURL" size="40" placeholder="{{.WebURL}}" value="{{.Notifications.WebURL}}"></td></tr>
+<tr><td class="label">{{tr "Subject"}}:</td>
+    <td><input type="text" name="Subject" size="80" value="{{.Subject}}"></td></tr>
+<tr><td class="label">{{tr "Body"}}:</td>
+    <td><textarea name="Body" rows="12" cols="80">{{.Body}}</textarea></td></tr>
+{{if .PreviewBody}}
+<tr><td class="label">{{tr "Preview"}}:</td>
+    <td><b>{{.PreviewSubject}}</b><pre>{{.PreviewBody}}</pre></td></tr>
+{{end}}
+<tr>
+<td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Save"}}'>
+<button type="submit" name="action" value="preview">{{tr "Preview"}}</button></td>
+</tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "job"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Generating %s" .Job.Name}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+{{with .Job}}
+<table class="form">
+<tr><td class="label">{{tr "State"}}:</td>
+    <td>{{if eq .State "queued"}}{{tr "Waiting for the certificates queued before..."}}{{else if eq .State "running"}}{{tr "Generating the key and the certificate..."}}{{else if eq .State "done"}}{{tr "Done"}}{{else}}<span class="revoked">{{tr "Failed"}}: {{.Error}}</span>{{end}}</td></tr>
+{{if .Cert}}
+<tr><td colspan="2"><a class="control" href="{{base}}/certControl?cert={{qEsc .Cert}}">{{.Cert}}</a></td></tr>
+{{end}}
+{{if .Key}}
+<tr><td colspan="2"><div class="explanation">{{tr "The key is not stored: download it now, this is the only chance."}}</div>
+<form action="{{base}}/job" method="post">{{template "csrf" $}}
+<input type="hidden" name="id" value="{{.ID}}">
+<input type="submit" value='{{tr "Download certificate and key"}}'>
+</form></td></tr>
+{{end}}
+</table>
+{{if or (eq .State "queued") (eq .State "running")}}
+<script type="text/javascript">
+function pollJob() {
+	fetch('{{base}}/jobStatus?id={{.ID}}', {credentials: 'same-origin'})
+	.then(function(resp) { return resp.json(); })
+	.then(function(st) {
+		if (st.state != '{{.State}}') {
+			location.reload();
+		} else {
+			setTimeout(pollJob, 1000);
+		}
+	})
+	.catch(function() { setTimeout(pollJob, 5000); });
+}
+setTimeout(pollJob, 1000);
+</script>
+{{end}}
+{{end}}
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "inbox"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Inbox"}}</h2>
+<div class="explanation">
+{{tr "The certificates about to expire, the renewals and the failures of the last %d days." .Days}}
+</div>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+<tr><th>{{tr "Time"}}</th><th>{{tr "Certificate"}}</th><th></th><th></th></tr>
+{{range .Items}}
+<tr{{if not (index .Read $.Username)}} class="unread"{{end}}><td>{{(inZone .Time).Format "2006/01/02 15:04"}}</td>
+    <td><a href="{{base}}/certControl?cert={{qEsc .Cert}}">{{.Cert}}</a></td>
+    <td>{{if or (eq .Kind "renew-failed") (eq .Kind "delivery-failed")}}<span class="revoked">{{.Text}}</span>{{else}}{{.Text}}{{end}}</td>
+    <td>{{if not (index .Read $.Username)}}<form action="{{base}}/inbox" method="post">{{template "csrf" $}}
+<input type="hidden" name="id" value="{{.ID}}">
+<input type="submit" value='{{tr "Mark as read"}}'>
+</form>{{end}}</td></tr>
+{{else}}
+<tr><td colspan="4">{{tr "Nothing new."}}</td></tr>
+{{end}}
+</table>
+{{if .Unread}}
+<form action="{{base}}/inbox" method="post">{{template "csrf" $}}
+<input type="submit" value='{{tr "Mark all as read"}}'>
+</form>
+{{end}}
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "trash"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Trash"}}</h2>
+<div class="explanation">
+{{tr "Deleted certificates are kept here with their keys, to be restored, until they are purged for good."}}
+</div>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<form action="{{base}}/trash" method="post">{{template "csrf" $}}
+<table class="form">
+<tr><td class="label">{{tr "Purge after"}}:</td>
+    <td><input type="text" name="TrashDays" size="4" value="{{.TrashDays}}"> {{tr "Days"}}
+    <input type="submit" value='{{tr "Save"}}'></td></tr>
+</table>
+</form>
+<table class="form">
+<tr><th>{{tr "Name"}}</th><th>{{tr "Serial"}}</th><th>{{tr "Deleted"}}</th><th>{{tr "Purged on"}}</th><th></th></tr>
+{{range .Trashed}}
+<tr><td>{{.Crt.Subject.CommonName}}</td><td>{{.Crt.SerialNumber | printf "%X"}}</td>
+    <td>{{(inZone .Deleted).Format "2006/01/02 15:04"}}</td><td>{{(inZone .Purge).Format "2006/01/02"}}</td>
+    <td><form action="{{base}}/trash" method="post">{{template "csrf" $}}
+<input type="hidden" name="file" value="{{.File}}">
+<input type="submit" value='{{tr "Restore"}}'>
+<input type="submit" name="purge" value='{{tr "Purge"}}'
+       onclick="return confirm('{{tr "Are you sure you want to destroy this certificate for good?"}}')">
+</form></td></tr>
+{{else}}
+<tr><td colspan="5">{{tr "The trash is empty."}}</td></tr>
+{{end}}
+</table>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "backups"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Automatic Backups"}}</h2>
+<div class="explanation">
+{{tr "Encrypted backups of the whole CA are written periodically to a directory or an S3 bucket, the oldest being deleted."}}
+</div>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<form action="{{base}}/backups" method="post">{{template "csrf" $}}
+<table class="form">
+<tr><td colspan="2"><input type="checkbox" name="Enabled" value="1"{{if .Backups}} checked{{end}}>
+{{tr "Make automatic backups"}}</td></tr>
+<tr><td class="label">{{tr "Every"}}:</td>
+    <td><input type="text" name="Hours" size="4" value="{{with .Backups}}{{if .Hours}}{{.Hours}}{{end}}{{end}}"
+               placeholder="24"> {{tr "hours"}}</td></tr>
+<tr><td class="label">{{tr "Backups kept"}}:</td>
+    <td><input type="text" name="Keep" size="4" value="{{with .Backups}}{{if .Keep}}{{.Keep}}{{end}}{{end}}"
+               placeholder="7"></td></tr>
+<tr><td class="label">{{tr "Passphrase"}}:</td>
+    <td><input type="password" name="Passphrase" autocomplete="new-password"
+               placeholder='{{with .Backups}}{{tr "unchanged"}}{{end}}'></td></tr>
+<tr><td class="label">{{tr "Directory"}}:</td>
+    <td><input type="text" name="Dir" value="{{with .Backups}}{{.Dir}}{{end}}" placeholder="/var/backups/webca"></td></tr>
+<tr><td class="label">{{tr "S3 Bucket"}}:</td>
+    <td><input type="text" name="S3Bucket" value="{{with .Backups}}{{with .S3}}{{.Bucket}}{{end}}{{end}}"
+               placeholder='{{tr "instead of the directory"}}'></td></tr>
+<tr><td class="label">{{tr "S3 Endpoint"}}:</td>
+    <td><input type="text" name="S3Endpoint" value="{{with .Backups}}{{with .S3}}{{.Endpoint}}{{end}}{{end}}"
+               placeholder="https://s3.us-east-1.amazonaws.com"></td></tr>
+<tr><td class="label">{{tr "S3 Region"}}:</td>
+    <td><input type="text" name="S3Region" value="{{with .Backups}}{{with .S3}}{{.Region}}{{end}}{{end}}"
+               placeholder="us-east-1"></td></tr>
+<tr><td class="label">{{tr "S3 Prefix"}}:</td>
+    <td><input type="text" name="S3Prefix" value="{{with .Backups}}{{with .S3}}{{.Prefix}}{{end}}{{end}}"
+               placeholder="webca/"></td></tr>
+<tr><td class="label">{{tr "S3 Access Key"}}:</td>
+    <td><input type="text" name="S3AccessKey" value="{{with .Backups}}{{with .S3}}{{.AccessKey}}{{end}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "S3 Secret Key"}}:</td>
+    <td><input type="password" name="S3SecretKey" autocomplete="off"
+               placeholder='{{with .Backups}}{{with .S3}}{{tr "unchanged"}}{{end}}{{end}}'></td></tr>
+<tr><td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Save"}}'></td></tr>
+</table>
+</form>
+{{if .Backups}}
+<form action="{{base}}/backups" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="run"/>
+<input type="submit" value='{{tr "Back up now"}}'>
+</form>
+{{end}}
+<h2>{{tr "Latest Backups"}}</h2>
+<table class="form">
+{{range .Outcomes}}
+<tr><td>{{.Time.Format "2006/01/02 15:04"}}</td><td>{{.Name}}</td>
+    <td>{{if .Error}}<span class="revoked">{{.Error}}</span>{{else}}{{.Size}} {{tr "bytes"}}{{end}}</td></tr>
+{{else}}
+<tr><td colspan="3">{{tr "No backups yet."}}</td></tr>
+{{end}}
+</table>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "webhooks"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Webhooks"}}</h2>
+<div class="explanation">
+{{tr "Certificate lifecycle events are posted as JSON to these URLs."}}
+{{tr "With a secret, the %s header carries the HMAC-SHA256 of the body." "X-WebCA-Signature"}}
+</div>
+<table class="form">
+{{range $i, $wh := .Webhooks}}
+<tr><td class="label">{{$wh.URL}}</td>
+    <td>{{if $wh.Events}}{{join $wh.Events ", "}}{{else}}{{tr "All events"}}{{end}}</td>
+    <td>{{if $wh.Secret}}{{tr "Signed"}}{{end}}</td>
+    <td><form action="{{base}}/webhooks" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="delete"/>
+        <input type="hidden" name="index" value="{{$i}}"/>
+        <input type="submit" value='{{tr "Delete"}}'
+               onclick="return confirm('{{tr "Are you sure you want to delete this webhook?"}}')">
+        </form></td></tr>
+{{else}}
+<tr><td class="explanation">{{tr "There are no webhooks yet."}}</td></tr>
+{{end}}
+</table>
+<h2>{{tr "Add a Webhook"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<form action="{{base}}/webhooks" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="add"/>
+<table class="form">
+<tr><td class="mainlabel">{{tr "URL"}}:</td>
+    <td><input type="text" class="main" name="URL"></td></tr>
+<tr><td class="label">{{tr "Secret"}}:</td>
+    <td><input type="password" name="Secret" autocomplete="new-password"></td></tr>
+<tr><td class="label">{{tr "Events"}}:</td>
+    <td>{{range .EventTypes}}
+        <input type="checkbox" name="Events" value="{{.}}">{{.}}<br/>
+        {{end}}</td></tr>
+<tr>
+<td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Add"}}'></td>
+</tr>
+</table>
+</form>
+<h2>{{tr "Chat Notifications"}}</h2>
+<div class="explanation">
+{{tr "Slack or Microsoft Teams incoming webhooks get formatted messages for the chosen events."}}
+</div>
+<table class="form">
+{{range $i, $ch := .ChatHooks}}
+<tr><td class="label">{{$ch.Kind}}</td><td>{{$ch.URL}}</td>
+    <td>{{if $ch.Events}}{{join $ch.Events ", "}}{{else}}{{tr "All events"}}{{end}}</td>
+    <td><form action="{{base}}/webhooks" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="deleteChat"/>
+        <input type="hidden" name="index" value="{{$i}}"/>
+        <input type="submit" value='{{tr "Delete"}}'
+               onclick="return confirm('{{tr "Are you sure you want to delete this webhook?"}}')">
+        </form></td></tr>
+{{end}}
+</table>
+<form action="{{base}}/webhooks" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="addChat"/>
+<table class="form">
+<tr><td class="label">{{tr "Chat"}}:</td>
+    <td><select name="Kind">
+            <option value="Slack">Slack</option>
+            <option value="Teams">Microsoft Teams</option>
+	</select></td></tr>
+<tr><td class="mainlabel">{{tr "Incoming Webhook URL"}}:</td>
+    <td><input type="text" class="main" name="URL"></td></tr>
+<tr><td class="label">{{tr "Events"}}:</td>
+    <td>{{range .ChatEventTypes}}
+        <input type="checkbox" name="Events" value="{{.}}">{{.}}<br/>
+        {{end}}</td></tr>
+<tr>
+<td colspan="2"><input type="submit" value='{{tr "Add"}}'></td>
+</tr>
+</table>
+</form>
+<h2>{{tr "Deployment Hooks"}}</h2>
+<div class="explanation">
+{{tr "These executables run after a certificate is issued or renewed, e.g. to reload a web server."}}
+{{tr "They get the certificate details and file paths in the WEBCA_* environment variables and their output goes to the log."}}
+</div>
+<table class="form">
+{{range $i, $dh := .DeployHooks}}
+<tr><td class="label">{{$dh.Path}}</td>
+    <td>{{if $dh.Certs}}{{join $dh.Certs ", "}}{{else}}{{tr "All certificates"}}{{end}}</td>
+    <td><form action="{{base}}/webhooks" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="deleteDeploy"/>
+        <input type="hidden" name="index" value="{{$i}}"/>
+        <input type="submit" value='{{tr "Delete"}}'
+               onclick="return confirm('{{tr "Are you sure you want to delete this hook?"}}')">
+        </form></td></tr>
+{{end}}
+</table>
+<form action="{{base}}/webhooks" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="addDeploy"/>
+<table class="form">
+<tr><td class="mainlabel">{{tr "Executable"}}:</td>
+    <td><input type="text" class="main" name="Path" placeholder="/usr/local/bin/reload-nginx"></td></tr>
+<tr><td class="label">{{tr "Certificates"}}:</td>
+    <td><input type="text" name="Certs" placeholder='{{tr "Comma separated, all if empty"}}'></td></tr>
+<tr>
+<td colspan="2"><input type="submit" value='{{tr "Add"}}'></td>
+</tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "p12"}}
+{{template "htmlheader" .}}
+<h2>{{tr "PKCS#12 for %s" .Cert.Crt.Subject.CommonName}}</h2>
+<div class="explanation">
+{{tr "The file will include the certificate, its private key and the CA chain, protected by this password."}}
+</div>
+<form action="{{base}}/p12" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+<tr><td class="label">{{tr "Password"}}:</td>
+    <td><input type="password" class="main" name="Password" autocomplete="new-password"></td></tr>
+<tr><td class="label">{{tr "Confirm Password"}}:</td>
+    <td><input type="password" class="main" name="Confirm" autocomplete="new-password"></td></tr>
+<tr><td colspan="2">
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Cancel"}}</a>
+<input type="submit" id="submit" name="submit" value='{{tr "Download"}}'></td></tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "keyExport"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Encrypted key for %s" .Cert.Crt.Subject.CommonName}}</h2>
+<div class="explanation">
+{{tr "The private key will be downloaded as encrypted PKCS#8 (AES-256), protected by this passphrase."}}
+</div>
+<form action="{{base}}/keyExport" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+<tr><td class="label">{{tr "Passphrase"}}:</td>
+    <td><input type="password" class="main" name="Password" autocomplete="new-password"></td></tr>
+<tr><td class="label">{{tr "Confirm Passphrase"}}:</td>
+    <td><input type="password" class="main" name="Confirm" autocomplete="new-password"></td></tr>
+<tr><td colspan="2">
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Cancel"}}</a>
+<input type="submit" id="submit" name="submit" value='{{tr "Download"}}'></td></tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "downloadLinks"}}
+{{template "htmlheader" .}}
+<h2>{{tr "One-time download links for %s" .Cert.Crt.Subject.CommonName}}</h2>
+<div class="explanation">
+{{tr "Whoever opens a link can download the certificate with its unencrypted key once, before it expires."}}
+</div>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+{{with .NewLink}}
+<div class="notice">{{tr "Copy the new link now, it won't be shown again:"}} <code>{{.}}</code></div>
+{{end}}
+<table class="form">
+{{range .Links}}
+<tr><td>{{.ID}}</td><td>{{.Format}}</td><td>{{.By}}</td><td>{{tr "Valid until"}} {{.Expires.Format "2006/01/02 15:04"}}</td>
+<td><form action="{{base}}/downloadLinks" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{$.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="revoke"/><input type="hidden" name="id" value="{{.ID}}"/>
+<input type="submit" value='{{tr "Revoke"}}'></form></td></tr>
+{{end}}
+</table>
+{{if .PlainKeys}}
+<form action="{{base}}/downloadLinks" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="create"/>
+<table class="form">
+<tr><td class="label">{{tr "Format"}}:</td>
+    <td><select name="Format">{{range .Formats}}<option value="{{.}}">{{.}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "Valid for (hours)"}}:</td>
+    <td><input type="number" name="Hours" min="1" value="{{.Hours}}"></td></tr>
+<tr><td colspan="2">
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Cancel"}}</a>
+<input type="submit" id="submit" name="submit" value='{{tr "Create link"}}'></td></tr>
+</table>
+</form>
+{{end}}
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "downloadLink"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Download %s" .Link.Cert}}</h2>
+<div class="explanation">
+{{tr "%s shared the certificate and its private key with you. The link works once, until %s." .Link.By (.Link.Expires.Format "2006/01/02 15:04")}}
+</div>
+<form action="{{base}}/download" method="post">{{template "csrf" $}}
+<input type="hidden" name="t" value="{{.Token}}"/>
+<input type="submit" id="submit" name="submit" value='{{tr "Download"}}'>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "kubernetes"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Kubernetes Secret for %s" .Cert.Crt.Subject.CommonName}}</h2>
+<div class="explanation">
+{{tr "The certificate, its chain and key are written to a kubernetes.io/tls Secret in the %s namespace, and updated on every renewal." .Namespace}}
+</div>
+<form action="{{base}}/kubernetes" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+<tr><td class="label">{{tr "Secret name"}}:</td>
+    <td><input type="text" class="main" name="Secret" value="{{.Secret}}"></td></tr>
+<tr><td colspan="2">
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Cancel"}}</a>
+{{if .Published}}<input type="submit" name="stop" value='{{tr "Stop publishing"}}'>{{end}}
+<input type="submit" id="submit" name="submit" value='{{tr "Publish"}}'></td></tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "delivery"}}
+{{template "htmlheader" .}}
+<h2>{{tr "SFTP delivery of %s" .Cert.Crt.Subject.CommonName}}</h2>
+<div class="explanation">
+{{tr "The certificate, its full chain and key are copied to these servers on every renewal."}}
+{{tr "Host keys are trusted the first time they are seen."}}
+</div>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+{{range $i, $d := .Deliveries}}
+<tr><td class="label">{{$d.Target}}</td>
+    <td>{{with $d.Status}}{{if .Error}}<span class="revoked">{{.Error}}</span>{{else}}{{tr "Delivered on %s" (.Time.Format "2006/01/02 15:04")}}{{end}}{{end}}</td>
+    <td><form action="{{base}}/delivery" method="post">{{template "csrf" $}}
+        <input type="hidden" name="cert" value="{{$.Cert.Crt.Subject.CommonName}}"/>
+        <input type="hidden" name="index" value="{{$i}}"/>
+        <button type="submit" name="action" value="deliver">{{tr "Deliver now"}}</button>
+        <button type="submit" name="action" value="delete"
+                onclick="return confirm('{{tr "Are you sure you want to delete this target?"}}')">{{tr "Delete"}}</button>
+        </form></td></tr>
+{{else}}
+<tr><td class="explanation">{{tr "There are no delivery targets yet."}}</td></tr>
+{{end}}
+</table>
+<h2>{{tr "Add a target"}}</h2>
+<form action="{{base}}/delivery" method="post">{{template "csrf" $}}
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="add"/>
+<table class="form">
+<tr><td class="mainlabel">{{tr "Host"}}:</td>
+    <td><input type="text" class="main" name="Host" placeholder="server.example.com:22"></td></tr>
+<tr><td class="label">{{tr "User"}}:</td>
+    <td><input type="text" name="User"></td></tr>
+<tr><td class="label">{{tr "Remote directory"}}:</td>
+    <td><input type="text" name="Path" placeholder="/etc/ssl/private"></td></tr>
+<tr><td class="label">{{tr "SSH private key"}}:</td>
+    <td><textarea name="Key" rows="8" cols="64"></textarea></td></tr>
+<tr><td colspan="2">
+<a href="{{base}}/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{tr "Cancel"}}</a>
+<input type="submit" id="submit" name="submit" value='{{tr "Add and deliver"}}'></td></tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "sessions"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Active Sessions"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<div class="explanation">
+{{if .AllUsers}}{{tr "The logged in sessions of all the users, most recently used first."}}
+{{else}}{{tr "Your logged in sessions, most recently used first."}}{{end}}
+</div>
+<table class="form">
+<tr><th>{{tr "User"}}</th><th>{{tr "Address"}}</th><th>{{tr "Logged in"}}</th><th>{{tr "Last used"}}</th><th></th></tr>
+{{range .Sessions}}
+<tr><td>{{.User}}</td><td>{{.Addr}}</td><td>{{.Started.Format "2006-01-02 15:04"}}</td>
+    <td>{{.LastUsed.Format "2006-01-02 15:04"}}</td>
+    <td>{{if .Current}}{{tr "This session"}}{{else}}<form action="{{base}}/sessions" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="revoke"/><input type="hidden" name="key" value="{{.Key}}"/>
+        <input type="submit" value='{{tr "Revoke"}}'></form>{{end}}</td></tr>
+{{end}}
+</table>
+<form action="{{base}}/sessions" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="logoutAll"/>
+<input type="submit" value='{{tr "Log out everywhere"}}'
+       onclick="return confirm('{{tr "Log out all your sessions, this one included, and forget your remembered devices?"}}')">
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "profile"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Profile"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<form action="{{base}}/profile" method="post">{{template "csrf" $}}
+<table class="form">
+<tr><td class="mainlabel">{{tr "Username"}}:</td><td>{{.U.Username}}</td></tr>
+<tr><td class="label">{{tr "Fullname"}}:</td>
+    <td><input type="text" name="Fullname" value="{{.U.Fullname}}"></td></tr>
+<tr><td class="label">{{tr "Email"}}:</td>
+    <td><input type="text" name="Email" value="{{.U.Email}}"></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Change password"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Leave it empty to keep your password. A new one logs out your other sessions and forgets your remembered devices."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Current password"}}:</td>
+    <td><input type="password" name="OldPassword" autocomplete="current-password"></td></tr>
+<tr><td class="label">{{tr "New password"}}:</td>
+    <td><input type="password" name="Password" autocomplete="new-password"></td></tr>
+<tr><td class="label">{{tr "Confirm Password"}}:</td>
+    <td><input type="password" name="Confirm" autocomplete="new-password"></td></tr>
+<tr><td colspan="2">{{template "passwordPolicy" .Policy}}</td></tr>
+<tr><td colspan="2"><input type="submit" value='{{tr "Save"}}'></td></tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "audit"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Audit Log"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{else}}
+<div class="explanation">
+{{tr "The %d entries are chained by their hashes, the last one is" .Total}} <code>{{.LastHash}}</code>
+</div>
+{{end}}
+<form action="{{base}}/audit" method="get">
+<table class="form">
+<tr><td class="label">{{tr "Action"}}:</td>
+    <td><select name="action"><option value="">{{tr "All"}}</option>
+{{range .Actions}}<option{{if eq . $.Action}} selected{{end}}>{{.}}</option>{{end}}</select></td>
+    <td class="label">{{tr "User"}}:</td>
+    <td><input type="text" name="user" value="{{.FilterUser}}"></td>
+    <td><input type="submit" value='{{tr "Filter"}}'></td></tr>
+</table>
+</form>
+<table class="form">
+<tr><th>#</th><th>{{tr "Time"}}</th><th>{{tr "Action"}}</th><th>{{tr "User"}}</th><th>{{tr "Address"}}</th>
+    <th>{{tr "Object"}}</th></tr>
+{{range .Entries}}
+<tr><td>{{.Seq}}</td><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Action}}</td><td>{{.User}}</td>
+    <td>{{.Addr}}</td><td>{{.Object}}</td></tr>
+{{end}}
+</table>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "requests"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Certificate Requests"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<div class="explanation">
+{{if .Can "operator"}}{{tr "Edit, approve or reject the pending requests, their submitters are emailed the outcome."}}
+{{else}}{{tr "Your requests wait for an operator to approve them, you will be emailed the outcome."}}{{end}}
+</div>
+<table class="form">
+<tr><th>{{tr "Name"}}</th><th>{{tr "CA"}}</th><th>{{tr "Days"}}</th><th>{{tr "Profile"}}</th><th>{{tr "Submitted"}}</th><th></th></tr>
+{{range .Requests}}{{$req := .}}
+{{if $.Can "operator"}}
+<tr><td><input type="text" name="Name" value="{{.Name}}" form="edit-{{.ID}}"></td>
+    <td><select name="parent" form="edit-{{.ID}}"><option value="">{{tr "None"}}</option>
+        {{range $.CAs}}<option{{if eq .Crt.Subject.CommonName $req.Parent}} selected{{end}}>{{.Crt.Subject.CommonName}}</option>{{end}}</select></td>
+    <td><input type="number" name="Days" min="0" value="{{if .Days}}{{.Days}}{{end}}" form="edit-{{.ID}}"></td>
+    <td><select name="profile" form="edit-{{.ID}}"><option value="">{{tr "None"}}</option>
+        {{range $.Profiles}}<option{{if eq . $req.Profile}} selected{{end}}>{{.}}</option>{{end}}</select></td>
+    <td>{{.Submitted.Format "2006-01-02 15:04"}} {{.By}} {{.Email}}</td>
+    <td><input type="submit" value='{{tr "Save"}}' form="edit-{{.ID}}">
+        <input type="submit" value='{{tr "Approve"}}' form="approve-{{.ID}}">
+        <input type="text" name="reason" placeholder='{{tr "Reason"}}' form="reject-{{.ID}}">
+        <input type="submit" value='{{tr "Reject"}}' form="reject-{{.ID}}"></td></tr>
+{{else}}
+<tr><td>{{.Name}}</td><td>{{.Parent}}</td><td>{{if .Days}}{{.Days}}{{end}}</td><td>{{.Profile}}</td>
+    <td>{{.Submitted.Format "2006-01-02 15:04"}}</td><td></td></tr>
+{{end}}
+{{else}}
+<tr><td colspan="6">{{tr "No pending certificate requests."}}</td></tr>
+{{end}}
+</table>
+{{if .Can "operator"}}{{range .Requests}}
+<form id="edit-{{.ID}}" action="{{base}}/requests" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="save"/><input type="hidden" name="id" value="{{.ID}}"/></form>
+<form id="approve-{{.ID}}" action="{{base}}/requests" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="approve"/><input type="hidden" name="id" value="{{.ID}}"/></form>
+<form id="reject-{{.ID}}" action="{{base}}/requests" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="reject"/><input type="hidden" name="id" value="{{.ID}}"/></form>
+{{end}}{{end}}
+<h2>{{tr "Request a Certificate"}}</h2>
+<form action="{{base}}/requests" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="submit"/>
+<table class="form">
+<tr><td class="label">{{tr "Certificate request"}}:</td>
+    <td><textarea name="CSR" rows="8" cols="64" placeholder="-----BEGIN CERTIFICATE REQUEST-----"></textarea></td></tr>
+<tr><td class="label">{{tr "CA"}}:</td>
+    <td><select name="parent"><option value="">{{tr "Any"}}</option>
+        {{range .CAs}}<option>{{.Crt.Subject.CommonName}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "Days"}}:</td><td><input type="number" name="Days" min="0"></td></tr>
+<tr><td class="label">{{tr "Profile"}}:</td>
+    <td><select name="profile"><option value="">{{tr "None"}}</option>
+        {{range .Profiles}}<option>{{.}}</option>{{end}}</select></td></tr>
+<tr><td colspan="2"><input type="submit" value='{{tr "Submit"}}'></td></tr>
+</table>
+</form>
+{{if .Instance}}
+<h2>{{tr "Submit Token"}}</h2>
+<div class="explanation">
+{{tr "Anyone with this token can POST certificate requests as JSON to /submit, a new token replaces the former one."}}
+</div>
+{{with .NewToken}}
+<div class="notice">{{tr "Copy the new token now, it won't be shown again:"}} <code>{{.}}</code></div>
+{{end}}
+<form action="{{base}}/requests" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="token"/>
+<input type="submit" value='{{tr "New submit token"}}'>
+</form>
+{{end}}
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "organizations"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Organizations"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<div class="explanation">
+{{tr "The users of an organization only see the certificates of its root CAs, the root CAs they create join it."}}
+</div>
+<table class="form">
+{{range .Organizations}}{{$org := .Name}}
+<tr><td class="label">{{.Name}}</td><td>{{tr "%d users" (index $.OrgUsers .Name)}}</td>
+    <td>{{range .CAs}}<form action="{{base}}/organizations" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="release"/><input type="hidden" name="CA" value="{{.}}"/>
+        {{.}} <input type="submit" value='{{tr "Release"}}'></form>{{else}}{{tr "No CAs."}}{{end}}</td>
+    <td><form action="{{base}}/organizations" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="assign"/><input type="hidden" name="Org" value="{{.Name}}"/>
+        <select name="CA">{{range $.Roots}}<option>{{.Crt.Subject.CommonName}}</option>{{end}}</select>
+        <input type="submit" value='{{tr "Assign"}}'></form></td>
+    <td><form action="{{base}}/organizations" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="delete"/><input type="hidden" name="Org" value="{{$org}}"/>
+        <input type="submit" value='{{tr "Delete"}}'
+               onclick="return confirm('{{tr "Are you sure you want to delete this organization?"}}')">
+        </form></td></tr>
+{{else}}
+<tr><td>{{tr "No organizations, every user sees every certificate."}}</td></tr>
+{{end}}
+</table>
+<form action="{{base}}/organizations" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="create"/>
+<input type="text" name="Org" placeholder='{{tr "Organization"}}'>
+<input type="submit" value='{{tr "Create"}}'>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "users"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Users"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+{{range .Users}}
+<tr><td class="label">{{.Username}}</td><td>{{.Fullname}}</td><td>{{.Email}}</td>
+    <td>{{tr .Role}}</td><td>{{.Org}}</td>
+    <td>{{if .Disabled}}{{tr "Disabled"}}{{end}}</td>
+    <td><a href="{{base}}/users?edit={{.Username}}">{{tr "Edit"}}</a></td>
+    <td><form action="{{base}}/users" method="post">{{template "csrf" $}}
+        <input type="hidden" name="Username" value="{{.Username}}"/>
+        {{if .Disabled}}<input type="hidden" name="action" value="enable"/>
+        <input type="submit" value='{{tr "Enable"}}'>
+        {{else}}<input type="hidden" name="action" value="disable"/>
+        <input type="submit" value='{{tr "Disable"}}'>{{end}}
+        </form></td>
+    <td><form action="{{base}}/users" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="delete"/>
+        <input type="hidden" name="Username" value="{{.Username}}"/>
+        <input type="submit" value='{{tr "Delete"}}'
+               onclick="return confirm('{{tr "Are you sure you want to delete this user?"}}')">
+        </form></td></tr>
+{{end}}
+</table>
+{{with .Edit}}
+<h2>{{tr "Edit %s" .Username}}</h2>
+<form action="{{base}}/users" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="edit"/>
+<input type="hidden" name="Username" value="{{.Username}}"/>
+{{else}}
+<h2>{{tr "Add a User"}}</h2>
+<form action="{{base}}/users" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="create"/>
+{{end}}
+<table class="form">
+{{if not .Edit}}
+<tr><td class="mainlabel">{{tr "Username"}}:</td>
+    <td><input type="text" class="main" name="Username"></td></tr>
+{{end}}
+<tr><td class="label">{{tr "Fullname"}}:</td>
+    <td><input type="text" name="Fullname" value="{{with .Edit}}{{.Fullname}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Email"}}:</td>
+    <td><input type="text" name="Email" value="{{with .Edit}}{{.Email}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Role"}}:</td>
+    <td><select name="Role">
+        {{$role := "viewer"}}{{with .Edit}}{{$role = .Role}}{{end}}
+        {{range .Roles}}<option value="{{.}}"{{if eq . $role}} selected{{end}}>{{tr .}}</option>
+        {{end}}
+        </select></td></tr>
+{{if .Organizations}}
+<tr><td class="label">{{tr "Organization"}}:</td>
+    <td><select name="Org"><option value="">{{tr "All, the whole WebCA"}}</option>
+        {{$org := ""}}{{with .Edit}}{{$org = .Org}}{{end}}
+        {{range .Organizations}}<option{{if eq .Name $org}} selected{{end}}>{{.Name}}</option>
+        {{end}}
+        </select></td></tr>
+{{end}}
+<tr><td class="label">{{tr "Password"}}:</td>
+    <td><input type="password" name="Password" autocomplete="new-password">
+        {{if .Edit}}{{tr "(unchanged if empty)"}}{{end}}</td></tr>
+<tr><td colspan="2">{{template "passwordPolicy" .Policy}}</td></tr>
+{{with .Edit}}
+<tr><td colspan="2"><input type="checkbox" name="Disabled" value="1"{{if .Disabled}} checked{{end}}>
+{{tr "Disabled, the user can't log in nor use their API tokens"}}</td></tr>
+{{end}}
+<tr>
+<td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Save"}}'></td>
+</tr>
+</table>
+</form>
+<h2>{{tr "Invite a User"}}</h2>
+<div class="explanation">
+{{tr "The invitee gets an email with a link, valid for %d days, to choose their own username and password." .InviteDays}}
+</div>
+<table class="form">
+{{range .Invitations}}
+<tr><td class="label">{{.Email}}</td><td>{{tr .Role}}</td>
+    <td>{{tr "Invited by %s, expires on %s" .By (.Expires.Format "2006/01/02 15:04")}}</td>
+    <td><form action="{{base}}/users" method="post">{{template "csrf" $}}
+        <input type="hidden" name="action" value="deleteInvite"/>
+        <input type="hidden" name="id" value="{{.ID}}"/>
+        <input type="submit" value='{{tr "Revoke"}}'>
+        </form></td></tr>
+{{end}}
+</table>
+<form action="{{base}}/users" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="invite"/>
+<table class="form">
+<tr><td class="mainlabel">{{tr "Email"}}:</td>
+    <td><input type="text" class="main" name="Email"></td></tr>
+<tr><td class="label">{{tr "Role"}}:</td>
+    <td><select name="Role">
+        {{range .Roles}}<option value="{{.}}"{{if eq . "viewer"}} selected{{end}}>{{tr .}}</option>
+        {{end}}
+        </select></td></tr>
+<tr>
+<td colspan="2"><input type="submit" value='{{tr "Invite"}}'></td>
+</tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "csrf"}}<input type="hidden" name="CSRFToken" value="{{.CSRF}}">{{end}}
+
+{{define "csrfError"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Request Rejected"}}</h2>
+<div class="notice">
+{{tr "This request did not come from a page of this WebCA, or your session has expired, so it was not carried out."}}
+</div>
+<p><a href="{{base}}/">{{tr "Go back and try again"}}</a></p>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "tooManyRequests"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Too Many Requests"}}</h2>
+<div class="notice">
+{{tr "You have made too many requests in a short while, please wait %v seconds before trying again." .Wait}}
+</div>
+<p><a href="{{base}}/">{{tr "Go back"}}</a></p>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "passkey"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Confirm with your passkey"}}</h2>
+<div class="explanation">
+{{tr "Your account requires a passkey after the password."}}
+</div>
+<p><input type="button" value='{{tr "Use my passkey"}}' onclick="passkeyLogin('', {{.URL}})"></p>
+<script type="text/javascript">
+{{template "JSWebAuthn" .}}
+passkeyLogin('', {{.URL}});
+</script>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "passwordPolicy"}}
+<div class="explanation">
+{{tr "Passwords have at least %d characters mixing %d of lowercase, uppercase, digits and symbols." .MinLength .MinClasses}}
+</div>
+{{end}}
+
+{{define "invite"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Welcome to WebCA"}}</h2>
+<div class="explanation">
+{{tr "%s invited %s as %s, choose your username and password." .Invitation.By .Invitation.Email (tr .Invitation.Role)}}
+</div>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<form action="{{base}}/invite" method="post">{{template "csrf" $}}
+<input type="hidden" name="id" value="{{.Invitation.ID}}"/>
+<input type="hidden" name="sig" value="{{.Sig}}"/>
+<table class="form">
+<tr><td class="mainlabel">{{tr "Username"}}:</td>
+    <td><input type="text" class="main" name="Username" value="{{.U.Username}}"></td></tr>
+<tr><td class="label">{{tr "Fullname"}}:</td>
+    <td><input type="text" name="Fullname" value="{{.U.Fullname}}"></td></tr>
+<tr><td class="label">{{tr "Password"}}:</td>
+    <td><input type="password" name="Password" autocomplete="new-password"></td></tr>
+<tr><td class="label">{{tr "Confirm Password"}}:</td>
+    <td><input type="password" name="Confirm" autocomplete="new-password"></td></tr>
+<tr><td colspan="2">{{template "passwordPolicy" .Policy}}</td></tr>
+<tr>
+<td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Join"}}'></td>
+</tr>
+</table>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "settings"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Settings"}}</h2>
+{{if .Instance}}
+<form action="{{base}}/settings" method="post">{{template "csrf" $}}
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+<tr><td colspan="2"><input type="checkbox" name="NoPlainKeys" value="1"{{if .Settings.NoPlainKeys}} checked{{end}}>
+{{tr "Only allow encrypted private key downloads"}}</td></tr>
+<tr><td class="label">{{tr "Auto-renewal"}}:</td>
+    <td><input type="number" name="AutoRenewDays" min="1" placeholder="14"
+               value="{{if .Settings.AutoRenewDays}}{{.Settings.AutoRenewDays}}{{end}}"> {{tr "days before expiry"}}</td></tr>
+<tr><td class="label">{{tr "Key pool"}}:</td>
+    <td><input type="text" name="KeyPool" placeholder="RSA-2048:10 ECDSA-256:10" value="{{.Settings.KeyPoolText}}">
+    {{range $kind, $n := .KeyPoolLevels}}<span class="tag">{{tr "%s: %d ready" $kind $n}}</span> {{end}}
+    <div class="explanation">{{tr "Keys generated in advance by kind, so that the certificates are issued without waiting."}}</div></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Mailer"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "The expiry notifications and the invitations are sent through this account, none if there is no server."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Email Server"}}:</td>
+    <td><input type="text" name="MailServer" placeholder="smtp.example.com:587"
+               value="{{with .Settings.Mailer}}{{.Server}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Email"}}:</td>
+    <td><input type="text" name="MailUser" value="{{with .Settings.Mailer}}{{.User}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Email Password"}}:</td>
+    <td><input type="password" name="MailPassword" autocomplete="new-password"
+               placeholder='{{if .Settings.Mailer}}{{tr "unchanged"}}{{end}}'></td></tr>
+{{$tls := ""}}{{$auth := ""}}{{$skip := false}}{{with .Settings.Mailer}}{{$tls = .TLS}}{{$auth = .Auth}}{{$skip = .SkipVerify}}{{end}}
+<tr><td class="label">{{tr "TLS"}}:</td>
+    <td><select name="MailTLS">
+        <option value=""{{if eq $tls ""}} selected{{end}}>{{tr "STARTTLS when offered"}}</option>
+        <option value="starttls"{{if eq $tls "starttls"}} selected{{end}}>{{tr "STARTTLS required"}}</option>
+        <option value="tls"{{if eq $tls "tls"}} selected{{end}}>{{tr "Implicit TLS (port 465)"}}</option>
+        <option value="none"{{if eq $tls "none"}} selected{{end}}>{{tr "No TLS"}}</option></select></td></tr>
+<tr><td class="label">{{tr "Authentication"}}:</td>
+    <td><select name="MailAuth">
+        <option value=""{{if eq $auth ""}} selected{{end}}>{{tr "The first one that works"}}</option>
+        <option{{if eq $auth "PLAIN"}} selected{{end}}>PLAIN</option>
+        <option{{if eq $auth "LOGIN"}} selected{{end}}>LOGIN</option>
+        <option{{if eq $auth "CRAM-MD5"}} selected{{end}}>CRAM-MD5</option></select></td></tr>
+<tr><td colspan="2"><input type="checkbox" name="MailSkipVerify" value="1"{{if $skip}} checked{{end}}>
+{{tr "Don't verify the certificate of the mail server"}}</td></tr>
+<tr><td colspan="2"><input type="button" value='{{tr "Send test email"}}' onclick="testMail(this.form)">
+<script type="text/javascript">
+{{template "JSTestMail"}}
+</script>
+<pre id="mailTest"></pre></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Web certificate"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "The certificate the WebCA is served with, from now on."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Certificate"}}:</td>
+    <td><select name="WebCert">
+{{range .WebCerts}}<option{{if $.Settings.WebCert}}{{if eq $.Settings.WebCert.Crt.Subject.CommonName .Crt.Subject.CommonName}} selected{{end}}{{end}}
+     >{{.Crt.Subject.CommonName}}</option>{{end}}</select></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "gRPC service"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Clients authenticate with certificates issued by the client CA. Changes apply on restart."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Client CA"}}:</td>
+    <td><select name="GRPCClientCA"><option value="">{{tr "Disabled"}}</option>
+{{range .CAs}}<option{{if $.Settings.GRPC}}{{if eq $.Settings.GRPC.ClientCA .Crt.Subject.CommonName}} selected{{end}}{{end}}
+     >{{.Crt.Subject.CommonName}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "Port"}}:</td>
+    <td><input type="number" name="GRPCPort" min="1" max="65535" placeholder="9443"
+               value="{{with .Settings.GRPC}}{{if .Port}}{{.Port}}{{end}}{{end}}"></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "ACME server"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "ACME clients such as certbot use the directory at /acme/directory, names are validated with http-01 or dns-01 challenges."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Issuing CA"}}:</td>
+    <td><select name="ACMECA"><option value="">{{tr "Disabled"}}</option>
+{{range .CAs}}<option{{if $.Settings.ACME}}{{if eq $.Settings.ACME.CA .Crt.Subject.CommonName}} selected{{end}}{{end}}
+     >{{.Crt.Subject.CommonName}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "Profile"}}:</td>
+    <td><select name="ACMEProfile"><option value="">{{tr "None"}}</option>
+{{range .Profiles}}<option{{if $.Settings.ACME}}{{if eq $.Settings.ACME.Profile .}} selected{{end}}{{end}}
+     >{{.}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "Days"}}:</td>
+    <td><input type="number" name="ACMEDays" min="1" placeholder="90"
+               value="{{with .Settings.ACME}}{{if .Days}}{{.Days}}{{end}}{{end}}"></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "SCEP enrollment"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Devices enroll at /scep with the challenge password, the CA must have an RSA key."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Issuing CA"}}:</td>
+    <td><select name="SCEPCA"><option value="">{{tr "Disabled"}}</option>
+{{range .CAs}}<option{{if $.Settings.SCEP}}{{if eq $.Settings.SCEP.CA .Crt.Subject.CommonName}} selected{{end}}{{end}}
+     >{{.Crt.Subject.CommonName}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "Challenge password"}}:</td>
+    <td><input type="password" name="SCEPChallenge" autocomplete="new-password"
+               placeholder='{{if .Settings.SCEP}}{{tr "unchanged"}}{{end}}'></td></tr>
+<tr><td class="label">{{tr "Profile"}}:</td>
+    <td><select name="SCEPProfile"><option value="">{{tr "None"}}</option>
+{{range .Profiles}}<option{{if $.Settings.SCEP}}{{if eq $.Settings.SCEP.Profile .}} selected{{end}}{{end}}
+     >{{.}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "Days"}}:</td>
+    <td><input type="number" name="SCEPDays" min="1" placeholder="365"
+               value="{{with .Settings.SCEP}}{{if .Days}}{{.Days}}{{end}}{{end}}"></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Vault PKI API"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Tools written for Vault's PKI engine can issue and sign at /v1/<mount>/ with an API token, roles are profile names or default."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Issuing CA"}}:</td>
+    <td><select name="VaultCA"><option value="">{{tr "Disabled"}}</option>
+{{range .CAs}}<option{{if $.Settings.Vault}}{{if eq $.Settings.Vault.CA .Crt.Subject.CommonName}} selected{{end}}{{end}}
+     >{{.Crt.Subject.CommonName}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "Mount"}}:</td>
+    <td><input type="text" name="VaultMount" placeholder="pki"
+               value="{{with .Settings.Vault}}{{.Mount}}{{end}}"></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Kubernetes"}}</td></tr>
+<tr><td colspan="2"><input type="checkbox" name="Kubernetes" value="1"{{if .Settings.Kubernetes}} checked{{end}}>
+{{tr "Publish certificates as kubernetes.io/tls Secrets"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Leave the server, token and CA empty to use the service account when running in the cluster."}}
+</div></td></tr>
+<tr><td class="label">{{tr "API server"}}:</td>
+    <td><input type="text" name="KubeServer" placeholder="https://kubernetes.example.com:6443"
+               value="{{with .Settings.Kubernetes}}{{.Server}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Namespace"}}:</td>
+    <td><input type="text" name="KubeNamespace" placeholder="default"
+               value="{{with .Settings.Kubernetes}}{{.Namespace}}{{else}}default{{end}}"></td></tr>
+<tr><td class="label">{{tr "Token"}}:</td>
+    <td><input type="password" name="KubeToken" autocomplete="off"
+               placeholder='{{with .Settings.Kubernetes}}{{if .Token}}{{tr "unchanged"}}{{end}}{{end}}'></td></tr>
+<tr><td class="label">{{tr "CA certificate"}}:</td>
+    <td><textarea name="KubeCA" rows="4" placeholder="-----BEGIN CERTIFICATE-----"
+               >{{with .Settings.Kubernetes}}{{.CA}}{{end}}</textarea></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Certificate Transparency"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Certificates issued by a CA are submitted to these logs and their SCTs stored alongside."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Log URLs"}}:</td>
+    <td><textarea name="CTLogs" rows="3" placeholder="https://ct.example.com/log"
+               >{{with .Settings.CT}}{{join .Logs "\n"}}{{end}}</textarea></td></tr>
+<tr><td colspan="2"><input type="checkbox" name="CTEmbed" value="1"{{with .Settings.CT}}{{if .Embed}} checked{{end}}{{end}}>
+{{tr "Log a precertificate first and embed the SCTs in the certificate"}}</td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Password Policy"}}</td></tr>
+<tr><td class="label">{{tr "Minimum length"}}:</td>
+    <td><input type="number" name="PasswordMinLength" min="1"
+               value="{{with .Settings.Passwords}}{{.MinLength}}{{end}}"
+               placeholder="{{.Policy.MinLength}}"> {{tr "characters"}}</td></tr>
+<tr><td class="label">{{tr "Character classes"}}:</td>
+    <td><input type="number" name="PasswordMinClasses" min="0" max="4"
+               value="{{with .Settings.Passwords}}{{.MinClasses}}{{end}}"
+               placeholder="{{.Policy.MinClasses}}"> {{tr "of lowercase, uppercase, digits and symbols"}}</td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Login Throttling"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Accounts and addresses with too many failed logins are locked out for a while, 0 failures never locks them out."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Account failures"}}:</td>
+    <td><input type="number" name="LoginAccountFailures" min="0"
+               value="{{with .Settings.Logins}}{{.AccountFailures}}{{end}}"
+               placeholder="{{.Limits.AccountFailures}}"></td></tr>
+<tr><td class="label">{{tr "Address failures"}}:</td>
+    <td><input type="number" name="LoginAddressFailures" min="0"
+               value="{{with .Settings.Logins}}{{.AddressFailures}}{{end}}"
+               placeholder="{{.Limits.AddressFailures}}"></td></tr>
+<tr><td class="label">{{tr "Counted over"}}:</td>
+    <td><input type="number" name="LoginWindow" min="1"
+               value="{{with .Settings.Logins}}{{.Window}}{{end}}"
+               placeholder="{{.Limits.Window}}"> {{tr "minutes"}}</td></tr>
+<tr><td class="label">{{tr "Lockout"}}:</td>
+    <td><input type="number" name="LoginLockout" min="1"
+               value="{{with .Settings.Logins}}{{.Lockout}}{{end}}"
+               placeholder="{{.Limits.Lockout}}"> {{tr "minutes"}}</td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Rate Limiting"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Every address can make that many requests per minute, fewer for the logins and the downloads, 0 never limits them."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Requests"}}:</td>
+    <td><input type="number" name="RateRequests" min="0"
+               value="{{with .Settings.Rates}}{{.Requests}}{{end}}"
+               placeholder="{{.Rates.Requests}}"> {{tr "per minute"}}</td></tr>
+<tr><td class="label">{{tr "Burst"}}:</td>
+    <td><input type="number" name="RateBurst" min="0"
+               value="{{with .Settings.Rates}}{{.Burst}}{{end}}"
+               placeholder="{{.Rates.Burst}}"> {{tr "requests over the rate at once"}}</td></tr>
+<tr><td class="label">{{tr "Logins"}}:</td>
+    <td><input type="number" name="RateLogins" min="0"
+               value="{{with .Settings.Rates}}{{.Logins}}{{end}}"
+               placeholder="{{.Rates.Logins}}"> {{tr "per minute"}}</td></tr>
+<tr><td class="label">{{tr "Downloads"}}:</td>
+    <td><input type="number" name="RateDownloads" min="0"
+               value="{{with .Settings.Rates}}{{.Downloads}}{{end}}"
+               placeholder="{{.Rates.Downloads}}"> {{tr "per minute"}}</td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Sessions"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Sessions expire when idle for a while and, with a lifetime, that long after the login even when in use (0 never)."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Idle timeout"}}:</td>
+    <td><input type="number" name="SessionIdle" min="1"
+               value="{{with .Settings.Sessions}}{{.Idle}}{{end}}"
+               placeholder="{{.SessionLimits.Idle}}"> {{tr "minutes"}}</td></tr>
+<tr><td class="label">{{tr "Lifetime"}}:</td>
+    <td><input type="number" name="SessionLifetime" min="0"
+               value="{{with .Settings.Sessions}}{{.Lifetime}}{{end}}"
+               placeholder="{{.SessionLimits.Lifetime}}"> {{tr "minutes"}}</td></tr>
+<tr><td class="label">{{tr "Cleanup every"}}:</td>
+    <td><input type="number" name="SessionCleanup" min="1"
+               value="{{with .Settings.Sessions}}{{.Cleanup}}{{end}}"
+               placeholder="{{.SessionLimits.Cleanup}}"> {{tr "minutes"}}</td></tr>
+<tr><td class="label">{{tr "Sessions per user"}}:</td>
+    <td><input type="number" name="SessionPerUser" min="0"
+               value="{{with .Settings.Sessions}}{{.PerUser}}{{end}}"
+               placeholder="{{.SessionLimits.PerUser}}"> {{tr "at once (0 no limit)"}}</td></tr>
+<tr><td class="label">{{tr "Over the limit"}}:</td>
+    <td><select name="SessionOverflow">
+        <option value="refuse">{{tr "Refuse the new login"}}</option>
+        <option value="evict" {{if .SessionLimits.Evict}}selected="selected"{{end}}>{{tr "Log out the oldest session"}}</option>
+        </select></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Single Sign On"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Users can sign in with an OpenID Connect provider, registered with the callback /oidc/callback of this server. The password login remains."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Issuer"}}:</td>
+    <td><input type="text" name="OIDCIssuer" placeholder='https://accounts.example.com ({{tr "empty disables it"}})'
+               value="{{with .Settings.OIDC}}{{.Issuer}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Name"}}:</td>
+    <td><input type="text" name="OIDCName" placeholder="Example SSO"
+               value="{{with .Settings.OIDC}}{{.Name}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Client ID"}}:</td>
+    <td><input type="text" name="OIDCClientID" value="{{with .Settings.OIDC}}{{.ClientID}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Client secret"}}:</td>
+    <td><input type="password" name="OIDCClientSecret" autocomplete="off"
+               placeholder='{{with .Settings.OIDC}}{{if .ClientSecret}}{{tr "unchanged"}}{{end}}{{end}}'></td></tr>
+<tr><td class="label">{{tr "Scopes"}}:</td>
+    <td><input type="text" name="OIDCScopes" placeholder="profile email"
+               value="{{with .Settings.OIDC}}{{.Scopes}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Username claim"}}:</td>
+    <td><input type="text" name="OIDCUsernameClaim" placeholder="preferred_username"
+               value="{{with .Settings.OIDC}}{{.UsernameClaim}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Roles claim"}}:</td>
+    <td><input type="text" name="OIDCRolesClaim" placeholder="groups"
+               value="{{with .Settings.OIDC}}{{.RolesClaim}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Roles"}}:</td>
+    <td><textarea name="OIDCRoles" rows="3" placeholder="pki-admins=admin"
+               >{{with .Settings.OIDC}}{{range $value, $role := .Roles}}{{$value}}={{$role}}
+{{end}}{{end}}</textarea></td></tr>
+<tr><td class="label">{{tr "Default role"}}:</td>
+    <td><select name="OIDCDefaultRole"><option value="">{{tr "None"}}</option>
+{{$default := ""}}{{with .Settings.OIDC}}{{$default = .DefaultRole}}{{end}}
+{{range .Roles}}<option value="{{.}}"{{if eq . $default}} selected{{end}}>{{tr .}}</option>{{end}}
+    </select></td></tr>
+<tr><td colspan="2"><input type="checkbox" name="OIDCCreateUsers" value="1"
+    {{with .Settings.OIDC}}{{if .CreateUsers}} checked{{end}}{{end}}>
+{{tr "Create the unknown users on their first sign in"}}</td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Certificate Logins"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Browsers presenting a valid certificate of the client CA over HTTPS are logged in as the user it names, without a password."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Client CA"}}:</td>
+    <td><select name="ClientCertCA"><option value="">{{tr "Disabled"}}</option>
+{{range .CAs}}<option{{if $.Settings.ClientCerts}}{{if eq $.Settings.ClientCerts.CA .Crt.Subject.CommonName}} selected{{end}}{{end}}
+     >{{.Crt.Subject.CommonName}}</option>{{end}}</select></td></tr>
+<tr><td class="label">{{tr "User"}}:</td>
+    <td><select name="ClientCertMatch">
+        <option value="cn">{{tr "Common name is the username"}}</option>
+        <option value="email"{{with .Settings.ClientCerts}}{{if eq .Match "email"}} selected{{end}}{{end}}
+        >{{tr "Email address is the one of the user"}}</option></select></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "HTTPS"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "The web listener can require a newer TLS version and restrict its TLS 1.2 cipher suites and its curves, which are comma separated names in order of preference. The new connections use them."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Minimum version"}}:</td>
+    <td><select name="TLSMinVersion"><option value="">{{tr "Default"}}</option>
+{{range $v := .TLSVersions}}<option{{with $.Settings.TLS}}{{if eq .MinVersion $v}} selected{{end}}{{end}}>{{$v}}</option>{{end}}
+        </select></td></tr>
+<tr><td class="label">{{tr "Cipher suites"}}:</td>
+    <td><input type="text" class="main" name="TLSCipherSuites" placeholder="TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, ..."
+               value="{{with .Settings.TLS}}{{join .CipherSuites ", "}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Curves"}}:</td>
+    <td><input type="text" class="main" name="TLSCurves" placeholder="X25519, CurveP256, ..."
+               value="{{with .Settings.TLS}}{{join .Curves ", "}}{{end}}"></td></tr>
+<tr><td colspan="2" class="bigger">{{tr "Audit Export"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "The audit events are also sent to the syslog server (RFC 5424) and appended to the file as JSON lines."}}
+</div></td></tr>
+{{template "auditSinksDetails" .Settings.AuditSinks}}
+<tr><td colspan="2" class="bigger">{{tr "Shared Sessions"}}</td></tr>
+<tr><td colspan="2"><div class="explanation">
+{{tr "Several WebCA instances behind a load balancer share their sessions in Redis. Changing it logs everybody out."}}
+</div></td></tr>
+<tr><td class="label">{{tr "Redis Server"}}:</td>
+    <td><input type="text" name="RedisAddr" placeholder="host:6379" value="{{with .Settings.Redis}}{{.Addr}}{{end}}">
+    <input type="checkbox" name="RedisTLS" value="1"{{with .Settings.Redis}}{{if .TLS}} checked{{end}}{{end}}>TLS</td></tr>
+<tr><td class="label">{{tr "Password"}}:</td>
+    <td><input type="password" name="RedisPassword" autocomplete="off"
+               placeholder='{{with .Settings.Redis}}{{if .Password}}{{tr "unchanged"}}{{end}}{{end}}'></td></tr>
+<tr><td class="label">{{tr "Database"}}:</td>
+    <td><input type="text" name="RedisDB" size="4" value="{{with .Settings.Redis}}{{.DB}}{{else}}0{{end}}"></td></tr>
+<tr><td colspan="2"><input type="submit" id="submit" name="submit" value='{{tr "Save"}}'></td></tr>
+</table>
+</form>
+<h2>{{tr "Backup"}}</h2>
+<div class="explanation">
+{{tr "Download the configuration, users, certificates, keys and revocations in a single archive encrypted with the passphrase."}}
+{{tr "Keys encrypted with the master key will need it again after restoring."}}
+</div>
+<form action="{{base}}/backup" method="post">{{template "csrf" $}}
+<table class="form">
+<tr><td class="label">{{tr "Passphrase"}}:</td>
+    <td><input type="password" name="BackupPassphrase" autocomplete="new-password">
+    <input type="submit" value='{{tr "Download Backup"}}'></td></tr>
+</table>
+</form>
+{{end}}
+<h2>{{tr "Preferences"}}</h2>
+<form action="{{base}}/preferences" method="post">{{template "csrf" $}}
+<table class="form">
+<tr><td class="label">{{tr "Language"}}:</td>
+    <td><select name="Lang"><option value="">{{tr "The browser's"}}</option>
+{{range languages}}<option value="{{.Tag}}"{{if eq .Tag $.Lang}} selected{{end}}>{{.Name}}</option>{{end}}
+    </select></td></tr>
+<tr><td class="label">{{tr "Time zone"}}:</td>
+    <td><input type="text" name="Timezone" value="{{.Timezone}}" placeholder="Europe/Madrid">
+    {{tr "the server's if empty"}}</td></tr>
+<tr><td colspan="2"><input type="submit" value='{{tr "Save"}}'></td></tr>
+</table>
+</form>
+<h2>{{tr "API Tokens"}}</h2>
+<div class="explanation">
+{{tr "Tokens are sent as an Authorization: Bearer header to use the API from scripts."}}
+</div>
+{{with .NewToken}}
+<div class="notice">{{tr "Copy the new token now, it won't be shown again:"}} <code>{{.}}</code></div>
+{{end}}
+<table class="form">
+{{range .Tokens}}
+<tr><td>{{.Name}}</td><td>{{.ID}}...</td><td>{{.Created.Format "2006/01/02 15:04"}}</td>
+<td><form action="{{base}}/tokens" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="delete"/><input type="hidden" name="id" value="{{.ID}}"/>
+<input type="submit" value='{{tr "Revoke"}}'></form></td></tr>
+{{else}}
+<tr><td colspan="4">{{tr "No API tokens."}}</td></tr>
+{{end}}
+<tr><td colspan="4"><form action="{{base}}/tokens" method="post">{{template "csrf" $}}
+<input type="text" name="Name" placeholder='{{tr "Token name"}}'>
+<input type="submit" value='{{tr "Create"}}'></form></td></tr>
+</table>
+<h2>{{tr "Passkeys"}}</h2>
+<div class="explanation">
+{{tr "Passkeys (FIDO2 security keys, phones or laptops) log you in without a password or confirm it."}}
+</div>
+<table class="form">
+{{range $i, $pk := .Passkeys}}
+<tr><td>{{$pk.Name}}</td><td>{{$pk.Created.Format "2006/01/02 15:04"}}</td>
+<td><form action="{{base}}/passkeys" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="delete"/><input type="hidden" name="index" value="{{$i}}"/>
+<input type="submit" value='{{tr "Delete"}}'
+       onclick="return confirm('{{tr "Are you sure you want to delete this passkey?"}}')"></form></td></tr>
+{{else}}
+<tr><td colspan="3">{{tr "No passkeys."}}</td></tr>
+{{end}}
+<tr><td colspan="3"><input type="text" id="PasskeyName" placeholder='{{tr "Passkey name"}}'>
+<input type="button" value='{{tr "Register a passkey"}}' onclick="passkeyRegister($('PasskeyName').value)"></td></tr>
+{{if .Passkeys}}
+<tr><td colspan="3"><form action="{{base}}/passkeys" method="post">{{template "csrf" $}}
+<input type="hidden" name="action" value="secondFactor"/>
+<input type="checkbox" name="SecondFactor" value="1"{{if .SecondFactor}} checked{{end}}>
+{{tr "Require a passkey after the password"}}
+<input type="submit" value='{{tr "Save"}}'></form></td></tr>
+{{end}}
+</table>
+<script type="text/javascript">
+{{template "JSWebAuthn" .}}
+</script>
+{{template "htmlfooter"}}
+{{end}}
 `
 )
@@ -0,0 +1,63 @@
+package webca
+
+import (
+	"html/template"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// parseTemplates parses the embedded templates and style, then the *.html and *.css files of the
+// theme directory, if any. Their {{define}} blocks, or the files themselves when named like an
+// embedded template (e.g. style.css), replace the embedded ones
+func parseTemplates(theme string) (*template.Template, error) {
+	t := template.New("webcaTemplates")
+	t.Funcs(template.FuncMap{
+		// The name "title" is what the function will be called in the template text.
+		"tr": tr, "indexOf": indexOf, "showPeriod": showPeriod, "qEsc": qEsc,
+		"archived": archived, "crossed": crossed, "join": strings.Join, "tags": certTags,
+		"ekuName": ekuName, "intList": intList, "base": base,
+		"lang": lang, "languages": uiLanguages, "inZone": inZone,
+	})
+	for _, text := range []string{htmlTemplates, jsTemplates, pages} {
+		if _, err := t.Parse(text); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := t.ParseFiles("style.css"); err != nil {
+		return nil, err
+	}
+	if theme == "" {
+		return t, nil
+	}
+	for _, pattern := range []string{"*.html", "*.css"} {
+		files, err := filepath.Glob(filepath.Join(theme, pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		if _, err := t.ParseFiles(files...); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// reloadTheme parses and localizes the templates again with the theme directory of the options,
+// keeping the ones in use if they are wrong
+func reloadTheme() error {
+	if options.ThemeDir == "" {
+		return nil
+	}
+	t, err := parseTemplates(options.ThemeDir)
+	if err != nil {
+		return err
+	}
+	if err := useTemplates(t, options.ThemeDir); err != nil {
+		return err
+	}
+	log.Printf("Theme reloaded from %s", options.ThemeDir)
+	return nil
+}
@@ -0,0 +1,48 @@
+package webca
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTheme(t *testing.T) {
+	theme := filepath.Join("tests", "theme")
+	dieOnError(t, os.MkdirAll(theme, 0750))
+	defer func() {
+		dieOnError(t, os.RemoveAll("tests"))
+	}()
+	defer func() {
+		dieOnError(t, useTemplates(template.Must(parseTemplates("")), ""))
+	}()
+	defer func(saved Options) { options = saved }(options)
+	footer := filepath.Join(theme, "brand.html")
+	dieOnError(t, ioutil.WriteFile(footer, []byte(`{{define "htmlfooter"}}<div>ACME Corp PKI</div>{{end}}`), 0640))
+	dieOnError(t, ioutil.WriteFile(filepath.Join(theme, "style.css"), []byte("body { color: purple; }"), 0640))
+	options = Options{ThemeDir: theme}
+	login := func() string {
+		var buf bytes.Buffer
+		dieOnError(t, templates.ExecuteTemplate(&buf, "login", PageStatus{}))
+		return buf.String()
+	}
+	dieOnError(t, reloadTheme())
+	page := login()
+	if !strings.Contains(page, "ACME Corp PKI") || strings.Contains(page, "Hosted on GitHub") ||
+		!strings.Contains(page, "color: purple") {
+		t.Error("The theme does not override the embedded templates")
+	}
+
+	dieOnError(t, ioutil.WriteFile(footer, []byte(`{{define "htmlfooter"}}{{.Missing</div>{{end}}`), 0640))
+	if err := reloadTheme(); err == nil || login() != page {
+		t.Errorf("A wrong theme was taken: %v", err)
+	}
+	dieOnError(t, ioutil.WriteFile(footer, []byte(`{{define "htmlfooter"}}<div>ACME Corp CA</div>{{end}}`), 0640))
+	dieOnError(t, Reload()) // as on SIGHUP
+	if !strings.Contains(login(), "ACME Corp CA") {
+		t.Error("The theme was not reloaded")
+	}
+}
@@ -0,0 +1,85 @@
+package webca
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	LOGIN_ACCOUNT_FAILURES = 5  // failed logins of an account before its lockout, if there are no limits
+	LOGIN_ADDRESS_FAILURES = 20 // failed logins from an address before its lockout, if there are no limits
+	LOGIN_WINDOW           = 15 // minutes the failures are counted over, if there are no limits
+	LOGIN_LOCKOUT          = 15 // minutes of lockout, if there are no limits
+)
+
+// LoginLimits throttle the logins to resist brute forcing the passwords
+type LoginLimits struct {
+	AccountFailures int // failed logins of an account before it is locked out
+	AddressFailures int // failed logins from an IP address before it is locked out
+	Window          int // minutes the failures are counted over
+	Lockout         int // minutes of lockout
+}
+
+// loginFailures counts the recent failed logins of an account or address
+type loginFailures struct {
+	count  int
+	first  time.Time
+	locked time.Time // until then
+}
+
+// failed logins by "user name" or "addr ip", in memory
+var failures = make(map[string]*loginFailures)
+
+// failed logins lock
+var sfailures sync.Mutex
+
+// loginLimits returns the configured login limits or the default ones
+func (cfg *config) loginLimits() LoginLimits {
+	if cfg == nil || cfg.Logins == nil {
+		return LoginLimits{LOGIN_ACCOUNT_FAILURES, LOGIN_ADDRESS_FAILURES, LOGIN_WINDOW, LOGIN_LOCKOUT}
+	}
+	return *cfg.Logins
+}
+
+// lockedOut tells whether or not the logins of the user or from the address are locked out
+func lockedOut(user, addr string, now time.Time) bool {
+	sfailures.Lock()
+	defer sfailures.Unlock()
+	for _, key := range []string{"user " + user, "addr " + addr} {
+		if f := failures[key]; f != nil && now.Before(f.locked) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginFailed counts a failed login of the user from the address, locking them out when they
+// reach their limit
+func (l LoginLimits) loginFailed(user, addr string, now time.Time) {
+	sfailures.Lock()
+	defer sfailures.Unlock()
+	for key, max := range map[string]int{"user " + user: l.AccountFailures, "addr " + addr: l.AddressFailures} {
+		f := failures[key]
+		if f == nil || now.Sub(f.first) > time.Duration(l.Window)*time.Minute {
+			f = &loginFailures{first: now}
+			failures[key] = f
+		}
+		if f.count++; max > 0 && f.count >= max {
+			f.count, f.first = 0, now
+			f.locked = now.Add(time.Duration(l.Lockout) * time.Minute)
+			audit(AUDIT_LOCKOUT, user, addr, key+" until "+f.locked.Format(time.RFC3339))
+		}
+	}
+	for key, f := range failures { // forget the old ones
+		if now.Sub(f.first) > time.Duration(l.Window)*time.Minute && now.After(f.locked) {
+			delete(failures, key)
+		}
+	}
+}
+
+// loginSucceeded forgets the failed logins of the user
+func loginSucceeded(user string) {
+	sfailures.Lock()
+	defer sfailures.Unlock()
+	delete(failures, "user "+user)
+}
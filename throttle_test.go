@@ -0,0 +1,51 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottling(t *testing.T) {
+	inTestDir(t)
+	defer func(saved map[string]*loginFailures) { failures = saved }(failures)
+	failures = make(map[string]*loginFailures)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{
+		"boss": {Username: "boss", Password: "Boss-passwd"},
+		"op":   {Username: "op", Role: ROLE_OPERATOR, Password: "Op-passwd"},
+	}, Logins: &LoginLimits{AccountFailures: 3, AddressFailures: 5, Window: 15, Lockout: 15}}
+	logIn := func(username, password, addr string) int {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader("Username="+username+"&Password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = addr + ":1234"
+		w := httptest.NewRecorder()
+		login(w, req)
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := logIn("boss", "guess", "10.0.0.1"); code != http.StatusOK {
+			t.Fatalf("Wrong failed login: %d", code)
+		}
+	}
+	if code := logIn("boss", "Boss-passwd", "10.0.0.2"); code != http.StatusTooManyRequests {
+		t.Errorf("The locked out account could log in: %d", code)
+	}
+	if code := logIn("op", "guess", "10.0.0.1"); code != http.StatusOK {
+		t.Fatalf("Wrong failed login: %d", code)
+	}
+	if code := logIn("op", "Op-passwd", "10.0.0.1"); code != http.StatusFound {
+		t.Errorf("The other account could not log in: %d", code)
+	}
+	if code := logIn("op", "guess", "10.0.0.1"); code != http.StatusOK {
+		t.Fatalf("Wrong failed login: %d", code)
+	}
+	if code := logIn("op", "Op-passwd", "10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Errorf("The locked out address could log in: %d", code)
+	}
+	if lockedOut("boss", "10.0.0.1", time.Now().Add(16*time.Minute)) {
+		t.Error("The lockout does not expire")
+	}
+}
@@ -0,0 +1,134 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	TOKEN_PREFIX = "webca_"
+	TOKEN_BYTES  = 32
+)
+
+// APIToken is a long lived credential for the API, only its hash is stored
+type APIToken struct {
+	ID       string // public identifier, the first hash characters
+	Username string
+	Name     string // what the token is used for
+	Hash     string // SHA-256 of the token, in hex
+	Created  time.Time
+}
+
+// NewAPIToken creates a token for the user and returns it in clear, the only time it is available
+func (cfg *config) NewAPIToken(username, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("%s", tr("The token needs a name!"))
+	}
+	secret := make([]byte, TOKEN_BYTES)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := TOKEN_PREFIX + hex.EncodeToString(secret)
+	hash := hashToken(token)
+	return token, cfg.update(func(cfg *config) error {
+		n := len(cfg.APITokens)
+		cfg.APITokens = append(cfg.APITokens[:n:n], APIToken{
+			ID:       hash[:12],
+			Username: username,
+			Name:     name,
+			Hash:     hash,
+			Created:  time.Now(),
+		})
+		return nil
+	})
+}
+
+// DeleteAPIToken revokes the user token with the given id
+func (cfg *config) DeleteAPIToken(username, id string) error {
+	return cfg.update(func(cfg *config) error {
+		for i, t := range cfg.APITokens {
+			if t.ID == id && t.Username == username {
+				cfg.APITokens = append(cfg.APITokens[:i:i], cfg.APITokens[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s", tr("Token not found!"))
+	})
+}
+
+// tokenUser returns the user owning the token, or nil if the token is not valid
+func (cfg *config) tokenUser(token string) *User {
+	if cfg == nil || !strings.HasPrefix(token, TOKEN_PREFIX) {
+		return nil
+	}
+	hash := hashToken(token)
+	for _, t := range cfg.APITokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			if u, ok := cfg.Users[t.Username]; ok && !u.Disabled {
+				return &u
+			}
+		}
+	}
+	return nil
+}
+
+// userTokens returns the tokens owned by the user
+func (cfg *config) userTokens(username string) []APIToken {
+	tokens := make([]APIToken, 0)
+	for _, t := range cfg.APITokens {
+		if t.Username == username {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// hashToken returns the hex SHA-256 of the token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the Authorization: Bearer token of the request, if any
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// tokens allows the web user to create and delete their API tokens
+func tokens(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	u, _ := ps[LOGGEDUSER].(User)
+	if r.Method == "POST" {
+		cfg := LoadConfig()
+		var err error
+		if r.FormValue("action") == "delete" {
+			err = cfg.DeleteAPIToken(u.Username, r.FormValue("id"))
+		} else {
+			var token string
+			if token, err = cfg.NewAPIToken(u.Username, r.FormValue("Name")); err == nil {
+				ps["NewToken"] = token
+			}
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+		} else {
+			auditRequest(w, r, AUDIT_CONFIG, strings.TrimSpace("API token "+r.FormValue("Name")+r.FormValue("id")+" "+
+				r.FormValue("action")))
+		}
+	}
+	showSettings(w, r, ps)
+}
@@ -0,0 +1,38 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPITokens(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"admin": {Username: "admin"}}}
+	token, err := cachedCfg.NewAPIToken("admin", "ci")
+	dieOnError(t, err)
+	tokens := cachedCfg.userTokens("admin")
+	if len(tokens) != 1 || tokens[0].Hash == token || strings.Contains(tokens[0].Hash, token) {
+		t.Fatalf("Token not stored hashed: %v", tokens)
+	}
+	h := apiAccess(api)
+	call := func(auth string) int {
+		req := httptest.NewRequest("GET", "/api/v1/cas", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := call("Bearer " + token); code != http.StatusOK {
+		t.Fatalf("Valid token refused with %d", code)
+	}
+	if code := call("Bearer " + token + "x"); code != http.StatusUnauthorized {
+		t.Fatalf("Invalid token accepted with %d", code)
+	}
+	dieOnError(t, cachedCfg.DeleteAPIToken("admin", tokens[0].ID))
+	if code := call("Bearer " + token); code != http.StatusUnauthorized {
+		t.Fatalf("Revoked token accepted with %d", code)
+	}
+}
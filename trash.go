@@ -0,0 +1,220 @@
+package webca
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TRASH_DIR  = "deleted"
+	TRASH_DAYS = 30
+)
+
+// TrashedCert is a deleted certificate, kept to be restored until purged
+type TrashedCert struct {
+	*Cert
+	File    string    // trash file path without suffix
+	Deleted time.Time // when it was deleted
+	Purge   time.Time // when it will be purged
+}
+
+// trashDays returns the days the deleted certificates are kept, TRASH_DAYS if not set
+func (cfg *config) trashDays() int {
+	if cfg != nil && cfg.TrashDays > 0 {
+		return cfg.TrashDays
+	}
+	return TRASH_DAYS
+}
+
+// trashed returns the trash file path (without suffix) for a certificate deleted at the time
+func trashed(cert *Cert, t time.Time) string {
+	return path.Join(TRASH_DIR, filename(cert.Crt.Subject.CommonName)+"."+serialKey(cert.Crt.SerialNumber)+"."+
+		strconv.FormatInt(t.Unix(), 10))
+}
+
+// trashCerts moves the certificate and key files of the certs to the trash, all or none of them
+func trashCerts(certs ...*Cert) error {
+	now := time.Now()
+	scerts.Lock()
+	defer scerts.Unlock()
+	err := storage.Tx(func(tx Storage) error {
+		for _, cert := range certs {
+			base := trashed(cert, now)
+			if err := copyFile(tx, certFile(*cert), base+CERT_SUFFIX, false); err != nil {
+				return err
+			}
+			if err := copyFile(tx, keyFile(*cert), base+KEY_SUFFIX, true); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := deleteCertFiles(tx, cert); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	purgeTrash(now)
+	return nil
+}
+
+// TrashedCerts returns the deleted certificates not purged yet, the latest deleted first, purging
+// the ones kept for long enough
+func TrashedCerts() []TrashedCert {
+	purgeTrash(time.Now())
+	return trashedCerts()
+}
+
+// trashedCerts returns the certificates in the trash, the latest deleted first
+func trashedCerts() []TrashedCert {
+	files, err := storage.List(TRASH_DIR)
+	if err != nil {
+		return nil
+	}
+	keep := time.Duration(LoadConfig().trashDays()) * 24 * time.Hour
+	certs := make([]TrashedCert, 0)
+	for _, name := range files {
+		if !strings.HasSuffix(name, CERT_SUFFIX) || strings.HasSuffix(name, KEY_SUFFIX) {
+			continue
+		}
+		base := strings.TrimSuffix(name, CERT_SUFFIX)
+		secs, err := strconv.ParseInt(base[strings.LastIndex(base, ".")+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		crt, err := readCert(path.Join(TRASH_DIR, base))
+		if err != nil {
+			log.Printf("(Warning) %s", err)
+			continue
+		}
+		deleted := time.Unix(secs, 0)
+		certs = append(certs, TrashedCert{crt, path.Join(TRASH_DIR, base), deleted, deleted.Add(keep)})
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Deleted.After(certs[j].Deleted) })
+	return certs
+}
+
+// findTrashed returns the certificate in the trash file
+func findTrashed(file string) (*TrashedCert, error) {
+	for _, tc := range trashedCerts() {
+		if tc.File == file {
+			return &tc, nil
+		}
+	}
+	return nil, fmt.Errorf("%s", tr("%v certificate not found!", path.Base(file)))
+}
+
+// RestoreCert puts the deleted certificate in the trash file back in place, unless another one
+// took its name
+func RestoreCert(file string) (*Cert, error) {
+	tc, err := findTrashed(file)
+	if err != nil {
+		return nil, err
+	}
+	if c := FindCert(tc.Crt.Subject.CommonName); c != nil && len(c.Crt.Raw) > 0 {
+		return nil, fmt.Errorf("%s", tr("Certificate %s already exists!", tc.Crt.Subject.CommonName))
+	}
+	scerts.Lock()
+	defer scerts.Unlock()
+	err = storage.Tx(func(tx Storage) error {
+		if err := copyFile(tx, tc.File+CERT_SUFFIX, certFile(*tc.Cert), false); err != nil {
+			return err
+		}
+		if err := copyFile(tx, tc.File+KEY_SUFFIX, keyFile(*tc.Cert), true); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return purgeFiles(tx, tc.File)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tc.Cert, nil
+}
+
+// PurgeCert destroys the deleted certificate in the trash file for good
+func PurgeCert(file string) (*Cert, error) {
+	tc, err := findTrashed(file)
+	if err != nil {
+		return nil, err
+	}
+	return tc.Cert, storage.Tx(func(tx Storage) error {
+		return purgeFiles(tx, tc.File)
+	})
+}
+
+// purgeTrash destroys the deleted certificates kept for long enough at now
+func purgeTrash(now time.Time) {
+	for _, tc := range trashedCerts() {
+		if now.After(tc.Purge) {
+			if err := storage.Tx(func(tx Storage) error { return purgeFiles(tx, tc.File) }); err != nil {
+				log.Printf("(Warning) Can't purge %s: %s", tc.File, err)
+			}
+		}
+	}
+}
+
+// purgeFiles deletes the certificate and key (if any) files of the trash
+func purgeFiles(tx Storage, file string) error {
+	if err := tx.Delete(file + CERT_SUFFIX); err != nil {
+		return err
+	}
+	if err := tx.Delete(file + KEY_SUFFIX); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// trash allows the admins to restore the deleted certificates or to purge them for good
+func trash(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	if r.Method == "POST" && r.FormValue("file") == "" {
+		days, err := strconv.Atoi(strings.TrimSpace(r.FormValue("TrashDays")))
+		if err != nil || days < 1 {
+			err = fmt.Errorf("%s", ps.tr("Wrong number of days!"))
+		} else {
+			err = LoadConfig().update(func(cfg *config) error {
+				cfg.TrashDays = days
+				return nil
+			})
+			if err == nil {
+				auditRequest(w, r, AUDIT_CONFIG, "trash retention")
+			}
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+		}
+	} else if r.Method == "POST" {
+		file := path.Join(TRASH_DIR, path.Base(r.FormValue("file")))
+		var c *Cert
+		var err error
+		action := AUDIT_RESTORE
+		if r.FormValue("purge") != "" {
+			c, err = PurgeCert(file)
+			action = AUDIT_DELETE
+		} else {
+			c, err = RestoreCert(file)
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+		} else {
+			auditRequest(w, r, action, certObject(c.Crt)+" from the trash")
+			http.Redirect(w, r, "/trash", 302)
+			return
+		}
+	}
+	ps["Trashed"] = TrashedCerts()
+	ps["TrashDays"] = LoadConfig().trashDays()
+	err := templatesFor(r).ExecuteTemplate(w, "trash", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,65 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{}
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "TrashCA"}, ForDays(365))
+	dieOnError(t, err)
+	bin, err := GenCert(ca, "bin", ForDays(30))
+	dieOnError(t, err)
+	if !DeleteCert(FindCert("bin")) || FindCert("bin") != nil {
+		t.Fatal("Certificate not deleted")
+	}
+	trashed := TrashedCerts()
+	if len(trashed) != 1 || trashed[0].Crt.Subject.CommonName != "bin" || trashed[0].Key == nil ||
+		trashed[0].Purge.Sub(trashed[0].Deleted) != TRASH_DAYS*24*time.Hour {
+		t.Fatalf("Unexpected trash %v", trashed)
+	}
+	_, err = RestoreCert(trashed[0].File)
+	dieOnError(t, err)
+	if c := FindCert("bin"); c == nil || c.Key == nil || serialKey(c.Crt.SerialNumber) != serialKey(bin.Crt.SerialNumber) {
+		t.Fatalf("Certificate not restored: %v", c)
+	}
+	if len(TrashedCerts()) != 0 {
+		t.Fatal("Restored certificate still in the trash")
+	}
+
+	dieOnError(t, trashCerts(FindCert("bin")))
+	_, err = GenCert(ca, "bin", ForDays(30))
+	dieOnError(t, err)
+	file := TrashedCerts()[0].File
+	if _, err := RestoreCert(file); err == nil {
+		t.Fatal("Restored over another certificate")
+	}
+	form := url.Values{"file": {path.Base(file)}, "purge": {"1"}}
+	req := httptest.NewRequest("POST", "/trash", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	trash(w, req)
+	if w.Code != http.StatusFound || len(TrashedCerts()) != 0 {
+		t.Fatalf("Not purged: %d %s", w.Code, w.Body)
+	}
+
+	dieOnError(t, trashCerts(FindCert("bin")))
+	purgeTrash(time.Now().AddDate(0, 0, TRASH_DAYS-1))
+	if len(trashedCerts()) != 1 {
+		t.Fatal("Purged before its time")
+	}
+	purgeTrash(time.Now().AddDate(0, 0, TRASH_DAYS+1))
+	if len(trashedCerts()) != 0 {
+		t.Fatal("Not purged after its time")
+	}
+}
@@ -0,0 +1,54 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	CA_BUNDLE_MAX_AGE = 3600 // seconds clients may cache the CA bundle
+)
+
+// CABundle returns the root and intermediate CA certificates managed by this instance
+func CABundle() []*x509.Certificate {
+	crts := make([]*x509.Certificate, 0)
+	for _, c := range Authorities() {
+		crts = append(crts, c.Crt)
+	}
+	return crts
+}
+
+// caBundle serves the CA bundle (unauthenticated) as PEM, concatenated DER or PKCS#7,
+// depending on the requested file extension
+func caBundle(w http.ResponseWriter, r *http.Request) {
+	crts := CABundle()
+	var data []byte
+	var ctype string
+	switch r.URL.Path {
+	case "/ca-bundle.der":
+		for _, crt := range crts {
+			data = append(data, crt.Raw...)
+		}
+		ctype = "application/pkix-cert"
+	case "/ca-bundle.p7b":
+		var err error
+		if data, err = PKCS7(crts); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctype = "application/x-pkcs7-certificates"
+	default:
+		data = pemCerts(crts...)
+		ctype = "application/x-pem-file"
+	}
+	sum := sha256.Sum256(data)
+	w.Header().Set("Content-type", ctype)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(CA_BUNDLE_MAX_AGE))
+	w.Header().Set("ETag", strconv.Quote(hex.EncodeToString(sum[:16])))
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+}
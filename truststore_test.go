@@ -0,0 +1,43 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCABundle(t *testing.T) {
+	inTestDir(t)
+	certree = nil
+	ca, err := GenCACert(pkix.Name{CommonName: "BundleCA"}, ForDays(365))
+	dieOnError(t, err)
+	_, err = GenCert(ca, "leaf.example.com", ForDays(30))
+	dieOnError(t, err)
+	w := httptest.NewRecorder()
+	caBundle(w, httptest.NewRequest("GET", "/ca-bundle.der", nil))
+	crts, err := x509.ParseCertificates(w.Body.Bytes())
+	dieOnError(t, err)
+	if len(crts) != 1 || crts[0].Subject.CommonName != "BundleCA" {
+		t.Fatalf("Unexpected DER bundle contents: %v", crts)
+	}
+	w = httptest.NewRecorder()
+	caBundle(w, httptest.NewRequest("GET", "/ca-bundle.pem", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), pemCerts(ca.Crt)) {
+		t.Fatalf("Unexpected PEM bundle: %d %s", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || !strings.Contains(w.Header().Get("Cache-Control"), "max-age") {
+		t.Fatalf("The bundle is not cacheable: %s", w.Header())
+	}
+	req := httptest.NewRequest("GET", "/ca-bundle.pem", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	caBundle(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("Expected not modified but got %d", w.Code)
+	}
+}
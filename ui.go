@@ -1,14 +1,23 @@
 package webca
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -16,6 +25,8 @@ const (
 	PORTFIX    = 8000
 	REQUEST    = "Request"
 	LOGGEDUSER = "LoggedUser"
+	FORMTIME   = "2006-01-02T15:04" // datetime-local input format
+	FORMDATE   = "2006-01-02"       // date input format
 )
 
 // address is a complex bind address
@@ -30,16 +41,44 @@ var fakedLogin bool
 // portFix contains the port correction when low ports are not permited
 var portFix int
 
-// listenAndServe starts the server with or without TLS on the address
+// listenAndServe starts the server with or without TLS on the address, or with TLS on the sockets
+// passed by systemd when it is socket activated. A proxy in front of it is taken into account
 func (a address) listenAndServe(smux *http.ServeMux) error {
-	if a.tls {
-		return http.ListenAndServeTLS(a.addr, a.certfile, a.keyfile, smux)
+	srv := &http.Server{Addr: a.addr, Handler: behindProxy(logRequests(rateLimit(smux)))}
+	if path, ok := a.socket(); ok {
+		ln, err := listenSocket(path)
+		if err != nil {
+			return err
+		}
+		return serve(srv, func() error { return srv.Serve(ln) })
+	}
+	if !a.tls {
+		return serve(srv, srv.ListenAndServe)
 	}
-	return http.ListenAndServe(a.addr, smux)
+	startRedirect(a) // before asking for the ACME certificate, as it answers the challenges
+	if err := RenewAutocert(time.Now()); err != nil {
+		log.Printf("(Warning) Could not get the web certificate through ACME, serving the self-issued one: %s", err)
+	}
+	// the certificate is hot-swapped when rotated
+	if err := serveWebCert(a.certfile, a.keyfile); err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{GetCertificate: webCertificate, GetConfigForClient: webTLSConfig}
+	lns, err := systemdListeners()
+	if err != nil {
+		return err
+	} else if len(lns) > 0 { // the address is the socket units' then
+		log.Printf("Serving on %d sockets passed by systemd", len(lns))
+		return serve(srv, func() error { return serveListeners(srv, lns) })
+	}
+	return serve(srv, func() error { return srv.ListenAndServeTLS("", "") })
 }
 
 // String prints this address properly
 func (a address) String() string {
+	if _, ok := a.socket(); ok {
+		return a.addr
+	}
 	prefix := "http"
 	if a.tls {
 		prefix = "https"
@@ -62,17 +101,11 @@ var defaultHandler func(w http.ResponseWriter, r *http.Request)
 //	M      Mailer
 type PageStatus map[string]interface{}
 
-// init prepares all web templates before anything else
+// init prepares and localizes all web templates before anything else
 func init() {
-	templates = template.New("webcaTemplates")
-	templates.Funcs(template.FuncMap{
-		// The name "title" is what the function will be called in the template text.
-		"tr": tr, "indexOf": indexOf, "showPeriod": showPeriod, "qEsc": qEsc,
-	})
-	template.Must(templates.Parse(htmlTemplates))
-	template.Must(templates.Parse(jsTemplates))
-	template.Must(templates.Parse(pages))
-	template.Must(templates.ParseFiles("style.css"))
+	if err := useTemplates(template.Must(parseTemplates("")), ""); err != nil {
+		log.Fatalf("(Error) Wrong message catalogs: %s", err)
+	}
 }
 
 // LoadCrt loads variables "Prfx" and "Crt" into PageSetup to point to the right
@@ -86,7 +119,9 @@ func (ps PageStatus) LoadCrt(arg interface{}, prfx string, defaultDuration int)
 	}
 	ps["Crt"] = cs
 	ps["Prfx"] = prfx
-	cs.Duration = defaultDuration
+	if cs.Duration == 0 && cs.NotAfter.IsZero() {
+		cs.Duration = defaultDuration
+	}
 	return ""
 }
 
@@ -97,7 +132,7 @@ func (ps PageStatus) IsSelected(duration int) bool {
 		return false
 	}
 	cs := crt.(*CertSetup)
-	return cs.Duration == duration
+	return cs.Unit != HOURS && cs.Duration == duration
 }
 
 // tr is the app translation function
@@ -116,6 +151,11 @@ func indexOf(sa []string, index int) string {
 	return sa[index]
 }
 
+// intList allows to build integer lists on templates
+func intList(ints ...int) []int {
+	return ints
+}
+
 // qEsc escapes a query string to be laced in the URL
 func qEsc(s string, args ...interface{}) string {
 	return url.QueryEscape(fmt.Sprintf(s, args...))
@@ -123,21 +163,36 @@ func qEsc(s string, args ...interface{}) string {
 
 // WebCA starts the prepares and serves the WebApp
 func WebCA() {
+	if err := LoadOptions(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatalf("(Error) Could not start!: %s", err)
+	}
+	if err := LoadMasterKey(); err != nil {
+		log.Fatalf("(Error) Could not start!: %s", err)
+	}
+	if err := BootstrapSetup(); err != nil {
+		log.Fatalf("(Error) Could not bootstrap the setup!: %s", err)
+	}
 	smux := http.DefaultServeMux
 	addr := PrepareServer(smux)
 	ReapSessions()
+	ScheduleNotifications()
+	ScheduleAutoRenew()
+	ScheduleWebCertRotation()
+	ScheduleBackups()
+	ScheduleKeyPool()
+	StartGRPC(LoadConfig())
 	err := addr.listenAndServe(smux)
-	if portFix == 0 { // port Fixing is only applied once
-		if err != nil {
-			log.Printf("Could not start server on address %v!: %s\n", addr, err)
-		}
-		portFix = PORTFIX
-		addr = fixAddress(addr)
+	if _, socket := addr.socket(); err != nil && portFix == 0 && !socket && !options.explicitPort() { // low ports may not be permitted
+		log.Printf("Could not start server on address %v!: %s\n", addr, err)
+		portFix = options.portFix()
+		addr = serverAddress()
 		log.Printf("(Warning) Failed to listen on standard port, go to %v\n", addr)
 		err = addr.listenAndServe(smux)
 	}
 	if err != nil {
-		log.Fatalf("Could not start!: %s", err)
+		log.Fatalf("(Error) Could not start!: %s", err)
 	}
 }
 
@@ -148,24 +203,25 @@ func webCA() {
 	log.Printf("Go to %v\n", addr)
 	err := addr.listenAndServe(smux)
 	if err != nil {
-		log.Fatalf("Could not start!: %s", err)
+		log.Fatalf("(Error) Could not start!: %s", err)
 	}
 }
 
-// fixAddress returns a repaired alternate address by portFix
-func fixAddress(a address) address {
-	port := 80
-	if strings.Contains(a.addr, ":") {
-		parts := strings.Split(a.addr, ":")
-		a.addr = parts[0]
-		var err error
-		port, err = strconv.Atoi(parts[1])
-		if err != nil {
-			port = 80
-		}
+// serverAddress returns the address the configured app listens on, or the setup wizard's if there
+// is no config yet
+func serverAddress() address {
+	cfg := LoadConfig()
+	if cfg == nil {
+		return address{addr: options.setupAddr(), tls: false}
 	}
-	a.addr = fmt.Sprintf("%s:%v", a.addr, port+portFix)
-	return a
+	if strings.HasPrefix(options.Bind, UNIX_PREFIX) {
+		return address{addr: options.Bind}
+	}
+	listen := webCAURL(cfg)
+	if options.Bind != "" {
+		listen = fmt.Sprintf("%s:%v", options.Bind, options.port()+portFix)
+	}
+	return address{listen, certFile(cfg.getWebCert()), keyFile(cfg.getWebCert()), true}
 }
 
 // prepareServer prepares the Web handlers for the setup wizard if there is no HTTPS config or
@@ -178,46 +234,178 @@ func PrepareServer(smux *http.ServeMux) address {
 	}
 	// otherwise start the normal app
 	log.Printf("Starting WebCA normal startup...")
-	smux.Handle("/", accessControl(index))
-	smux.HandleFunc("/login", login)
-	smux.HandleFunc("/logout", logout)
+	if options.Headless {
+		log.Printf("Headless mode, the HTML UI is disabled")
+		smux.HandleFunc("/", headless)
+	} else {
+		prepareUI(smux)
+	}
+	smux.Handle(API_PREFIX, apiAccess(api))
+	smux.HandleFunc("/ca-bundle.pem", caBundle)
+	smux.HandleFunc("/ca-bundle.der", caBundle)
+	smux.HandleFunc("/ca-bundle.p7b", caBundle)
+	smux.HandleFunc(ACME_PREFIX, acmeHandler)
+	smux.HandleFunc(SCEP_PATH, scep)
+	smux.HandleFunc(SCEP_PATH+"/", scep) // e.g. /scep/pkiclient.exe
+	smux.HandleFunc(VAULT_PREFIX, vaultAPI)
+	smux.HandleFunc(SUBMIT_PATH, submitCertRequest)
+	return serverAddress()
+}
+
+// prepareUI prepares the handlers of the HTML UI
+func prepareUI(smux *http.ServeMux) {
+	smux.Handle("/", csrfControl(accessControl(index)))
+	smux.Handle("/login", csrfControl(http.HandlerFunc(login)))
+	smux.Handle("/logout", csrfControl(http.HandlerFunc(logout)))
+	smux.Handle("/invite", csrfControl(http.HandlerFunc(invite)))
+	smux.Handle(DOWNLOAD_LINK_PATH, csrfControl(http.HandlerFunc(downloadByLink)))
 	smux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir("img"))))
 	smux.Handle("/favicon.ico", http.FileServer(http.Dir("img")))
-	smux.Handle("/cert", accessControl(cert))
-	smux.Handle("/gen", accessControl(gen))
-	smux.Handle("/certControl", accessControl(certControl))
-	smux.Handle("/cert/", authCertServer("/cert/", http.Dir(".")))
-	smux.Handle("/renew", accessControl(renew))
-	smux.Handle("/clone", accessControl(clone))
-	smux.Handle("/del", accessControl(del))
-	return address{webCAURL(cfg), certFile(cfg.getWebCert()), keyFile(cfg.getWebCert()), true}
+	smux.HandleFunc("/language", setLanguage)
+	smux.Handle("/cert", csrfControl(roleControl(ROLE_OPERATOR, cert)))
+	smux.Handle("/gen", csrfControl(roleControl(ROLE_OPERATOR, gen)))
+	smux.Handle("/job", csrfControl(accessControl(jobPage)))
+	smux.Handle("/jobStatus", accessControl(jobStatusPage))
+	smux.Handle("/certControl", csrfControl(accessControl(certControl)))
+	smux.Handle("/certDetails", csrfControl(accessControl(certDetails)))
+	smux.Handle("/cert/", csrfControl(authCertServer("/cert/", storage)))
+	smux.Handle("/renew", csrfControl(roleControl(ROLE_OPERATOR, renew)))
+	smux.Handle("/clone", csrfControl(roleControl(ROLE_OPERATOR, clone)))
+	smux.Handle("/del", csrfControl(roleControl(ROLE_OPERATOR, del)))
+	smux.Handle("/delTree", csrfControl(roleControl(ROLE_ADMIN, delTree)))
+	smux.Handle("/trash", csrfControl(instanceControl(trash)))
+	smux.Handle("/crossSign", csrfControl(roleControl(ROLE_ADMIN, crossSign)))
+	smux.Handle("/profiles", csrfControl(instanceControl(profiles)))
+	smux.Handle("/bulk", csrfControl(roleControl(ROLE_OPERATOR, bulk)))
+	smux.Handle("/bulkZip", csrfControl(accessControl(bulkZip)))
+	smux.Handle("/batch", csrfControl(roleControl(ROLE_OPERATOR, batch)))
+	smux.Handle("/requests", csrfControl(accessControl(certRequests)))
+	smux.Handle("/inbox", csrfControl(accessControl(inboxPage)))
+	smux.Handle("/expiring", csrfControl(accessControl(expiring)))
+	smux.Handle("/notifications", csrfControl(instanceControl(notifications)))
+	smux.Handle("/notifyOptOut", csrfControl(roleControl(ROLE_OPERATOR, notifyOptOut)))
+	smux.Handle("/certNotifications", csrfControl(roleControl(ROLE_OPERATOR, certNotifications)))
+	smux.Handle("/webhooks", csrfControl(instanceControl(webhooks)))
+	smux.Handle("/users", csrfControl(instanceControl(users)))
+	smux.Handle("/organizations", csrfControl(instanceControl(organizations)))
+	smux.Handle("/audit", csrfControl(instanceControl(auditLog)))
+	smux.Handle("/p12", csrfControl(accessControl(p12)))
+	smux.Handle("/p7b", csrfControl(accessControl(p7b)))
+	smux.Handle("/fullchain", csrfControl(accessControl(fullchain)))
+	smux.Handle("/package", csrfControl(accessControl(certPackage)))
+	smux.Handle("/export", csrfControl(accessControl(export)))
+	smux.Handle("/snippets", csrfControl(accessControl(snippets)))
+	smux.Handle("/keyExport", csrfControl(accessControl(keyExport)))
+	smux.Handle("/downloadLinks", csrfControl(accessControl(downloadLinks)))
+	smux.Handle("/settings", csrfControl(accessControl(settings)))
+	smux.Handle("/testMail", csrfControl(instanceControl(testMail)))
+	smux.Handle("/backup", csrfControl(instanceControl(backup)))
+	smux.Handle("/backups", csrfControl(instanceControl(backups)))
+	smux.Handle("/tokens", csrfControl(accessControl(tokens)))
+	smux.Handle("/sessions", csrfControl(accessControl(activeSessionsPage)))
+	smux.Handle("/profile", csrfControl(accessControl(profile)))
+	smux.Handle("/passkeys", csrfControl(accessControl(passkeys)))
+	smux.Handle("/preferences", csrfControl(accessControl(preferences)))
+	smux.Handle("/webauthn/register/begin", csrfControl(accessControl(passkeyRegisterBegin)))
+	smux.Handle("/webauthn/register/finish", csrfControl(accessControl(passkeyRegisterFinish)))
+	smux.Handle("/webauthn/login/begin", csrfControl(http.HandlerFunc(passkeyLoginBegin)))
+	smux.Handle("/webauthn/login/finish", csrfControl(http.HandlerFunc(passkeyLoginFinish)))
+	smux.HandleFunc("/oidc/login", oidcLogin)
+	smux.Handle("/oidc/link", csrfControl(accessControl(oidcLink)))
+	smux.HandleFunc(OIDC_CALLBACK, oidcCallback)
+	smux.Handle("/revoke", csrfControl(roleControl(ROLE_OPERATOR, revoke)))
+	smux.Handle("/kubernetes", csrfControl(roleControl(ROLE_OPERATOR, kubernetes)))
+	smux.Handle("/autoRenew", csrfControl(roleControl(ROLE_OPERATOR, autoRenew)))
+	smux.Handle("/labels", csrfControl(roleControl(ROLE_OPERATOR, labels)))
+	smux.Handle("/delivery", csrfControl(roleControl(ROLE_OPERATOR, delivery)))
+}
+
+// headless answers the requests for the HTML UI when it is disabled, pointing to the API
+func headless(w http.ResponseWriter, r *http.Request) {
+	apiFail(w, http.StatusNotFound, fmt.Errorf("%s", trFor(r, "The HTML UI is disabled, use the API at %s", API_PREFIX)))
 }
 
 // webCAURL returns the WebCA URL
 func webCAURL(cfg *config) string {
 	certName := cfg.getWebCert().Crt.Subject.CommonName
-	return fmt.Sprintf("%s:%v", certName, PORT+portFix)
+	return fmt.Sprintf("%s:%v", certName, options.port()+portFix)
 }
 
 // authCertServer returns a authorized certServer for downloading certificates
-func authCertServer(prefix string, dir http.Dir) http.Handler {
-	return accessControlHandler(http.StripPrefix(prefix, certServer(dir)))
+func authCertServer(prefix string, st Storage) http.Handler {
+	return accessControlHandler(http.StripPrefix(prefix, certServer(st)))
 }
 
 // certServer returns a certificate server filtering the downloadable cert files properly
-func certServer(dir http.Dir) http.Handler {
-	h := http.FileServer(dir)
+func certServer(st Storage) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ext := path.Ext(r.URL.Path); ext == DER_SUFFIX || ext == CRT_SUFFIX {
+			serveDER(w, r, st, strings.TrimSuffix(r.URL.Path, ext)+CERT_SUFFIX)
+			return
+		}
 		if !strings.HasSuffix(r.URL.Path, ".key.pem") && !strings.HasSuffix(r.URL.Path, ".pem") {
 			http.NotFound(w, r)
 			return
 		}
+		if strings.HasSuffix(r.URL.Path, KEY_SUFFIX) && !LoadConfig().plainKeysAllowed() {
+			http.Error(w, tr("Unencrypted private key downloads are disabled!"), http.StatusForbidden)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, KEY_SUFFIX) && !keyAllowed(w, r, keyCertName(r.URL.Path)) {
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, KEY_SUFFIX) {
+			auditRequest(w, r, AUDIT_KEY_DOWNLOAD, strings.TrimSuffix(r.URL.Path, KEY_SUFFIX))
+		}
+		data, err := st.Get(r.URL.Path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, KEY_SUFFIX) {
+			if data, err = plainKey(data); handleError(w, r, err) {
+				return
+			}
+		}
 		w.Header().Set("Content-disposition", "attachment; filename="+r.URL.Path)
 		w.Header().Set("Content-type", "application/x-pem-file")
-		h.ServeHTTP(w, r)
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
 	})
 }
 
+// keyCertName returns the name of the certificate of the stored key file, also of its previous
+// versions
+func keyCertName(keyFile string) string {
+	name := strings.TrimSuffix(keyFile, KEY_SUFFIX)
+	if strings.HasPrefix(name, ARCHIVE_DIR+"/") {
+		name = strings.TrimPrefix(name, ARCHIVE_DIR+"/")
+		name = strings.TrimSuffix(name, path.Ext(name)) // the serial
+	}
+	if c := certByFile(name); c != nil {
+		return c.Crt.Subject.CommonName
+	}
+	return name
+}
+
+// serveDER serves the stored PEM certificate file converted to DER
+func serveDER(w http.ResponseWriter, r *http.Request, st Storage, pemFile string) {
+	if strings.HasSuffix(pemFile, KEY_SUFFIX) {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := st.Get(pemFile)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		http.NotFound(w, r)
+		return
+	}
+	download(w, path.Base(r.URL.Path), "application/pkix-cert", block.Bytes)
+}
+
 // readUser reads the user data from the request
 func readUser(r *http.Request) User {
 	u := User{}
@@ -240,14 +428,45 @@ func readCertSetup(prefix string, r *http.Request) (*CertSetup, error) {
 	cs.Name.OrganizationalUnit[0] = r.FormValue(prefix + ".OrganizationalUnit")
 	cs.Name.Organization[0] = r.FormValue(prefix + ".Organization")
 	cs.Name.Country[0] = r.FormValue(prefix + ".Country")
-	duration, err := strconv.Atoi(r.FormValue(prefix + ".Duration"))
-	if err != nil || duration < 0 {
-		return nil, fmt.Errorf("%s: %v", tr("Wrong duration!"), err)
+	cs.SANs = splitSANs(r.FormValue(prefix + ".SANs"))
+	cs.Unit = DAYS
+	var err error
+	if cs.NotBefore, err = readFormTime(r, prefix+".NotBefore"); err != nil {
+		return nil, err
+	}
+	if cs.NotAfter, err = readFormTime(r, prefix+".NotAfter"); err != nil {
+		return nil, err
+	}
+	if !cs.NotAfter.IsZero() {
+		return &cs, nil
+	}
+	duration := r.FormValue(prefix + ".Duration")
+	if custom := strings.TrimSpace(r.FormValue(prefix + ".Custom")); custom != "" {
+		duration = custom
+		if r.FormValue(prefix+".Unit") == HOURS {
+			cs.Unit = HOURS
+		}
+	}
+	cs.Duration, err = strconv.Atoi(duration)
+	if err != nil || cs.Duration <= 0 {
+		return nil, fmt.Errorf("%s: %v", tr("Wrong duration!"), duration)
 	}
-	cs.Duration = duration
 	return &cs, nil
 }
 
+// readFormTime reads an optional date and time field from the request
+func readFormTime(r *http.Request, field string) (time.Time, error) {
+	value := strings.TrimSpace(r.FormValue(field))
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation(FORMTIME, value, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("%s: %v", tr("Wrong date!"), value)
+	}
+	return t, nil
+}
+
 // readMailer reads the mailer config from the request
 func readMailer(r *http.Request) Mailer {
 	m := Mailer{}
@@ -258,6 +477,9 @@ func readMailer(r *http.Request) Mailer {
 		m.Server += ":" + port
 	}
 	m.Passwd = r.FormValue("M.Password")
+	m.TLS = r.FormValue("M.TLS")
+	m.SkipVerify = r.FormValue("M.SkipVerify") != ""
+	m.Auth = r.FormValue("M.Auth")
 	return m
 }
 
@@ -271,24 +493,38 @@ func index(w http.ResponseWriter, r *http.Request) {
 	if ps == nil {
 		return
 	}
-	ct := ListCerts()
-	ps["CAs"] = ct.roots
-	ps["Others"] = ct.foreign
-	err := templates.ExecuteTemplate(w, "index", ps)
+	f, err := readCertFilter(r)
+	if err != nil {
+		ps["Error"] = err.Error()
+	} else {
+		// searches, explicit pages and big inventories get a paged listing instead of the tree
+		number, size := readPaging(r)
+		page := PageCerts(f, number, size)
+		if !f.IsEmpty() || number > 0 || page.Total > page.Size {
+			ps["Page"] = page
+		}
+	}
+	ps["Filter"] = f
+	local, foreign := ListCerts().Tree()
+	ps["CAs"], ps["Others"] = visibleTree(requestOrg(r), local), visibleTree(requestOrg(r), foreign)
+	ps["Reasons"] = RevocationReasons
+	err = templatesFor(r).ExecuteTemplate(w, "index", ps)
 	handleError(w, r, err)
 }
 
 // setCertPageTexts sets cert's page texts for CA or Certs
 func setCertPageTexts(ps PageStatus, parent string) {
 	if parent != "" {
-		ps["Title"] = tr("New Certificate at %s", parent)
-		ps["CommonName"] = tr("Certificate Name")
-		ps["Action"] = tr("Generate Certificate")
+		ps["Title"] = ps.tr("New Certificate at %s", parent)
+		ps["CommonName"] = ps.tr("Certificate Name")
+		ps["Action"] = ps.tr("Generate Certificate")
+		ps["PlainKeys"] = LoadConfig().plainKeysAllowed()
 	} else {
-		ps["Title"] = tr("New CA")
-		ps["CommonName"] = tr("CA Name")
-		ps["Action"] = tr("Generate CA")
+		ps["Title"] = ps.tr("New CA")
+		ps["CommonName"] = ps.tr("CA Name")
+		ps["Action"] = ps.tr("Generate CA")
 	}
+	ps["KMS"] = kmsChoice{}
 }
 
 // cert allows the web user to generate a new certificate
@@ -298,54 +534,109 @@ func cert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	parent := r.FormValue("parent")
+	if parent == "" && !allowed(w, r, ROLE_ADMIN) { // a new root CA
+		return
+	}
+	name := pkix.Name{}
 	if parent != "" {
 		pc, err := FindCertOrFail(parent)
 		if handleError(w, r, err) {
 			return
 		}
-		pc.Crt.Subject.CommonName = ""
-		ps["parent"] = parent
-		ps["Cert"] = &CertSetup{Name: pc.Crt.Subject}
+		name = copyName(pc.Crt.Subject)
+		name.CommonName = ""
+	}
+	ps["parent"] = parent
+	profile := r.FormValue("profile")
+	ps["Cert"] = &CertSetup{Name: name}
+	if prof := LoadConfig().getProfile(profile); prof != nil {
+		ps["Cert"] = prof.certSetup(name)
 	}
 	setCertPageTexts(ps, parent)
-	err := templates.ExecuteTemplate(w, "cert", ps)
+	setProfiles(ps, profile)
+	err := templatesFor(r).ExecuteTemplate(w, "cert", ps)
 	handleError(w, r, err)
 }
 
+// setProfiles loads the available issuance profiles and the selected one into the page
+func setProfiles(ps PageStatus, selected string) {
+	ps["Profiles"] = LoadConfig().profileNames()
+	ps["ProfileName"] = selected
+}
+
 // gen will generate a certificate with the given request data
 func gen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
 	ps := newLoggedPage(w, r)
 	if ps == nil {
 		return
 	}
 	parent := r.FormValue("parent")
+	if parent == "" && !allowed(w, r, ROLE_ADMIN) { // a new root CA
+		return
+	}
+	profile := r.FormValue("profile")
+	noStoredKey := r.FormValue("NoStoredKey") != ""
+	kms := readKMS(r)
 	cs, err := readCertSetup("Cert", r)
-	handleError(w, r, err)
-	if cs.Name.CommonName == "" {
-		ps["Error"] = tr("Can't create a certificate with no name!")
+	if handleError(w, r, err) {
+		return
+	}
+	period, err := cs.Period()
+	if err == nil && cs.Name.CommonName == "" {
+		err = fmt.Errorf("%s", tr("Can't create a certificate with no name!"))
+	}
+	var pc *Cert
+	if err == nil && parent != "" {
+		pc, err = FindCertOrFail(parent)
+	}
+	if err == nil && noStoredKey && pc == nil {
+		err = fmt.Errorf("%s", tr("The key of a root CA must be stored!"))
+	}
+	var j *Job
+	if err == nil {
+		prof := LoadConfig().getProfile(profile)
+		org, user, addr := requestOrg(r), requestUser(w, r).Username, remoteAddr(r)
+		j, err = enqueueJob(user, cs.Name.CommonName, noStoredKey, func() (c *Cert, err error) {
+			if noStoredKey {
+				var once crypto.Signer
+				if c, once, err = IssueCertOnce(pc, cs.Name, period, prof, cs.SANs...); err == nil {
+					c.Key = once // only in memory, for the download
+				}
+			} else {
+				var key crypto.Signer
+				if key, err = kms.signer(); err == nil {
+					c, err = issueCert(pc, cs.Name, period, prof, key, cs.SANs...)
+				}
+			}
+			if err == nil && pc == nil {
+				err = LoadConfig().assignCA(org, c.Crt.Subject.CommonName)
+			}
+			if err == nil {
+				err = LoadConfig().setOwner(c.Crt.Subject.CommonName, user)
+			}
+			if err == nil {
+				audit(AUDIT_ISSUE, user, addr, certObject(c.Crt))
+			}
+			return c, err
+		})
+	}
+	if err != nil {
+		ps["Error"] = err.Error()
 		ps["Cert"] = cs
 		ps["parent"] = parent
 		setCertPageTexts(ps, parent)
-		err := templates.ExecuteTemplate(w, "cert", ps)
+		ps["KMS"] = kms
+		ps["NoStoredKey"] = noStoredKey
+		setProfiles(ps, profile)
+		err := templatesFor(r).ExecuteTemplate(w, "cert", ps)
 		handleError(w, r, err)
 		return
 	}
-	if parent != "" {
-		cacert := FindCert(parent)
-		if handleError(w, r, err) {
-			return
-		}
-		_, err = GenCert(cacert, cs.Name.CommonName, cs.Duration)
-		if handleError(w, r, err) {
-			return
-		}
-	} else {
-		_, err := GenCACert(cs.Name, cs.Duration)
-		if handleError(w, r, err) {
-			return
-		}
-	}
-	http.Redirect(w, r, "/", 302)
+	http.Redirect(w, r, "/job?id="+j.ID, 302)
 }
 
 // certControl allows the web user to manage a certificate
@@ -360,31 +651,127 @@ func certControl(w http.ResponseWriter, r *http.Request) {
 		if handleError(w, r, err) {
 			return
 		}
-		ps["Cert"] = c
+		setCertControl(ps, c)
 	}
-	err := templates.ExecuteTemplate(w, "certControl", ps)
+	err := templatesFor(r).ExecuteTemplate(w, "certControl", ps)
 	handleError(w, r, err)
 }
 
-// renew the certificate requested
+// setCertControl loads the certificate c and its related certificates into the certControl page
+func setCertControl(ps PageStatus, c *Cert) {
+	ps["Cert"] = c
+	ps["Previous"] = PreviousCerts(c)
+	n := LoadConfig().getNotifications()
+	ps["OptOut"] = n.OptOut[c.Crt.Subject.CommonName]
+	ps["CertNotify"] = n.PerCert[c.Crt.Subject.CommonName]
+	ps["NotifyRecipients"] = LoadConfig().certRecipients(c)
+	ps["NotifyDays"] = n.certDays(c)
+	ps["PlainKeys"] = LoadConfig().plainKeysAllowed()
+	u, _ := ps[LOGGEDUSER].(User)
+	ps["KeyOwner"] = currentUser(u).ownsKey(c.Crt.Subject.CommonName)
+	rv := Revoked(c)
+	ps["Revoked"] = rv
+	ps["Revocable"] = rv == nil || rv.OnHold()
+	reasons := make([]RevocationReason, 0)
+	for _, reason := range RevocationReasons {
+		if rv == nil || reason.Code != REASON_HOLD {
+			reasons = append(reasons, reason)
+		}
+	}
+	ps["Reasons"] = reasons
+	ps["AutoRenew"] = LoadConfig().AutoRenew[c.Crt.Subject.CommonName]
+	ps["Labels"] = LoadConfig().certLabels(c.Crt.Subject.CommonName)
+	ps["AutoRenewDays"] = LoadConfig().autoRenewDays()
+	ps["Renewal"] = LastRenewal(c.Crt.Subject.CommonName)
+	ps["SCTs"] = SCTs(c)
+	if k := LoadConfig().Kubernetes; k != nil && c.Key != nil {
+		ps["Kubernetes"] = true
+		ps["Secret"] = k.Secrets[c.Crt.Subject.CommonName]
+	}
+	if c.Key != nil {
+		ps["Deliveries"] = Deliveries(c.Crt.Subject.CommonName)
+	}
+	if c.Crt.IsCA {
+		ps["Crosses"] = CrossCerts(c)
+	}
+}
+
+// crossSign allows the web user to cross-sign a CA with another CA
+func crossSign(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	if signer := r.FormValue("signer"); signer != "" && r.Method == "POST" {
+		s, err := FindCertOrFail(signer)
+		if handleError(w, r, err) {
+			return
+		}
+		cs, err := readCertSetup("Cert", r)
+		if handleError(w, r, err) {
+			return
+		}
+		period, err := cs.Period()
+		var crt *x509.Certificate
+		if err == nil {
+			crt, err = CrossSign(c, s, period)
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_CROSS, certObject(crt))
+			http.Redirect(w, r, "/certControl?cert="+url.QueryEscape(c.Crt.Subject.CommonName), 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	signers := make([]*Cert, 0)
+	for _, ca := range visibleCerts(requestOrg(r), Authorities()) {
+		if ca.Crt.Subject.CommonName != c.Crt.Subject.CommonName {
+			signers = append(signers, ca)
+		}
+	}
+	ps["Cert"] = c
+	ps["Signers"] = signers
+	ps["Validity"] = &CertSetup{}
+	err = templatesFor(r).ExecuteTemplate(w, "crossSign", ps)
+	handleError(w, r, err)
+}
+
+// renew the certificate requested, once the user has reviewed and confirmed the changes
 func renew(w http.ResponseWriter, r *http.Request) {
 	ps := newLoggedPage(w, r)
 	if ps == nil {
 		return
 	}
 	cert := r.FormValue("cert")
+	rekey := r.FormValue("rekey") != ""
 	if cert != "" {
 		c, err := FindCertOrFail(cert)
 		if handleError(w, r, err) {
 			return
 		}
-		c, err = RenewCert(c)
+		if c.Crt.IsCA && !allowed(w, r, ROLE_ADMIN) {
+			return
+		}
+		if r.FormValue("confirm") == "" || r.Method != "POST" {
+			ps["Cert"] = c
+			ps["Rekey"] = rekey
+			ps["Changes"] = certChanges(c.Crt, RenewTemplate(c, rekey))
+			err := templatesFor(r).ExecuteTemplate(w, "renew", ps)
+			handleError(w, r, err)
+			return
+		}
+		c, err = RenewCert(c, rekey)
 		if handleError(w, r, err) {
 			return
 		}
-		ps["Cert"] = c
+		auditRequest(w, r, AUDIT_RENEW, certObject(c.Crt))
+		setCertControl(ps, c)
 	}
-	err := templates.ExecuteTemplate(w, "certControl", ps)
+	err := templatesFor(r).ExecuteTemplate(w, "certControl", ps)
 	handleError(w, r, err)
 }
 
@@ -406,7 +793,7 @@ func clone(w http.ResponseWriter, r *http.Request) {
 		ps["parent"] = c.Parent.Crt.Subject.CommonName
 		ps["Cert"] = &CertSetup{Name: c.Crt.Subject}
 		setCertPageTexts(ps, c.Parent.Crt.Subject.CommonName)
-		err = templates.ExecuteTemplate(w, "cert", ps)
+		err = templatesFor(r).ExecuteTemplate(w, "cert", ps)
 	} else {
 		err = fmt.Errorf("%s", tr("Nothing to clone!"))
 	}
@@ -415,6 +802,10 @@ func clone(w http.ResponseWriter, r *http.Request) {
 
 // del will try to remove the requested certificate if possible
 func del(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
 	ps := newLoggedPage(w, r)
 	if ps == nil {
 		return
@@ -426,9 +817,14 @@ func del(w http.ResponseWriter, r *http.Request) {
 		if handleError(w, r, err) {
 			return
 		}
+		if c.Crt.IsCA && !allowed(w, r, ROLE_ADMIN) {
+			return
+		}
 		ps["Cert"] = c
 		if c.Childs == nil || len(c.Childs) == 0 {
-			DeleteCert(c)
+			if DeleteCert(c) {
+				auditRequest(w, r, AUDIT_DELETE, certObject(c.Crt))
+			}
 			index(w, r)
 			return
 		} else if c.Crt.IsCA {
@@ -436,7 +832,39 @@ func del(w http.ResponseWriter, r *http.Request) {
 			ps["Childs"] = c.Childs
 		}
 	}
-	err = templates.ExecuteTemplate(w, "certControl", ps)
+	err = templatesFor(r).ExecuteTemplate(w, "certControl", ps)
+	handleError(w, r, err)
+}
+
+// delTree allows the web user to delete a CA with all the certificates below it, once its name
+// is typed to confirm it
+func delTree(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	if r.Method == "POST" {
+		if r.FormValue("confirm") != name {
+			ps["Error"] = ps.tr("Type %s to confirm the deletion!", name)
+		} else {
+			deleted, err := DeleteTree(c)
+			if handleError(w, r, err) {
+				return
+			}
+			auditRequest(w, r, AUDIT_DELETE, fmt.Sprintf("%s and the %d certificates below", certObject(c.Crt),
+				len(deleted)-1))
+			http.Redirect(w, r, "/", 302)
+			return
+		}
+	}
+	ps["Cert"] = c
+	ps["Tree"] = Subtree(c)
+	err = templatesFor(r).ExecuteTemplate(w, "delTree", ps)
 	handleError(w, r, err)
 }
 
@@ -448,6 +876,9 @@ func newLoggedPage(w http.ResponseWriter, r *http.Request) PageStatus {
 	}
 	ps := newPageStatus(r)
 	ps[LOGGEDUSER] = s[LOGGEDUSER]
+	if u, ok := s[LOGGEDUSER].(User); ok {
+		usePreferences(w, r, currentUser(u))
+	}
 	return ps
 }
 
@@ -463,53 +894,121 @@ func accessControlHandler(h http.Handler) http.Handler {
 		if handleError(w, r, err) {
 			return
 		}
+		if u, ok := s[LOGGEDUSER].(User); ok && !fakedLogin && !LoadConfig().activeUser(u.Username) {
+			delete(s, LOGGEDUSER) // deleted or disabled since the login
+			s.Save()
+		}
 		if s[LOGGEDUSER] == nil {
 			if fakedLogin {
-				s[LOGGEDUSER] = User{"fuser", "Faked User", "****", "fuser@fuser.com"}
+				s[LOGGEDUSER] = User{Username: "fuser", Fullname: "Faked User", Password: "****",
+					Email: "fuser@fuser.com", Role: ROLE_ADMIN}
 				s.Save()
 				h.ServeHTTP(w, r)
 				return
 			}
+			if rememberLogin(w, r, s) || certLogin(w, r, s) {
+				serveOrg(h, w, r)
+				return
+			}
 			ps := newPageStatus(r)
 			ps[SESSIONID] = s.Id()
-			err := templates.ExecuteTemplate(w, "login", ps)
+			err := templatesFor(r).ExecuteTemplate(w, "login", ps)
 			handleError(w, r, err)
 			return
 		}
-		h.ServeHTTP(w, r)
+		serveOrg(h, w, r)
 	})
 }
 
-// login handles login action
+// login handles login action, and shows the login page on a GET
 func login(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		ps := newPageStatus(r)
+		err := templatesFor(r).ExecuteTemplate(w, "login", ps)
+		handleError(w, r, err)
+		return
+	}
 	Username := r.FormValue("Username")
-	Password := crypt(r.FormValue("Password"))
+	Password := r.FormValue("Password")
 	cfg := LoadConfig()
+	addr := remoteAddr(r)
+	if lockedOut(Username, addr, time.Now()) {
+		audit(AUDIT_LOCKED_OUT, Username, addr, "")
+		ps := newPageStatus(r)
+		ps["Error"] = ps.tr("Too many failed logins, try again later")
+		w.WriteHeader(http.StatusTooManyRequests)
+		err := templatesFor(r).ExecuteTemplate(w, "login", ps)
+		handleError(w, r, err)
+		return
+	}
 	u := cfg.getUser(Username)
-	if u.Password != Password {
+	if u.Username == "" || u.Disabled || !checkPassword(u.Password, Password) {
+		audit(AUDIT_LOGIN_FAILED, Username, addr, "")
+		cfg.loginLimits().loginFailed(Username, addr, time.Now())
 		ps := newPageStatus(r)
-		ps["Error"] = tr("Access Denied")
-		err := templates.ExecuteTemplate(w, "login", ps)
+		ps["Error"] = ps.tr("Access Denied")
+		err := templatesFor(r).ExecuteTemplate(w, "login", ps)
 		handleError(w, r, err)
 		return
 	} else {
+		loginSucceeded(Username)
 		s, err := SessionFor(w, r)
 		if handleError(w, r, err) {
 			return
 		}
-		s[LOGGEDUSER] = u
-		s.Save()
+		u = cfg.upgradePassword(u, Password)
 		targetUrl := r.FormValue("URL")
 		if targetUrl == "" {
 			targetUrl = "/"
 		}
+		remember := r.FormValue("Remember") != ""
+		if u.SecondFactor && len(u.Passkeys) > 0 {
+			s[PENDINGUSER] = u.Username
+			s[PENDINGREMEMBER] = remember
+			if handleError(w, r, s.Renew(w, r)) {
+				return
+			}
+			ps := newPageStatus(r)
+			ps["URL"] = targetUrl
+			err = templatesFor(r).ExecuteTemplate(w, "passkey", ps)
+			handleError(w, r, err)
+			return
+		}
+		if err := admitLogin(u.Username, s.Id(), addr); err != nil {
+			audit(AUDIT_LOGIN_FAILED, Username, addr, err.Error())
+			ps := newPageStatus(r)
+			ps["Error"] = err.Error()
+			w.WriteHeader(http.StatusForbidden)
+			err = templatesFor(r).ExecuteTemplate(w, "login", ps)
+			handleError(w, r, err)
+			return
+		}
+		audit(AUDIT_LOGIN, Username, addr, "")
+		s[LOGGEDUSER] = u
+		if handleError(w, r, s.Renew(w, r)) {
+			return
+		}
+		if remember {
+			if err := cfg.remember(w, r, u.Username); err != nil {
+				log.Printf("(Warning) Could not remember the device of %s: %s", u.Username, err)
+			}
+		}
 		http.Redirect(w, r, targetUrl, 302)
 	}
 }
 
+// logout destroys the session, expiring its cookie, and goes back to the login page
 func logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	if u := requestUser(w, r); u != nil {
+		audit(AUDIT_LOGOUT, u.Username, remoteAddr(r), "")
+	}
+	LoadConfig().forget(w, r)
 	RemoveSession(w, r)
-	http.Redirect(w, r, "/", 302)
+	http.Redirect(w, r, "/login", http.StatusFound)
 }
 
 // newPageStatus generates a new PageStatus including the Request
@@ -530,14 +1029,14 @@ func FindCertOrFail(certname string) (*Cert, error) {
 	if cert != nil {
 		return cert, nil
 	}
-	return nil, fmt.Errorf(tr("%v certificate not found!", cert))
+	return nil, fmt.Errorf("%s", tr("%v certificate not found!", certname))
 }
 
-// handleError displays err (if not nil) on Stderr and (if possible) displays a web error page
+// handleError logs err (if not nil) and (if possible) displays a web error page
 // it also returns true if the error was found and handled and false if err was nil
 func handleError(w http.ResponseWriter, r *http.Request, err error) bool {
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
+		log.Printf("(Error) %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return true
 	}
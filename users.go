@@ -0,0 +1,276 @@
+package webca
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// validUsername restricts the usernames to what is safe in URLs and logs
+var validUsername = regexp.MustCompile(`^[a-zA-Z0-9._@-]+$`)
+
+// UserInfo is the JSON representation of a user on the API
+type UserInfo struct {
+	Username string `json:"username"`
+	Fullname string `json:"fullname"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+	Org      string `json:"org,omitempty"` // every organization if empty
+}
+
+// UserRequest asks the API to create or update a user
+type UserRequest struct {
+	UserInfo
+	Password string `json:"password"` // kept if empty on updates
+}
+
+// newUserInfo returns the API representation of u, without its password
+func newUserInfo(u User) UserInfo {
+	return UserInfo{Username: u.Username, Fullname: u.Fullname, Email: u.Email, Role: u.role(),
+		Disabled: u.Disabled, Org: u.Org}
+}
+
+// activeUser tells whether or not the named user exists and is enabled
+func (cfg *config) activeUser(username string) bool {
+	if cfg == nil {
+		return false
+	}
+	u, ok := cfg.Users[username]
+	return ok && !u.Disabled
+}
+
+// userList returns the users sorted by username, with their effective role
+func (cfg *config) userList() []User {
+	list := make([]User, 0, len(cfg.Users))
+	for _, u := range cfg.Users {
+		u.Role = u.role()
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// keepsAdmin tells whether or not an enabled admin of the whole WebCA is left once the named user
+// is replaced by u (or deleted if u is nil)
+func (cfg *config) keepsAdmin(username string, u *User) bool {
+	if u != nil && !u.Disabled && u.instanceAdmin() {
+		return true
+	}
+	for name, other := range cfg.Users {
+		if name != username && !other.Disabled && other.instanceAdmin() {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveUser creates (if create is set) or updates the user. u.Password is the new password in
+// clear, an update keeps the current one if it is empty
+func (cfg *config) SaveUser(u User, create bool) error {
+	u.Username = strings.TrimSpace(u.Username)
+	if !validUsername.MatchString(u.Username) {
+		return fmt.Errorf("%s: %v", tr("Wrong username!"), u.Username)
+	}
+	if roleRank(u.Role) == 0 {
+		return fmt.Errorf("%s: %v", tr("Wrong role!"), u.Role)
+	}
+	if u.Org != "" && cfg.findOrg(u.Org) == nil {
+		return fmt.Errorf("%s", tr("Organization %s not found!", u.Org))
+	}
+	current, exists := cfg.Users[u.Username]
+	if create && exists {
+		return fmt.Errorf("%s", tr("User %s already exists!", u.Username))
+	}
+	if !create && !exists {
+		return fmt.Errorf("%s", tr("User %s not found!", u.Username))
+	}
+	if !create { // the preferences are only changed by the user
+		u.Lang, u.Timezone = current.Lang, current.Timezone
+	}
+	if u.Password == "" {
+		if create {
+			return fmt.Errorf("%s", tr("The password is required!"))
+		}
+		u.Password = current.Password
+	} else {
+		if err := cfg.passwordPolicy().check(u.Username, u.Password); err != nil {
+			return err
+		}
+		hash, err := hashPassword(u.Password)
+		if err != nil {
+			return err
+		}
+		u.Password = hash
+	}
+	return cfg.update(func(cfg *config) error {
+		if !cfg.keepsAdmin(u.Username, &u) {
+			return fmt.Errorf("%s", tr("There must be at least one enabled admin!"))
+		}
+		users := copyUsers(cfg.Users)
+		users[u.Username] = u
+		cfg.Users = users
+		return nil
+	})
+}
+
+// DeleteUser removes the named user along with their API tokens
+func (cfg *config) DeleteUser(username string) error {
+	return cfg.update(func(cfg *config) error {
+		if _, ok := cfg.Users[username]; !ok {
+			return fmt.Errorf("%s", tr("User %s not found!", username))
+		}
+		if !cfg.keepsAdmin(username, nil) {
+			return fmt.Errorf("%s", tr("There must be at least one enabled admin!"))
+		}
+		users := copyUsers(cfg.Users)
+		delete(users, username)
+		cfg.Users = users
+		tokens := make([]APIToken, 0)
+		for _, t := range cfg.APITokens {
+			if t.Username != username {
+				tokens = append(tokens, t)
+			}
+		}
+		cfg.APITokens = tokens
+		return nil
+	})
+}
+
+// copyUsers returns a copy of the users, to change and replace them in a config update
+func copyUsers(users map[string]User) map[string]User {
+	copied := make(map[string]User, len(users)+1)
+	for name, u := range users {
+		copied[name] = u
+	}
+	return copied
+}
+
+// selfLockout fails if the logged user (me) would delete or disable their own account
+func selfLockout(me *User, username string, removed bool) error {
+	if removed && me != nil && me.Username == username {
+		return fmt.Errorf("%s", tr("You cannot delete or disable yourself!"))
+	}
+	return nil
+}
+
+// users allows the admins to create, edit, disable, delete and invite the web users
+func users(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	me := requestUser(w, r)
+	if r.Method == "POST" {
+		name, action := r.FormValue("Username"), r.FormValue("action")
+		object := "user " + name + " " + action
+		var err error
+		switch action {
+		case "delete":
+			if err = selfLockout(me, name, true); err == nil {
+				err = cfg.DeleteUser(name)
+			}
+		case "invite":
+			object = "invitation " + r.FormValue("Email") + " " + r.FormValue("Role")
+			err = cfg.Invite(r.FormValue("Email"), r.FormValue("Role"), me.Username, webBase(r))
+		case "deleteInvite":
+			object = "invitation " + r.FormValue("id") + " delete"
+			err = cfg.DeleteInvitation(r.FormValue("id"))
+		case "disable", "enable":
+			u, ok := cfg.Users[name]
+			if !ok {
+				err = fmt.Errorf("%s", tr("User %s not found!", name))
+			} else if err = selfLockout(me, name, action == "disable"); err == nil {
+				u.Role, u.Password, u.Disabled = u.role(), "", action == "disable"
+				err = cfg.SaveUser(u, false)
+			}
+		default:
+			u := readUser(r)
+			u.Role, u.Org = r.FormValue("Role"), r.FormValue("Org")
+			u.Disabled = r.FormValue("Disabled") != ""
+			object = strings.TrimSpace("user " + u.Username + " " + action + " " + u.Role)
+			if err = selfLockout(me, u.Username, u.Disabled); err == nil {
+				err = cfg.SaveUser(u, action == "create")
+			}
+			if err != nil && action != "create" {
+				ps["Edit"] = u
+			}
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_CONFIG, object)
+			http.Redirect(w, r, "/users", 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	if u, ok := cfg.Users[r.FormValue("edit")]; ok && ps["Edit"] == nil {
+		u.Role = u.role()
+		ps["Edit"] = u
+	}
+	ps["Users"] = cfg.userList()
+	ps["Invitations"] = cfg.pendingInvitations()
+	ps["InviteDays"] = INVITE_DAYS
+	ps["Roles"] = Roles
+	ps["Organizations"] = cfg.Organizations
+	ps["Policy"] = cfg.passwordPolicy()
+	err := templatesFor(r).ExecuteTemplate(w, "users", ps)
+	handleError(w, r, err)
+}
+
+// apiUsers handles the users API calls of the admins
+func apiUsers(w http.ResponseWriter, r *http.Request, route string, username string) {
+	cfg := LoadConfig()
+	u, exists := cfg.Users[username]
+	if strings.HasSuffix(route, "/*") && !exists {
+		apiFail(w, http.StatusNotFound, fmt.Errorf("%s", tr("User %s not found!", username)))
+		return
+	}
+	switch route {
+	case "GET users":
+		list := make([]UserInfo, 0)
+		for _, u := range cfg.userList() {
+			list = append(list, newUserInfo(u))
+		}
+		apiReply(w, http.StatusOK, list)
+	case "GET users/*":
+		apiReply(w, http.StatusOK, newUserInfo(u))
+	case "DELETE users/*":
+		err := selfLockout(requestUser(w, r), username, true)
+		if err == nil {
+			err = cfg.DeleteUser(username)
+		}
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		auditRequest(w, r, AUDIT_CONFIG, "user "+username+" delete")
+		w.WriteHeader(http.StatusNoContent)
+	default: // POST users, PUT users/*
+		status, create := http.StatusOK, route == "POST users"
+		req := UserRequest{UserInfo: newUserInfo(u)}
+		if create {
+			status, req = http.StatusCreated, UserRequest{UserInfo: UserInfo{Role: ROLE_VIEWER}}
+		}
+		if err := apiRead(r, &req); err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		if !create {
+			req.Username = username
+		}
+		err := selfLockout(requestUser(w, r), req.Username, req.Disabled)
+		if err == nil {
+			err = cfg.SaveUser(User{Username: req.Username, Fullname: req.Fullname, Email: req.Email,
+				Password: req.Password, Role: req.Role, Disabled: req.Disabled, Org: req.Org}, create)
+		}
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		auditRequest(w, r, AUDIT_CONFIG, "user "+req.Username+" "+strings.ToLower(r.Method)+" "+req.Role)
+		apiReply(w, status, newUserInfo(cfg.Users[req.Username]))
+	}
+}
@@ -0,0 +1,86 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUsers(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Password: "legacy"}}}
+	if !checkPassword("legacy", "legacy") || checkPassword("", "") {
+		t.Fatal("Clear text passwords from before hashing are not checked")
+	}
+	hash, err := hashPassword("s3cret")
+	dieOnError(t, err)
+	if !strings.HasPrefix(hash, "$"+PASSWORD_SCHEME+"$") || !checkPassword(hash, "s3cret") || checkPassword(hash, "wrong") {
+		t.Fatalf("Wrong password hash %s", hash)
+	}
+	token, err := cachedCfg.NewAPIToken("boss", "test")
+	dieOnError(t, err)
+	call := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		apiAccess(api).ServeHTTP(w, req)
+		return w
+	}
+	w := call("POST", "/api/v1/users", `{"username":"alice","fullname":"Alice","password":"Corr3ct-horse"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Could not create a user: %d %s", w.Code, w.Body)
+	}
+	alice := cachedCfg.Users["alice"]
+	if alice.Role != ROLE_VIEWER || alice.Password == "Corr3ct-horse" || !checkPassword(alice.Password, "Corr3ct-horse") {
+		t.Fatalf("Wrong new user %+v", alice)
+	}
+	if w = call("DELETE", "/api/v1/users/boss", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("The last admin could be deleted: %d", w.Code)
+	}
+	if w = call("PUT", "/api/v1/users/boss", `{"disabled":true}`); w.Code != http.StatusBadRequest {
+		t.Errorf("The admin could disable themselves: %d", w.Code)
+	}
+	if w = call("PUT", "/api/v1/users/alice", `{"role":"operator","disabled":true}`); w.Code != http.StatusOK {
+		t.Fatalf("Could not update a user: %d %s", w.Code, w.Body)
+	}
+	if u := cachedCfg.Users["alice"]; u.Role != ROLE_OPERATOR || !u.Disabled || u.Password != alice.Password {
+		t.Fatalf("Wrong updated user %+v", u)
+	}
+	logIn := func(username, password string) int {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader("Username="+username+"&Password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		http.HandlerFunc(login).ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := logIn("alice", "Corr3ct-horse"); code == http.StatusFound {
+		t.Error("A disabled user could log in")
+	}
+	if code := logIn("nobody", ""); code == http.StatusFound {
+		t.Error("An unknown user could log in")
+	}
+	if code := logIn("boss", "legacy"); code != http.StatusFound {
+		t.Errorf("The admin could not log in: %d", code)
+	}
+	aliceToken, err := cachedCfg.NewAPIToken("alice", "test")
+	dieOnError(t, err)
+	if cachedCfg.tokenUser(aliceToken) != nil {
+		t.Error("A disabled user token is valid")
+	}
+	bossToken := token
+	token = aliceToken
+	if w = call("GET", "/api/v1/users", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("A disabled user could use the API: %d", w.Code)
+	}
+	token = bossToken
+	if w = call("DELETE", "/api/v1/users/alice", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Could not delete a user: %d %s", w.Code, w.Body)
+	}
+	if _, ok := cachedCfg.Users["alice"]; ok || len(cachedCfg.userTokens("alice")) > 0 {
+		t.Error("The deleted user or their tokens are still there")
+	}
+}
@@ -0,0 +1,291 @@
+package webca
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VAULT_PREFIX       = "/v1/"
+	VAULT_MOUNT        = "pki"
+	VAULT_DEFAULT_ROLE = "default"
+	VAULT_DEFAULT_TTL  = 30 * 24 * time.Hour
+)
+
+// Vault configures the HashiCorp Vault PKI engine compatible API
+type Vault struct {
+	Mount string // path the engine is mounted at, VAULT_MOUNT if empty
+	CA    string // name of the CA issuing the certificates
+}
+
+// vaultRequest holds the issue and sign parameters, roles are the issuance profiles
+type vaultRequest struct {
+	CommonName string      `json:"common_name"`
+	AltNames   string      `json:"alt_names"` // comma separated
+	IPSANs     string      `json:"ip_sans"`
+	URISANs    string      `json:"uri_sans"`
+	TTL        interface{} `json:"ttl"` // seconds or duration string
+	Format     string      `json:"format"`
+	CSR        string      `json:"csr"`
+}
+
+// vaultAPI serves the Vault PKI engine issue, sign, ca and crl paths under VAULT_PREFIX, the API
+// tokens are accepted as Vault tokens
+func vaultAPI(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.Vault == nil {
+		vaultFail(w, http.StatusNotFound, fmt.Errorf("no handler for route"))
+		return
+	}
+	mount := cfg.Vault.Mount
+	if mount == "" {
+		mount = VAULT_MOUNT
+	}
+	path := strings.TrimPrefix(r.URL.Path, VAULT_PREFIX)
+	if !strings.HasPrefix(path, mount+"/") {
+		vaultFail(w, http.StatusNotFound, fmt.Errorf("no handler for route %q", path))
+		return
+	}
+	ca, err := findIssuer(cfg.Vault.CA)
+	if err != nil {
+		vaultFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	path = strings.TrimPrefix(path, mount+"/")
+	switch path {
+	case "ca", "ca/pem", "ca_chain", "cert/ca_chain":
+		if path == "ca" {
+			w.Header().Set("Content-type", "application/pkix-cert")
+			w.Write(ca.Crt.Raw)
+			return
+		}
+		crts := []*x509.Certificate{ca.Crt}
+		if path != "ca/pem" {
+			crts = append(crts, Chain(ca)...)
+		}
+		w.Header().Set("Content-type", "application/pem-certificate-chain")
+		w.Write(pemCerts(crts...))
+		return
+	case "crl", "crl/pem":
+		data, err := CRL(ca)
+		if err != nil {
+			vaultFail(w, http.StatusInternalServerError, err)
+			return
+		}
+		if path == "crl" {
+			w.Header().Set("Content-type", "application/pkix-crl")
+		} else {
+			w.Header().Set("Content-type", "application/x-pem-file")
+			data = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: data})
+		}
+		w.Write(data)
+		return
+	}
+	if r.Method != "POST" && r.Method != "PUT" {
+		vaultFail(w, http.StatusMethodNotAllowed, fmt.Errorf("unsupported operation"))
+		return
+	}
+	token := r.Header.Get("X-Vault-Token")
+	if token == "" {
+		token = bearerToken(r)
+	}
+	u := cfg.tokenUser(token)
+	if u == nil || !u.can(ROLE_OPERATOR) {
+		vaultFail(w, http.StatusForbidden, fmt.Errorf("permission denied"))
+		return
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || (parts[0] != "issue" && parts[0] != "sign") {
+		vaultFail(w, http.StatusNotFound, fmt.Errorf("no handler for route %q", path))
+		return
+	}
+	var req vaultRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, API_MAX_BODY)).Decode(&req); err != nil {
+		vaultFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Format != "" && req.Format != "pem" && req.Format != "der" {
+		vaultFail(w, http.StatusBadRequest, fmt.Errorf("unsupported format: %s", req.Format))
+		return
+	}
+	var data map[string]interface{}
+	if parts[0] == "issue" {
+		data, err = vaultIssue(cfg, ca, parts[1], req)
+	} else {
+		data, err = vaultSign(cfg, ca, parts[1], req)
+	}
+	if err == nil && parts[0] == "issue" {
+		err = cfg.setOwner(strings.TrimSpace(req.CommonName), u.Username)
+	}
+	if err != nil {
+		vaultFail(w, http.StatusBadRequest, err)
+		return
+	}
+	audit(AUDIT_ISSUE, u.Username, remoteAddr(r), strings.TrimSpace(fmt.Sprintf("vault %s %s %s", parts[0],
+		data["serial_number"], req.CommonName)))
+	id, _ := genId()
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_id": id, "lease_id": "", "renewable": false, "lease_duration": 0,
+		"data": data, "wrap_info": nil, "warnings": nil, "auth": nil,
+	})
+}
+
+// vaultIssue generates a key pair and certificate for the request
+func vaultIssue(cfg *config, ca *Cert, role string, req vaultRequest) (map[string]interface{}, error) {
+	if !cfg.plainKeysAllowed() {
+		return nil, fmt.Errorf("%s", tr("Unencrypted private key downloads are disabled!"))
+	}
+	req.CommonName = strings.TrimSpace(req.CommonName)
+	if req.CommonName == "" {
+		return nil, fmt.Errorf("the common_name field is required")
+	}
+	prof, period, err := vaultRole(cfg, role, req.TTL)
+	if err != nil {
+		return nil, err
+	}
+	sans := make([]string, 0)
+	for _, list := range []string{req.AltNames, req.IPSANs, req.URISANs} {
+		for _, san := range strings.Split(list, ",") {
+			if san = strings.TrimSpace(san); san != "" {
+				sans = append(sans, san)
+			}
+		}
+	}
+	old, err := replaceable(ca, req.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil { // the new files replace the current ones, kept until then
+		if err := archiveCert(old); err != nil {
+			return nil, err
+		}
+	}
+	name := copyName(ca.Crt.Subject)
+	name.CommonName = req.CommonName
+	c, err := IssueCert(ca, name, period, prof, sans...)
+	if err != nil {
+		return nil, err
+	}
+	data := vaultCertData(c, req.Format)
+	block, err := marshalKey(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	data["private_key"] = string(pem.EncodeToMemory(block))
+	data["private_key_type"] = "rsa"
+	if keyType(c.Key.Public()) != RSA {
+		data["private_key_type"] = "ec"
+	}
+	if req.Format == "der" {
+		data["private_key"] = base64.StdEncoding.EncodeToString(block.Bytes)
+	}
+	return data, nil
+}
+
+// vaultSign issues a certificate for the request CSR
+func vaultSign(cfg *config, ca *Cert, role string, req vaultRequest) (map[string]interface{}, error) {
+	csr, err := ParseCSR([]byte(req.CSR))
+	if err != nil {
+		return nil, err
+	}
+	if csr.Subject.CommonName == "" {
+		csr.Subject.CommonName = strings.TrimSpace(req.CommonName)
+	}
+	prof, period, err := vaultRole(cfg, role, req.TTL)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ReplaceCSR(ca, csr, period, prof)
+	if err != nil {
+		return nil, err
+	}
+	return vaultCertData(c, req.Format), nil
+}
+
+// vaultRole returns the profile named after the role (none for VAULT_DEFAULT_ROLE) and the
+// validity for the requested TTL, or the profile one, or VAULT_DEFAULT_TTL
+func vaultRole(cfg *config, role string, ttl interface{}) (*Profile, Period, error) {
+	prof := cfg.getProfile(role)
+	if prof == nil && role != VAULT_DEFAULT_ROLE {
+		return nil, Period{}, fmt.Errorf("unknown role: %s", role)
+	}
+	d, err := vaultTTL(ttl)
+	if err != nil {
+		return nil, Period{}, err
+	}
+	if d > 0 {
+		return prof, ForDuration(d), nil
+	}
+	if prof != nil && prof.Duration > 0 {
+		p, err := requestPeriod(0, prof)
+		return prof, p, err
+	}
+	return prof, ForDuration(VAULT_DEFAULT_TTL), nil
+}
+
+// vaultTTL parses a Vault TTL: seconds, as a number or string, or a duration like 72h or 30d
+func vaultTTL(ttl interface{}) (time.Duration, error) {
+	switch v := ttl.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return time.Duration(v) * time.Second, nil
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return 0, nil
+		}
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second, nil
+		}
+		if strings.HasSuffix(v, "d") {
+			if days, err := strconv.Atoi(strings.TrimSuffix(v, "d")); err == nil {
+				return time.Duration(days) * 24 * time.Hour, nil
+			}
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid ttl: %v", ttl)
+}
+
+// vaultCertData returns the certificate fields of an issue or sign response
+func vaultCertData(c *Cert, format string) map[string]interface{} {
+	encode := func(crt *x509.Certificate) string {
+		return string(pemCerts(crt))
+	}
+	if format == "der" {
+		encode = func(crt *x509.Certificate) string {
+			return base64.StdEncoding.EncodeToString(crt.Raw)
+		}
+	}
+	chain := make([]string, 0)
+	for _, crt := range Chain(c) {
+		chain = append(chain, encode(crt))
+	}
+	serial := strings.ToLower(fmt.Sprintf("% X", c.Crt.SerialNumber.Bytes()))
+	return map[string]interface{}{
+		"certificate":   encode(c.Crt),
+		"issuing_ca":    encode(c.Parent.Crt),
+		"ca_chain":      chain,
+		"serial_number": strings.Replace(serial, " ", ":", -1),
+		"expiration":    c.Crt.NotAfter.Unix(),
+	}
+}
+
+// vaultFail sends the error as a Vault error response
+func vaultFail(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {err.Error()}})
+}
@@ -0,0 +1,68 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVault(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"admin": {Username: "admin"}}, Vault: &Vault{CA: "VaultCA"}}
+	token, err := cachedCfg.NewAPIToken("admin", "vault")
+	dieOnError(t, err)
+	ca, err := GenCACert(pkix.Name{CommonName: "VaultCA"}, ForDays(365))
+	dieOnError(t, err)
+	call := func(url, token, body string, status int) map[string]interface{} {
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("X-Vault-Token", token)
+		w := httptest.NewRecorder()
+		vaultAPI(w, req)
+		if w.Code != status {
+			t.Fatalf("POST %s -> %d (expected %d): %s", url, w.Code, status, w.Body)
+		}
+		var res struct{ Data map[string]interface{} }
+		dieOnError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res.Data
+	}
+	call("/v1/pki/issue/default", "", `{"common_name": "vault.example.com"}`, http.StatusForbidden)
+	call("/v1/pki/issue/nope", token, `{"common_name": "vault.example.com"}`, http.StatusBadRequest)
+	data := call("/v1/pki/issue/default", token, `{"common_name": "vault.example.com",
+		"alt_names": "vault.example.com,www.example.com", "ttl": "72h"}`, http.StatusOK)
+	b, _ := pem.Decode([]byte(data["certificate"].(string)))
+	crt, err := x509.ParseCertificate(b.Bytes)
+	dieOnError(t, err)
+	if len(crt.DNSNames) != 2 || crt.NotAfter.Sub(crt.NotBefore) > 73*time.Hour ||
+		!strings.Contains(data["private_key"].(string), "PRIVATE KEY") || data["issuing_ca"] != string(pemCerts(ca.Crt)) {
+		t.Fatalf("Unexpected issue response %v", data)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "signed.example.com"}}, key)
+	dieOnError(t, err)
+	csr, _ := json.Marshal(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})))
+	data = call("/v1/pki/sign/default", token, `{"csr": `+string(csr)+`, "ttl": 3600}`, http.StatusOK)
+	if data["private_key"] != nil || FindCert("signed.example.com") == nil {
+		t.Fatalf("Unexpected sign response %v", data)
+	}
+	dieOnError(t, RevokeCert(FindCert("vault.example.com"), 1))
+	w := httptest.NewRecorder()
+	vaultAPI(w, httptest.NewRequest("GET", "/v1/pki/crl", nil))
+	crl, err := x509.ParseRevocationList(w.Body.Bytes())
+	dieOnError(t, err)
+	if crl.CheckSignatureFrom(ca.Crt) != nil || len(crl.RevokedCertificateEntries) != 1 ||
+		crl.RevokedCertificateEntries[0].SerialNumber.Cmp(crt.SerialNumber) != 0 {
+		t.Fatal("Unexpected CRL")
+	}
+}
@@ -0,0 +1,502 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WEBAUTHN_CHALLENGE_BYTES = 32
+	WEBAUTHN_TIMEOUT         = 120000              // milliseconds the browser waits for the authenticator
+	WEBAUTHN_CHALLENGE       = "WebAuthnChallenge" // session key of the pending ceremony challenge
+	PENDINGUSER              = "PendingUser"       // session key of the user whose password was checked
+	COSE_ES256               = -7
+	COSE_EDDSA               = -8
+	COSE_RS256               = -257
+	AUTHDATA_USER_PRESENT    = 0x01
+	AUTHDATA_ATTESTED        = 0x40
+)
+
+// Passkey is a FIDO2/WebAuthn credential a user logs in with
+type Passkey struct {
+	ID        []byte
+	PublicKey []byte // PKIX DER
+	SignCount uint32
+	Name      string
+	Created   time.Time
+}
+
+// webauthnRequest is the outcome of a browser ceremony, with binary fields in base64url
+type webauthnRequest struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`     // of the new passkey
+	Username          string `json:"username"` // to log in, any discoverable passkey if empty
+	URL               string `json:"url"`      // to go after the login
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+}
+
+// authData is the parsed authenticator data
+type authData struct {
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte           // only when attested
+	PublicKey    crypto.PublicKey // only when attested
+}
+
+// passkeyCredentials returns the passkeys as WebAuthn credential descriptors
+func passkeyCredentials(passkeys []Passkey) []map[string]string {
+	creds := make([]map[string]string, 0)
+	for _, pk := range passkeys {
+		creds = append(creds, map[string]string{"type": "public-key", "id": base64.RawURLEncoding.EncodeToString(pk.ID)})
+	}
+	return creds
+}
+
+// findPasskey returns the user owning the credential and its index in their passkeys
+func (cfg *config) findPasskey(id []byte) (User, int, bool) {
+	for _, u := range cfg.Users {
+		for i, pk := range u.Passkeys {
+			if bytes.Equal(pk.ID, id) {
+				return u, i, true
+			}
+		}
+	}
+	return User{}, 0, false
+}
+
+// rpID returns the WebAuthn relying party id, the host name the browser sees
+func rpID(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+// newChallenge stores in the session a new challenge for a ceremony and returns it in base64url
+func newChallenge(s session) (string, error) {
+	challenge := make([]byte, WEBAUTHN_CHALLENGE_BYTES)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	s[WEBAUTHN_CHALLENGE] = base64.RawURLEncoding.EncodeToString(challenge)
+	s.Save()
+	return s[WEBAUTHN_CHALLENGE].(string), nil
+}
+
+// checkClientData verifies the client data of a ceremony of the given type answers the session
+// challenge, which can't be used again, from this origin
+func checkClientData(raw []byte, ceremony string, s session, r *http.Request) error {
+	challenge, _ := s[WEBAUTHN_CHALLENGE].(string)
+	delete(s, WEBAUTHN_CHALLENGE)
+	s.Save()
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return err
+	}
+	if cd.Type != ceremony || challenge == "" || cd.Challenge != challenge || cd.Origin != webOrigin(r) {
+		return fmt.Errorf("%s", tr("Wrong WebAuthn client data!"))
+	}
+	return nil
+}
+
+// parseAuthData parses the authenticator data, checking it is for the relying party and the user
+// was present, and reads the new credential if attested
+func parseAuthData(data []byte, rp string, attested bool) (*authData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%s", tr("Wrong WebAuthn authenticator data!"))
+	}
+	hash := sha256.Sum256([]byte(rp))
+	ad := &authData{Flags: data[32], SignCount: binary.BigEndian.Uint32(data[33:37])}
+	if !bytes.Equal(data[:32], hash[:]) || ad.Flags&AUTHDATA_USER_PRESENT == 0 {
+		return nil, fmt.Errorf("%s", tr("Wrong WebAuthn authenticator data!"))
+	}
+	if !attested {
+		return ad, nil
+	}
+	data = data[37:]
+	if ad.Flags&AUTHDATA_ATTESTED == 0 || len(data) < 18 {
+		return nil, fmt.Errorf("%s", tr("There is no WebAuthn credential!"))
+	}
+	n := int(binary.BigEndian.Uint16(data[16:18])) // after the AAGUID
+	if len(data) < 18+n {
+		return nil, fmt.Errorf("%s", tr("Wrong WebAuthn authenticator data!"))
+	}
+	ad.CredentialID = data[18 : 18+n]
+	key, _, err := cborDecode(data[18+n:])
+	if err != nil {
+		return nil, err
+	}
+	m, ok := key.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s", tr("Wrong COSE key!"))
+	}
+	if ad.PublicKey, err = coseKey(m); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// coseKey returns the public key of a COSE (RFC 9053) ES256, EdDSA or RS256 key
+func coseKey(m map[interface{}]interface{}) (crypto.PublicKey, error) {
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	switch {
+	case kty == 2 && alg == COSE_ES256 && crv == 1:
+		y, _ := m[int64(-3)].([]byte)
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if len(x) != 32 || len(y) != 32 || !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("%s", tr("Wrong COSE key!"))
+		}
+		return pub, nil
+	case kty == 1 && alg == COSE_EDDSA && crv == 6 && len(x) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(x), nil
+	case kty == 3 && alg == COSE_RS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		exp := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31 {
+			return nil, fmt.Errorf("%s", tr("Wrong COSE key!"))
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	}
+	return nil, fmt.Errorf("%s: kty=%d alg=%d", tr("Unsupported COSE key"), kty, alg)
+}
+
+// verifyAssertion checks the signature of the authenticator data and client data hash
+func verifyAssertion(pub crypto.PublicKey, authData, clientData, sig []byte) error {
+	hash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), hash[:]...)
+	digest := sha256.Sum256(signed)
+	ok := false
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, signed, sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return fmt.Errorf("%s", tr("Wrong WebAuthn signature!"))
+	}
+	return nil
+}
+
+// decodeFields decodes the base64url fields of a ceremony
+func decodeFields(fields ...string) ([][]byte, error) {
+	decoded := make([][]byte, 0, len(fields))
+	for _, f := range fields {
+		b, err := base64.RawURLEncoding.DecodeString(f)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("%s", tr("Wrong WebAuthn request!"))
+		}
+		decoded = append(decoded, b)
+	}
+	return decoded, nil
+}
+
+// passkeyRegisterBegin returns the options to create a passkey for the logged user
+func passkeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiFail(w, http.StatusMethodNotAllowed, fmt.Errorf("%s", tr("Method not allowed")))
+		return
+	}
+	s, err := SessionFor(w, r)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	u := requestUser(w, r)
+	if u == nil {
+		apiFail(w, http.StatusUnauthorized, fmt.Errorf("%s", tr("Authentication required!")))
+		return
+	}
+	challenge, err := newChallenge(s)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiReply(w, http.StatusOK, map[string]interface{}{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": rpID(r), "name": "WebCA"},
+		"user": map[string]string{"id": base64.RawURLEncoding.EncodeToString([]byte(u.Username)),
+			"name": u.Username, "displayName": u.Fullname},
+		"pubKeyCredParams": []map[string]interface{}{{"type": "public-key", "alg": COSE_ES256},
+			{"type": "public-key", "alg": COSE_EDDSA}, {"type": "public-key", "alg": COSE_RS256}},
+		"timeout":                WEBAUTHN_TIMEOUT,
+		"attestation":            "none",
+		"authenticatorSelection": map[string]string{"residentKey": "preferred", "userVerification": "preferred"},
+		"excludeCredentials":     passkeyCredentials(u.Passkeys),
+	})
+}
+
+// passkeyRegisterFinish stores the passkey created by the browser for the logged user
+func passkeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiFail(w, http.StatusMethodNotAllowed, fmt.Errorf("%s", tr("Method not allowed")))
+		return
+	}
+	s, err := SessionFor(w, r)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	u := requestUser(w, r)
+	if u == nil {
+		apiFail(w, http.StatusUnauthorized, fmt.Errorf("%s", tr("Authentication required!")))
+		return
+	}
+	var req webauthnRequest
+	if err := apiRead(r, &req); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	fields, err := decodeFields(req.ClientDataJSON, req.AttestationObject)
+	if err == nil {
+		err = checkClientData(fields[0], "webauthn.create", s, r)
+	}
+	var ad *authData
+	if err == nil {
+		var att interface{}
+		att, _, err = cborDecode(fields[1])
+		m, _ := att.(map[interface{}]interface{})
+		data, _ := m["authData"].([]byte)
+		if err == nil {
+			ad, err = parseAuthData(data, rpID(r), true)
+		}
+	}
+	cfg := LoadConfig()
+	if err == nil {
+		if _, _, exists := cfg.findPasskey(ad.CredentialID); exists {
+			err = fmt.Errorf("%s", tr("The passkey is already registered!"))
+		}
+	}
+	var der []byte
+	if err == nil {
+		der, err = x509.MarshalPKIXPublicKey(ad.PublicKey)
+	}
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = tr("Passkey") + " " + strconv.Itoa(len(u.Passkeys)+1)
+	}
+	err = cfg.update(func(cfg *config) error {
+		stored, ok := cfg.Users[u.Username]
+		if !ok {
+			return fmt.Errorf("%s", tr("User %s not found!", u.Username))
+		}
+		n := len(stored.Passkeys)
+		stored.Passkeys = append(stored.Passkeys[:n:n], Passkey{ID: ad.CredentialID, PublicKey: der,
+			SignCount: ad.SignCount, Name: name, Created: time.Now()})
+		users := copyUsers(cfg.Users)
+		users[u.Username] = stored
+		cfg.Users = users
+		return nil
+	})
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	audit(AUDIT_PASSKEY_ADDED, u.Username, remoteAddr(r), name)
+	apiReply(w, http.StatusCreated, map[string]string{"name": name})
+}
+
+// passkeyLoginBegin returns the options to log in with a passkey, of the user whose password was
+// checked, of the given user or any discoverable one
+func passkeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiFail(w, http.StatusMethodNotAllowed, fmt.Errorf("%s", tr("Method not allowed")))
+		return
+	}
+	s, err := SessionFor(w, r)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	var req webauthnRequest
+	if err := apiRead(r, &req); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if pending, ok := s[PENDINGUSER].(string); ok {
+		req.Username = pending
+	}
+	challenge, err := newChallenge(s)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	allowed := passkeyCredentials(nil)
+	if req.Username != "" {
+		allowed = passkeyCredentials(LoadConfig().getUser(req.Username).Passkeys)
+	}
+	apiReply(w, http.StatusOK, map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             rpID(r),
+		"timeout":          WEBAUTHN_TIMEOUT,
+		"userVerification": "preferred",
+		"allowCredentials": allowed,
+	})
+}
+
+// passkeyLoginFinish logs in the owner of the passkey if its assertion is right
+func passkeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiFail(w, http.StatusMethodNotAllowed, fmt.Errorf("%s", tr("Method not allowed")))
+		return
+	}
+	s, err := SessionFor(w, r)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	var req webauthnRequest
+	if err := apiRead(r, &req); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	addr := remoteAddr(r)
+	cfg := LoadConfig()
+	fields, err := decodeFields(req.ID, req.ClientDataJSON, req.AuthenticatorData, req.Signature)
+	if err == nil {
+		err = checkClientData(fields[1], "webauthn.get", s, r)
+	}
+	var u User
+	var i int
+	if err == nil {
+		var found bool
+		u, i, found = cfg.findPasskey(fields[0])
+		pending, isPending := s[PENDINGUSER].(string)
+		if !found || u.Disabled || isPending && pending != u.Username {
+			err = fmt.Errorf("%s", tr("Unknown passkey!"))
+		}
+	}
+	var ad *authData
+	if err == nil {
+		ad, err = parseAuthData(fields[2], rpID(r), false)
+	}
+	if err == nil {
+		var pub interface{}
+		if pub, err = x509.ParsePKIXPublicKey(u.Passkeys[i].PublicKey); err == nil {
+			err = verifyAssertion(pub, fields[2], fields[1], fields[3])
+		}
+	}
+	if err == nil && (ad.SignCount != 0 || u.Passkeys[i].SignCount != 0) && ad.SignCount <= u.Passkeys[i].SignCount {
+		err = fmt.Errorf("%s", tr("The passkey signature counter went back, it may be cloned!"))
+	}
+	if err == nil {
+		err = admitLogin(u.Username, s.Id(), addr)
+	}
+	if err != nil {
+		audit(AUDIT_LOGIN_FAILED, u.Username, addr, "passkey: "+err.Error())
+		apiFail(w, http.StatusUnauthorized, err)
+		return
+	}
+	err = cfg.update(func(cfg *config) error {
+		stored, j, found := cfg.findPasskey(fields[0])
+		if !found {
+			return fmt.Errorf("%s", tr("Unknown passkey!"))
+		}
+		stored.Passkeys = append([]Passkey(nil), stored.Passkeys...)
+		stored.Passkeys[j].SignCount = ad.SignCount
+		users := copyUsers(cfg.Users)
+		users[stored.Username] = stored
+		cfg.Users = users
+		u, i = stored, j
+		return nil
+	})
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	audit(AUDIT_LOGIN, u.Username, addr, "passkey "+u.Passkeys[i].Name)
+	remember := s[PENDINGREMEMBER] == true
+	delete(s, PENDINGUSER)
+	delete(s, PENDINGREMEMBER)
+	s[LOGGEDUSER] = u
+	if err := s.Renew(w, r); err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	if remember {
+		if err := cfg.remember(w, r, u.Username); err != nil {
+			log.Printf("(Warning) Could not remember the device of %s: %s", u.Username, err)
+		}
+	}
+	apiReply(w, http.StatusOK, map[string]string{"url": options.basePath() + localURL(req.URL)})
+}
+
+// localURL returns the target if it is a path of this server, the index otherwise, so logins
+// can't redirect elsewhere
+func localURL(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+// passkeys allows the web user to delete their passkeys and require one after the password
+func passkeys(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	if r.Method == "POST" {
+		u := requestUser(w, r)
+		deleted := ""
+		err := LoadConfig().update(func(cfg *config) error {
+			stored, ok := cfg.Users[u.Username]
+			if !ok {
+				return fmt.Errorf("%s", tr("User %s not found!", u.Username))
+			}
+			switch i, _ := strconv.Atoi(r.FormValue("index")); {
+			case r.FormValue("action") == "delete" && i >= 0 && i < len(stored.Passkeys):
+				deleted = stored.Passkeys[i].Name
+				stored.Passkeys = append(stored.Passkeys[:i:i], stored.Passkeys[i+1:]...)
+			case r.FormValue("action") == "secondFactor":
+				stored.SecondFactor = r.FormValue("SecondFactor") != ""
+			}
+			users := copyUsers(cfg.Users)
+			users[u.Username] = stored
+			cfg.Users = users
+			return nil
+		})
+		if err == nil && deleted != "" {
+			audit(AUDIT_PASSKEY_DELETED, u.Username, remoteAddr(r), deleted)
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+		}
+	}
+	showSettings(w, r, ps)
+}
@@ -0,0 +1,125 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPasskeys(t *testing.T) {
+	inTestDir(t)
+	defer func(saved bool) { fakedLogin = saved }(fakedLogin)
+	fakedLogin = false
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{Users: map[string]User{"boss": {Username: "boss", Password: "Boss-passwd"}}}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	id, err := genId()
+	dieOnError(t, err)
+	call := func(h http.HandlerFunc, url string, body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		dieOnError(t, err)
+		req := httptest.NewRequest("POST", url, bytes.NewReader(data))
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+		w := httptest.NewRecorder()
+		h(w, req)
+		id = followSession(id, w)
+		return w
+	}
+	challenge := func(w *httptest.ResponseRecorder) string {
+		var o struct{ Challenge string }
+		if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil || w.Code != http.StatusOK || o.Challenge == "" {
+			t.Fatalf("Wrong WebAuthn options: %d %s", w.Code, w.Body)
+		}
+		return o.Challenge
+	}
+	clientData := func(ceremony, challenge string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(`{"type":"` + ceremony + `","challenge":"` + challenge +
+			`","origin":"http://example.com"}`))
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	rpHash := sha256.Sum256([]byte("example.com"))
+	credID := []byte("credential-1")
+
+	current := func() session {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+		s, err := SessionFor(httptest.NewRecorder(), req)
+		dieOnError(t, err)
+		return s
+	}
+	s := current()
+	s[LOGGEDUSER] = cachedCfg.Users["boss"]
+	s.Save()
+	c := challenge(call(passkeyRegisterBegin, "/webauthn/register/begin", nil))
+	cose := append([]byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}, key.X.FillBytes(make([]byte, 32))...)
+	cose = append(append(cose, 0x22, 0x58, 0x20), key.Y.FillBytes(make([]byte, 32))...)
+	authData := append(append(rpHash[:], 0x41, 0, 0, 0, 0), make([]byte, 16)...) // no AAGUID
+	authData = append(append(append(authData, 0, byte(len(credID))), credID...), cose...)
+	att := append([]byte{0xa3, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0x67, 'a', 't', 't', 'S', 't', 'm', 't', 0xa0,
+		0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a', 0x59, 0, byte(len(authData))}, authData...)
+	w := call(passkeyRegisterFinish, "/webauthn/register/finish", webauthnRequest{Name: "key",
+		ClientDataJSON: clientData("webauthn.create", c), AttestationObject: b64(att)})
+	if w.Code != http.StatusCreated || len(cachedCfg.Users["boss"].Passkeys) != 1 {
+		t.Fatalf("Could not register a passkey: %d %s", w.Code, w.Body)
+	}
+
+	s = current()
+	delete(s, LOGGEDUSER)
+	s.Save()
+	assert := func(c string, count byte) webauthnRequest {
+		cd := clientData("webauthn.get", c)
+		raw, _ := base64.RawURLEncoding.DecodeString(cd)
+		ad := append(append([]byte{}, rpHash[:]...), 0x05, 0, 0, 0, count)
+		hash := sha256.Sum256(raw)
+		digest := sha256.Sum256(append(append([]byte{}, ad...), hash[:]...))
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		dieOnError(t, err)
+		return webauthnRequest{ID: b64(credID), URL: "/settings", ClientDataJSON: cd,
+			AuthenticatorData: b64(ad), Signature: b64(sig)}
+	}
+	c = challenge(call(passkeyLoginBegin, "/webauthn/login/begin", webauthnRequest{}))
+	assertion := assert(c, 1)
+	if w = call(passkeyLoginFinish, "/webauthn/login/finish", assertion); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "/settings") {
+		t.Fatalf("Could not log in with the passkey: %d %s", w.Code, w.Body)
+	}
+	if u, ok := current()[LOGGEDUSER].(User); !ok || u.Username != "boss" {
+		t.Fatal("The passkey did not log in")
+	}
+	if w = call(passkeyLoginFinish, "/webauthn/login/finish", assertion); w.Code != http.StatusUnauthorized {
+		t.Errorf("A passkey assertion was replayed: %d", w.Code)
+	}
+	c = challenge(call(passkeyLoginBegin, "/webauthn/login/begin", webauthnRequest{Username: "boss"}))
+	if w = call(passkeyLoginFinish, "/webauthn/login/finish", assert(c, 1)); w.Code != http.StatusUnauthorized {
+		t.Errorf("A passkey signature counter went back: %d", w.Code)
+	}
+
+	s = current()
+	delete(s, LOGGEDUSER)
+	s.Save()
+	boss := cachedCfg.Users["boss"]
+	boss.SecondFactor = true
+	cachedCfg.Users["boss"] = boss
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("Username=boss&Password=Boss-passwd"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+	w = httptest.NewRecorder()
+	login(w, req)
+	id = followSession(id, w)
+	if s = current(); w.Code != http.StatusOK || s[LOGGEDUSER] != nil || s[PENDINGUSER] != "boss" {
+		t.Fatalf("The password alone logged in: %d", w.Code)
+	}
+	c = challenge(call(passkeyLoginBegin, "/webauthn/login/begin", webauthnRequest{}))
+	if w = call(passkeyLoginFinish, "/webauthn/login/finish", assert(c, 2)); w.Code != http.StatusOK || current()[LOGGEDUSER] == nil {
+		t.Fatalf("The passkey did not confirm the password: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,205 @@
+package webca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	WEBCERT_PERIOD = 12 * time.Hour
+	WEBCERT_DAYS   = 30 // days before expiry the web certificate is renewed
+)
+
+// served is the web certificate the TLS listeners present, swapped on rotation
+var served struct {
+	sync.RWMutex
+	crt *tls.Certificate
+}
+
+// web certificate rotation lock
+var swebcert sync.Mutex
+
+func init() {
+	Subscribe(rotateRenewedWebCert)
+}
+
+// ScheduleWebCertRotation checks the web certificate in the background now and periodically
+func ScheduleWebCertRotation() {
+	go func() {
+		for {
+			if err := RotateWebCert(time.Now()); err != nil {
+				log.Printf("(Warning) Web certificate rotation failed: %s", err)
+			}
+			if err := RenewAutocert(time.Now()); err != nil {
+				log.Printf("(Warning) Web certificate renewal through ACME failed: %s", err)
+			}
+			time.Sleep(WEBCERT_PERIOD)
+		}
+	}()
+}
+
+// renewing is the web certificate being renewed by RotateWebCert, which serves the renewal itself
+var renewing struct {
+	sync.Mutex
+	name string
+}
+
+// rotateRenewedWebCert serves the web certificate as soon as it gets renewed elsewhere
+func rotateRenewedWebCert(e Event) {
+	cfg := LoadConfig()
+	if e.Type != EVENT_RENEW || cfg == nil || cfg.WebCert == nil ||
+		cfg.getWebCert().Crt.Subject.CommonName != e.Name {
+		return
+	}
+	renewing.Lock()
+	own := renewing.name == e.Name
+	renewing.Unlock()
+	if own {
+		return
+	}
+	if err := RotateWebCert(time.Now()); err != nil {
+		log.Printf("(Warning) Web certificate rotation failed: %s", err)
+	}
+}
+
+// RotateWebCert renews the web certificate when it expires within WEBCERT_DAYS (or the last third
+// of its validity) and swaps the
+// served one whenever the stored certificate changed (renewed here or by the user)
+func RotateWebCert(now time.Time) error {
+	swebcert.Lock()
+	defer swebcert.Unlock()
+	cfg := LoadConfig()
+	if cfg == nil || cfg.WebCert == nil {
+		return nil
+	}
+	name := cfg.getWebCert().Crt.Subject.CommonName
+	c := FindCert(name)
+	if c == nil {
+		return fmt.Errorf("%s", tr("Web certificate %s not found!", name))
+	}
+	margin := WEBCERT_DAYS * 24 * time.Hour
+	if third := c.Crt.NotAfter.Sub(c.Crt.NotBefore) / 3; third < margin { // short lived ones
+		margin = third
+	}
+	if c.Crt.NotAfter.Before(now.Add(margin)) {
+		if c.Key == nil {
+			return fmt.Errorf("%s", tr("There is no key for %s!", name))
+		}
+		renewing.Lock()
+		renewing.name = name
+		renewing.Unlock()
+		renewed, err := RenewCert(c, false)
+		renewing.Lock()
+		renewing.name = ""
+		renewing.Unlock()
+		if err != nil {
+			return err
+		}
+		log.Printf("Web certificate %s renewed until %s", name, renewed.Crt.NotAfter.Format(MYFMT))
+		c = renewed
+	}
+	if cfg.WebCert.Crt.SerialNumber.Cmp(c.Crt.SerialNumber) != 0 {
+		err := cfg.update(func(cfg *config) error {
+			cfg.WebCert = &Cert{Crt: c.Crt, Parent: &Cert{Crt: c.Parent.Crt}} // off the tree, without keys
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return serveWebCert(certFile(*c), keyFile(*c))
+}
+
+// webCertCandidates returns the certificates the WebCA can be served with: valid server
+// certificates with their keys
+func webCertCandidates() []*Cert {
+	now := time.Now()
+	certs := make([]*Cert, 0)
+	for _, c := range FindCerts(CertFilter{}) {
+		if c.Key != nil && !c.Crt.IsCA && c.Parent != nil && now.Before(c.Crt.NotAfter) {
+			certs = append(certs, c)
+		}
+	}
+	return certs
+}
+
+// setWebCert makes the named certificate the web certificate, once the configuration is saved and
+// the certificate served
+func (cfg *config) setWebCert(name string) (*Cert, error) {
+	c, err := FindCertOrFail(name)
+	if err != nil {
+		return nil, err
+	}
+	if c.Key == nil {
+		return nil, fmt.Errorf("%s", tr("There is no key for %s!", name))
+	}
+	if c.Crt.IsCA || c.Parent == nil || time.Now().After(c.Crt.NotAfter) {
+		return nil, fmt.Errorf("%s", tr("%s can't be the web certificate!", name))
+	}
+	if cfg.WebCert == nil || cfg.WebCert.Crt.SerialNumber.Cmp(c.Crt.SerialNumber) != 0 {
+		cfg.WebCert = &Cert{Crt: c.Crt, Parent: &Cert{Crt: c.Parent.Crt}} // off the tree, without keys
+	}
+	return c, nil
+}
+
+// serveWebCert loads the certificate and key files to present them from now on, followed by the
+// intermediate CAs, or those of the options (or got through ACME) if they override them
+func serveWebCert(certfile, keyfile string) error {
+	read := storage.Get
+	if options.CertFile != "" {
+		certfile, keyfile, read = options.CertFile, options.KeyFile, ioutil.ReadFile
+		if keyfile == "" {
+			keyfile = certfile
+		}
+	} else if options.AutocertHost != "" {
+		acmeCert, acmeKey := options.autocertFiles()
+		if _, err := os.Stat(acmeCert); err == nil { // once got
+			certfile, keyfile, read = acmeCert, acmeKey, ioutil.ReadFile
+		}
+	}
+	certPEM, err := read(certfile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := read(keyfile)
+	if err != nil {
+		return err
+	}
+	crt, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if leaf, err := x509.ParseCertificate(crt.Certificate[0]); err == nil && len(crt.Certificate) == 1 {
+		crt.Certificate = append(crt.Certificate, webChain(leaf)...)
+	}
+	served.Lock()
+	defer served.Unlock()
+	served.crt = &crt
+	return nil
+}
+
+// webCertificate returns the web certificate to present in the TLS handshakes
+func webCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	served.RLock()
+	crt := served.crt
+	served.RUnlock()
+	if crt != nil {
+		return crt, nil
+	}
+	cfg := LoadConfig()
+	if cfg == nil || cfg.WebCert == nil {
+		return nil, fmt.Errorf("%s", tr("No web certificate configured!"))
+	}
+	if err := serveWebCert(certFile(cfg.getWebCert()), keyFile(cfg.getWebCert())); err != nil {
+		return nil, err
+	}
+	served.RLock()
+	defer served.RUnlock()
+	return served.crt, nil
+}
@@ -0,0 +1,46 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestWebCertRotation(t *testing.T) {
+	inTestDir(t)
+	ca, err := GenCACert(pkix.Name{CommonName: "WebCA"}, ForDays(365))
+	dieOnError(t, err)
+	now := time.Now()
+	web, err := GenCert(ca, "webca.example.com", Period{NotBefore: now.AddDate(0, 0, -80), NotAfter: now.AddDate(0, 0, 10)})
+	dieOnError(t, err)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	cachedCfg = &config{WebCert: &Cert{Crt: web.Crt, Parent: &Cert{Crt: ca.Crt}}}
+	certree = nil
+	dieOnError(t, serveWebCert(certFile(*web), keyFile(*web)))
+	dieOnError(t, RotateWebCert(now))
+	renewed := FindCert("webca.example.com")
+	if renewed.Crt.SerialNumber.Cmp(web.Crt.SerialNumber) == 0 {
+		t.Fatalf("The web certificate was not renewed")
+	}
+	if cachedCfg.getWebCert().Crt.SerialNumber.Cmp(renewed.Crt.SerialNumber) != 0 {
+		t.Fatalf("The config still points to the old web certificate")
+	}
+	crt, err := webCertificate(nil)
+	dieOnError(t, err)
+	if !bytes.Equal(crt.Certificate[0], renewed.Crt.Raw) {
+		t.Fatalf("The renewed web certificate is not served")
+	}
+	dieOnError(t, RotateWebCert(now))
+	if FindCert("webca.example.com").Crt.SerialNumber.Cmp(renewed.Crt.SerialNumber) != 0 {
+		t.Fatalf("A valid web certificate was renewed again")
+	}
+	again, err := RenewCert(renewed, false)
+	dieOnError(t, err)
+	crt, err = webCertificate(nil)
+	dieOnError(t, err)
+	if !bytes.Equal(crt.Certificate[0], again.Crt.Raw) ||
+		cachedCfg.getWebCert().Crt.SerialNumber.Cmp(again.Crt.SerialNumber) != 0 {
+		t.Fatalf("The web certificate renewed elsewhere is not served")
+	}
+}
@@ -0,0 +1,206 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WEBHOOK_RETRIES   = 3
+	WEBHOOK_BACKOFF   = 2 * time.Second // doubled on every retry
+	WEBHOOK_TIMEOUT   = 10 * time.Second
+	WEBHOOK_EVENT     = "X-WebCA-Event"
+	WEBHOOK_SIGNATURE = "X-WebCA-Signature"
+)
+
+// Webhook is an URL receiving lifecycle events as JSON
+type Webhook struct {
+	URL    string
+	Secret string   // HMAC-SHA256 signing key, no signature if empty
+	Events []string // event types to send, all if empty
+}
+
+// webhookClient delivers the webhooks
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+// webhookBackoff is the delay before the first retry (replaceable for testing)
+var webhookBackoff = WEBHOOK_BACKOFF
+
+func init() {
+	Subscribe(fireWebhooks)
+}
+
+// fireWebhooks delivers the event in the background to all webhooks interested on it
+func fireWebhooks(e Event) {
+	cfg := LoadConfig()
+	if cfg == nil {
+		return
+	}
+	for _, wh := range cfg.Webhooks {
+		if e.Matches(wh.Events) {
+			go func(wh Webhook) {
+				if err := wh.deliver(e); err != nil {
+					log.Printf("(Warning) Webhook %s failed: %s", wh.URL, err)
+				}
+			}(wh)
+		}
+	}
+}
+
+// deliver posts the event to the webhook, retrying with backoff on failure
+func (wh Webhook) deliver(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return retry(func() error { return wh.post(e.Type, body) })
+}
+
+// retry calls f until it succeeds or fails WEBHOOK_RETRIES times more, with increasing delays
+func retry(f func() error) error {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > WEBHOOK_RETRIES {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends a single webhook request
+func (wh Webhook) post(eventType string, body []byte) error {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT, eventType)
+	if wh.Secret != "" {
+		req.Header.Set(WEBHOOK_SIGNATURE, "sha256="+sign(wh.Secret, body))
+	}
+	return send(req)
+}
+
+// send sends a webhook request, failing unless the response is successful
+func send(req *http.Request) error {
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hexadecimal HMAC-SHA256 of body with the given secret
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readWebhook reads a webhook from the request
+func readWebhook(r *http.Request) (*Webhook, error) {
+	wh := &Webhook{URL: strings.TrimSpace(r.FormValue("URL")), Secret: r.FormValue("Secret"),
+		Events: r.Form["Events"]}
+	return wh, checkURL(wh.URL)
+}
+
+// checkURL verifies the URL is a valid http or https one
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: %v", tr("Wrong URL!"), s)
+	}
+	return nil
+}
+
+// webhooks allows the web user to list, add and remove webhooks
+func webhooks(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	if r.Method == "POST" {
+		var err error
+		i, _ := strconv.Atoi(r.FormValue("index"))
+		switch r.FormValue("action") {
+		case "delete":
+			err = cfg.update(func(cfg *config) error {
+				if i >= 0 && i < len(cfg.Webhooks) {
+					cfg.Webhooks = append(cfg.Webhooks[:i:i], cfg.Webhooks[i+1:]...)
+				}
+				return nil
+			})
+		case "deleteChat":
+			err = cfg.update(func(cfg *config) error {
+				if i >= 0 && i < len(cfg.ChatHooks) {
+					cfg.ChatHooks = append(cfg.ChatHooks[:i:i], cfg.ChatHooks[i+1:]...)
+				}
+				return nil
+			})
+		case "deleteDeploy":
+			err = cfg.update(func(cfg *config) error {
+				if i >= 0 && i < len(cfg.DeployHooks) {
+					cfg.DeployHooks = append(cfg.DeployHooks[:i:i], cfg.DeployHooks[i+1:]...)
+				}
+				return nil
+			})
+		case "addDeploy":
+			var dh *DeployHook
+			if dh, err = readDeployHook(r); err == nil {
+				err = cfg.update(func(cfg *config) error {
+					n := len(cfg.DeployHooks)
+					cfg.DeployHooks = append(cfg.DeployHooks[:n:n], *dh)
+					return nil
+				})
+			}
+		case "addChat":
+			var ch *ChatHook
+			if ch, err = readChatHook(r); err == nil {
+				err = cfg.update(func(cfg *config) error {
+					n := len(cfg.ChatHooks)
+					cfg.ChatHooks = append(cfg.ChatHooks[:n:n], *ch)
+					return nil
+				})
+			}
+		default:
+			var wh *Webhook
+			if wh, err = readWebhook(r); err == nil {
+				err = cfg.update(func(cfg *config) error {
+					n := len(cfg.Webhooks)
+					cfg.Webhooks = append(cfg.Webhooks[:n:n], *wh)
+					return nil
+				})
+			}
+		}
+		if err == nil {
+			auditRequest(w, r, AUDIT_CONFIG, strings.TrimSpace("webhooks "+r.FormValue("action")))
+			http.Redirect(w, r, "/webhooks", 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	ps["Webhooks"] = cfg.Webhooks
+	ps["ChatHooks"] = cfg.ChatHooks
+	ps["DeployHooks"] = cfg.DeployHooks
+	ps["EventTypes"] = EventTypes
+	ps["ChatEventTypes"] = append([]string{EVENT_EXPIRY, EVENT_RENEW_FAILED}, EventTypes...)
+	err := templatesFor(r).ExecuteTemplate(w, "webhooks", ps)
+	handleError(w, r, err)
+}
@@ -0,0 +1,40 @@
+package webca
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	defer func(saved time.Duration) { webhookBackoff = saved }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	attempts := 0
+	var received Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(WEBHOOK_SIGNATURE) != "sha256="+sign("s3cr3t", body) {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer srv.Close()
+	e := Event{Type: EVENT_ISSUE, Name: "hook.example.com", Serial: "01"}
+	dieOnError(t, Webhook{URL: srv.URL, Secret: "s3cr3t"}.deliver(e))
+	if attempts != 2 || received.Name != e.Name || received.Type != e.Type {
+		t.Fatalf("Unexpected delivery after %d attempts: %+v", attempts, received)
+	}
+	attempts = -10 // keeps failing
+	if err := (Webhook{URL: srv.URL}).deliver(e); err == nil || attempts != -10+WEBHOOK_RETRIES+1 {
+		t.Fatalf("Expected %d failed attempts but got %d (%v)", WEBHOOK_RETRIES+1, attempts+10, err)
+	}
+}
@@ -0,0 +1,106 @@
+package webca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// TLS versions the web listener may require at least
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// tlsCurves are the key exchanges the web listener may prefer
+var tlsCurves = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// WebTLS hardens the HTTPS web listener, the Go defaults applying to what is not set
+type WebTLS struct {
+	MinVersion   string   // "1.2" or "1.3"
+	CipherSuites []string // TLS 1.2 cipher suites by name, TLS 1.3 ones can't be chosen
+	Curves       []string // key exchanges by name, in order of preference
+}
+
+// cipherSuite returns the ID of the secure cipher suite with the name
+func cipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if strings.EqualFold(cs.Name, name) {
+			return cs.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: %s", tr("Unknown or insecure cipher suite!"), name)
+}
+
+// curve returns the ID of the key exchange with the name
+func curve(name string) (tls.CurveID, error) {
+	for _, c := range tlsCurves {
+		if strings.EqualFold(c.String(), name) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: %s", tr("Unknown curve!"), name)
+}
+
+// apply sets the version, cipher suites and curves of the settings in c
+func (wt *WebTLS) apply(c *tls.Config) error {
+	if wt == nil {
+		return nil
+	}
+	if wt.MinVersion != "" {
+		v, ok := tlsVersions[wt.MinVersion]
+		if !ok {
+			return fmt.Errorf("%s: %s", tr("Wrong TLS version!"), wt.MinVersion)
+		}
+		c.MinVersion = v
+	}
+	for _, name := range wt.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return err
+		}
+		c.CipherSuites = append(c.CipherSuites, id)
+	}
+	for _, name := range wt.Curves {
+		id, err := curve(name)
+		if err != nil {
+			return err
+		}
+		c.CurvePreferences = append(c.CurvePreferences, id)
+	}
+	return nil
+}
+
+// webTLSConfig applies the TLS settings and asks the browsers for a certificate of the client CA,
+// when certificate logins are enabled, so the settings apply to the new connections without a
+// restart
+func webTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.TLS == nil && cfg.ClientCerts == nil {
+		return nil, nil
+	}
+	c := &tls.Config{GetCertificate: webCertificate}
+	if err := cfg.TLS.apply(c); err != nil {
+		return nil, err
+	}
+	if cfg.ClientCerts != nil {
+		if ca := FindCert(cfg.ClientCerts.CA); ca != nil {
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.Crt)
+			c.ClientAuth, c.ClientCAs = tls.VerifyClientCertIfGiven, pool
+		}
+	}
+	return c, nil
+}
+
+// webChain returns the intermediate CA certificates served after the web certificate, so the
+// clients that only trust the root can verify it
+func webChain(crt *x509.Certificate) [][]byte {
+	c := FindCert(crt.Subject.CommonName)
+	if c == nil || !c.Crt.Equal(crt) {
+		return nil
+	}
+	chain := [][]byte{}
+	for p := c.Parent; p != nil && p.Parent != nil && p.Parent != p; p = p.Parent { // up to the root
+		chain = append(chain, p.Crt.Raw)
+	}
+	return chain
+}
@@ -0,0 +1,66 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWebTLS(t *testing.T) {
+	inTestDir(t)
+	defer func(saved *Certree) { certree = saved }(certree)
+	defer func(saved *config) { cachedCfg = saved }(cachedCfg)
+	defer func(saved *tls.Certificate) { served.crt = saved }(served.crt)
+
+	post := func(form url.Values) *http.Request {
+		r := httptest.NewRequest("POST", "/settings", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	cfg := &config{}
+	form := url.Values{"TLSMinVersion": {"1.3"}, "TLSCipherSuites": {"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, "},
+		"TLSCurves": {"X25519, CurveP256"}}
+	dieOnError(t, readWebTLS(cfg, post(form)))
+	if cfg.TLS == nil || cfg.TLS.MinVersion != "1.3" || len(cfg.TLS.CipherSuites) != 1 || len(cfg.TLS.Curves) != 2 {
+		t.Fatalf("Wrong TLS settings: %+v", cfg.TLS)
+	}
+	cachedCfg = cfg
+	c, err := webTLSConfig(nil)
+	dieOnError(t, err)
+	if c.MinVersion != tls.VersionTLS13 || c.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+		c.CurvePreferences[0] != tls.X25519 || c.CurvePreferences[1] != tls.CurveP256 || c.ClientAuth != tls.NoClientCert {
+		t.Errorf("Wrong TLS config: %+v", c)
+	}
+	for name, wrong := range map[string]string{"TLSMinVersion": "1.0", "TLSCipherSuites": "TLS_RSA_WITH_RC4_128_SHA",
+		"TLSCurves": "Curve25519x"} {
+		if err := readWebTLS(&config{}, post(url.Values{name: {wrong}})); err == nil {
+			t.Errorf("Wrong %s %s was accepted", name, wrong)
+		}
+	}
+	dieOnError(t, readWebTLS(cfg, post(url.Values{})))
+	if cfg.TLS != nil {
+		t.Error("The Go defaults are not used without settings")
+	}
+
+	certree = nil
+	root, err := GenCACert(pkix.Name{CommonName: "ChainRoot"}, ForDays(365))
+	dieOnError(t, err)
+	p := ForDays(180)
+	inter, err := genCert(root, &x509.Certificate{Subject: pkix.Name{CommonName: "ChainIntermediate"},
+		NotBefore: p.NotBefore, NotAfter: p.NotAfter, BasicConstraintsValid: true, IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign}, nil)
+	dieOnError(t, err)
+	web, err := GenCert(inter, "chain.example.com", ForDays(30))
+	dieOnError(t, err)
+	certree = nil
+	dieOnError(t, serveWebCert(certFile(*web), keyFile(*web)))
+	if len(served.crt.Certificate) != 2 || !bytes.Equal(served.crt.Certificate[1], inter.Crt.Raw) {
+		t.Errorf("The intermediate CA is not served with the web certificate: %d", len(served.crt.Certificate))
+	}
+}